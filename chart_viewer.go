@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/wcharczuk/go-chart/v2"
@@ -19,10 +33,152 @@ import (
 
 const (
 	WINDOW_SIZE     = 1000
+	WINDOW_STEP     = 50 // 每次移动50个点，加快滚动速度
 	UPDATE_INTERVAL = 2 * time.Second
 	WEB_PORT        = ":8080"
+
+	// 预取缓存最多保留的窗口数量
+	PREFETCH_CACHE_SIZE = 4
+)
+
+// 通过 -last 参数指定的相对时间范围，0 表示加载全部历史
+var lastRange time.Duration
+
+// 通过 -series 选择绘制的价格序列：price 为最新价，mid 为买一卖一中间价，spread 为以最小变动价位计的买卖价差
+var priceSeries = "price"
+
+// 通过 -tick-size 指定的最小变动价位，0 表示按品种自动查表
+var tickSizeOverride float64
+
+// 价位线文件，与Web查看器的 -levels-file 相同：{"jm2509": [{"id": "...", "price": 1012.5, "label": "前高"}]}
+var levelsPath = "levels.json"
+
+// 价位线（支撑/压力位），在Web查看器上添加
+type priceLevel struct {
+	Price float64 `json:"price"`
+	Label string  `json:"label"`
+}
+
+// 读取合约的价位线；文件不存在时没有价位线
+func loadLevels(path, symbol string) ([]priceLevel, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read levels: %w", err)
+	}
+	var all map[string][]priceLevel
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse levels %s: %w", path, err)
+	}
+	return all[strings.ToLower(symbol)], nil
+}
+
+// Web服务监听地址，host:port 或 unix:/path.sock
+var listenAddr = WEB_PORT
+
+// 监听端口被占用时是否改用其他端口，以及启动后是否打开浏览器
+var (
+	portFallback = true
+	openOnStart  bool
 )
 
+// 单次ClickHouse查询的超时时间，超时后取消请求，避免慢查询堆积goroutine
+var queryTimeout time.Duration
+
+// 常见期货品种的最小变动价位，未列出的品种视为未知，价格不按tick舍入
+var productTickSizes = map[string]float64{
+	"a": 1, "ag": 1, "al": 5, "ap": 1, "au": 0.02, "bu": 1, "c": 1, "cf": 5, "cu": 10,
+	"eb": 1, "eg": 1, "fg": 1, "fu": 1, "hc": 1, "i": 0.5, "j": 0.5, "jm": 0.5, "l": 1,
+	"lc": 50, "lh": 5, "m": 1, "ma": 1, "ni": 10, "oi": 1, "p": 2, "pg": 1, "pp": 1,
+	"rb": 1, "rm": 1, "ru": 5, "sa": 1, "sc": 0.1, "sf": 2, "si": 5, "sm": 2, "sp": 2,
+	"sr": 1, "ss": 5, "ta": 2, "ur": 1, "v": 1, "y": 2, "zn": 5,
+}
+
+func validateSeries(series string) error {
+	switch series {
+	case "price", "mid", "spread":
+		return nil
+	}
+	return fmt.Errorf("unknown series %q (price, mid or spread)", series)
+}
+
+func tickSizeFor(symbol string) float64 {
+	if tickSizeOverride > 0 {
+		return tickSizeOverride
+	}
+	if size, ok := productTickSizes[strings.ToLower(strings.TrimRight(symbol, "0123456789"))]; ok {
+		return size
+	}
+	return 0
+}
+
+// 按 -series 取一条记录的绘图值；没有有效买一/卖一报价时中间价退回最新价，价差记为0。
+// 价格先换算成tick数再计算，价差是精确的整数，中间价不会带上float32的舍入误差。
+// 最小变动价位未知时直接用原始价格计算，价差的单位是价格而不是tick
+func seriesValue(record MarketData) float64 {
+	tick := tickSizeFor(record.Symbol)
+	quoted := record.Bid1 > 0 && record.Ask1 > 0
+	switch {
+	case priceSeries == "mid" && quoted && tick <= 0:
+		return rawPrice(float32((rawPrice(record.Bid1) + rawPrice(record.Ask1)) / 2))
+	case priceSeries == "mid" && quoted:
+		return ticksToPrice(priceToTicks(record.Bid1, tick)+priceToTicks(record.Ask1, tick), tick/2)
+	case priceSeries == "spread" && quoted && tick <= 0:
+		return rawPrice(float32(rawPrice(record.Ask1) - rawPrice(record.Bid1)))
+	case priceSeries == "spread" && quoted:
+		return float64(priceToTicks(record.Ask1, tick) - priceToTicks(record.Bid1, tick))
+	case priceSeries == "spread":
+		return 0
+	}
+	return priceValue(record.Price, tick)
+}
+
+// float32价格经tick数换算得到的精确十进制价格；最小变动价位未知时不舍入，取原始价格
+func priceValue(price float32, tick float64) float64 {
+	if tick <= 0 {
+		return rawPrice(price)
+	}
+	return ticksToPrice(priceToTicks(price, tick), tick)
+}
+
+// float32价格的最短十进制表示，例如 3801.2 而不是 3801.199951171875
+func rawPrice(price float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(price), 'g', -1, 32), 64)
+	return v
+}
+
+// 价格在内部按最小变动价位的整数倍（tick数）计算，只在输出时换算回价格，避免float32舍入误差在价差和指标中累积
+func priceToTicks(price float32, tick float64) int64 {
+	return int64(math.Round(float64(price) / tick))
+}
+
+// tick数换算回价格，并舍入到最小变动价位的小数位数（例如 0.1 的3倍为 0.3 而不是 0.30000000000000004）
+func ticksToPrice(ticks int64, tick float64) float64 {
+	scale := math.Pow10(tickDecimals(tick))
+	return math.Round(float64(ticks)*tick*scale) / scale
+}
+
+// 最小变动价位的小数位数，例如 0.5 为1位、0.02 为2位、1 为0位
+func tickDecimals(tick float64) int {
+	text := strconv.FormatFloat(tick, 'f', -1, 64)
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		return len(text) - i - 1
+	}
+	return 0
+}
+
+func seriesLabel() string {
+	switch priceSeries {
+	case "mid":
+		return "Mid Price"
+	case "spread":
+		return "Spread (ticks)"
+	}
+	return "Price"
+}
+
 type MarketData struct {
 	Symbol       string    `json:"symbol"`
 	Time         time.Time `json:"time"`
@@ -39,40 +195,94 @@ type MarketData struct {
 }
 
 var (
-	allData     []MarketData
-	currentData []MarketData
-	dataMutex   sync.RWMutex
-	windowStart int
+	currentData  []MarketData
+	dataMutex    sync.RWMutex
+	windowStart  int
+	totalRecords int
+
+	// 启动或重试加载失败时的错误信息，页面据此显示错误横幅，加载成功后清空
+	loadError string
+	// 页面点击重试时唤醒数据更新协程，立即重新加载
+	retryLoad = make(chan struct{}, 1)
+
+	// 查询的数据源表，启动时确定一次（宽时间范围可能是分钟线表）
+	dataSource string
+	windows    = newWindowCache()
 )
 
 func main() {
-	fmt.Println("Connecting to ClickHouse...")
+	last := flag.String("last", "all", "只加载最近一段时间的数据，例如 30m、2h、1d、5d 或 all")
+	flag.StringVar(&priceSeries, "series", "price", "绘制的价格序列: price(最新价)、mid(买一卖一中间价) 或 spread(买卖价差，单位为最小变动价位)")
+	flag.Float64Var(&tickSizeOverride, "tick-size", 0, "计算价差使用的最小变动价位，0 表示按品种自动识别")
+	proxy := flag.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	flag.StringVar(&listenAddr, "listen", WEB_PORT, "Web服务监听地址: host:port（如 127.0.0.1:8080 只允许本机访问）或 unix:/path/to.sock")
+	flag.BoolVar(&portFallback, "port-fallback", true, "端口被占用时依次尝试后面的端口，都被占用时使用系统分配的空闲端口；false 时直接退出")
+	flag.BoolVar(&openOnStart, "open", false, "启动后用默认浏览器打开页面")
+	flag.DurationVar(&queryTimeout, "query-timeout", 60*time.Second, "单次ClickHouse查询的超时时间，0 表示不限制")
+	flag.StringVar(&marketSource, "source", SOURCE_CLICKHOUSE, "行情数据来源: clickhouse 或 demo（本地生成的模拟行情，不需要ClickHouse）")
+	flag.StringVar(&levelsPath, "levels-file", levelsPath, "价位线文件，与Web查看器的 -levels-file 相同，落在窗口价格范围内的价位线画在图表上")
+	logFile := flag.String("log-file", "", "日志文件，指定后日志和控制台输出都写入该文件并按大小轮转，为空时输出到终端")
+	flag.Int64Var(&logMaxSize, "log-max-size", 50<<20, "日志文件超过该字节数时轮转")
+	flag.IntVar(&logBackups, "log-backups", 5, "日志轮转后保留的旧文件个数")
+	daemon := flag.Bool("daemon", false, "在后台运行：以相同参数启动子进程后立即返回，需同时指定 -log-file")
+	flag.Parse()
+
+	if *daemon {
+		if *logFile == "" {
+			log.Fatal("-daemon requires -log-file")
+		}
+		// 先在前台确认日志文件可写，子进程启动后就看不到错误了
+		if l, err := newRotatingLog(*logFile, logMaxSize, logBackups); err != nil {
+			log.Fatal(err)
+		} else {
+			l.file.Close()
+		}
+		if err := daemonize(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if os.Getenv(DAEMON_CHILD_ENV) != "" {
+		signal.Ignore(syscall.SIGHUP)
+	}
+	if *logFile != "" {
+		if err := setupLogFile(*logFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// 测试连接
-	if err := testConnection(); err != nil {
-		log.Fatal("Failed to connect to ClickHouse:", err)
+	if marketSource != SOURCE_CLICKHOUSE && marketSource != SOURCE_DEMO {
+		log.Fatalf("invalid -source %q: expected clickhouse or demo", marketSource)
 	}
 
-	fmt.Println("Successfully connected to ClickHouse!")
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
 
-	// 查询数据
-	data, err := queryMarketData()
-	if err != nil {
-		log.Fatal("Failed to query data:", err)
+	if err := validateSeries(priceSeries); err != nil {
+		log.Fatal(err)
 	}
 
-	if len(data) == 0 {
-		log.Fatal("No data found in the table")
+	var err error
+	lastRange, err = parseRelativeRange(*last)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	fmt.Printf("Found %d records\n", len(data))
+	if marketSource == SOURCE_DEMO {
+		fmt.Println("Using simulated demo data, ClickHouse is not required")
+	} else {
+		fmt.Println("Connecting to ClickHouse...")
+	}
 
-	// 初始化全局数据
-	allData = data
-	windowStart = 0
+	// 加载失败不退出进程：页面显示错误横幅，数据更新协程定期重试
+	if err := loadDataset(); err != nil {
+		log.Printf("Failed to load data, will keep retrying: %v", err)
+		setLoadError(err)
+	}
 
-	// 启动数据更新协程
-	go updateDataLoop()
+	// 启动数据更新协程，崩溃后自动重启，窗口位置保存在全局变量中，重启后从原位置继续
+	supervise("update loop", updateDataLoop)
 
 	// 启动Web服务器
 	startWebServer()
@@ -84,6 +294,34 @@ func testConnection() error {
 	return err
 }
 
+// 所有ClickHouse查询共用的HTTP客户端，代理由 -proxy 参数或 HTTP_PROXY/HTTPS_PROXY 环境变量决定
+var httpClient = http.DefaultClient
+
+// 按 -proxy 参数构建共享的HTTP客户端；参数为空时沿用 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 环境变量
+func setupHTTPClient(proxy string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q (expected e.g. http://proxy.example.com:3128)", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// ClickHouse字符串字面量：转义反斜杠和单引号。只把单引号写成两个单引号不够，以反斜杠结尾的symbol会转义掉闭合的引号
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
 func executeQuery(query string) (string, error) {
 	// 构建请求URL
 	baseURL := "http://xm.local:8123"
@@ -91,10 +329,23 @@ func executeQuery(query string) (string, error) {
 	params.Add("database", "feature")
 	params.Add("query", query)
 
+	ctx := context.Background()
+	if queryTimeout > 0 {
+		// 同时让ClickHouse在服务端按相同时限中止查询，不在客户端断开后继续占用资源
+		params.Add("max_execution_time", strconv.Itoa(int(math.Ceil(queryTimeout.Seconds()))))
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
 	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
 
 	// 发送HTTP请求
-	resp, err := http.Get(fullURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("HTTP request failed: %w", err)
 	}
@@ -113,8 +364,36 @@ func executeQuery(query string) (string, error) {
 	return string(body), nil
 }
 
-func queryMarketData() ([]MarketData, error) {
-	query := `
+func countMarketData() (int, error) {
+	if marketSource == SOURCE_DEMO {
+		return len(demoMarketData("jm2509")), nil
+	}
+
+	query := fmt.Sprintf("SELECT count() FROM feature.%s WHERE symbol = 'jm2509'%s",
+		dataSource, timeRangePredicate("jm", "jm2509", lastRange))
+
+	result, err := executeQuery(query)
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %w", err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(result))
+}
+
+// 按偏移量分页查询一个窗口的数据
+func queryMarketDataWindow(offset, limit int) ([]MarketData, error) {
+	if marketSource == SOURCE_DEMO {
+		data := demoMarketData("jm2509")
+		if offset >= len(data) {
+			return nil, nil
+		}
+		if offset+limit < len(data) {
+			data = data[:offset+limit]
+		}
+		return data[offset:], nil
+	}
+
+	query := fmt.Sprintf(`
 		SELECT 
 			symbol, 
 			time, 
@@ -128,11 +407,12 @@ func queryMarketData() ([]MarketData, error) {
 			ask_1, 
 			ask_volumn_1, 
 			datetime
-		FROM feature.jm 
-		WHERE symbol = 'jm2509'
-		ORDER BY time ASC 
+		FROM feature.%s 
+		WHERE symbol = 'jm2509'%s
+		ORDER BY time ASC, datetime ASC
+		LIMIT %d OFFSET %d
 		FORMAT TabSeparated
-	`
+	`, dataSource, timeRangePredicate("jm", "jm2509", lastRange), limit, offset)
 
 	result, err := executeQuery(query)
 	if err != nil {
@@ -142,6 +422,269 @@ func queryMarketData() ([]MarketData, error) {
 	return parseTabSeparatedData(result)
 }
 
+// 行情数据来源：clickhouse 查询 xm.local 上的ClickHouse，demo 在本地生成模拟行情，新用户和CI环境不需要数据库
+const (
+	SOURCE_CLICKHOUSE = "clickhouse"
+	SOURCE_DEMO       = "demo"
+)
+
+var marketSource = SOURCE_CLICKHOUSE
+
+// 演示行情从启动前两天的零点开始每2秒一笔，一直生成到当前时间
+const (
+	DEMO_TICK_INTERVAL = 2 * time.Second
+	DEMO_HISTORY_DAYS  = 2
+)
+
+var demoStart = func() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -DEMO_HISTORY_DAYS)
+}()
+
+// 生成 [from, to) 内的模拟tick：价格按最小变动价位随机游走，偶尔放量，持仓随成交量增减，盘口为一到两个tick的价差。
+// 随机数种子由合约代码决定，同一合约每次生成相同的序列
+func demoTicks(symbol string, from, to time.Time) []MarketData {
+	h := fnv.New64a()
+	h.Write([]byte(symbol))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	tick := tickSizeFor(symbol)
+	if tick <= 0 {
+		tick = 1 // 模拟行情需要价格网格，最小变动价位未知的品种按1生成
+	}
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	last := int64(2000 + rng.Intn(6000)) // 价格，单位为最小变动价位
+	vol, oi := uint32(0), int64(80000+rng.Intn(120000))
+	var data []MarketData
+	for t := demoStart; t.Before(to); t = t.Add(DEMO_TICK_INTERVAL) {
+		last += int64(math.Round(rng.NormFloat64() * 0.8))
+		diffVol := int32(1 + rng.Intn(12))
+		if rng.Intn(50) == 0 {
+			diffVol *= int32(5 + rng.Intn(10))
+		}
+		diffOI := int32(math.Round(rng.NormFloat64() * float64(diffVol) * 0.4))
+		if oi+int64(diffOI) < 0 {
+			diffOI = int32(-oi)
+		}
+		vol += uint32(diffVol)
+		oi += int64(diffOI)
+
+		spread := int64(1)
+		if rng.Intn(10) == 0 {
+			spread = 2
+		}
+		bid, ask := last, last+spread
+		if rng.Intn(2) == 0 {
+			bid, ask = last-spread, last
+		}
+		bidVolumn, askVolumn := uint32(1+rng.Intn(200)), uint32(1+rng.Intn(200))
+
+		// 随机数在过滤之前取完，保证不同时间范围得到的是同一条序列
+		if t.Before(from) {
+			continue
+		}
+		data = append(data, MarketData{
+			Symbol:       symbol,
+			Time:         t,
+			Price:        float32(ticksToPrice(last, tick)),
+			Vol:          vol,
+			OpenInterest: uint32(oi),
+			DiffVol:      diffVol,
+			DiffOI:       diffOI,
+			Bid1:         float32(ticksToPrice(bid, tick)),
+			BidVolumn1:   bidVolumn,
+			Ask1:         float32(ticksToPrice(ask, tick)),
+			AskVolumn1:   askVolumn,
+			DateTime:     uint64(t.UnixMilli()),
+		})
+	}
+	return data
+}
+
+// 演示模式下按 -last 截取最近一段时间的数据
+func demoMarketData(symbol string) []MarketData {
+	var from time.Time
+	if lastRange > 0 {
+		from = time.Now().Add(-lastRange)
+	}
+	return demoTicks(symbol, from, time.Now())
+}
+
+// 查询所需的列及其兼容的ClickHouse类型族
+var expectedColumns = []struct {
+	name     string
+	families []string
+}{
+	{"symbol", []string{"String", "FixedString"}},
+	{"time", []string{"DateTime"}},
+	{"price", []string{"Float", "Decimal"}},
+	{"vol", []string{"UInt", "Int"}},
+	{"open_interest", []string{"UInt", "Int"}},
+	{"diff_vol", []string{"Int", "UInt"}},
+	{"diff_oi", []string{"Int", "UInt"}},
+	{"bid_1", []string{"Float", "Decimal"}},
+	{"bid_volumn_1", []string{"UInt", "Int"}},
+	{"ask_1", []string{"Float", "Decimal"}},
+	{"ask_volumn_1", []string{"UInt", "Int"}},
+	{"datetime", []string{"UInt", "Int"}},
+}
+
+// 通过 DESCRIBE 检查表结构，缺少列或类型不兼容时返回列出具体列名的错误，
+// 避免解析时静默跳过所有行后只报 "No data found"
+func validateSchema(table string) error {
+	result, err := executeQuery(fmt.Sprintf("DESCRIBE TABLE feature.%s FORMAT TabSeparated", table))
+	if err != nil {
+		return fmt.Errorf("failed to describe table feature.%s: %w", table, err)
+	}
+
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			types[fields[0]] = fields[1]
+		}
+	}
+
+	var missing, mismatched []string
+	for _, col := range expectedColumns {
+		typ, ok := types[col.name]
+		if !ok {
+			missing = append(missing, col.name)
+			continue
+		}
+
+		// 去掉 Nullable(...) / LowCardinality(...) 包装后比较类型族
+		base := typ
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			for strings.HasPrefix(base, wrapper) {
+				base = strings.TrimSuffix(strings.TrimPrefix(base, wrapper), ")")
+			}
+		}
+		compatible := false
+		for _, family := range col.families {
+			if strings.HasPrefix(base, family) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s (expected %s)", col.name, typ, strings.Join(col.families, "/")))
+		}
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		problems = append(problems, "incompatible types: "+strings.Join(mismatched, "; "))
+	}
+	return fmt.Errorf("table feature.%s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+}
+
+// 解析相对时间范围，支持 s/m/h/d/w 单位，如 30m、2h、1d、5d；空字符串或 all 表示全部历史
+func parseRelativeRange(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" || spec == "all" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	unit, ok := units[spec[len(spec)-1]]
+	n, err := strconv.Atoi(spec[:len(spec)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q: expected forms like 30m, 2h, 1d, 5d or all", spec)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// 将相对时间范围转换为ClickHouse时间条件，以该symbol的最新数据时间为基准，
+// 这样对已停止交易的合约也能得到有意义的结果
+func timeRangePredicate(table, symbol string, d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" AND time >= (SELECT max(time) FROM feature.%s WHERE symbol = %s) - INTERVAL %d SECOND",
+		table, quoteString(symbol), int64(d/time.Second))
+}
+
+// 宽时间范围（超过1天或全部历史）优先读取 market_cli.go bars build 生成的分钟线表
+const BAR_TABLE_MIN_RANGE = 24 * time.Hour
+
+// 返回查询应使用的数据源，分钟线表不存在时回退到原始tick表
+func preferBarTable(table string, span time.Duration) string {
+	if span > 0 && span <= BAR_TABLE_MIN_RANGE {
+		return table
+	}
+
+	barTable := table + "_bars_1m"
+	result, err := executeQuery("EXISTS TABLE feature." + barTable)
+	if err != nil || strings.TrimSpace(result) != "1" {
+		return table
+	}
+
+	fmt.Printf("Using minute bar table feature.%s for a wide time range\n", barTable)
+	return barTable + " FINAL"
+}
+
+// 解析时被跳过的行按错误类型分类
+const (
+	PARSE_ERROR_SHORT_ROW     = "short_row"
+	PARSE_ERROR_TIME          = "bad_time"
+	PARSE_ERROR_PRICE         = "bad_price"
+	PARSE_ERROR_VOL           = "bad_vol"
+	PARSE_ERROR_OPEN_INTEREST = "bad_open_interest"
+)
+
+// 启动以来解析时跳过的行数，按错误类型计数，页面上显示汇总
+var (
+	parseErrors      = make(map[string]int)
+	parseErrorsMutex sync.Mutex
+)
+
+// 记录一行被跳过的原因，同时写日志
+func recordParseError(kind string, err error) {
+	log.Printf("Skipping row (%s): %v", kind, err)
+	parseErrorsMutex.Lock()
+	parseErrors[kind]++
+	parseErrorsMutex.Unlock()
+}
+
+// 跳过的总行数和按次数从多到少排列的明细，例如 "bad_price 2, short_row 1"
+func parseErrorSummary() (int, string) {
+	parseErrorsMutex.Lock()
+	defer parseErrorsMutex.Unlock()
+	kinds := make([]string, 0, len(parseErrors))
+	total := 0
+	for kind, count := range parseErrors {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if parseErrors[kinds[i]] != parseErrors[kinds[j]] {
+			return parseErrors[kinds[i]] > parseErrors[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s %d", kind, parseErrors[kind])
+	}
+	return total, strings.Join(parts, ", ")
+}
+
 func parseTabSeparatedData(data string) ([]MarketData, error) {
 	lines := strings.Split(strings.TrimSpace(data), "\n")
 	var marketData []MarketData
@@ -153,6 +696,7 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 
 		fields := strings.Split(line, "\t")
 		if len(fields) < 12 {
+			recordParseError(PARSE_ERROR_SHORT_ROW, fmt.Errorf("expected 12 fields, got %d", len(fields)))
 			continue
 		}
 
@@ -160,28 +704,28 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 		timeStr := fields[1]
 		parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
 		if err != nil {
-			log.Printf("Failed to parse time %s: %v", timeStr, err)
+			recordParseError(PARSE_ERROR_TIME, err)
 			continue
 		}
 
 		// 解析价格
 		price, err := strconv.ParseFloat(fields[2], 32)
 		if err != nil {
-			log.Printf("Failed to parse price %s: %v", fields[2], err)
+			recordParseError(PARSE_ERROR_PRICE, err)
 			continue
 		}
 
 		// 解析成交量
 		vol, err := strconv.ParseUint(fields[3], 10, 32)
 		if err != nil {
-			log.Printf("Failed to parse vol %s: %v", fields[3], err)
+			recordParseError(PARSE_ERROR_VOL, err)
 			continue
 		}
 
 		// 解析持仓量
 		openInterest, err := strconv.ParseUint(fields[4], 10, 32)
 		if err != nil {
-			log.Printf("Failed to parse open_interest %s: %v", fields[4], err)
+			recordParseError(PARSE_ERROR_OPEN_INTEREST, err)
 			continue
 		}
 
@@ -215,28 +759,158 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 	return marketData, nil
 }
 
+// 预取缓存中的一个窗口，ready 关闭后 data/err 可读
+type windowEntry struct {
+	ready chan struct{}
+	data  []MarketData
+	err   error
+}
+
+// 按窗口序号缓存分页数据，当前窗口显示时在后台预取下一个窗口，避免滚动时卡顿
+type windowCache struct {
+	mu      sync.Mutex
+	entries map[int]*windowEntry
+}
+
+func newWindowCache() *windowCache {
+	return &windowCache{entries: map[int]*windowEntry{}}
+}
+
+// 启动指定窗口的加载（已在缓存中则直接返回）
+func (c *windowCache) load(index int) *windowEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[index]; ok {
+		return entry
+	}
+
+	entry := &windowEntry{ready: make(chan struct{})}
+	c.entries[index] = entry
+	go func() {
+		entry.data, entry.err = queryMarketDataWindow(index*WINDOW_STEP, WINDOW_SIZE)
+		close(entry.ready)
+	}()
+	return entry
+}
+
+// 获取窗口数据，如果预取尚未完成则等待
+func (c *windowCache) get(index int) ([]MarketData, error) {
+	entry := c.load(index)
+	<-entry.ready
+
+	if entry.err != nil {
+		c.mu.Lock()
+		delete(c.entries, index)
+		c.mu.Unlock()
+	}
+	return entry.data, entry.err
+}
+
+// 后台预取
+func (c *windowCache) prefetch(index int) {
+	c.load(index)
+}
+
+// 丢弃当前窗口之前以及超出预取范围的缓存
+func (c *windowCache) evict(current int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index := range c.entries {
+		if index < current || index >= current+PREFETCH_CACHE_SIZE {
+			delete(c.entries, index)
+		}
+	}
+}
+
+// 连接ClickHouse、校验表结构并统计数据量，成功后重置滚动窗口
+func loadDataset() error {
+	if marketSource != SOURCE_DEMO {
+		if err := testConnection(); err != nil {
+			return fmt.Errorf("failed to connect to ClickHouse: %w", err)
+		}
+		fmt.Println("Successfully connected to ClickHouse!")
+		if err := validateSchema("jm"); err != nil {
+			return err
+		}
+		// 查询数据量，窗口数据在滚动时按需分页加载
+		dataSource = preferBarTable("jm", lastRange)
+	}
+
+	count, err := countMarketData()
+	if err != nil {
+		return fmt.Errorf("failed to query data: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("no data found in table %s", dataSource)
+	}
+
+	fmt.Printf("Found %d records\n", count)
+
+	dataMutex.Lock()
+	totalRecords = count
+	windowStart = 0
+	loadError = ""
+	dataMutex.Unlock()
+	return nil
+}
+
+func setLoadError(err error) {
+	dataMutex.Lock()
+	loadError = err.Error()
+	dataMutex.Unlock()
+}
+
+// 等待下一次更新，页面请求重试时提前返回
+func waitForUpdate() {
+	select {
+	case <-time.After(UPDATE_INTERVAL):
+	case <-retryLoad:
+	}
+}
+
 // 数据更新循环
 func updateDataLoop() {
-	totalRecords := len(allData)
-
 	for {
-		// 获取当前窗口数据
-		windowEnd := windowStart + WINDOW_SIZE
-		if windowEnd > totalRecords {
-			windowEnd = totalRecords
+		dataMutex.RLock()
+		failed := loadError != ""
+		dataMutex.RUnlock()
+		if failed {
+			if err := loadDataset(); err != nil {
+				log.Printf("Retry failed: %v", err)
+				setLoadError(err)
+				waitForUpdate()
+				continue
+			}
 		}
 
 		if windowStart >= totalRecords {
+			// 回到开头时重新统计数据量，以包含新写入的数据
 			windowStart = 0
-			windowEnd = WINDOW_SIZE
-			if windowEnd > totalRecords {
-				windowEnd = totalRecords
+			if count, err := countMarketData(); err == nil && count > 0 {
+				dataMutex.Lock()
+				totalRecords = count
+				dataMutex.Unlock()
 			}
 		}
 
+		// 获取当前窗口数据，并在后台预取下一个窗口
+		index := windowStart / WINDOW_STEP
+		data, err := windows.get(index)
+		if err != nil {
+			log.Printf("Failed to load window %d: %v", index, err)
+			time.Sleep(UPDATE_INTERVAL)
+			continue
+		}
+		windows.evict(index)
+		windows.prefetch(index + 1)
+
+		windowEnd := windowStart + len(data)
+
 		// 更新当前数据
 		dataMutex.Lock()
-		currentData = allData[windowStart:windowEnd]
+		currentData = data
 		dataMutex.Unlock()
 
 		if len(currentData) >= 2 {
@@ -245,7 +919,7 @@ func updateDataLoop() {
 			oiValues := make([]float64, len(currentData))
 
 			for i, record := range currentData {
-				priceValues[i] = float64(record.Price)
+				priceValues[i] = seriesValue(record)
 				oiValues[i] = float64(record.OpenInterest)
 			}
 
@@ -260,20 +934,256 @@ func updateDataLoop() {
 
 		// 等待并移动窗口
 		time.Sleep(UPDATE_INTERVAL)
-		windowStart += 50 // 每次移动50个点，加快滚动速度
+		windowStart += WINDOW_STEP
 	}
 }
 
 // Web服务器
 func startWebServer() {
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/chart", chartHandler)
-	http.HandleFunc("/data", dataHandler)
+	http.HandleFunc("/", withRecover(indexHandler))
+	http.HandleFunc("/chart", withRecover(chartHandler))
+	http.HandleFunc("/data", withRecover(dataHandler))
+	http.HandleFunc("/retry", withRecover(retryHandler))
+
+	listener, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 端口被占用而改用其他端口时，提示和 -open 使用实际监听的地址
+	if listener.Addr().Network() == "tcp" {
+		listenAddr = listener.Addr().String()
+	}
 
-	fmt.Printf("\n\nStarting web server at http://localhost%s\n", WEB_PORT)
+	base := displayURL(listenAddr)
+	fmt.Printf("\n\nStarting web server at %s\n", base)
 	fmt.Println("Open your browser and visit the URL above to view the live chart")
+	if openOnStart {
+		if strings.HasPrefix(base, "unix:") {
+			log.Printf("-open ignored: listening on a unix socket")
+		} else if err := openBrowser(base); err != nil {
+			log.Printf("Failed to open the browser, visit %s manually: %v", base, err)
+		}
+	}
+
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 << 10,
+	}
+	log.Fatal(server.Serve(listener))
+}
+
+// 按 -listen 参数创建监听：host:port 走TCP，unix:/path.sock 走Unix套接字（先清理上次遗留的套接字文件）
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid listen address %q (expected unix:/path/to.sock)", addr)
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q (expected host:port or unix:/path.sock): %w", addr, err)
+	}
+	return listenTCP(addr)
+}
 
-	log.Fatal(http.ListenAndServe(WEB_PORT, nil))
+// 端口被占用时（如另一个查看器实例已在运行）依次尝试后面的 PORT_FALLBACK_TRIES 个端口，
+// 都被占用时由系统分配一个空闲端口；-port-fallback=false 时直接报错
+const PORT_FALLBACK_TRIES = 10
+
+func listenTCP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err == nil || !portFallback || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+	host, portSpec, _ := net.SplitHostPort(addr)
+	if port, convErr := strconv.Atoi(portSpec); convErr == nil {
+		for next := port + 1; next <= port+PORT_FALLBACK_TRIES && next <= 65535; next++ {
+			if l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(next))); err == nil {
+				log.Printf("Port %d is already in use, listening on port %d instead", port, next)
+				return l, nil
+			}
+		}
+	}
+	l, fallbackErr := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if fallbackErr != nil {
+		return nil, err
+	}
+	log.Printf("Port %s and the next %d ports are in use, listening on %s instead", portSpec, PORT_FALLBACK_TRIES, l.Addr())
+	return l, nil
+}
+
+// -open：用系统默认浏览器打开查看器页面
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// 启动提示中使用的访问地址，未指定主机或绑定所有接口时显示 localhost
+func displayURL(addr string) string {
+	if strings.HasPrefix(addr, "unix:") {
+		return addr
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// 长时间运行：日志写入按大小轮转的文件，处理器中的panic被捕获并记录，数据更新协程崩溃后自动重启
+const (
+	SUPERVISE_RESTART_DELAY = 5 * time.Second // 后台循环崩溃后等待该时长再重启
+	DAEMON_CHILD_ENV        = "CHART_DAEMON_CHILD"
+)
+
+var (
+	logMaxSize int64
+	logBackups int
+)
+
+// 按大小轮转的日志文件：写入前超过上限时当前文件改名为 .1，已有的 .N 依次后移，超出保留个数的删除
+type rotatingLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	backups int
+}
+
+func newRotatingLog(path string, maxSize int64, backups int) (*rotatingLog, error) {
+	l := &rotatingLog{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		l.file.Close()
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+		for i := l.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if l.backups > 0 {
+			os.Rename(l.path, l.path+".1")
+		} else {
+			os.Remove(l.path)
+		}
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// 把 log 包和标准输出、标准错误都写入 -log-file，窗口统计等 fmt 输出也一起轮转
+func setupLogFile(path string) error {
+	out, err := newRotatingLog(path, logMaxSize, logBackups)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	go io.Copy(out, r)
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(out)
+	return nil
+}
+
+// -daemon：以相同的参数在后台重新启动自身，打印子进程PID后父进程退出；子进程忽略SIGHUP
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	cmd := exec.Command(exe, append(os.Args[1:], "-daemon=false")...)
+	cmd.Env = append(os.Environ(), DAEMON_CHILD_ENV+"=1")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+	fmt.Printf("Chart viewer running in the background, pid %d\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// 捕获处理器中的panic：记录请求和调用栈并返回500，http.ErrAbortHandler 照常向上抛出
+func withRecover(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.RequestURI(), err, debug.Stack())
+			http.Error(w, fmt.Sprintf("internal server error: %v", err), http.StatusInternalServerError)
+		}()
+		handler(w, r)
+	}
+}
+
+// 在后台运行一个常驻循环，panic时记录调用栈并在 SUPERVISE_RESTART_DELAY 后重新启动
+func supervise(name string, loop func()) {
+	go func() {
+		for {
+			panicked := func() (panicked bool) {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("%s crashed: %v\n%s", name, err, debug.Stack())
+						panicked = true
+					}
+				}()
+				loop()
+				return false
+			}()
+			if !panicked {
+				return
+			}
+			log.Printf("Restarting %s in %v", name, SUPERVISE_RESTART_DELAY)
+			time.Sleep(SUPERVISE_RESTART_DELAY)
+		}
+	}()
 }
 
 // 主页处理器
@@ -352,6 +1262,20 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
             border-radius: 5px;
             color: #155724;
         }
+        .error-banner {
+            display: none;
+            padding: 10px 15px;
+            margin-bottom: 20px;
+            background-color: #f8d7da;
+            border: 1px solid #f5c6cb;
+            border-radius: 5px;
+            color: #721c24;
+        }
+        .error-banner button {
+            padding: 5px 12px;
+            margin-left: 10px;
+            background-color: #dc3545;
+        }
     </style>
 </head>
 <body>
@@ -360,6 +1284,11 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
             <h1>JM2509 实时市场数据图表</h1>
             <p>价格和持仓量滚动显示</p>
         </div>
+
+        <div class="error-banner" id="errorBanner">
+            <span id="errorBannerText"></span>
+            <button onclick="retryLoad()">重试</button>
+        </div>
         
         <div class="stats" id="stats">
             <div class="stat-item">
@@ -403,6 +1332,8 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
         let autoUpdate = true;
         let updateInterval;
 
+        const seriesLabels = { price: '价格', mid: '中间价', spread: '价差 (跳)' };
+
         // 初始化图表
         function initChart() {
             const ctx = document.getElementById('myChart').getContext('2d');
@@ -485,9 +1416,13 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
                 .then(response => response.json())
                 .then(data => {
                     if (data.error) {
+                        if (data.retryable) {
+                            showErrorBanner('数据加载失败: ' + data.error + '（后台会自动重试）');
+                        }
                         document.getElementById('status').textContent = '错误: ' + data.error;
                         return;
                     }
+                    hideErrorBanner();
 
                     // 更新图表数据
                     const labels = data.data.map(item => {
@@ -495,7 +1430,13 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
                         return date.toLocaleTimeString();
                     });
                     
-                    const prices = data.data.map(item => item.price);
+                    // 服务器按 -series 计算的价格序列（最新价/中间价/价差）
+                    const prices = data.series ? data.series.values : data.data.map(item => item.price);
+                    if (data.series) {
+                        const label = seriesLabels[data.series.name] || '价格';
+                        chart.data.datasets[0].label = label;
+                        chart.options.scales.y.title.text = label;
+                    }
                     const openInterests = data.data.map(item => item.open_interest);
 
                     chart.data.labels = labels;
@@ -507,16 +1448,37 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
                     updateStats(data.stats);
                     
                     // 更新状态
-                    document.getElementById('status').textContent = 
-                        '最后更新: ' + new Date().toLocaleTimeString() + 
+                    let status = '最后更新: ' + new Date().toLocaleTimeString() +
                         ' | 数据窗口: ' + data.window_info;
+                    if (data.stats.skipped_rows) {
+                        status += ' | 已跳过 ' + data.stats.skipped_rows + ' 行无法解析的数据（' + data.stats.skipped_detail + '）';
+                    }
+                    document.getElementById('status').textContent = status;
                 })
                 .catch(error => {
                     console.error('Error:', error);
                     document.getElementById('status').textContent = '数据获取失败: ' + error.message;
+                    showErrorBanner('无法连接到服务器: ' + error.message);
                 });
         }
 
+        function showErrorBanner(message) {
+            document.getElementById('errorBannerText').textContent = message;
+            document.getElementById('errorBanner').style.display = 'block';
+        }
+
+        function hideErrorBanner() {
+            document.getElementById('errorBanner').style.display = 'none';
+        }
+
+        // 请求服务器立即重新加载数据，稍后刷新图表
+        function retryLoad() {
+            document.getElementById('errorBannerText').textContent = '正在重试...';
+            fetch('/retry', { method: 'POST' })
+                .catch(error => console.error('Error:', error))
+                .finally(() => setTimeout(updateChart, 1000));
+        }
+
         // 更新统计信息
         function updateStats(stats) {
             document.getElementById('avgPrice').textContent = stats.avg_price.toFixed(2);
@@ -589,17 +1551,14 @@ func chartHandler(w http.ResponseWriter, r *http.Request) {
 
 	for i, record := range data {
 		xValues[i] = record.Time
-		priceValues[i] = float64(record.Price)
+		priceValues[i] = seriesValue(record)
 		oiValues[i] = float64(record.OpenInterest)
 	}
 
-	// 标准化持仓量数据到价格范围
-	normalizedOI := normalizeToRange(oiValues, priceValues)
-
 	// 创建图表
 	graph := chart.Chart{
-		Title: fmt.Sprintf("JM2509 - Price and Open Interest Chart (Window: %d-%d)",
-			windowStart+1, windowStart+len(data)),
+		Title: fmt.Sprintf("JM2509 - %s and Open Interest Chart (Window: %d-%d)",
+			seriesLabel(), windowStart+1, windowStart+len(data)),
 		TitleStyle: chart.Style{
 			FontSize: 16,
 		},
@@ -621,14 +1580,14 @@ func chartHandler(w http.ResponseWriter, r *http.Request) {
 			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
 		},
 		YAxis: chart.YAxis{
-			Name: "Price",
+			Name: seriesLabel(),
 			Style: chart.Style{
 				FontSize: 10,
 			},
 		},
 		Series: []chart.Series{
 			chart.TimeSeries{
-				Name: "Price",
+				Name: seriesLabel(),
 				Style: chart.Style{
 					StrokeColor: drawing.ColorGreen,
 					StrokeWidth: 2,
@@ -636,16 +1595,53 @@ func chartHandler(w http.ResponseWriter, r *http.Request) {
 				XValues: xValues,
 				YValues: priceValues,
 			},
-			chart.TimeSeries{
-				Name: "Open Interest (normalized)",
+		},
+	}
+
+	// 持仓量按原值画在右轴上；数据源不提供持仓量时不画这条线和右轴
+	if lo, hi, ok := oiRange(oiValues); ok {
+		graph.YAxisSecondary = chart.YAxis{
+			Name: "Open Interest",
+			Style: chart.Style{
+				FontSize: 10,
+			},
+			Range:          &chart.ContinuousRange{Min: lo, Max: hi},
+			ValueFormatter: chart.IntValueFormatter,
+		}
+		graph.Series = append(graph.Series, chart.TimeSeries{
+			Name: "Open Interest",
+			Style: chart.Style{
+				StrokeColor: drawing.ColorRed,
+				StrokeWidth: 2,
+			},
+			YAxis:   chart.YAxisSecondary,
+			XValues: xValues,
+			YValues: oiValues,
+		})
+	}
+
+	// 价位线：每次请求重新读取文件，只画落在价格范围内的，不改变纵轴的自动缩放
+	if priceSeries != "spread" {
+		lo, hi := findMin(priceValues), findMax(priceValues)
+		levels, err := loadLevels(levelsPath, "jm2509")
+		if err != nil {
+			log.Printf("Failed to load levels: %v", err)
+		}
+		for _, level := range levels {
+			if level.Price < lo || level.Price > hi {
+				continue
+			}
+			graph.Series = append(graph.Series, chart.TimeSeries{
+				Name: strings.TrimSpace(fmt.Sprintf("Level %g %s", level.Price, level.Label)),
 				Style: chart.Style{
-					StrokeColor: drawing.ColorRed,
-					StrokeWidth: 2,
+					StrokeColor:     drawing.Color{R: 255, G: 140, B: 0, A: 255},
+					StrokeWidth:     1,
+					StrokeDashArray: []float64{6, 4},
 				},
-				XValues: xValues,
-				YValues: normalizedOI,
-			},
-		},
+				XValues: []time.Time{xValues[0], xValues[len(xValues)-1]},
+				YValues: []float64{level.Price, level.Price},
+			})
+		}
 	}
 
 	// 添加图例
@@ -660,12 +1656,35 @@ func chartHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// 重试API处理器，唤醒数据更新协程立即重新加载
+func retryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case retryLoad <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // 数据API处理器
 func dataHandler(w http.ResponseWriter, r *http.Request) {
 	dataMutex.RLock()
 	data := currentData
+	loadErr := loadError
 	dataMutex.RUnlock()
 
+	if loadErr != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     loadErr,
+			"retryable": true,
+		})
+		return
+	}
+
 	if len(data) == 0 {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -679,7 +1698,7 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 	oiValues := make([]float64, len(data))
 
 	for i, record := range data {
-		priceValues[i] = float64(record.Price)
+		priceValues[i] = seriesValue(record)
 		oiValues[i] = float64(record.OpenInterest)
 	}
 
@@ -690,41 +1709,51 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 		"avg_oi":      calculateAverage(oiValues),
 		"data_points": len(data),
 	}
+	if skipped, detail := parseErrorSummary(); skipped > 0 {
+		stats["skipped_rows"] = skipped
+		stats["skipped_detail"] = detail
+	}
 
-	windowInfo := fmt.Sprintf("%d-%d of %d", windowStart+1, windowStart+len(data), len(allData))
+	dataMutex.RLock()
+	total := totalRecords
+	dataMutex.RUnlock()
+
+	windowInfo := fmt.Sprintf("%d-%d of %d", windowStart+1, windowStart+len(data), total)
 
 	response := map[string]interface{}{
 		"data":        data,
 		"stats":       stats,
 		"window_info": windowInfo,
 		"timestamp":   time.Now(),
+		"series": map[string]interface{}{
+			"name":   priceSeries,
+			"values": priceValues,
+		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func normalizeToRange(source, target []float64) []float64 {
-	if len(source) == 0 || len(target) == 0 {
-		return source
+// 持仓量右轴的范围：跳过缺失（NaN/Inf）的点；全为0视为数据源不提供持仓量，
+// 此时 ok 为 false，不画这条线和右轴。持仓量不变时上下各留1手，避免范围为0
+func oiRange(values []float64) (lo, hi float64, ok bool) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	nonZero := false
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+		nonZero = nonZero || v != 0
 	}
-
-	sourceMin := findMin(source)
-	sourceMax := findMax(source)
-	targetMin := findMin(target)
-	targetMax := findMax(target)
-
-	if sourceMax == sourceMin {
-		return source
+	if !nonZero {
+		return 0, 0, false
 	}
-
-	normalized := make([]float64, len(source))
-	for i, val := range source {
-		// 将source数据从[sourceMin, sourceMax]映射到[targetMin, targetMax]
-		normalized[i] = targetMin + (val-sourceMin)*(targetMax-targetMin)/(sourceMax-sourceMin)
+	if lo == hi {
+		lo, hi = lo-1, hi+1
 	}
-
-	return normalized
+	return lo, hi, true
 }
 
 func findMax(data []float64) float64 {
@@ -1,24 +1,521 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"image"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
 )
 
 const (
 	WINDOW_SIZE     = 200
+	MIN_WINDOW_SIZE = 25
+	MAX_WINDOW_SIZE = 3200
 	UPDATE_INTERVAL = 5 * time.Second
+	CLICKHOUSE_URL  = "http://xm.local:8123"
 )
 
+// 通过 -last 参数指定的相对时间范围，0 表示加载全部历史
+var lastRange time.Duration
+
+// 终端图表显示的一个合约
+type chartSource struct {
+	table  string
+	symbol string
+}
+
+var (
+	// 主图合约
+	primarySource chartSource
+	// 分屏对比的第二个合约，symbol 为空表示不分屏
+	splitSource chartSource
+)
+
+// 终端查看器中可以重新绑定按键的操作
+const (
+	ACTION_QUIT         = "quit"
+	ACTION_REFRESH      = "refresh"
+	ACTION_SCROLL_LEFT  = "scroll_left"
+	ACTION_SCROLL_RIGHT = "scroll_right"
+	ACTION_ZOOM_IN      = "zoom_in"
+	ACTION_ZOOM_OUT     = "zoom_out"
+	ACTION_PAUSE        = "pause"
+	ACTION_SEARCH       = "search"
+	ACTION_EXPORT       = "export"
+	ACTION_LOCK_SCALE   = "lock_scale"
+	ACTION_FOLLOW       = "follow"
+	ACTION_MARK_IN      = "mark_in"
+	ACTION_MARK_OUT     = "mark_out"
+	ACTION_EXPORT_CLIP  = "export_clip"
+)
+
+// 默认按键，键名使用termui的事件ID，如 "q"、"<C-c>"、"<Left>"、"<Space>"、"<F5>"
+var defaultKeyBindings = map[string][]string{
+	ACTION_QUIT:         {"q", "<C-c>"},
+	ACTION_REFRESH:      {"r"},
+	ACTION_SCROLL_LEFT:  {"<Left>"},
+	ACTION_SCROLL_RIGHT: {"<Right>"},
+	ACTION_ZOOM_IN:      {"+", "="},
+	ACTION_ZOOM_OUT:     {"-"},
+	ACTION_PAUSE:        {"p", "<Space>"},
+	ACTION_SEARCH:       {"/"},
+	ACTION_EXPORT:       {"e"},
+	ACTION_LOCK_SCALE:   {"L"},
+	ACTION_FOLLOW:       {"f"},
+	ACTION_MARK_IN:      {"["},
+	ACTION_MARK_OUT:     {"]"},
+	ACTION_EXPORT_CLIP:  {"c"},
+}
+
+// 终端查看器的配置文件 (JSON)，通过 -config 指定。例如在tmux中避开 C-b：
+//
+//	{"keys": {"quit": ["Q"], "scroll_left": ["h", "<Left>"], "scroll_right": ["l", "<Right>"]}}
+//
+// 未配置的操作使用默认按键；export_dir 是按导出键保存CSV/PNG的目录；
+// y_min/y_max 固定导出PNG的纵轴范围（只设一端时另一端按数据自动），y_max 同时作为终端图表的纵轴上限；
+// fields 按表配置列名映射，与Web查看器的 -field-map 文件格式相同，如 {"fields": {"SA": {"vol": "volume"}}}；
+// number_format 设置统计数字的格式，与Web查看器的 -number-* 参数相同，如 {"number_format": {"locale": "en-US", "decimals": {"price": 1}, "units": "cn"}}
+type tuiConfig struct {
+	Keys         map[string][]string          `json:"keys"`
+	ExportDir    string                       `json:"export_dir"`
+	YMin         *float64                     `json:"y_min"`
+	YMax         *float64                     `json:"y_max"`
+	Fields       map[string]map[string]string `json:"fields"`
+	NumberFormat numberFormat                 `json:"number_format"`
+	// 自动滚动的间隔和两次重绘之间的最小间隔，如 "500ms"，解析后保存在 updateInterval/renderInterval
+	UpdateInterval string `json:"update_interval"`
+	RenderInterval string `json:"render_interval"`
+
+	updateInterval time.Duration
+	renderInterval time.Duration
+}
+
+// 统计数字的格式：locale 决定千位分隔符和小数点，decimals 按字段 (price/volume/oi) 设置小数位，
+// units 把成交量和持仓量换算成 万/亿 (cn) 或 k/M/B (metric)，换算后保留2位小数
+type numberFormat struct {
+	Locale   string         `json:"locale"`
+	Decimals map[string]int `json:"decimals"`
+	Units    string         `json:"units"`
+}
+
+var numberLocales = map[string][2]string{
+	"zh-CN": {",", "."},
+	"en-US": {",", "."},
+	"de-DE": {".", ","},
+	"plain": {"", "."},
+}
+
+var numberUnitSets = map[string][]struct {
+	scale  float64
+	suffix string
+}{
+	"none":   nil,
+	"cn":     {{1e8, "亿"}, {1e4, "万"}},
+	"metric": {{1e9, "B"}, {1e6, "M"}, {1e3, "k"}},
+}
+
+var defaultDecimals = map[string]int{"price": 2, "volume": 0, "oi": 0}
+
+func (f numberFormat) validate() error {
+	if _, ok := numberLocales[f.Locale]; !ok {
+		return fmt.Errorf("number_format.locale %q: expected zh-CN, en-US, de-DE or plain", f.Locale)
+	}
+	if _, ok := numberUnitSets[f.Units]; !ok {
+		return fmt.Errorf("number_format.units %q: expected none, cn or metric", f.Units)
+	}
+	for field, n := range f.Decimals {
+		if _, ok := defaultDecimals[field]; !ok || n < 0 || n > 8 {
+			return fmt.Errorf("number_format.decimals.%s = %d: expected price/volume/oi with 0..8 decimals", field, n)
+		}
+	}
+	return nil
+}
+
+// 按字段格式化数字，price 不换算单位
+func (f numberFormat) format(v float64, field string) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "-"
+	}
+	decimals, ok := f.Decimals[field]
+	if !ok {
+		decimals = defaultDecimals[field]
+	}
+	suffix := ""
+	if field != "price" {
+		for _, unit := range numberUnitSets[f.Units] {
+			if math.Abs(v) >= unit.scale {
+				v, suffix, decimals = v/unit.scale, unit.suffix, 2
+				break
+			}
+		}
+	}
+	seps := numberLocales[f.Locale]
+	intPart, frac, _ := strings.Cut(strconv.FormatFloat(math.Abs(v), 'f', decimals, 64), ".")
+	var b strings.Builder
+	if v < 0 {
+		b.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(seps[0])
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(seps[1] + frac)
+	}
+	return b.String() + suffix
+}
+
+var config tuiConfig
+
+// 读取配置文件，文件不存在时使用默认配置
+func loadConfig(path string) (tuiConfig, error) {
+	cfg := tuiConfig{ExportDir: "exports", NumberFormat: numberFormat{Locale: "zh-CN", Units: "none"},
+		updateInterval: UPDATE_INTERVAL, renderInterval: DEFAULT_RENDER_INTERVAL}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if cfg.YMin != nil && cfg.YMax != nil && *cfg.YMin >= *cfg.YMax {
+		return cfg, fmt.Errorf("invalid config %s: y_min must be less than y_max", path)
+	}
+	if err := cfg.NumberFormat.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if cfg.UpdateInterval != "" {
+		if cfg.updateInterval, err = time.ParseDuration(cfg.UpdateInterval); err != nil || cfg.updateInterval < 10*time.Millisecond {
+			return cfg, fmt.Errorf("invalid config %s: update_interval %q must be a duration of at least 10ms", path, cfg.UpdateInterval)
+		}
+	}
+	if cfg.RenderInterval != "" {
+		if cfg.renderInterval, err = time.ParseDuration(cfg.RenderInterval); err != nil || cfg.renderInterval < 0 {
+			return cfg, fmt.Errorf("invalid config %s: render_interval %q must be a non-negative duration", path, cfg.RenderInterval)
+		}
+	}
+	for table, fields := range cfg.Fields {
+		for column, source := range fields {
+			known := false
+			for _, col := range expectedColumns {
+				if col.name == column {
+					known = true
+					break
+				}
+			}
+			if !known || strings.TrimSpace(source) == "" || strings.Contains(source, ";") {
+				return cfg, fmt.Errorf("invalid config %s: bad field mapping %s.%s = %q", path, table, column, source)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// 查询中引用的表：配置了列名映射时换成按标准列名补上映射列的子查询
+func tableSource(table string) string {
+	fields := config.Fields[table]
+	if len(fields) == 0 {
+		return "feature." + table
+	}
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	aliases := make([]string, len(columns))
+	for i, column := range columns {
+		aliases[i] = fields[column] + " AS " + column
+	}
+	return "(SELECT *, " + strings.Join(aliases, ", ") + " FROM feature." + table + ")"
+}
+
+// 合并默认按键和配置的按键，返回 按键 -> 操作 的映射；未知操作或同一按键绑定多个操作时返回错误
+func buildKeyMap(custom map[string][]string) (map[string]string, error) {
+	bindings := make(map[string][]string)
+	for action, keys := range defaultKeyBindings {
+		bindings[action] = keys
+	}
+	for action, keys := range custom {
+		if _, ok := defaultKeyBindings[action]; !ok {
+			return nil, fmt.Errorf("unknown key action %q", action)
+		}
+		bindings[action] = keys
+	}
+
+	keyMap := make(map[string]string)
+	for action, keys := range bindings {
+		for _, key := range keys {
+			if other, ok := keyMap[key]; ok && other != action {
+				return nil, fmt.Errorf("key %q is bound to both %s and %s", key, other, action)
+			}
+			keyMap[key] = action
+		}
+	}
+	return keyMap, nil
+}
+
+// 状态栏中显示的按键提示，取该操作绑定的第一个按键
+func keyHint(keyMap map[string]string, action string) string {
+	var keys []string
+	for key, a := range keyMap {
+		if a == action {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "-"
+	}
+	// map无序，按默认绑定的顺序优先，保证提示稳定
+	sort.Strings(keys)
+	for _, key := range defaultKeyBindings[action] {
+		if keyMap[key] == action {
+			return strings.Trim(key, "<>")
+		}
+	}
+	return strings.Trim(keys[0], "<>")
+}
+
+// 通过 -series 选择绘制的价格序列：price 为最新价，mid 为买一卖一中间价，spread 为以最小变动价位计的买卖价差
+var priceSeries = "price"
+
+// 通过 -tick-size 指定的最小变动价位，0 表示按品种自动查表
+var tickSizeOverride float64
+
+// 价位线文件，与Web查看器的 -levels-file 相同：{"jm2509": [{"id": "...", "price": 1012.5, "label": "前高"}]}
+var levelsPath = "levels.json"
+
+// 价位线（支撑/压力位），在Web查看器上添加
+type priceLevel struct {
+	Price float64 `json:"price"`
+	Label string  `json:"label"`
+}
+
+// 读取合约的价位线，按价格升序；文件不存在时没有价位线
+func loadLevels(path, symbol string) ([]priceLevel, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read levels: %w", err)
+	}
+	var all map[string][]priceLevel
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse levels %s: %w", path, err)
+	}
+	levels := all[strings.ToLower(symbol)]
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Price < levels[j].Price })
+	return levels, nil
+}
+
+// 价格从 prev 到 cur 穿越的价位线，没有穿越时返回空字符串；价差序列不检查
+func crossedLevel(levels []priceLevel, prev, cur float64) string {
+	if priceSeries == "spread" {
+		return ""
+	}
+	for _, level := range levels {
+		switch {
+		case prev < level.Price && cur >= level.Price:
+			return fmt.Sprintf("crossed level %g up", level.Price)
+		case prev > level.Price && cur <= level.Price:
+			return fmt.Sprintf("crossed level %g down", level.Price)
+		}
+	}
+	return ""
+}
+
+// 界面状态文件，与Web查看器和简易图表的 -state-file 相同，为空时不保存也不恢复
+var statePath = "ui_state.json"
+
+// 定期保存界面状态的间隔，程序被强制结束时最多丢失这段时间内的改动
+const STATE_SAVE_INTERVAL = 30 * time.Second
+
+// 上次使用的界面状态，各查看器只读写自己用得到的字段，其余字段原样保留；
+// window_end 为窗口最右端的时间，follow 为 true 时窗口跟随最新数据，不恢复滚动位置
+type uiState struct {
+	Table      string   `json:"table,omitempty"`
+	Symbol     string   `json:"symbol,omitempty"`
+	Range      string   `json:"range,omitempty"`
+	Series     string   `json:"series,omitempty"`
+	Theme      string   `json:"theme,omitempty"`
+	Indicators []string `json:"indicators,omitempty"`
+	WindowSize int      `json:"window_size,omitempty"`
+	WindowEnd  string   `json:"window_end,omitempty"`
+	Follow     bool     `json:"follow,omitempty"`
+	SavedAt    string   `json:"saved_at,omitempty"`
+	SavedBy    string   `json:"saved_by,omitempty"`
+}
+
+// 读取界面状态，文件不存在时返回空状态
+func loadUIState(path string) (uiState, error) {
+	var state uiState
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return uiState{}, fmt.Errorf("failed to parse state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// 在文件中现有状态的基础上修改并保存，先写临时文件再改名，写到一半退出时不会留下损坏的状态文件；
+// 现有文件损坏时从空状态开始
+func saveUIState(path, savedBy string, update func(*uiState)) error {
+	if path == "" {
+		return nil
+	}
+	state, err := loadUIState(path)
+	if err != nil {
+		log.Printf("Overwriting unreadable state file: %v", err)
+		state = uiState{}
+	}
+	update(&state)
+	state.SavedAt = time.Now().Format("2006-01-02 15:04:05")
+	state.SavedBy = savedBy
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// 恢复后的界面状态，只有合约与启动时的主合约相同时才在 createChart 中恢复窗口大小和滚动位置
+var restoredState uiState
+
+// 常见期货品种的最小变动价位，未列出的品种视为未知，价格不按tick舍入
+var productTickSizes = map[string]float64{
+	"a": 1, "ag": 1, "al": 5, "ap": 1, "au": 0.02, "bu": 1, "c": 1, "cf": 5, "cu": 10,
+	"eb": 1, "eg": 1, "fg": 1, "fu": 1, "hc": 1, "i": 0.5, "j": 0.5, "jm": 0.5, "l": 1,
+	"lc": 50, "lh": 5, "m": 1, "ma": 1, "ni": 10, "oi": 1, "p": 2, "pg": 1, "pp": 1,
+	"rb": 1, "rm": 1, "ru": 5, "sa": 1, "sc": 0.1, "sf": 2, "si": 5, "sm": 2, "sp": 2,
+	"sr": 1, "ss": 5, "ta": 2, "ur": 1, "v": 1, "y": 2, "zn": 5,
+}
+
+func validateSeries(series string) error {
+	switch series {
+	case "price", "mid", "spread":
+		return nil
+	}
+	return fmt.Errorf("unknown series %q (price, mid or spread)", series)
+}
+
+func tickSizeFor(symbol string) float64 {
+	if tickSizeOverride > 0 {
+		return tickSizeOverride
+	}
+	if size, ok := productTickSizes[strings.ToLower(strings.TrimRight(symbol, "0123456789"))]; ok {
+		return size
+	}
+	return 0
+}
+
+// 按 -series 取一条记录的绘图值；没有有效买一/卖一报价时中间价退回最新价，价差记为0。
+// 价格先换算成tick数再计算，价差是精确的整数，中间价不会带上float32的舍入误差。
+// 最小变动价位未知时直接用原始价格计算，价差的单位是价格而不是tick
+func seriesValue(record MarketData) float64 {
+	tick := tickSizeFor(record.Symbol)
+	quoted := record.Bid1 > 0 && record.Ask1 > 0
+	switch {
+	case priceSeries == "mid" && quoted && tick <= 0:
+		return rawPrice(float32((rawPrice(record.Bid1) + rawPrice(record.Ask1)) / 2))
+	case priceSeries == "mid" && quoted:
+		return ticksToPrice(priceToTicks(record.Bid1, tick)+priceToTicks(record.Ask1, tick), tick/2)
+	case priceSeries == "spread" && quoted && tick <= 0:
+		return rawPrice(float32(rawPrice(record.Ask1) - rawPrice(record.Bid1)))
+	case priceSeries == "spread" && quoted:
+		return float64(priceToTicks(record.Ask1, tick) - priceToTicks(record.Bid1, tick))
+	case priceSeries == "spread":
+		return 0
+	}
+	return priceValue(record.Price, tick)
+}
+
+// float32价格经tick数换算得到的精确十进制价格；最小变动价位未知时不舍入，取原始价格
+func priceValue(price float32, tick float64) float64 {
+	if tick <= 0 {
+		return rawPrice(price)
+	}
+	return ticksToPrice(priceToTicks(price, tick), tick)
+}
+
+// float32价格的最短十进制表示，例如 3801.2 而不是 3801.199951171875
+func rawPrice(price float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(price), 'g', -1, 32), 64)
+	return v
+}
+
+// 价格在内部按最小变动价位的整数倍（tick数）计算，只在输出时换算回价格，避免float32舍入误差在价差和指标中累积
+func priceToTicks(price float32, tick float64) int64 {
+	return int64(math.Round(float64(price) / tick))
+}
+
+// tick数换算回价格，并舍入到最小变动价位的小数位数（例如 0.1 的3倍为 0.3 而不是 0.30000000000000004）
+func ticksToPrice(ticks int64, tick float64) float64 {
+	scale := math.Pow10(tickDecimals(tick))
+	return math.Round(float64(ticks)*tick*scale) / scale
+}
+
+// 最小变动价位的小数位数，例如 0.5 为1位、0.02 为2位、1 为0位
+func tickDecimals(tick float64) int {
+	text := strconv.FormatFloat(tick, 'f', -1, 64)
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		return len(text) - i - 1
+	}
+	return 0
+}
+
+func seriesLabel() string {
+	switch priceSeries {
+	case "mid":
+		return "Mid Price"
+	case "spread":
+		return "Spread (ticks)"
+	}
+	return "Price"
+}
+
 type MarketData struct {
 	Symbol       string    `json:"symbol"`
 	Time         time.Time `json:"time"`
@@ -35,26 +532,120 @@ type MarketData struct {
 }
 
 func main() {
-	fmt.Println("Connecting to ClickHouse...")
+	last := flag.String("last", "all", "只加载最近一段时间的数据，例如 30m、2h、1d、5d 或 all")
+	flag.StringVar(&primarySource.table, "table", "jm", "数据表名 (feature库)")
+	flag.StringVar(&primarySource.symbol, "symbol", "jm2509", "合约代码")
+	flag.StringVar(&splitSource.symbol, "split", "", "分屏显示的第二个合约，例如 j2509，与主合约共享时间窗口和滚动位置")
+	flag.StringVar(&splitSource.table, "split-table", "", "第二个合约所在的表，默认取合约代码的字母前缀")
+	flag.StringVar(&priceSeries, "series", "price", "绘制的价格序列: price(最新价)、mid(买一卖一中间价) 或 spread(买卖价差，单位为最小变动价位)")
+	flag.Float64Var(&tickSizeOverride, "tick-size", 0, "计算价差使用的最小变动价位，0 表示按品种自动识别")
+	flag.StringVar(&levelsPath, "levels-file", levelsPath, "价位线文件，与Web查看器的 -levels-file 相同，价位线画在价格图上，刷新时价格穿越价位线在状态栏提示")
+	flag.StringVar(&statePath, "state-file", statePath, "界面状态文件，与Web查看器的 -state-file 相同，退出时和每30秒保存合约、序列、窗口大小和滚动位置，下次启动时恢复；为空时不保存")
+	configPath := flag.String("config", "chart_config.json", "配置文件路径 (JSON)，用于自定义按键等")
+	proxy := flag.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	flag.StringVar(&marketSource, "source", SOURCE_CLICKHOUSE, "行情数据来源: clickhouse 或 demo（本地生成的模拟行情，不需要ClickHouse）")
+	replayServer := flag.String("replay-server", "", "加入Web查看器上的共享回放，填Web查看器的地址，例如 127.0.0.1:8082，需同时指定 -replay-room")
+	replayRoom := flag.String("replay-room", "", "共享回放的房间名，合约和交易日由房间决定，忽略 -symbol、-table 和 -last")
+	customQuery := flag.String("query", "", "画自定义查询的结果而不是行情，查询返回 (时间, 数值[, 序列名])，如 \"SELECT toStartOfHour(time) AS t, count() FROM feature.jm GROUP BY t ORDER BY t\"")
+	flag.Parse()
+
+	if marketSource != SOURCE_CLICKHOUSE && marketSource != SOURCE_DEMO {
+		log.Fatalf("invalid -source %q: expected clickhouse or demo", marketSource)
+	}
+
+	// 恢复上次的合约和序列，命令行上明确指定的参数优先
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if state, err := loadUIState(statePath); err != nil {
+		log.Printf("Ignoring UI state: %v", err)
+	} else {
+		if state.Symbol != "" && !explicit["symbol"] && !explicit["table"] {
+			primarySource.symbol = state.Symbol
+			primarySource.table = state.Table
+			if primarySource.table == "" {
+				primarySource.table = strings.TrimRight(state.Symbol, "0123456789")
+			}
+		}
+		if state.Series != "" && !explicit["series"] && validateSeries(state.Series) == nil {
+			priceSeries = state.Series
+		}
+		if strings.EqualFold(state.Symbol, primarySource.symbol) {
+			restoredState = state
+		}
+	}
 
-	// 测试连接
-	if err := testConnection(); err != nil {
-		log.Fatal("Failed to connect to ClickHouse:", err)
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
 	}
 
-	fmt.Println("Successfully connected to ClickHouse!")
+	if err := validateSeries(priceSeries); err != nil {
+		log.Fatal(err)
+	}
 
-	// 查询数据
-	data, err := queryMarketData()
+	var err error
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyMap, err := buildKeyMap(config.Keys)
 	if err != nil {
-		log.Fatal("Failed to query data:", err)
+		log.Fatal("Invalid key bindings:", err)
 	}
 
-	if len(data) == 0 {
-		log.Fatal("No data found in the table")
+	if *customQuery != "" {
+		if marketSource == SOURCE_DEMO {
+			log.Fatal("-query requires -source clickhouse")
+		}
+		fmt.Println("Running custom query...")
+		res, err := runCustomQuery(*customQuery)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Found %d points in %d series\n", len(res.times), len(res.series))
+		if err := termui.Init(); err != nil {
+			log.Fatalf("failed to initialize termui: %v", err)
+		}
+		defer termui.Close()
+		createQueryChart(*customQuery, res, keyMap)
+		return
+	}
+
+	if (*replayServer == "") != (*replayRoom == "") {
+		log.Fatal("-replay-server and -replay-room must be used together")
+	}
+	if *replayServer != "" {
+		fmt.Printf("Joining replay room %s on %s...\n", *replayRoom, *replayServer)
+		state, err := joinReplay(*replayServer, *replayRoom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replaySession = state
+		primarySource = chartSource{table: state.Table, symbol: state.Symbol}
+	}
+
+	if splitSource.symbol != "" && splitSource.table == "" {
+		splitSource.table = strings.TrimRight(splitSource.symbol, "0123456789")
 	}
 
-	fmt.Printf("Found %d records\n", len(data))
+	lastRange, err = parseRelativeRange(*last)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if marketSource == SOURCE_DEMO {
+		fmt.Println("Using simulated demo data, ClickHouse is not required")
+	} else {
+		fmt.Println("Connecting to ClickHouse...")
+	}
+
+	// 加载失败时不退出，进入界面后显示错误并等待按键重试
+	data, splitData, loadErr := loadChartData()
+	if loadErr == nil {
+		fmt.Printf("Found %d records\n", len(data))
+		if splitSource.symbol != "" {
+			fmt.Printf("Found %d records for %s\n", len(splitData), splitSource.symbol)
+		}
+	}
 
 	// 初始化termui
 	if err := termui.Init(); err != nil {
@@ -62,8 +653,187 @@ func main() {
 	}
 	defer termui.Close()
 
+	if loadErr != nil {
+		var ok bool
+		data, splitData, ok = showLoadError(loadErr, keyMap)
+		if !ok {
+			return
+		}
+	}
+
 	// 创建图表
-	createChart(data)
+	createChart(data, splitData, keyMap)
+}
+
+// 连接ClickHouse、校验表结构并查询主合约和分屏合约的数据
+func loadChartData() ([]MarketData, []MarketData, error) {
+	if marketSource != SOURCE_DEMO {
+		if err := testConnection(); err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+		}
+
+		for _, source := range []chartSource{primarySource, splitSource} {
+			if source.symbol == "" {
+				continue
+			}
+			if err := validateSchema(source.table); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	data, err := queryMarketData(primarySource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query data: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, nil, &emptyResultError{table: primarySource.table, symbol: primarySource.symbol}
+	}
+
+	var splitData []MarketData
+	if splitSource.symbol != "" {
+		splitData, err = queryMarketData(splitSource)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query split symbol data: %w", err)
+		}
+	}
+	return data, splitData, nil
+}
+
+// 主合约查询成功但没有数据（合约代码不对、还没有成交或 -last 范围内没有数据）。
+// 这不是故障，界面显示空状态和可以改选的合约，而不是退出
+type emptyResultError struct {
+	table, symbol string
+}
+
+func (e *emptyResultError) Error() string {
+	return fmt.Sprintf("no data found in table %s for symbol %s", e.table, e.symbol)
+}
+
+// 空状态中最多列出的候选合约数
+const EMPTY_STATE_SUGGESTIONS = 8
+
+// 空状态的说明文字：可能的原因和表中可选的合约，同品种的合约在前
+func emptyStateText(empty *emptyResultError, keyMap map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "表 %s 中没有合约 %s 的数据\n\n可能的原因:\n", empty.table, empty.symbol)
+	b.WriteString("  - 合约代码不正确（例如 jm2509）\n")
+	if lastRange > 0 {
+		fmt.Fprintf(&b, "  - 最近 %s 内没有成交（休市、节假日或夜盘开始前），可以用 -last all 加载全部数据\n", lastRange)
+	} else {
+		b.WriteString("  - 该合约还没有写入任何行情\n")
+	}
+
+	symbols, err := querySymbols(empty.table)
+	switch {
+	case err != nil:
+		fmt.Fprintf(&b, "\n无法列出表中的合约: %v\n", err)
+	case len(symbols) == 0:
+		fmt.Fprintf(&b, "\n表 %s 中还没有任何合约的数据\n", empty.table)
+	default:
+		product := strings.ToLower(strings.TrimRight(empty.symbol, "0123456789"))
+		var same, other []string
+		for _, symbol := range symbols {
+			switch {
+			case symbol == empty.symbol:
+			case strings.ToLower(strings.TrimRight(symbol, "0123456789")) == product:
+				same = append(same, symbol)
+			default:
+				other = append(other, symbol)
+			}
+		}
+		suggestions := append(same, other...)
+		if len(suggestions) > EMPTY_STATE_SUGGESTIONS {
+			suggestions = suggestions[:EMPTY_STATE_SUGGESTIONS]
+		}
+		fmt.Fprintf(&b, "\n可选的合约: %s\n", strings.Join(suggestions, "  "))
+	}
+	fmt.Fprintf(&b, "\n按 %s 选择合约，按 %s 重试，按 %s 退出",
+		keyHint(keyMap, ACTION_SEARCH), keyHint(keyMap, ACTION_REFRESH), keyHint(keyMap, ACTION_QUIT))
+	return b.String()
+}
+
+// 全屏显示加载错误，按刷新键重试，按退出键返回 false。
+// 没有数据时显示空状态，可以按搜索键打开合约选择器改选合约
+func showLoadError(loadErr error, keyMap map[string]string) ([]MarketData, []MarketData, bool) {
+	message := widgets.NewParagraph()
+	message.TextStyle.Fg = termui.ColorWhite
+	message.WrapText = true
+	picker := newSymbolPicker()
+
+	attempts := 1
+	render := func(text string) {
+		width, height := termui.TerminalDimensions()
+		message.SetRect(0, 0, width, height)
+		picker.list.SetRect(width/4, 2, width*3/4, height-2)
+		message.Text = text
+		termui.Clear()
+		if picker.active {
+			termui.Render(message, picker.list)
+		} else {
+			termui.Render(message)
+		}
+	}
+	showError := func() {
+		var empty *emptyResultError
+		if errors.As(loadErr, &empty) {
+			message.Title = "没有数据"
+			message.BorderStyle.Fg = termui.ColorYellow
+			render(emptyStateText(empty, keyMap))
+			return
+		}
+		message.Title = "数据加载失败"
+		message.BorderStyle.Fg = termui.ColorRed
+		render(fmt.Sprintf("%v\n\n已尝试 %d 次，最近一次: %s\n\n按 %s 重试，按 %s 退出",
+			loadErr, attempts, time.Now().Format("15:04:05"),
+			keyHint(keyMap, ACTION_REFRESH), keyHint(keyMap, ACTION_QUIT)))
+	}
+	retry := func() ([]MarketData, []MarketData, bool) {
+		render("正在加载...")
+		data, splitData, err := loadChartData()
+		if err == nil {
+			termui.Clear()
+			return data, splitData, true
+		}
+		loadErr = err
+		attempts++
+		showError()
+		return nil, nil, false
+	}
+	showError()
+
+	for e := range termui.PollEvents() {
+		if e.ID == "<Resize>" {
+			showError()
+			continue
+		}
+		if picker.active && e.Type == termui.KeyboardEvent {
+			selected, done := picker.handleKey(e.ID)
+			if done && selected != "" {
+				primarySource.symbol = selected
+				if data, splitData, ok := retry(); ok {
+					return data, splitData, true
+				}
+				continue
+			}
+			showError()
+			continue
+		}
+		switch keyMap[e.ID] {
+		case ACTION_QUIT:
+			return nil, nil, false
+		case ACTION_SEARCH:
+			if err := picker.open(primarySource.table); err != nil {
+				log.Printf("Failed to list symbols: %v", err)
+			}
+			showError()
+		case ACTION_REFRESH:
+			if data, splitData, ok := retry(); ok {
+				return data, splitData, true
+			}
+		}
+	}
+	return nil, nil, false
 }
 
 func testConnection() error {
@@ -72,9 +842,54 @@ func testConnection() error {
 	return err
 }
 
+// 所有ClickHouse查询共用的HTTP客户端，代理由 -proxy 参数或 HTTP_PROXY/HTTPS_PROXY 环境变量决定
+var httpClient = http.DefaultClient
+
+// 按 -proxy 参数构建共享的HTTP客户端；参数为空时沿用 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 环境变量
+func setupHTTPClient(proxy string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q (expected e.g. http://proxy.example.com:3128)", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// ClickHouse字符串字面量：转义反斜杠和单引号。只把单引号写成两个单引号不够，以反斜杠结尾的symbol会转义掉闭合的引号
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// 表名直接拼接进SQL，只允许字母、数字和下划线
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func invalidTableError(table string) error {
+	return fmt.Errorf("invalid table name %q", table)
+}
+
 func executeQuery(query string) (string, error) {
 	// 构建请求URL
-	baseURL := "http://xm.local:8123"
+	baseURL := CLICKHOUSE_URL
 	params := url.Values{}
 	params.Add("database", "feature")
 	params.Add("query", query)
@@ -82,7 +897,7 @@ func executeQuery(query string) (string, error) {
 	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
 
 	// 发送HTTP请求
-	resp, err := http.Get(fullURL)
+	resp, err := httpClient.Get(fullURL)
 	if err != nil {
 		return "", fmt.Errorf("HTTP request failed: %w", err)
 	}
@@ -101,8 +916,31 @@ func executeQuery(query string) (string, error) {
 	return string(body), nil
 }
 
-func queryMarketData() ([]MarketData, error) {
-	query := `
+func queryMarketData(source chartSource) ([]MarketData, error) {
+	if marketSource == SOURCE_DEMO {
+		if replaySession.From != "" {
+			from, _ := time.ParseInLocation("2006-01-02 15:04:05", replaySession.From, time.Local)
+			to, _ := time.ParseInLocation("2006-01-02 15:04:05", replaySession.To, time.Local)
+			return demoTicks(source.symbol, from, to), nil
+		}
+		return demoMarketData(source.symbol), nil
+	}
+
+	if !isIdentifier(source.table) {
+		return nil, invalidTableError(source.table)
+	}
+	table, predicate := preferBarTable(source.table, lastRange), timeRangePredicate(source.table, source.symbol, lastRange)
+	// 分钟线表由 market_cli.go 按标准列名生成，只对原始tick表做列名映射
+	if table == source.table {
+		table = tableSource(table)
+	} else {
+		table = "feature." + table
+	}
+	if replaySession.From != "" {
+		table = tableSource(source.table)
+		predicate = fmt.Sprintf(" AND time >= toDateTime(%s) AND time < toDateTime(%s)", quoteString(replaySession.From), quoteString(replaySession.To))
+	}
+	query := fmt.Sprintf(`
 		SELECT 
 			symbol, 
 			time, 
@@ -116,11 +954,11 @@ func queryMarketData() ([]MarketData, error) {
 			ask_1, 
 			ask_volumn_1, 
 			datetime
-		FROM feature.jm 
-		WHERE symbol = 'jm2509'
+		FROM %s 
+		WHERE symbol = %s%s
 		ORDER BY time ASC 
 		FORMAT TabSeparated
-	`
+	`, table, quoteString(source.symbol), predicate)
 
 	result, err := executeQuery(query)
 	if err != nil {
@@ -130,9 +968,276 @@ func queryMarketData() ([]MarketData, error) {
 	return parseTabSeparatedData(result)
 }
 
-func queryLatestMarketData(limit int) ([]MarketData, error) {
+// 开盘/收盘摘要的交易日划分与Web查看器相同：20:00以后的夜盘归入下一交易日，周五夜盘归入下周一；
+// 日盘15:00收盘后到当晚20:00之前显示当日的收盘和结算
+const (
+	SESSION_CUTOFF_HOUR = 20
+	SESSION_CLOSE_HOUR  = 15
+	// 定期重新查询摘要，盘前、交易中和收盘之间的切换不需要手动刷新
+	SUMMARY_REFRESH_INTERVAL = time.Minute
+)
+
+// 一个交易日的汇总，结算价与交易所的算法相同取全天成交量加权平均价，没有成交量时取收盘价
+type dailyBar struct {
+	day                            string
+	open, high, low, close, settle float64
+	openInterest                   int64
+}
+
+// tick所属的交易日（当天零点）
+func tradingDay(t time.Time) time.Time {
+	shifted := t.Add(time.Duration(24-SESSION_CUTOFF_HOUR) * time.Hour)
+	day := time.Date(shifted.Year(), shifted.Month(), shifted.Day(), 0, 0, 0, 0, t.Location())
+	switch day.Weekday() {
+	case time.Saturday:
+		day = day.AddDate(0, 0, 2)
+	case time.Sunday:
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// 查询合约最近两个交易日的汇总，按交易日降序，聚合方式与Web查看器的 /daily/data 相同
+func queryDailyBars(source chartSource) ([]dailyBar, error) {
+	if marketSource == SOURCE_DEMO {
+		now := time.Now()
+		return demoDailyBars(demoTicks(source.symbol, now.AddDate(0, 0, -10), now)), nil
+	}
+
+	if !isIdentifier(source.table) {
+		return nil, invalidTableError(source.table)
+	}
+	table := tableSource(source.table)
+	shifted := fmt.Sprintf("toDate(time + INTERVAL %d HOUR)", 24-SESSION_CUTOFF_HOUR)
 	query := fmt.Sprintf(`
-		SELECT 
+		SELECT
+			toString(%s + multiIf(toDayOfWeek(%s) = 6, 2, toDayOfWeek(%s) = 7, 1, 0)) AS day,
+			argMin(price, (time, datetime)),
+			max(price),
+			min(price),
+			argMax(price, (time, datetime)),
+			if(sum(diff_vol) > 0, sum(price * diff_vol) / sum(diff_vol), argMax(price, (time, datetime))),
+			argMax(open_interest, (time, datetime))
+		FROM %s
+		WHERE symbol = %s AND time >= (SELECT max(time) FROM %s WHERE symbol = %s) - INTERVAL 10 DAY
+		GROUP BY day
+		ORDER BY day DESC
+		LIMIT 2
+		FORMAT TabSeparated
+	`, shifted, shifted, shifted, table, quoteString(source.symbol), table, quoteString(source.symbol))
+
+	result, err := executeQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	var bars []dailyBar
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		bar := dailyBar{day: fields[0]}
+		for i, p := range []*float64{&bar.open, &bar.high, &bar.low, &bar.close, &bar.settle} {
+			if *p, err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+				return nil, fmt.Errorf("failed to parse daily bar %q: %w", line, err)
+			}
+		}
+		if bar.openInterest, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse daily bar %q: %w", line, err)
+		}
+		bars = append(bars, bar)
+	}
+	return bars, nil
+}
+
+// 演示模式下在本地按交易日汇总，返回最近两个交易日
+func demoDailyBars(data []MarketData) []dailyBar {
+	var bars []dailyBar
+	var turnover, volume float64
+	for _, md := range data {
+		day := tradingDay(md.Time).Format("2006-01-02")
+		price := float64(md.Price)
+		if len(bars) == 0 || bars[0].day != day {
+			bars = append([]dailyBar{{day: day, open: price, high: price, low: price}}, bars...)
+			turnover, volume = 0, 0
+		}
+		bar := &bars[0]
+		bar.high = math.Max(bar.high, price)
+		bar.low = math.Min(bar.low, price)
+		bar.close = price
+		bar.openInterest = int64(md.OpenInterest)
+		turnover += price * float64(md.DiffVol)
+		volume += float64(md.DiffVol)
+		bar.settle = price
+		if volume > 0 {
+			bar.settle = turnover / volume
+		}
+	}
+	if len(bars) > 2 {
+		bars = bars[:2]
+	}
+	return bars
+}
+
+// 状态区的开盘/收盘摘要：当前交易日还没有成交时（盘前）显示上一交易日的结算和收盘，
+// 交易中显示开盘相对前结算的跳空、当日区间和持仓相对上一交易日收盘的变化，日盘收盘后补上当日结算价
+func summaryText(symbol string, bars []dailyBar, now time.Time, numbers numberFormat) string {
+	today := tradingDay(now)
+	var cur, prev *dailyBar
+	if len(bars) > 0 && bars[0].day == today.Format("2006-01-02") {
+		cur = &bars[0]
+		if len(bars) > 1 {
+			prev = &bars[1]
+		}
+	} else if len(bars) > 0 {
+		prev = &bars[0]
+	}
+	tick := tickSizeFor(symbol)
+	price := func(v float64) string {
+		return numbers.format(priceValue(float32(v), tick), "price")
+	}
+
+	closed := !now.Before(today.Add(SESSION_CLOSE_HOUR * time.Hour))
+	phase := "[PRE-OPEN](fg:white)"
+	if cur != nil && closed {
+		phase = "[CLOSED](fg:yellow)"
+	} else if cur != nil {
+		phase = "[OPEN](fg:green)"
+	}
+	parts := []string{fmt.Sprintf(" %s %s %s", strings.ToUpper(symbol), today.Format("2006-01-02"), phase)}
+	if prev != nil {
+		parts = append(parts, fmt.Sprintf("prev settle %s (%s)", price(prev.settle), prev.day))
+	}
+	if cur == nil {
+		if prev != nil {
+			parts = append(parts, "prev close "+price(prev.close), "OI "+numbers.format(float64(prev.openInterest), "oi"))
+		}
+		return strings.Join(parts, " | ")
+	}
+
+	open := "open " + price(cur.open)
+	if prev != nil && prev.settle != 0 {
+		gap := rawPrice(float32(rawPrice(float32(cur.open)) - rawPrice(float32(prev.settle))))
+		if tick > 0 {
+			gap = ticksToPrice(priceToTicks(float32(cur.open), tick)-priceToTicks(float32(prev.settle), tick), tick)
+		}
+		color := "white"
+		if gap > 0 {
+			color = "red"
+		} else if gap < 0 {
+			color = "green"
+		}
+		open += fmt.Sprintf(" [gap %+g, %+.2f%%](fg:%s)", gap, gap/prev.settle*100, color)
+	}
+	parts = append(parts, open, fmt.Sprintf("range %s - %s", price(cur.low), price(cur.high)), "last "+price(cur.close))
+	if closed {
+		parts = append(parts, "settle "+price(cur.settle))
+	}
+	oi := "OI " + numbers.format(float64(cur.openInterest), "oi")
+	if prev != nil {
+		change := cur.openInterest - prev.openInterest
+		sign := ""
+		if change > 0 {
+			sign = "+"
+		}
+		oi += " (" + sign + numbers.format(float64(change), "oi") + ")"
+	}
+	return strings.Join(append(parts, oi), " | ")
+}
+
+// 查询表中的所有合约代码，供合约选择器使用
+func querySymbols(table string) ([]string, error) {
+	if marketSource == SOURCE_DEMO {
+		return demoSymbols[table], nil
+	}
+	if !isIdentifier(table) {
+		return nil, invalidTableError(table)
+	}
+
+	result, err := executeQuery(fmt.Sprintf("SELECT DISTINCT symbol FROM %s ORDER BY symbol FORMAT TabSeparated", tableSource(table)))
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	var symbols []string
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			symbols = append(symbols, line)
+		}
+	}
+	return symbols, nil
+}
+
+// 合约选择器：按 '/' 打开，输入代码、中文名或拼音过滤，上下键选择，回车切换，Esc 取消
+type symbolPicker struct {
+	active  bool
+	query   string
+	symbols []string
+	list    *widgets.List
+}
+
+func newSymbolPicker() *symbolPicker {
+	list := widgets.NewList()
+	list.SelectedRowStyle = termui.NewStyle(termui.ColorBlack, termui.ColorYellow)
+	list.BorderStyle = termui.NewStyle(termui.ColorYellow)
+	return &symbolPicker{list: list}
+}
+
+func (p *symbolPicker) open(table string) error {
+	symbols, err := querySymbols(table)
+	if err != nil {
+		return err
+	}
+	p.symbols = symbols
+	p.query = ""
+	p.active = true
+	p.refresh()
+	return nil
+}
+
+func (p *symbolPicker) refresh() {
+	p.list.Rows = filterSymbols(p.symbols, p.query)
+	p.list.SelectedRow = 0
+	p.list.Title = fmt.Sprintf("Symbol: %s_  (%d/%d)", p.query, len(p.list.Rows), len(p.symbols))
+}
+
+// 处理选择器打开时的按键，返回选中的合约；done 为 true 表示选择器已关闭
+func (p *symbolPicker) handleKey(id string) (selected string, done bool) {
+	switch id {
+	case "<Escape>", "<C-c>":
+		p.active = false
+		return "", true
+	case "<Enter>":
+		p.active = false
+		if len(p.list.Rows) == 0 {
+			return "", true
+		}
+		return p.list.Rows[p.list.SelectedRow], true
+	case "<Up>":
+		p.list.ScrollUp()
+	case "<Down>":
+		p.list.ScrollDown()
+	case "<Backspace>", "<C-<Backspace>>":
+		if runes := []rune(p.query); len(runes) > 0 {
+			p.query = string(runes[:len(runes)-1])
+			p.refresh()
+		}
+	case "<Space>":
+		p.query += " "
+		p.refresh()
+	default:
+		// 普通字符（包括中文输入）的事件ID就是字符本身
+		if !strings.HasPrefix(id, "<") {
+			p.query += id
+			p.refresh()
+		}
+	}
+	return "", false
+}
+
+func queryLatestMarketData(limit int) ([]MarketData, error) {
+	query := fmt.Sprintf(`
+		SELECT 
 			symbol, 
 			time, 
 			price, 
@@ -152,275 +1257,1966 @@ func queryLatestMarketData(limit int) ([]MarketData, error) {
 		FORMAT TabSeparated
 	`, limit)
 
-	result, err := executeQuery(query)
-	if err != nil {
-		return nil, fmt.Errorf("query failed: %w", err)
+	result, err := executeQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	data, err := parseTabSeparatedData(result)
+	if err != nil {
+		return nil, err
+	}
+
+	// 反转数据，使其按时间升序排列
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+
+	return data, nil
+}
+
+// 行情数据来源：clickhouse 查询 xm.local 上的ClickHouse，demo 在本地生成模拟行情，新用户和CI环境不需要数据库
+const (
+	SOURCE_CLICKHOUSE = "clickhouse"
+	SOURCE_DEMO       = "demo"
+)
+
+var marketSource = SOURCE_CLICKHOUSE
+
+// 演示行情从启动前两天的零点开始每2秒一笔，一直生成到当前时间
+const (
+	DEMO_TICK_INTERVAL = 2 * time.Second
+	DEMO_HISTORY_DAYS  = 2
+)
+
+var demoStart = func() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -DEMO_HISTORY_DAYS)
+}()
+
+// 演示模式下合约选择器列出的合约；其它合约代码同样可以直接查询
+var demoSymbols = map[string][]string{
+	"jm": {"jm2509", "jm2601"},
+	"j":  {"j2509", "j2601"},
+	"i":  {"i2509", "i2601"},
+	"rb": {"rb2510", "rb2601"},
+}
+
+// 生成 [from, to) 内的模拟tick：价格按最小变动价位随机游走，偶尔放量，持仓随成交量增减，盘口为一到两个tick的价差。
+// 随机数种子由合约代码决定，同一合约每次生成相同的序列
+func demoTicks(symbol string, from, to time.Time) []MarketData {
+	h := fnv.New64a()
+	h.Write([]byte(symbol))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	tick := tickSizeFor(symbol)
+	if tick <= 0 {
+		tick = 1 // 模拟行情需要价格网格，最小变动价位未知的品种按1生成
+	}
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	last := int64(2000 + rng.Intn(6000)) // 价格，单位为最小变动价位
+	vol, oi := uint32(0), int64(80000+rng.Intn(120000))
+	var data []MarketData
+	for t := demoStart; t.Before(to); t = t.Add(DEMO_TICK_INTERVAL) {
+		last += int64(math.Round(rng.NormFloat64() * 0.8))
+		diffVol := int32(1 + rng.Intn(12))
+		if rng.Intn(50) == 0 {
+			diffVol *= int32(5 + rng.Intn(10))
+		}
+		diffOI := int32(math.Round(rng.NormFloat64() * float64(diffVol) * 0.4))
+		if oi+int64(diffOI) < 0 {
+			diffOI = int32(-oi)
+		}
+		vol += uint32(diffVol)
+		oi += int64(diffOI)
+
+		spread := int64(1)
+		if rng.Intn(10) == 0 {
+			spread = 2
+		}
+		bid, ask := last, last+spread
+		if rng.Intn(2) == 0 {
+			bid, ask = last-spread, last
+		}
+		bidVolumn, askVolumn := uint32(1+rng.Intn(200)), uint32(1+rng.Intn(200))
+
+		// 随机数在过滤之前取完，保证不同时间范围得到的是同一条序列
+		if t.Before(from) {
+			continue
+		}
+		data = append(data, MarketData{
+			Symbol:       symbol,
+			Time:         t,
+			Price:        float32(ticksToPrice(last, tick)),
+			Vol:          vol,
+			OpenInterest: uint32(oi),
+			DiffVol:      diffVol,
+			DiffOI:       diffOI,
+			Bid1:         float32(ticksToPrice(bid, tick)),
+			BidVolumn1:   bidVolumn,
+			Ask1:         float32(ticksToPrice(ask, tick)),
+			AskVolumn1:   askVolumn,
+			DateTime:     uint64(t.UnixMilli()),
+		})
+	}
+	return data
+}
+
+// 演示模式下按 -last 截取最近一段时间的数据
+func demoMarketData(symbol string) []MarketData {
+	var from time.Time
+	if lastRange > 0 {
+		from = time.Now().Add(-lastRange)
+	}
+	return demoTicks(symbol, from, time.Now())
+}
+
+// 查询所需的列及其兼容的ClickHouse类型族
+var expectedColumns = []struct {
+	name     string
+	families []string
+}{
+	{"symbol", []string{"String", "FixedString"}},
+	{"time", []string{"DateTime"}},
+	{"price", []string{"Float", "Decimal"}},
+	{"vol", []string{"UInt", "Int"}},
+	{"open_interest", []string{"UInt", "Int"}},
+	{"diff_vol", []string{"Int", "UInt"}},
+	{"diff_oi", []string{"Int", "UInt"}},
+	{"bid_1", []string{"Float", "Decimal"}},
+	{"bid_volumn_1", []string{"UInt", "Int"}},
+	{"ask_1", []string{"Float", "Decimal"}},
+	{"ask_volumn_1", []string{"UInt", "Int"}},
+	{"datetime", []string{"UInt", "Int"}},
+}
+
+// 通过 DESCRIBE 检查表结构，缺少列或类型不兼容时返回列出具体列名的错误，
+// 避免解析时静默跳过所有行后只报 "No data found"
+func validateSchema(table string) error {
+	if !isIdentifier(table) {
+		return invalidTableError(table)
+	}
+	result, err := executeQuery(fmt.Sprintf("DESCRIBE TABLE feature.%s FORMAT TabSeparated", table))
+	if err != nil {
+		return fmt.Errorf("failed to describe table feature.%s: %w", table, err)
+	}
+
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			types[fields[0]] = fields[1]
+		}
+	}
+
+	// 映射到其他列时检查被映射的列，映射为表达式时跳过
+	var missing, mismatched []string
+	for _, col := range expectedColumns {
+		name := col.name
+		if source, ok := config.Fields[table][col.name]; ok {
+			if strings.ContainsAny(source, "( )") {
+				continue
+			}
+			name = source
+		}
+		typ, ok := types[name]
+		if !ok {
+			if name != col.name {
+				missing = append(missing, fmt.Sprintf("%s (mapped to %s)", col.name, name))
+			} else {
+				missing = append(missing, col.name)
+			}
+			continue
+		}
+
+		// 去掉 Nullable(...) / LowCardinality(...) 包装后比较类型族
+		base := typ
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			for strings.HasPrefix(base, wrapper) {
+				base = strings.TrimSuffix(strings.TrimPrefix(base, wrapper), ")")
+			}
+		}
+		compatible := false
+		for _, family := range col.families {
+			if strings.HasPrefix(base, family) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s (expected %s)", name, typ, strings.Join(col.families, "/")))
+		}
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		problems = append(problems, "incompatible types: "+strings.Join(mismatched, "; "))
+	}
+	return fmt.Errorf("table feature.%s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+}
+
+// 解析相对时间范围，支持 s/m/h/d/w 单位，如 30m、2h、1d、5d；空字符串或 all 表示全部历史
+func parseRelativeRange(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" || spec == "all" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	unit, ok := units[spec[len(spec)-1]]
+	n, err := strconv.Atoi(spec[:len(spec)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q: expected forms like 30m, 2h, 1d, 5d or all", spec)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// 将相对时间范围转换为ClickHouse时间条件，以该symbol的最新数据时间为基准，
+// 这样对已停止交易的合约也能得到有意义的结果
+func timeRangePredicate(table, symbol string, d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" AND time >= (SELECT max(time) FROM %s WHERE symbol = %s) - INTERVAL %d SECOND",
+		tableSource(table), quoteString(symbol), int64(d/time.Second))
+}
+
+// 宽时间范围（超过1天或全部历史）优先读取 market_cli.go bars build 生成的分钟线表
+const BAR_TABLE_MIN_RANGE = 24 * time.Hour
+
+// 返回查询应使用的数据源，分钟线表不存在时回退到原始tick表
+func preferBarTable(table string, span time.Duration) string {
+	if span > 0 && span <= BAR_TABLE_MIN_RANGE {
+		return table
+	}
+
+	barTable := table + "_bars_1m"
+	result, err := executeQuery("EXISTS TABLE feature." + barTable)
+	if err != nil || strings.TrimSpace(result) != "1" {
+		return table
+	}
+
+	fmt.Printf("Using minute bar table feature.%s for a wide time range\n", barTable)
+	return barTable + " FINAL"
+}
+
+// 解析时被跳过的行按错误类型分类
+const (
+	PARSE_ERROR_SHORT_ROW     = "short_row"
+	PARSE_ERROR_TIME          = "bad_time"
+	PARSE_ERROR_PRICE         = "bad_price"
+	PARSE_ERROR_VOL           = "bad_vol"
+	PARSE_ERROR_OPEN_INTEREST = "bad_open_interest"
+)
+
+// 启动以来解析时跳过的行数，按错误类型计数，界面上显示汇总
+var parseErrors = make(map[string]int)
+
+// 记录一行被跳过的原因，同时写日志
+func recordParseError(kind string, err error) {
+	log.Printf("Skipping row (%s): %v", kind, err)
+	parseErrors[kind]++
+}
+
+// 跳过的总行数和按次数从多到少排列的明细，例如 "bad_price 2, short_row 1"
+func parseErrorSummary() (int, string) {
+	kinds := make([]string, 0, len(parseErrors))
+	total := 0
+	for kind, count := range parseErrors {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if parseErrors[kinds[i]] != parseErrors[kinds[j]] {
+			return parseErrors[kinds[i]] > parseErrors[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s %d", kind, parseErrors[kind])
+	}
+	return total, strings.Join(parts, ", ")
+}
+
+func parseTabSeparatedData(data string) ([]MarketData, error) {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	var marketData []MarketData
+
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 12 {
+			recordParseError(PARSE_ERROR_SHORT_ROW, fmt.Errorf("expected 12 fields, got %d", len(fields)))
+			continue
+		}
+
+		// 解析时间
+		timeStr := fields[1]
+		parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
+		if err != nil {
+			recordParseError(PARSE_ERROR_TIME, err)
+			continue
+		}
+
+		// 解析价格
+		price, err := strconv.ParseFloat(fields[2], 32)
+		if err != nil {
+			recordParseError(PARSE_ERROR_PRICE, err)
+			continue
+		}
+
+		// 解析成交量
+		vol, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			recordParseError(PARSE_ERROR_VOL, err)
+			continue
+		}
+
+		// 解析持仓量
+		openInterest, err := strconv.ParseUint(fields[4], 10, 32)
+		if err != nil {
+			recordParseError(PARSE_ERROR_OPEN_INTEREST, err)
+			continue
+		}
+
+		// 解析其他字段
+		diffVol, _ := strconv.ParseInt(fields[5], 10, 32)
+		diffOI, _ := strconv.ParseInt(fields[6], 10, 32)
+		bid1, _ := strconv.ParseFloat(fields[7], 32)
+		bidVolumn1, _ := strconv.ParseUint(fields[8], 10, 32)
+		ask1, _ := strconv.ParseFloat(fields[9], 32)
+		askVolumn1, _ := strconv.ParseUint(fields[10], 10, 32)
+		datetime, _ := strconv.ParseUint(fields[11], 10, 64)
+
+		md := MarketData{
+			Symbol:       fields[0],
+			Time:         parsedTime,
+			Price:        float32(price),
+			Vol:          uint32(vol),
+			OpenInterest: uint32(openInterest),
+			DiffVol:      int32(diffVol),
+			DiffOI:       int32(diffOI),
+			Bid1:         float32(bid1),
+			BidVolumn1:   uint32(bidVolumn1),
+			Ask1:         float32(ask1),
+			AskVolumn1:   uint32(askVolumn1),
+			DateTime:     datetime,
+		}
+
+		marketData = append(marketData, md)
+	}
+
+	return marketData, nil
+}
+
+// termui Plot 的纵轴标签宽度（widgets 包内未导出的 yAxisLabelsWidth），数据从其右侧一列开始绘制
+const (
+	PLOT_Y_LABEL_WIDTH = 4
+	TIME_LABEL_GAP     = 3
+)
+
+// 带时间刻度的折线图：termui 的 Plot 在x轴下方只显示数据点序号，
+// 这里在同一行改为显示对应tick的时间，并在x轴上标出刻度位置
+type timePlot struct {
+	*widgets.Plot
+	// 与 Data 中各点一一对应的时间
+	Times []time.Time
+	// 回放片段的入点/出点，落在窗口内时画成竖线
+	Marks []time.Time
+	// 右轴序列（原始持仓量）：按自身的最小/最大值缩放，刻度标在绘图区右侧；
+	// 没有有效值时不画
+	Secondary      []float64
+	SecondaryColor termui.Color
+	// 价位线：在价格对应的行上用虚线画出，只覆盖空白的格子，不遮挡折线
+	Levels []float64
+}
+
+func newTimePlot() *timePlot {
+	return &timePlot{Plot: widgets.NewPlot()}
+}
+
+func (p *timePlot) Draw(buf *termui.Buffer) {
+	p.Plot.Draw(buf)
+	p.drawSecondary(buf)
+	p.drawLevels(buf)
+	if !p.ShowAxes || len(p.Times) == 0 {
+		return
+	}
+
+	// 跨天时带上日期，否则只显示时分秒
+	layout := "15:04:05"
+	first, last := p.Times[0], p.Times[len(p.Times)-1]
+	if first.YearDay() != last.YearDay() || first.Year() != last.Year() {
+		layout = "01-02 15:04"
+	}
+
+	labelRow := p.Inner.Max.Y - 1
+	axisRow := labelRow - 1
+	for x := p.Inner.Min.X; x < p.Inner.Max.X; x++ {
+		buf.SetCell(termui.NewCell(' '), image.Pt(x, labelRow))
+	}
+
+	style := termui.NewStyle(termui.ColorWhite)
+	originX := p.Inner.Min.X + PLOT_Y_LABEL_WIDTH + 1
+	for x := originX; x+len(layout) <= p.Inner.Max.X; x += len(layout) + TIME_LABEL_GAP {
+		i := (x - originX) / p.HorizontalScale
+		if i >= len(p.Times) {
+			break
+		}
+		buf.SetCell(termui.NewCell('┬', style), image.Pt(x, axisRow))
+		buf.SetString(p.Times[i].Format(layout), style, image.Pt(x, labelRow))
+	}
+
+	markStyle := termui.NewStyle(termui.ColorYellow)
+	for _, mark := range p.Marks {
+		if mark.Before(first) || mark.After(last) {
+			continue
+		}
+		i := sort.Search(len(p.Times), func(i int) bool { return !p.Times[i].Before(mark) })
+		// 盲文点阵模式下每个字符格横向有两个点
+		x := originX + i*p.HorizontalScale
+		if p.Marker == widgets.MarkerBraille {
+			x = originX + i*p.HorizontalScale/2
+		}
+		if x >= p.Inner.Max.X {
+			continue
+		}
+		for y := p.Inner.Min.Y; y < axisRow; y++ {
+			buf.SetCell(termui.NewCell('┊', markStyle), image.Pt(x, y))
+		}
+	}
+}
+
+// 在 Plot 的绘图区内按右轴范围画出 Secondary，点的横向位置与 Plot 自己的折线一致。
+// 缺失（NaN/Inf）的点处断开，不当作0画到底部
+func (p *timePlot) drawSecondary(buf *termui.Buffer) {
+	lo, hi, ok := oiRange(p.Secondary)
+	if !ok || len(p.Secondary) < 2 {
+		return
+	}
+
+	drawArea := p.Inner
+	if p.ShowAxes {
+		drawArea = image.Rect(p.Inner.Min.X+PLOT_Y_LABEL_WIDTH+1, p.Inner.Min.Y, p.Inner.Max.X, p.Inner.Max.Y-2)
+	}
+	if drawArea.Dy() < 2 {
+		return
+	}
+	height := func(v float64) int {
+		return int((v - lo) / (hi - lo) * float64(drawArea.Dy()-1))
+	}
+
+	style := termui.NewStyle(p.SecondaryColor)
+	canvas := termui.NewCanvas()
+	canvas.Rectangle = drawArea
+	for j := 1; j < len(p.Secondary); j++ {
+		prev, val := p.Secondary[j-1], p.Secondary[j]
+		if math.IsNaN(prev) || math.IsInf(prev, 0) || math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+		if p.Marker == widgets.MarkerBraille {
+			canvas.SetLine(
+				image.Pt((drawArea.Min.X+(j-1)*p.HorizontalScale)*2, (drawArea.Max.Y-height(prev)-1)*4),
+				image.Pt((drawArea.Min.X+j*p.HorizontalScale)*2, (drawArea.Max.Y-height(val)-1)*4),
+				p.SecondaryColor,
+			)
+			continue
+		}
+		pt := image.Pt(drawArea.Min.X+j*p.HorizontalScale, drawArea.Max.Y-height(val)-1)
+		if pt.In(drawArea) {
+			buf.SetCell(termui.NewCell(p.DotMarkerRune, style), pt)
+		}
+	}
+	canvas.Draw(buf)
+
+	if !p.ShowAxes {
+		return
+	}
+	// 右轴刻度：与左轴一样隔一行标一个值，用序列颜色区分
+	for row := 0; row < drawArea.Dy(); row += 2 {
+		value := lo + float64(row)/float64(drawArea.Dy()-1)*(hi-lo)
+		label := strconv.FormatFloat(value, 'f', 0, 64)
+		x := drawArea.Max.X - len(label)
+		if x <= drawArea.Min.X {
+			break
+		}
+		buf.SetString(label, style, image.Pt(x, drawArea.Max.Y-1-row))
+	}
+}
+
+// 按 Plot 的纵轴缩放（以0为下限、MaxVal 或数据最大值为上限）画出价位线，超出范围的不画
+func (p *timePlot) drawLevels(buf *termui.Buffer) {
+	if len(p.Levels) == 0 || len(p.Data) == 0 {
+		return
+	}
+	maxVal := p.MaxVal
+	if maxVal == 0 {
+		maxVal = findMax(p.Data[0])
+	}
+	drawArea := p.Inner
+	if p.ShowAxes {
+		drawArea = image.Rect(p.Inner.Min.X+PLOT_Y_LABEL_WIDTH+1, p.Inner.Min.Y, p.Inner.Max.X, p.Inner.Max.Y-2)
+	}
+	if maxVal <= 0 || drawArea.Dy() < 2 {
+		return
+	}
+
+	style := termui.NewStyle(termui.ColorYellow)
+	for _, level := range p.Levels {
+		if level <= 0 || level > maxVal {
+			continue
+		}
+		y := drawArea.Max.Y - 1 - int(level/maxVal*float64(drawArea.Dy()-1))
+		for x := drawArea.Min.X; x < drawArea.Max.X; x++ {
+			if r := buf.GetCell(image.Pt(x, y)).Rune; r == ' ' || r == 0 {
+				buf.SetCell(termui.NewCell('┈', style), image.Pt(x, y))
+			}
+		}
+		buf.SetString(strconv.FormatFloat(level, 'f', -1, 64), style, image.Pt(drawArea.Min.X, y))
+	}
+}
+
+// 两次重绘之间的默认最小间隔，可以用配置项 render_interval 修改
+const DEFAULT_RENDER_INTERVAL = 100 * time.Millisecond
+
+// 终端重绘器：状态变化后调用 update，flush 只重绘内容指纹变化过的组件，而不是每次清屏后重画全部组件；
+// 两次重绘至少间隔 interval，间隔内的多次更新在 due() 到期时合并成一次，快速刷新时不再闪烁。
+// 只有窗口大小变化时才清屏，弹出层（合约选择器）打开时总是画在最上面，关闭后重画被它遮住的组件
+type screenRenderer struct {
+	interval time.Duration
+	items    []termui.Drawable
+	overlay  func() termui.Drawable
+
+	dirty        bool
+	clear        bool
+	prints       map[termui.Drawable]uint64
+	overlayShown bool
+	last         time.Time
+	timer        *time.Timer
+}
+
+func newScreenRenderer(interval time.Duration, items []termui.Drawable, overlay func() termui.Drawable) *screenRenderer {
+	return &screenRenderer{interval: interval, items: items, overlay: overlay, prints: map[termui.Drawable]uint64{}}
+}
+
+// 标记状态可能变化，下一次 flush 时比较各组件的指纹
+func (s *screenRenderer) update() {
+	s.dirty = true
+}
+
+// 窗口大小变化：清屏后重画全部组件
+func (s *screenRenderer) resize() {
+	s.dirty, s.clear = true, true
+}
+
+// 合并重绘到期的通道，没有等待中的重绘时返回nil（select 中永远不会就绪）
+func (s *screenRenderer) due() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.C
+}
+
+// 重绘变化过的组件；距上次重绘不足 interval 时推迟到 due() 到期
+func (s *screenRenderer) flush() {
+	if !s.dirty {
+		return
+	}
+	if wait := s.interval - time.Since(s.last); wait > 0 {
+		if s.timer == nil {
+			s.timer = time.NewTimer(wait)
+		}
+		return
+	}
+	s.timer, s.dirty = nil, false
+	s.last = time.Now()
+
+	overlay := s.overlay()
+	// 关闭弹出层后它遮住的区域需要重画，直接重画全部组件
+	full := s.clear || (s.overlayShown && overlay == nil)
+	if s.clear {
+		termui.Clear()
+	}
+	s.clear, s.overlayShown = false, overlay != nil
+
+	var changed []termui.Drawable
+	for _, item := range s.items {
+		print, ok := widgetFingerprint(item)
+		if full || !ok || s.prints[item] != print {
+			changed = append(changed, item)
+		}
+		s.prints[item] = print
+	}
+	if overlay != nil {
+		changed = append(changed, overlay)
+	}
+	if len(changed) > 0 {
+		termui.Render(changed...)
+	}
+}
+
+// 组件内容的指纹：包括位置、标题和要画的数据，不认识的组件返回 false，每次都重画
+func widgetFingerprint(item termui.Drawable) (uint64, bool) {
+	h := fnv.New64a()
+	var b [8]byte
+	putUint := func(v uint64) {
+		for i := range b {
+			b[i] = byte(v >> (8 * i))
+		}
+		h.Write(b[:])
+	}
+	putFloats := func(values []float64) {
+		putUint(uint64(len(values)))
+		for _, v := range values {
+			putUint(math.Float64bits(v))
+		}
+	}
+	putTimes := func(times []time.Time) {
+		putUint(uint64(len(times)))
+		for _, t := range times {
+			putUint(uint64(t.UnixNano()))
+		}
+	}
+	rect := item.GetRect()
+	for _, v := range []int{rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y} {
+		putUint(uint64(v))
+	}
+	switch w := item.(type) {
+	case *timePlot:
+		h.Write([]byte(w.Title))
+		putUint(math.Float64bits(w.MaxVal))
+		putUint(uint64(len(w.Data)))
+		for _, series := range w.Data {
+			putFloats(series)
+		}
+		putFloats(w.Secondary)
+		putFloats(w.Levels)
+		putTimes(w.Times)
+		putTimes(w.Marks)
+	case *widgets.Paragraph:
+		h.Write([]byte(w.Title + "\x00" + w.Text))
+	default:
+		return 0, false
+	}
+	return h.Sum64(), true
+}
+
+func createChart(allData []MarketData, splitData []MarketData, keyMap map[string]string) {
+	if len(allData) == 0 {
+		log.Fatal("No data to display")
+	}
+
+	// 创建线图组件
+	lineChart := newTimePlot()
+	lineChart.Title = strings.ToUpper(primarySource.symbol) + " - " + seriesLabel() + " and Open Interest Chart (Scrolling Window)"
+	lineChart.Data = make([][]float64, 1)
+	lineChart.LineColors[0] = termui.ColorGreen // 价格线 - 绿色
+	lineChart.SecondaryColor = termui.ColorRed  // 持仓量线 - 红色，右轴
+	lineChart.AxesColor = termui.ColorWhite
+
+	// 分屏模式下的第二个合约图表
+	split := splitSource.symbol != ""
+	splitChart := newTimePlot()
+	splitChart.Data = make([][]float64, 1)
+	splitChart.LineColors[0] = termui.ColorCyan     // 价格线 - 青色
+	splitChart.SecondaryColor = termui.ColorMagenta // 持仓量线 - 品红，右轴
+	splitChart.AxesColor = termui.ColorWhite
+
+	info := widgets.NewParagraph()
+	info.Title = "Legend & Controls"
+	info.Text = "Green Line: " + seriesLabel() + "\nRed Line: Open Interest (right axis)"
+
+	stats := widgets.NewParagraph()
+	stats.Title = "Statistics"
+
+	// 单行状态栏：无边框，内边距取-1使内容区域等于整行
+	statusBar := widgets.NewParagraph()
+	statusBar.Border = false
+	statusBar.PaddingLeft, statusBar.PaddingRight = -1, -1
+	statusBar.PaddingTop, statusBar.PaddingBottom = -1, -1
+
+	// 状态栏下方一行的开盘/收盘摘要，与Web查看器页头的横幅相同
+	summaryBar := widgets.NewParagraph()
+	summaryBar.Border = false
+	summaryBar.PaddingLeft, summaryBar.PaddingRight = -1, -1
+	summaryBar.PaddingTop, summaryBar.PaddingBottom = -1, -1
+
+	dataHost := CLICKHOUSE_URL
+	if u, err := url.Parse(CLICKHOUSE_URL); err == nil {
+		dataHost = u.Host
+	}
+	lastRefresh := time.Now()
+	var refreshErr error
+	// 状态栏上的临时提示，例如导出结果
+	notice := ""
+	// 主合约的价位线，启动、刷新和切换合约时从 -levels-file 重新读取，读取失败时不画
+	var levels []priceLevel
+	reloadLevels := func() {
+		var err error
+		if levels, err = loadLevels(levelsPath, primarySource.symbol); err != nil {
+			log.Printf("Failed to load levels: %v", err)
+		}
+	}
+	reloadLevels()
+	// 共享回放显示的是历史交易日，不显示摘要
+	reloadSummary := func() {
+		if replayStates != nil {
+			return
+		}
+		bars, err := queryDailyBars(primarySource)
+		if err != nil {
+			log.Printf("Failed to load session summary: %v", err)
+			summaryBar.Text = " [session summary unavailable](fg:red)"
+			return
+		}
+		summaryBar.Text = summaryText(primarySource.symbol, bars, time.Now(), config.NumberFormat)
+	}
+	reloadSummary()
+
+	drawables := []termui.Drawable{lineChart, info, stats, statusBar, summaryBar}
+	picker := newSymbolPicker()
+	if split {
+		drawables = append(drawables, splitChart)
+		info.Text = fmt.Sprintf("Top: %s  Bottom: %s\nGreen/Cyan: %s\nRed/Magenta: Open Interest (right axis)",
+			strings.ToUpper(primarySource.symbol), strings.ToUpper(splitSource.symbol), seriesLabel())
+	}
+
+	// 设置初始布局
+	updateLayout := func() {
+		termWidth, termHeight := termui.TerminalDimensions()
+		chartHeight := termHeight - 20
+		if split {
+			lineChart.SetRect(0, 0, termWidth, chartHeight/2)
+			splitChart.SetRect(0, chartHeight/2, termWidth, chartHeight)
+		} else {
+			lineChart.SetRect(0, 0, termWidth, chartHeight)
+		}
+		info.SetRect(0, termHeight-20, termWidth/2, termHeight-10)
+		stats.SetRect(termWidth/2, termHeight-20, termWidth, termHeight-10)
+		statusBar.SetRect(0, termHeight-10, termWidth, termHeight-9)
+		summaryBar.SetRect(0, termHeight-9, termWidth, termHeight-8)
+		picker.list.SetRect(termWidth/4, 2, termWidth*3/4, chartHeight-2)
+	}
+	updateLayout()
+
+	// 共享回放时只显示回放时钟之前的数据，房间关闭后恢复显示整个交易时段；
+	// 折线图至少需要两个点，时钟停在第一笔tick时多显示一笔
+	syncClosed := false
+	recordCount := func() int {
+		if replayStates != nil {
+			if n := replayClockIndex(allData, replaySession.Clock); n > 2 {
+				return n
+			}
+			if len(allData) < 2 {
+				return len(allData)
+			}
+			return 2
+		}
+		return len(allData)
+	}
+
+	// 数据窗口索引和窗口大小（可缩放），paused 为 true 时停止自动滚动
+	windowStart := 0
+	windowSize := WINDOW_SIZE
+	totalRecords := recordCount()
+	paused := false
+	// 锁定纵轴：termui 的折线图以0为下限、按窗口最大值缩放，锁定后保持锁定时的上限，自动滚动时不再随窗口变化
+	scaleLocked := false
+	configMaxVal := 0.0
+	if config.YMax != nil {
+		configMaxVal = *config.YMax
+	}
+	lineChart.MaxVal = configMaxVal
+	// 自动跟随：窗口位于最右端时开启，刷新得到新数据后窗口保持在最右端；
+	// 向左滚动回看历史时关闭，刷新后窗口停留在原来的位置，滚动回最右端或按跟随键时重新开启
+	atRightEdge := func() bool { return windowStart+windowSize >= totalRecords }
+	if replayStates != nil {
+		windowStart = totalRecords - windowSize
+		if windowStart < 0 {
+			windowStart = 0
+		}
+	}
+	// 恢复上次的窗口大小和滚动位置：上次跟随最新数据时贴到最右端，否则窗口最右端回到上次查看的时间
+	if replayStates == nil {
+		if restoredState.WindowSize >= MIN_WINDOW_SIZE && restoredState.WindowSize <= MAX_WINDOW_SIZE {
+			windowSize = restoredState.WindowSize
+		}
+		if restoredState.Follow {
+			windowStart = totalRecords - windowSize
+		} else if end, err := time.ParseInLocation("2006-01-02 15:04:05", restoredState.WindowEnd, time.Local); err == nil {
+			windowStart = sort.Search(totalRecords, func(i int) bool { return allData[i].Time.After(end) }) - windowSize
+		}
+		if windowStart < 0 {
+			windowStart = 0
+		}
+	}
+	follow := atRightEdge()
+	// 回放片段的入点和出点，取标记时窗口最右端（即回放当前位置）的时间，刷新或切换数据后仍然有效
+	var markIn, markOut time.Time
+
+	// 更新状态栏：连接状态、数据源、合约、最后刷新时间、回放/实时模式和主要按键
+	updateStatus := func() {
+		conn := "[●](fg:green)"
+		if refreshErr != nil {
+			conn = "[● refresh failed](fg:red)"
+		}
+		mode := "[REPLAY](fg:yellow)"
+		if paused {
+			mode = "[PAUSED](fg:red)"
+		} else if windowStart+windowSize >= totalRecords {
+			mode = "[LIVE](fg:green)"
+		}
+		if replayStates != nil {
+			mode = fmt.Sprintf("[SYNC %s %gx %s](fg:magenta)", replaySession.Room, replaySession.Speed, replaySession.Clock)
+			if !replaySession.Playing {
+				mode += " [PAUSED](fg:red)"
+			}
+		} else if syncClosed {
+			mode = fmt.Sprintf("[SYNC %s CLOSED](fg:red)", replaySession.Room)
+		}
+		if scaleLocked {
+			mode += " [Y-LOCK](fg:cyan)"
+		}
+		if !markIn.IsZero() || !markOut.IsZero() {
+			clip := "IN --:--:--"
+			if !markIn.IsZero() {
+				clip = "IN " + markIn.Format("15:04:05")
+			}
+			if !markOut.IsZero() {
+				clip += " OUT " + markOut.Format("15:04:05")
+			}
+			mode += " [" + clip + "](fg:yellow)"
+		}
+		if follow {
+			mode += " [FOLLOW](fg:green)"
+		} else if behind := totalRecords - windowStart - windowSize; behind > 0 {
+			mode += fmt.Sprintf(" [FOLLOW OFF, %d newer](fg:yellow)", behind)
+		}
+		symbols := strings.ToUpper(primarySource.symbol)
+		if split {
+			symbols += " / " + strings.ToUpper(splitSource.symbol)
+		}
+		statusBar.Text = fmt.Sprintf(" %s %s | %s | %s | refreshed %s | %s:quit %s:refresh %s:search %s/%s:scroll %s/%s:zoom %s:pause %s:follow %s:export %s/%s:in/out %s:clip",
+			conn, dataHost, symbols, mode, lastRefresh.Format("15:04:05"),
+			keyHint(keyMap, ACTION_QUIT), keyHint(keyMap, ACTION_REFRESH), keyHint(keyMap, ACTION_SEARCH),
+			keyHint(keyMap, ACTION_SCROLL_LEFT), keyHint(keyMap, ACTION_SCROLL_RIGHT),
+			keyHint(keyMap, ACTION_ZOOM_IN), keyHint(keyMap, ACTION_ZOOM_OUT), keyHint(keyMap, ACTION_PAUSE),
+			keyHint(keyMap, ACTION_FOLLOW), keyHint(keyMap, ACTION_EXPORT),
+			keyHint(keyMap, ACTION_MARK_IN), keyHint(keyMap, ACTION_MARK_OUT), keyHint(keyMap, ACTION_EXPORT_CLIP))
+		if notice != "" {
+			statusBar.Text += " | " + notice
+		}
+	}
+
+	// 更新图表数据的函数
+	updateChart := func() {
+		windowEnd := windowStart + windowSize
+		if windowEnd > totalRecords {
+			windowEnd = totalRecords
+		}
+
+		if windowStart >= totalRecords {
+			windowStart = totalRecords - windowSize
+			if windowStart < 0 {
+				windowStart = 0
+			}
+			windowEnd = totalRecords
+		}
+
+		currentData := allData[windowStart:windowEnd]
+
+		if len(currentData) < 2 {
+			return
+		}
+
+		// 准备数据
+		priceData := make([]float64, len(currentData))
+		oiData := make([]float64, len(currentData))
+		times := make([]time.Time, len(currentData))
+
+		for i, record := range currentData {
+			priceData[i] = seriesValue(record)
+			oiData[i] = float64(record.OpenInterest)
+			times[i] = record.Time
+		}
+
+		// 更新图表数据：持仓量按原值画在右轴上
+		lineChart.Data[0] = priceData
+		lineChart.Secondary = oiData
+		lineChart.Times = times
+		lineChart.Levels = lineChart.Levels[:0]
+		if priceSeries != "spread" {
+			for _, level := range levels {
+				lineChart.Levels = append(lineChart.Levels, level.Price)
+			}
+		}
+		lineChart.Marks = lineChart.Marks[:0]
+		for _, mark := range []time.Time{markIn, markOut} {
+			if !mark.IsZero() {
+				lineChart.Marks = append(lineChart.Marks, mark)
+			}
+		}
+
+		// 更新标题显示当前窗口信息
+		lineChart.Title = fmt.Sprintf("%s - Records %d-%d of %d (Window: %d points)",
+			strings.ToUpper(primarySource.symbol), windowStart+1, windowEnd, totalRecords, len(currentData))
+
+		if split {
+			updateSplitChart(splitChart, currentData, splitData)
+		}
+
+		// 更新统计信息
+		avgPrice := calculateAverage(priceData)
+		avgOI := calculateAverage(oiData)
+		maxPrice := findMax(priceData)
+		minPrice := findMin(priceData)
+
+		var timeRange string
+		if len(currentData) > 0 {
+			timeRange = fmt.Sprintf("%s - %s",
+				currentData[0].Time.Format("15:04:05"),
+				currentData[len(currentData)-1].Time.Format("15:04:05"))
+		}
+
+		label := seriesLabel()
+		numbers := config.NumberFormat
+		stats.Text = fmt.Sprintf("Time Range: %s\nAvg %s: %s\nMax %s: %s\nMin %s: %s\nAvg Open Interest: %s\nWindow: %d/%d",
+			timeRange, label, numbers.format(avgPrice, "price"), label, numbers.format(maxPrice, "price"),
+			label, numbers.format(minPrice, "price"), numbers.format(avgOI, "oi"), windowStart/windowSize+1, (totalRecords+windowSize-1)/windowSize)
+		if skipped, detail := parseErrorSummary(); skipped > 0 {
+			stats.Text += fmt.Sprintf("\n[Skipped: %d rows (%s)](fg:yellow)", skipped, detail)
+		}
+
+		updateStatus()
+	}
+
+	// 初始更新
+	screen := newScreenRenderer(config.renderInterval, drawables, func() termui.Drawable {
+		if picker.active {
+			return picker.list
+		}
+		return nil
+	})
+	updateChart()
+	screen.update()
+
+	// 创建定时器用于自动滚动
+	ticker := time.NewTicker(config.updateInterval)
+	defer ticker.Stop()
+
+	// 退出时和定期保存界面状态，共享回放的合约和位置由房间决定，不保存
+	saveState := func() {
+		if replayStates != nil {
+			return
+		}
+		end := windowStart + windowSize
+		if end > totalRecords {
+			end = totalRecords
+		}
+		err := saveUIState(statePath, "terminal", func(state *uiState) {
+			state.Table, state.Symbol = primarySource.table, primarySource.symbol
+			state.Series = priceSeries
+			state.WindowSize = windowSize
+			state.Follow = follow
+			state.WindowEnd = ""
+			if end > 0 {
+				state.WindowEnd = allData[end-1].Time.Format("2006-01-02 15:04:05")
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to save UI state: %v", err)
+		}
+	}
+	defer saveState()
+	stateTicker := time.NewTicker(STATE_SAVE_INTERVAL)
+	defer stateTicker.Stop()
+	summaryTicker := time.NewTicker(SUMMARY_REFRESH_INTERVAL)
+	defer summaryTicker.Stop()
+
+	// 事件循环：各分支只更新状态并调用 screen.update()，每轮开始时统一按需重绘
+	uiEvents := termui.PollEvents()
+	for {
+		screen.flush()
+		select {
+		case <-screen.due():
+		case e := <-uiEvents:
+			// 合约选择器打开时由选择器处理按键
+			if picker.active && e.Type == termui.KeyboardEvent {
+				selected, done := picker.handleKey(e.ID)
+				if done && selected != "" && selected != primarySource.symbol {
+					source := chartSource{table: primarySource.table, symbol: selected}
+					if newData, err := queryMarketData(source); err != nil {
+						log.Printf("Failed to load %s: %v", selected, err)
+						notice = fmt.Sprintf("[failed to load %s: %v](fg:red)", selected, err)
+						updateStatus()
+					} else if len(newData) < 2 {
+						// 没有数据时保留当前图表，在状态栏提示
+						log.Printf("Not enough data for %s", selected)
+						notice = fmt.Sprintf("[no data for %s in %s, still showing %s](fg:yellow)", selected, primarySource.table, primarySource.symbol)
+						updateStatus()
+					} else {
+						primarySource = source
+						allData = newData
+						reloadLevels()
+						reloadSummary()
+						totalRecords = recordCount()
+						windowStart = 0
+						follow = atRightEdge()
+						lastRefresh = time.Now()
+						updateChart()
+						saveState()
+					}
+				}
+				screen.update()
+				continue
+			}
+
+			if e.ID == "<Resize>" {
+				updateLayout()
+				screen.resize()
+				continue
+			}
+
+			switch keyMap[e.ID] {
+			case ACTION_QUIT:
+				return
+			case ACTION_REFRESH:
+				// 刷新数据
+				newData, err := queryMarketData(primarySource)
+				if err == nil && split {
+					var newSplitData []MarketData
+					if newSplitData, err = queryMarketData(splitSource); err == nil {
+						splitData = newSplitData
+					}
+				}
+				refreshErr = err
+				if err != nil {
+					log.Printf("Failed to refresh data: %v", err)
+					updateStatus()
+				} else if len(newData) == 0 {
+					// 刷新后没有数据（例如 -last 范围内已无成交）时保留当前图表
+					notice = fmt.Sprintf("[no data for %s, keeping previous data](fg:yellow)", primarySource.symbol)
+					updateStatus()
+				} else {
+					// 最新价穿越价位线时在状态栏提示
+					reloadLevels()
+					reloadSummary()
+					prev, cur := seriesValue(allData[len(allData)-1]), seriesValue(newData[len(newData)-1])
+					if crossed := crossedLevel(levels, prev, cur); crossed != "" {
+						log.Printf("%s %s (%g -> %g)", strings.ToUpper(primarySource.symbol), crossed, prev, cur)
+						notice = "[" + crossed + "](fg:magenta)"
+						updateStatus()
+					}
+					allData = newData
+					totalRecords = recordCount()
+					// 跟随时贴到新数据的最右端，否则停留在正在查看的位置
+					if follow {
+						windowStart = totalRecords - windowSize
+					}
+					if windowStart < 0 {
+						windowStart = 0
+					}
+					lastRefresh = time.Now()
+					updateChart()
+				}
+				screen.update()
+			case ACTION_SEARCH:
+				if err := picker.open(primarySource.table); err != nil {
+					log.Printf("Failed to list symbols: %v", err)
+				} else {
+					screen.update()
+				}
+			case ACTION_SCROLL_LEFT:
+				// 向前滚动
+				if windowStart > 0 {
+					windowStart -= windowSize / 4
+					if windowStart < 0 {
+						windowStart = 0
+					}
+					follow = atRightEdge()
+					updateChart()
+					screen.update()
+				}
+			case ACTION_SCROLL_RIGHT:
+				// 向后滚动
+				if windowStart+windowSize < totalRecords {
+					windowStart += windowSize / 4
+					follow = atRightEdge()
+					updateChart()
+					screen.update()
+				}
+			case ACTION_ZOOM_IN, ACTION_ZOOM_OUT:
+				// 以窗口右端为锚点缩放窗口大小
+				windowEnd := windowStart + windowSize
+				if keyMap[e.ID] == ACTION_ZOOM_IN && windowSize > MIN_WINDOW_SIZE {
+					windowSize /= 2
+				} else if keyMap[e.ID] == ACTION_ZOOM_OUT && windowSize < MAX_WINDOW_SIZE {
+					windowSize *= 2
+				}
+				windowStart = windowEnd - windowSize
+				if windowStart < 0 {
+					windowStart = 0
+				}
+				if follow {
+					windowStart = totalRecords - windowSize
+					if windowStart < 0 {
+						windowStart = 0
+					}
+				}
+				updateChart()
+				screen.update()
+			case ACTION_EXPORT:
+				windowEnd := windowStart + windowSize
+				if windowEnd > totalRecords {
+					windowEnd = totalRecords
+				}
+				csvPath, pngPath, err := exportView(config.ExportDir, primarySource, allData[windowStart:windowEnd])
+				if err != nil {
+					notice = fmt.Sprintf("[export failed: %v](fg:red)", err)
+				} else {
+					notice = fmt.Sprintf("[saved %s, %s](fg:green)", csvPath, pngPath)
+				}
+				updateStatus()
+				screen.update()
+			case ACTION_MARK_IN, ACTION_MARK_OUT:
+				// 再次在同一位置标记时取消该标记
+				windowEnd := windowStart + windowSize
+				if windowEnd > totalRecords {
+					windowEnd = totalRecords
+				}
+				if windowEnd > 0 {
+					at := allData[windowEnd-1].Time
+					mark := &markIn
+					if keyMap[e.ID] == ACTION_MARK_OUT {
+						mark = &markOut
+					}
+					if mark.Equal(at) {
+						*mark = time.Time{}
+					} else {
+						*mark = at
+					}
+				}
+				updateChart()
+				screen.update()
+			case ACTION_EXPORT_CLIP:
+				if markIn.IsZero() || markOut.IsZero() {
+					notice = fmt.Sprintf("[mark in/out with %s/%s first](fg:yellow)", keyHint(keyMap, ACTION_MARK_IN), keyHint(keyMap, ACTION_MARK_OUT))
+				} else if clipDir, err := exportClip(config.ExportDir, primarySource, allData, markIn, markOut); err != nil {
+					notice = fmt.Sprintf("[clip export failed: %v](fg:red)", err)
+				} else {
+					notice = fmt.Sprintf("[saved clip %s](fg:green)", clipDir)
+				}
+				updateStatus()
+				screen.update()
+			case ACTION_LOCK_SCALE:
+				scaleLocked = !scaleLocked
+				if scaleLocked {
+					lineChart.MaxVal = findMax(lineChart.Data[0])
+				} else {
+					lineChart.MaxVal = configMaxVal
+				}
+				updateStatus()
+				screen.update()
+			case ACTION_PAUSE:
+				paused = !paused
+				updateStatus()
+				screen.update()
+			case ACTION_FOLLOW:
+				// 开启时立即跳到最右端
+				follow = !follow
+				if follow {
+					windowStart = totalRecords - windowSize
+					if windowStart < 0 {
+						windowStart = 0
+					}
+				}
+				updateChart()
+				screen.update()
+			}
+		case state := <-replayStates:
+			if state.Type == "replay_closed" {
+				replayStates, syncClosed = nil, true
+				totalRecords = recordCount()
+			} else {
+				// 房间切换了合约或交易日时重新加载该交易时段
+				reload := state.Symbol != replaySession.Symbol || state.Date != replaySession.Date
+				replaySession = state
+				if reload {
+					source := chartSource{table: state.Table, symbol: state.Symbol}
+					if newData, err := queryMarketData(source); err != nil {
+						notice = fmt.Sprintf("[failed to load %s: %v](fg:red)", state.Symbol, err)
+					} else if len(newData) == 0 {
+						notice = fmt.Sprintf("[no data for %s on %s](fg:yellow)", state.Symbol, state.Date)
+					} else {
+						primarySource, allData = source, newData
+						lastRefresh = time.Now()
+					}
+				}
+				totalRecords = recordCount()
+			}
+			if follow {
+				windowStart = totalRecords - windowSize
+				if windowStart < 0 {
+					windowStart = 0
+				}
+			}
+			updateChart()
+			screen.update()
+		case <-stateTicker.C:
+			saveState()
+		case <-summaryTicker.C:
+			reloadSummary()
+			screen.update()
+		case <-ticker.C:
+			// 自动向前滚动，暂停、选择合约或跟随共享回放时不滚动
+			if !paused && !picker.active && replayStates == nil && windowStart+windowSize < totalRecords {
+				windowStart += 1
+				follow = atRightEdge()
+				updateChart()
+				screen.update()
+			}
+		}
+	}
+}
+
+// 导出当前窗口：CSV 保存原始数据，PNG 使用与Web查看器相同的go-chart渲染，返回生成的文件路径
+func exportView(dir string, source chartSource, data []MarketData) (string, string, error) {
+	if len(data) < 2 {
+		return "", "", fmt.Errorf("not enough data to export")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%s_%s", source.symbol, time.Now().Format("20060102_150405")))
+	csvPath, pngPath := base+".csv", base+".png"
+
+	if err := writeViewCSV(csvPath, data); err != nil {
+		return "", "", err
+	}
+	if err := writeViewPNG(pngPath, source, data); err != nil {
+		return csvPath, "", err
+	}
+	return csvPath, pngPath, nil
+}
+
+// 导出回放片段：入点到出点之间（含两端）的数据保存到一个目录，包含 clip.csv、用go-chart渲染的 clip.png
+// 和记录合约、入点、出点的 clip.json，便于整体打包分享。入点晚于出点时自动交换
+func exportClip(dir string, source chartSource, data []MarketData, in, out time.Time) (string, error) {
+	if out.Before(in) {
+		in, out = out, in
+	}
+	lo := sort.Search(len(data), func(i int) bool { return !data[i].Time.Before(in) })
+	hi := sort.Search(len(data), func(i int) bool { return data[i].Time.After(out) })
+	clip := data[lo:hi]
+	if len(clip) < 2 {
+		return "", fmt.Errorf("clip %s - %s has fewer than 2 records", in.Format("15:04:05"), out.Format("15:04:05"))
+	}
+
+	clipDir := filepath.Join(dir, fmt.Sprintf("%s_clip_%s_%s", source.symbol, in.Format("20060102_150405"), out.Format("150405")))
+	if err := os.MkdirAll(clipDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create clip directory: %w", err)
+	}
+	if err := writeViewCSV(filepath.Join(clipDir, "clip.csv"), clip); err != nil {
+		return "", err
+	}
+	if err := writeViewPNG(filepath.Join(clipDir, "clip.png"), source, clip); err != nil {
+		return "", err
+	}
+
+	meta, _ := json.MarshalIndent(map[string]interface{}{
+		"table":   source.table,
+		"symbol":  source.symbol,
+		"in":      in.Format("2006-01-02 15:04:05"),
+		"out":     out.Format("2006-01-02 15:04:05"),
+		"records": len(clip),
+	}, "", "  ")
+	if err := os.WriteFile(filepath.Join(clipDir, "clip.json"), append(meta, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write clip.json: %w", err)
+	}
+	return clipDir, nil
+}
+
+func writeViewCSV(path string, data []MarketData) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"symbol", "time", "price", "vol", "open_interest", "diff_vol", "diff_oi",
+		"bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "datetime"})
+	for _, record := range data {
+		w.Write([]string{
+			record.Symbol,
+			record.Time.Format("2006-01-02 15:04:05"),
+			strconv.FormatFloat(float64(record.Price), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.Vol), 10),
+			strconv.FormatUint(uint64(record.OpenInterest), 10),
+			strconv.FormatInt(int64(record.DiffVol), 10),
+			strconv.FormatInt(int64(record.DiffOI), 10),
+			strconv.FormatFloat(float64(record.Bid1), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.BidVolumn1), 10),
+			strconv.FormatFloat(float64(record.Ask1), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.AskVolumn1), 10),
+			strconv.FormatUint(record.DateTime, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func writeViewPNG(path string, source chartSource, data []MarketData) error {
+	// 准备数据
+	xValues := make([]time.Time, len(data))
+	priceValues := make([]float64, len(data))
+	oiValues := make([]float64, len(data))
+
+	for i, record := range data {
+		xValues[i] = record.Time
+		priceValues[i] = seriesValue(record)
+		oiValues[i] = float64(record.OpenInterest)
+	}
+
+	graph := chart.Chart{
+		Title: fmt.Sprintf("%s - %s and Open Interest (%s - %s)", strings.ToUpper(source.symbol), seriesLabel(),
+			data[0].Time.Format("2006-01-02 15:04:05"), data[len(data)-1].Time.Format("15:04:05")),
+		TitleStyle: chart.Style{
+			FontSize: 16,
+		},
+		Width:  1200,
+		Height: 600,
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top:    50,
+				Left:   50,
+				Right:  50,
+				Bottom: 50,
+			},
+		},
+		XAxis: chart.XAxis{
+			Name: "Time",
+			Style: chart.Style{
+				FontSize: 10,
+			},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
+		},
+		YAxis: chart.YAxis{
+			Name: seriesLabel(),
+			Style: chart.Style{
+				FontSize: 10,
+			},
+			Range: configYRange(priceValues),
+		},
+		Series: []chart.Series{
+			chart.TimeSeries{
+				Name: seriesLabel(),
+				Style: chart.Style{
+					StrokeColor: drawing.ColorGreen,
+					StrokeWidth: 2,
+				},
+				XValues: xValues,
+				YValues: priceValues,
+			},
+		},
+	}
+
+	// 持仓量按原值画在右轴上；数据源不提供持仓量时不画这条线和右轴
+	if lo, hi, ok := oiRange(oiValues); ok {
+		graph.YAxisSecondary = chart.YAxis{
+			Name: "Open Interest",
+			Style: chart.Style{
+				FontSize: 10,
+			},
+			Range:          &chart.ContinuousRange{Min: lo, Max: hi},
+			ValueFormatter: chart.IntValueFormatter,
+		}
+		graph.Series = append(graph.Series, chart.TimeSeries{
+			Name: "Open Interest",
+			Style: chart.Style{
+				StrokeColor: drawing.ColorRed,
+				StrokeWidth: 2,
+			},
+			YAxis:   chart.YAxisSecondary,
+			XValues: xValues,
+			YValues: oiValues,
+		})
+	}
+
+	// 价位线：只画落在价格范围内的，不改变纵轴的自动缩放
+	if priceSeries != "spread" {
+		lo, hi := findMin(priceValues), findMax(priceValues)
+		if levels, err := loadLevels(levelsPath, source.symbol); err != nil {
+			log.Printf("Failed to load levels: %v", err)
+		} else {
+			for _, level := range levels {
+				if level.Price < lo || level.Price > hi {
+					continue
+				}
+				graph.Series = append(graph.Series, chart.TimeSeries{
+					Name: strings.TrimSpace(fmt.Sprintf("Level %g %s", level.Price, level.Label)),
+					Style: chart.Style{
+						StrokeColor:     drawing.Color{R: 255, G: 140, B: 0, A: 255},
+						StrokeWidth:     1,
+						StrokeDashArray: []float64{6, 4},
+					},
+					XValues: []time.Time{xValues[0], xValues[len(xValues)-1]},
+					YValues: []float64{level.Price, level.Price},
+				})
+			}
+		}
+	}
+
+	// 添加图例
+	graph.Elements = []chart.Renderable{
+		chart.Legend(&graph),
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := graph.Render(chart.PNG, f); err != nil {
+		return fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// 配置的纵轴范围，未设置的一端取数据的最值；两端都未设置时返回 nil 交给 go-chart 自动缩放
+func configYRange(values []float64) chart.Range {
+	if config.YMin == nil && config.YMax == nil {
+		return nil
+	}
+	lo, hi := findMin(values), findMax(values)
+	if config.YMin != nil {
+		lo = *config.YMin
+	}
+	if config.YMax != nil {
+		hi = *config.YMax
+	}
+	if hi <= lo {
+		if config.YMin == nil {
+			lo = hi - 1
+		} else {
+			hi = lo + 1
+		}
+	}
+	return &chart.ContinuousRange{Min: lo, Max: hi}
+}
+
+// 更新分屏图表：按主图窗口的时间点对第二个合约做as-of对齐（取不晚于该时间的最后一笔），
+// 两个图表的横轴因此一一对应
+func updateSplitChart(splitChart *timePlot, window, splitData []MarketData) {
+	from, to := window[0].Time, window[len(window)-1].Time
+	symbol := strings.ToUpper(splitSource.symbol)
+
+	// 第二个合约按主图的tick时间对齐，共用同样的时间刻度
+	splitChart.Times = make([]time.Time, len(window))
+	for i, record := range window {
+		splitChart.Times[i] = record.Time
 	}
 
-	data, err := parseTabSeparatedData(result)
-	if err != nil {
-		return nil, err
+	// 找到第二个合约中不晚于窗口起点的最后一笔
+	j := sort.Search(len(splitData), func(i int) bool { return splitData[i].Time.After(from) }) - 1
+	if j < 0 {
+		j = 0
 	}
 
-	// 反转数据，使其按时间升序排列
-	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
-		data[i], data[j] = data[j], data[i]
+	if len(splitData) == 0 || splitData[j].Time.After(to) {
+		splitChart.Title = fmt.Sprintf("%s - No data in %s - %s", symbol, from.Format("15:04:05"), to.Format("15:04:05"))
+		splitChart.Data[0] = []float64{0, 0}
+		splitChart.Secondary = nil
+		return
 	}
 
-	return data, nil
+	priceData := make([]float64, len(window))
+	oiData := make([]float64, len(window))
+	for i, record := range window {
+		for j+1 < len(splitData) && !splitData[j+1].Time.After(record.Time) {
+			j++
+		}
+		priceData[i] = seriesValue(splitData[j])
+		oiData[i] = float64(splitData[j].OpenInterest)
+	}
+
+	splitChart.Data[0] = priceData
+	splitChart.Secondary = oiData
+	splitChart.Title = fmt.Sprintf("%s - %s - %s | Last: %.2f | Max: %.2f | Min: %.2f",
+		symbol, from.Format("15:04:05"), to.Format("15:04:05"),
+		priceData[len(priceData)-1], findMax(priceData), findMin(priceData))
 }
 
-func parseTabSeparatedData(data string) ([]MarketData, error) {
-	lines := strings.Split(strings.TrimSpace(data), "\n")
-	var marketData []MarketData
+// 自定义查询模式：-query 给出一条返回 (时间, 数值[, 序列名]) 的查询时，终端画该查询的结果而不是行情。
+// 第三列的每个取值画一条线，各序列按时间对齐，某序列在对齐后缺少的点沿用它的上一个值
+const QUERY_MAX_ROWS = 200000
+
+// 各序列的线条颜色，name 用于图例的样式标记
+var queryLineColors = []struct {
+	color termui.Color
+	name  string
+}{
+	{termui.ColorGreen, "green"}, {termui.ColorRed, "red"}, {termui.ColorCyan, "cyan"}, {termui.ColorMagenta, "magenta"},
+	{termui.ColorYellow, "yellow"}, {termui.ColorBlue, "blue"}, {termui.ColorWhite, "white"},
+}
 
-	for _, line := range lines {
-		if line == "" {
-			continue
+type querySeries struct {
+	name   string
+	values []float64
+}
+
+// 对齐后的查询结果：times 为所有序列时间的并集
+type queryResult struct {
+	valueColumn string
+	times       []time.Time
+	series      []querySeries
+	truncated   bool
+}
+
+// 包装成子查询执行：只接受单条 SELECT/WITH 语句，经GET发送时ClickHouse按只读执行
+func runCustomQuery(sql string) (*queryResult, error) {
+	sql = strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n")
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	if strings.Contains(sql, ";") {
+		return nil, fmt.Errorf("only a single statement is allowed")
+	}
+	if first := strings.ToUpper(fields[0]); first != "SELECT" && first != "WITH" {
+		return nil, fmt.Errorf("only SELECT queries are allowed")
+	}
+	result, err := executeQuery(fmt.Sprintf("SELECT * FROM (%s\n) LIMIT %d FORMAT TabSeparatedWithNames", sql, QUERY_MAX_ROWS+1))
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	return parseQueryResult(result)
+}
+
+// 时间列可以是 Date、DateTime、DateTime64，或秒/毫秒级的Unix时间戳
+func parseQueryTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
 		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("first column %q is not a time", s)
+	}
+	if n > 1e11 {
+		return time.UnixMilli(n), nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// 解析 TabSeparatedWithNames 格式的结果，数值为 NULL 或 nan 的行跳过
+func parseQueryResult(result string) (*queryResult, error) {
+	lines := strings.Split(strings.TrimRight(result, "\n"), "\n")
+	columns := strings.Split(lines[0], "\t")
+	if len(columns) < 2 || len(columns) > 3 {
+		return nil, fmt.Errorf("query must return (time, value[, series]), got %d columns", len(columns))
+	}
+	res := &queryResult{valueColumn: columns[1]}
+	rows := lines[1:]
+	if len(rows) > QUERY_MAX_ROWS {
+		rows, res.truncated = rows[:QUERY_MAX_ROWS], true
+	}
 
+	var names []string
+	values := make(map[string]map[time.Time]float64)
+	for i, line := range rows {
 		fields := strings.Split(line, "\t")
-		if len(fields) < 12 {
-			continue
+		if len(fields) != len(columns) {
+			return nil, fmt.Errorf("row %d has %d columns, expected %d", i+1, len(fields), len(columns))
 		}
-
-		// 解析时间
-		timeStr := fields[1]
-		parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
+		t, err := parseQueryTime(fields[0])
 		if err != nil {
-			log.Printf("Failed to parse time %s: %v", timeStr, err)
-			continue
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
 		}
-
-		// 解析价格
-		price, err := strconv.ParseFloat(fields[2], 32)
-		if err != nil {
-			log.Printf("Failed to parse price %s: %v", fields[2], err)
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
 			continue
 		}
-
-		// 解析成交量
-		vol, err := strconv.ParseUint(fields[3], 10, 32)
-		if err != nil {
-			log.Printf("Failed to parse vol %s: %v", fields[3], err)
-			continue
+		name := columns[1]
+		if len(fields) == 3 {
+			name = fields[2]
 		}
-
-		// 解析持仓量
-		openInterest, err := strconv.ParseUint(fields[4], 10, 32)
-		if err != nil {
-			log.Printf("Failed to parse open_interest %s: %v", fields[4], err)
-			continue
+		if values[name] == nil {
+			if len(names) == len(queryLineColors) {
+				return nil, fmt.Errorf("query returned more than %d series", len(queryLineColors))
+			}
+			names = append(names, name)
+			values[name] = make(map[time.Time]float64)
 		}
+		values[name][t] = v
+	}
 
-		// 解析其他字段
-		diffVol, _ := strconv.ParseInt(fields[5], 10, 32)
-		diffOI, _ := strconv.ParseInt(fields[6], 10, 32)
-		bid1, _ := strconv.ParseFloat(fields[7], 32)
-		bidVolumn1, _ := strconv.ParseUint(fields[8], 10, 32)
-		ask1, _ := strconv.ParseFloat(fields[9], 32)
-		askVolumn1, _ := strconv.ParseUint(fields[10], 10, 32)
-		datetime, _ := strconv.ParseUint(fields[11], 10, 64)
-
-		md := MarketData{
-			Symbol:       fields[0],
-			Time:         parsedTime,
-			Price:        float32(price),
-			Vol:          uint32(vol),
-			OpenInterest: uint32(openInterest),
-			DiffVol:      int32(diffVol),
-			DiffOI:       int32(diffOI),
-			Bid1:         float32(bid1),
-			BidVolumn1:   uint32(bidVolumn1),
-			Ask1:         float32(ask1),
-			AskVolumn1:   uint32(askVolumn1),
-			DateTime:     datetime,
+	seen := make(map[time.Time]bool)
+	for _, name := range names {
+		for t := range values[name] {
+			if !seen[t] {
+				seen[t] = true
+				res.times = append(res.times, t)
+			}
 		}
-
-		marketData = append(marketData, md)
 	}
-
-	return marketData, nil
-}
-
-func createChart(allData []MarketData) {
-	if len(allData) == 0 {
-		log.Fatal("No data to display")
+	sort.Slice(res.times, func(i, j int) bool { return res.times[i].Before(res.times[j]) })
+
+	for _, name := range names {
+		series := querySeries{name: name, values: make([]float64, len(res.times))}
+		// 序列开始之前的点取它的第一个值，之后的缺口沿用上一个值
+		last := 0.0
+		for _, t := range res.times {
+			if v, ok := values[name][t]; ok {
+				last = v
+				break
+			}
+		}
+		for i, t := range res.times {
+			if v, ok := values[name][t]; ok {
+				last = v
+			}
+			series.values[i] = last
+		}
+		res.series = append(res.series, series)
 	}
+	if len(res.times) < 2 {
+		return nil, fmt.Errorf("query returned fewer than 2 points")
+	}
+	return res, nil
+}
 
-	// 创建线图组件
-	lineChart := widgets.NewPlot()
-	lineChart.Title = "JM2509 - Price and Open Interest Chart (Scrolling Window)"
-	lineChart.Data = make([][]float64, 2)
-	lineChart.LineColors[0] = termui.ColorGreen // 价格线 - 绿色
-	lineChart.LineColors[1] = termui.ColorRed   // 持仓量线 - 红色
-	lineChart.AxesColor = termui.ColorWhite
-
-	info := widgets.NewParagraph()
-	info.Title = "Legend & Controls"
-	info.Text = "Green Line: Price\nRed Line: Open Interest (normalized)\n\nPress 'q' to quit\nPress 'r' to refresh data\nLeft/Right: Manual scroll"
-
+// 画自定义查询的结果：左右键滚动、加减号缩放、刷新键重新执行查询
+func createQueryChart(sql string, res *queryResult, keyMap map[string]string) {
+	plot := newTimePlot()
+	plot.AxesColor = termui.ColorWhite
+	legend := widgets.NewParagraph()
+	legend.Title = "Series"
 	stats := widgets.NewParagraph()
 	stats.Title = "Statistics"
+	statusBar := widgets.NewParagraph()
+	statusBar.Border = false
+	statusBar.PaddingLeft, statusBar.PaddingRight = -1, -1
+	statusBar.PaddingTop, statusBar.PaddingBottom = -1, -1
+	drawables := []termui.Drawable{plot, legend, stats, statusBar}
 
-	// 设置初始布局
 	updateLayout := func() {
 		termWidth, termHeight := termui.TerminalDimensions()
-		lineChart.SetRect(0, 0, termWidth, termHeight-20)
-		info.SetRect(0, termHeight-20, termWidth/2, termHeight-10)
-		stats.SetRect(termWidth/2, termHeight-20, termWidth, termHeight-10)
+		plot.SetRect(0, 0, termWidth, termHeight-11)
+		legend.SetRect(0, termHeight-11, termWidth/2, termHeight-1)
+		stats.SetRect(termWidth/2, termHeight-11, termWidth, termHeight-1)
+		statusBar.SetRect(0, termHeight-1, termWidth, termHeight)
 	}
 	updateLayout()
 
-	// 数据窗口索引
-	windowStart := 0
-	totalRecords := len(allData)
-
-	// 更新图表数据的函数
-	updateChart := func() {
-		windowEnd := windowStart + WINDOW_SIZE
-		if windowEnd > totalRecords {
-			windowEnd = totalRecords
+	windowSize := WINDOW_SIZE
+	windowStart := len(res.times) - windowSize
+	notice := ""
+	lastRefresh := time.Now()
+	// 只在按键后更新，不需要合并重绘，但同样只重画变化过的组件
+	screen := newScreenRenderer(0, drawables, func() termui.Drawable { return nil })
+
+	update := func() {
+		total := len(res.times)
+		if windowStart > total-windowSize {
+			windowStart = total - windowSize
 		}
-
-		if windowStart >= totalRecords {
-			windowStart = totalRecords - WINDOW_SIZE
-			if windowStart < 0 {
-				windowStart = 0
-			}
-			windowEnd = totalRecords
+		if windowStart < 0 {
+			windowStart = 0
 		}
-
-		currentData := allData[windowStart:windowEnd]
-
-		if len(currentData) < 2 {
-			return
+		windowEnd := windowStart + windowSize
+		if windowEnd > total {
+			windowEnd = total
 		}
 
-		// 准备数据
-		priceData := make([]float64, len(currentData))
-		oiData := make([]float64, len(currentData))
-
-		for i, record := range currentData {
-			priceData[i] = float64(record.Price)
-			oiData[i] = float64(record.OpenInterest)
+		plot.Data = make([][]float64, len(res.series))
+		legend.Text = ""
+		stats.Text = ""
+		for i, series := range res.series {
+			window := series.values[windowStart:windowEnd]
+			plot.Data[i] = window
+			plot.LineColors[i] = queryLineColors[i].color
+			legend.Text += fmt.Sprintf("[━━](fg:%s) %s\n", queryLineColors[i].name, series.name)
+			stats.Text += fmt.Sprintf("%s: last %.4g  min %.4g  max %.4g\n", series.name, window[len(window)-1], findMin(window), findMax(window))
+		}
+		plot.Times = res.times[windowStart:windowEnd]
+		plot.Title = fmt.Sprintf("%s - Points %d-%d of %d", res.valueColumn, windowStart+1, windowEnd, total)
+
+		statusBar.Text = fmt.Sprintf(" custom query | refreshed %s | %s:quit %s:refresh %s/%s:scroll %s/%s:zoom",
+			lastRefresh.Format("15:04:05"), keyHint(keyMap, ACTION_QUIT), keyHint(keyMap, ACTION_REFRESH),
+			keyHint(keyMap, ACTION_SCROLL_LEFT), keyHint(keyMap, ACTION_SCROLL_RIGHT),
+			keyHint(keyMap, ACTION_ZOOM_IN), keyHint(keyMap, ACTION_ZOOM_OUT))
+		if res.truncated {
+			statusBar.Text += fmt.Sprintf(" | [truncated to %d rows](fg:yellow)", QUERY_MAX_ROWS)
 		}
+		if notice != "" {
+			statusBar.Text += " | " + notice
+		}
+		screen.update()
+		screen.flush()
+	}
+	update()
 
-		// 标准化持仓量数据
-		normalizedOI := normalizeData(oiData, priceData)
+	for e := range termui.PollEvents() {
+		if e.ID == "<Resize>" {
+			updateLayout()
+			screen.resize()
+			update()
+			continue
+		}
+		switch keyMap[e.ID] {
+		case ACTION_QUIT:
+			return
+		case ACTION_REFRESH:
+			if newRes, err := runCustomQuery(sql); err != nil {
+				notice = fmt.Sprintf("[refresh failed: %v](fg:red)", err)
+			} else {
+				// 停在最右端时跟随新数据
+				if windowStart+windowSize >= len(res.times) {
+					windowStart = len(newRes.times)
+				}
+				res, notice, lastRefresh = newRes, "", time.Now()
+			}
+		case ACTION_SCROLL_LEFT:
+			windowStart -= windowSize / 4
+		case ACTION_SCROLL_RIGHT:
+			windowStart += windowSize / 4
+		case ACTION_ZOOM_IN:
+			if windowSize > MIN_WINDOW_SIZE {
+				windowStart += windowSize / 2
+				windowSize /= 2
+			}
+		case ACTION_ZOOM_OUT:
+			if windowSize < MAX_WINDOW_SIZE {
+				windowStart -= windowSize
+				windowSize *= 2
+			}
+		default:
+			continue
+		}
+		update()
+	}
+}
 
-		// 更新图表数据
-		lineChart.Data[0] = priceData
-		lineChart.Data[1] = normalizedOI
+// 加入Web服务器上的共享回放房间（-replay-server/-replay-room）时，终端查看器只加载该交易时段的数据，
+// 窗口右端跟随服务端广播的回放时钟，不再自动滚动
+type replayState struct {
+	Type    string  `json:"type"`
+	Room    string  `json:"room"`
+	Table   string  `json:"table"`
+	Symbol  string  `json:"symbol"`
+	Date    string  `json:"date"`
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Clock   string  `json:"clock"`
+	Speed   float64 `json:"speed"`
+	Playing bool    `json:"playing"`
+	Viewers int     `json:"viewers"`
+	Error   string  `json:"error"`
+}
 
-		// 更新标题显示当前窗口信息
-		lineChart.Title = fmt.Sprintf("JM2509 - Records %d-%d of %d (Window: %d points)",
-			windowStart+1, windowEnd, totalRecords, len(currentData))
+var (
+	// 当前回放的交易时段，From 为空表示不限制时间范围
+	replaySession replayState
+	// 回放状态更新，未加入回放房间时为nil，事件循环中永远不会选中
+	replayStates chan replayState
+)
 
-		// 更新统计信息
-		avgPrice := calculateAverage(priceData)
-		avgOI := calculateAverage(oiData)
-		maxPrice := findMax(priceData)
-		minPrice := findMin(priceData)
+// 连接Web服务器的 /ws 并加入回放房间，之后只读取服务端推送的消息
+type replayClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
 
-		var timeRange string
-		if len(currentData) > 0 {
-			timeRange = fmt.Sprintf("%s - %s",
-				currentData[0].Time.Format("15:04:05"),
-				currentData[len(currentData)-1].Time.Format("15:04:05"))
-		}
+func dialReplay(server, room string) (*replayClient, error) {
+	conn, err := net.DialTimeout("tcp", server, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to replay server %s: %w", server, err)
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		server, base64.StdEncoding.EncodeToString(key))
 
-		stats.Text = fmt.Sprintf("Time Range: %s\nAvg Price: %.2f\nMax Price: %.2f\nMin Price: %.2f\nAvg Open Interest: %.0f\nWindow: %d/%d",
-			timeRange, avgPrice, maxPrice, minPrice, avgOI, windowStart/WINDOW_SIZE+1, (totalRecords+WINDOW_SIZE-1)/WINDOW_SIZE)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
 	}
 
-	// 初始更新
-	updateChart()
-	termui.Render(lineChart, info, stats)
+	client := &replayClient{conn: conn, reader: reader}
+	join, _ := json.Marshal(map[string]string{"replay": room})
+	if err := client.writeFrame(0x1, join); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
 
-	// 创建定时器用于自动滚动
-	ticker := time.NewTicker(UPDATE_INTERVAL)
-	defer ticker.Stop()
+// 客户端发出的帧必须加掩码
+func (c *replayClient) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 0x80|126, byte(n>>8), byte(n))
+	default:
+		return fmt.Errorf("websocket frame too large: %d bytes", n)
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	_, err := c.conn.Write(append(append(header, mask...), masked...))
+	return err
+}
 
-	// 事件循环
-	uiEvents := termui.PollEvents()
+// 读取下一条回放消息，自动应答ping，忽略其它类型的消息
+func (c *replayClient) readState() (replayState, error) {
 	for {
-		select {
-		case e := <-uiEvents:
-			switch e.ID {
-			case "q", "<C-c>":
-				return
-			case "r":
-				// 刷新数据
-				newData, err := queryMarketData()
-				if err != nil {
-					log.Printf("Failed to refresh data: %v", err)
-				} else {
-					allData = newData
-					totalRecords = len(allData)
-					windowStart = 0
-					updateChart()
-					termui.Clear()
-					termui.Render(lineChart, info, stats)
-				}
-			case "<Resize>":
-				updateLayout()
-				termui.Clear()
-				termui.Render(lineChart, info, stats)
-			case "<Left>":
-				// 向前滚动
-				if windowStart > 0 {
-					windowStart -= WINDOW_SIZE / 4
-					if windowStart < 0 {
-						windowStart = 0
-					}
-					updateChart()
-					termui.Clear()
-					termui.Render(lineChart, info, stats)
-				}
-			case "<Right>":
-				// 向后滚动
-				if windowStart+WINDOW_SIZE < totalRecords {
-					windowStart += WINDOW_SIZE / 4
-					updateChart()
-					termui.Clear()
-					termui.Render(lineChart, info, stats)
-				}
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return replayState{}, err
+		}
+		opcode := header[0] & 0x0F
+		n := uint64(header[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return replayState{}, err
 			}
-		case <-ticker.C:
-			// 自动向前滚动
-			if windowStart+WINDOW_SIZE < totalRecords {
-				windowStart += 1
-				updateChart()
-				termui.Clear()
-				termui.Render(lineChart, info, stats)
+			n = uint64(ext[0])<<8 | uint64(ext[1])
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return replayState{}, err
+			}
+			n = 0
+			for _, b := range ext {
+				n = n<<8 | uint64(b)
 			}
 		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return replayState{}, err
+		}
+
+		switch opcode {
+		case 0x8:
+			return replayState{}, io.EOF
+		case 0x9:
+			c.writeFrame(0xA, payload)
+			continue
+		case 0x1:
+		default:
+			continue
+		}
+		var state replayState
+		if err := json.Unmarshal(payload, &state); err != nil {
+			continue
+		}
+		switch state.Type {
+		case "error":
+			return state, errors.New(state.Error)
+		case "replay", "replay_closed":
+			return state, nil
+		}
 	}
 }
 
-// 标准化数据，将持仓量数据缩放到价格数据的范围内
-func normalizeData(source, target []float64) []float64 {
-	if len(source) == 0 || len(target) == 0 {
-		return source
+// 加入回放房间并等待第一条状态，之后在后台把状态更新转发到 replayStates；
+// 连接断开或房间关闭时发送一条 replay_closed 后结束
+func joinReplay(server, room string) (replayState, error) {
+	client, err := dialReplay(server, room)
+	if err != nil {
+		return replayState{}, err
+	}
+	first, err := client.readState()
+	if err != nil {
+		client.conn.Close()
+		return replayState{}, fmt.Errorf("failed to join replay room %s: %w", room, err)
+	}
+	if first.Type != "replay" {
+		client.conn.Close()
+		return replayState{}, fmt.Errorf("replay room %s was closed", room)
 	}
 
-	sourceMin := findMin(source)
-	sourceMax := findMax(source)
-	targetMin := findMin(target)
-	targetMax := findMax(target)
+	replayStates = make(chan replayState, 16)
+	go func() {
+		defer client.conn.Close()
+		for {
+			state, err := client.readState()
+			if err != nil || state.Type == "replay_closed" {
+				replayStates <- replayState{Type: "replay_closed", Room: room}
+				return
+			}
+			replayStates <- state
+		}
+	}()
+	return first, nil
+}
 
-	if sourceMax == sourceMin {
-		return source
-	}
+// 回放时钟所在的位置：最后一条时间不晚于时钟的记录之后的下标。按墙上时间比较，
+// 与服务端和本地解析时使用的时区无关
+func replayClockIndex(data []MarketData, clock string) int {
+	return sort.Search(len(data), func(i int) bool {
+		return data[i].Time.Format("2006-01-02 15:04:05") > clock
+	})
+}
 
-	normalized := make([]float64, len(source))
-	for i, val := range source {
-		// 将source数据从[sourceMin, sourceMax]映射到[targetMin, targetMax]
-		normalized[i] = targetMin + (val-sourceMin)*(targetMax-targetMin)/(sourceMax-sourceMin)
+// 持仓量右轴的范围：跳过缺失（NaN/Inf）的点；全为0视为数据源不提供持仓量，
+// 此时 ok 为 false，调用方不画这条线和右轴。持仓量不变时上下各留1手，避免范围为0
+func oiRange(values []float64) (lo, hi float64, ok bool) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	nonZero := false
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+		nonZero = nonZero || v != 0
 	}
-
-	return normalized
+	if !nonZero {
+		return 0, 0, false
+	}
+	if lo == hi {
+		lo, hi = lo-1, hi+1
+	}
+	return lo, hi, true
 }
 
 func findMax(data []float64) float64 {
@@ -459,3 +3255,129 @@ func calculateAverage(data []float64) float64 {
 	}
 	return sum / float64(len(data))
 }
+
+// 常见期货品种的中文名和拼音，用于合约搜索时按中文或拼音匹配
+var productNames = map[string][2]string{
+	"a":  {"豆一", "dou yi"},
+	"ag": {"白银", "bai yin"},
+	"al": {"铝", "lv"},
+	"ap": {"苹果", "ping guo"},
+	"au": {"黄金", "huang jin"},
+	"bu": {"沥青", "li qing"},
+	"c":  {"玉米", "yu mi"},
+	"cf": {"棉花", "mian hua"},
+	"cu": {"铜", "tong"},
+	"eb": {"苯乙烯", "ben yi xi"},
+	"eg": {"乙二醇", "yi er chun"},
+	"fg": {"玻璃", "bo li"},
+	"fu": {"燃料油", "ran liao you"},
+	"hc": {"热卷", "re juan"},
+	"i":  {"铁矿石", "tie kuang shi"},
+	"j":  {"焦炭", "jiao tan"},
+	"jm": {"焦煤", "jiao mei"},
+	"l":  {"塑料", "su liao"},
+	"lc": {"碳酸锂", "tan suan li"},
+	"lh": {"生猪", "sheng zhu"},
+	"m":  {"豆粕", "dou po"},
+	"ma": {"甲醇", "jia chun"},
+	"ni": {"镍", "nie"},
+	"oi": {"菜油", "cai you"},
+	"p":  {"棕榈油", "zong lv you"},
+	"pg": {"液化气", "ye hua qi"},
+	"pp": {"聚丙烯", "ju bing xi"},
+	"rb": {"螺纹钢", "luo wen gang"},
+	"rm": {"菜粕", "cai po"},
+	"ru": {"橡胶", "xiang jiao"},
+	"sa": {"纯碱", "chun jian"},
+	"sc": {"原油", "yuan you"},
+	"sf": {"硅铁", "gui tie"},
+	"si": {"工业硅", "gong ye gui"},
+	"sm": {"锰硅", "meng gui"},
+	"sp": {"纸浆", "zhi jiang"},
+	"sr": {"白糖", "bai tang"},
+	"ss": {"不锈钢", "bu xiu gang"},
+	"ta": {"PTA", "p t a"},
+	"ur": {"尿素", "niao su"},
+	"v":  {"PVC", "p v c"},
+	"y":  {"豆油", "dou you"},
+	"zn": {"锌", "xin"},
+}
+
+// 合约代码的品种部分（字母前缀）和月份部分
+func splitSymbolCode(symbol string) (string, string) {
+	i := strings.IndexFunc(symbol, func(r rune) bool { return r >= '0' && r <= '9' })
+	if i < 0 {
+		return symbol, ""
+	}
+	return symbol[:i], symbol[i:]
+}
+
+// 计算合约与搜索词的匹配得分，0 表示不匹配。
+// 依次尝试：前缀、子串、品种中文名/拼音/拼音首字母（可带月份，如 jiaomei25）、按顺序出现的模糊匹配
+func symbolMatchScore(symbol, query string) int {
+	q := strings.ToLower(strings.TrimSpace(query))
+	s := strings.ToLower(symbol)
+	if q == "" {
+		return 1
+	}
+	if strings.HasPrefix(s, q) {
+		return 100
+	}
+	if strings.Contains(s, q) {
+		return 80
+	}
+
+	product, month := splitSymbolCode(s)
+	if names, ok := productNames[product]; ok {
+		if strings.Contains(names[0], query) {
+			return 70
+		}
+
+		syllables := strings.Fields(names[1])
+		initials := ""
+		for _, syllable := range syllables {
+			initials += syllable[:1]
+		}
+		qProduct, qMonth := splitSymbolCode(q)
+		if strings.HasPrefix(month, qMonth) && qProduct != "" &&
+			(strings.HasPrefix(strings.Join(syllables, ""), qProduct) || strings.HasPrefix(initials, qProduct)) {
+			return 60
+		}
+	}
+
+	// 子序列模糊匹配，字符间隔越小得分越高
+	pos, gaps := 0, 0
+	for _, c := range q {
+		i := strings.IndexRune(s[pos:], c)
+		if i < 0 {
+			return 0
+		}
+		gaps += i
+		pos += i + 1
+	}
+	if score := 40 - gaps; score > 1 {
+		return score
+	}
+	return 1
+}
+
+// 按匹配得分过滤并排序，得分相同的保持原有顺序
+func filterSymbols(symbols []string, query string) []string {
+	type match struct {
+		symbol string
+		score  int
+	}
+	var matches []match
+	for _, symbol := range symbols {
+		if score := symbolMatchScore(symbol, query); score > 0 {
+			matches = append(matches, match{symbol, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	result := make([]string, len(matches))
+	for i, m := range matches {
+		result[i] = m.symbol
+	}
+	return result
+}
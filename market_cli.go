@@ -0,0 +1,2456 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+)
+
+// 分钟线表名后缀，查看器在宽时间范围下会优先读取该表
+const BAR_TABLE_SUFFIX = "_bars_1m"
+
+func main() {
+	if len(os.Args) < 2 {
+		cliUsage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "bars":
+		runBarsCommand(os.Args[2:])
+	case "convert":
+		runConvertCommand(os.Args[2:])
+	case "stats":
+		runStatsCommand(os.Args[2:])
+	case "tail":
+		runTailCommand(os.Args[2:])
+	case "report":
+		runReportCommand(os.Args[2:])
+	case "render":
+		runRenderCommand(os.Args[2:])
+	case "export-site":
+		runExportSiteCommand(os.Args[2:])
+	case "-h", "--help", "help":
+		cliUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		cliUsage()
+		os.Exit(2)
+	}
+}
+
+func cliUsage() {
+	fmt.Fprintln(os.Stderr, `Usage: go run market_cli.go <command> [flags]
+
+Commands:
+  bars build   创建并回填分钟线表 (feature.<table>_bars_1m)
+  convert      把tick数据（ClickHouse或CSV）聚合成K线，写出CSV/Parquet
+  stats        打印一组symbol的最新价、涨跌、成交量、持仓和买卖价差，-watch 定时刷新
+  tail         把symbol的新tick实时输出到stdout（JSON Lines或CSV）
+  report       按报告模板生成多页PDF，每个图表一页，包含K线收盘价、指标和统计表
+  render       把symbol的价格和持仓画成PNG，-animate 按终端滚动窗口生成GIF/MP4动画
+  export-site  把symbol一段时间的数据和交互式图表导出为静态目录，直接打开 index.html 查看`)
+}
+
+// 所有ClickHouse查询共用的HTTP客户端，代理由 -proxy 参数或 HTTP_PROXY/HTTPS_PROXY 环境变量决定
+var httpClient = http.DefaultClient
+
+// 按 -proxy 参数构建共享的HTTP客户端；参数为空时沿用 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 环境变量
+func setupHTTPClient(proxy string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q (expected e.g. http://proxy.example.com:3128)", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// ClickHouse字符串字面量：转义反斜杠和单引号。只把单引号写成两个单引号不够，以反斜杠结尾的symbol会转义掉闭合的引号
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// symbol IN (...) 条件
+func symbolInCondition(symbols []string) string {
+	quoted := make([]string, len(symbols))
+	for i, s := range symbols {
+		quoted[i] = quoteString(s)
+	}
+	return "symbol IN (" + strings.Join(quoted, ", ") + ")"
+}
+
+// 表名直接拼接进SQL，只允许字母、数字和下划线
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// 命令行工具会执行 CREATE/INSERT，ClickHouse 的 HTTP 接口对 GET 请求是只读的，因此通过 POST 发送查询
+func executeQuery(query string) (string, error) {
+	// 构建请求URL
+	baseURL := "http://xm.local:8123"
+	params := url.Values{}
+	params.Add("database", "feature")
+
+	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
+
+	// 发送HTTP请求
+	resp, err := httpClient.Post(fullURL, "text/plain", strings.NewReader(query))
+	if err != nil {
+		return "", fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("ClickHouse error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return string(body), nil
+}
+
+// 查询所需的列及其兼容的ClickHouse类型族
+var expectedColumns = []struct {
+	name     string
+	families []string
+}{
+	{"symbol", []string{"String", "FixedString"}},
+	{"time", []string{"DateTime"}},
+	{"price", []string{"Float", "Decimal"}},
+	{"vol", []string{"UInt", "Int"}},
+	{"open_interest", []string{"UInt", "Int"}},
+	{"diff_vol", []string{"Int", "UInt"}},
+	{"diff_oi", []string{"Int", "UInt"}},
+	{"bid_1", []string{"Float", "Decimal"}},
+	{"bid_volumn_1", []string{"UInt", "Int"}},
+	{"ask_1", []string{"Float", "Decimal"}},
+	{"ask_volumn_1", []string{"UInt", "Int"}},
+	{"datetime", []string{"UInt", "Int"}},
+}
+
+// 通过 DESCRIBE 检查表结构，缺少列或类型不兼容时返回列出具体列名的错误，
+// 避免解析时静默跳过所有行后只报 "No data found"。各子命令在查询前都先调用它，表名在这里统一检查
+func validateSchema(table string) error {
+	if !isIdentifier(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	result, err := executeQuery(fmt.Sprintf("DESCRIBE TABLE feature.%s FORMAT TabSeparated", table))
+	if err != nil {
+		return fmt.Errorf("failed to describe table feature.%s: %w", table, err)
+	}
+
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			types[fields[0]] = fields[1]
+		}
+	}
+
+	var missing, mismatched []string
+	for _, col := range expectedColumns {
+		typ, ok := types[col.name]
+		if !ok {
+			missing = append(missing, col.name)
+			continue
+		}
+
+		// 去掉 Nullable(...) / LowCardinality(...) 包装后比较类型族
+		base := typ
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			for strings.HasPrefix(base, wrapper) {
+				base = strings.TrimSuffix(strings.TrimPrefix(base, wrapper), ")")
+			}
+		}
+		compatible := false
+		for _, family := range col.families {
+			if strings.HasPrefix(base, family) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s (expected %s)", col.name, typ, strings.Join(col.families, "/")))
+		}
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		problems = append(problems, "incompatible types: "+strings.Join(mismatched, "; "))
+	}
+	return fmt.Errorf("table feature.%s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+}
+
+// bars 子命令
+func runBarsCommand(args []string) {
+	if len(args) == 0 || args[0] != "build" {
+		fmt.Fprintln(os.Stderr, "Usage: go run market_cli.go bars build [-table jm] [-symbols jm2509,j2509] [-full]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("bars build", flag.ExitOnError)
+	table := fs.String("table", "jm", "源tick数据表名 (feature库)")
+	symbols := fs.String("symbols", "", "逗号分隔的symbol列表，为空时处理表中所有symbol")
+	full := fs.Bool("full", false, "回填全部历史，而不是从已有的最后一根分钟线开始增量回填")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args[1:])
+
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validateSchema(*table); err != nil {
+		log.Fatal(err)
+	}
+
+	symbolList := splitSymbols(*symbols)
+	if len(symbolList) == 0 {
+		var err error
+		symbolList, err = queryDistinctSymbols(*table)
+		if err != nil {
+			log.Fatal("Failed to list symbols:", err)
+		}
+	}
+
+	if err := createBarTable(*table); err != nil {
+		log.Fatal("Failed to create bar table:", err)
+	}
+
+	for _, symbol := range symbolList {
+		if err := backfillBars(*table, symbol, *full); err != nil {
+			log.Fatalf("Failed to backfill bars for %s: %v", symbol, err)
+		}
+	}
+
+	fmt.Printf("Bar table feature.%s%s is up to date for %d symbols\n", *table, BAR_TABLE_SUFFIX, len(symbolList))
+}
+
+func splitSymbols(list string) []string {
+	var symbols []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			symbols = append(symbols, s)
+		}
+	}
+	return symbols
+}
+
+func queryDistinctSymbols(table string) ([]string, error) {
+	result, err := executeQuery(fmt.Sprintf("SELECT DISTINCT symbol FROM feature.%s ORDER BY symbol", table))
+	if err != nil {
+		return nil, err
+	}
+	return splitSymbols(strings.ReplaceAll(strings.TrimSpace(result), "\n", ",")), nil
+}
+
+// 分钟线表的列是tick表的超集：price 保存收盘价，这样查看器可以用同一个SELECT读取两种表
+func createBarTable(table string) error {
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS feature.%s%s
+		(
+			symbol String,
+			time DateTime,
+			open Float32,
+			high Float32,
+			low Float32,
+			price Float32,
+			vol UInt32,
+			open_interest UInt32,
+			diff_vol Int64,
+			diff_oi Int64,
+			bid_1 Float32,
+			bid_volumn_1 UInt32,
+			ask_1 Float32,
+			ask_volumn_1 UInt32,
+			datetime UInt64,
+			ticks UInt32
+		)
+		ENGINE = ReplacingMergeTree
+		ORDER BY (symbol, time)
+	`, table, BAR_TABLE_SUFFIX)
+
+	_, err := executeQuery(query)
+	return err
+}
+
+// 使用 INSERT SELECT 按 toStartOfMinute 聚合回填分钟线。
+// 增量模式从已有的最后一根分钟线开始（包含该分钟，以补全未走完的分钟线），
+// 重复的分钟线由 ReplacingMergeTree 合并，查看器读取时使用 FINAL。
+func backfillBars(table, symbol string, full bool) error {
+	barTable := table + BAR_TABLE_SUFFIX
+
+	condition := "symbol = " + quoteString(symbol)
+	if !full {
+		condition += fmt.Sprintf(" AND time >= (SELECT max(time) FROM feature.%s WHERE symbol = %s)", barTable, quoteString(symbol))
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO feature.%s
+		SELECT
+			symbol,
+			toStartOfMinute(time) AS bar_time,
+			argMin(price, (time, datetime)),
+			max(price),
+			min(price),
+			argMax(price, (time, datetime)),
+			argMax(vol, (time, datetime)),
+			argMax(open_interest, (time, datetime)),
+			sum(diff_vol),
+			sum(diff_oi),
+			argMax(bid_1, (time, datetime)),
+			argMax(bid_volumn_1, (time, datetime)),
+			argMax(ask_1, (time, datetime)),
+			argMax(ask_volumn_1, (time, datetime)),
+			max(datetime),
+			count()
+		FROM feature.%s
+		WHERE %s
+		GROUP BY symbol, bar_time
+	`, barTable, table, condition)
+
+	if _, err := executeQuery(query); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backfilled %s bars into feature.%s\n", symbol, barTable)
+	return nil
+}
+
+// 一笔tick数据，convert 子命令从ClickHouse或CSV读取
+type tick struct {
+	symbol       string
+	time         time.Time // 交易所本地时间，按UTC保存以便直接做整点对齐
+	price        float64
+	vol          int64
+	openInterest int64
+	diffVol      int64
+	diffOI       int64
+	bid1         float64
+	bidVolumn1   int64
+	ask1         float64
+	askVolumn1   int64
+	datetime     int64
+}
+
+// 聚合后的K线，字段含义与分钟线表一致
+type bar struct {
+	symbol       string
+	time         time.Time
+	open         float64
+	high         float64
+	low          float64
+	close        float64
+	vol          int64
+	openInterest int64
+	diffVol      int64
+	diffOI       int64
+	bid1         float64
+	bidVolumn1   int64
+	ask1         float64
+	askVolumn1   int64
+	ticks        int64
+}
+
+// 把按 (time, datetime) 排序的tick聚合成K线，语义与 bars build 中的 INSERT SELECT 相同：
+// 开盘/收盘为周期内第一笔/最后一笔的价格，成交量、持仓和盘口取最后一笔，diff_vol/diff_oi 求和
+func aggregateBars(ticks []tick, interval time.Duration) []bar {
+	var bars []bar
+	index := make(map[string]int) // symbol -> 该symbol最后一根K线在bars中的位置
+
+	for _, t := range ticks {
+		start := t.time.Truncate(interval)
+
+		i, ok := index[t.symbol]
+		if !ok || !bars[i].time.Equal(start) {
+			bars = append(bars, bar{
+				symbol: t.symbol,
+				time:   start,
+				open:   t.price,
+				high:   t.price,
+				low:    t.price,
+			})
+			i = len(bars) - 1
+			index[t.symbol] = i
+		}
+
+		b := &bars[i]
+		b.high = math.Max(b.high, t.price)
+		b.low = math.Min(b.low, t.price)
+		b.close = t.price
+		b.vol = t.vol
+		b.openInterest = t.openInterest
+		b.diffVol += t.diffVol
+		b.diffOI += t.diffOI
+		b.bid1, b.bidVolumn1 = t.bid1, t.bidVolumn1
+		b.ask1, b.askVolumn1 = t.ask1, t.askVolumn1
+		b.ticks++
+	}
+
+	sort.SliceStable(bars, func(i, j int) bool {
+		if bars[i].symbol != bars[j].symbol {
+			return bars[i].symbol < bars[j].symbol
+		}
+		return bars[i].time.Before(bars[j].time)
+	})
+	return bars
+}
+
+// convert 子命令：读取tick（ClickHouse或CSV），按一个或多个周期聚合后写出CSV/Parquet
+func runConvertCommand(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	input := fs.String("input", "", "tick CSV文件路径（表头包含 symbol,time,price 等列名），为空时从ClickHouse读取")
+	table := fs.String("table", "jm", "ClickHouse源tick数据表名 (feature库)")
+	symbols := fs.String("symbols", "", "逗号分隔的symbol列表，为空时处理所有symbol")
+	last := fs.String("last", "all", "只转换各symbol最近一段时间的数据，例如 2h、5d 或 all（仅ClickHouse）")
+	intervals := fs.String("intervals", "1m", "逗号分隔的K线周期，例如 1m,5m,15m,1h,1d")
+	format := fs.String("format", "csv", "输出格式: csv 或 parquet")
+	outDir := fs.String("out", ".", "输出目录，每个周期一个文件 bars_<周期>.<格式>")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	if *format != "csv" && *format != "parquet" {
+		log.Fatalf("unknown format %q (csv or parquet)", *format)
+	}
+
+	var periods []time.Duration
+	var periodNames []string
+	for _, spec := range splitSymbols(*intervals) {
+		d, err := parseInterval(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		periods = append(periods, d)
+		periodNames = append(periodNames, spec)
+	}
+	if len(periods) == 0 {
+		log.Fatal("no intervals given")
+	}
+
+	var ticks []tick
+	var err error
+	if *input != "" {
+		ticks, err = readTicksCSV(*input, splitSymbols(*symbols))
+	} else {
+		ticks, err = queryTicks(*table, splitSymbols(*symbols), *last)
+	}
+	if err != nil {
+		log.Fatal("Failed to read ticks:", err)
+	}
+	if len(ticks) == 0 {
+		log.Fatal("No ticks found")
+	}
+	fmt.Printf("Read %d ticks\n", len(ticks))
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal("Failed to create output directory:", err)
+	}
+
+	for i, period := range periods {
+		bars := aggregateBars(ticks, period)
+		path := filepath.Join(*outDir, fmt.Sprintf("bars_%s.%s", periodNames[i], *format))
+		if *format == "csv" {
+			err = writeBarsCSV(path, bars)
+		} else {
+			err = writeBarsParquet(path, bars)
+		}
+		if err != nil {
+			log.Fatalf("Failed to write %s: %v", path, err)
+		}
+		fmt.Printf("Wrote %d bars to %s\n", len(bars), path)
+	}
+}
+
+// 一个symbol在统计窗口内的汇总：最新价、相对窗口首笔的涨跌、成交量、持仓及其变化、最新买卖价差
+type symbolStats struct {
+	Symbol   string  `json:"symbol"`
+	Time     string  `json:"time"`
+	Last     float64 `json:"last"`
+	Change   float64 `json:"change"`
+	ChangePc float64 `json:"change_pct"`
+	Volume   int64   `json:"volume"`
+	OI       int64   `json:"open_interest"`
+	OIChange int64   `json:"oi_change"`
+	Spread   float64 `json:"spread"`
+}
+
+func runStatsCommand(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	table := fs.String("table", "", "数据表名 (feature库)，为空时取每个symbol的字母前缀")
+	symbols := fs.String("symbols", "jm2509", "逗号分隔的symbol列表")
+	window := fs.String("window", "1d", "统计窗口，以各symbol最新数据时间为终点，例如 30m、2h、1d")
+	watch := fs.Bool("watch", false, "按 -interval 定时刷新，直到被中断")
+	interval := fs.Duration("interval", 5*time.Second, "-watch 模式下的刷新间隔")
+	jsonOut := fs.Bool("json", false, "每个symbol输出一行JSON（JSON Lines），便于管道处理或写日志")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	span, err := parseInterval(*window)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *watch && *interval <= 0 {
+		log.Fatal("-interval must be positive")
+	}
+
+	// 按表分组，每个表一条查询
+	groups := make(map[string][]string)
+	var tables []string
+	for _, symbol := range splitSymbols(*symbols) {
+		t := *table
+		if t == "" {
+			t = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+		}
+		if _, ok := groups[t]; !ok {
+			if err := validateSchema(t); err != nil {
+				log.Fatal(err)
+			}
+			tables = append(tables, t)
+		}
+		groups[t] = append(groups[t], symbol)
+	}
+	if len(tables) == 0 {
+		log.Fatal("no symbols given")
+	}
+
+	out := csv.NewWriter(os.Stdout)
+	out.Comma = '\t'
+	enc := json.NewEncoder(os.Stdout)
+	for first := true; ; first = false {
+		var rows []symbolStats
+		var queryErr error
+		for _, t := range tables {
+			stats, err := querySymbolStats(t, groups[t], span)
+			if err != nil {
+				queryErr = fmt.Errorf("%s: %w", t, err)
+				break
+			}
+			rows = append(rows, stats...)
+		}
+
+		switch {
+		case queryErr != nil && !*watch:
+			log.Fatal(queryErr)
+		case queryErr != nil:
+			// 监视模式下查询失败只记录到stderr，下一轮继续
+			log.Printf("Failed to query stats: %v", queryErr)
+		case *jsonOut:
+			for _, row := range rows {
+				enc.Encode(row)
+			}
+		default:
+			if first {
+				out.Write([]string{"symbol", "time", "last", "change", "change_pct", "volume", "open_interest", "oi_change", "spread"})
+			}
+			for _, row := range rows {
+				out.Write([]string{
+					row.Symbol,
+					row.Time,
+					strconv.FormatFloat(row.Last, 'f', -1, 64),
+					strconv.FormatFloat(row.Change, 'f', -1, 64),
+					strconv.FormatFloat(row.ChangePc, 'f', 2, 64),
+					strconv.FormatInt(row.Volume, 10),
+					strconv.FormatInt(row.OI, 10),
+					strconv.FormatInt(row.OIChange, 10),
+					strconv.FormatFloat(row.Spread, 'f', -1, 64),
+				})
+			}
+			out.Flush()
+		}
+
+		if !*watch {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// 在ClickHouse中按symbol汇总统计窗口内的数据，窗口终点为该表的最新数据时间
+func querySymbolStats(table string, symbols []string, span time.Duration) ([]symbolStats, error) {
+	condition := symbolInCondition(symbols)
+
+	result, err := executeQuery(fmt.Sprintf(`
+		SELECT
+			symbol,
+			toString(max(time)) AS time,
+			toFloat64(argMax(price, (time, datetime))) AS last,
+			toFloat64(argMin(price, (time, datetime))) AS first,
+			toInt64(sum(diff_vol)) AS volume,
+			toInt64(argMax(open_interest, (time, datetime))) AS oi,
+			toInt64(argMin(open_interest, (time, datetime))) AS first_oi,
+			toFloat64(argMax(ask_1, (time, datetime)) - argMax(bid_1, (time, datetime))) AS spread
+		FROM feature.%s %s
+		WHERE %s AND time >= recent.window_start
+		GROUP BY symbol
+		ORDER BY symbol
+		SETTINGS output_format_json_quote_64bit_integers = 0
+		FORMAT JSONEachRow
+	`, table, recentWindowJoin(table, condition, span), condition))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []symbolStats
+	for _, line := range strings.Split(result, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var row struct {
+			Symbol  string  `json:"symbol"`
+			Time    string  `json:"time"`
+			Last    float64 `json:"last"`
+			First   float64 `json:"first"`
+			Volume  int64   `json:"volume"`
+			OI      int64   `json:"oi"`
+			FirstOI int64   `json:"first_oi"`
+			Spread  float64 `json:"spread"`
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, fmt.Errorf("failed to parse stats row: %w", err)
+		}
+		last, lastDecimals := float32Price(row.Last)
+		first, firstDecimals := float32Price(row.First)
+		decimals := lastDecimals
+		if firstDecimals > decimals {
+			decimals = firstDecimals
+		}
+		scale := math.Pow(10, float64(decimals))
+		s := symbolStats{
+			Symbol:   row.Symbol,
+			Time:     row.Time,
+			Last:     last,
+			Change:   math.Round((last-first)*scale) / scale,
+			Volume:   row.Volume,
+			OI:       row.OI,
+			OIChange: row.OI - row.FirstOI,
+		}
+		s.Spread, _ = float32Price(row.Spread)
+		if first != 0 {
+			s.ChangePc = math.Round((last/first-1)*1e6) / 1e4
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// price 列为float32，取float32的最短十进制表示，避免输出 737.4000244140625 这类尾数；同时返回小数位数
+func float32Price(v float64) (float64, int) {
+	s := strconv.FormatFloat(v, 'f', -1, 32)
+	price, _ := strconv.ParseFloat(s, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return price, len(s) - i - 1
+	}
+	return price, 0
+}
+
+// tail 子命令输出的tick字段，列名与表结构一致
+var tickColumns = []string{"symbol", "time", "price", "vol", "open_interest", "diff_vol", "diff_oi",
+	"bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "datetime"}
+
+func runTailCommand(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	table := fs.String("table", "", "数据表名 (feature库)，为空时取symbol的字母前缀")
+	symbol := fs.String("symbol", "jm2509", "合约代码")
+	format := fs.String("format", "jsonl", "输出格式: jsonl（每行一个JSON对象）或 csv（带表头）")
+	lines := fs.Int("n", 10, "启动时先输出最近的tick条数，0 表示只输出启动后的新tick")
+	interval := fs.Duration("interval", time.Second, "轮询ClickHouse的间隔")
+	follow := fs.Bool("f", true, "持续输出新tick；-f=false 时输出最近 -n 条后退出")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+	if *format != "jsonl" && *format != "csv" {
+		log.Fatalf("unknown format %q (jsonl or csv)", *format)
+	}
+	if *lines < 0 || *interval <= 0 {
+		log.Fatal("-n must be >= 0 and -interval must be positive")
+	}
+	if *table == "" {
+		*table = strings.ToLower(strings.TrimRight(*symbol, "0123456789"))
+	}
+	if err := validateSchema(*table); err != nil {
+		log.Fatal(err)
+	}
+
+	out := csv.NewWriter(os.Stdout)
+	enc := json.NewEncoder(os.Stdout)
+	emit := func(ticks []tick) {
+		for _, t := range ticks {
+			if *format == "csv" {
+				out.Write(tickFields(t))
+			} else {
+				enc.Encode(tickJSON(t))
+			}
+		}
+		// 每批立即刷新，下游通过管道读取时不会被缓冲延迟
+		out.Flush()
+	}
+	if *format == "csv" {
+		out.Write(tickColumns)
+	}
+
+	// 启动时至少取最新一条作为游标，-n 0 时不输出
+	limit := *lines
+	if limit == 0 {
+		limit = 1
+	}
+	ticks, err := queryTailTicks(*table, *symbol, nil, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *lines > 0 {
+		emit(ticks)
+	} else {
+		out.Flush()
+	}
+	if !*follow {
+		return
+	}
+
+	var cursor *tick
+	if len(ticks) > 0 {
+		cursor = &ticks[len(ticks)-1]
+	}
+	for {
+		time.Sleep(*interval)
+		fresh, err := queryTailTicks(*table, *symbol, cursor, 0)
+		if err != nil {
+			// 查询失败只记录到stderr，下一轮从同一游标继续，不会丢tick
+			log.Printf("Failed to query new ticks: %v", err)
+			continue
+		}
+		if len(fresh) > 0 {
+			emit(fresh)
+			cursor = &fresh[len(fresh)-1]
+		}
+	}
+}
+
+// 查询 cursor 之后的tick（按 (time, datetime) 排序）；cursor 为空时返回最近 limit 条
+func queryTailTicks(table, symbol string, cursor *tick, limit int) ([]tick, error) {
+	columns := strings.Join(tickColumns, ", ")
+
+	var query string
+	if cursor == nil {
+		query = fmt.Sprintf(`
+			SELECT * FROM (
+				SELECT %s
+				FROM feature.%s
+				WHERE symbol = %s
+				ORDER BY time DESC, datetime DESC
+				LIMIT %d
+			)
+			ORDER BY time ASC, datetime ASC
+			FORMAT TabSeparatedWithNames
+		`, columns, table, quoteString(symbol), limit)
+	} else {
+		query = fmt.Sprintf(`
+			SELECT %s
+			FROM feature.%s
+			WHERE symbol = %s AND (time, datetime) > (toDateTime('%s'), %d)
+			ORDER BY time ASC, datetime ASC
+			FORMAT TabSeparatedWithNames
+		`, columns, table, quoteString(symbol), cursor.time.Format("2006-01-02 15:04:05"), cursor.datetime)
+	}
+
+	result, err := executeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimRight(result, "\n"), "\n") {
+		if line != "" {
+			rows = append(rows, strings.Split(line, "\t"))
+		}
+	}
+	return parseTickRows(rows, nil)
+}
+
+func tickFields(t tick) []string {
+	return []string{
+		t.symbol,
+		t.time.Format("2006-01-02 15:04:05"),
+		strconv.FormatFloat(t.price, 'f', -1, 64),
+		strconv.FormatInt(t.vol, 10),
+		strconv.FormatInt(t.openInterest, 10),
+		strconv.FormatInt(t.diffVol, 10),
+		strconv.FormatInt(t.diffOI, 10),
+		strconv.FormatFloat(t.bid1, 'f', -1, 64),
+		strconv.FormatInt(t.bidVolumn1, 10),
+		strconv.FormatFloat(t.ask1, 'f', -1, 64),
+		strconv.FormatInt(t.askVolumn1, 10),
+		strconv.FormatInt(t.datetime, 10),
+	}
+}
+
+// JSON Lines 的一行，字段名与Web查看器 /data 接口一致
+func tickJSON(t tick) interface{} {
+	return struct {
+		Symbol       string  `json:"symbol"`
+		Time         string  `json:"time"`
+		Price        float64 `json:"price"`
+		Vol          int64   `json:"vol"`
+		OpenInterest int64   `json:"open_interest"`
+		DiffVol      int64   `json:"diff_vol"`
+		DiffOI       int64   `json:"diff_oi"`
+		Bid1         float64 `json:"bid_1"`
+		BidVolumn1   int64   `json:"bid_volumn_1"`
+		Ask1         float64 `json:"ask_1"`
+		AskVolumn1   int64   `json:"ask_volumn_1"`
+		DateTime     int64   `json:"datetime"`
+	}{t.symbol, t.time.Format("2006-01-02 15:04:05"), t.price, t.vol, t.openInterest, t.diffVol, t.diffOI,
+		t.bid1, t.bidVolumn1, t.ask1, t.askVolumn1, t.datetime}
+}
+
+// 解析K线周期，支持 s/m/h/d 单位，日线按交易所本地日期对齐
+func parseInterval(spec string) (time.Duration, error) {
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}
+	if len(spec) < 2 {
+		return 0, fmt.Errorf("invalid interval %q", spec)
+	}
+	unit, ok := units[spec[len(spec)-1]]
+	n, err := strconv.Atoi(spec[:len(spec)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid interval %q, expected e.g. 30s, 1m, 5m, 1h, 1d", spec)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// 按symbol各自的最新数据时间确定最近 span 的窗口起点（recent.window_start），与行情表按symbol连接。
+// 窗口不能以整张表的 max(time) 为终点：已停止交易的合约的最后一笔早于表中其他合约，整表的窗口里会没有它的数据
+func recentWindowJoin(table, condition string, span time.Duration) string {
+	return fmt.Sprintf(`INNER JOIN (
+			SELECT symbol, max(time) - INTERVAL %d SECOND AS window_start
+			FROM feature.%s WHERE %s GROUP BY symbol
+		) AS recent USING (symbol)`, int64(span.Seconds()), table, condition)
+}
+
+// 从ClickHouse读取tick，按 (symbol, time, datetime) 排序
+func queryTicks(table string, symbols []string, last string) ([]tick, error) {
+	if err := validateSchema(table); err != nil {
+		return nil, err
+	}
+
+	condition := "1"
+	if len(symbols) > 0 {
+		condition = symbolInCondition(symbols)
+	}
+	join := ""
+	if last != "" && last != "all" {
+		span, err := parseInterval(last)
+		if err != nil {
+			return nil, err
+		}
+		join = recentWindowJoin(table, condition, span)
+		condition += " AND time >= recent.window_start"
+	}
+
+	result, err := executeQuery(fmt.Sprintf(`
+		SELECT symbol, time, price, vol, open_interest, diff_vol, diff_oi,
+			bid_1, bid_volumn_1, ask_1, ask_volumn_1, datetime
+		FROM feature.%s %s
+		WHERE %s
+		ORDER BY symbol, time, datetime
+		FORMAT TabSeparatedWithNames
+	`, table, join, condition))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimRight(result, "\n"), "\n")
+	var rows [][]string
+	for _, line := range lines {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	return parseTickRows(rows, nil)
+}
+
+// 读取tick CSV，第一行为列名；与终端查看器导出的CSV格式相同
+func readTicksCSV(path string, symbols []string) ([]tick, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	ticks, err := parseTickRows(rows, symbols)
+	if err != nil {
+		return nil, err
+	}
+
+	// CSV不保证有序
+	sort.SliceStable(ticks, func(i, j int) bool {
+		if ticks[i].symbol != ticks[j].symbol {
+			return ticks[i].symbol < ticks[j].symbol
+		}
+		if !ticks[i].time.Equal(ticks[j].time) {
+			return ticks[i].time.Before(ticks[j].time)
+		}
+		return ticks[i].datetime < ticks[j].datetime
+	})
+	return ticks, nil
+}
+
+// 按表头列名解析tick行，symbol/time/price 为必需列，其他列缺失时记为0
+func parseTickRows(rows [][]string, symbols []string) ([]tick, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"symbol", "time", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing required column %q", name)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, s := range symbols {
+		wanted[s] = true
+	}
+
+	var ticks []tick
+	for n, row := range rows[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		num := func(name string) float64 {
+			v, _ := strconv.ParseFloat(field(name), 64)
+			return v
+		}
+
+		t := tick{symbol: field("symbol")}
+		if len(wanted) > 0 && !wanted[t.symbol] {
+			continue
+		}
+
+		var err error
+		if t.time, err = time.Parse("2006-01-02 15:04:05", field("time")); err != nil {
+			return nil, fmt.Errorf("row %d: invalid time %q", n+2, field("time"))
+		}
+		if t.price, err = strconv.ParseFloat(field("price"), 64); err != nil {
+			return nil, fmt.Errorf("row %d: invalid price %q", n+2, field("price"))
+		}
+		t.vol = int64(num("vol"))
+		t.openInterest = int64(num("open_interest"))
+		t.diffVol = int64(num("diff_vol"))
+		t.diffOI = int64(num("diff_oi"))
+		t.bid1 = num("bid_1")
+		t.bidVolumn1 = int64(num("bid_volumn_1"))
+		t.ask1 = num("ask_1")
+		t.askVolumn1 = int64(num("ask_volumn_1"))
+		t.datetime, _ = strconv.ParseInt(field("datetime"), 10, 64)
+		ticks = append(ticks, t)
+	}
+	return ticks, nil
+}
+
+// K线输出的列，CSV和Parquet共用
+var barColumns = []string{"symbol", "time", "open", "high", "low", "close", "vol", "open_interest",
+	"diff_vol", "diff_oi", "bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "ticks"}
+
+func writeBarsCSV(path string, bars []bar) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	formatInt := func(v int64) string { return strconv.FormatInt(v, 10) }
+
+	w := csv.NewWriter(f)
+	w.Write(barColumns)
+	for _, b := range bars {
+		w.Write([]string{
+			b.symbol, b.time.Format("2006-01-02 15:04:05"),
+			formatFloat(b.open), formatFloat(b.high), formatFloat(b.low), formatFloat(b.close),
+			formatInt(b.vol), formatInt(b.openInterest), formatInt(b.diffVol), formatInt(b.diffOI),
+			formatFloat(b.bid1), formatInt(b.bidVolumn1), formatFloat(b.ask1), formatInt(b.askVolumn1),
+			formatInt(b.ticks),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Parquet物理类型和转换类型
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMillis = 9
+)
+
+// 写出单个行组、无压缩、PLAIN编码的Parquet文件，所有列均为 REQUIRED。
+// time 列为 TIMESTAMP_MILLIS，保存的是交易所本地时间（与ClickHouse中的墙上时间一致）
+func writeBarsParquet(path string, bars []bar) error {
+	type column struct {
+		name      string
+		typ       int32
+		converted int32 // -1 表示无
+		values    []byte
+	}
+
+	var columns []column
+	addInt64 := func(name string, converted int32, get func(b bar) int64) {
+		values := make([]byte, 0, 8*len(bars))
+		for _, b := range bars {
+			values = binary.LittleEndian.AppendUint64(values, uint64(get(b)))
+		}
+		columns = append(columns, column{name, parquetInt64, converted, values})
+	}
+	addDouble := func(name string, get func(b bar) float64) {
+		values := make([]byte, 0, 8*len(bars))
+		for _, b := range bars {
+			values = binary.LittleEndian.AppendUint64(values, math.Float64bits(get(b)))
+		}
+		columns = append(columns, column{name, parquetDouble, -1, values})
+	}
+
+	var symbols []byte
+	for _, b := range bars {
+		symbols = binary.LittleEndian.AppendUint32(symbols, uint32(len(b.symbol)))
+		symbols = append(symbols, b.symbol...)
+	}
+	columns = append(columns, column{"symbol", parquetByteArray, parquetConvertedUTF8, symbols})
+	addInt64("time", parquetConvertedTimestampMillis, func(b bar) int64 { return b.time.UnixMilli() })
+	addDouble("open", func(b bar) float64 { return b.open })
+	addDouble("high", func(b bar) float64 { return b.high })
+	addDouble("low", func(b bar) float64 { return b.low })
+	addDouble("close", func(b bar) float64 { return b.close })
+	addInt64("vol", -1, func(b bar) int64 { return b.vol })
+	addInt64("open_interest", -1, func(b bar) int64 { return b.openInterest })
+	addInt64("diff_vol", -1, func(b bar) int64 { return b.diffVol })
+	addInt64("diff_oi", -1, func(b bar) int64 { return b.diffOI })
+	addDouble("bid_1", func(b bar) float64 { return b.bid1 })
+	addInt64("bid_volumn_1", -1, func(b bar) int64 { return b.bidVolumn1 })
+	addDouble("ask_1", func(b bar) float64 { return b.ask1 })
+	addInt64("ask_volumn_1", -1, func(b bar) int64 { return b.askVolumn1 })
+	addInt64("ticks", -1, func(b bar) int64 { return b.ticks })
+
+	out := []byte("PAR1")
+
+	// 每列一个数据页，列块的位置和大小记录到行组元数据中
+	var chunks thriftWriter
+	chunks.listBegin(thriftStruct, len(columns))
+	totalSize := 0
+	for _, col := range columns {
+		var header thriftWriter
+		header.structBegin()  // PageHeader
+		header.fieldI32(1, 0) // DATA_PAGE
+		header.fieldI32(2, int32(len(col.values)))
+		header.fieldI32(3, int32(len(col.values)))
+		header.fieldStructBegin(5) // DataPageHeader
+		header.fieldI32(1, int32(len(bars)))
+		header.fieldI32(2, 0) // PLAIN
+		header.fieldI32(3, 3) // RLE
+		header.fieldI32(4, 3) // RLE
+		header.structEnd()
+		header.structEnd()
+
+		offset := len(out)
+		out = append(out, header.buf...)
+		out = append(out, col.values...)
+		size := len(out) - offset
+		totalSize += size
+
+		chunks.structBegin() // ColumnChunk
+		chunks.fieldI64(2, int64(offset))
+		chunks.fieldStructBegin(3) // ColumnMetaData
+		chunks.fieldI32(1, col.typ)
+		chunks.fieldListBegin(2, thriftI32, 1)
+		chunks.i32(0) // PLAIN
+		chunks.fieldListBegin(3, thriftBinary, 1)
+		chunks.binary(col.name)
+		chunks.fieldI32(4, 0) // UNCOMPRESSED
+		chunks.fieldI64(5, int64(len(bars)))
+		chunks.fieldI64(6, int64(size))
+		chunks.fieldI64(7, int64(size))
+		chunks.fieldI64(9, int64(offset))
+		chunks.structEnd()
+		chunks.structEnd()
+	}
+
+	var meta thriftWriter
+	meta.structBegin() // FileMetaData
+	meta.fieldI32(1, 1)
+	meta.fieldListBegin(2, thriftStruct, len(columns)+1)
+	meta.structBegin() // 根节点
+	meta.fieldBinary(4, "schema")
+	meta.fieldI32(5, int32(len(columns)))
+	meta.structEnd()
+	for _, col := range columns {
+		meta.structBegin()
+		meta.fieldI32(1, col.typ)
+		meta.fieldI32(3, 0) // REQUIRED
+		meta.fieldBinary(4, col.name)
+		if col.converted >= 0 {
+			meta.fieldI32(6, col.converted)
+		}
+		meta.structEnd()
+	}
+	meta.fieldI64(3, int64(len(bars)))
+	meta.fieldListBegin(4, thriftStruct, 1)
+	meta.structBegin() // RowGroup
+	meta.fieldBegin(1, thriftList)
+	meta.buf = append(meta.buf, chunks.buf...)
+	meta.fieldI64(2, int64(totalSize))
+	meta.fieldI64(3, int64(len(bars)))
+	meta.structEnd()
+	meta.fieldBinary(6, "chart_for_data market_cli")
+	meta.structEnd()
+
+	out = append(out, meta.buf...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(meta.buf)))
+	out = append(out, "PAR1"...)
+
+	return os.WriteFile(path, out, 0644)
+}
+
+// Thrift compact protocol 的最小实现，只包含写Parquet元数据需要的类型
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	buf []byte
+	// 字段ID按差值编码，每层结构体各自记录上一个字段ID
+	lastIDs []int16
+}
+
+func (w *thriftWriter) varint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *thriftWriter) i32(v int32) {
+	w.varint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (w *thriftWriter) i64(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftWriter) binary(s string) {
+	w.varint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *thriftWriter) structBegin() {
+	w.lastIDs = append(w.lastIDs, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf = append(w.buf, 0)
+	w.lastIDs = w.lastIDs[:len(w.lastIDs)-1]
+}
+
+func (w *thriftWriter) fieldBegin(id int16, typ byte) {
+	last := &w.lastIDs[len(w.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.i32(int32(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) fieldI32(id int16, v int32) {
+	w.fieldBegin(id, thriftI32)
+	w.i32(v)
+}
+
+func (w *thriftWriter) fieldI64(id int16, v int64) {
+	w.fieldBegin(id, thriftI64)
+	w.i64(v)
+}
+
+func (w *thriftWriter) fieldBinary(id int16, s string) {
+	w.fieldBegin(id, thriftBinary)
+	w.binary(s)
+}
+
+func (w *thriftWriter) fieldStructBegin(id int16) {
+	w.fieldBegin(id, thriftStruct)
+	w.structBegin()
+}
+
+// 列表头，元素为结构体时每个元素用 structBegin/structEnd 包裹
+func (w *thriftWriter) listBegin(elemType byte, size int) {
+	if size < 15 {
+		w.buf = append(w.buf, byte(size)<<4|elemType)
+	} else {
+		w.buf = append(w.buf, 0xf0|elemType)
+		w.varint(uint64(size))
+	}
+}
+
+func (w *thriftWriter) fieldListBegin(id int16, elemType byte, size int) {
+	w.fieldBegin(id, thriftList)
+	w.listBegin(elemType, size)
+}
+
+// report 子命令：按报告模板逐个图表查询tick、聚合成K线、计算指标，生成多页PDF。
+// 模板为JSON，顶层的 range/bar/indicators 是各图表的默认值：
+//
+//	{
+//	  "title": "Weekly Coking Coal Package",
+//	  "range": "5d", "bar": "1h", "indicators": ["ma:20", "oi"],
+//	  "charts": [
+//	    {"symbol": "jm2509"},
+//	    {"symbol": "j2509", "range": "1d", "bar": "5m", "indicators": ["boll:20"]}
+//	  ]
+//	}
+type reportTemplate struct {
+	Title      string        `json:"title"`
+	Range      string        `json:"range"`
+	Bar        string        `json:"bar"`
+	Indicators []string      `json:"indicators"`
+	Charts     []reportChart `json:"charts"`
+}
+
+type reportChart struct {
+	Table      string   `json:"table"`
+	Symbol     string   `json:"symbol"`
+	Range      string   `json:"range"`
+	Bar        string   `json:"bar"`
+	Indicators []string `json:"indicators"`
+	Title      string   `json:"title"`
+}
+
+// 报告图表支持的指标：ma/ema/boll 带周期参数（K线根数），oi 在右轴画持仓量
+type reportIndicator struct {
+	kind   string
+	period int
+}
+
+func parseReportIndicator(spec string) (reportIndicator, error) {
+	kind, arg, _ := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	switch kind {
+	case "oi":
+		if arg != "" {
+			return reportIndicator{}, fmt.Errorf("indicator %q takes no period", spec)
+		}
+		return reportIndicator{kind: kind}, nil
+	case "ma", "ema", "boll":
+		period, err := strconv.Atoi(arg)
+		if err != nil || period < 2 {
+			return reportIndicator{}, fmt.Errorf("invalid indicator %q, expected e.g. %s:20", spec, kind)
+		}
+		return reportIndicator{kind, period}, nil
+	}
+	return reportIndicator{}, fmt.Errorf("unknown indicator %q (ma:N, ema:N, boll:N or oi)", spec)
+}
+
+// 读取模板，把顶层默认值填入各图表并校验
+func loadReportTemplate(path string) (reportTemplate, error) {
+	var tmpl reportTemplate
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tmpl, fmt.Errorf("failed to read template: %w", err)
+	}
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return tmpl, fmt.Errorf("failed to parse template %s: %w", path, err)
+	}
+	if len(tmpl.Charts) == 0 {
+		return tmpl, fmt.Errorf("template %s has no charts", path)
+	}
+	if tmpl.Range == "" {
+		tmpl.Range = "5d"
+	}
+	if tmpl.Bar == "" {
+		tmpl.Bar = "1h"
+	}
+	for i := range tmpl.Charts {
+		c := &tmpl.Charts[i]
+		if c.Symbol == "" {
+			return tmpl, fmt.Errorf("chart %d: symbol is required", i+1)
+		}
+		if c.Table == "" {
+			c.Table = strings.ToLower(strings.TrimRight(c.Symbol, "0123456789"))
+		}
+		if c.Range == "" {
+			c.Range = tmpl.Range
+		}
+		if c.Bar == "" {
+			c.Bar = tmpl.Bar
+		}
+		if c.Indicators == nil {
+			c.Indicators = tmpl.Indicators
+		}
+		if c.Range != "all" {
+			if _, err := parseInterval(c.Range); err != nil {
+				return tmpl, fmt.Errorf("chart %d: %w", i+1, err)
+			}
+		}
+		if _, err := parseInterval(c.Bar); err != nil {
+			return tmpl, fmt.Errorf("chart %d: %w", i+1, err)
+		}
+		for _, spec := range c.Indicators {
+			if _, err := parseReportIndicator(spec); err != nil {
+				return tmpl, fmt.Errorf("chart %d: %w", i+1, err)
+			}
+		}
+	}
+	return tmpl, nil
+}
+
+func runReportCommand(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	templatePath := fs.String("template", "report.json", "报告模板文件 (JSON)，列出各图表的symbol、时间范围、K线周期和指标")
+	out := fs.String("out", "report.pdf", "输出的PDF文件路径")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+	tmpl, err := loadReportTemplate(*templatePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var sections []reportSection
+	for _, c := range tmpl.Charts {
+		section, err := buildReportSection(c)
+		if err != nil {
+			log.Fatalf("Failed to build chart for %s: %v", c.Symbol, err)
+		}
+		fmt.Printf("%s: %d bars (%s, %s)\n", c.Symbol, len(section.bars), c.Range, c.Bar)
+		sections = append(sections, section)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := writeReportPDF(f, tmpl, sections, time.Now()); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %d charts to %s\n", len(sections), *out)
+}
+
+// 一个图表的数据和统计
+type reportSection struct {
+	chart reportChart
+	bars  []bar
+	ticks int
+	stats [][2]string
+	png   []byte
+}
+
+func buildReportSection(c reportChart) (reportSection, error) {
+	section := reportSection{chart: c}
+	ticks, err := queryTicks(c.Table, []string{c.Symbol}, c.Range)
+	if err != nil {
+		return section, err
+	}
+	if len(ticks) == 0 {
+		return section, fmt.Errorf("no ticks in table %s for %s", c.Table, c.Symbol)
+	}
+	interval, _ := parseInterval(c.Bar)
+	section.bars = aggregateBars(ticks, interval)
+	section.ticks = len(ticks)
+	section.stats = reportStats(section.bars, len(ticks))
+	if section.png, err = renderReportChart(c, section.bars); err != nil {
+		return section, err
+	}
+	return section, nil
+}
+
+// 报告中每个图表下方的统计表：区间首尾、OHLC、涨跌、成交量、持仓变化、逐根收益率标准差和最大回撤
+func reportStats(bars []bar, ticks int) [][2]string {
+	first, last := bars[0], bars[len(bars)-1]
+	high, low := first.high, first.low
+	var volume int64
+	peak, drawdown := first.close, 0.0
+	var returns []float64
+	for i, b := range bars {
+		high, low = math.Max(high, b.high), math.Min(low, b.low)
+		volume += b.diffVol
+		peak = math.Max(peak, b.close)
+		if peak > 0 {
+			drawdown = math.Max(drawdown, 1-b.close/peak)
+		}
+		if i > 0 && bars[i-1].close > 0 && b.close > 0 {
+			returns = append(returns, math.Log(b.close/bars[i-1].close))
+		}
+	}
+	stddev := 0.0
+	if len(returns) > 1 {
+		mean := 0.0
+		for _, r := range returns {
+			mean += r
+		}
+		mean /= float64(len(returns))
+		for _, r := range returns {
+			stddev += (r - mean) * (r - mean)
+		}
+		stddev = math.Sqrt(stddev / float64(len(returns)-1))
+	}
+
+	// 价格按float32最短表示的最大小数位数输出，涨跌同样取整到该位数
+	decimals := 0
+	for _, v := range []float64{first.open, high, low, last.close} {
+		if _, d := float32Price(v); d > decimals {
+			decimals = d
+		}
+	}
+	price := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', decimals, 64)
+	}
+	change := last.close - first.open
+	changePct := "-"
+	if first.open != 0 {
+		changePct = strconv.FormatFloat(change/first.open*100, 'f', 2, 64) + "%"
+	}
+	return [][2]string{
+		{"Period", first.time.Format("2006-01-02 15:04") + " - " + last.time.Format("2006-01-02 15:04")},
+		{"Open / High / Low / Close", price(first.open) + " / " + price(high) + " / " + price(low) + " / " + price(last.close)},
+		{"Change", price(change) + " (" + changePct + ")"},
+		{"Volume", strconv.FormatInt(volume, 10)},
+		{"Open interest", fmt.Sprintf("%d -> %d (%+d)", first.openInterest, last.openInterest, last.openInterest-first.openInterest)},
+		{"Return stddev per bar", strconv.FormatFloat(stddev*100, 'f', 3, 64) + "%"},
+		{"Max drawdown", strconv.FormatFloat(drawdown*100, 'f', 2, 64) + "%"},
+		{"Bars / ticks", fmt.Sprintf("%d / %d", len(bars), ticks)},
+	}
+}
+
+// 简单移动平均、指数移动平均和布林带（均线 ± 2倍标准差），结果与K线对齐，前 period-1 根K线不足一个周期，画图时跳过
+func movingAverage(closes []float64, period int) []float64 {
+	out := make([]float64, len(closes))
+	sum := 0.0
+	for i, c := range closes {
+		sum += c
+		if i >= period {
+			sum -= closes[i-period]
+		}
+		if i >= period-1 {
+			out[i] = sum / float64(period)
+		}
+	}
+	return out
+}
+
+func exponentialAverage(closes []float64, period int) []float64 {
+	out := make([]float64, len(closes))
+	alpha := 2 / float64(period+1)
+	for i, c := range closes {
+		if i == 0 {
+			out[i] = c
+		} else {
+			out[i] = alpha*c + (1-alpha)*out[i-1]
+		}
+	}
+	return out
+}
+
+func bollingerBands(closes []float64, period int) ([]float64, []float64) {
+	mid := movingAverage(closes, period)
+	upper, lower := make([]float64, len(closes)), make([]float64, len(closes))
+	for i := range closes {
+		if i < period-1 {
+			continue
+		}
+		variance := 0.0
+		for _, c := range closes[i-period+1 : i+1] {
+			variance += (c - mid[i]) * (c - mid[i])
+		}
+		sd := math.Sqrt(variance / float64(period))
+		upper[i], lower[i] = mid[i]+2*sd, mid[i]-2*sd
+	}
+	return upper, lower
+}
+
+var reportIndicatorColors = []drawing.Color{
+	{R: 255, G: 140, B: 0, A: 255}, {R: 111, G: 66, B: 193, A: 255}, {R: 32, G: 201, B: 151, A: 255}, {R: 232, G: 62, B: 140, A: 255},
+}
+
+// 用go-chart渲染收盘价和指标，返回PNG
+func renderReportChart(c reportChart, bars []bar) ([]byte, error) {
+	times := make([]time.Time, len(bars))
+	closes := make([]float64, len(bars))
+	ois := make([]float64, len(bars))
+	for i, b := range bars {
+		times[i], closes[i], ois[i] = b.time, b.close, float64(b.openInterest)
+	}
+
+	series := []chart.Series{
+		chart.TimeSeries{
+			Name:    "Close",
+			Style:   chart.Style{StrokeColor: drawing.Color{R: 0, G: 123, B: 255, A: 255}, StrokeWidth: 2},
+			XValues: times,
+			YValues: closes,
+		},
+	}
+	// skip 为开头不足一个周期、没有指标值的K线数
+	line := func(name string, values []float64, skip int, color drawing.Color, axis chart.YAxisType) {
+		if skip >= len(values) {
+			return
+		}
+		series = append(series, chart.TimeSeries{
+			Name:    name,
+			Style:   chart.Style{StrokeColor: color, StrokeWidth: 1.5},
+			YAxis:   axis,
+			XValues: times[skip:],
+			YValues: values[skip:],
+		})
+	}
+	hasOI := false
+	for i, spec := range c.Indicators {
+		ind, _ := parseReportIndicator(spec)
+		color := reportIndicatorColors[i%len(reportIndicatorColors)]
+		switch ind.kind {
+		case "ma":
+			line(fmt.Sprintf("MA(%d)", ind.period), movingAverage(closes, ind.period), ind.period-1, color, chart.YAxisPrimary)
+		case "ema":
+			line(fmt.Sprintf("EMA(%d)", ind.period), exponentialAverage(closes, ind.period), 0, color, chart.YAxisPrimary)
+		case "boll":
+			upper, lower := bollingerBands(closes, ind.period)
+			line(fmt.Sprintf("BOLL(%d) upper", ind.period), upper, ind.period-1, color, chart.YAxisPrimary)
+			line(fmt.Sprintf("BOLL(%d) lower", ind.period), lower, ind.period-1, color, chart.YAxisPrimary)
+		case "oi":
+			hasOI = true
+			line("Open Interest", ois, 0, drawing.ColorRed, chart.YAxisSecondary)
+		}
+	}
+
+	layout := "01-02 15:04"
+	if interval, _ := parseInterval(c.Bar); interval >= 24*time.Hour {
+		layout = "2006-01-02"
+	}
+	graph := chart.Chart{
+		Width:  1200,
+		Height: 600,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 30, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: chart.XAxis{
+			Style:          chart.Style{FontSize: 10},
+			ValueFormatter: chart.TimeValueFormatterWithFormat(layout),
+		},
+		YAxis: chart.YAxis{
+			Name:  "Price",
+			Style: chart.Style{FontSize: 10},
+		},
+		Series: series,
+	}
+	if hasOI {
+		graph.YAxisSecondary = chart.YAxis{Name: "Open Interest", Style: chart.Style{FontSize: 10}}
+	}
+	graph.Elements = []chart.Renderable{chart.LegendThin(&graph)}
+
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, fmt.Errorf("failed to render chart: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// A4纵向页面，单位为点 (1/72 英寸)
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 40.0
+)
+
+// 封面是模板标题和各图表的汇总表，之后每个图表一页：标题、图表和统计表
+func writeReportPDF(w io.Writer, tmpl reportTemplate, sections []reportSection, generated time.Time) error {
+	doc := newPDFDocument()
+	total := len(sections) + 1
+
+	title := tmpl.Title
+	if title == "" {
+		title = "Market Report"
+	}
+	cover := &pdfPage{}
+	cover.text(pdfMargin, 80, 20, true, title)
+	cover.text(pdfMargin, 105, 10, false, "Generated "+generated.Format("2006-01-02 15:04:05 MST"))
+	rows := [][]string{{"Symbol", "Range", "Bar", "Close", "Change", "Volume", "OI change"}}
+	for _, s := range sections {
+		first, last := s.bars[0], s.bars[len(s.bars)-1]
+		var volume int64
+		for _, b := range s.bars {
+			volume += b.diffVol
+		}
+		change := "-"
+		if first.open != 0 {
+			change = strconv.FormatFloat((last.close/first.open-1)*100, 'f', 2, 64) + "%"
+		}
+		closePrice, _ := float32Price(last.close)
+		rows = append(rows, []string{
+			s.chart.Symbol, s.chart.Range, s.chart.Bar, strconv.FormatFloat(closePrice, 'f', -1, 64), change,
+			strconv.FormatInt(volume, 10), fmt.Sprintf("%+d", last.openInterest-first.openInterest),
+		})
+	}
+	cover.table(pdfMargin, 140, []float64{90, 60, 50, 75, 70, 85, 85}, rows)
+	cover.footer(1, total)
+	doc.addPage(cover)
+
+	for i, s := range sections {
+		img, err := png.Decode(bytes.NewReader(s.png))
+		if err != nil {
+			return fmt.Errorf("failed to decode chart for %s: %w", s.chart.Symbol, err)
+		}
+		heading := s.chart.Title
+		if heading == "" {
+			heading = strings.ToUpper(s.chart.Symbol)
+		}
+		page := &pdfPage{}
+		page.text(pdfMargin, 60, 16, true, heading)
+		page.text(pdfMargin, 80, 10, false, fmt.Sprintf("Table %s, last %s, %s bars, indicators: %s",
+			s.chart.Table, s.chart.Range, s.chart.Bar, strings.Join(append([]string{"close"}, s.chart.Indicators...), ", ")))
+		width := pdfPageWidth - 2*pdfMargin
+		height := width * float64(img.Bounds().Dy()) / float64(img.Bounds().Dx())
+		page.image(doc.addImage(img), pdfMargin, 95, width, height)
+		stats := [][]string{{"Metric", "Value"}}
+		for _, kv := range s.stats {
+			stats = append(stats, []string{kv[0], kv[1]})
+		}
+		page.table(pdfMargin, 95+height+30, []float64{170, width - 170}, stats)
+		page.footer(i+2, total)
+		doc.addPage(page)
+	}
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// 最小的PDF写出器：只用标准14字体中的 Helvetica（WinAnsi编码，非Latin字符替换为 ?）和
+// FlateDecode压缩的RGB图像，满足报告的文字、表格和图表需要。对象编号从1开始，
+// 1 为 Catalog，2 为 Pages，3/4 为常规和粗体字体
+type pdfDocument struct {
+	objects [][]byte
+	pages   []int
+}
+
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.add(nil) // Catalog
+	d.add(nil) // Pages，页面都加完后写入
+	d.add([]byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>"))
+	d.add([]byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>"))
+	return d
+}
+
+// 添加对象，返回对象编号
+func (d *pdfDocument) add(body []byte) int {
+	d.objects = append(d.objects, body)
+	return len(d.objects)
+}
+
+func (d *pdfDocument) addStream(dict string, data []byte) int {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	return d.add(b.Bytes())
+}
+
+func (d *pdfDocument) addImage(img image.Image) int {
+	bounds := img.Bounds()
+	var raw bytes.Buffer
+	zw := zlib.NewWriter(&raw)
+	row := make([]byte, 0, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		zw.Write(row)
+	}
+	zw.Close()
+	return d.addStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+		bounds.Dx(), bounds.Dy()), raw.Bytes())
+}
+
+func (d *pdfDocument) addPage(p *pdfPage) {
+	contents := d.addStream("", p.content.Bytes())
+	var xobjects strings.Builder
+	for _, obj := range p.images {
+		fmt.Fprintf(&xobjects, " /Im%d %d 0 R", obj, obj)
+	}
+	d.pages = append(d.pages, d.add([]byte(fmt.Sprintf(
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject <<%s >> >> >>",
+		pdfPageWidth, pdfPageHeight, contents, xobjects.String()))))
+}
+
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	kids := make([]string, len(d.pages))
+	for i, page := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", page)
+	}
+	d.objects[0] = []byte("<< /Type /Catalog /Pages 2 0 R >>")
+	d.objects[1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(d.objects))
+	for i, body := range d.objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n", i+1)
+		b.Write(body)
+		b.WriteString("\nendobj\n")
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(d.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(d.objects)+1, xref)
+	return b.WriteTo(w)
+}
+
+// 一页的内容流。坐标以页面左上角为原点、向下为正，写入时换算为PDF的左下角坐标
+type pdfPage struct {
+	content bytes.Buffer
+	images  []int
+}
+
+// 转义PDF字符串中的括号和反斜杠，WinAnsi以外的字符替换为 ?
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfString(s))
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// 在 (x, y) 处按 width x height 绘制图像，y 为图像上边缘
+func (p *pdfPage) image(obj int, x, y, width, height float64) {
+	p.images = append(p.images, obj)
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, x, pdfPageHeight-y-height, obj)
+}
+
+// 第一行为粗体表头，表头下和表格末尾画横线
+func (p *pdfPage) table(x, y float64, widths []float64, rows [][]string) {
+	const rowHeight = 16.0
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	for i, row := range rows {
+		cx := x
+		for j, cell := range row {
+			p.text(cx, y+rowHeight*float64(i)+11, 9, i == 0, cell)
+			cx += widths[j]
+		}
+		if i == 0 {
+			p.line(x, y+rowHeight, x+total, y+rowHeight)
+		}
+	}
+	p.line(x, y+rowHeight*float64(len(rows))+4, x+total, y+rowHeight*float64(len(rows))+4)
+}
+
+func (p *pdfPage) footer(page, total int) {
+	p.text(pdfPageWidth/2-20, pdfPageHeight-25, 8, false, fmt.Sprintf("Page %d / %d", page, total))
+}
+
+// 动画默认帧数上限，超出时自动加大每帧滚动的记录数
+const RENDER_MAX_FRAMES = 120
+
+func runRenderCommand(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	table := fs.String("table", "jm", "ClickHouse表名 (feature.<table>)")
+	symbol := fs.String("symbol", "jm2509", "合约代码")
+	last := fs.String("last", "1d", "时间范围，相对各symbol最新数据时间，例如 2h、1d，all 表示全部")
+	barSpec := fs.String("bar", "", "先聚合成K线再绘制，例如 1m、5m，为空时直接绘制tick")
+	window := fs.Int("window", 200, "每帧显示的记录数，与终端查看器的滚动窗口对应")
+	step := fs.Int("step", 0, "相邻两帧之间滚动的记录数，0 表示按 -frames 自动计算")
+	frames := fs.Int("frames", RENDER_MAX_FRAMES, "动画最多帧数")
+	fps := fs.Int("fps", 10, "动画帧率")
+	width := fs.Int("width", 960, "图片宽度 (像素)")
+	height := fs.Int("height", 480, "图片高度 (像素)")
+	animate := fs.Bool("animate", false, "把滚动窗口渲染成动画，-out 为 .gif 或 .mp4 (需要ffmpeg)")
+	out := fs.String("out", "", "输出文件路径，默认 <symbol>.png，-animate 时默认 <symbol>.gif")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if *window < 2 || *frames < 1 || *fps < 1 || *fps > 100 || *step < 0 {
+		log.Fatal("-window must be at least 2, -frames at least 1, -fps between 1 and 100 and -step not negative")
+	}
+	if *out == "" {
+		*out = *symbol + ".png"
+		if *animate {
+			*out = *symbol + ".gif"
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(*out))
+	if *animate && ext != ".gif" && ext != ".mp4" {
+		log.Fatalf("-animate writes .gif or .mp4, got %q", *out)
+	}
+	if !*animate && ext != ".png" {
+		log.Fatalf("without -animate the output is a PNG, got %q", *out)
+	}
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	ticks, err := queryTicks(*table, []string{*symbol}, *last)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := renderSeries{symbol: *symbol}
+	if *barSpec != "" {
+		interval, err := parseInterval(*barSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, b := range aggregateBars(ticks, interval) {
+			s.times = append(s.times, b.time)
+			s.prices = append(s.prices, b.close)
+			s.ois = append(s.ois, float64(b.openInterest))
+		}
+	} else {
+		for _, t := range ticks {
+			s.times = append(s.times, t.time)
+			s.prices = append(s.prices, t.price)
+			s.ois = append(s.ois, float64(t.openInterest))
+		}
+	}
+	if len(s.times) < 2 {
+		log.Fatalf("%s: not enough data in %s (%d records)", *symbol, *last, len(s.times))
+	}
+
+	bounds := [][2]int{{0, len(s.times)}}
+	if *animate {
+		bounds = renderFrameBounds(len(s.times), *window, *step, *frames)
+	}
+	var images [][]byte
+	for _, b := range bounds {
+		img, err := renderFrame(s, b[0], b[1], *width, *height)
+		if err != nil {
+			log.Fatal(err)
+		}
+		images = append(images, img)
+	}
+
+	switch ext {
+	case ".png":
+		err = os.WriteFile(*out, images[0], 0644)
+	case ".gif":
+		var f *os.File
+		if f, err = os.Create(*out); err == nil {
+			err = writeRenderGIF(f, images, *fps)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	case ".mp4":
+		err = writeRenderMP4(*out, images, *fps)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	fmt.Printf("Wrote %d frames (%d records) to %s\n", len(images), len(s.times), *out)
+}
+
+// 待绘制的一条价格/持仓序列，tick或K线收盘价
+type renderSeries struct {
+	symbol string
+	times  []time.Time
+	prices []float64
+	ois    []float64
+}
+
+// 计算每帧显示的记录区间 [from, to)，与终端自动滚动一致：窗口右边缘从第一个完整窗口一路推进到最新记录。
+// step 为 0 时按 maxFrames 均分，最后一帧总是停在最新记录上
+func renderFrameBounds(n, window, step, maxFrames int) [][2]int {
+	if window > n {
+		window = n
+	}
+	span := n - window
+	if step <= 0 {
+		step = 1
+		if maxFrames > 1 && span > maxFrames-1 {
+			step = (span + maxFrames - 2) / (maxFrames - 1)
+		}
+	}
+
+	var bounds [][2]int
+	for end := window; end < n && len(bounds) < maxFrames-1; end += step {
+		bounds = append(bounds, [2]int{end - window, end})
+	}
+	return append(bounds, [2]int{n - window, n})
+}
+
+// 把 [from, to) 区间渲染成一张PNG，价格在主坐标轴，持仓量在副坐标轴，坐标轴随窗口重新缩放
+func renderFrame(s renderSeries, from, to, width, height int) ([]byte, error) {
+	times := s.times[from:to]
+	layout := "15:04:05"
+	if times[len(times)-1].Sub(times[0]) >= 24*time.Hour {
+		layout = "01-02 15:04"
+	}
+	graph := chart.Chart{
+		Title:      fmt.Sprintf("%s  %s - %s", s.symbol, times[0].Format("2006-01-02 15:04:05"), times[len(times)-1].Format("15:04:05")),
+		Width:      width,
+		Height:     height,
+		TitleStyle: chart.Style{FontSize: 11},
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: chart.XAxis{
+			Style:          chart.Style{FontSize: 9},
+			ValueFormatter: chart.TimeValueFormatterWithFormat(layout),
+		},
+		YAxis:          chart.YAxis{Name: "Price", Style: chart.Style{FontSize: 9}},
+		YAxisSecondary: chart.YAxis{Name: "Open Interest", Style: chart.Style{FontSize: 9}},
+		Series: []chart.Series{
+			chart.TimeSeries{
+				Name:    "Price",
+				Style:   chart.Style{StrokeColor: drawing.Color{R: 0, G: 160, B: 0, A: 255}, StrokeWidth: 1.5},
+				XValues: times,
+				YValues: s.prices[from:to],
+			},
+			chart.TimeSeries{
+				Name:    "Open Interest",
+				Style:   chart.Style{StrokeColor: drawing.ColorRed, StrokeWidth: 1},
+				YAxis:   chart.YAxisSecondary,
+				XValues: times,
+				YValues: s.ois[from:to],
+			},
+		},
+	}
+	// 顶部留给标题，图例放在绘图区左上角
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, fmt.Errorf("failed to render frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// 把PNG帧编码成循环播放的GIF，颜色量化到Plan 9调色板；图表只有少数几种颜色，不做抖动以免帧间闪烁
+func writeRenderGIF(w io.Writer, frames [][]byte, fps int) error {
+	anim := &gif.GIF{}
+	for i, data := range frames {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.Draw(paletted, paletted.Rect, img, img.Bounds().Min, draw.Src)
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, 100/fps)
+	}
+	// 最后一帧停留一秒再从头播放
+	anim.Delay[len(anim.Delay)-1] += 100
+	return gif.EncodeAll(w, anim)
+}
+
+// 通过 ffmpeg 把PNG帧编码成H.264 MP4，宽高补齐到偶数以满足 yuv420p 的要求
+func writeRenderMP4(path string, frames [][]byte, fps int) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("MP4 output needs ffmpeg in PATH (or use a .gif output): %w", err)
+	}
+	cmd := exec.Command(ffmpeg, "-y", "-loglevel", "error",
+		"-f", "image2pipe", "-framerate", strconv.Itoa(fps), "-i", "-",
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2", "-c:v", "libx264", "-pix_fmt", "yuv420p", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	for _, data := range frames {
+		if _, err = stdin.Write(data); err != nil {
+			break
+		}
+	}
+	stdin.Close()
+	if werr := cmd.Wait(); werr != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", werr, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// export-site 子命令：把一个symbol一段时间的数据和交互式图表页面写到一个目录，直接用浏览器打开 index.html 即可查看，
+// 不需要服务端和网络，适合归档分析结果
+func runExportSiteCommand(args []string) {
+	fs := flag.NewFlagSet("export-site", flag.ExitOnError)
+	table := fs.String("table", "jm", "ClickHouse表名 (feature.<table>)")
+	symbol := fs.String("symbol", "jm2509", "合约代码")
+	last := fs.String("last", "1d", "时间范围，相对各symbol最新数据时间，例如 2h、1d，all 表示全部（仅ClickHouse）")
+	input := fs.String("input", "", "tick CSV文件路径（表头包含 symbol,time,price 等列名），为空时从ClickHouse读取")
+	barSpec := fs.String("bar", "", "先聚合成K线再导出，例如 1m、5m，为空时导出tick")
+	title := fs.String("title", "", "页面标题，默认为 <SYMBOL> <时间范围>")
+	out := fs.String("out", "", "输出目录，默认 <symbol>_site")
+	proxy := fs.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	fs.Parse(args)
+
+	if *out == "" {
+		*out = *symbol + "_site"
+	}
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	var ticks []tick
+	var err error
+	if *input != "" {
+		ticks, err = readTicksCSV(*input, []string{*symbol})
+	} else {
+		ticks, err = queryTicks(*table, []string{*symbol}, *last)
+	}
+	if err != nil {
+		log.Fatal("Failed to read ticks:", err)
+	}
+	if len(ticks) < 2 {
+		log.Fatalf("%s: not enough data (%d ticks)", *symbol, len(ticks))
+	}
+
+	site := siteData{
+		Table:     *table,
+		Symbol:    *symbol,
+		Bar:       *barSpec,
+		Generated: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if *input != "" {
+		site.Table = filepath.Base(*input)
+	}
+	if *barSpec != "" {
+		interval, err := parseInterval(*barSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, b := range aggregateBars(ticks, interval) {
+			site.add(b.time, b.close, b.openInterest, b.diffVol)
+		}
+	} else {
+		for _, t := range ticks {
+			site.add(t.time, t.price, t.openInterest, t.diffVol)
+		}
+	}
+	site.From, site.To = site.Times[0], site.Times[len(site.Times)-1]
+	site.Title = *title
+	if site.Title == "" {
+		site.Title = fmt.Sprintf("%s %s - %s", strings.ToUpper(*symbol), site.From, site.To)
+	}
+
+	if err := writeSite(*out, site); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %d records to %s, open %s in a browser\n", len(site.Times), *out, filepath.Join(*out, "index.html"))
+}
+
+// 导出的数据，按列存放以减小文件体积
+type siteData struct {
+	Title     string    `json:"title"`
+	Table     string    `json:"table"`
+	Symbol    string    `json:"symbol"`
+	Bar       string    `json:"bar,omitempty"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Generated string    `json:"generated"`
+	Times     []string  `json:"time"`
+	Prices    []float64 `json:"price"`
+	OIs       []int64   `json:"open_interest"`
+	Volumes   []int64   `json:"volume"`
+}
+
+func (s *siteData) add(t time.Time, price float64, oi, volume int64) {
+	s.Times = append(s.Times, t.Format("2006-01-02 15:04:05"))
+	s.Prices = append(s.Prices, price)
+	s.OIs = append(s.OIs, oi)
+	s.Volumes = append(s.Volumes, volume)
+}
+
+// 写出 index.html、data.js 和 data.json。页面通过 <script src="data.js"> 加载数据：
+// 以 file:// 打开时浏览器不允许 fetch 本地文件；data.json 内容相同，供其他工具读取
+func writeSite(dir string, site siteData) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	data, err := json.Marshal(site)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"data.json", data},
+		{"data.js", append(append([]byte("window.CHART_DATA = "), data...), ";\n"...)},
+		{"index.html", []byte(siteIndexHTML)},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.content, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// 导出页面：用canvas直接绘制价格（左轴）和持仓（右轴），不依赖任何外部脚本。
+// 滚轮缩放、拖动平移、双击还原，鼠标悬停显示该点的时间、价格、持仓和成交量
+const siteIndexHTML = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Chart</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1600px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+            position: relative;
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+            margin: 0 0 5px;
+        }
+        .meta {
+            text-align: center;
+            color: #666;
+            font-size: 0.9em;
+            margin-bottom: 15px;
+        }
+        .stats {
+            display: flex;
+            justify-content: space-around;
+            margin-bottom: 15px;
+            padding: 15px;
+            background-color: #f8f9fa;
+            border-radius: 5px;
+        }
+        .stat-item {
+            text-align: center;
+        }
+        .stat-value {
+            font-size: 1.4em;
+            font-weight: bold;
+            color: #007bff;
+        }
+        .stat-label {
+            font-size: 0.9em;
+            color: #666;
+        }
+        canvas {
+            width: 100%;
+            height: 560px;
+            cursor: crosshair;
+        }
+        .hint {
+            text-align: center;
+            color: #888;
+            font-size: 0.85em;
+            margin-top: 8px;
+        }
+        .tooltip {
+            position: absolute;
+            display: none;
+            padding: 6px 10px;
+            background-color: rgba(33, 37, 41, 0.9);
+            color: white;
+            border-radius: 4px;
+            font-size: 12px;
+            pointer-events: none;
+            white-space: pre;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1 id="title"></h1>
+        <div class="meta" id="meta"></div>
+        <div class="stats" id="stats"></div>
+        <canvas id="chart"></canvas>
+        <div class="hint">滚轮缩放，拖动平移，双击还原</div>
+        <div class="tooltip" id="tooltip"></div>
+    </div>
+    <script src="data.js"></script>
+    <script>
+        const data = window.CHART_DATA;
+        const canvas = document.getElementById('chart');
+        const ctx = canvas.getContext('2d');
+        const tooltip = document.getElementById('tooltip');
+        const pad = { left: 70, right: 80, top: 20, bottom: 40 };
+        const n = data.time.length;
+        let view = { from: 0, to: n - 1 };
+        let hover = -1;
+        let drag = null;
+
+        document.title = data.title;
+        document.getElementById('title').textContent = data.title;
+        document.getElementById('meta').textContent = data.table + ' / ' + data.symbol + (data.bar ? '，' + data.bar + ' K线' : '，tick') +
+            '，' + n.toLocaleString() + ' 条记录，导出于 ' + data.generated;
+
+        function stat(label, value) {
+            const item = document.createElement('div');
+            item.className = 'stat-item';
+            const v = document.createElement('div');
+            v.className = 'stat-value';
+            v.textContent = value;
+            const l = document.createElement('div');
+            l.className = 'stat-label';
+            l.textContent = label;
+            item.append(v, l);
+            document.getElementById('stats').appendChild(item);
+        }
+        const first = data.price[0], lastPrice = data.price[n - 1];
+        const change = lastPrice - first;
+        stat('开盘', first);
+        stat('最新', lastPrice);
+        stat('最高', Math.max(...data.price));
+        stat('最低', Math.min(...data.price));
+        stat('涨跌', (change >= 0 ? '+' : '') + change.toFixed(2) + ' (' + (change / first * 100).toFixed(2) + '%)');
+        stat('持仓变化', (data.open_interest[n - 1] - data.open_interest[0]).toLocaleString());
+        stat('成交量', data.volume.reduce((a, b) => a + b, 0).toLocaleString());
+
+        function range(values) {
+            let min = Infinity, max = -Infinity;
+            for (let i = view.from; i <= view.to; i++) {
+                min = Math.min(min, values[i]);
+                max = Math.max(max, values[i]);
+            }
+            if (min === max) {
+                min -= 1;
+                max += 1;
+            }
+            const margin = (max - min) * 0.05;
+            return { min: min - margin, max: max + margin };
+        }
+
+        function plotWidth() {
+            return canvas.clientWidth - pad.left - pad.right;
+        }
+
+        function xOf(i) {
+            return pad.left + (view.to === view.from ? 0 : (i - view.from) / (view.to - view.from) * plotWidth());
+        }
+
+        function indexAt(x) {
+            const i = Math.round(view.from + (x - pad.left) / plotWidth() * (view.to - view.from));
+            return Math.max(view.from, Math.min(view.to, i));
+        }
+
+        function line(values, r, color, height) {
+            ctx.strokeStyle = color;
+            ctx.lineWidth = 1.5;
+            ctx.beginPath();
+            for (let i = view.from; i <= view.to; i++) {
+                const y = pad.top + (r.max - values[i]) / (r.max - r.min) * height;
+                if (i === view.from) {
+                    ctx.moveTo(xOf(i), y);
+                } else {
+                    ctx.lineTo(xOf(i), y);
+                }
+            }
+            ctx.stroke();
+        }
+
+        function draw() {
+            const ratio = window.devicePixelRatio || 1;
+            const width = canvas.clientWidth, height = canvas.clientHeight;
+            canvas.width = width * ratio;
+            canvas.height = height * ratio;
+            ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+            ctx.clearRect(0, 0, width, height);
+
+            const plotHeight = height - pad.top - pad.bottom;
+            const price = range(data.price), oi = range(data.open_interest);
+            ctx.font = '12px Arial';
+            ctx.lineWidth = 1;
+            for (let k = 0; k <= 5; k++) {
+                const y = pad.top + plotHeight * k / 5;
+                ctx.strokeStyle = '#e9ecef';
+                ctx.beginPath();
+                ctx.moveTo(pad.left, y);
+                ctx.lineTo(width - pad.right, y);
+                ctx.stroke();
+                ctx.fillStyle = '#007bff';
+                ctx.textAlign = 'right';
+                ctx.fillText((price.max - (price.max - price.min) * k / 5).toFixed(1), pad.left - 6, y + 4);
+                ctx.fillStyle = '#fd7e14';
+                ctx.textAlign = 'left';
+                ctx.fillText(Math.round(oi.max - (oi.max - oi.min) * k / 5).toLocaleString(), width - pad.right + 6, y + 4);
+            }
+            ctx.fillStyle = '#666';
+            ctx.textAlign = 'center';
+            for (let k = 0; k <= 5; k++) {
+                const i = Math.round(view.from + (view.to - view.from) * k / 5);
+                ctx.fillText(data.time[i].slice(5, 16), xOf(i), height - pad.bottom + 18);
+            }
+
+            line(data.open_interest, oi, '#fd7e14', plotHeight);
+            line(data.price, price, '#007bff', plotHeight);
+
+            if (hover >= 0) {
+                ctx.strokeStyle = '#adb5bd';
+                ctx.lineWidth = 1;
+                ctx.beginPath();
+                ctx.moveTo(xOf(hover), pad.top);
+                ctx.lineTo(xOf(hover), pad.top + plotHeight);
+                ctx.stroke();
+            }
+        }
+
+        canvas.addEventListener('mousemove', event => {
+            const x = event.offsetX;
+            if (drag) {
+                const shift = Math.round((drag.x - x) / plotWidth() * (drag.to - drag.from));
+                const span = drag.to - drag.from;
+                view.from = Math.max(0, Math.min(n - 1 - span, drag.from + shift));
+                view.to = view.from + span;
+            }
+            hover = indexAt(x);
+            tooltip.style.display = 'block';
+            tooltip.style.left = (canvas.offsetLeft + x + 15) + 'px';
+            tooltip.style.top = (canvas.offsetTop + event.offsetY + 15) + 'px';
+            tooltip.textContent = data.time[hover] + '\n价格: ' + data.price[hover] +
+                '\n持仓: ' + data.open_interest[hover].toLocaleString() + '\n成交量: ' + data.volume[hover].toLocaleString();
+            draw();
+        });
+        canvas.addEventListener('mouseleave', () => {
+            hover = -1;
+            drag = null;
+            tooltip.style.display = 'none';
+            draw();
+        });
+        canvas.addEventListener('mousedown', event => {
+            drag = { x: event.offsetX, from: view.from, to: view.to };
+        });
+        window.addEventListener('mouseup', () => {
+            drag = null;
+        });
+        canvas.addEventListener('wheel', event => {
+            event.preventDefault();
+            const center = indexAt(event.offsetX);
+            const factor = event.deltaY > 0 ? 1.25 : 0.8;
+            const span = Math.max(10, Math.round((view.to - view.from) * factor));
+            const left = (center - view.from) / Math.max(1, view.to - view.from);
+            view.from = Math.max(0, Math.round(center - span * left));
+            view.to = Math.min(n - 1, view.from + span);
+            view.from = Math.max(0, view.to - span);
+            draw();
+        }, { passive: false });
+        canvas.addEventListener('dblclick', () => {
+            view = { from: 0, to: n - 1 };
+            draw();
+        });
+        window.addEventListener('resize', draw);
+        draw();
+    </script>
+</body>
+</html>
+`
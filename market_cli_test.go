@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// 用假的ClickHouse替换共享HTTP客户端：DESCRIBE 返回标准表结构，其他查询交给 respond，返回收到的所有查询
+func fakeCLIClickHouse(t *testing.T, respond func(query string) string) *[]string {
+	t.Helper()
+	var queries []string
+	old := httpClient
+	httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		query := string(body)
+		queries = append(queries, query)
+		result := ""
+		if strings.HasPrefix(query, "DESCRIBE") {
+			for _, col := range expectedColumns {
+				result += col.name + "\t" + col.families[0] + "64\n"
+			}
+		} else {
+			result = respond(query)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(result)), Header: make(http.Header)}, nil
+	})}
+	t.Cleanup(func() { httpClient = old })
+	return &queries
+}
+
+func TestAggregateBars(t *testing.T) {
+	at := func(s string) time.Time {
+		v, _ := time.Parse("2006-01-02 15:04:05", s)
+		return v
+	}
+	ticks := []tick{
+		{symbol: "jm2509", time: at("2025-07-01 09:00:01"), price: 800, vol: 10, diffVol: 10, diffOI: 2, bid1: 799, ask1: 801},
+		{symbol: "j2509", time: at("2025-07-01 09:00:02"), price: 1500, vol: 5, diffVol: 5},
+		{symbol: "jm2509", time: at("2025-07-01 09:00:30"), price: 805, vol: 13, diffVol: 3, diffOI: -1, bid1: 804, ask1: 806},
+		{symbol: "jm2509", time: at("2025-07-01 09:00:59"), price: 798, vol: 20, openInterest: 900, diffVol: 7, bid1: 797, bidVolumn1: 4, ask1: 799, askVolumn1: 6},
+		{symbol: "jm2509", time: at("2025-07-01 09:01:00"), price: 802, vol: 21, diffVol: 1},
+	}
+
+	bars := aggregateBars(ticks, time.Minute)
+	if len(bars) != 3 {
+		t.Fatalf("%d bars: %+v", len(bars), bars)
+	}
+	// 按 symbol、时间排序
+	if bars[0].symbol != "j2509" || bars[1].symbol != "jm2509" || !bars[2].time.Equal(at("2025-07-01 09:01:00")) {
+		t.Errorf("order = %s %s %s", bars[0].symbol, bars[1].symbol, bars[2].time)
+	}
+	want := bar{
+		symbol: "jm2509", time: at("2025-07-01 09:00:00"), open: 800, high: 805, low: 798, close: 798,
+		vol: 20, openInterest: 900, diffVol: 20, diffOI: 1, bid1: 797, bidVolumn1: 4, ask1: 799, askVolumn1: 6, ticks: 3,
+	}
+	if bars[1] != want {
+		t.Errorf("bar = %+v, want %+v", bars[1], want)
+	}
+	if b := bars[2]; b.open != 802 || b.close != 802 || b.ticks != 1 || b.diffVol != 1 {
+		t.Errorf("next bar = %+v", b)
+	}
+	if hourly := aggregateBars(ticks, time.Hour); len(hourly) != 2 || hourly[1].ticks != 4 || hourly[1].diffVol != 21 {
+		t.Errorf("hourly = %+v", hourly)
+	}
+}
+
+// Thrift compact protocol 的读取，只用于校验 writeBarsParquet 的元数据：结构体读成 字段ID -> 值，列表读成切片
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 4, thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.varint())
+		r.pos += n
+		return string(r.buf[r.pos-n : r.pos])
+	case thriftList:
+		header := r.buf[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i] = r.value(header & 0x0f)
+		}
+		return items
+	case thriftStruct:
+		fields := make(map[int16]interface{})
+		var id int16
+		for {
+			header := r.buf[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.zigzag())
+			}
+			fields[id] = r.value(header & 0x0f)
+		}
+	}
+	panic("unsupported thrift type")
+}
+
+func thriftStructAt(buf []byte, pos int) (map[int16]interface{}, int) {
+	r := &thriftReader{buf: buf, pos: pos}
+	fields := r.value(thriftStruct).(map[int16]interface{})
+	return fields, r.pos
+}
+
+func TestWriteBarsParquet(t *testing.T) {
+	start := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	bars := make([]bar, 20)
+	for i := range bars {
+		bars[i] = bar{
+			symbol: []string{"jm2509", "j2509"}[i%2], time: start.Add(time.Duration(i) * time.Minute),
+			open: 800 + float64(i), high: 810.5, low: 790.25, close: 801, vol: int64(1000 + i), openInterest: 50000,
+			diffVol: int64(i), diffOI: int64(i - 10), bid1: 800, bidVolumn1: 3, ask1: 801, askVolumn1: 4, ticks: int64(i + 1),
+		}
+	}
+	path := filepath.Join(t.TempDir(), "bars.parquet")
+	if err := writeBarsParquet(path, bars); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件头尾的 PAR1 和尾部的元数据长度
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatal("missing PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerLen
+	meta, end := thriftStructAt(data, footerStart)
+	if end != len(data)-8 {
+		t.Fatalf("footer parsed to %d, want %d", end, len(data)-8)
+	}
+	if meta[1] != int64(1) || meta[3] != int64(len(bars)) {
+		t.Errorf("version %v num_rows %v", meta[1], meta[3])
+	}
+
+	type column struct {
+		name      string
+		typ       int64
+		converted int64
+	}
+	want := []column{
+		{"symbol", parquetByteArray, parquetConvertedUTF8}, {"time", parquetInt64, parquetConvertedTimestampMillis},
+		{"open", parquetDouble, -1}, {"high", parquetDouble, -1}, {"low", parquetDouble, -1}, {"close", parquetDouble, -1},
+		{"vol", parquetInt64, -1}, {"open_interest", parquetInt64, -1}, {"diff_vol", parquetInt64, -1}, {"diff_oi", parquetInt64, -1},
+		{"bid_1", parquetDouble, -1}, {"bid_volumn_1", parquetInt64, -1}, {"ask_1", parquetDouble, -1}, {"ask_volumn_1", parquetInt64, -1},
+		{"ticks", parquetInt64, -1},
+	}
+	schema := meta[2].([]interface{})
+	if root := schema[0].(map[int16]interface{}); root[4] != "schema" || root[5] != int64(len(want)) {
+		t.Errorf("schema root = %v", root)
+	}
+	var got []column
+	for _, item := range schema[1:] {
+		e := item.(map[int16]interface{})
+		if e[3] != int64(0) {
+			t.Errorf("%v is not REQUIRED", e[4])
+		}
+		c := column{e[4].(string), e[1].(int64), -1}
+		if v, ok := e[6]; ok {
+			c.converted = v.(int64)
+		}
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("schema = %v", got)
+	}
+
+	// 单个行组，每列一个 PLAIN 编码、无压缩的数据页，列块首尾相接直到元数据
+	groups := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups", len(groups))
+	}
+	group := groups[0].(map[int16]interface{})
+	chunks := group[1].([]interface{})
+	if len(chunks) != len(want) || group[3] != int64(len(bars)) {
+		t.Fatalf("%d chunks, num_rows %v", len(chunks), group[3])
+	}
+	next, total := int64(4), int64(0)
+	for i, item := range chunks {
+		chunk := item.(map[int16]interface{})
+		cm := chunk[3].(map[int16]interface{})
+		offset := chunk[2].(int64)
+		size := cm[7].(int64)
+		if offset != next || cm[9] != offset || cm[6] != size {
+			t.Fatalf("%s: chunk at %d (data page %v) size %d/%v, want offset %d", want[i].name, offset, cm[9], size, cm[6], next)
+		}
+		if cm[1] != want[i].typ || !reflect.DeepEqual(cm[3], []interface{}{want[i].name}) || cm[4] != int64(0) || cm[5] != int64(len(bars)) {
+			t.Errorf("%s: column metadata = %v", want[i].name, cm)
+		}
+		if !reflect.DeepEqual(cm[2], []interface{}{int64(0)}) {
+			t.Errorf("%s: encodings = %v", want[i].name, cm[2])
+		}
+		next, total = offset+size, total+size
+
+		page, valuesStart := thriftStructAt(data, int(offset))
+		dph := page[5].(map[int16]interface{})
+		if page[1] != int64(0) || page[2] != page[3] || dph[1] != int64(len(bars)) || dph[2] != int64(0) {
+			t.Errorf("%s: page header = %v", want[i].name, page)
+		}
+		values := data[valuesStart : valuesStart+int(page[3].(int64))]
+		if int64(valuesStart)+page[3].(int64) != offset+size {
+			t.Errorf("%s: page ends at %d, chunk at %d", want[i].name, int64(valuesStart)+page[3].(int64), offset+size)
+		}
+
+		for j, b := range bars {
+			switch want[i].name {
+			case "symbol":
+				n := int(binary.LittleEndian.Uint32(values))
+				if s := string(values[4 : 4+n]); s != b.symbol {
+					t.Errorf("row %d symbol = %q, want %q", j, s, b.symbol)
+				}
+				values = values[4+n:]
+			case "time":
+				if v := int64(binary.LittleEndian.Uint64(values[8*j:])); v != b.time.UnixMilli() {
+					t.Errorf("row %d time = %d", j, v)
+				}
+			case "open", "close":
+				v := math.Float64frombits(binary.LittleEndian.Uint64(values[8*j:]))
+				if (want[i].name == "open" && v != b.open) || (want[i].name == "close" && v != b.close) {
+					t.Errorf("row %d %s = %v", j, want[i].name, v)
+				}
+			case "diff_oi":
+				if v := int64(binary.LittleEndian.Uint64(values[8*j:])); v != b.diffOI {
+					t.Errorf("row %d diff_oi = %d, want %d", j, v, b.diffOI)
+				}
+			case "ticks":
+				if v := int64(binary.LittleEndian.Uint64(values[8*j:])); v != b.ticks {
+					t.Errorf("row %d ticks = %d, want %d", j, v, b.ticks)
+				}
+			}
+		}
+	}
+	if next != int64(footerStart) || group[2] != total {
+		t.Errorf("chunks end at %d (total %v), footer at %d", next, group[2], footerStart)
+	}
+}
+
+func TestQueryTicksRecentWindow(t *testing.T) {
+	queries := fakeCLIClickHouse(t, func(query string) string {
+		return "symbol\ttime\tprice\tdatetime\njm2505\t2025-05-15 14:59:59\t812.5\t1747292399000\n"
+	})
+	ticks, err := queryTicks("jm", []string{"jm2505", "jm2509"}, "2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ticks) != 1 || ticks[0].symbol != "jm2505" || ticks[0].price != 812.5 {
+		t.Errorf("ticks = %+v", ticks)
+	}
+	// 窗口终点为每个symbol自己的最新时间：已交割的 jm2505 不因表中 jm2509 的更新数据而落在窗口外
+	query := strings.Join(strings.Fields((*queries)[len(*queries)-1]), " ")
+	for _, part := range []string{
+		"SELECT symbol, max(time) - INTERVAL 7200 SECOND AS window_start FROM feature.jm WHERE symbol IN ('jm2505', 'jm2509') GROUP BY symbol",
+		"AS recent USING (symbol)",
+		"time >= recent.window_start",
+	} {
+		if !strings.Contains(query, part) {
+			t.Errorf("query missing %q:\n%s", part, query)
+		}
+	}
+	if strings.Contains(query, "(SELECT max(time) FROM feature.jm)") {
+		t.Errorf("query still anchors on the table-wide max(time):\n%s", query)
+	}
+
+	// all 不限制时间
+	if _, err := queryTicks("jm", nil, "all"); err != nil {
+		t.Fatal(err)
+	}
+	if query := (*queries)[len(*queries)-1]; strings.Contains(query, "recent") || !strings.Contains(query, "WHERE 1") {
+		t.Errorf("all query = %s", query)
+	}
+}
+
+func TestQuerySymbolStatsRecentWindow(t *testing.T) {
+	queries := fakeCLIClickHouse(t, func(query string) string {
+		return `{"symbol":"jm2505","time":"2025-05-15 14:59:59","last":812.5,"first":800,"volume":1200,"oi":30000,"first_oi":31000,"spread":0.5}
+{"symbol":"jm2509","time":"2025-07-01 15:00:00","last":737.4000244140625,"first":750,"volume":5000,"oi":90000,"first_oi":88000,"spread":0.5}
+`
+	})
+	stats, err := querySymbolStats("jm", []string{"jm2505", "jm2509"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if s := stats[0]; s.Symbol != "jm2505" || s.Change != 12.5 || s.ChangePc != 1.5625 || s.OIChange != -1000 {
+		t.Errorf("jm2505 = %+v", s)
+	}
+	if s := stats[1]; s.Last != 737.4 || s.Change != -12.6 || s.OIChange != 2000 {
+		t.Errorf("jm2509 = %+v", s)
+	}
+	// 每个symbol的窗口以自己的最新时间为终点，已停止交易的 jm2505 仍有统计
+	query := strings.Join(strings.Fields((*queries)[len(*queries)-1]), " ")
+	for _, part := range []string{
+		"SELECT symbol, max(time) - INTERVAL 86400 SECOND AS window_start FROM feature.jm WHERE symbol IN ('jm2505', 'jm2509') GROUP BY symbol",
+		"WHERE symbol IN ('jm2505', 'jm2509') AND time >= recent.window_start GROUP BY symbol",
+	} {
+		if !strings.Contains(query, part) {
+			t.Errorf("query missing %q:\n%s", part, query)
+		}
+	}
+	if strings.Contains(query, "(SELECT max(time) FROM feature.jm)") {
+		t.Errorf("query still anchors on the table-wide max(time):\n%s", query)
+	}
+}
+
+func TestQuoteString(t *testing.T) {
+	for in, want := range map[string]string{
+		"jm2509":      `'jm2509'`,
+		"it's":        `'it\'s'`,
+		`jm\`:         `'jm\\'`,
+		`x\' OR 1=1 `: `'x\\\' OR 1=1 '`,
+	} {
+		if got := quoteString(in); got != want {
+			t.Errorf("quoteString(%q) = %s, want %s", in, got, want)
+		}
+	}
+	if got := symbolInCondition([]string{"a", `b\`}); got != `symbol IN ('a', 'b\\')` {
+		t.Errorf("symbolInCondition = %s", got)
+	}
+
+	// 表名拼接进SQL，不合法时在查询前拒绝
+	queries := fakeCLIClickHouse(t, func(string) string { return "" })
+	if _, err := queryTicks("jm; DROP TABLE jm", nil, "all"); err == nil || len(*queries) != 0 {
+		t.Errorf("invalid table: err = %v, %d queries sent", err, len(*queries))
+	}
+}
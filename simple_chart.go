@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,8 +26,210 @@ const (
 	UPDATE_INTERVAL = 2 * time.Second
 	CHART_HEIGHT    = 20
 	CHART_WIDTH     = 100
+	RETRY_INTERVAL  = 5 * time.Second
 )
 
+// 通过 -last 参数指定的相对时间范围，0 表示加载全部历史
+var lastRange time.Duration
+
+// 显示的合约，没有数据时可以在空状态中改选；表固定为 feature.jm
+const CHART_TABLE = "jm"
+
+var chartSymbol = "jm2509"
+
+// 通过 -series 选择绘制的价格序列：price 为最新价，mid 为买一卖一中间价，spread 为以最小变动价位计的买卖价差
+var priceSeries = "price"
+
+// 通过 -tick-size 指定的最小变动价位，0 表示按品种自动查表
+var tickSizeOverride float64
+
+// 价位线文件，与Web查看器的 -levels-file 相同：{"jm2509": [{"id": "...", "price": 1012.5, "label": "前高"}]}
+var levelsPath = "levels.json"
+
+// 读取合约的价位线价格；文件不存在时没有价位线，读取失败只记日志
+func loadLevels(path, symbol string) []float64 {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var all map[string][]struct {
+		Price float64 `json:"price"`
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &all)
+	}
+	if err != nil {
+		log.Printf("Failed to load levels %s: %v", path, err)
+		return nil
+	}
+	var prices []float64
+	for _, level := range all[strings.ToLower(symbol)] {
+		prices = append(prices, level.Price)
+	}
+	return prices
+}
+
+// 界面状态文件，与Web查看器和终端图表的 -state-file 相同，为空时不保存也不恢复
+var statePath = "ui_state.json"
+
+// 定期保存界面状态的间隔，程序被强制结束时最多丢失这段时间内的改动
+const STATE_SAVE_INTERVAL = 30 * time.Second
+
+// 上次使用的界面状态，各查看器只读写自己用得到的字段，其余字段原样保留；
+// window_end 为窗口最右端的时间，follow 为 true 时窗口跟随最新数据，不恢复滚动位置
+type uiState struct {
+	Table      string   `json:"table,omitempty"`
+	Symbol     string   `json:"symbol,omitempty"`
+	Range      string   `json:"range,omitempty"`
+	Series     string   `json:"series,omitempty"`
+	Theme      string   `json:"theme,omitempty"`
+	Indicators []string `json:"indicators,omitempty"`
+	WindowSize int      `json:"window_size,omitempty"`
+	WindowEnd  string   `json:"window_end,omitempty"`
+	Follow     bool     `json:"follow,omitempty"`
+	SavedAt    string   `json:"saved_at,omitempty"`
+	SavedBy    string   `json:"saved_by,omitempty"`
+}
+
+// 读取界面状态，文件不存在时返回空状态
+func loadUIState(path string) (uiState, error) {
+	var state uiState
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return uiState{}, fmt.Errorf("failed to parse state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// 在文件中现有状态的基础上修改并保存，先写临时文件再改名，写到一半退出时不会留下损坏的状态文件；
+// 现有文件损坏时从空状态开始
+func saveUIState(path, savedBy string, update func(*uiState)) error {
+	if path == "" {
+		return nil
+	}
+	state, err := loadUIState(path)
+	if err != nil {
+		log.Printf("Overwriting unreadable state file: %v", err)
+		state = uiState{}
+	}
+	update(&state)
+	state.SavedAt = time.Now().Format("2006-01-02 15:04:05")
+	state.SavedBy = savedBy
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// 常见期货品种的最小变动价位，未列出的品种视为未知，价格不按tick舍入
+var productTickSizes = map[string]float64{
+	"a": 1, "ag": 1, "al": 5, "ap": 1, "au": 0.02, "bu": 1, "c": 1, "cf": 5, "cu": 10,
+	"eb": 1, "eg": 1, "fg": 1, "fu": 1, "hc": 1, "i": 0.5, "j": 0.5, "jm": 0.5, "l": 1,
+	"lc": 50, "lh": 5, "m": 1, "ma": 1, "ni": 10, "oi": 1, "p": 2, "pg": 1, "pp": 1,
+	"rb": 1, "rm": 1, "ru": 5, "sa": 1, "sc": 0.1, "sf": 2, "si": 5, "sm": 2, "sp": 2,
+	"sr": 1, "ss": 5, "ta": 2, "ur": 1, "v": 1, "y": 2, "zn": 5,
+}
+
+func validateSeries(series string) error {
+	switch series {
+	case "price", "mid", "spread":
+		return nil
+	}
+	return fmt.Errorf("unknown series %q (price, mid or spread)", series)
+}
+
+func tickSizeFor(symbol string) float64 {
+	if tickSizeOverride > 0 {
+		return tickSizeOverride
+	}
+	if size, ok := productTickSizes[strings.ToLower(strings.TrimRight(symbol, "0123456789"))]; ok {
+		return size
+	}
+	return 0
+}
+
+// 按 -series 取一条记录的绘图值；没有有效买一/卖一报价时中间价退回最新价，价差记为0。
+// 价格先换算成tick数再计算，价差是精确的整数，中间价不会带上float32的舍入误差。
+// 最小变动价位未知时直接用原始价格计算，价差的单位是价格而不是tick
+func seriesValue(record MarketData) float64 {
+	tick := tickSizeFor(record.Symbol)
+	quoted := record.Bid1 > 0 && record.Ask1 > 0
+	switch {
+	case priceSeries == "mid" && quoted && tick <= 0:
+		return rawPrice(float32((rawPrice(record.Bid1) + rawPrice(record.Ask1)) / 2))
+	case priceSeries == "mid" && quoted:
+		return ticksToPrice(priceToTicks(record.Bid1, tick)+priceToTicks(record.Ask1, tick), tick/2)
+	case priceSeries == "spread" && quoted && tick <= 0:
+		return rawPrice(float32(rawPrice(record.Ask1) - rawPrice(record.Bid1)))
+	case priceSeries == "spread" && quoted:
+		return float64(priceToTicks(record.Ask1, tick) - priceToTicks(record.Bid1, tick))
+	case priceSeries == "spread":
+		return 0
+	}
+	return priceValue(record.Price, tick)
+}
+
+// float32价格经tick数换算得到的精确十进制价格；最小变动价位未知时不舍入，取原始价格
+func priceValue(price float32, tick float64) float64 {
+	if tick <= 0 {
+		return rawPrice(price)
+	}
+	return ticksToPrice(priceToTicks(price, tick), tick)
+}
+
+// float32价格的最短十进制表示，例如 3801.2 而不是 3801.199951171875
+func rawPrice(price float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(price), 'g', -1, 32), 64)
+	return v
+}
+
+// 价格在内部按最小变动价位的整数倍（tick数）计算，只在输出时换算回价格，避免float32舍入误差在价差和指标中累积
+func priceToTicks(price float32, tick float64) int64 {
+	return int64(math.Round(float64(price) / tick))
+}
+
+// tick数换算回价格，并舍入到最小变动价位的小数位数（例如 0.1 的3倍为 0.3 而不是 0.30000000000000004）
+func ticksToPrice(ticks int64, tick float64) float64 {
+	scale := math.Pow10(tickDecimals(tick))
+	return math.Round(float64(ticks)*tick*scale) / scale
+}
+
+// 最小变动价位的小数位数，例如 0.5 为1位、0.02 为2位、1 为0位
+func tickDecimals(tick float64) int {
+	text := strconv.FormatFloat(tick, 'f', -1, 64)
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		return len(text) - i - 1
+	}
+	return 0
+}
+
+func seriesLabel() string {
+	switch priceSeries {
+	case "mid":
+		return "Mid Price"
+	case "spread":
+		return "Spread (ticks)"
+	}
+	return "Price"
+}
+
 type MarketData struct {
 	Symbol       string    `json:"symbol"`
 	Time         time.Time `json:"time"`
@@ -34,31 +246,196 @@ type MarketData struct {
 }
 
 func main() {
-	fmt.Println("Connecting to ClickHouse...")
+	last := flag.String("last", "all", "只加载最近一段时间的数据，例如 30m、2h、1d、5d 或 all")
+	flag.StringVar(&priceSeries, "series", "price", "绘制的价格序列: price(最新价)、mid(买一卖一中间价) 或 spread(买卖价差，单位为最小变动价位)")
+	flag.Float64Var(&tickSizeOverride, "tick-size", 0, "计算价差使用的最小变动价位，0 表示按品种自动识别")
+	proxy := flag.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	flag.StringVar(&chartSymbol, "symbol", chartSymbol, "显示的合约代码（feature.jm 表中的合约）")
+	flag.StringVar(&marketSource, "source", SOURCE_CLICKHOUSE, "行情数据来源: clickhouse 或 demo（本地生成的模拟行情，不需要ClickHouse）")
+	flag.StringVar(&levelsPath, "levels-file", levelsPath, "价位线文件，与Web查看器的 -levels-file 相同，落在窗口价格范围内的价位线用 - 标出")
+	flag.StringVar(&statePath, "state-file", statePath, "界面状态文件，与Web查看器的 -state-file 相同，退出时和每30秒保存合约、序列和滚动位置，下次启动时恢复；为空时不保存")
+	flag.Parse()
+
+	if marketSource != SOURCE_CLICKHOUSE && marketSource != SOURCE_DEMO {
+		log.Fatalf("invalid -source %q: expected clickhouse or demo", marketSource)
+	}
 
-	// 测试连接
-	if err := testConnection(); err != nil {
-		log.Fatal("Failed to connect to ClickHouse:", err)
+	// 恢复上次的合约和序列，命令行上明确指定的参数优先；其他表的合约不恢复
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	state, err := loadUIState(statePath)
+	if err != nil {
+		log.Printf("Ignoring UI state: %v", err)
+	}
+	if state.Symbol != "" && !explicit["symbol"] && (state.Table == "" || state.Table == CHART_TABLE) {
+		chartSymbol = state.Symbol
+	}
+	if state.Series != "" && !explicit["series"] && validateSeries(state.Series) == nil {
+		priceSeries = state.Series
 	}
 
-	fmt.Println("Successfully connected to ClickHouse!")
+	if err := setupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
 
-	// 查询数据
-	data, err := queryMarketData()
+	if err := validateSeries(priceSeries); err != nil {
+		log.Fatal(err)
+	}
+
+	lastRange, err = parseRelativeRange(*last)
 	if err != nil {
-		log.Fatal("Failed to query data:", err)
+		log.Fatal(err)
 	}
 
-	if len(data) == 0 {
-		log.Fatal("No data found in the table")
+	if marketSource == SOURCE_DEMO {
+		fmt.Println("Using simulated demo data, ClickHouse is not required")
+	} else {
+		fmt.Println("Connecting to ClickHouse...")
 	}
 
+	// 加载失败不退出：打印错误后定时重试，按回车立即重试
+	data := loadDataWithRetry()
+
 	fmt.Printf("Found %d records\n", len(data))
+	if skipped, detail := parseErrorSummary(); skipped > 0 {
+		fmt.Printf("%d rows skipped due to parse errors: %s\n", skipped, detail)
+	}
 	fmt.Println("Starting chart display... Press Ctrl+C to exit")
 	time.Sleep(2 * time.Second)
 
-	// 创建图表
-	createASCIIChart(data)
+	// 创建图表，合约没有改变时从上次查看的位置开始
+	windowEnd := ""
+	if strings.EqualFold(state.Symbol, chartSymbol) && !state.Follow {
+		windowEnd = state.WindowEnd
+	}
+	createASCIIChart(data, windowEnd)
+}
+
+// 连接ClickHouse、校验表结构并查询数据
+func loadData() ([]MarketData, error) {
+	if marketSource != SOURCE_DEMO {
+		if err := testConnection(); err != nil {
+			return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+		}
+		if err := validateSchema(CHART_TABLE); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := queryMarketData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, &emptyResultError{table: CHART_TABLE, symbol: chartSymbol}
+	}
+	return data, nil
+}
+
+// 查询成功但合约没有数据（合约代码不对、还没有成交或 -last 范围内没有数据），显示空状态而不是当作故障
+type emptyResultError struct {
+	table, symbol string
+}
+
+func (e *emptyResultError) Error() string {
+	return fmt.Sprintf("no data found in table %s for symbol %s", e.table, e.symbol)
+}
+
+// 空状态中最多列出的候选合约数
+const EMPTY_STATE_SUGGESTIONS = 8
+
+// 表中可以改选的合约，同品种的合约在前
+func symbolSuggestions(empty *emptyResultError) ([]string, error) {
+	result, err := executeQuery(fmt.Sprintf("SELECT DISTINCT symbol FROM feature.%s ORDER BY symbol FORMAT TabSeparated", empty.table))
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	product := strings.ToLower(strings.TrimRight(empty.symbol, "0123456789"))
+	var same, other []string
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		switch symbol := strings.TrimSpace(line); {
+		case symbol == "" || symbol == empty.symbol:
+		case strings.ToLower(strings.TrimRight(symbol, "0123456789")) == product:
+			same = append(same, symbol)
+		default:
+			other = append(other, symbol)
+		}
+	}
+	suggestions := append(same, other...)
+	if len(suggestions) > EMPTY_STATE_SUGGESTIONS {
+		suggestions = suggestions[:EMPTY_STATE_SUGGESTIONS]
+	}
+	return suggestions, nil
+}
+
+// 打印空状态：可能的原因和带编号的候选合约
+func printEmptyState(empty *emptyResultError, suggestions []string, suggestErr error) {
+	fmt.Println(strings.Repeat("-", CHART_WIDTH))
+	fmt.Printf("表 %s 中没有合约 %s 的数据\n", empty.table, empty.symbol)
+	fmt.Println("可能的原因: 合约代码不正确（例如 jm2509）")
+	if lastRange > 0 {
+		fmt.Printf("            或最近 %s 内没有成交（休市、节假日或夜盘开始前），可以用 -last all 加载全部数据\n", lastRange)
+	} else {
+		fmt.Println("            或该合约还没有写入任何行情")
+	}
+	switch {
+	case suggestErr != nil:
+		fmt.Printf("无法列出表中的合约: %v\n", suggestErr)
+	case len(suggestions) == 0:
+		fmt.Printf("表 %s 中还没有任何合约的数据\n", empty.table)
+	default:
+		fmt.Println("可选的合约:")
+		for i, symbol := range suggestions {
+			fmt.Printf("  %d) %s\n", i+1, symbol)
+		}
+	}
+	fmt.Printf("输入编号或合约代码后回车切换合约，直接回车重试，%s 后自动重试，Ctrl+C 退出\n", RETRY_INTERVAL)
+	fmt.Println(strings.Repeat("-", CHART_WIDTH))
+}
+
+// 反复加载直到成功，每次失败打印错误横幅；等待期间按回车可立即重试。
+// 没有数据时打印空状态，输入候选编号或合约代码可以改选合约
+func loadDataWithRetry() []MarketData {
+	input := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			select {
+			case input <- strings.TrimSpace(scanner.Text()):
+			default:
+			}
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		data, err := loadData()
+		if err == nil {
+			return data
+		}
+
+		var suggestions []string
+		var empty *emptyResultError
+		if errors.As(err, &empty) {
+			var suggestErr error
+			suggestions, suggestErr = symbolSuggestions(empty)
+			printEmptyState(empty, suggestions, suggestErr)
+		} else {
+			fmt.Println(strings.Repeat("!", CHART_WIDTH))
+			fmt.Printf("数据加载失败（第 %d 次）: %v\n", attempt, err)
+			fmt.Printf("%s 后自动重试，按回车立即重试，Ctrl+C 退出\n", RETRY_INTERVAL)
+			fmt.Println(strings.Repeat("!", CHART_WIDTH))
+		}
+
+		select {
+		case <-time.After(RETRY_INTERVAL):
+		case line := <-input:
+			if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(suggestions) {
+				chartSymbol = suggestions[n-1]
+			} else if line != "" && empty != nil {
+				chartSymbol = line
+			}
+		}
+	}
 }
 
 func testConnection() error {
@@ -67,6 +444,34 @@ func testConnection() error {
 	return err
 }
 
+// 所有ClickHouse查询共用的HTTP客户端，代理由 -proxy 参数或 HTTP_PROXY/HTTPS_PROXY 环境变量决定
+var httpClient = http.DefaultClient
+
+// 按 -proxy 参数构建共享的HTTP客户端；参数为空时沿用 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 环境变量
+func setupHTTPClient(proxy string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q (expected e.g. http://proxy.example.com:3128)", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// ClickHouse字符串字面量：转义反斜杠和单引号。只把单引号写成两个单引号不够，以反斜杠结尾的symbol会转义掉闭合的引号
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
 func executeQuery(query string) (string, error) {
 	// 构建请求URL
 	baseURL := "http://xm.local:8123"
@@ -77,7 +482,7 @@ func executeQuery(query string) (string, error) {
 	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
 
 	// 发送HTTP请求
-	resp, err := http.Get(fullURL)
+	resp, err := httpClient.Get(fullURL)
 	if err != nil {
 		return "", fmt.Errorf("HTTP request failed: %w", err)
 	}
@@ -97,7 +502,11 @@ func executeQuery(query string) (string, error) {
 }
 
 func queryMarketData() ([]MarketData, error) {
-	query := `
+	if marketSource == SOURCE_DEMO {
+		return demoMarketData(chartSymbol), nil
+	}
+
+	query := fmt.Sprintf(`
 		SELECT 
 			symbol, 
 			time, 
@@ -111,11 +520,11 @@ func queryMarketData() ([]MarketData, error) {
 			ask_1, 
 			ask_volumn_1, 
 			datetime
-		FROM feature.jm 
-		WHERE symbol = 'jm2509'
+		FROM feature.%s 
+		WHERE symbol = %s%s
 		ORDER BY time ASC 
 		FORMAT TabSeparated
-	`
+	`, preferBarTable(CHART_TABLE, lastRange), quoteString(chartSymbol), timeRangePredicate(CHART_TABLE, chartSymbol, lastRange))
 
 	result, err := executeQuery(query)
 	if err != nil {
@@ -125,6 +534,262 @@ func queryMarketData() ([]MarketData, error) {
 	return parseTabSeparatedData(result)
 }
 
+// 行情数据来源：clickhouse 查询 xm.local 上的ClickHouse，demo 在本地生成模拟行情，新用户和CI环境不需要数据库
+const (
+	SOURCE_CLICKHOUSE = "clickhouse"
+	SOURCE_DEMO       = "demo"
+)
+
+var marketSource = SOURCE_CLICKHOUSE
+
+// 演示行情从启动前两天的零点开始每2秒一笔，一直生成到当前时间
+const (
+	DEMO_TICK_INTERVAL = 2 * time.Second
+	DEMO_HISTORY_DAYS  = 2
+)
+
+var demoStart = func() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -DEMO_HISTORY_DAYS)
+}()
+
+// 生成 [from, to) 内的模拟tick：价格按最小变动价位随机游走，偶尔放量，持仓随成交量增减，盘口为一到两个tick的价差。
+// 随机数种子由合约代码决定，同一合约每次生成相同的序列
+func demoTicks(symbol string, from, to time.Time) []MarketData {
+	h := fnv.New64a()
+	h.Write([]byte(symbol))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	tick := tickSizeFor(symbol)
+	if tick <= 0 {
+		tick = 1 // 模拟行情需要价格网格，最小变动价位未知的品种按1生成
+	}
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	last := int64(2000 + rng.Intn(6000)) // 价格，单位为最小变动价位
+	vol, oi := uint32(0), int64(80000+rng.Intn(120000))
+	var data []MarketData
+	for t := demoStart; t.Before(to); t = t.Add(DEMO_TICK_INTERVAL) {
+		last += int64(math.Round(rng.NormFloat64() * 0.8))
+		diffVol := int32(1 + rng.Intn(12))
+		if rng.Intn(50) == 0 {
+			diffVol *= int32(5 + rng.Intn(10))
+		}
+		diffOI := int32(math.Round(rng.NormFloat64() * float64(diffVol) * 0.4))
+		if oi+int64(diffOI) < 0 {
+			diffOI = int32(-oi)
+		}
+		vol += uint32(diffVol)
+		oi += int64(diffOI)
+
+		spread := int64(1)
+		if rng.Intn(10) == 0 {
+			spread = 2
+		}
+		bid, ask := last, last+spread
+		if rng.Intn(2) == 0 {
+			bid, ask = last-spread, last
+		}
+		bidVolumn, askVolumn := uint32(1+rng.Intn(200)), uint32(1+rng.Intn(200))
+
+		// 随机数在过滤之前取完，保证不同时间范围得到的是同一条序列
+		if t.Before(from) {
+			continue
+		}
+		data = append(data, MarketData{
+			Symbol:       symbol,
+			Time:         t,
+			Price:        float32(ticksToPrice(last, tick)),
+			Vol:          vol,
+			OpenInterest: uint32(oi),
+			DiffVol:      diffVol,
+			DiffOI:       diffOI,
+			Bid1:         float32(ticksToPrice(bid, tick)),
+			BidVolumn1:   bidVolumn,
+			Ask1:         float32(ticksToPrice(ask, tick)),
+			AskVolumn1:   askVolumn,
+			DateTime:     uint64(t.UnixMilli()),
+		})
+	}
+	return data
+}
+
+// 演示模式下按 -last 截取最近一段时间的数据
+func demoMarketData(symbol string) []MarketData {
+	var from time.Time
+	if lastRange > 0 {
+		from = time.Now().Add(-lastRange)
+	}
+	return demoTicks(symbol, from, time.Now())
+}
+
+// 查询所需的列及其兼容的ClickHouse类型族
+var expectedColumns = []struct {
+	name     string
+	families []string
+}{
+	{"symbol", []string{"String", "FixedString"}},
+	{"time", []string{"DateTime"}},
+	{"price", []string{"Float", "Decimal"}},
+	{"vol", []string{"UInt", "Int"}},
+	{"open_interest", []string{"UInt", "Int"}},
+	{"diff_vol", []string{"Int", "UInt"}},
+	{"diff_oi", []string{"Int", "UInt"}},
+	{"bid_1", []string{"Float", "Decimal"}},
+	{"bid_volumn_1", []string{"UInt", "Int"}},
+	{"ask_1", []string{"Float", "Decimal"}},
+	{"ask_volumn_1", []string{"UInt", "Int"}},
+	{"datetime", []string{"UInt", "Int"}},
+}
+
+// 通过 DESCRIBE 检查表结构，缺少列或类型不兼容时返回列出具体列名的错误，
+// 避免解析时静默跳过所有行后只报 "No data found"
+func validateSchema(table string) error {
+	result, err := executeQuery(fmt.Sprintf("DESCRIBE TABLE feature.%s FORMAT TabSeparated", table))
+	if err != nil {
+		return fmt.Errorf("failed to describe table feature.%s: %w", table, err)
+	}
+
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			types[fields[0]] = fields[1]
+		}
+	}
+
+	var missing, mismatched []string
+	for _, col := range expectedColumns {
+		typ, ok := types[col.name]
+		if !ok {
+			missing = append(missing, col.name)
+			continue
+		}
+
+		// 去掉 Nullable(...) / LowCardinality(...) 包装后比较类型族
+		base := typ
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			for strings.HasPrefix(base, wrapper) {
+				base = strings.TrimSuffix(strings.TrimPrefix(base, wrapper), ")")
+			}
+		}
+		compatible := false
+		for _, family := range col.families {
+			if strings.HasPrefix(base, family) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s (expected %s)", col.name, typ, strings.Join(col.families, "/")))
+		}
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		problems = append(problems, "incompatible types: "+strings.Join(mismatched, "; "))
+	}
+	return fmt.Errorf("table feature.%s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+}
+
+// 解析相对时间范围，支持 s/m/h/d/w 单位，如 30m、2h、1d、5d；空字符串或 all 表示全部历史
+func parseRelativeRange(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" || spec == "all" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	unit, ok := units[spec[len(spec)-1]]
+	n, err := strconv.Atoi(spec[:len(spec)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q: expected forms like 30m, 2h, 1d, 5d or all", spec)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// 将相对时间范围转换为ClickHouse时间条件，以该symbol的最新数据时间为基准，
+// 这样对已停止交易的合约也能得到有意义的结果
+func timeRangePredicate(table, symbol string, d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" AND time >= (SELECT max(time) FROM feature.%s WHERE symbol = %s) - INTERVAL %d SECOND",
+		table, quoteString(symbol), int64(d/time.Second))
+}
+
+// 宽时间范围（超过1天或全部历史）优先读取 market_cli.go bars build 生成的分钟线表
+const BAR_TABLE_MIN_RANGE = 24 * time.Hour
+
+// 返回查询应使用的数据源，分钟线表不存在时回退到原始tick表
+func preferBarTable(table string, span time.Duration) string {
+	if span > 0 && span <= BAR_TABLE_MIN_RANGE {
+		return table
+	}
+
+	barTable := table + "_bars_1m"
+	result, err := executeQuery("EXISTS TABLE feature." + barTable)
+	if err != nil || strings.TrimSpace(result) != "1" {
+		return table
+	}
+
+	fmt.Printf("Using minute bar table feature.%s for a wide time range\n", barTable)
+	return barTable + " FINAL"
+}
+
+// 解析时被跳过的行按错误类型分类
+const (
+	PARSE_ERROR_SHORT_ROW     = "short_row"
+	PARSE_ERROR_TIME          = "bad_time"
+	PARSE_ERROR_PRICE         = "bad_price"
+	PARSE_ERROR_VOL           = "bad_vol"
+	PARSE_ERROR_OPEN_INTEREST = "bad_open_interest"
+)
+
+// 启动以来解析时跳过的行数，按错误类型计数，界面上显示汇总
+var parseErrors = make(map[string]int)
+
+// 记录一行被跳过的原因，同时写日志
+func recordParseError(kind string, err error) {
+	log.Printf("Skipping row (%s): %v", kind, err)
+	parseErrors[kind]++
+}
+
+// 跳过的总行数和按次数从多到少排列的明细，例如 "bad_price 2, short_row 1"
+func parseErrorSummary() (int, string) {
+	kinds := make([]string, 0, len(parseErrors))
+	total := 0
+	for kind, count := range parseErrors {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if parseErrors[kinds[i]] != parseErrors[kinds[j]] {
+			return parseErrors[kinds[i]] > parseErrors[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s %d", kind, parseErrors[kind])
+	}
+	return total, strings.Join(parts, ", ")
+}
+
 func parseTabSeparatedData(data string) ([]MarketData, error) {
 	lines := strings.Split(strings.TrimSpace(data), "\n")
 	var marketData []MarketData
@@ -136,6 +801,7 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 
 		fields := strings.Split(line, "\t")
 		if len(fields) < 12 {
+			recordParseError(PARSE_ERROR_SHORT_ROW, fmt.Errorf("expected 12 fields, got %d", len(fields)))
 			continue
 		}
 
@@ -143,28 +809,28 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 		timeStr := fields[1]
 		parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
 		if err != nil {
-			log.Printf("Failed to parse time %s: %v", timeStr, err)
+			recordParseError(PARSE_ERROR_TIME, err)
 			continue
 		}
 
 		// 解析价格
 		price, err := strconv.ParseFloat(fields[2], 32)
 		if err != nil {
-			log.Printf("Failed to parse price %s: %v", fields[2], err)
+			recordParseError(PARSE_ERROR_PRICE, err)
 			continue
 		}
 
 		// 解析成交量
 		vol, err := strconv.ParseUint(fields[3], 10, 32)
 		if err != nil {
-			log.Printf("Failed to parse vol %s: %v", fields[3], err)
+			recordParseError(PARSE_ERROR_VOL, err)
 			continue
 		}
 
 		// 解析持仓量
 		openInterest, err := strconv.ParseUint(fields[4], 10, 32)
 		if err != nil {
-			log.Printf("Failed to parse open_interest %s: %v", fields[4], err)
+			recordParseError(PARSE_ERROR_OPEN_INTEREST, err)
 			continue
 		}
 
@@ -198,9 +864,31 @@ func parseTabSeparatedData(data string) ([]MarketData, error) {
 	return marketData, nil
 }
 
-func createASCIIChart(allData []MarketData) {
+// 滚动显示图表，windowEnd 非空时窗口最右端从该时间开始；按 Ctrl+C 退出时保存界面状态
+func createASCIIChart(allData []MarketData, windowEnd string) {
 	windowStart := 0
 	totalRecords := len(allData)
+	if end, err := time.ParseInLocation("2006-01-02 15:04:05", windowEnd, time.Local); err == nil {
+		windowStart = sort.Search(totalRecords, func(i int) bool { return allData[i].Time.After(end) }) - WINDOW_SIZE
+		if windowStart < 0 {
+			windowStart = 0
+		}
+	}
+
+	saveState := func(currentData []MarketData) {
+		err := saveUIState(statePath, "simple", func(state *uiState) {
+			state.Table, state.Symbol = CHART_TABLE, chartSymbol
+			state.Series = priceSeries
+			state.Follow = false
+			state.WindowEnd = currentData[len(currentData)-1].Time.Format("2006-01-02 15:04:05")
+		})
+		if err != nil {
+			log.Printf("Failed to save UI state: %v", err)
+		}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	lastSaved := time.Now()
 
 	for {
 		// 清屏
@@ -232,7 +920,7 @@ func createASCIIChart(allData []MarketData) {
 		oiData := make([]float64, len(currentData))
 
 		for i, record := range currentData {
-			priceData[i] = float64(record.Price)
+			priceData[i] = seriesValue(record)
 			oiData[i] = float64(record.OpenInterest)
 		}
 
@@ -240,14 +928,34 @@ func createASCIIChart(allData []MarketData) {
 		normalizedPrice := normalizeToRange(priceData, 0, CHART_HEIGHT-1)
 		normalizedOI := normalizeToRange(oiData, 0, CHART_HEIGHT-1)
 
+		// 价位线按与价格相同的比例换算成行号，窗口价格范围之外的不画；价差序列不画
+		levelRows := map[int]float64{}
+		if lo, hi := findMin(priceData), findMax(priceData); priceSeries != "spread" && hi > lo {
+			for _, level := range loadLevels(levelsPath, chartSymbol) {
+				if level >= lo && level <= hi {
+					levelRows[int((level-lo)*float64(CHART_HEIGHT-1)/(hi-lo))] = level
+				}
+			}
+		}
+
 		// 绘制图表
-		drawChart(normalizedPrice, normalizedOI, currentData)
+		drawChart(normalizedPrice, normalizedOI, currentData, levelRows)
 
 		// 显示统计信息
 		showStats(priceData, oiData, currentData, windowStart, windowEnd, totalRecords)
 
+		if time.Since(lastSaved) >= STATE_SAVE_INTERVAL {
+			saveState(currentData)
+			lastSaved = time.Now()
+		}
+
 		// 等待并移动窗口
-		time.Sleep(UPDATE_INTERVAL)
+		select {
+		case <-time.After(UPDATE_INTERVAL):
+		case <-interrupt:
+			saveState(currentData)
+			return
+		}
 		windowStart += 5 // 每次移动5个点
 	}
 }
@@ -279,7 +987,7 @@ func normalizeToRange(data []float64, min, max int) []int {
 	return result
 }
 
-func drawChart(priceData, oiData []int, currentData []MarketData) {
+func drawChart(priceData, oiData []int, currentData []MarketData, levelRows map[int]float64) {
 	// 创建图表网格
 	chart := make([][]rune, CHART_HEIGHT)
 	for i := range chart {
@@ -318,9 +1026,19 @@ func drawChart(priceData, oiData []int, currentData []MarketData) {
 		}
 	}
 
+	// 价位线 (用 - 填充空白处)
+	for row := range levelRows {
+		y := CHART_HEIGHT - 1 - row
+		for x := range chart[y] {
+			if chart[y][x] == ' ' {
+				chart[y][x] = '-'
+			}
+		}
+	}
+
 	// 打印标题
-	fmt.Printf("JM2509 - Price and Open Interest Chart (Window: %d points)\n", len(currentData))
-	fmt.Println("Legend: * = Price, # = Open Interest, @ = Both")
+	fmt.Printf("%s - %s and Open Interest Chart (Window: %d points)\n", strings.ToUpper(chartSymbol), seriesLabel(), len(currentData))
+	fmt.Printf("Legend: * = %s, # = Open Interest, @ = Both, - = Level\n", seriesLabel())
 	fmt.Println(strings.Repeat("=", CHART_WIDTH+10))
 
 	// 打印图表
@@ -329,6 +1047,10 @@ func drawChart(priceData, oiData []int, currentData []MarketData) {
 		for j := 0; j < CHART_WIDTH; j++ {
 			fmt.Printf("%c", chart[i][j])
 		}
+		if level, ok := levelRows[CHART_HEIGHT-i-1]; ok {
+			fmt.Printf("| %g\n", level)
+			continue
+		}
 		fmt.Println("|")
 	}
 
@@ -353,9 +1075,13 @@ func showStats(priceData, oiData []float64, currentData []MarketData, windowStar
 
 	fmt.Println(strings.Repeat("=", CHART_WIDTH+10))
 	fmt.Printf("Statistics - Records %d-%d of %d\n", windowStart+1, windowEnd, totalRecords)
-	fmt.Printf("Avg Price: %.2f | Max Price: %.2f | Min Price: %.2f\n", avgPrice, maxPrice, minPrice)
+	label := seriesLabel()
+	fmt.Printf("Avg %s: %.2f | Max %s: %.2f | Min %s: %.2f\n", label, avgPrice, label, maxPrice, label, minPrice)
 	fmt.Printf("Avg Open Interest: %.0f | Data Points: %d\n", avgOI, len(currentData))
 	fmt.Printf("Window: %d/%d\n", windowStart/WINDOW_SIZE+1, (totalRecords+WINDOW_SIZE-1)/WINDOW_SIZE)
+	if skipped, detail := parseErrorSummary(); skipped > 0 {
+		fmt.Printf("%d rows skipped: %s\n", skipped, detail)
+	}
 	fmt.Println(strings.Repeat("=", CHART_WIDTH+10))
 }
 
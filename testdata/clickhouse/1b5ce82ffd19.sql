@@ -0,0 +1 @@
+SELECT symbol, time, price, vol, open_interest, diff_vol, diff_oi, bid_1, bid_volumn_1, ask_1, ask_volumn_1, datetime FROM feature.tst WHERE symbol = 'tst2509' AND time >= toDateTime('2025-06-30 20:00:00') AND time < toDateTime('2025-07-01 20:00:00') ORDER BY time ASC, datetime ASC FORMAT TabSeparated
@@ -0,0 +1 @@
+SELECT DISTINCT symbol FROM feature.tst ORDER BY symbol
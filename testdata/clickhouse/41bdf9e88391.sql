@@ -0,0 +1 @@
+SELECT toString(toDate(time + INTERVAL 4 HOUR) + multiIf(toDayOfWeek(toDate(time + INTERVAL 4 HOUR)) = 6, 2, toDayOfWeek(toDate(time + INTERVAL 4 HOUR)) = 7, 1, 0)) AS day, toFloat64(argMin(price, (time, datetime))) AS open, toFloat64(max(price)) AS high, toFloat64(min(price)) AS low, toFloat64(argMax(price, (time, datetime))) AS close, toFloat64(if(sum(diff_vol) > 0, sum(price * diff_vol) / sum(diff_vol), argMax(price, (time, datetime)))) AS settle, toInt64(sum(diff_vol)) AS volume, toInt64(sum(diff_oi)) AS oi_change, toInt64(argMax(open_interest, (time, datetime))) AS open_interest, count() AS ticks, toString(min(time)) AS first, toString(max(time)) AS last FROM feature.tst WHERE symbol = 'tst2509' AND time >= toDateTime('2025-06-06 00:00:00') AND time < toDateTime('2025-07-01 09:01:59') GROUP BY day ORDER BY day DESC LIMIT 4 SETTINGS output_format_json_quote_64bit_integers = 0 FORMAT JSONEachRow
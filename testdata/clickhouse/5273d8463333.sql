@@ -0,0 +1 @@
+SHOW TABLES
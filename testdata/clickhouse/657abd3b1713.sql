@@ -0,0 +1 @@
+SELECT 1 FROM feature.tst LIMIT 1
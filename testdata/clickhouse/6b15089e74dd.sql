@@ -0,0 +1 @@
+SELECT symbol, time, price, vol, open_interest, diff_vol, diff_oi, bid_1, bid_volumn_1, ask_1, ask_volumn_1, datetime FROM feature.tst WHERE symbol = 'tst2509' ORDER BY time ASC FORMAT TabSeparated
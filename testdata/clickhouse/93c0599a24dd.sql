@@ -0,0 +1 @@
+SELECT count() FROM feature.tst WHERE symbol = 'tst2509'
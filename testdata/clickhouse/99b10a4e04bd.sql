@@ -0,0 +1 @@
+SELECT toString(time) FROM feature.tst WHERE symbol = 'tst2509' AND time < toDateTime('2025-06-30 20:00:00') ORDER BY time DESC LIMIT 1 FORMAT TabSeparated
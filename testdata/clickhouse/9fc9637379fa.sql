@@ -0,0 +1 @@
+SELECT toString(time) FROM feature.tst WHERE symbol = 'tst2509' ORDER BY time DESC LIMIT 1 FORMAT TabSeparated
@@ -0,0 +1 @@
+EXISTS TABLE feature.tst_bars_1m
@@ -0,0 +1 @@
+SELECT count(), toString(min(`symbol`)), toString(max(`symbol`)), countIf(isNull(`symbol`)), uniq(`symbol`), toString(min(`time`)), toString(max(`time`)), countIf(isNull(`time`)), uniq(`time`), toString(min(`price`)), toString(max(`price`)), countIf(isNull(`price`)), uniq(`price`), toString(min(`vol`)), toString(max(`vol`)), countIf(isNull(`vol`)), uniq(`vol`), toString(min(`open_interest`)), toString(max(`open_interest`)), countIf(isNull(`open_interest`)), uniq(`open_interest`), toString(min(`diff_vol`)), toString(max(`diff_vol`)), countIf(isNull(`diff_vol`)), uniq(`diff_vol`), toString(min(`diff_oi`)), toString(max(`diff_oi`)), countIf(isNull(`diff_oi`)), uniq(`diff_oi`), toString(min(`bid_1`)), toString(max(`bid_1`)), countIf(isNull(`bid_1`)), uniq(`bid_1`), toString(min(`bid_volumn_1`)), toString(max(`bid_volumn_1`)), countIf(isNull(`bid_volumn_1`)), uniq(`bid_volumn_1`), toString(min(`ask_1`)), toString(max(`ask_1`)), countIf(isNull(`ask_1`)), uniq(`ask_1`), toString(min(`ask_volumn_1`)), toString(max(`ask_volumn_1`)), countIf(isNull(`ask_volumn_1`)), uniq(`ask_volumn_1`), toString(min(`datetime`)), toString(max(`datetime`)), countIf(isNull(`datetime`)), uniq(`datetime`) FROM feature.tst WHERE symbol = 'tst2509' FORMAT TabSeparated
@@ -0,0 +1 @@
+SELECT toString(exchange) AS exchange, toString(expire_date) AS expiry, toFloat64(margin_rate) AS margin FROM feature.contracts WHERE symbol = 'tst2509' LIMIT 1 FORMAT JSONEachRow
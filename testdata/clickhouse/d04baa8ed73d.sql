@@ -0,0 +1 @@
+DESCRIBE TABLE feature.tst FORMAT TabSeparated
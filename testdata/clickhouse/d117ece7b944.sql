@@ -0,0 +1 @@
+SELECT toString(toDate(time)) AS day, formatDateTime(toStartOfInterval(time, INTERVAL 3600 SECOND), '%H:%M') AS slot, toFloat64(sum(diff_oi)) AS oi, count() AS ticks FROM feature.tst WHERE symbol = 'tst2509' AND time >= toDateTime('2025-07-01 00:00:00') AND time < toDateTime('2025-07-03 00:00:00') GROUP BY day, slot ORDER BY day ASC, slot ASC SETTINGS output_format_json_quote_64bit_integers = 0 FORMAT JSONEachRow
@@ -1,18 +1,46 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"log"
 	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/golang/freetype/truetype"
 	"github.com/wcharczuk/go-chart/v2"
 	"github.com/wcharczuk/go-chart/v2/drawing"
 )
@@ -36,1511 +64,21136 @@ type WebMarketData struct {
 	DateTime     uint64  `json:"datetime"`
 }
 
-var (
-	webAllData     []WebMarketData
-	webCurrentData []WebMarketData
-	webDataMutex   sync.RWMutex
-)
+// 手写JSON编码：非有限的浮点数（NaN/±Inf）编码为 null，单条坏数据不会导致整个响应编码失败，
+// 浏览器端绘图时 null 显示为断点。其余字段的编码与 encoding/json 的默认结果一致
+func (md WebMarketData) MarshalJSON() ([]byte, error) {
+	return md.appendJSON(make([]byte, 0, 256), webRawPriceFormat), nil
+}
 
-func main() {
-	fmt.Println("Connecting to ClickHouse...")
+// 按价格格式编码一条记录，price/bid_1/ask_1 使用 pf，其余字段与 MarshalJSON 相同
+func (md WebMarketData) appendJSON(b []byte, pf webPriceFormat) []byte {
+	b = append(b, `{"symbol":`...)
+	b = webAppendJSONString(b, md.Symbol)
+	b = append(b, `,"time":`...)
+	b = webAppendJSONString(b, md.Time)
+	b = append(b, `,"price":`...)
+	b = pf.appendPrice(b, md.Price)
+	b = append(b, `,"vol":`...)
+	b = strconv.AppendUint(b, uint64(md.Vol), 10)
+	b = append(b, `,"open_interest":`...)
+	b = strconv.AppendUint(b, uint64(md.OpenInterest), 10)
+	b = append(b, `,"diff_vol":`...)
+	b = strconv.AppendInt(b, int64(md.DiffVol), 10)
+	b = append(b, `,"diff_oi":`...)
+	b = strconv.AppendInt(b, int64(md.DiffOI), 10)
+	b = append(b, `,"bid_1":`...)
+	b = pf.appendPrice(b, md.Bid1)
+	b = append(b, `,"bid_volumn_1":`...)
+	b = strconv.AppendUint(b, uint64(md.BidVolumn1), 10)
+	b = append(b, `,"ask_1":`...)
+	b = pf.appendPrice(b, md.Ask1)
+	b = append(b, `,"ask_volumn_1":`...)
+	b = strconv.AppendUint(b, uint64(md.AskVolumn1), 10)
+	b = append(b, `,"datetime":`...)
+	b = strconv.AppendUint(b, md.DateTime, 10)
+	return append(b, '}')
+}
+
+// JSON响应中价格字段（price、bid_1、ask_1 及价格统计量）的格式：decimals 为保留的小数位数，
+// 负数表示按float32最短表示输出；quoted 时编码为字符串，调用方可以按精确的十进制数解析
+type webPriceFormat struct {
+	decimals int
+	quoted   bool
+}
+
+var webRawPriceFormat = webPriceFormat{decimals: -1}
 
-	// 测试连接
-	if err := webTestConnection(); err != nil {
-		log.Fatal("Failed to connect to ClickHouse:", err)
+// 按请求参数确定价格格式：?price_format=auto（默认，小数位数由品种最小变动价位决定，最小变动价位未知时同 raw）、
+// raw 或 string，?decimals=N 覆盖小数位数
+func webParsePriceFormat(r *http.Request, symbol string) (webPriceFormat, error) {
+	pf := webPriceFormat{decimals: webPriceDecimals(symbol)}
+	switch r.URL.Query().Get("price_format") {
+	case "", "auto":
+	case "raw":
+		pf.decimals = -1
+	case "string":
+		pf.quoted = true
+	default:
+		return pf, fmt.Errorf("unknown price_format %q (auto, raw or string)", r.URL.Query().Get("price_format"))
 	}
+	if spec := r.URL.Query().Get("decimals"); spec != "" {
+		n, err := strconv.Atoi(spec)
+		if err != nil || n < 0 || n > 8 {
+			return pf, fmt.Errorf("invalid decimals %q (0-8)", spec)
+		}
+		pf.decimals = n
+	}
+	if pf.quoted && pf.decimals < 0 {
+		pf.decimals = webPriceDecimals(symbol)
+	}
+	return pf, nil
+}
 
-	fmt.Println("Successfully connected to ClickHouse!")
+// 品种价格的小数位数，与最小变动价位一致；最小变动价位未知时为-1，按float32最短表示输出完整精度
+func webPriceDecimals(symbol string) int {
+	tick := webTickSizeFor(symbol)
+	if tick <= 0 {
+		return -1
+	}
+	return webTickDecimals(tick)
+}
 
-	// 查询数据
-	data, err := webQueryMarketData()
-	if err != nil {
-		log.Fatal("Failed to query data:", err)
+// 最小变动价位的小数位数，例如 0.5 为1位、0.02 为2位、1 为0位
+func webTickDecimals(tick float64) int {
+	text := strconv.FormatFloat(tick, 'f', -1, 64)
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		return len(text) - i - 1
 	}
+	return 0
+}
 
-	if len(data) == 0 {
-		log.Fatal("No data found in the table")
+// 价格在内部按最小变动价位的整数倍（tick数）计算，只在输出时换算回价格，避免float32舍入误差在价差和指标中累积
+func webPriceToTicks(price float32, tick float64) int64 {
+	return int64(math.Round(float64(price) / tick))
+}
+
+// tick数换算回价格，并舍入到最小变动价位的小数位数（例如 0.1 的3倍为 0.3 而不是 0.30000000000000004）
+func webTicksToPrice(ticks int64, tick float64) float64 {
+	scale := math.Pow10(webTickDecimals(tick))
+	return math.Round(float64(ticks)*tick*scale) / scale
+}
+
+// float32价格经tick数换算得到的精确十进制价格，用于统计量和指标计算；最小变动价位未知时不舍入，取原始价格
+func webPriceValue(price float32, symbol string) float64 {
+	if math.IsNaN(float64(price)) || math.IsInf(float64(price), 0) {
+		return float64(price)
 	}
+	tick := webTickSizeFor(symbol)
+	if tick <= 0 {
+		return webRawPrice(price)
+	}
+	return webTicksToPrice(webPriceToTicks(price, tick), tick)
+}
 
-	fmt.Printf("Found %d records\n", len(data))
+// float32价格的最短十进制表示，例如 3801.2 而不是 3801.199951171875
+func webRawPrice(price float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(price), 'g', -1, 32), 64)
+	return v
+}
 
-	// 初始化全局数据
-	webAllData = data
+func (pf webPriceFormat) appendPrice(b []byte, f float32) []byte {
+	if pf.decimals < 0 && !pf.quoted {
+		return webAppendJSONFloat32(b, f)
+	}
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return append(b, "null"...)
+	}
+	if pf.quoted {
+		b = append(b, '"')
+	}
+	b = strconv.AppendFloat(b, float64(f), 'f', pf.decimals, 32)
+	if pf.quoted {
+		b = append(b, '"')
+	}
+	return b
+}
 
-	// 对数据进行采样以便在浏览器中显示
-	sampleSize := 100 // 减少到100条记录确保JSON响应不会太大
-	webDataMutex.Lock()
-	if len(webAllData) > sampleSize {
-		// 均匀采样
-		step := len(webAllData) / sampleSize
-		webCurrentData = make([]WebMarketData, 0, sampleSize)
-		for i := 0; i < len(webAllData); i += step {
-			webCurrentData = append(webCurrentData, webAllData[i])
+// 把由float32价格计算出的统计量舍入到 decimals+extra 位小数，消除 737.4000244140625 这类尾数；
+// 原始格式时只把单个float32价格还原为其最短十进制表示
+func (pf webPriceFormat) round(v float64, extra int) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	if pf.decimals < 0 {
+		if extra > 0 {
+			return v
 		}
-		fmt.Printf("Sampled %d records from %d total records (every %d records) for display\n",
-			len(webCurrentData), len(webAllData), step)
-	} else {
-		webCurrentData = webAllData
-		fmt.Printf("Displaying all %d records in a single view\n", len(webAllData))
+		rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', -1, 32), 64)
+		return rounded
 	}
-	webDataMutex.Unlock()
-
-	// 启动Web服务器
-	webStartWebServer()
+	scale := math.Pow10(pf.decimals + extra)
+	return math.Round(v*scale) / scale
 }
 
-func webTestConnection() error {
-	query := "SELECT 1"
-	_, err := webExecuteQuery(query)
-	return err
+// 按价格格式编码的记录列表
+type webFormattedRecords struct {
+	data   []WebMarketData
+	format webPriceFormat
 }
 
-func webExecuteQuery(query string) (string, error) {
-	// 构建请求URL
-	baseURL := "http://xm.local:8123"
-	params := url.Values{}
-	params.Add("database", "feature")
-	params.Add("query", query)
+func (fr webFormattedRecords) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 192*len(fr.data)+2)
+	b = append(b, '[')
+	for i, md := range fr.data {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = md.appendJSON(b, fr.format)
+	}
+	return append(b, ']'), nil
+}
 
-	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
+func webAppendJSONString(b []byte, s string) []byte {
+	quoted, _ := json.Marshal(s)
+	return append(b, quoted...)
+}
 
-	// 发送HTTP请求
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
+// 与 encoding/json 对 float32 的格式一致，非有限值写为 null
+func webAppendJSONFloat32(b []byte, f float32) []byte {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return append(b, "null"...)
 	}
-	defer resp.Body.Close()
+	format := byte('f')
+	if abs := math.Abs(v); abs != 0 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, v, format, -1, 32)
+	if format == 'e' {
+		// 与 encoding/json 一样把 e-09 写成 e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("ClickHouse error (status %d): %s", resp.StatusCode, string(body))
+var (
+	// 已加载数据集的展示数据，按查询键在所有会话间共享
+	webViews     = make(map[webDatasetKey]*webView)
+	webDataMutex sync.RWMutex
+
+	// 使用 RowBinaryWithNamesAndTypes 代替 TabSeparated 传输和解析查询结果
+	webUseRowBinary bool
+
+	// /data?raw=1 时最多返回的原始数据点数，超过时仍按该点数均匀采样，避免浏览器卡死
+	webMaxRawPoints int
+
+	// POST /refresh 的认证令牌，为空时禁用该接口
+	webRefreshToken string
+	// 后台定时刷新缓存数据集的间隔，0 表示不缓存、每次请求直接查询
+	webRefreshInterval time.Duration
+	// 缓存数据集的有效期，过期后先返回旧数据再在后台重新查询，0 表示不按有效期刷新
+	webCacheTTL time.Duration
+
+	// 通过 -tick-size 指定的最小变动价位，0 表示按品种自动查表
+	webTickSizeOverride float64
+
+	// Web服务监听地址，host:port 或 unix:/path.sock
+	webListenAddr = WEB_PORT
+	// 监听端口被占用时是否改用其他端口，以及启动后是否打开浏览器
+	webPortFallback = true
+	webOpenOnStart  bool
+
+	// 单次ClickHouse查询的超时时间，超时后取消请求，避免慢查询堆积goroutine
+	webQueryTimeout time.Duration
+	// 单次ClickHouse查询的结果行数和字节数上限，0 表示不限制。误选整表一年的数据时直接报错，不把内存撑爆
+	webMaxQueryRows  int64
+	webMaxQueryBytes int64
+	// 普通接口的响应写超时，/export.arrow 和 /ws 见 webHandlerTimeouts
+	webWriteTimeout time.Duration
+	// /export.arrow 预计大小超过 webExportConfirmBytes 时需要确认，超过 webExportMaxBytes 时拒绝，0 表示不检查
+	webExportConfirmBytes int64
+	webExportMaxBytes     int64
+
+	// 事件/新闻标注表 (feature库)，包含 timestamp、title、severity 列，为空时不显示事件标记
+	webEventsTable string
+
+	// 合约日历表 (feature库)，包含 symbol、exchange、expire_date、margin_rate 列，为空时按内置品种表估算
+	webCalendarTable string
+
+	// 通过 -y-range 配置的默认纵轴范围，用于PNG图表和页面初始的纵轴输入框
+	webDefaultYRange = webYRange{math.NaN(), math.NaN()}
+
+	// PNG图表纵轴在数据范围上下各留出的比例，避免曲线贴住绘图区边缘
+	webAxisPadding float64
+)
+
+// 按接口覆盖写超时：导出大量数据需要更长时间，WebSocket 长连接不限制（0）
+var webHandlerTimeouts = map[string]time.Duration{
+	"/export.arrow": 10 * time.Minute,
+	"/api/v1/jobs/": 10 * time.Minute,
+	"/ws":           0,
+	"/updates":      0,
+}
+
+// 常见期货品种的最小变动价位，未列出的品种视为未知（0），价格不按tick舍入
+var webProductTickSizes = map[string]float64{
+	"a": 1, "ag": 1, "al": 5, "ap": 1, "au": 0.02, "bu": 1, "c": 1, "cf": 5, "cu": 10,
+	"eb": 1, "eg": 1, "fg": 1, "fu": 1, "hc": 1, "i": 0.5, "j": 0.5, "jm": 0.5, "l": 1,
+	"lc": 50, "lh": 5, "m": 1, "ma": 1, "ni": 10, "oi": 1, "p": 2, "pg": 1, "pp": 1,
+	"rb": 1, "rm": 1, "ru": 5, "sa": 1, "sc": 0.1, "sf": 2, "si": 5, "sm": 2, "sp": 2,
+	"sr": 1, "ss": 5, "ta": 2, "ur": 1, "v": 1, "y": 2, "zn": 5,
+}
+
+func webTickSizeFor(symbol string) float64 {
+	if webTickSizeOverride > 0 {
+		return webTickSizeOverride
 	}
+	if size, ok := webProductTickSizes[strings.ToLower(strings.TrimRight(symbol, "0123456789"))]; ok {
+		return size
+	}
+	return 0
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+// 估计最小变动价位未知的品种的tick：取数据中相邻不同价格的最小差值，不足两个不同价格时返回0。
+// 只用于按跳计数的统计（价差、转折点、盘口阶梯），价格本身不按它舍入
+func webEstimateTickSize(prices []float64) float64 {
+	var sorted []float64
+	for _, p := range prices {
+		if p > 0 && !math.IsInf(p, 0) {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.Float64s(sorted)
+	step := 0.0
+	for i := 1; i < len(sorted); i++ {
+		if d := webRawPrice(float32(sorted[i] - sorted[i-1])); d > 0 && (step == 0 || d < step) {
+			step = d
+		}
 	}
+	return step
+}
 
-	return string(body), nil
+// 数字格式：统计面板、PNG标题等处显示的数字按 -number-locale 分组，按字段 (price/volume/oi/count) 取小数位，
+// 成交量和持仓量按 -number-units 换算成 万/亿 或 k/M/B。页面通过 {{NUMBER_FORMAT}} 拿到同一份设置
+type webNumberFormat struct {
+	Locale   string          `json:"locale"`
+	Group    string          `json:"group"`   // 千位分隔符，plain 为空
+	Decimal  string          `json:"decimal"` // 小数点
+	Decimals map[string]int  `json:"decimals"`
+	Units    []webNumberUnit `json:"units"` // 从大到小，绝对值达到 Scale 时换算
 }
 
-func webQueryMarketData() ([]WebMarketData, error) {
-	query := `
-		SELECT 
-			symbol, 
-			time, 
-			price, 
-			vol, 
-			open_interest, 
-			diff_vol, 
-			diff_oi, 
-			bid_1, 
-			bid_volumn_1, 
-			ask_1, 
-			ask_volumn_1, 
-			datetime
-		FROM feature.jm 
-		WHERE symbol = 'jm2509'
-		ORDER BY time ASC 
-		FORMAT TabSeparated
-	`
-
-	result, err := webExecuteQuery(query)
-	if err != nil {
-		return nil, fmt.Errorf("query failed: %w", err)
-	}
+type webNumberUnit struct {
+	Scale  float64 `json:"scale"`
+	Suffix string  `json:"suffix"`
+}
 
-	return webParseTabSeparatedData(result)
+var webNumberLocales = map[string][2]string{
+	"zh-CN": {",", "."},
+	"en-US": {",", "."},
+	"de-DE": {".", ","},
+	"plain": {"", "."},
 }
 
-func webParseTabSeparatedData(data string) ([]WebMarketData, error) {
-	lines := strings.Split(strings.TrimSpace(data), "\n")
-	var marketData []WebMarketData
+var webNumberUnitSets = map[string][]webNumberUnit{
+	"none":   nil,
+	"cn":     {{1e8, "亿"}, {1e4, "万"}},
+	"metric": {{1e9, "B"}, {1e6, "M"}, {1e3, "k"}},
+}
 
-	for _, line := range lines {
-		if line == "" {
+// 换算单位后保留的小数位数
+const NUMBER_UNIT_DECIMALS = 2
+
+var webNumbers = webDefaultNumberFormat()
+
+func webDefaultNumberFormat() webNumberFormat {
+	f, _ := webParseNumberFormat("zh-CN", "", "none")
+	return f
+}
+
+// 解析 -number-locale、-number-decimals (price=2,volume=0) 和 -number-units
+func webParseNumberFormat(locale, decimals, units string) (webNumberFormat, error) {
+	seps, ok := webNumberLocales[locale]
+	if !ok {
+		return webNumberFormat{}, fmt.Errorf("invalid -number-locale %q: expected zh-CN, en-US, de-DE or plain", locale)
+	}
+	unitSet, ok := webNumberUnitSets[units]
+	if !ok {
+		return webNumberFormat{}, fmt.Errorf("invalid -number-units %q: expected none, cn or metric", units)
+	}
+	f := webNumberFormat{
+		Locale:   locale,
+		Group:    seps[0],
+		Decimal:  seps[1],
+		Decimals: map[string]int{"price": 2, "volume": 0, "oi": 0, "count": 0},
+		Units:    unitSet,
+	}
+	for _, item := range strings.Split(decimals, ",") {
+		if strings.TrimSpace(item) == "" {
 			continue
 		}
+		field, value, _ := strings.Cut(item, "=")
+		field = strings.TrimSpace(field)
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if _, known := f.Decimals[field]; !known || field == "count" || err != nil || n < 0 || n > 8 {
+			return webNumberFormat{}, fmt.Errorf("invalid -number-decimals item %q: expected price/volume/oi=0..8", item)
+		}
+		f.Decimals[field] = n
+	}
+	return f, nil
+}
 
-		fields := strings.Split(line, "\t")
-		if len(fields) < 12 {
-			continue
+// 按字段格式化数字：price 不换算单位，count 为条数（不换算、无小数）
+func (f webNumberFormat) Format(v float64, field string) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "-"
+	}
+	decimals, suffix := f.Decimals[field], ""
+	if field == "volume" || field == "oi" {
+		for _, unit := range f.Units {
+			if math.Abs(v) >= unit.Scale {
+				v, suffix, decimals = v/unit.Scale, unit.Suffix, NUMBER_UNIT_DECIMALS
+				break
+			}
+		}
+	}
+	digits := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, frac, _ := strings.Cut(digits, ".")
+	var b strings.Builder
+	if v < 0 {
+		b.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(f.Group)
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(f.Decimal + frac)
+	}
+	return b.String() + suffix
+}
+
+// 图表默认显示的采样点数
+const WEB_SAMPLE_SIZE = 100
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "assets" {
+		if err := webAssetsCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
+		return
+	}
 
-		// 解析时间
-		timeStr := fields[1]
-		parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
-		if err != nil {
-			log.Printf("Failed to parse time %s: %v", timeStr, err)
-			continue
+	flag.BoolVar(&webUseRowBinary, "rowbinary", false, "使用RowBinary二进制格式查询数据，大数据量时解析更快")
+	parseBench := flag.Bool("parse-bench", false, "分别用TabSeparated和RowBinary查询默认数据集，比较解析耗时后退出")
+	flag.IntVar(&webMaxRawPoints, "max-raw-points", 20000, "原始数据模式下单次返回的最大数据点数")
+	flag.StringVar(&webRefreshToken, "refresh-token", os.Getenv("WEB_REFRESH_TOKEN"), "POST /refresh 接口的Bearer令牌，默认读取环境变量 WEB_REFRESH_TOKEN，为空时禁用")
+	flag.DurationVar(&webRefreshInterval, "refresh-interval", 0, "后台定时刷新缓存数据集的间隔，如 30s、5m，0 表示不缓存")
+	flag.Float64Var(&webTickSizeOverride, "tick-size", 0, "计算价差使用的最小变动价位，0 表示按品种自动识别")
+	flag.DurationVar(&webCacheTTL, "cache-ttl", 0, "缓存数据集的有效期，如 1m；过期后立即返回旧数据并在后台刷新，完成后推送给页面，0 表示不启用")
+	refreshSymbols := flag.String("refresh-symbols", "", "定时刷新时预加载并常驻缓存的数据集，格式 table/symbol[@range]，逗号分隔")
+	flag.IntVar(&webFetchConcurrency, "fetch-concurrency", webFetchConcurrency, "同时查询多个合约时（watchlist 预加载、定时刷新、联动仪表盘）最多并发的查询数")
+	proxy := flag.String("proxy", "", "ClickHouse HTTP代理地址，例如 http://proxy.example.com:3128，为空时读取 HTTP_PROXY/HTTPS_PROXY 环境变量")
+	flag.StringVar(&webListenAddr, "listen", WEB_PORT, "Web服务监听地址: host:port（如 127.0.0.1:8082 只允许本机访问）或 unix:/path/to.sock")
+	flag.BoolVar(&webPortFallback, "port-fallback", true, "端口被占用时依次尝试后面的端口，都被占用时使用系统分配的空闲端口；false 时直接退出")
+	flag.BoolVar(&webOpenOnStart, "open", false, "启动后用默认浏览器打开页面")
+	flag.DurationVar(&webQueryTimeout, "query-timeout", 60*time.Second, "单次ClickHouse查询的超时时间，0 表示不限制")
+	flag.Int64Var(&webMaxQueryRows, "max-query-rows", 5000000, "单次ClickHouse查询最多返回的行数，超出时报错并提示缩小时间范围，0 表示不限制")
+	flag.Int64Var(&webMaxQueryBytes, "max-query-bytes", 1<<30, "单次ClickHouse查询最多返回的字节数，超出时报错并提示缩小时间范围，0 表示不限制")
+	flag.DurationVar(&webWriteTimeout, "write-timeout", 2*time.Minute, "普通HTTP接口的响应写超时，0 表示不限制")
+	flag.Int64Var(&webExportConfirmBytes, "export-confirm-bytes", 100<<20, "导出Arrow前先用 count() 预估大小，超过该字节数时页面要求确认，0 表示不需要确认")
+	flag.Int64Var(&webExportMaxBytes, "export-max-bytes", 2<<30, "导出Arrow的预估大小超过该字节数时拒绝导出，0 表示不限制")
+	flag.Float64Var(&webAxisPadding, "axis-padding", 0.05, "PNG图表纵轴在数据范围上下各留出的比例，0 表示不留白")
+	yRange := flag.String("y-range", "", "固定价格纵轴范围，格式 min,max，任一端留空表示按数据自动，如 700,760 或 700,")
+	flag.StringVar(&webCalendarTable, "calendar-table", "", "合约日历表名 (feature库，列 symbol/exchange/expire_date/margin_rate)，提供最后交易日和保证金率")
+	flag.StringVar(&webEventsTable, "events-table", "", "事件标注表名 (feature库，列 timestamp/title/severity)，在图表上绘制交割、库存报告、交易所公告等事件标记")
+	imbalanceWatch := flag.String("imbalance-watch", "", "监控盘口失衡的合约，格式 table/symbol，逗号分隔；买一/卖一挂单量失衡连续超过阈值时告警并保存快照")
+	flag.Float64Var(&webImbalanceThreshold, "imbalance-threshold", IMBALANCE_DEFAULT_THRESHOLD, "盘口失衡告警阈值 |买一量-卖一量|/(买一量+卖一量)，取值 (0, 1]")
+	flag.IntVar(&webImbalanceTicks, "imbalance-ticks", IMBALANCE_DEFAULT_TICKS, "失衡需要连续超过阈值的tick数")
+	flag.StringVar(&webIncidentsDir, "incidents-dir", "incidents", "失衡告警快照（数据CSV和PNG图表）的保存目录")
+	flag.StringVar(&webLevelsPath, "levels-file", webLevelsPath, "页面上添加的价位线按合约保存到该JSON文件，终端查看器、simple_chart 和 chart_viewer 读取同一个文件")
+	incidentRetention := flag.String("incident-retention", "", "告警快照按合约的保留策略，格式 symbol=天数d/容量，逗号分隔，* 表示其他合约，如 *=30d,jm2509=7d/500MB；为空时不清理")
+	flag.DurationVar(&webIncidentPruneInterval, "incident-prune-interval", INCIDENT_DEFAULT_PRUNE_INTERVAL, "按 -incident-retention 清理告警快照的间隔")
+	flag.DurationVar(&webIncidentWindow, "incident-window", INCIDENT_DEFAULT_WINDOW, "告警快照截取触发点前后的时间窗口，触发后等待该时长再保存")
+	flag.IntVar(&webVolRegimeDefaults.window, "vol-window", VOL_DEFAULT_WINDOW, "波动率状态着色的滚动窗口点数")
+	flag.Float64Var(&webVolRegimeDefaults.low, "vol-low", VOL_DEFAULT_LOW, "滚动波动率低于中位数的该倍数时视为低波动")
+	flag.Float64Var(&webVolRegimeDefaults.high, "vol-high", VOL_DEFAULT_HIGH, "滚动波动率高于中位数的该倍数时视为高波动")
+	basisSpot := flag.String("basis-spot", "", "基差图各品种默认的现货/指数序列，格式 品种表名=table/symbol，逗号分隔，如 jm=spot/jm_tangshan")
+	sharedCache := flag.String("shared-cache", "", "多个实例共用的Redis缓存，格式 redis://[:password@]host[:port][/db]，缓存完整历史查询和表/合约列表")
+	flag.DurationVar(&webSharedCacheTTL, "shared-cache-ttl", time.Minute, "共享缓存中查询结果的有效期，应短于 -refresh-interval")
+	flag.DurationVar(&webCatalogTTL, "catalog-ttl", webCatalogTTL, "表和合约目录的缓存有效期，过期后先使用旧目录并在后台刷新")
+	flag.BoolVar(&webQueryEnabled, "enable-query", false, "启用 /query 自定义查询页面，允许页面对ClickHouse执行任意只读 SELECT 并画成时间序列")
+	auditLog := flag.String("audit-log", "", "查询审计日志文件 (JSON Lines)，记录每次ClickHouse查询的用户、来源、耗时和行数，为空时只在内存中保留最近的记录")
+	flag.Int64Var(&webAuditMaxSize, "audit-max-size", 100<<20, "审计日志文件超过该字节数时轮转")
+	flag.IntVar(&webAuditBackups, "audit-backups", 5, "审计日志轮转后保留的旧文件个数")
+	configPath := flag.String("config", "", "运行时配置的JSON文件（watchlist、alerts、refresh_interval、cache_ttl、catalog_ttl、theme、shortcuts、profiles、downsampling、levels），修改后自动生效无需重启，省略的字段使用命令行参数的值")
+	profile := flag.String("profile", WEB_DEFAULT_PROFILE, "启动时使用的ClickHouse连接配置，在 -config 文件的 profiles 中定义；default 为 xm.local 上的 feature 库")
+	flag.StringVar(&webAssetsDir, "assets-dir", "", "自定义资源目录（templates/、js/、fonts/），其中的文件优先于内置资源，可以先用 assets export 子命令导出")
+	flag.StringVar(&webTheme, "theme", "light", "主页配色: light 或 dark")
+	flag.StringVar(&webStatePath, "state-file", webStatePath, "界面状态文件，与终端查看器和 simple_chart 的 -state-file 相同，保存最近使用的表、symbol、时间范围、价格序列、配色和开启的指标，重启后新会话从这里开始；为空时不保存")
+	numberLocale := flag.String("number-locale", "zh-CN", "统计数字的千位分隔符和小数点: zh-CN、en-US (1,234.5)、de-DE (1.234,5) 或 plain (不分组)")
+	numberDecimals := flag.String("number-decimals", "", "各类数字的小数位数，如 price=1,volume=0,oi=0，省略的字段使用默认值 (价格2位，成交量和持仓量0位)")
+	numberUnits := flag.String("number-units", "none", "成交量和持仓量的单位后缀: none、cn (万/亿) 或 metric (k/M/B)，换算后保留2位小数")
+	aclPath := flag.String("acl", "", "访问控制配置的JSON文件，按令牌限制各用户可以访问的表和symbol，为空时不启用")
+	fieldMap := flag.String("field-map", "", "按表配置列名映射的JSON文件，如 {\"SA\": {\"bid_volumn_1\": \"bid_volume_1\"}}，键为标准列名，值为该表中的列名或表达式")
+	queryPresets := flag.String("query-presets", "", "自定义查询页面的预设查询文件 (JSON 数组，元素为 {\"name\", \"sql\"})，为空时使用内置示例")
+	flag.StringVar(&webMarketSource, "source", SOURCE_CLICKHOUSE, "行情数据来源: clickhouse 或 demo（本地生成的模拟行情，不需要ClickHouse）")
+	logFile := flag.String("log-file", "", "日志文件，指定后日志和控制台输出都写入该文件并按大小轮转，为空时输出到终端")
+	flag.Int64Var(&webLogMaxSize, "log-max-size", 50<<20, "日志文件超过该字节数时轮转")
+	flag.IntVar(&webLogBackups, "log-backups", 5, "日志轮转后保留的旧文件个数")
+	daemon := flag.Bool("daemon", false, "在后台运行：以相同参数启动子进程后立即返回，需同时指定 -log-file")
+	flag.Parse()
+
+	if *daemon {
+		if *logFile == "" {
+			log.Fatal("-daemon requires -log-file")
+		}
+		// 先在前台确认日志文件可写，子进程启动后就看不到错误了
+		if l, err := newWebRotatingLog(*logFile, webLogMaxSize, webLogBackups); err != nil {
+			log.Fatal(err)
+		} else {
+			l.file.Close()
+		}
+		if err := webDaemonize(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if os.Getenv(DAEMON_CHILD_ENV) != "" {
+		signal.Ignore(syscall.SIGHUP)
+	}
+	if *logFile != "" {
+		if err := webSetupLogFile(*logFile); err != nil {
+			log.Fatal(err)
 		}
+	}
+
+	if webMarketSource != SOURCE_CLICKHOUSE && webMarketSource != SOURCE_DEMO {
+		log.Fatalf("invalid -source %q: expected clickhouse or demo", webMarketSource)
+	}
+	if webDemoMode() && (*parseBench || webEventsTable != "" || webCalendarTable != "" || *profile != WEB_DEFAULT_PROFILE) {
+		log.Fatal("-parse-bench, -events-table, -calendar-table and -profile require -source clickhouse")
+	}
 
-		// 解析价格
-		price, err := strconv.ParseFloat(fields[2], 32)
+	if err := webSetupHTTPClient(*proxy); err != nil {
+		log.Fatal(err)
+	}
+
+	if *sharedCache != "" {
+		client, err := webParseRedisURL(*sharedCache)
 		if err != nil {
-			log.Printf("Failed to parse price %s: %v", fields[2], err)
-			continue
+			log.Fatal(err)
+		}
+		webSharedCache = client
+		if webSharedCacheTTL <= 0 {
+			log.Fatalf("invalid -shared-cache-ttl %v: must be positive", webSharedCacheTTL)
+		}
+		if _, err := webSharedCache.do("PING"); err != nil {
+			log.Printf("Shared cache %s is not reachable yet, querying ClickHouse directly until it is: %v", webSharedCache.addr, err)
+		}
+	}
+
+	if webEventsTable != "" && !webIsIdentifier(webEventsTable) {
+		log.Fatalf("invalid events table name %q", webEventsTable)
+	}
+	if webCalendarTable != "" && !webIsIdentifier(webCalendarTable) {
+		log.Fatalf("invalid calendar table name %q", webCalendarTable)
+	}
+
+	pinned, err := webParseDatasetKeys(*refreshSymbols)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	watched, err := webParseDatasetKeys(*imbalanceWatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if webImbalanceThreshold <= 0 || webImbalanceThreshold > 1 {
+		log.Fatalf("invalid -imbalance-threshold %v: must be in (0, 1]", webImbalanceThreshold)
+	}
+	if webImbalanceTicks < 1 {
+		log.Fatalf("invalid -imbalance-ticks %d: must be at least 1", webImbalanceTicks)
+	}
+	if webIncidentWindow <= 0 {
+		log.Fatalf("invalid -incident-window %v: must be positive", webIncidentWindow)
+	}
+	if webIncidentRetention, err = webParseRetention(*incidentRetention); err != nil {
+		log.Fatal(err)
+	}
+	if webIncidentPruneInterval <= 0 {
+		log.Fatalf("invalid -incident-prune-interval %v: must be positive", webIncidentPruneInterval)
+	}
+	if webExportConfirmBytes < 0 || webExportMaxBytes < 0 {
+		log.Fatalf("invalid -export-confirm-bytes %d / -export-max-bytes %d: must not be negative", webExportConfirmBytes, webExportMaxBytes)
+	}
+
+	if webNumbers, err = webParseNumberFormat(*numberLocale, *numberDecimals, *numberUnits); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := webVolRegimeDefaults.validate(); err != nil {
+		log.Fatalf("invalid -vol-window/-vol-low/-vol-high: %v", err)
+	}
+
+	if webBasisSpot, err = webParseBasisSpot(*basisSpot); err != nil {
+		log.Fatal(err)
+	}
+
+	if *queryPresets != "" {
+		if webQueryPresets, err = webLoadQueryPresets(*queryPresets); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *fieldMap != "" {
+		if webFieldMaps, err = webLoadFieldMap(*fieldMap); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *aclPath != "" {
+		if webACL, err = webLoadACL(*aclPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *auditLog != "" {
+		if err := webOpenAuditLog(*auditLog); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// 解析成交量
-		vol, err := strconv.ParseUint(fields[3], 10, 32)
+	if webDefaultYRange, err = webParseYRange(*yRange); err != nil {
+		log.Fatal(err)
+	}
+	if webMaxRawPoints < 1 {
+		log.Fatalf("invalid -max-raw-points %d: must be at least 1", webMaxRawPoints)
+	}
+	if webFetchConcurrency < 1 {
+		log.Fatalf("invalid -fetch-concurrency %d: must be at least 1", webFetchConcurrency)
+	}
+	if webCatalogTTL <= 0 {
+		log.Fatalf("invalid -catalog-ttl %v: must be positive", webCatalogTTL)
+	}
+	if webAxisPadding < 0 || webAxisPadding >= 1 {
+		log.Fatalf("invalid -axis-padding %v: must be in [0, 1)", webAxisPadding)
+	}
+	if webTheme != "light" && webTheme != "dark" {
+		log.Fatalf("invalid -theme %q: expected light or dark", webTheme)
+	}
+	if webStatePath != "" {
+		state, err := webLoadUIState(webStatePath)
 		if err != nil {
-			log.Printf("Failed to parse vol %s: %v", fields[3], err)
-			continue
+			log.Printf("Ignoring UI state: %v", err)
 		}
+		webRestoreUIState(state)
+		// 命令行上明确指定的 -theme 优先，配置文件中的 theme 仍然覆盖两者
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "theme" })
+		if !explicit && (state.Theme == "light" || state.Theme == "dark") {
+			webTheme = state.Theme
+		}
+	}
 
-		// 解析持仓量
-		openInterest, err := strconv.ParseUint(fields[4], 10, 32)
+	// 命令行参数作为运行时配置的基础值，-config 文件中给出的字段覆盖它们
+	webConfigBase = webSettings{
+		Watchlist:       pinned,
+		AlertSymbols:    watched,
+		AlertThreshold:  webImbalanceThreshold,
+		AlertTicks:      webImbalanceTicks,
+		RefreshInterval: webRefreshInterval,
+		CacheTTL:        webCacheTTL,
+		CatalogTTL:      webCatalogTTL,
+		Theme:           webTheme,
+		Shortcuts:       webDefaultShortcuts(),
+		Profiles: map[string]webClickHouseProfile{
+			WEB_DEFAULT_PROFILE: {URL: webClickHouseURL, Database: WEB_DEFAULT_DATABASE},
+		},
+		Downsampling: webDefaultDownsampling(),
+	}
+	webConfigCurrent = webConfigBase
+	if *configPath != "" {
+		settings, err := webLoadSettings(*configPath, webConfigBase)
 		if err != nil {
-			log.Printf("Failed to parse open_interest %s: %v", fields[4], err)
-			continue
+			log.Fatal(err)
+		}
+		// 此时还没有后台任务和数据源，只需替换设置，下面按最终的设置预加载和启动监控
+		webUseSettings(settings)
+		webConfigCurrent = settings
+		webConfigPath = *configPath
+		webConfigLoadedAt = time.Now()
+	}
+	if levels, err := webLoadLevels(webLevelsPath); err != nil {
+		log.Fatal(err)
+	} else {
+		webLevels = levels
+	}
+	if p, ok := webConfigCurrent.Profiles[*profile]; !ok {
+		log.Fatalf("unknown -profile %q: define it under \"profiles\" in the -config file", *profile)
+	} else {
+		// 此时还没有缓存和页面，只需替换连接配置
+		webUseProfile(*profile, p)
+		fmt.Printf("Using ClickHouse profile %s: %s\n", *profile, p)
+	}
+
+	if *parseBench {
+		if err := webTestConnection(); err != nil {
+			log.Fatal("Failed to connect to ClickHouse:", err)
+		}
+		webRunParseBenchmark()
+		return
+	}
+
+	// ClickHouse不可用或表中没有数据时不退出：服务照常启动，页面显示错误横幅，点击重试时重新查询
+	if err := webLoadDefaultDataset(); err != nil {
+		log.Printf("Failed to load the default dataset, serving the error page until a retry succeeds: %v", err)
+	}
+
+	if webCacheEnabled() {
+		go webPreloadDatasets(webConfigCurrent.Watchlist)
+	}
+	webSupervise("refresh loop", webRefreshLoop)
+	webSupervise("session pruning loop", webSessionPruneLoop)
+	for _, key := range webConfigCurrent.AlertSymbols {
+		webWatchImbalance(key)
+	}
+	if len(webIncidentRetention) > 0 {
+		webSupervise("incident pruning loop", webIncidentPruneLoop)
+	}
+	if webConfigPath != "" {
+		webSupervise("config watcher", func() { webWatchConfig(webConfigPath) })
+	}
+	if webStatePath != "" {
+		webSupervise("UI state saver", webStateSaveLoop)
+		webSaveUIStateOnExit()
+	}
+
+	// 启动Web服务器
+	webStartWebServer()
+}
+
+// 连接ClickHouse并加载默认数据集，对数据进行采样以便在浏览器中显示，减少到100条记录确保JSON响应不会太大
+func webLoadDefaultDataset() error {
+	if webDemoMode() {
+		fmt.Println("Using simulated demo data, ClickHouse is not required")
+	} else {
+		fmt.Println("Connecting to ClickHouse...")
+
+		// 测试连接
+		if err := webTestConnection(); err != nil {
+			return fmt.Errorf("failed to connect to ClickHouse: %w", err)
 		}
 
-		// 解析其他字段
-		diffVol, _ := strconv.ParseInt(fields[5], 10, 32)
-		diffOI, _ := strconv.ParseInt(fields[6], 10, 32)
-		bid1, _ := strconv.ParseFloat(fields[7], 32)
-		bidVolumn1, _ := strconv.ParseUint(fields[8], 10, 32)
-		ask1, _ := strconv.ParseFloat(fields[9], 32)
-		askVolumn1, _ := strconv.ParseUint(fields[10], 10, 32)
-		datetime, _ := strconv.ParseUint(fields[11], 10, 64)
+		fmt.Println("Successfully connected to ClickHouse!")
 
-		md := WebMarketData{
-			Symbol:       fields[0],
-			Time:         parsedTime.Format("2006-01-02 15:04:05"),
-			Price:        float32(price),
-			Vol:          uint32(vol),
-			OpenInterest: uint32(openInterest),
-			DiffVol:      int32(diffVol),
-			DiffOI:       int32(diffOI),
-			Bid1:         float32(bid1),
-			BidVolumn1:   uint32(bidVolumn1),
-			Ask1:         float32(ask1),
-			AskVolumn1:   uint32(askVolumn1),
-			DateTime:     datetime,
+		if err := webValidateSchema(context.Background(), "jm"); err != nil {
+			return err
 		}
+	}
 
-		marketData = append(marketData, md)
+	// 查询数据
+	gen := webProfileGeneration.Load()
+	data, err := webQueryMarketData(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to query data: %w", err)
 	}
 
-	return marketData, nil
+	if len(data) == 0 {
+		return webEmptyDatasetError(webDefaultKey.table, webDefaultKey.symbol)
+	}
+
+	fmt.Printf("Found %d records\n", len(data))
+
+	view := webSetLoadedData(webDefaultKey, data, gen)
+	if len(data) > WEB_SAMPLE_SIZE {
+		fmt.Printf("Sampled %d records from %d total records (every %d records) for display\n",
+			len(view.sampled), len(data), len(data)/WEB_SAMPLE_SIZE)
+	} else {
+		fmt.Printf("Displaying all %d records in a single view\n", len(data))
+	}
+
+	if webCacheEnabled() {
+		webStoreDataset(webDefaultKey, data, false, gen)
+	}
+	return nil
 }
 
-// Web服务器
-func webStartWebServer() {
-	http.HandleFunc("/", webIndexHandler)
-	http.HandleFunc("/chart", webChartHandler)
-	http.HandleFunc("/data", webDataHandler)
-	http.HandleFunc("/tables", webTablesHandler)
-	http.HandleFunc("/symbols", webSymbolsHandler)
+func webTestConnection() error {
+	query := "SELECT 1"
+	_, err := webExecuteQuery(query)
+	return err
+}
 
-	fmt.Printf("\n\nStarting web server at http://localhost%s\n", WEB_PORT)
-	fmt.Println("Open your browser and visit the URL above to view the chart")
-	fmt.Println("Direct chart access: http://localhost" + WEB_PORT + "/chart")
+// 所有ClickHouse查询共用的HTTP客户端，代理由 -proxy 参数或 HTTP_PROXY/HTTPS_PROXY 环境变量决定
+var webHTTPClient = http.DefaultClient
+
+// ClickHouse HTTP接口地址，测试中替换为本地的假服务器
+var webClickHouseURL = "http://xm.local:8123"
 
-	log.Fatal(http.ListenAndServe(WEB_PORT, nil))
+// 一个ClickHouse集群/数据库的连接配置，配置文件的 "profiles" 中按名称定义（如 dev、staging、prod），
+// 启动时用 -profile 选择，运行中可以在页面上切换
+type webClickHouseProfile struct {
+	URL      string `json:"url"`
+	Database string `json:"database,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
-// 主页处理器 - 显示JavaScript图表页面
-func webIndexHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := `
-<!DOCTYPE html>
-<html lang="zh-CN">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>JM2509 Interactive Chart</title>
-    <script src="https://cdn.jsdelivr.net/npm/chart.js@4.4.0/dist/chart.umd.js"></script>
-    <script src="https://cdn.jsdelivr.net/npm/chartjs-plugin-zoom@2.0.1/dist/chartjs-plugin-zoom.min.js"></script>
-    <style>
-        body { 
-            font-family: Arial, sans-serif; 
-            margin: 20px; 
-            background-color: #f5f5f5;
-        }
-        .container { 
-            max-width: 1600px; 
+// 不写配置文件时使用的配置：xm.local 上的 feature 库
+const (
+	WEB_DEFAULT_PROFILE  = "default"
+	WEB_DEFAULT_DATABASE = "feature"
+)
+
+// 当前配置的数据库和账号，与 webClickHouseURL 一起在切换配置时于 webProfileMutex 下修改
+var (
+	webActiveProfile      = WEB_DEFAULT_PROFILE
+	webClickHouseDatabase = WEB_DEFAULT_DATABASE
+	webClickHouseUser     string
+	webClickHousePassword string
+	webProfileMutex       sync.RWMutex
+)
+
+// 当前使用的连接配置快照
+func webClickHouseTarget() webClickHouseProfile {
+	webProfileMutex.RLock()
+	defer webProfileMutex.RUnlock()
+	return webClickHouseProfile{webClickHouseURL, webClickHouseDatabase, webClickHouseUser, webClickHousePassword}
+}
+
+// 当前数据库中的表名，查询中的表一律带库名
+func webQualifiedTable(table string) string {
+	return webClickHouseTarget().Database + "." + table
+}
+
+// 按 -proxy 参数构建共享的HTTP客户端；参数为空时沿用 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 环境变量
+func webSetupHTTPClient(proxy string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q (expected e.g. http://proxy.example.com:3128)", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	webHTTPClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// 查询超过 -max-query-rows、-max-query-bytes 或 -query-timeout 上限时返回的错误
+type webQueryLimitError struct {
+	what  string // 超限的项目：结果行数、结果大小、耗时
+	limit string // 上限的可读形式
+	flag  string // 调整上限的命令行参数
+}
+
+func (e *webQueryLimitError) Error() string {
+	return fmt.Sprintf("查询%s超过上限 %s (%s)，请缩小时间范围（如 range=1d，或用 session:日期 按交易时段查看）后重试",
+		e.what, e.limit, e.flag)
+}
+
+func webQueryRowsLimitError() error {
+	return &webQueryLimitError{"结果行数", fmt.Sprintf("%d 行", webMaxQueryRows), "-max-query-rows"}
+}
+
+func webQueryBytesLimitError() error {
+	return &webQueryLimitError{"结果大小", fmt.Sprintf("%.1f MB", float64(webMaxQueryBytes)/(1<<20)), "-max-query-bytes"}
+}
+
+func webQueryTimeoutError() error {
+	return &webQueryLimitError{"耗时", webQueryTimeout.String(), "-query-timeout"}
+}
+
+// 识别ClickHouse的超限异常：TOO_MANY_ROWS_OR_BYTES (396) 和 TIMEOUT_EXCEEDED (159)。
+// 结果已经开始流式返回后才超限时，状态码仍是200，异常文本追加在响应末尾
+func webClickHouseLimitError(body string) error {
+	if len(body) > 1024 {
+		body = body[len(body)-1024:]
+	}
+	if !strings.Contains(body, "DB::Exception") {
+		return nil
+	}
+	switch {
+	case strings.Contains(body, "Code: 396."):
+		if strings.Contains(body, "max bytes") {
+			return webQueryBytesLimitError()
+		}
+		return webQueryRowsLimitError()
+	case strings.Contains(body, "Code: 159."):
+		return webQueryTimeoutError()
+	}
+	return nil
+}
+
+// ClickHouse查询构造器。所有读取行情表的查询都经过它拼接：表名在 From 中统一校验，
+// 字符串和时间常量统一转义，新增接口时不需要再手写 fmt.Sprintf 拼SQL。
+// 生成单行SQL，子句顺序固定为 SELECT/FROM/WHERE/GROUP BY/ORDER BY/LIMIT/SETTINGS/FORMAT，多个条件用 AND 连接。
+// 访问控制也在这里执行：webSelect 的 ctx 带有请求的用户时，Build 拒绝该用户无权访问的行情表和合约，
+// 限制了合约的用户必须用 Symbol/Symbols 指定合约，不能整表读取
+type webQuery struct {
+	ctx      context.Context // 构造时查询元数据（分钟线表是否存在）使用，随请求取消
+	user     *webACLUser
+	table    string   // From 的行情表，参考表和子查询不记录
+	symbols  []string // Symbol/Symbols 限定的合约
+	filtered bool
+	columns  []string
+	from     string
+	where    []string
+	groupBy  []string
+	orderBy  []string
+	limit    int
+	settings []string
+	format   string
+	err      error
+}
+
+// 行情表的标准列，与 WebMarketData 的字段顺序一致
+var webMarketDataColumns = []string{
+	"symbol", "time", "price", "vol", "open_interest", "diff_vol", "diff_oi",
+	"bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "datetime",
+}
+
+// 按表配置的列名映射（-field-map）：表名 -> 标准列名 -> 该表中的列名或表达式。
+// 各品种的表由不同的采集程序写入，个别列名不一致（如 volume 与 vol），映射后所有查询仍按标准列名书写
+var webFieldMaps map[string]map[string]string
+
+// 读取 -field-map 指定的JSON文件，键必须是标准列名
+func webLoadFieldMap(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read field map: %w", err)
+	}
+	var maps map[string]map[string]string
+	if err := json.Unmarshal(data, &maps); err != nil {
+		return nil, fmt.Errorf("failed to parse field map %s: %w", path, err)
+	}
+	for table, fields := range maps {
+		if !webIsIdentifier(table) {
+			return nil, fmt.Errorf("invalid table name %q in field map %s", table, path)
+		}
+		for column, source := range fields {
+			known := false
+			for _, c := range webMarketDataColumns {
+				if c == column {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("field map %s: %s.%s is not a standard column (%s)", path, table, column, strings.Join(webMarketDataColumns, ", "))
+			}
+			if strings.TrimSpace(source) == "" || strings.Contains(source, ";") {
+				return nil, fmt.Errorf("field map %s: invalid source %q for %s.%s", path, source, table, column)
+			}
+		}
+	}
+	return maps, nil
+}
+
+// ctx 为请求的context时按请求的用户检查权限；后台任务和共享缓存使用 context.Background()，不受限制
+func webSelect(ctx context.Context, columns ...string) *webQuery {
+	return &webQuery{ctx: ctx, user: webContextUser(ctx), columns: columns}
+}
+
+// 从当前配置的库（默认 feature）的表读取。表配置了列名映射时改为从子查询读取，子查询在原有列之外按标准列名补上映射的列，
+// 外层的 SELECT、WHERE、ORDER BY 都可以直接使用标准列名
+func (q *webQuery) From(table string) *webQuery {
+	if !webIsIdentifier(table) {
+		q.err = fmt.Errorf("invalid table name %q", table)
+		return q
+	}
+	q.table = table
+	q.from = webQualifiedTable(table)
+	if fields := webFieldMaps[table]; len(fields) > 0 {
+		columns := make([]string, 0, len(fields))
+		for column := range fields {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		aliases := make([]string, len(columns))
+		for i, column := range columns {
+			aliases[i] = fields[column] + " AS " + column
+		}
+		q.from = "(SELECT *, " + strings.Join(aliases, ", ") + " FROM " + webQualifiedTable(table) + ")"
+	}
+	return q
+}
+
+// 时间跨度较宽时改为读取分钟线表（见 webPreferBarTable）；分钟线表由 market_cli.go 按标准列名生成，不做映射
+func (q *webQuery) FromBars(table string, span time.Duration) *webQuery {
+	if q.From(table).err == nil {
+		if bars := webPreferBarTable(q.ctx, table, span); bars != table {
+			q.from = webQualifiedTable(bars)
+		}
+	}
+	return q
+}
+
+// 从参考表（-events-table 事件表、-calendar-table 合约日历）读取：不是行情表，不做列名映射，也不按表检查访问权限
+func (q *webQuery) FromReference(table string) *webQuery {
+	if !webIsIdentifier(table) {
+		q.err = fmt.Errorf("invalid table name %q", table)
+		return q
+	}
+	q.from = webQualifiedTable(table)
+	return q
+}
+
+// 从 system 库的表读取，如 system.processes
+func (q *webQuery) FromSystem(table string) *webQuery {
+	if !webIsIdentifier(table) {
+		q.err = fmt.Errorf("invalid system table name %q", table)
+		return q
+	}
+	q.from = "system." + table
+	return q
+}
+
+// 从子查询读取，子查询的错误一并返回
+func (q *webQuery) FromSubquery(sub *webQuery) *webQuery {
+	s, err := sub.Build()
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.from = "(" + s + ")"
+	return q
+}
+
+// 从用户提供的查询读取（/query 自定义查询）。只接受单条 SELECT 或 WITH 语句，末尾的分号会被去掉；
+// 查询经HTTP GET发送，ClickHouse按只读执行，写入和DDL会被服务端拒绝。右括号前换行，避免末尾的 -- 注释吞掉括号
+func (q *webQuery) FromUserQuery(sql string) *webQuery {
+	sql = strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n")
+	first := strings.ToUpper(strings.SplitN(strings.Join(strings.Fields(sql), " "), " ", 2)[0])
+	switch {
+	case sql == "":
+		q.err = fmt.Errorf("查询为空")
+	case strings.Contains(sql, ";"):
+		q.err = fmt.Errorf("只能执行一条查询语句")
+	case first != "SELECT" && first != "WITH":
+		q.err = fmt.Errorf("只支持 SELECT 查询")
+	default:
+		q.from = "(" + sql + "\n)"
+	}
+	return q
+}
+
+// 追加一个条件。条件中的常量须经 webQuoteString/webDateTime 转义
+func (q *webQuery) Where(condition string) *webQuery {
+	q.where = append(q.where, condition)
+	return q
+}
+
+func (q *webQuery) Symbol(symbol string) *webQuery {
+	q.symbols, q.filtered = append(q.symbols, symbol), true
+	return q.Where("symbol = " + webQuoteString(symbol))
+}
+
+func (q *webQuery) Symbols(symbols []string) *webQuery {
+	q.symbols, q.filtered = append(q.symbols, symbols...), true
+	quoted := make([]string, len(symbols))
+	for i, symbol := range symbols {
+		quoted[i] = webQuoteString(symbol)
+	}
+	return q.Where("symbol IN (" + strings.Join(quoted, ", ") + ")")
+}
+
+// time 列落在 [from, to) 内
+func (q *webQuery) TimeRange(from, to time.Time) *webQuery {
+	return q.Where("time >= " + webDateTime(from)).Where("time < " + webDateTime(to))
+}
+
+func (q *webQuery) GroupBy(columns ...string) *webQuery {
+	q.groupBy = append(q.groupBy, columns...)
+	return q
+}
+
+func (q *webQuery) OrderBy(columns ...string) *webQuery {
+	q.orderBy = append(q.orderBy, columns...)
+	return q
+}
+
+func (q *webQuery) Limit(n int) *webQuery {
+	q.limit = n
+	return q
+}
+
+func (q *webQuery) Settings(settings ...string) *webQuery {
+	q.settings = append(q.settings, settings...)
+	return q
+}
+
+func (q *webQuery) Format(format string) *webQuery {
+	q.format = format
+	return q
+}
+
+func (q *webQuery) Build() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	if len(q.columns) == 0 || q.from == "" {
+		return "", fmt.Errorf("incomplete query: SELECT and FROM are required")
+	}
+	if err := q.authorize(); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("SELECT " + strings.Join(q.columns, ", ") + " FROM " + q.from)
+	if len(q.where) > 0 {
+		b.WriteString(" WHERE " + strings.Join(q.where, " AND "))
+	}
+	if len(q.groupBy) > 0 {
+		b.WriteString(" GROUP BY " + strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.limit > 0 {
+		fmt.Fprintf(&b, " LIMIT %d", q.limit)
+	}
+	if len(q.settings) > 0 {
+		b.WriteString(" SETTINGS " + strings.Join(q.settings, ", "))
+	}
+	if q.format != "" {
+		b.WriteString(" FORMAT " + q.format)
+	}
+	return b.String(), nil
+}
+
+// 检查 ctx 中的用户能否读取 From 的行情表和 Symbol/Symbols 限定的合约
+func (q *webQuery) authorize() error {
+	if q.user == nil || q.table == "" {
+		return nil
+	}
+	if !q.user.allowsTable(q.table) {
+		return q.user.denied(q.table, "")
+	}
+	if len(q.user.Symbols) > 0 && !q.filtered {
+		return &webACLError{fmt.Sprintf("用户 %s 只能按合约查询表 %s", q.user.Name, q.table)}
+	}
+	for _, symbol := range q.symbols {
+		if !q.user.allows(q.table, symbol) {
+			return q.user.denied(q.table, symbol)
+		}
+	}
+	return nil
+}
+
+// ClickHouse字符串常量：反斜杠和单引号按ClickHouse的规则转义
+func webQuoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func webDateTime(t time.Time) string {
+	return "toDateTime('" + t.Format("2006-01-02 15:04:05") + "')"
+}
+
+// 按 bucket 对 column 分段的起点，bucket 取整到秒
+func webIntervalStart(column string, bucket time.Duration) string {
+	return fmt.Sprintf("toStartOfInterval(%s, INTERVAL %d SECOND)", column, int64(bucket/time.Second))
+}
+
+func webExecuteQuery(query string) (string, error) {
+	return webExecuteQueryContext(context.Background(), query)
+}
+
+// 在 ctx 下执行查询：ctx 取消时中止请求；ctx 属于异步查询任务时同时上报接收进度。每次查询都记入审计日志
+func webExecuteQueryContext(ctx context.Context, query string) (result string, err error) {
+	start := time.Now()
+	var summary string
+	defer func() { webAuditQuery(ctx, query, start, result, summary, err) }()
+
+	// 构建请求URL
+	target := webClickHouseTarget()
+	baseURL := target.URL
+	params := url.Values{}
+	params.Add("database", target.Database)
+	params.Add("query", query)
+	if webMaxQueryRows > 0 || webMaxQueryBytes > 0 {
+		// 由ClickHouse在生成结果时检查上限并中止查询，客户端读取时再按字节数兜底
+		if webMaxQueryRows > 0 {
+			params.Add("max_result_rows", strconv.FormatInt(webMaxQueryRows, 10))
+		}
+		if webMaxQueryBytes > 0 {
+			params.Add("max_result_bytes", strconv.FormatInt(webMaxQueryBytes, 10))
+		}
+		params.Add("result_overflow_mode", "throw")
+	}
+	job := webJobFromContext(ctx)
+	if job != nil {
+		// 按 query_id 在 system.processes 中查询服务端的扫描进度
+		params.Add("query_id", job.nextQueryID())
+	}
+
+	if webQueryTimeout > 0 {
+		// 同时让ClickHouse在服务端按相同时限中止查询，不在客户端断开后继续占用资源
+		params.Add("max_execution_time", strconv.Itoa(int(math.Ceil(webQueryTimeout.Seconds()))))
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, webQueryTimeout)
+		defer cancel()
+	}
+
+	fullURL := fmt.Sprintf("%s/?%s", baseURL, params.Encode())
+
+	// 发送HTTP请求
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build request: %w", err)
+	}
+	if target.User != "" {
+		req.Header.Set("X-ClickHouse-User", target.User)
+		req.Header.Set("X-ClickHouse-Key", target.Password)
+	}
+	resp, err := webHTTPClient.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", webQueryTimeoutError()
+		}
+		return "", fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	summary = resp.Header.Get("X-ClickHouse-Summary")
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if err := webClickHouseLimitError(string(body)); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("ClickHouse error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	reader := io.Reader(resp.Body)
+	if webMaxQueryBytes > 0 {
+		reader = io.LimitReader(resp.Body, webMaxQueryBytes+1)
+	}
+	if job != nil {
+		reader = &webJobReader{reader: reader, job: job}
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", webQueryTimeoutError()
+		}
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if webMaxQueryBytes > 0 && int64(len(body)) > webMaxQueryBytes {
+		return "", webQueryBytesLimitError()
+	}
+	if err := webClickHouseLimitError(string(body)); err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// 查询审计：内存中保留最近的记录供 /admin/queries 查看，-audit-log 指定文件时同时按JSON Lines追加写入，
+// 文件超过 -audit-max-size 后轮转为 .1、.2……，最多保留 -audit-backups 个。查询文本超过上限时截断
+const (
+	AUDIT_RECENT     = 2000
+	AUDIT_MAX_QUERY  = 4096
+	AUDIT_PAGE_LIMIT = 200
+)
+
+type webAuditEntry struct {
+	Time       string  `json:"time"`
+	User       string  `json:"user,omitempty"`
+	Source     string  `json:"source"`
+	Query      string  `json:"query"`
+	DurationMs float64 `json:"duration_ms"`
+	Rows       int64   `json:"rows"`
+	ReadRows   int64   `json:"read_rows,omitempty"`
+	Bytes      int     `json:"bytes"`
+	Error      string  `json:"error,omitempty"`
+}
+
+var (
+	webAuditRecent  []webAuditEntry
+	webAuditMutex   sync.Mutex
+	webAuditPath    string
+	webAuditFile    *os.File
+	webAuditSize    int64
+	webAuditMaxSize int64
+	webAuditBackups int
+)
+
+// 查询的发起方：用户（启用访问控制时）和来源（接口路径），由 webHandle 放入请求的context
+type webAuditCaller struct {
+	User   string
+	Source string
+}
+
+type webAuditContextKey struct{}
+
+func webAuditCallerFrom(ctx context.Context) webAuditCaller {
+	caller, _ := ctx.Value(webAuditContextKey{}).(webAuditCaller)
+	return caller
+}
+
+func webWithAudit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller := webAuditCaller{Source: r.URL.Path}
+		if u := webRequestUser(r); u != nil {
+			caller.User = u.Name
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), webAuditContextKey{}, caller)))
+	}
+}
+
+// 带有请求发起方和用户的context，随请求取消：客户端断开后查询随之中止，不在服务端继续占用资源。
+// 中止的查询不写入共享的数据集缓存，其他请求需要时重新查询；需要比请求活得更久的异步任务用 context.WithoutCancel
+func webAuditContext(r *http.Request) context.Context {
+	ctx := context.WithValue(r.Context(), webAuditContextKey{}, webAuditCallerFrom(r.Context()))
+	return webWithUser(ctx, webRequestUser(r))
+}
+
+// 打开（或创建）审计日志文件，追加写入
+func webOpenAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	webAuditPath, webAuditFile, webAuditSize = path, f, info.Size()
+	return nil
+}
+
+// 当前文件改名为 .1，已有的 .N 依次后移，超出保留个数的删除
+func webRotateAuditLogLocked() error {
+	webAuditFile.Close()
+	os.Remove(fmt.Sprintf("%s.%d", webAuditPath, webAuditBackups))
+	for i := webAuditBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", webAuditPath, i), fmt.Sprintf("%s.%d", webAuditPath, i+1))
+	}
+	if webAuditBackups > 0 {
+		os.Rename(webAuditPath, webAuditPath+".1")
+	} else {
+		os.Remove(webAuditPath)
+	}
+	return webOpenAuditLog(webAuditPath)
+}
+
+func webAuditQuery(ctx context.Context, query string, start time.Time, result, summary string, err error) {
+	caller := webAuditCallerFrom(ctx)
+	if job := webJobFromContext(ctx); job != nil {
+		caller.Source = strings.TrimSpace(caller.Source + " job " + job.ID)
+	} else if caller.Source == "" {
+		caller.Source = webAuditStackSource()
+	}
+	if len(query) > AUDIT_MAX_QUERY {
+		query = query[:AUDIT_MAX_QUERY] + "..."
+	}
+	entry := webAuditEntry{
+		Time:       start.Format("2006-01-02 15:04:05.000"),
+		User:       caller.User,
+		Source:     caller.Source,
+		Query:      query,
+		DurationMs: math.Round(float64(time.Since(start).Microseconds())) / 1000,
+		Bytes:      len(result),
+	}
+	// ClickHouse在响应头中返回扫描行数和结果行数；文本格式的结果行数也可以直接数出来
+	var stats struct {
+		ReadRows   string `json:"read_rows"`
+		ResultRows string `json:"result_rows"`
+	}
+	json.Unmarshal([]byte(summary), &stats)
+	entry.ReadRows, _ = strconv.ParseInt(stats.ReadRows, 10, 64)
+	if err != nil {
+		entry.Error = err.Error()
+	} else if rows, perr := strconv.ParseInt(stats.ResultRows, 10, 64); perr == nil && rows > 0 {
+		entry.Rows = rows
+	} else {
+		entry.Rows = webAuditCountRows(query, result)
+	}
+
+	line, _ := json.Marshal(entry)
+	webAuditMutex.Lock()
+	defer webAuditMutex.Unlock()
+	if len(webAuditRecent) >= AUDIT_RECENT {
+		webAuditRecent = append(webAuditRecent[:0], webAuditRecent[len(webAuditRecent)-AUDIT_RECENT+1:]...)
+	}
+	webAuditRecent = append(webAuditRecent, entry)
+	if webAuditFile == nil {
+		return
+	}
+	if webAuditMaxSize > 0 && webAuditSize > 0 && webAuditSize+int64(len(line))+1 > webAuditMaxSize {
+		if err := webRotateAuditLogLocked(); err != nil {
+			log.Printf("Audit log rotation failed, audit entries are kept in memory only: %v", err)
+			webAuditFile = nil
+			return
+		}
+	}
+	n, _ := webAuditFile.Write(append(line, '\n'))
+	webAuditSize += int64(n)
+}
+
+// 按查询的输出格式数结果行数：TabSeparated 系列每行一条，WithNames 减去表头；二进制等其他格式返回0
+func webAuditCountRows(query, result string) int64 {
+	format := ""
+	if i := strings.LastIndex(query, " FORMAT "); i >= 0 {
+		format = strings.TrimSpace(query[i+len(" FORMAT "):])
+	}
+	header := int64(0)
+	switch format {
+	case "", "TabSeparated", "TSV", "CSV":
+	case "TabSeparatedWithNames", "TSVWithNames", "CSVWithNames":
+		header = 1
+	case "TabSeparatedWithNamesAndTypes", "TSVWithNamesAndTypes":
+		header = 2
+	default:
+		return 0
+	}
+	rows := int64(strings.Count(result, "\n")) - header
+	if rows < 0 {
+		rows = 0
+	}
+	return rows
+}
+
+// 没有请求上下文的查询（后台刷新、目录加载、各接口内部的辅助查询）记录发起查询的函数名
+func webAuditStackSource() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		// 函数全名为 包路径.函数名[.funcN]，闭包归到所在的函数
+		name := frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+		if parts := strings.SplitN(name, ".", 3); len(parts) >= 2 {
+			name = parts[1]
+		}
+		if !strings.HasPrefix(name, "webExecute") && !strings.HasPrefix(name, "webAudit") {
+			return name
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// 多个查看器实例连接同一个ClickHouse时，可以通过 -shared-cache 共用一个Redis缓存：
+// 完整历史等大查询和表/合约列表的结果按查询文本缓存，同一查询同一时刻只有一个实例访问ClickHouse
+// （SET NX 加锁），其他实例等待结果写入后直接读取。Redis不可用时退回直接查询，不影响页面。
+// 锁的值是每次加锁时生成的随机令牌，释放时用脚本比较后再删除：查询超过锁的有效期后锁可能已被其他实例取得，
+// 不能删掉别人的锁
+const webSharedCacheUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+const (
+	SHARED_CACHE_PREFIX       = "chart_for_data:"
+	SHARED_CACHE_POLL         = 200 * time.Millisecond
+	SHARED_CACHE_DIAL_TIMEOUT = 2 * time.Second
+	SHARED_CACHE_IO_TIMEOUT   = 30 * time.Second
+	SHARED_CACHE_LOCK_TTL     = 5 * time.Minute
+)
+
+var (
+	webSharedCache    *webRedisClient
+	webSharedCacheTTL time.Duration
+
+	// Redis出错时最多每分钟记录一次日志，避免每个请求都刷屏
+	webSharedCacheLastLog time.Time
+	webSharedCacheLogMu   sync.Mutex
+)
+
+// 最小化的Redis客户端（RESP2协议），只实现缓存用到的 GET/SET/EVAL，以及连接时的 AUTH/SELECT。
+// 单个连接，命令串行执行；连接出错后关闭，下一条命令重新连接
+type webRedisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Redis返回的错误回复（-ERR ...），连接本身仍然可用
+type webRedisError string
+
+func (e webRedisError) Error() string { return "redis: " + string(e) }
+
+// 解析 redis://[:password@]host[:port][/db]
+func webParseRedisURL(raw string) (*webRedisClient, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid shared cache URL %q (expected redis://[:password@]host[:port][/db])", raw)
+	}
+	client := &webRedisClient{addr: u.Host}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil || client.db < 0 {
+			return nil, fmt.Errorf("invalid redis database %q in %q", db, raw)
+		}
+	}
+	return client, nil
+}
+
+func (c *webRedisClient) connectLocked() error {
+	conn, err := net.DialTimeout("tcp", c.addr, SHARED_CACHE_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTripLocked("AUTH", c.password); err != nil {
+			c.closeLocked()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTripLocked("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.closeLocked()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *webRedisClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn, c.reader = nil, nil
+}
+
+// 执行一条命令。回复类型：简单字符串和批量字符串为 string，空值为 nil，整数为 int64
+func (c *webRedisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTripLocked(args...)
+	if _, ok := err.(webRedisError); err != nil && !ok {
+		c.closeLocked()
+	}
+	return reply, err
+}
+
+func (c *webRedisClient) roundTripLocked(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(SHARED_CACHE_IO_TIMEOUT))
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReplyLocked()
+}
+
+func (c *webRedisClient) readReplyLocked() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, webRedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
+
+func webLogSharedCacheError(err error) {
+	webSharedCacheLogMu.Lock()
+	defer webSharedCacheLogMu.Unlock()
+	if time.Since(webSharedCacheLastLog) >= time.Minute {
+		webSharedCacheLastLog = time.Now()
+		log.Printf("Shared cache unavailable, querying ClickHouse directly: %v", err)
+	}
+}
+
+// 读取缓存的查询结果（gzip压缩存储），未命中或出错时 ok 为 false
+func webSharedCacheGet(key string) (string, bool) {
+	reply, err := webSharedCache.do("GET", key)
+	if err != nil {
+		webLogSharedCacheError(err)
+		return "", false
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false
+	}
+	zr, err := gzip.NewReader(strings.NewReader(value))
+	if err != nil {
+		return "", false
+	}
+	result, err := io.ReadAll(zr)
+	if err != nil {
+		return "", false
+	}
+	return string(result), true
+}
+
+func webSharedCacheSet(key, result string) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(result))
+	zw.Close()
+	ms := strconv.FormatInt(webSharedCacheTTL.Milliseconds(), 10)
+	if _, err := webSharedCache.do("SET", key, buf.String(), "PX", ms); err != nil {
+		webLogSharedCacheError(err)
+	}
+}
+
+// 经过共享缓存执行查询：命中时直接返回；未命中时抢到锁的实例查询ClickHouse并写入缓存，
+// 其他实例轮询等待结果，锁过期（查询实例退出）或等待超时后自己查询
+func webExecuteSharedQuery(ctx context.Context, query string) (string, error) {
+	if webSharedCache == nil {
+		return webExecuteQueryContext(ctx, query)
+	}
+	target := webClickHouseTarget()
+	sum := sha1.Sum([]byte(target.URL + "\n" + target.Database + "\n" + query))
+	key := SHARED_CACHE_PREFIX + hex.EncodeToString(sum[:])
+	lockKey := key + ":lock"
+	lockTTL := SHARED_CACHE_LOCK_TTL
+	if webQueryTimeout > 0 {
+		lockTTL = webQueryTimeout + SHARED_CACHE_POLL
+	}
+
+	deadline := time.Now().Add(lockTTL)
+	for {
+		if result, ok := webSharedCacheGet(key); ok {
+			return result, nil
+		}
+		token := webSharedCacheToken()
+		reply, err := webSharedCache.do("SET", lockKey, token, "NX", "PX", strconv.FormatInt(lockTTL.Milliseconds(), 10))
+		if err != nil {
+			webLogSharedCacheError(err)
+			return webExecuteQueryContext(ctx, query)
+		}
+		if reply != nil {
+			// 抢到锁之前其他实例可能刚写入结果并释放锁
+			result, ok := webSharedCacheGet(key)
+			if !ok {
+				result, err = webExecuteQueryContext(ctx, query)
+				if err == nil {
+					webSharedCacheSet(key, result)
+				}
+			}
+			webReleaseSharedCacheLock(lockKey, token)
+			return result, err
+		}
+		if time.Now().After(deadline) {
+			return webExecuteQueryContext(ctx, query)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(SHARED_CACHE_POLL):
+		}
+	}
+}
+
+// 加锁用的随机令牌，区分同一把锁的不同持有者
+func webSharedCacheToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 只有锁仍是自己持有（值等于 token）时才删除；已过期并被其他实例取得的锁保留，由它自己释放
+func webReleaseSharedCacheLock(lockKey, token string) {
+	if _, err := webSharedCache.do("EVAL", webSharedCacheUnlockScript, "1", lockKey, token); err != nil {
+		webLogSharedCacheError(err)
+	}
+}
+
+func webQueryMarketData(ctx context.Context) ([]WebMarketData, error) {
+	if webDemoMode() {
+		return webDemoTicks("jm2509", time.Time{}, time.Now()), nil
+	}
+
+	query, err := webSelect(ctx, webMarketDataColumns...).
+		FromBars("jm", 0).
+		Symbol("jm2509").
+		OrderBy("time ASC").
+		Format(webResultFormat()).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	return webParseMarketData(result)
+}
+
+func webParseTabSeparatedData(data string) ([]WebMarketData, error) {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	var marketData []WebMarketData
+
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		md, kind, err := webParseTabSeparatedLine(line)
+		if err != nil {
+			webRecordParseError(kind, line, err)
+			continue
+		}
+		marketData = append(marketData, md)
+	}
+
+	return marketData, nil
+}
+
+// 解析一行TabSeparated数据，失败时返回错误类型（PARSE_ERROR_*）和原因
+func webParseTabSeparatedLine(line string) (WebMarketData, string, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 12 {
+		return WebMarketData{}, PARSE_ERROR_SHORT_ROW, fmt.Errorf("expected 12 fields, got %d", len(fields))
+	}
+
+	// 解析时间
+	timeStr := fields[1]
+	parsedTime, err := time.Parse("2006-01-02 15:04:05", timeStr)
+	if err != nil {
+		return WebMarketData{}, PARSE_ERROR_TIME, err
+	}
+
+	// 解析价格
+	price, err := strconv.ParseFloat(fields[2], 32)
+	if err != nil {
+		return WebMarketData{}, PARSE_ERROR_PRICE, err
+	}
+
+	// 解析成交量
+	vol, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return WebMarketData{}, PARSE_ERROR_VOL, err
+	}
+
+	// 解析持仓量
+	openInterest, err := strconv.ParseUint(fields[4], 10, 32)
+	if err != nil {
+		return WebMarketData{}, PARSE_ERROR_OPEN_INTEREST, err
+	}
+
+	// 解析其他字段
+	diffVol, _ := strconv.ParseInt(fields[5], 10, 32)
+	diffOI, _ := strconv.ParseInt(fields[6], 10, 32)
+	bid1, _ := strconv.ParseFloat(fields[7], 32)
+	bidVolumn1, _ := strconv.ParseUint(fields[8], 10, 32)
+	ask1, _ := strconv.ParseFloat(fields[9], 32)
+	askVolumn1, _ := strconv.ParseUint(fields[10], 10, 32)
+	datetime, _ := strconv.ParseUint(fields[11], 10, 64)
+
+	return WebMarketData{
+		Symbol:       fields[0],
+		Time:         parsedTime.Format("2006-01-02 15:04:05"),
+		Price:        float32(price),
+		Vol:          uint32(vol),
+		OpenInterest: uint32(openInterest),
+		DiffVol:      int32(diffVol),
+		DiffOI:       int32(diffOI),
+		Bid1:         float32(bid1),
+		BidVolumn1:   uint32(bidVolumn1),
+		Ask1:         float32(ask1),
+		AskVolumn1:   uint32(askVolumn1),
+		DateTime:     datetime,
+	}, "", nil
+}
+
+// 流式解析：边接收TabSeparated响应边按完整的行解析，查询任务据此在全部数据到达之前提供预览。
+// 无法解析的行直接跳过，由查询完成后的完整解析统一计入解析错误，不会重复计数。
+// 完整结果由查询完成后的解析得到，这里只计数并保留每 stride 行中的一行作为预览的来源：
+// 保留的行超过 STREAM_PREVIEW_ROWS 时隔行丢弃并把 stride 加倍，内存不随结果大小增长
+const STREAM_PREVIEW_ROWS = 2 * JOB_PREVIEW_MAX_POINTS
+
+type webStreamParser struct {
+	mu      sync.Mutex
+	pending []byte // 尚未收到换行符的不完整行
+	rows    []WebMarketData
+	count   int // 已解析的行数
+	stride  int
+}
+
+func (p *webStreamParser) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			break
+		}
+		if line := string(p.pending[:i]); line != "" {
+			if md, _, err := webParseTabSeparatedLine(line); err == nil {
+				p.add(md)
+			}
+		}
+		p.pending = p.pending[i+1:]
+	}
+	// 只保留不完整的行，已解析的部分不再占用内存
+	p.pending = append(p.pending[:0:0], p.pending...)
+	return len(b), nil
+}
+
+// 保留的始终是第 0、stride、2*stride……行，调用方需持有 p.mu
+func (p *webStreamParser) add(md WebMarketData) {
+	if p.stride == 0 {
+		p.stride = 1
+	}
+	if p.count%p.stride == 0 {
+		p.rows = append(p.rows, md)
+	}
+	p.count++
+	if len(p.rows) > STREAM_PREVIEW_ROWS {
+		kept := p.rows[:0]
+		for i := 0; i < len(p.rows); i += 2 {
+			kept = append(kept, p.rows[i])
+		}
+		p.rows = kept
+		p.stride *= 2
+	}
+}
+
+// 已解析的行数，以及均匀采样到不超过 points 个点的副本
+func (p *webStreamParser) snapshot(points int) (int, []WebMarketData) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sampled := webSampleData(p.rows, points)
+	return p.count, append([]WebMarketData(nil), sampled...)
+}
+
+// 解析时被跳过的行按错误类型分类
+const (
+	PARSE_ERROR_SHORT_ROW     = "short_row"
+	PARSE_ERROR_TIME          = "bad_time"
+	PARSE_ERROR_PRICE         = "bad_price"
+	PARSE_ERROR_VOL           = "bad_vol"
+	PARSE_ERROR_OPEN_INTEREST = "bad_open_interest"
+
+	// 每类错误保留的示例行最大长度
+	PARSE_ERROR_SAMPLE_LEN = 200
+)
+
+var webParseErrorDescriptions = map[string]string{
+	PARSE_ERROR_SHORT_ROW:     "字段数不足12列",
+	PARSE_ERROR_TIME:          "time 无法解析",
+	PARSE_ERROR_PRICE:         "price 无法解析",
+	PARSE_ERROR_VOL:           "vol 无法解析",
+	PARSE_ERROR_OPEN_INTEREST: "open_interest 无法解析",
+}
+
+// 某一类解析错误的累计次数，以及最近一次出错的行和错误信息
+type webParseErrorEntry struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Count       int    `json:"count"`
+	Sample      string `json:"sample"`
+	LastError   string `json:"last_error"`
+	FirstSeen   string `json:"first_seen"`
+	LastSeen    string `json:"last_seen"`
+}
+
+// 进程启动以来解析时跳过的行，页面显示总数，/api/v1/parse-errors 返回按类型的明细
+var (
+	webParseErrors      = make(map[string]*webParseErrorEntry)
+	webParseErrorsMutex sync.Mutex
+)
+
+// 记录一行被跳过的原因，同时写日志
+func webRecordParseError(kind, line string, err error) {
+	log.Printf("Skipping row (%s): %v", kind, err)
+
+	if len(line) > PARSE_ERROR_SAMPLE_LEN {
+		line = line[:PARSE_ERROR_SAMPLE_LEN] + "..."
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	webParseErrorsMutex.Lock()
+	defer webParseErrorsMutex.Unlock()
+	entry, ok := webParseErrors[kind]
+	if !ok {
+		entry = &webParseErrorEntry{Type: kind, Description: webParseErrorDescriptions[kind], FirstSeen: now}
+		webParseErrors[kind] = entry
+	}
+	entry.Count++
+	entry.Sample = line
+	entry.LastError = err.Error()
+	entry.LastSeen = now
+}
+
+// 按次数从多到少返回各类解析错误及跳过的总行数
+func webParseErrorSummary() ([]webParseErrorEntry, int) {
+	webParseErrorsMutex.Lock()
+	defer webParseErrorsMutex.Unlock()
+	entries := make([]webParseErrorEntry, 0, len(webParseErrors))
+	total := 0
+	for _, entry := range webParseErrors {
+		entries = append(entries, *entry)
+		total += entry.Count
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries, total
+}
+
+func webResetParseErrors() {
+	webParseErrorsMutex.Lock()
+	webParseErrors = make(map[string]*webParseErrorEntry)
+	webParseErrorsMutex.Unlock()
+}
+
+// 解析错误明细接口：GET 返回按类型汇总的跳过行数和示例行，DELETE 清空计数
+func webParseErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		webResetParseErrors()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, total := webParseErrorSummary()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"skipped_rows": total,
+		"by_type":      entries,
+	})
+}
+
+func webResultFormat() string {
+	if webUseRowBinary {
+		return "RowBinaryWithNamesAndTypes"
+	}
+	return "TabSeparated"
+}
+
+func webParseMarketData(result string) ([]WebMarketData, error) {
+	if webUseRowBinary {
+		return webParseRowBinaryData(result)
+	}
+	return webParseTabSeparatedData(result)
+}
+
+// 解析 RowBinaryWithNamesAndTypes 格式：列数、列名、列类型之后是逐行的小端二进制值。
+// 字段按列名映射到 WebMarketData，因此列顺序和分钟线表的宽整数类型都不影响解析。
+func webParseRowBinaryData(data string) ([]WebMarketData, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	r := &webBinaryReader{data: data}
+
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column count: %w", err)
+	}
+
+	names := make([]string, count)
+	types := make([]string, count)
+	for i := range names {
+		if names[i], err = r.str(); err != nil {
+			return nil, fmt.Errorf("failed to read column name: %w", err)
+		}
+	}
+	for i := range types {
+		if types[i], err = r.str(); err != nil {
+			return nil, fmt.Errorf("failed to read column type: %w", err)
+		}
+	}
+
+	loc := webServerLocation()
+	var marketData []WebMarketData
+	for r.pos < len(r.data) {
+		var md WebMarketData
+		for i := range names {
+			v, err := r.value(types[i])
+			if err != nil {
+				return marketData, fmt.Errorf("row %d column %s: %w", len(marketData)+1, names[i], err)
+			}
+
+			switch names[i] {
+			case "symbol":
+				md.Symbol = v.str
+			case "time":
+				md.Time = time.Unix(v.int, 0).In(loc).Format("2006-01-02 15:04:05")
+			case "price":
+				md.Price = float32(v.num)
+			case "vol":
+				md.Vol = uint32(v.int)
+			case "open_interest":
+				md.OpenInterest = uint32(v.int)
+			case "diff_vol":
+				md.DiffVol = int32(v.int)
+			case "diff_oi":
+				md.DiffOI = int32(v.int)
+			case "bid_1":
+				md.Bid1 = float32(v.num)
+			case "bid_volumn_1":
+				md.BidVolumn1 = uint32(v.int)
+			case "ask_1":
+				md.Ask1 = float32(v.num)
+			case "ask_volumn_1":
+				md.AskVolumn1 = uint32(v.int)
+			case "datetime":
+				md.DateTime = uint64(v.int)
+			}
+		}
+		marketData = append(marketData, md)
+	}
+
+	return marketData, nil
+}
+
+type webBinaryValue struct {
+	str string
+	num float64
+	int int64 // 整数原值 (UInt64 按位保存)，避免转换为float64丢失精度
+}
+
+type webBinaryReader struct {
+	data string
+	pos  int
+}
+
+func (r *webBinaryReader) take(n int) (string, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return s, nil
+}
+
+func (r *webBinaryReader) uvarint() (uint64, error) {
+	var x uint64
+	for shift := 0; shift < 64; shift += 7 {
+		if r.pos >= len(r.data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		b := r.data[r.pos]
+		r.pos++
+		x |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("varint overflow")
+}
+
+func (r *webBinaryReader) str() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	return r.take(int(n))
+}
+
+// 读取n字节的小端无符号整数
+func (r *webBinaryReader) fixed(n int) (uint64, error) {
+	s, err := r.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for i := n - 1; i >= 0; i-- {
+		x = x<<8 | uint64(s[i])
+	}
+	return x, nil
+}
+
+// 按ClickHouse类型名读取一个值，整数类型同时填充 num 以便按浮点数使用
+func (r *webBinaryReader) value(typ string) (webBinaryValue, error) {
+	var v webBinaryValue
+
+	if strings.HasPrefix(typ, "Nullable(") {
+		isNull, err := r.fixed(1)
+		if err != nil || isNull == 1 {
+			return v, err
+		}
+		return r.value(typ[len("Nullable(") : len(typ)-1])
+	}
+	if strings.HasPrefix(typ, "LowCardinality(") {
+		return r.value(typ[len("LowCardinality(") : len(typ)-1])
+	}
+	if strings.HasPrefix(typ, "DateTime(") {
+		typ = "DateTime"
+	}
+
+	var err error
+	var x uint64
+	switch typ {
+	case "String":
+		v.str, err = r.str()
+		return v, err
+	case "Float32":
+		x, err = r.fixed(4)
+		v.num = float64(math.Float32frombits(uint32(x)))
+		return v, err
+	case "Float64":
+		x, err = r.fixed(8)
+		v.num = math.Float64frombits(x)
+		return v, err
+	case "UInt8", "Bool":
+		x, err = r.fixed(1)
+		v.int = int64(x)
+	case "UInt16":
+		x, err = r.fixed(2)
+		v.int = int64(x)
+	case "UInt32", "DateTime":
+		x, err = r.fixed(4)
+		v.int = int64(x)
+	case "UInt64":
+		x, err = r.fixed(8)
+		v.int = int64(x)
+	case "Int8":
+		x, err = r.fixed(1)
+		v.int = int64(int8(x))
+	case "Int16":
+		x, err = r.fixed(2)
+		v.int = int64(int16(x))
+	case "Int32":
+		x, err = r.fixed(4)
+		v.int = int64(int32(x))
+	case "Int64":
+		x, err = r.fixed(8)
+		v.int = int64(x)
+	default:
+		return v, fmt.Errorf("unsupported column type %s", typ)
+	}
+
+	v.num = float64(v.int)
+	return v, err
+}
+
+var (
+	webServerLoc     *time.Location
+	webServerLocOnce sync.Once
+)
+
+// DateTime 在RowBinary中是Unix秒数，需要按服务器时区转换成与TabSeparated一致的墙上时间
+func webServerLocation() *time.Location {
+	webServerLocOnce.Do(func() {
+		webServerLoc = time.UTC
+		if webDemoMode() {
+			// 演示行情按本机时区生成
+			webServerLoc = time.Local
+			return
+		}
+		result, err := webExecuteQuery("SELECT timezone()")
+		if err != nil {
+			log.Printf("Failed to query server timezone, using UTC: %v", err)
+			return
+		}
+		loc, err := time.LoadLocation(strings.TrimSpace(result))
+		if err != nil {
+			log.Printf("Failed to load timezone %s, using UTC: %v", strings.TrimSpace(result), err)
+			return
+		}
+		webServerLoc = loc
+	})
+	return webServerLoc
+}
+
+// 对默认数据集分别使用两种格式查询并计时，输出下载和解析耗时对比
+func webRunParseBenchmark() {
+	for _, rowBinary := range []bool{false, true} {
+		webUseRowBinary = rowBinary
+
+		start := time.Now()
+		query, err := webSelect(context.Background(), webMarketDataColumns...).
+			From("jm").
+			Symbol("jm2509").
+			OrderBy("time ASC").
+			Format(webResultFormat()).
+			Build()
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := webExecuteQuery(query)
+		if err != nil {
+			log.Fatal("Benchmark query failed:", err)
+		}
+		fetched := time.Now()
+
+		data, err := webParseMarketData(result)
+		if err != nil {
+			log.Fatal("Benchmark parse failed:", err)
+		}
+		parseTime := time.Since(fetched)
+
+		fmt.Printf("%-28s rows=%-9d bytes=%-11d fetch=%-12v parse=%-12v (%.0f rows/s)\n",
+			webResultFormat(), len(data), len(result), fetched.Sub(start), parseTime,
+			float64(len(data))/parseTime.Seconds())
+	}
+}
+
+// Web服务器
+func webStartWebServer() {
+	webHandle("/", webIndexHandler)
+	webHandle("/chart", webChartHandler)
+	webHandle("/download/chart.png", webDownloadChartHandler)
+	webHandle("/sparkline.png", webSparklineHandler)
+	webHandle("/data", webDataHandler)
+	webHandle("/tables", webTablesHandler)
+	webHandle("/symbols", webSymbolsHandler)
+	webHandle("/api/v1/catalog", webCatalogHandler)
+	webHandle("/api/v1/describe", webDescribeHandler)
+	webHandle("/query", webQueryHandler)
+	webHandle("/query/data", webQueryDataHandler)
+	webHandle("/export.arrow", webExportArrowHandler)
+	webHandle("/api/v1/export/estimate", webExportEstimateHandler)
+	webHandle("/ws", webWSHandler)
+	webHandle("/api/v1/ws/stats", webWSStatsHandler)
+	webHandle("/refresh", webRefreshHandler)
+	webHandle("/compare", webCompareHandler)
+	webHandle("/compare/data", webCompareDataHandler)
+	webHandle("/overlay/data", webOverlayDataHandler)
+	webHandle("/leadlag", webLeadLagHandler)
+	webHandle("/events", webEventsHandler)
+	webHandle("/api/v1/contract", webContractHandler)
+	webHandle("/heatmap", webHeatmapHandler)
+	webHandle("/heatmap/data", webHeatmapDataHandler)
+	webHandle("/daily", webDailyHandler)
+	webHandle("/daily/data", webDailyDataHandler)
+	webHandle("/summary/data", webSummaryDataHandler)
+	webHandle("/profile/data", webProfileDataHandler)
+	webHandle("/ghost/data", webGhostDataHandler)
+	webHandle("/volcone", webVolConeHandler)
+	webHandle("/volcone/data", webVolConeDataHandler)
+	webHandle("/correlation", webCorrelationHandler)
+	webHandle("/correlation/data", webCorrelationDataHandler)
+	webHandle("/basis", webBasisHandler)
+	webHandle("/basis/data", webBasisDataHandler)
+	webHandle("/termstructure", webTermStructureHandler)
+	webHandle("/termstructure/data", webTermStructureDataHandler)
+	webHandle("/dom", webDomHandler)
+	webHandle("/dom/data", webDomDataHandler)
+	webHandle("/api/v1/diagnostics", webDiagnosticsHandler)
+	webHandle("/api/v1/distribution", webDistributionHandler)
+	webHandle("/api/v1/pivots", webPivotsHandler)
+	webHandle("/api/v1/levels", webLevelsHandler)
+	webHandle("/api/v1/parse-errors", webParseErrorsHandler)
+	webHandle("/api/v1/incidents", webIncidentsHandler)
+	webHandle("/api/v1/incidents/usage", webIncidentUsageHandler)
+	webHandle("/api/v1/session", webSessionNavHandler)
+	webHandle("/api/v1/report", webReportHandler)
+	webHandle("/api/v1/jobs", webJobsHandler)
+	webHandle("/api/v1/jobs/", webJobHandler)
+	webHandle("/api/v1/replay", webReplaysHandler)
+	webHandle("/api/v1/replay/", webReplayHandler)
+	webHandle("/replay", webReplayPageHandler)
+	webHandle("/api/v1/range/", webRangeLinkHandler)
+	webHandle("/dashboard", webDashboardHandler)
+	webHandle("/dashboard/data", webDashboardDataHandler)
+	webHandle("/api/v1/audit", webAuditHandler)
+	webHandle("/admin/queries", webAuditPageHandler)
+	webHandle("/api/v1/config", webConfigHandler)
+	webHandle("/api/v1/profile", webProfileHandler)
+	webHandle("/admin/config", webConfigPageHandler)
+	webHandle("/healthz", webHealthHandler)
+	webHandle("/assets/", webAssetsHandler)
+	webHandle("/incidents/", webIncidentFileHandler)
+	webHandle("/session", webSessionHandler)
+	webHandle("/updates", webUpdatesHandler)
+
+	webSupervise("WebSocket feed loop", webFeedLoop)
+	webSupervise("replay loop", webReplayLoop)
+	webCheckAssets()
+
+	listener, err := webListen(webListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 端口被占用而改用其他端口时，提示和 -open 使用实际监听的地址
+	if listener.Addr().Network() == "tcp" {
+		webListenAddr = listener.Addr().String()
+	}
+
+	base := webDisplayURL(webListenAddr)
+	fmt.Printf("\n\nStarting web server at %s\n", base)
+	fmt.Println("Open your browser and visit the URL above to view the chart")
+	fmt.Println("Direct chart access: " + base + "/chart")
+	if webOpenOnStart {
+		if strings.HasPrefix(base, "unix:") {
+			log.Printf("-open ignored: listening on a unix socket")
+		} else if err := webOpenBrowser(base); err != nil {
+			log.Printf("Failed to open the browser, visit %s manually: %v", base, err)
+		}
+	}
+
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      webWriteTimeout,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 << 10,
+	}
+	log.Fatal(server.Serve(listener))
+}
+
+// 注册处理器，并按 webHandlerTimeouts 覆盖该接口的写超时（默认为 -write-timeout）
+func webHandle(pattern string, handler http.HandlerFunc) {
+	timeout, ok := webHandlerTimeouts[pattern]
+	if !ok {
+		timeout = webWriteTimeout
+	}
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if timeout != webWriteTimeout {
+			rc := http.NewResponseController(w)
+			if timeout > 0 {
+				rc.SetWriteDeadline(time.Now().Add(timeout))
+			} else {
+				// 长连接同时清除读超时，否则读超时到期后请求的context会被取消
+				rc.SetWriteDeadline(time.Time{})
+				rc.SetReadDeadline(time.Time{})
+			}
+		}
+		webWrapHandler(pattern, handler)(w, r)
+	})
+}
+
+// 自带认证的接口不经过访问控制：/refresh 由定时任务带 -refresh-token 调用，这个令牌不是ACL用户的令牌
+var webACLExempt = map[string]bool{"/refresh": true}
+
+// 每个接口共用的处理链：恢复panic、访问控制（webACLExempt 中的接口除外）和审计
+func webWrapHandler(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	handler = webWithAudit(handler)
+	if !webACLExempt[pattern] {
+		handler = webWithACL(handler)
+	}
+	return webWithRecover(handler)
+}
+
+// 按 -listen 参数创建监听：host:port 走TCP，unix:/path.sock 走Unix套接字（先清理上次遗留的套接字文件）
+func webListen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid listen address %q (expected unix:/path/to.sock)", addr)
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q (expected host:port or unix:/path.sock): %w", addr, err)
+	}
+	return webListenTCP(addr)
+}
+
+// 端口被占用时（如另一个查看器实例已在运行）依次尝试后面的 PORT_FALLBACK_TRIES 个端口，
+// 都被占用时由系统分配一个空闲端口；-port-fallback=false 时直接报错
+const PORT_FALLBACK_TRIES = 10
+
+func webListenTCP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err == nil || !webPortFallback || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+	host, portSpec, _ := net.SplitHostPort(addr)
+	if port, convErr := strconv.Atoi(portSpec); convErr == nil {
+		for next := port + 1; next <= port+PORT_FALLBACK_TRIES && next <= 65535; next++ {
+			if l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(next))); err == nil {
+				log.Printf("Port %d is already in use, listening on port %d instead", port, next)
+				return l, nil
+			}
+		}
+	}
+	l, fallbackErr := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if fallbackErr != nil {
+		return nil, err
+	}
+	log.Printf("Port %s and the next %d ports are in use, listening on %s instead", portSpec, PORT_FALLBACK_TRIES, l.Addr())
+	return l, nil
+}
+
+// -open：用系统默认浏览器打开查看器页面
+func webOpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// 启动提示中使用的访问地址，未指定主机或绑定所有接口时显示 localhost
+func webDisplayURL(addr string) string {
+	if strings.HasPrefix(addr, "unix:") {
+		return addr
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// 长时间运行：日志写入按大小轮转的文件，处理器和后台循环中的panic被捕获并记录，
+// 后台循环崩溃后自动重新启动，单个请求或数据源的异常数据不会让整个服务退出
+const (
+	SUPERVISE_RESTART_DELAY = 5 * time.Second // 后台循环崩溃后等待该时长再重启
+	DAEMON_CHILD_ENV        = "CHART_DAEMON_CHILD"
+)
+
+var (
+	webLogPath      string
+	webLogMaxSize   int64
+	webLogBackups   int
+	webStartedAt    = time.Now()
+	webRecovered    atomic.Int64 // 处理器中捕获的panic次数
+	webLoopRestarts atomic.Int64 // 后台循环崩溃后重启的次数
+)
+
+// 按大小轮转的日志文件：写入前超过上限时当前文件改名为 .1，已有的 .N 依次后移，超出保留个数的删除
+type webRotatingLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	backups int
+}
+
+func newWebRotatingLog(path string, maxSize int64, backups int) (*webRotatingLog, error) {
+	l := &webRotatingLog{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *webRotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+func (l *webRotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		l.file.Close()
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+		for i := l.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if l.backups > 0 {
+			os.Rename(l.path, l.path+".1")
+		} else {
+			os.Remove(l.path)
+		}
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// 把 log 包和标准输出、标准错误都写入 -log-file。标准输出经管道转发，启动提示等 fmt 输出也一起轮转
+func webSetupLogFile(path string) error {
+	out, err := newWebRotatingLog(path, webLogMaxSize, webLogBackups)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	go io.Copy(out, r)
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(out)
+	webLogPath = path
+	return nil
+}
+
+// 进程存活检查，供 systemd、监控脚本等使用：运行时长、捕获的panic次数和后台循环重启次数
+func webHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":           "ok",
+		"pid":              os.Getpid(),
+		"started_at":       webStartedAt.Format("2006-01-02 15:04:05"),
+		"uptime":           time.Since(webStartedAt).Round(time.Second).String(),
+		"recovered_panics": webRecovered.Load(),
+		"loop_restarts":    webLoopRestarts.Load(),
+		"log_file":         webLogPath,
+	})
+}
+
+// -daemon：以相同的参数在后台重新启动自身，输出只写入 -log-file，打印子进程PID后父进程退出。
+// 子进程忽略SIGHUP，关闭终端后继续运行；停止时向该PID发送SIGTERM
+func webDaemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	cmd := exec.Command(exe, append(os.Args[1:], "-daemon=false")...)
+	cmd.Env = append(os.Environ(), DAEMON_CHILD_ENV+"=1")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+	fmt.Printf("Web chart viewer running in the background, pid %d\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// 捕获处理器中的panic：记录请求和调用栈，返回500，连接和其他请求不受影响。
+// http.ErrAbortHandler 是主动中断响应的约定，照常向上抛出
+func webWithRecover(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			webRecovered.Add(1)
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.RequestURI(), err, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("服务器内部错误: %v", err)})
+		}()
+		handler(w, r)
+	}
+}
+
+// 在后台运行一个常驻循环，循环panic时记录调用栈并在 SUPERVISE_RESTART_DELAY 后重新启动；
+// 循环正常返回时不再重启
+func webSupervise(name string, loop func()) {
+	go func() {
+		for {
+			panicked := func() (panicked bool) {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("%s crashed: %v\n%s", name, err, debug.Stack())
+						panicked = true
+					}
+				}()
+				loop()
+				return false
+			}()
+			if !panicked {
+				return
+			}
+			webLoopRestarts.Add(1)
+			log.Printf("Restarting %s in %v", name, SUPERVISE_RESTART_DELAY)
+			time.Sleep(SUPERVISE_RESTART_DELAY)
+		}
+	}()
+}
+
+// 访问控制 (-acl)：按令牌识别用户，限制其可以访问的表和symbol，例如实习生只能浏览测试表。
+// 所有读取的表都在 feature 库，模式为 filepath.Match 语法（如 tst*、jm25??），不区分大小写，为空表示不限制。
+// 自定义SQL可以读取任意库和表，只有 query 为 true 的用户可以使用 /query；admin 为 true 的用户可以查看查询审计
+type webACLUser struct {
+	Name    string   `json:"name"`
+	Token   string   `json:"token"`
+	Tables  []string `json:"tables"`
+	Symbols []string `json:"symbols"`
+	Query   bool     `json:"query"`
+	Admin   bool     `json:"admin"`
+}
+
+// 通过 ?token= 登录后保存令牌的cookie，页面内的后续请求和WebSocket握手自动带上
+const WEB_TOKEN_COOKIE = "chart_token"
+
+// 已配置的用户，nil 表示未启用访问控制
+var webACL []*webACLUser
+
+type webACLContextKey struct{}
+
+// 读取 -acl 指定的JSON文件：{"users": [{"name": ..., "token": ..., "tables": [...], "symbols": [...], "query": false}]}
+func webLoadACL(path string) ([]*webACLUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACL: %w", err)
+	}
+	var config struct {
+		Users []*webACLUser `json:"users"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse ACL %s: %w", path, err)
+	}
+	if len(config.Users) == 0 {
+		return nil, fmt.Errorf("ACL %s has no users", path)
+	}
+	tokens := make(map[string]bool)
+	for _, u := range config.Users {
+		if u.Name == "" || u.Token == "" {
+			return nil, fmt.Errorf("ACL %s: every user needs a name and a token", path)
+		}
+		if tokens[u.Token] {
+			return nil, fmt.Errorf("ACL %s: duplicate token for user %s", path, u.Name)
+		}
+		tokens[u.Token] = true
+		for _, pattern := range append(append([]string{}, u.Tables...), u.Symbols...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("ACL %s: invalid pattern %q for user %s", path, pattern, u.Name)
+			}
+		}
+	}
+	return config.Users, nil
+}
+
+func webACLMatch(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nil 用户（未启用访问控制）允许访问所有数据
+func (u *webACLUser) allowsTable(table string) bool {
+	return u == nil || webACLMatch(u.Tables, table)
+}
+
+func (u *webACLUser) allows(table, symbol string) bool {
+	return u == nil || (webACLMatch(u.Tables, table) && webACLMatch(u.Symbols, symbol))
+}
+
+// 访问控制拒绝的错误，接口据此返回 403
+type webACLError struct {
+	msg string
+}
+
+func (e *webACLError) Error() string {
+	return e.msg
+}
+
+func (u *webACLUser) denied(table, symbol string) error {
+	if symbol == "" {
+		return &webACLError{fmt.Sprintf("用户 %s 无权访问表 %s", u.Name, table)}
+	}
+	return &webACLError{fmt.Sprintf("用户 %s 无权访问 %s/%s", u.Name, table, symbol)}
+}
+
+// 令牌依次取自 Authorization: Bearer、?token= 和cookie。通过 ?token= 认证成功时写入cookie，
+// 之后在页面中打开的其他页面和WebSocket连接不需要再带令牌
+func webAuthenticate(w http.ResponseWriter, r *http.Request) *webACLUser {
+	token, fromQuery := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), false
+	if token == "" {
+		if token = r.URL.Query().Get("token"); token != "" {
+			fromQuery = true
+		} else if cookie, err := r.Cookie(WEB_TOKEN_COOKIE); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return nil
+	}
+	for _, u := range webACL {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(u.Token)) == 1 {
+			if fromQuery {
+				http.SetCookie(w, &http.Cookie{
+					Name:     WEB_TOKEN_COOKIE,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+			return u
+		}
+	}
+	return nil
+}
+
+// 当前请求的用户，未启用访问控制时为 nil
+func webRequestUser(r *http.Request) *webACLUser {
+	return webContextUser(r.Context())
+}
+
+// context 中的用户：请求的context由 webWithACL 放入，WebSocket订阅等后台查询用 webWithUser 放入
+func webContextUser(ctx context.Context) *webACLUser {
+	u, _ := ctx.Value(webACLContextKey{}).(*webACLUser)
+	return u
+}
+
+func webWithUser(ctx context.Context, u *webACLUser) context.Context {
+	if u == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, webACLContextKey{}, u)
+}
+
+// 直接使用已加载数据（会话当前数据集、共享的展示数据）而不构建查询的接口，检查该数据集（初始为启动参数指定的默认数据集）
+func webAuthorizeDataset(r *http.Request, key webDatasetKey) error {
+	if u := webRequestUser(r); !u.allows(key.table, key.symbol) {
+		return u.denied(key.table, key.symbol)
+	}
+	return nil
+}
+
+// 所有接口都经 webHandle 注册，启用访问控制时先认证用户，再把用户放入请求的context，
+// 由查询构造器（webQuery）和数据集缓存（webGetDataset）按用户检查表和合约
+func webWithACL(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webACL == nil {
+			handler(w, r)
+			return
+		}
+		user := webAuthenticate(w, r)
+		if user == nil {
+			webACLDeny(w, http.StatusUnauthorized, "需要访问令牌：请求头 Authorization: Bearer <token>，或在地址后加 ?token=<token>")
+			return
+		}
+		handler(w, r.WithContext(webWithUser(r.Context(), user)))
+	}
+}
+
+// 管理接口只对 admin 用户开放。未启用访问控制时无法识别用户，这些接口一律拒绝
+func webRequireAdmin(r *http.Request, what string) error {
+	u := webRequestUser(r)
+	switch {
+	case u == nil:
+		return fmt.Errorf("%s需要启用访问控制 (-acl) 并使用管理员令牌", what)
+	case !u.Admin:
+		return fmt.Errorf("用户 %s 无权查看%s", u.Name, what)
+	}
+	return nil
+}
+
+func webACLDeny(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+}
+
+// 内置资源：页面模板是下面的常量，JS库、字体和默认配置放在 assets/ 目录中随编译嵌入，部署时只需复制可执行文件。
+// assets/js 和 assets/fonts 需要在编译前用 `assets fetch` 下载或手动放入字体，缺少JS库时页面改从CDN加载，
+// 缺少字体时PNG使用go-chart自带的Roboto（中文显示为方框）
+//
+//go:embed assets
+var webEmbeddedAssets embed.FS
+
+// -assets-dir 指定的目录，其中的 templates/、js/、fonts/ 优先于内置资源，通常先用 `assets export` 导出再修改
+var webAssetsDir string
+
+// 页面使用的JS库：文件名 -> CDN地址，未嵌入时 /assets/js/ 重定向到CDN
+var webJSLibraries = map[string]string{
+	"chart.umd.js":               "https://cdn.jsdelivr.net/npm/chart.js@4.4.0/dist/chart.umd.js",
+	"chartjs-plugin-zoom.min.js": "https://cdn.jsdelivr.net/npm/chartjs-plugin-zoom@2.0.1/dist/chartjs-plugin-zoom.min.js",
+	"hammer.min.js":              "https://cdn.jsdelivr.net/npm/hammerjs@2.0.8/hammer.min.js",
+}
+
+// 内置的页面模板，按 templates/ 下的文件名索引
+var webTemplates = map[string]string{
+	"index.html":         webIndexTemplate,
+	"compare.html":       webCompareTemplate,
+	"heatmap.html":       webHeatmapTemplate,
+	"daily.html":         webDailyTemplate,
+	"volcone.html":       webVolConeTemplate,
+	"correlation.html":   webCorrelationTemplate,
+	"basis.html":         webBasisTemplate,
+	"termstructure.html": webTermStructureTemplate,
+	"dom.html":           webDomTemplate,
+	"query.html":         webQueryTemplate,
+	"replay.html":        webReplayTemplate,
+	"dashboard.html":     webDashboardTemplate,
+	"audit.html":         webAuditTemplate,
+	"config.html":        webConfigTemplate,
+}
+
+// 资源文件系统，按优先级排列：-assets-dir、内置的 assets/
+func webAssetFS() []fs.FS {
+	embedded, _ := fs.Sub(webEmbeddedAssets, "assets")
+	if webAssetsDir == "" {
+		return []fs.FS{embedded}
+	}
+	return []fs.FS{os.DirFS(webAssetsDir), embedded}
+}
+
+// 读取资源文件，name 为相对 assets/ 的路径，如 js/chart.umd.js
+func webReadAsset(name string) ([]byte, error) {
+	var err error
+	for _, fsys := range webAssetFS() {
+		var data []byte
+		if data, err = fs.ReadFile(fsys, name); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// 页面模板：-assets-dir/templates 中有同名文件时使用它（每次请求重新读取，修改后刷新页面即可），否则使用内置模板
+func webTemplate(name string) string {
+	if data, err := webReadAsset("templates/" + name); err == nil {
+		return string(data)
+	}
+	return webTemplates[name]
+}
+
+// 提供页面使用的JS库：依次查找 -assets-dir/js 和内置的 assets/js，都没有时重定向到CDN
+func webAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/assets/js/")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if data, err := webReadAsset("js/" + name); err == nil {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(data)
+		return
+	}
+	if cdn, ok := webJSLibraries[name]; ok {
+		http.Redirect(w, r, cdn, http.StatusFound)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// 启动时提示没有嵌入的JS库和字体：仓库不包含这些文件，直接从仓库编译的版本页面依赖CDN、PNG中文显示为方框
+func webCheckAssets() {
+	var missing []string
+	for name := range webJSLibraries {
+		if _, err := webReadAsset("js/" + name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		log.Printf("JS libraries not embedded, browsers will load them from the CDN: %s (run `assets fetch` before building)", strings.Join(missing, ", "))
+	}
+	hasFont := false
+	for _, fsys := range webAssetFS() {
+		if names, _ := fs.Glob(fsys, "fonts/*.ttf"); len(names) > 0 {
+			hasFont = true
+		}
+	}
+	if !hasFont {
+		log.Printf("No chart font under assets/fonts, PNG charts will render CJK text as boxes")
+	}
+}
+
+var (
+	webFontOnce sync.Once
+	webFont     *truetype.Font
+)
+
+// PNG图表的字体：-assets-dir/fonts 或内置 assets/fonts 中按文件名排在最前的 .ttf，
+// 应该是包含中文的字体（如 Noto Sans SC、文泉驿），都没有时返回nil，由go-chart使用自带字体
+func webChartFont() *truetype.Font {
+	webFontOnce.Do(func() {
+		for _, fsys := range webAssetFS() {
+			names, _ := fs.Glob(fsys, "fonts/*.ttf")
+			if len(names) == 0 {
+				continue
+			}
+			data, err := fs.ReadFile(fsys, names[0])
+			if err == nil {
+				webFont, err = truetype.Parse(data)
+			}
+			if err != nil {
+				log.Printf("Failed to load chart font %s: %v", names[0], err)
+				continue
+			}
+			log.Printf("Using chart font %s", names[0])
+			return
+		}
+	})
+	return webFont
+}
+
+// assets 子命令：export 导出内置资源供修改，fetch 在编译前下载JS库到 assets/js
+func webAssetsCommand(args []string) error {
+	usage := `Usage: go run web_chart_viewer.go assets <command> [flags]
+
+Commands:
+  export  把内置的页面模板、JS库、字体和默认配置导出到目录 (-dir assets-custom)，修改后用 -assets-dir 指定
+  fetch   从CDN下载页面使用的JS库到 -dir assets/js，重新编译后页面不再需要访问外网`
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "export":
+		cmd := flag.NewFlagSet("assets export", flag.ExitOnError)
+		dir := cmd.String("dir", "assets-custom", "导出目录")
+		force := cmd.Bool("force", false, "覆盖目录中已存在的文件")
+		cmd.Parse(args[1:])
+		written, skipped, err := webExportAssets(*dir, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d files to %s\n", written, *dir)
+		if skipped > 0 {
+			fmt.Printf("Skipped %d existing files (use -force to overwrite)\n", skipped)
+		}
+		fmt.Printf("Run with -assets-dir %s to use them\n", *dir)
+		return nil
+	case "fetch":
+		cmd := flag.NewFlagSet("assets fetch", flag.ExitOnError)
+		dir := cmd.String("dir", "assets", "资源目录，JS库保存到其中的 js/")
+		cmd.Parse(args[1:])
+		return webFetchJSLibraries(filepath.Join(*dir, "js"))
+	}
+	return fmt.Errorf("unknown assets command %q\n\n%s", args[0], usage)
+}
+
+// 导出内置资源到 dir：templates/ 来自模板常量，其余文件原样复制自嵌入的 assets/；
+// 已存在的文件除非 force 否则保留，避免覆盖修改过的版本
+func webExportAssets(dir string, force bool) (written, skipped int, err error) {
+	files := map[string][]byte{}
+	for name, tmpl := range webTemplates {
+		files["templates/"+name] = []byte(strings.TrimPrefix(tmpl, "\n"))
+	}
+	err = fs.WalkDir(webEmbeddedAssets, "assets", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := webEmbeddedAssets.ReadFile(path)
+		files[strings.TrimPrefix(path, "assets/")] = data
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if _, statErr := os.Stat(path); statErr == nil && !force {
+			skipped++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return written, skipped, err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return written, skipped, err
+		}
+		written++
+	}
+	return written, skipped, nil
+}
+
+// 从CDN下载 webJSLibraries 到 dir
+func webFetchJSLibraries(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	for name, cdn := range webJSLibraries {
+		resp, err := client.Get(cdn)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to download %s: %s", name, resp.Status)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Downloaded %s (%d bytes)\n", filepath.Join(dir, name), len(data))
+	}
+	return nil
+}
+
+// 主页的HTML模板 (templates/index.html)
+const webIndexTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>JM2509 Interactive Chart</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <script src="/assets/js/chartjs-plugin-zoom.min.js"></script>
+    <style>
+        body { 
+            font-family: Arial, sans-serif; 
+            margin: 20px; 
+            background-color: #f5f5f5;
+        }
+        .container { 
+            max-width: 1600px; 
             margin: 0 auto; 
             background-color: white;
             padding: 20px;
             border-radius: 8px;
             box-shadow: 0 2px 10px rgba(0,0,0,0.1);
         }
-        .header {
+        .header {
+            text-align: center;
+            margin-bottom: 20px;
+            color: #333;
+        }
+        /* 开盘/收盘摘要横幅：盘前灰色、交易中蓝色、收盘后橙色 */
+        .session-summary {
+            display: inline-block;
+            padding: 6px 14px;
+            border-radius: 4px;
+            font-size: 14px;
+            background-color: #f1f3f5;
+            border: 1px solid #dee2e6;
+        }
+        .session-summary.open {
+            background-color: #e7f3ff;
+            border-color: #b6d4fe;
+        }
+        .session-summary.closed {
+            background-color: #fff4e5;
+            border-color: #ffd8a8;
+        }
+        .stats {
+            display: flex;
+            justify-content: space-around;
+            margin-bottom: 20px;
+            padding: 15px;
+            background-color: #f8f9fa;
+            border-radius: 5px;
+        }
+        .stat-item {
+            text-align: center;
+        }
+        .stat-value {
+            font-size: 1.5em;
+            font-weight: bold;
+            color: #007bff;
+        }
+        .stat-label {
+            font-size: 0.9em;
+            color: #666;
+        }
+        .stat-exact {
+            font-size: 0.85em;
+            color: #28a745;
+            min-height: 1.2em;
+        }
+        .stats-note {
+            margin: -12px 0 20px;
+            padding: 6px 15px;
+            font-size: 0.9em;
+            color: #856404;
+            background-color: #fff3cd;
+            border-radius: 5px;
+        }
+        #chartContainer {
+            position: relative;
+            height: 700px;
+            margin-bottom: 20px;
+        }
+        #flowContainer {
+            position: relative;
+            height: 220px;
+            margin-bottom: 20px;
+        }
+        .y-bound {
+            width: 90px;
+        }
+        .diagnostics {
+            margin-bottom: 20px;
+            padding: 10px 15px;
+            background-color: #f8f9fa;
+            border-radius: 5px;
+            font-size: 13px;
+        }
+        .diagnostics table {
+            border-collapse: collapse;
+            margin: 6px 0;
+        }
+        .diagnostics td, .diagnostics th {
+            border: 1px solid #dee2e6;
+            padding: 3px 10px;
+            text-align: right;
+        }
+        .diagnostics .significant {
+            color: #dc3545;
+            font-weight: bold;
+        }
+        .distribution-chart {
+            position: relative;
+            height: 300px;
+        }
+        .controls {
+            text-align: center;
+            margin-bottom: 20px;
+        }
+        button {
+            padding: 10px 20px;
+            margin: 0 5px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            font-size: 14px;
+        }
+        button:hover {
+            background-color: #0056b3;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            background-color: #d4edda;
+            border: 1px solid #c3e6cb;
+            border-radius: 5px;
+            color: #155724;
+            margin-top: 20px;
+        }
+        .info {
+            background-color: #e7f3ff;
+            border: 1px solid #bee5eb;
+            border-radius: 5px;
+            padding: 15px;
+            margin: 20px 0;
+            text-align: center;
+        }
+        .query-controls {
+            display: flex;
+            justify-content: center;
+            align-items: center;
+            gap: 20px;
+            margin-bottom: 20px;
+            padding: 15px;
+            background-color: #f8f9fa;
+            border-radius: 5px;
+            border: 1px solid #dee2e6;
+        }
+        .control-group {
+            display: flex;
+            flex-direction: column;
+            align-items: center;
+        }
+        .control-group label {
+            font-weight: bold;
+            margin-bottom: 5px;
+            color: #495057;
+            font-size: 14px;
+        }
+        .control-group select,
+        .control-group input {
+            padding: 8px 12px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+            font-size: 14px;
+            min-width: 150px;
+        }
+        .control-group select:focus,
+        .control-group input:focus {
+            outline: none;
+            border-color: #007bff;
+            box-shadow: 0 0 0 2px rgba(0,123,255,0.25);
+        }
+        .query-btn {
+            background-color: #28a745 !important;
+            padding: 8px 20px !important;
+            margin-top: 20px !important;
+        }
+        .query-btn:hover {
+            background-color: #218838 !important;
+        }
+        .input-mode-toggle {
+            margin-top: 5px;
+            font-size: 12px;
+        }
+        .input-mode-toggle label {
+            display: flex;
+            align-items: center;
+            gap: 5px;
+            font-weight: normal !important;
+            cursor: pointer;
+        }
+        .input-mode-toggle input[type="checkbox"] {
+            width: auto;
+            min-width: auto;
+        }
+        .error-message {
+            background-color: #f8d7da;
+            border: 1px solid #f5c6cb;
+            color: #721c24;
+            padding: 10px;
+            border-radius: 4px;
+            margin-top: 10px;
+            text-align: center;
+            font-weight: bold;
+        }
+        .success-message {
+            background-color: #d4edda;
+            border: 1px solid #c3e6cb;
+            color: #155724;
+            padding: 10px;
+            border-radius: 4px;
+            margin-top: 10px;
+            text-align: center;
+            font-weight: bold;
+        }
+        .error-banner {
+            display: flex;
+            align-items: center;
+            justify-content: space-between;
+            gap: 15px;
+            background-color: #f8d7da;
+            border: 1px solid #f5c6cb;
+            color: #721c24;
+            padding: 12px 15px;
+            border-radius: 4px;
+            margin-bottom: 15px;
+        }
+        .error-banner button {
+            background-color: #dc3545;
+            color: white;
+            border: none;
+            padding: 6px 16px;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+        .empty-state {
+            background-color: #fff8e1;
+            border: 1px solid #ffe082;
+            color: #5d4200;
+            padding: 12px 15px;
+            border-radius: 4px;
+            margin-bottom: 15px;
+        }
+        .empty-state ul {
+            margin: 8px 0;
+            padding-left: 20px;
+        }
+        .empty-state button {
+            margin: 4px 6px 0 0;
+            padding: 4px 12px;
+            border: 1px solid #ffb300;
+            background-color: white;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+        .job-progress {
+            display: flex;
+            align-items: center;
+            gap: 10px;
+            margin-bottom: 15px;
+            font-size: 14px;
+            color: #555;
+        }
+        .job-progress-track {
+            flex: 1;
+            height: 8px;
+            background-color: #e9ecef;
+            border-radius: 4px;
+            overflow: hidden;
+        }
+        .job-progress-bar {
+            width: 0;
+            height: 100%;
+            background-color: #007bff;
+            transition: width 0.3s;
+        }
+        .job-progress button {
+            padding: 4px 12px;
+            cursor: pointer;
+        }
+        .parse-warning {
+            background-color: #fff3cd;
+            border: 1px solid #ffeeba;
+            color: #856404;
+            padding: 8px 15px;
+            border-radius: 4px;
+            margin-bottom: 15px;
+            font-size: 14px;
+        }
+        .parse-warning a {
+            color: #856404;
+            cursor: pointer;
+            text-decoration: underline;
+        }
+        .parse-warning ul {
+            margin: 8px 0 0 0;
+        }
+        .parse-warning code {
+            font-size: 12px;
+            word-break: break-all;
+        }
+        datalist {
+            background-color: white;
+        }
+        .range-controls {
+            text-align: center;
+            margin-bottom: 20px;
+        }
+        .range-controls span {
+            color: #495057;
+            font-weight: bold;
+            margin-right: 5px;
+        }
+        .range-btn {
+            background-color: #6c757d;
+            padding: 6px 14px;
+        }
+        .range-btn.active {
+            background-color: #007bff;
+        }
+        .mode-badge {
+            display: inline-block;
+            padding: 6px 12px;
+            border-radius: 12px;
+            font-size: 13px;
+            font-weight: bold;
+            margin-left: 10px;
+        }
+        .mode-badge.sampled {
+            background-color: #fff3cd;
+            color: #856404;
+        }
+        .mode-badge.raw {
+            background-color: #d4edda;
+            color: #155724;
+        }
+        .mode-badge.capped {
+            background-color: #f8d7da;
+            color: #721c24;
+        }
+        .mode-badge.zoom {
+            background-color: #e7f3ff;
+            color: #004085;
+        }
+        .mode-badge.profile {
+            background-color: #f3e8ff;
+            color: #5a2d82;
+        }
+        .event-tooltip {
+            position: absolute;
+            display: none;
+            max-width: 320px;
+            padding: 6px 10px;
+            background-color: rgba(33, 37, 41, 0.9);
+            color: white;
+            border-radius: 4px;
+            font-size: 12px;
+            pointer-events: none;
+            z-index: 10;
+        }
+        /* 深色配色：由 -theme 或配置文件的 theme 设置，修改后通过 /updates 即时切换 */
+        body.theme-dark {
+            background-color: #121212;
+            color: #ddd;
+        }
+        body.theme-dark .container {
+            background-color: #1e1e1e;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.6);
+        }
+        body.theme-dark .header,
+        body.theme-dark .control-group label {
+            color: #ddd;
+        }
+        body.theme-dark .stats,
+        body.theme-dark .query-controls,
+        body.theme-dark .session-summary,
+        body.theme-dark .diagnostics th {
+            background-color: #2a2a2a;
+            border-color: #444;
+        }
+        body.theme-dark .stat-label {
+            color: #aaa;
+        }
+        body.theme-dark .info {
+            background-color: #1c2b3a;
+            border-color: #2c4a66;
+        }
+        body.theme-dark .status {
+            background-color: #1e3324;
+            border-color: #2f5438;
+            color: #a3d9b1;
+        }
+        body.theme-dark .control-group input,
+        body.theme-dark .control-group select {
+            background-color: #2a2a2a;
+            border-color: #555;
+            color: #ddd;
+        }
+    </style>
+</head>
+<body class="theme-{{THEME}}">
+    <div class="container">
+        <div class="header">
+            <h1>实时市场数据图表</h1>
+            <p>JavaScript交互式图表 - 支持缩放、平移和详细数据查看</p>
+            <div class="session-summary" id="sessionSummary" style="display: none;"></div>
+        </div>
+
+        <div class="error-banner" id="errorBanner" style="display: none;">
+            <span id="errorBannerText"></span>
+            <button onclick="retryLoad()">重试</button>
+        </div>
+
+        <div class="empty-state" id="emptyState" style="display: none;">
+            <strong id="emptyStateMessage"></strong>
+            <ul id="emptyStateHints"></ul>
+            <div id="emptyStateSuggestions"></div>
+        </div>
+        
+        <div class="query-controls">
+            <div class="control-group" id="profileGroup" style="display: none;">
+                <label for="profileSelect">ClickHouse配置:</label>
+                <select id="profileSelect" onchange="switchProfile(this.value)"></select>
+            </div>
+            <div class="control-group">
+                <label for="tableInput">数据表名:</label>
+                <input type="text" id="tableInput" placeholder="例如: jm, SA, MA, rb" list="tableList">
+                <datalist id="tableList">
+                    <!-- 动态加载的表选项 -->
+                </datalist>
+                <div class="input-mode-toggle">
+                    <label>
+                        <input type="checkbox" id="tableDropdownMode"> 使用下拉选择
+                    </label>
+                </div>
+                <select id="tableSelect" style="display: none;">
+                    <option value="">正在加载...</option>
+                </select>
+            </div>
+            <div class="control-group">
+                <label for="symbolInput">Symbol代码:</label>
+                <input type="text" id="symbolInput" placeholder="例如: jm2509, SA509, MA509" list="symbolList">
+                <datalist id="symbolList">
+                    <!-- 动态加载的symbol选项 -->
+                </datalist>
+                <div class="input-mode-toggle">
+                    <label>
+                        <input type="checkbox" id="symbolDropdownMode"> 使用下拉选择
+                    </label>
+                </div>
+                <select id="symbolSelect" style="display: none;">
+                    <option value="">请先选择数据表</option>
+                </select>
+            </div>
+            <div class="control-group">
+                <button onclick="queryData()" class="query-btn">查询数据</button>
+            </div>
+            <div class="error-message" id="errorMessage" style="display: none;"></div>
+        </div>
+        
+        <div class="stats" id="stats">
+            <div class="stat-item">
+                <div class="stat-value" id="avgPrice">--</div>
+                <div class="stat-exact" id="avgPriceExact"></div>
+                <div class="stat-label">平均价格</div>
+            </div>
+            <div class="stat-item">
+                <div class="stat-value" id="maxPrice">--</div>
+                <div class="stat-exact" id="maxPriceExact"></div>
+                <div class="stat-label">最高价格</div>
+            </div>
+            <div class="stat-item">
+                <div class="stat-value" id="minPrice">--</div>
+                <div class="stat-exact" id="minPriceExact"></div>
+                <div class="stat-label">最低价格</div>
+            </div>
+            <div class="stat-item">
+                <div class="stat-value" id="avgOI">--</div>
+                <div class="stat-exact" id="avgOIExact"></div>
+                <div class="stat-label">平均持仓量</div>
+            </div>
+            <div class="stat-item">
+                <div class="stat-value" id="dataPoints">--</div>
+                <div class="stat-exact" id="dataPointsExact"></div>
+                <div class="stat-label">数据点数</div>
+            </div>
+            <div class="stat-item" id="contractStat">
+                <div class="stat-value" id="contractExpiry">--</div>
+                <div class="stat-exact" id="contractDays"></div>
+                <div class="stat-label" id="contractLabel">合约信息</div>
+            </div>
+        </div>
+        <div class="parse-warning" id="expiryWarning" style="display: none;"></div>
+        <div class="stats-note" id="statsNote" style="display: none;"></div>
+
+        <div class="info">
+            <p><strong>操作说明：</strong></p>
+            <p>• 鼠标滚轮：缩放图表 | 拖拽：平移查看不同时间段 | 双击：重置缩放</p>
+            <p>• 点击图例：显示/隐藏对应数据线 | 悬停：查看详细数据</p>
+        </div>
+
+        <div class="range-controls" id="rangeControls">
+            <span>时间范围:</span>
+            <button class="range-btn" data-range="30m" onclick="setRange('30m')">30分钟</button>
+            <button class="range-btn" data-range="2h" onclick="setRange('2h')">2小时</button>
+            <button class="range-btn" data-range="1d" onclick="setRange('1d')">1天</button>
+            <button class="range-btn" data-range="5d" onclick="setRange('5d')">5天</button>
+            <button class="range-btn" data-range="all" onclick="setRange('all')">全部</button>
+            <button onclick="stepSession(-1)" data-shortcut="prev_session" title="上一个交易时段">◀ 上一交易日</button>
+            <button onclick="stepSession(1)" data-shortcut="next_session" title="下一个交易时段">下一交易日 ▶</button>
+        </div>
+
+        <div class="controls">
+            <button onclick="resetZoom()" data-shortcut="reset_zoom">重置缩放</button>
+            <button onclick="zoomIn()" data-shortcut="zoom_in">放大</button>
+            <button onclick="zoomOut()" data-shortcut="zoom_out">缩小</button>
+            <button onclick="togglePrice()" data-shortcut="toggle_price">显示/隐藏价格</button>
+            <button onclick="toggleOI()" data-shortcut="toggle_oi">显示/隐藏持仓量</button>
+            <button onclick="toggleFlow()" data-shortcut="toggle_flow">显示/隐藏成交增仓</button>
+            <select id="flowColorSelect" onchange="setFlowColor(this.value)" title="成交/增仓副图中成交量柱的着色方式">
+                <option value="sign">柱色: 默认</option>
+                <option value="oi">柱色: 按持仓变化</option>
+                <option value="volume">柱色: 按成交强度</option>
+            </select>
+            <button onclick="refreshData()" data-shortcut="refresh">刷新数据</button>
+            <button onclick="exportArrow()">导出Arrow</button>
+            <button onclick="downloadSnapshot()">下载图片</button>
+            <button onclick="window.open('/compare')">窗口对比</button>
+            <button onclick="window.open('/heatmap')">持仓热力图</button>
+            <button onclick="window.open('/daily')">日统计</button>
+            <button onclick="window.open('/volcone')">波动率锥</button>
+            <button onclick="window.open('/correlation')">相关性矩阵</button>
+            <button onclick="window.open('/basis')">基差</button>
+            <button onclick="window.open('/termstructure')">期限结构</button>
+            <button onclick="window.open('/query')">自定义查询</button>
+            <button onclick="window.open('/replay')">共享回放</button>
+            <button onclick="window.open('/dashboard')">联动仪表盘</button>
+            <button onclick="window.open('/admin/queries')">查询审计</button>
+            <button onclick="window.open('/admin/config')">运行时配置</button>
+            <button onclick="openDom()">盘口阶梯</button>
+            <button onclick="loadDiagnostics()">收益率诊断</button>
+            <button onclick="loadDistribution()">收益率分布</button>
+            <button onclick="toggleRaw()" id="rawToggle">显示原始数据</button>
+            <button onclick="toggleLive()" id="liveToggle">实时跟踪</button>
+            <button onclick="toggleFollow()" id="followToggle" style="display: none;">自动跟随: 开</button>
+            <select id="seriesSelect" onchange="setSeries(this.value)">
+                <option value="price">最新价</option>
+                <option value="mid">中间价</option>
+                <option value="spread">价差 (跳)</option>
+            </select>
+            <button onclick="togglePercent()" id="percentToggle">百分比坐标</button>
+            <button onclick="toggleRegimes()" id="regimeToggle" title="按滚动波动率给背景着色：低波动蓝色，高波动红色">波动率着色</button>
+            <button onclick="toggleVWAP()" id="vwapToggle" title="按交易时段累计的成交量加权均价及 ±1σ/±2σ 带，每个交易日从夜盘开始重新计算">VWAP带</button>
+            <button onclick="togglePivots()" id="pivotToggle" title="在可见范围内标出摆动高低点：价格从极值反转超过设定的跳数时确认">高低点</button>
+            <input type="number" id="pivotTicks" value="10" min="1" style="width: 4em;" onchange="loadPivots()" title="高低点灵敏度：反转超过多少跳确认一个高低点，越小标出的越多">
+            <button onclick="addLevel()" title="为当前合约添加一条价位线（支撑/阻力），实时跟踪时价格穿越会告警；点击线上的标签删除">价位线</button>
+            <button onclick="toggleProfile()" id="profileToggle" title="最近20个交易日同一时段相对开盘的平均涨跌幅 ±1 标准差，叠加在当天的走势上">日内均值带</button>
+            <input type="date" id="ghostDate" onchange="setGhost(this.value)" title="影子线：把所选交易日的走势按时刻对齐到当前交易日，以当天开盘价为基准叠加，清空日期即关闭">
+            <button onclick="toggleExactStats()" id="exactToggle" title="统计默认基于图表上的采样点，开启后另外按可见范围内的全部原始数据计算">精确统计</button>
+            <input type="text" id="overlayInput" placeholder="叠加合约，如 i2509,index:000300" onchange="setOverlays(this.value)">
+            <input type="number" id="yMinInput" class="y-bound" placeholder="纵轴下限" onchange="setYBounds()">
+            <input type="number" id="yMaxInput" class="y-bound" placeholder="纵轴上限" onchange="setYBounds()">
+            <button onclick="toggleScaleLock()" id="scaleLockToggle">锁定纵轴</button>
+            <span class="mode-badge" id="modeBadge">--</span>
+            <span class="mode-badge profile" id="profileBadge" style="display: none;"></span>
+            <span class="mode-badge profile" id="ghostBadge" style="display: none;"></span>
+        </div>
+
+        <div class="parse-warning" id="parseWarning" style="display: none;">
+            <span id="parseWarningText"></span>
+            <a onclick="toggleParseErrors()">（查看详情）</a>
+            <ul id="parseErrorList" style="display: none;"></ul>
+        </div>
+
+        <div id="chartContainer">
+            <canvas id="myChart"></canvas>
+            <div class="event-tooltip" id="eventTooltip"></div>
+        </div>
+
+        <div id="flowContainer">
+            <canvas id="flowChart"></canvas>
+        </div>
+
+        <div class="diagnostics" id="diagnostics" style="display: none;"></div>
+
+        <div class="diagnostics" id="distribution" style="display: none;">
+            <div id="distributionStats"></div>
+            <div class="distribution-chart"><canvas id="distributionChart"></canvas></div>
+        </div>
+
+        <div class="job-progress" id="jobProgress" style="display: none;">
+            <div class="job-progress-track"><div class="job-progress-bar" id="jobProgressBar"></div></div>
+            <span id="jobProgressText"></span>
+            <button onclick="cancelQueryJob()">取消</button>
+        </div>
+
+        <div class="status" id="status">
+            正在加载数据...
+        </div>
+    </div>
+
+    <script>
+        let chart;
+        let chartData = null;
+        // 当前选择的相对时间范围，空字符串表示沿用服务器当前数据
+        let currentRange = '';
+        // 正在运行的异步查询任务，以及查询序号（丢弃已被新查询取代的结果）
+        let currentJobId = null;
+        let querySeq = 0;
+        const JOB_POLL_MS = 500;
+        // 查询任务运行中预览已接收数据时请求的点数
+        const PREVIEW_POINTS = 2000;
+        // 是否请求原始数据（不采样），服务器对点数有上限
+        let rawMode = false;
+        // 绘制的价格序列：price 最新价，mid 买一卖一中间价，spread 以最小变动价位计的买卖价差
+        let currentSeries = 'price';
+        const seriesLabels = { price: '价格', mid: '中间价', spread: '价差 (跳)' };
+
+        // 实时跟踪：通过 /ws 订阅当前symbol，断线后按指数退避自动重连，
+        // 重连时带上最后收到的tick位置，由服务端从ClickHouse补发断线期间的数据
+        const LIVE_MAX_POINTS = 20000;
+        const LIVE_MAX_BACKOFF = 30000;
+        let liveEnabled = false;
+        let liveSocket = null;
+        let liveTimer = null;
+        let liveAttempts = 0;
+        let liveReconnects = 0;
+        let liveUpstreamReconnects = 0;
+        let liveState = '';
+        let liveTarget = null;
+        let liveCursor = null;
+        // 自动跟随：开启时新tick到达后可见窗口保持宽度并移到最右端；
+        // 平移回看历史时自动关闭，可见窗口不再随新数据移动，平移回最右端或点击按钮时重新开启
+        let autoFollow = true;
+        let liveBehind = 0;
+
+        // 事件标注（交割、库存报告、交易所公告等），由 /events 按当前数据的时间范围加载
+        let chartEvents = [];
+        const eventColors = { critical: '#dc3545', high: '#dc3545', warning: '#fd7e14', medium: '#fd7e14', info: '#17a2b8', low: '#6c757d' };
+
+        function eventColor(severity) {
+            return eventColors[String(severity).toLowerCase()] || '#6f42c1';
+        }
+
+        // 事件时间对应的数据点下标：第一个不早于事件时间的点，超出数据范围时返回 -1
+        function eventIndex(time) {
+            const rows = chartData && chartData.data;
+            if (!rows || rows.length === 0 || time < rows[0].time || time > rows[rows.length - 1].time) {
+                return -1;
+            }
+            let lo = 0, hi = rows.length - 1;
+            while (lo < hi) {
+                const mid = (lo + hi) >> 1;
+                if (rows[mid].time < time) lo = mid + 1; else hi = mid;
+            }
+            return lo;
+        }
+
+        // 波动率状态着色：开启时 /data 带上 regimes=1，由服务端计算各状态区间（box 标注），这里只负责绘制
+        let showRegimes = false;
+
+        function regimeParam() {
+            return showRegimes ? '&regimes=1' : '';
+        }
+
+        // 交易时段VWAP带：开启时 /data 带上 vwap=1，服务端按全部原始tick逐交易日累计，返回与主图的点一一对应的VWAP和各带上下沿
+        let showVWAP = false;
+
+        function vwapParam() {
+            return showVWAP ? '&vwap=1' : '';
+        }
+
+        function toggleVWAP() {
+            showVWAP = !showVWAP;
+            document.getElementById('vwapToggle').textContent = showVWAP ? '隐藏VWAP带' : 'VWAP带';
+            saveIndicators();
+            if (!showVWAP) {
+                alignOverlays();
+                applyValueMode();
+                chart.update('none');
+            } else if (zoomWindow) {
+                loadZoomWindow(zoomWindow);
+            } else {
+                refreshData();
+            }
+        }
+
+        // 精确统计：开启时 /data 带上 exact=1，服务端按可见范围内的全部原始数据另算一份统计，与采样统计并列显示
+        let exactStats = false;
+
+        function exactParam() {
+            return exactStats ? '&exact=1' : '';
+        }
+
+        function toggleExactStats() {
+            exactStats = !exactStats;
+            document.getElementById('exactToggle').textContent = exactStats ? '取消精确统计' : '精确统计';
+            saveIndicators();
+            if (zoomWindow) {
+                loadZoomWindow(zoomWindow);
+            } else {
+                refreshData();
+            }
+        }
+
+        // 时间对应的数据点下标，超出数据范围时取两端
+        function clampedIndex(time) {
+            const rows = chartData.data;
+            if (time <= rows[0].time) return 0;
+            if (time >= rows[rows.length - 1].time) return rows.length - 1;
+            return eventIndex(time);
+        }
+
+        const volRegimePlugin = {
+            id: 'volRegimes',
+            beforeDatasetsDraw(chart) {
+                const regimes = showRegimes && chartData && chartData.vol_regimes;
+                if (!regimes || !chartData.data || chartData.data.length === 0) return;
+                const area = chart.chartArea;
+                const ctx = chart.ctx;
+                ctx.save();
+                ctx.beginPath();
+                ctx.rect(area.left, area.top, area.right - area.left, area.bottom - area.top);
+                ctx.clip();
+                regimes.annotations.forEach(box => {
+                    if (box.regime === 'normal') return;
+                    const left = chart.scales.x.getPixelForValue(clampedIndex(box.xMin));
+                    const right = chart.scales.x.getPixelForValue(clampedIndex(box.xMax));
+                    ctx.fillStyle = box.backgroundColor;
+                    ctx.fillRect(left, area.top, Math.max(right - left, 1), area.bottom - area.top);
+                });
+                ctx.restore();
+            }
+        };
+
+        function toggleRegimes() {
+            showRegimes = !showRegimes;
+            document.getElementById('regimeToggle').textContent = showRegimes ? '取消波动率着色' : '波动率着色';
+            saveIndicators();
+            if (!showRegimes) {
+                chart.update('none');
+            } else if (zoomWindow) {
+                loadZoomWindow(zoomWindow);
+            } else {
+                refreshData();
+            }
+        }
+
+        // 在图表上绘制事件竖线，鼠标靠近竖线时显示事件标题
+        const eventMarkerPlugin = {
+            id: 'eventMarkers',
+            afterDatasetsDraw(chart) {
+                const area = chart.chartArea;
+                const ctx = chart.ctx;
+                ctx.save();
+                ctx.lineWidth = 1;
+                ctx.setLineDash([4, 4]);
+                chartEvents.forEach(event => {
+                    event.px = null;
+                    const index = eventIndex(event.time);
+                    if (index < 0) return;
+                    const px = chart.scales.x.getPixelForValue(index);
+                    if (px < area.left || px > area.right) return;
+                    event.px = px;
+                    ctx.strokeStyle = eventColor(event.severity);
+                    ctx.fillStyle = eventColor(event.severity);
+                    ctx.beginPath();
+                    ctx.moveTo(px, area.top);
+                    ctx.lineTo(px, area.bottom);
+                    ctx.stroke();
+                    ctx.beginPath();
+                    ctx.moveTo(px - 5, area.top);
+                    ctx.lineTo(px + 5, area.top);
+                    ctx.lineTo(px, area.top + 7);
+                    ctx.fill();
+                });
+                ctx.restore();
+            },
+            afterEvent(chart, args) {
+                const tooltip = document.getElementById('eventTooltip');
+                const e = args.event;
+                const hits = e.type === 'mousemove' ?
+                    chartEvents.filter(event => event.px !== null && event.px !== undefined && Math.abs(event.px - e.x) <= 4) : [];
+                if (hits.length === 0) {
+                    tooltip.style.display = 'none';
+                    return;
+                }
+                tooltip.innerHTML = '';
+                hits.forEach(event => {
+                    const line = document.createElement('div');
+                    line.textContent = event.time + ' [' + event.severity + '] ' + event.title;
+                    line.style.borderLeft = '3px solid ' + eventColor(event.severity);
+                    line.style.paddingLeft = '6px';
+                    tooltip.appendChild(line);
+                });
+                tooltip.style.left = Math.min(e.x + 12, chart.width - 320) + 'px';
+                tooltip.style.top = (chart.chartArea.top + 10) + 'px';
+                tooltip.style.display = 'block';
+            }
+        };
+
+        // 摆动高低点：/api/v1/pivots 按可见范围内的全部原始tick识别，标签画在对应时刻的价格上，
+        // 未确认的最后一个极值用空心标签
+        let showPivots = false;
+        let chartPivots = [];
+
+        const pivotMarkerPlugin = {
+            id: 'pivotMarkers',
+            afterDatasetsDraw(chart) {
+                if (!showPivots || chartPivots.length === 0 || percentMode || currentSeries === 'spread') return;
+                const area = chart.chartArea;
+                const ctx = chart.ctx;
+                ctx.save();
+                ctx.font = '11px sans-serif';
+                ctx.textAlign = 'center';
+                chartPivots.forEach(pivot => {
+                    const index = eventIndex(pivot.time);
+                    if (index < 0) return;
+                    const px = chart.scales.x.getPixelForValue(index);
+                    const py = chart.scales.y.getPixelForValue(pivot.price);
+                    if (px < area.left || px > area.right || py < area.top || py > area.bottom) return;
+                    const high = pivot.kind === 'high';
+                    const color = high ? '#dc3545' : '#28a745';
+                    const text = (high ? 'H ' : 'L ') + pivot.price;
+                    const y = high ? py - 8 : py + 8;
+                    const width = ctx.measureText(text).width + 8;
+                    ctx.fillStyle = pivot.confirmed ? color : 'white';
+                    ctx.strokeStyle = color;
+                    ctx.fillRect(px - width / 2, high ? y - 14 : y, width, 14);
+                    ctx.strokeRect(px - width / 2, high ? y - 14 : y, width, 14);
+                    ctx.fillStyle = pivot.confirmed ? 'white' : color;
+                    ctx.textBaseline = 'middle';
+                    ctx.fillText(text, px, high ? y - 7 : y + 7);
+                });
+                ctx.restore();
+            }
+        };
+
+        function togglePivots() {
+            showPivots = !showPivots;
+            document.getElementById('pivotToggle').textContent = showPivots ? '隐藏高低点' : '高低点';
+            saveIndicators();
+            if (!showPivots) {
+                chartPivots = [];
+                chart.update('none');
+                return;
+            }
+            loadPivots();
+        }
+
+        // 可见范围：图表自身的缩放/平移优先，否则为当前数据的首尾
+        function loadPivots() {
+            const rows = chartData && chartData.data;
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            if (!showPivots || !rows || rows.length === 0 || !dataset) return;
+            let lo = 0, hi = rows.length - 1;
+            if (chart.isZoomedOrPanned()) {
+                lo = Math.max(0, Math.floor(chart.scales.x.min));
+                hi = Math.min(rows.length - 1, Math.ceil(chart.scales.x.max));
+            }
+            const ticks = parseInt(document.getElementById('pivotTicks').value, 10) || 10;
+            const params = new URLSearchParams({ table: dataset[1], symbol: dataset[2], range: dataset[3],
+                from: rows[lo].time, to: rows[hi].time, ticks: String(ticks) });
+            fetch('/api/v1/pivots?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError('高低点: ' + data.error);
+                        return;
+                    }
+                    chartPivots = data.pivots;
+                    chart.update('none');
+                })
+                .catch(error => console.error('加载高低点失败:', error));
+        }
+
+        // 价位线：按合约保存在服务端（/api/v1/levels），配置文件中的价位线只读；
+        // 画成横跨图表的虚线，右侧标签可点击删除
+        let chartLevels = [];
+        let levelLabelBoxes = [];
+
+        const priceLevelPlugin = {
+            id: 'priceLevels',
+            afterDatasetsDraw(chart) {
+                levelLabelBoxes = [];
+                if (chartLevels.length === 0 || percentMode || currentSeries === 'spread') return;
+                const area = chart.chartArea;
+                const ctx = chart.ctx;
+                ctx.save();
+                ctx.font = '11px sans-serif';
+                ctx.textBaseline = 'middle';
+                chartLevels.forEach(level => {
+                    const py = chart.scales.y.getPixelForValue(level.price);
+                    if (py < area.top || py > area.bottom) return;
+                    ctx.strokeStyle = '#ff8c00';
+                    ctx.setLineDash([6, 4]);
+                    ctx.beginPath();
+                    ctx.moveTo(area.left, py);
+                    ctx.lineTo(area.right, py);
+                    ctx.stroke();
+                    ctx.setLineDash([]);
+                    const text = level.price + (level.label ? ' ' + level.label : '');
+                    const width = ctx.measureText(text).width + 8;
+                    const box = { level: level, left: area.right - width, top: py - 7, width: width, height: 14 };
+                    ctx.fillStyle = '#ff8c00';
+                    ctx.fillRect(box.left, box.top, box.width, box.height);
+                    ctx.fillStyle = 'white';
+                    ctx.fillText(text, box.left + 4, py);
+                    levelLabelBoxes.push(box);
+                });
+                ctx.restore();
+            },
+            afterEvent(chart, args) {
+                const e = args.event;
+                if (e.type !== 'click') return;
+                const box = levelLabelBoxes.find(b => e.x >= b.left && e.x <= b.left + b.width && e.y >= b.top && e.y <= b.top + b.height);
+                if (box) deleteLevel(box.level);
+            }
+        };
+
+        function levelSymbol() {
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            return dataset ? dataset[2] : getCurrentInputs().symbol;
+        }
+
+        function loadLevels() {
+            const symbol = levelSymbol();
+            if (!symbol) return;
+            fetch('/api/v1/levels?symbol=' + encodeURIComponent(symbol))
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError('价位线: ' + data.error);
+                        return;
+                    }
+                    chartLevels = data.levels || [];
+                    chart.update('none');
+                })
+                .catch(error => console.error('加载价位线失败:', error));
+        }
+
+        function changeLevels(method, params) {
+            fetch('/api/v1/levels?' + new URLSearchParams(params).toString(), { method: method })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError('价位线: ' + data.error);
+                        return;
+                    }
+                    chartLevels = data.levels || [];
+                    chart.update('none');
+                })
+                .catch(error => showError('价位线: ' + error.message));
+        }
+
+        function addLevel() {
+            const symbol = levelSymbol();
+            if (!symbol) return;
+            const input = prompt('为 ' + symbol + ' 添加价位线，格式：价格 [说明]');
+            if (!input || !input.trim()) return;
+            const parts = input.trim().split(/\s+/);
+            changeLevels('POST', { symbol: symbol, price: parts[0], label: parts.slice(1).join(' ') });
+        }
+
+        function deleteLevel(level) {
+            if (level.source === 'config') {
+                showError('价位线 ' + level.price + ' 来自配置文件，请在配置文件中删除');
+                return;
+            }
+            if (!confirm('删除价位线 ' + level.price + (level.label ? '（' + level.label + '）' : '') + '？')) return;
+            changeLevels('DELETE', { symbol: levelSymbol(), id: level.id });
+        }
+
+        // 开盘/收盘摘要横幅：盘前显示上一交易日的结算和收盘，交易中显示开盘跳空、当日区间和持仓变化，收盘后补上结算价
+        const summaryPhases = { pre_open: '盘前', open: '交易中', closed: '已收盘' };
+
+        function loadSummary() {
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            const { table, symbol } = dataset ? { table: dataset[1], symbol: dataset[2] } : getCurrentInputs();
+            const banner = document.getElementById('sessionSummary');
+            if (!symbol) return;
+            const params = new URLSearchParams({ symbol });
+            if (table) params.set('table', table);
+            fetch('/summary/data?' + params.toString())
+                .then(response => response.json())
+                .then(summary => {
+                    if (summary.error) {
+                        banner.style.display = 'none';
+                        return;
+                    }
+                    const signed = (value, field) => (value > 0 ? '+' : '') + formatNumber(value, field);
+                    const parts = [summary.symbol.toUpperCase() + ' ' + summary.day + ' ' + summaryPhases[summary.phase]];
+                    if (summary.prev_settle !== null) {
+                        parts.push('前结算 ' + formatNumber(summary.prev_settle, 'price') + '（' + summary.prev_day + '）');
+                    }
+                    if (summary.phase === 'pre_open') {
+                        if (summary.prev_close !== null) parts.push('前收盘 ' + formatNumber(summary.prev_close, 'price'));
+                    } else {
+                        let open = '开盘 ' + formatNumber(summary.open, 'price');
+                        if (summary.gap !== null) {
+                            open += '（跳空 ' + signed(summary.gap, 'price') + '，' + (summary.gap_pct > 0 ? '+' : '') + summary.gap_pct.toFixed(2) + '%）';
+                        }
+                        parts.push(open);
+                        parts.push('区间 ' + formatNumber(summary.low, 'price') + ' - ' + formatNumber(summary.high, 'price'));
+                        parts.push((summary.phase === 'closed' ? '收盘 ' : '最新 ') + formatNumber(summary.last, 'price'));
+                        if (summary.settle !== null) parts.push('结算 ' + formatNumber(summary.settle, 'price'));
+                    }
+                    if (summary.open_interest !== null) {
+                        let oi = '持仓 ' + formatNumber(summary.open_interest, 'oi');
+                        if (summary.oi_change !== null) oi += '（' + signed(summary.oi_change, 'oi') + '）';
+                        parts.push(oi);
+                    }
+                    banner.textContent = parts.join(' · ');
+                    banner.className = 'session-summary ' + summary.phase;
+                    banner.style.display = 'inline-block';
+                })
+                .catch(error => console.error('加载开盘/收盘摘要失败:', error));
+        }
+
+        // 按当前数据的首尾时间加载事件标注
+        // 合约信息：交易所、最后交易日、剩余天数和保证金率，鼠标悬停显示详情；临近最后交易日时提示换月
+        function loadContract() {
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            const symbol = dataset ? dataset[2] : getCurrentInputs().symbol;
+            const warning = document.getElementById('expiryWarning');
+            if (!symbol) return;
+            fetch('/api/v1/contract?symbol=' + encodeURIComponent(symbol))
+                .then(response => response.json())
+                .then(info => {
+                    const stat = document.getElementById('contractStat');
+                    if (info.error) {
+                        document.getElementById('contractExpiry').textContent = '--';
+                        document.getElementById('contractDays').textContent = '';
+                        document.getElementById('contractLabel').textContent = '合约信息';
+                        stat.title = info.error;
+                        warning.style.display = 'none';
+                        return;
+                    }
+                    const margin = info.margin === null ? '未知（未配置合约日历表）' : (info.margin * 100).toFixed(1) + '%';
+                    document.getElementById('contractExpiry').textContent = info.expiry;
+                    document.getElementById('contractDays').textContent = info.expired ? '已到期' : '剩余 ' + info.days_to_expiry + ' 天';
+                    document.getElementById('contractLabel').textContent = info.exchange + ' 最后交易日' + (info.estimated ? '（估算）' : '');
+                    stat.title = info.symbol.toUpperCase() + '\n交易所: ' + (info.exchange_name || info.exchange) +
+                        '\n最后交易日: ' + info.expiry + (info.estimated ? '（按交易所规则估算，未考虑节假日）' : '') +
+                        '\n剩余天数: ' + info.days_to_expiry + '\n保证金率: ' + margin;
+                    if (info.near_expiry || info.expired) {
+                        warning.textContent = '⚠ ' + info.symbol.toUpperCase() + (info.expired
+                            ? ' 已于 ' + info.expiry + ' 到期，图表为历史数据'
+                            : ' 距最后交易日（' + info.expiry + '）仅剩 ' + info.days_to_expiry + ' 天，临近交割流动性下降，请注意换月');
+                        warning.style.display = 'block';
+                    } else {
+                        warning.style.display = 'none';
+                    }
+                })
+                .catch(error => console.error('加载合约信息失败:', error));
+        }
+
+        function loadEvents() {
+            const rows = chartData && chartData.data;
+            if (!rows || rows.length === 0) {
+                chartEvents = [];
+                return;
+            }
+            fetch('/events?from=' + encodeURIComponent(rows[0].time) + '&to=' + encodeURIComponent(rows[rows.length - 1].time))
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        console.error('加载事件失败:', data.error);
+                        return;
+                    }
+                    chartEvents = data.events || [];
+                    chart.update('none');
+                })
+                .catch(error => console.error('加载事件失败:', error));
+        }
+
+        // 按当前序列计算绘图值，没有有效报价时中间价退回最新价，价差记为0。
+        // 最小变动价位未知（tick_size 为0）时用原始价格计算，只消去浮点误差，价差的单位是价格
+        function seriesValues(data) {
+            const tick = (data.stats && data.stats.tick_size) || 0;
+            const tickDecimals = (String(tick).split('.')[1] || '').length;
+            return data.data.map(item => {
+                const quoted = item.bid_1 > 0 && item.ask_1 > 0;
+                if (!tick) {
+                    if (currentSeries === 'mid') {
+                        return quoted ? Number(((item.bid_1 + item.ask_1) / 2).toPrecision(7)) : item.price;
+                    }
+                    if (currentSeries === 'spread') {
+                        return quoted ? Number((item.ask_1 - item.bid_1).toPrecision(7)) : 0;
+                    }
+                    return item.price;
+                }
+                // 先换算成tick数再计算，价差是精确的整数，中间价不带浮点舍入误差
+                const bidTicks = Math.round(item.bid_1 / tick);
+                const askTicks = Math.round(item.ask_1 / tick);
+                if (currentSeries === 'mid') {
+                    return quoted ? Number(((bidTicks + askTicks) * tick / 2).toFixed(tickDecimals + 1)) : item.price;
+                }
+                if (currentSeries === 'spread') {
+                    return quoted ? askTicks - bidTicks : 0;
+                }
+                return item.price;
+            });
+        }
+
+        // 百分比坐标：所有序列换算为相对可见区间第一个有效点的涨跌幅，叠加不同合约或指数时可以直接比较
+        let percentMode = false;
+        // 叠加序列：按输入顺序的 [table:]symbol 列表，以及各自按时间升序的 [{time, price}]
+        let overlaySymbols = [];
+        let overlayRows = {};
+        const overlayColors = ['#6f42c1', '#fd7e14', '#17a2b8', '#e83e8c', '#20c997'];
+        // 日内均值带：/profile/data 返回的各时段均值，按主图每个点的时刻换算成价格，只覆盖目标交易日
+        let profileEnabled = false;
+        let profileData = null;
+        // 影子线：参考交易日（YYYY-MM-DD，空为不显示）和 /ghost/data 返回的平移到当前交易日的走势
+        let ghostDate = '';
+        let ghostData = null;
+
+        // 设置主序列数据，绝对值保存在 dataset.values，绘图值由 applyValueMode 按当前坐标模式生成
+        function setChartSeries(prices, openInterests) {
+            chart.data.datasets[0].values = prices;
+            chart.data.datasets[1].values = openInterests;
+            alignOverlays();
+            applyValueMode();
+        }
+
+        // 叠加序列按主图每个点的时间取不晚于该时间的最后一个价格（as-of 对齐）
+        function alignOverlays() {
+            const rows = (chartData && chartData.data) || [];
+            chart.data.datasets.length = 2;
+            overlaySymbols.forEach((name, i) => {
+                const source = overlayRows[name] || [];
+                const values = new Array(rows.length).fill(null);
+                let j = -1;
+                rows.forEach((row, k) => {
+                    while (j + 1 < source.length && source[j + 1].time <= row.time) j++;
+                    values[k] = j >= 0 ? source[j].price : null;
+                });
+                chart.data.datasets.push({
+                    label: name.toUpperCase(),
+                    values: values,
+                    data: values,
+                    borderColor: overlayColors[i % overlayColors.length],
+                    backgroundColor: 'transparent',
+                    tension: 0.1,
+                    yAxisID: 'yOverlay',
+                    pointRadius: 0,
+                    pointHoverRadius: 4,
+                    borderWidth: 1.5
+                });
+            });
+            // 价差序列的单位是跳，不叠加价格的均值带
+            if (profileEnabled && profileData && currentSeries !== 'spread') {
+                const band = profileValues(rows);
+                const style = { yAxisID: 'y', profile: true, pointRadius: 0, pointHoverRadius: 0, tension: 0, spanGaps: false };
+                chart.data.datasets.push(
+                    Object.assign({ label: '均值带下沿', values: band.lower, data: band.lower, borderColor: 'rgba(111, 66, 193, 0.3)', borderWidth: 1, fill: false }, style),
+                    Object.assign({ label: '均值带上沿', values: band.upper, data: band.upper, borderColor: 'rgba(111, 66, 193, 0.3)', borderWidth: 1,
+                        fill: '-1', backgroundColor: 'rgba(111, 66, 193, 0.12)' }, style),
+                    Object.assign({ label: '日内均值', values: band.mean, data: band.mean, borderColor: '#6f42c1', borderWidth: 1.5,
+                        borderDash: [6, 4], backgroundColor: 'transparent' }, style));
+            }
+            if (ghostData && currentSeries !== 'spread') {
+                const ghost = ghostValues(rows);
+                chart.data.datasets.push({ label: '影子线 ' + ghostData.date, values: ghost, data: ghost, borderColor: 'rgba(108, 117, 125, 0.8)',
+                    backgroundColor: 'transparent', borderWidth: 1.5, borderDash: [4, 3], yAxisID: 'y', profile: true,
+                    pointRadius: 0, pointHoverRadius: 3, tension: 0, spanGaps: false });
+            }
+            // VWAP带由外向内填充，内侧的带颜色叠加更深；实时追加的点还没有VWAP，显示为断点
+            const vwap = showVWAP && chartData && chartData.vwap;
+            if (vwap && currentSeries !== 'spread') {
+                const style = { yAxisID: 'y', profile: true, pointRadius: 0, pointHoverRadius: 0, tension: 0, spanGaps: false };
+                const aligned = values => rows.map((_, k) => values[k] === undefined ? null : values[k]);
+                for (let j = vwap.bands.length - 1; j >= 0; j--) {
+                    const lower = aligned(vwap.lower[j]);
+                    const upper = aligned(vwap.upper[j]);
+                    chart.data.datasets.push(
+                        Object.assign({ label: 'VWAP -' + vwap.bands[j] + 'σ', values: lower, data: lower, borderColor: 'rgba(0, 123, 255, 0.3)', borderWidth: 1, fill: false }, style),
+                        Object.assign({ label: 'VWAP +' + vwap.bands[j] + 'σ', values: upper, data: upper, borderColor: 'rgba(0, 123, 255, 0.3)', borderWidth: 1,
+                            fill: '-1', backgroundColor: 'rgba(0, 123, 255, 0.08)' }, style));
+                }
+                const line = aligned(vwap.vwap);
+                chart.data.datasets.push(Object.assign({ label: 'VWAP', values: line, data: line, borderColor: '#007bff', borderWidth: 1.5,
+                    borderDash: [6, 4], backgroundColor: 'transparent' }, style));
+            }
+        }
+
+        // 时段均值以目标交易日的开盘价为基准换算成价格：均值 ±1 标准差
+        function profileValues(rows) {
+            const slots = {};
+            profileData.slots.forEach(slot => slots[slot.slot] = slot);
+            const step = profileData.slot_minutes;
+            const open = profileData.open;
+            const band = { lower: [], upper: [], mean: [] };
+            rows.forEach(row => {
+                let slot = null;
+                if (open !== null && row.time >= profileData.session_from && row.time < profileData.session_to) {
+                    const minutes = Number(row.time.slice(11, 13)) * 60 + Number(row.time.slice(14, 16));
+                    const start = Math.floor(minutes / step) * step;
+                    slot = slots[String(Math.floor(start / 60)).padStart(2, '0') + ':' + String(start % 60).padStart(2, '0')];
+                }
+                if (!slot || slot.sessions === 0) {
+                    band.lower.push(null);
+                    band.upper.push(null);
+                    band.mean.push(null);
+                    return;
+                }
+                const price = pct => open * (1 + pct / 100);
+                band.lower.push(price(slot.price_mean - slot.price_std));
+                band.upper.push(price(slot.price_mean + slot.price_std));
+                band.mean.push(price(slot.price_mean));
+            });
+            return band;
+        }
+
+        function toggleProfile() {
+            profileEnabled = !profileEnabled;
+            document.getElementById('profileToggle').textContent = profileEnabled ? '隐藏均值带' : '日内均值带';
+            saveIndicators();
+            if (!profileEnabled) {
+                profileData = null;
+                document.getElementById('profileBadge').style.display = 'none';
+                alignOverlays();
+                applyValueMode();
+                chart.update('none');
+                return;
+            }
+            loadProfile();
+        }
+
+        // 按主图最后一个点所在的交易日加载均值带，并对比当天截至最新时段的累计成交量与历史同时段的均值
+        function loadProfile() {
+            const rows = chartData && chartData.data;
+            if (!profileEnabled || !rows || rows.length === 0) return;
+            const { table, symbol } = getCurrentInputs();
+            const params = new URLSearchParams({ symbol: symbol, at: rows[rows.length - 1].time });
+            if (table) params.set('table', table);
+            fetch('/profile/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError('日内均值带: ' + data.error);
+                        return;
+                    }
+                    profileData = data;
+                    const badge = document.getElementById('profileBadge');
+                    badge.style.display = '';
+                    badge.textContent = '均值带 ' + data.day + '（' + data.sessions.length + '个交易日）';
+                    if (data.latest_slot && data.typical_volume > 0) {
+                        const diff = (data.today_volume / data.typical_volume - 1) * 100;
+                        badge.textContent += ' | 截至' + data.latest_slot + '成交 ' + data.today_volume.toLocaleString() +
+                            '，同时段均值 ' + Math.round(data.typical_volume).toLocaleString() + '（' + (diff >= 0 ? '+' : '') + diff.toFixed(1) + '%）';
+                    }
+                    alignOverlays();
+                    applyValueMode();
+                    chart.update('none');
+                })
+                .catch(error => showError('加载日内均值带失败: ' + error.message));
+        }
+
+        // 影子线：把 ghostDate 交易日的走势按时刻对齐到当前交易日，以当天第一笔价格为基准平移后叠加
+        function ghostValues(rows) {
+            const values = new Array(rows.length).fill(null);
+            const source = ghostData.data;
+            const todayOpen = rows.find(row => row.time >= ghostData.session_from && row.price !== null);
+            if (!todayOpen) return values;
+            const shift = todayOpen.price - ghostData.open;
+            let j = -1;
+            rows.forEach((row, k) => {
+                if (row.time < ghostData.session_from || row.time >= ghostData.session_to) return;
+                while (j + 1 < source.length && source[j + 1].time <= row.time) j++;
+                values[k] = j >= 0 ? source[j].price + shift : null;
+            });
+            return values;
+        }
+
+        function setGhost(date) {
+            ghostDate = date;
+            ghostData = null;
+            document.getElementById('ghostBadge').style.display = 'none';
+            alignOverlays();
+            applyValueMode();
+            chart.update('none');
+            loadGhost();
+        }
+
+        // 按主图最后一个点所在的交易日加载参考日的影子线，切换交易日后重新平移
+        function loadGhost() {
+            const rows = chartData && chartData.data;
+            if (!ghostDate || !rows || rows.length === 0) return;
+            const { table, symbol } = getCurrentInputs();
+            const params = new URLSearchParams({ symbol: symbol, date: ghostDate, at: rows[rows.length - 1].time });
+            if (table) params.set('table', table);
+            fetch('/ghost/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError('影子线: ' + data.error);
+                        return;
+                    }
+                    ghostData = data;
+                    const badge = document.getElementById('ghostBadge');
+                    badge.style.display = '';
+                    badge.textContent = '影子线 ' + data.date + ' → ' + data.day + '（参考日开盘 ' + formatNumber(data.open, 'price') +
+                        '，收盘 ' + formatNumber(data.close, 'price') + '）';
+                    alignOverlays();
+                    applyValueMode();
+                    chart.update('none');
+                })
+                .catch(error => showError('加载影子线失败: ' + error.message));
+        }
+
+        function applyValueMode() {
+            const x = chart.scales.x;
+            const start = percentMode && x ? Math.max(0, Math.floor(x.min)) : 0;
+            const baseOf = values => {
+                for (let k = Math.min(start, values.length - 1); k >= 0 && k < values.length; k++) {
+                    if (values[k] !== null && isFinite(values[k]) && values[k] !== 0) {
+                        return values[k];
+                    }
+                }
+                return null;
+            };
+            chart.data.datasets.forEach((dataset, i) => {
+                const values = dataset.values || [];
+                if (i > 0 && !dataset.profile) {
+                    dataset.yAxisID = percentMode ? 'y' : (i === 1 ? 'y1' : 'yOverlay');
+                }
+                if (!percentMode) {
+                    dataset.data = values;
+                    return;
+                }
+                // 均值带与价格共用同一个基准点，否则各自换算后会失去相对位置
+                const base = dataset.profile ? baseOf(chart.data.datasets[0].values || []) : baseOf(values);
+                dataset.data = values.map(v => base === null || v === null ? null : (v / base - 1) * 100);
+            });
+            chart.options.scales.y1.display = !percentMode;
+            chart.options.scales.y.title.text = percentMode ? '涨跌幅 (%)' : seriesLabels[currentSeries];
+            applyYBounds();
+        }
+
+        // 价格纵轴范围：手动输入的上下限优先，其次为锁定时的范围，都没有时自动缩放；百分比坐标下不限制。
+        // 锁定后实时跟踪追加数据时纵轴保持不变，安静的行情不会被放大成剧烈波动
+        let yBounds = { min: null, max: null };
+        let scaleLock = null;
+
+        function applyYBounds() {
+            const y = chart.options.scales.y;
+            y.min = undefined;
+            y.max = undefined;
+            if (percentMode) return;
+            if (scaleLock) {
+                y.min = scaleLock.min;
+                y.max = scaleLock.max;
+            }
+            if (yBounds.min !== null) y.min = yBounds.min;
+            if (yBounds.max !== null) y.max = yBounds.max;
+        }
+
+        function setYBounds() {
+            const parse = id => {
+                const value = document.getElementById(id).value.trim();
+                return value === '' ? null : Number(value);
+            };
+            const min = parse('yMinInput'), max = parse('yMaxInput');
+            if ((min !== null && !isFinite(min)) || (max !== null && !isFinite(max)) || (min !== null && max !== null && min >= max)) {
+                showError('纵轴范围无效：下限必须小于上限');
+                return;
+            }
+            yBounds = { min, max };
+            applyYBounds();
+            chart.update('none');
+        }
+
+        function toggleScaleLock() {
+            scaleLock = scaleLock ? null : { min: chart.scales.y.min, max: chart.scales.y.max };
+            document.getElementById('scaleLockToggle').textContent = scaleLock ? '解锁纵轴' : '锁定纵轴';
+            applyYBounds();
+            chart.update('none');
+        }
+
+        // 缩放或平移后可见区间的起点变了，百分比坐标需要重新取基准点
+        function rebasePercent() {
+            if (!percentMode) return;
+            applyValueMode();
+            chart.update('none');
+        }
+
+        function onViewChanged() {
+            rebasePercent();
+            scheduleZoomFetch();
+            if (liveEnabled) loadPivots();
+        }
+
+        // 缩放不改变自动跟随（下一笔tick到达时按新的宽度贴到最右端），只有平移会开启或关闭
+        function onPanned() {
+            updateFollowFromView();
+            onViewChanged();
+        }
+
+        function togglePercent() {
+            percentMode = !percentMode;
+            document.getElementById('percentToggle').textContent = percentMode ? '价格坐标' : '百分比坐标';
+            saveIndicators();
+            applyValueMode();
+            chart.update('none');
+        }
+
+        function setOverlays(value) {
+            overlaySymbols = value.split(/[,\s]+/).filter(name => name);
+            overlayRows = {};
+            alignOverlays();
+            applyValueMode();
+            chart.update('none');
+            loadOverlays();
+        }
+
+        // 按主图数据的首尾时间加载叠加序列，table 省略时由服务端取合约代码的字母前缀
+        function loadOverlays() {
+            const rows = chartData && chartData.data;
+            if (overlaySymbols.length === 0 || !rows || rows.length === 0) return;
+            const from = rows[0].time, to = rows[rows.length - 1].time;
+            Promise.all(overlaySymbols.map(name => {
+                const parts = name.split(':');
+                const params = new URLSearchParams({ symbol: parts[parts.length - 1], from, to, points: ZOOM_POINTS });
+                if (parts.length > 1) {
+                    params.set('table', parts[0]);
+                }
+                return fetch('/overlay/data?' + params.toString())
+                    .then(response => response.json())
+                    .then(data => {
+                        if (data.error) {
+                            showError(name + ': ' + data.error);
+                            return;
+                        }
+                        overlayRows[name] = data.data;
+                    });
+            }))
+                .then(() => {
+                    alignOverlays();
+                    applyValueMode();
+                    chart.update('none');
+                })
+                .catch(error => showError('加载叠加序列失败: ' + error.message));
+        }
+
+        // 切换价格序列，直接用已加载的数据重绘，并保存到会话
+        function setSeries(series) {
+            currentSeries = series;
+            fetch('/session?series=' + encodeURIComponent(series), { method: 'POST' })
+                .catch(error => console.error('保存会话失败:', error));
+            chart.data.datasets[0].label = seriesLabels[series];
+            chart.options.scales.y.title.text = seriesLabels[series];
+            if (chartData) {
+                chart.data.datasets[0].values = seriesValues(chartData);
+            }
+            applyValueMode();
+            chart.update('none');
+        }
+
+        // 初始化图表
+        function initChart() {
+            // 注册缩放插件，事件标注只画在价格主图上
+            Chart.register(ChartZoom);
+            
+            const ctx = document.getElementById('myChart').getContext('2d');
+            chart = new Chart(ctx, {
+                type: 'line',
+                plugins: [volRegimePlugin, eventMarkerPlugin, pivotMarkerPlugin, priceLevelPlugin],
+                data: {
+                    labels: [],
+                    datasets: [{
+                        label: '价格',
+                        data: [],
+                        borderColor: '#28a745',
+                        backgroundColor: 'rgba(40, 167, 69, 0.1)',
+                        tension: 0.1,
+                        yAxisID: 'y',
+                        pointRadius: 0,
+                        pointHoverRadius: 4,
+                        borderWidth: 2
+                    }, {
+                        label: '持仓量',
+                        data: [],
+                        borderColor: '#dc3545',
+                        backgroundColor: 'rgba(220, 53, 69, 0.1)',
+                        tension: 0.1,
+                        yAxisID: 'y1',
+                        pointRadius: 0,
+                        pointHoverRadius: 4,
+                        borderWidth: 2
+                    }]
+                },
+                options: {
+                    responsive: true,
+                    maintainAspectRatio: false,
+                    interaction: {
+                        mode: 'index',
+                        intersect: false,
+                    },
+                    scales: {
+                        x: {
+                            display: true,
+                            title: {
+                                display: true,
+                                text: '日期时间',
+                                font: {
+                                    size: 14
+                                }
+                            },
+                            ticks: {
+                                font: {
+                                    size: 12
+                                }
+                            }
+                        },
+                        y: {
+                            type: 'linear',
+                            display: true,
+                            position: 'left',
+                            afterFit: fitAxisWidth,
+                            title: {
+                                display: true,
+                                text: '价格',
+                                font: {
+                                    size: 14
+                                }
+                            },
+                            ticks: {
+                                font: {
+                                    size: 12
+                                }
+                            }
+                        },
+                        y1: {
+                            type: 'linear',
+                            display: true,
+                            position: 'right',
+                            afterFit: fitAxisWidth,
+                            title: {
+                                display: true,
+                                text: '持仓量',
+                                font: {
+                                    size: 14
+                                }
+                            },
+                            grid: {
+                                drawOnChartArea: false,
+                            },
+                            ticks: {
+                                font: {
+                                    size: 12
+                                }
+                            }
+                        },
+                        // 价格坐标下叠加序列使用独立的隐藏坐标轴，只比较形状
+                        yOverlay: {
+                            type: 'linear',
+                            display: false
+                        }
+                    },
+                    plugins: {
+                        legend: {
+                            display: true,
+                            position: 'top',
+                            labels: {
+                                font: {
+                                    size: 14
+                                }
+                            }
+                        },
+                        title: {
+                            display: true,
+                            text: 'JM2509 交互式数据图表',
+                            font: {
+                                size: 16
+                            }
+                        },
+                        zoom: {
+                            pan: {
+                                enabled: true,
+                                mode: 'x',
+                                onPan: ({ chart }) => syncXRange(chart, flowChart),
+                                onPanComplete: onPanned
+                            },
+                            zoom: {
+                                wheel: {
+                                    enabled: true,
+                                },
+                                pinch: {
+                                    enabled: true
+                                },
+                                mode: 'x',
+                                onZoom: ({ chart }) => syncXRange(chart, flowChart),
+                                onZoomComplete: onViewChanged
+                            }
+                        }
+                    },
+                    elements: {
+                        point: {
+                            radius: 0
+                        }
+                    }
+                }
+            });
+        }
+
+        // 成交/增仓副图：diff_vol 画成交量柱，diff_oi 画正负持仓变化柱（增仓红、减仓绿），
+        // 与价格主图共用x轴下标，任一图缩放或平移时把可见范围同步到另一图
+        const AXIS_WIDTH = 80;
+        let flowChart;
+        let syncingXRange = false;
+
+        // 两图的y轴固定宽度，保证绘图区左右对齐
+        function fitAxisWidth(scale) {
+            scale.width = AXIS_WIDTH;
+        }
+
+        function syncXRange(source, target) {
+            if (syncingXRange || !source || !target) return;
+            syncingXRange = true;
+            target.zoomScale('x', { min: source.scales.x.min, max: source.scales.x.max }, 'none');
+            syncingXRange = false;
+        }
+
+        function initFlowChart() {
+            const ctx = document.getElementById('flowChart').getContext('2d');
+            flowChart = new Chart(ctx, {
+                type: 'bar',
+                data: {
+                    labels: [],
+                    datasets: [{
+                        label: '成交量',
+                        data: [],
+                        backgroundColor: 'rgba(0, 123, 255, 0.5)',
+                        yAxisID: 'y'
+                    }, {
+                        label: '持仓变化',
+                        data: [],
+                        backgroundColor: [],
+                        yAxisID: 'y1'
+                    }]
+                },
+                options: {
+                    responsive: true,
+                    maintainAspectRatio: false,
+                    animation: false,
+                    interaction: {
+                        mode: 'index',
+                        intersect: false,
+                    },
+                    scales: {
+                        x: {
+                            offset: false,
+                            ticks: {
+                                display: false
+                            }
+                        },
+                        y: {
+                            position: 'left',
+                            afterFit: fitAxisWidth,
+                            beginAtZero: true,
+                            title: {
+                                display: true,
+                                text: '成交量'
+                            }
+                        },
+                        y1: {
+                            position: 'right',
+                            afterFit: fitAxisWidth,
+                            title: {
+                                display: true,
+                                text: '持仓变化'
+                            },
+                            grid: {
+                                drawOnChartArea: false,
+                            }
+                        }
+                    },
+                    plugins: {
+                        legend: {
+                            display: true,
+                            position: 'top'
+                        },
+                        zoom: {
+                            pan: {
+                                enabled: true,
+                                mode: 'x',
+                                onPan: ({ chart: source }) => syncXRange(source, chart),
+                                onPanComplete: onPanned
+                            },
+                            zoom: {
+                                wheel: {
+                                    enabled: true,
+                                },
+                                pinch: {
+                                    enabled: true
+                                },
+                                mode: 'x',
+                                onZoom: ({ chart: source }) => syncXRange(source, chart),
+                                onZoomComplete: onViewChanged
+                            }
+                        }
+                    }
+                }
+            });
+        }
+
+        // 成交量柱的着色方式：sign 统一颜色；oi 按该柱的持仓变化，增仓红、减仓绿，深浅为 |持仓变化|/成交量，
+        // 放量增仓（开仓为主）和放量减仓（平仓为主）一眼可以区分；volume 按成交量相对第95百分位的强度由浅黄到深红
+        let flowColor = 'sign';
+
+        function volumeBarColors(rows) {
+            if (flowColor === 'oi') {
+                return rows.map(item => {
+                    const ratio = item.diff_vol > 0 ? Math.min(1, Math.abs(item.diff_oi) / item.diff_vol) : 0;
+                    const alpha = (0.15 + 0.85 * ratio).toFixed(2);
+                    return item.diff_oi >= 0 ? 'rgba(220, 53, 69, ' + alpha + ')' : 'rgba(40, 167, 69, ' + alpha + ')';
+                });
+            }
+            if (flowColor === 'volume') {
+                // 按第95百分位归一化，个别巨量柱不会把其余柱子都压成最浅的颜色
+                const sorted = rows.map(item => item.diff_vol).filter(v => v > 0).sort((a, b) => a - b);
+                const p95 = sorted.length ? sorted[Math.floor((sorted.length - 1) * 0.95)] : 1;
+                return rows.map(item => {
+                    const t = Math.min(1, Math.max(0, item.diff_vol) / p95);
+                    return 'rgba(' + Math.round(255 - 35 * t) + ', ' + Math.round(220 - 190 * t) + ', ' + Math.round(120 - 80 * t) + ', ' + (0.35 + 0.6 * t).toFixed(2) + ')';
+                });
+            }
+            return 'rgba(0, 123, 255, 0.5)';
+        }
+
+        function setFlowColor(mode) {
+            flowColor = mode;
+            fetch('/session?flow_color=' + encodeURIComponent(mode), { method: 'POST' })
+                .catch(error => console.error('保存会话失败:', error));
+            updateFlowChart();
+        }
+
+        // 主图数据更新后调用，副图沿用主图的标签和可见范围
+        function updateFlowChart() {
+            const rows = (chartData && chartData.data) || [];
+            flowChart.data.labels = chart.data.labels;
+            flowChart.data.datasets[0].data = rows.map(item => item.diff_vol);
+            flowChart.data.datasets[0].backgroundColor = volumeBarColors(rows);
+            flowChart.data.datasets[1].data = rows.map(item => item.diff_oi);
+            flowChart.data.datasets[1].backgroundColor = rows.map(item =>
+                item.diff_oi >= 0 ? 'rgba(220, 53, 69, 0.7)' : 'rgba(40, 167, 69, 0.7)');
+            flowChart.update('none');
+            syncXRange(chart, flowChart);
+        }
+
+        function toggleFlow() {
+            const container = document.getElementById('flowContainer');
+            container.style.display = container.style.display === 'none' ? '' : 'none';
+        }
+
+        // 收益率诊断面板：当前表/symbol/时间范围的收益率自相关和ADF检验，超出95%置信带的自相关系数标红
+        function loadDiagnostics() {
+            const { table, symbol } = getCurrentInputs();
+            if (!symbol) {
+                showError('请输入或选择Symbol代码');
+                return;
+            }
+            const panel = document.getElementById('diagnostics');
+            panel.style.display = 'block';
+            panel.textContent = '正在计算诊断...';
+
+            const params = new URLSearchParams({ table, symbol, range: currentRange || 'all' });
+            fetch('/api/v1/diagnostics?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        panel.textContent = '诊断失败: ' + data.error;
+                        return;
+                    }
+                    const header = document.createElement('div');
+                    header.textContent = data.symbol.toUpperCase() + ' ' + data.bucket + ' 对数收益率，样本 ' +
+                        data.returns.toLocaleString() + ' 个，95%置信带 ±' + data.acf_band.toFixed(4);
+                    const table = document.createElement('table');
+                    const lagRow = table.insertRow();
+                    const acfRow = table.insertRow();
+                    lagRow.insertCell().textContent = '滞后阶数';
+                    acfRow.insertCell().textContent = '自相关';
+                    data.acf.forEach(item => {
+                        lagRow.insertCell().textContent = item.lag;
+                        const td = acfRow.insertCell();
+                        td.textContent = item.acf === null ? '--' : item.acf.toFixed(4);
+                        if (item.acf !== null && Math.abs(item.acf) > data.acf_band) {
+                            td.className = 'significant';
+                        }
+                    });
+                    const adf = document.createElement('div');
+                    adf.textContent = data.adf.statistic === undefined ? 'ADF检验: 样本不足' :
+                        'ADF统计量 (对数价格, 滞后' + data.adf.lags + '阶): ' + data.adf.statistic.toFixed(3) + ' | 临界值 ' +
+                        data.adf.critical.map(cv => cv.level + ' ' + cv.value).join(', ') + ' | ' +
+                        (data.adf.stationary_at ? '在 ' + data.adf.stationary_at + ' 水平拒绝单位根（平稳）' : '不能拒绝单位根（非平稳）');
+                    panel.innerHTML = '';
+                    panel.append(header, table, adf);
+                })
+                .catch(error => {
+                    panel.textContent = '诊断失败: ' + error.message;
+                });
+        }
+
+        // 收益率分布面板：当前表/symbol/时间范围的收益率直方图（基点），叠加同均值同标准差的正态分布
+        let distributionChart = null;
+
+        function loadDistribution() {
+            const { table, symbol } = getCurrentInputs();
+            if (!symbol) {
+                showError('请输入或选择Symbol代码');
+                return;
+            }
+            const panel = document.getElementById('distribution');
+            const stats = document.getElementById('distributionStats');
+            panel.style.display = 'block';
+            stats.textContent = '正在计算收益率分布...';
+
+            const params = new URLSearchParams({ table, symbol, range: currentRange || 'all' });
+            fetch('/api/v1/distribution?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        stats.textContent = '计算失败: ' + data.error;
+                        return;
+                    }
+                    const dist = data.distribution;
+                    const bp = value => (value * 10000).toFixed(2);
+                    stats.textContent = data.symbol.toUpperCase() + ' ' + data.bucket + ' 对数收益率，样本 ' +
+                        dist.count.toLocaleString() + ' 个 | 均值 ' + bp(dist.mean) + 'bp | 标准差 ' + bp(dist.stddev) +
+                        'bp | 偏度 ' + dist.skew.toFixed(3) + ' | 超额峰度 ' + dist.excess_kurtosis.toFixed(3) +
+                        ' | Jarque-Bera ' + dist.jarque_bera.toFixed(1) + ' (p=' + dist.jarque_bera_p.toPrecision(3) + ')' +
+                        (dist.clipped > 0 ? ' | ' + dist.clipped + ' 个超出±6σ的样本计入两端' : '');
+
+                    if (distributionChart) distributionChart.destroy();
+                    distributionChart = new Chart(document.getElementById('distributionChart').getContext('2d'), {
+                        data: {
+                            labels: dist.bins.map(bin => bp((bin.from + bin.to) / 2)),
+                            datasets: [{
+                                type: 'line',
+                                label: '正态分布',
+                                data: dist.bins.map(bin => bin.normal),
+                                borderColor: 'rgb(220, 53, 69)',
+                                borderWidth: 2,
+                                pointRadius: 0
+                            }, {
+                                type: 'bar',
+                                label: '样本数',
+                                data: dist.bins.map(bin => bin.count),
+                                backgroundColor: 'rgba(75, 192, 192, 0.7)',
+                                barPercentage: 1,
+                                categoryPercentage: 1
+                            }]
+                        },
+                        options: {
+                            responsive: true,
+                            maintainAspectRatio: false,
+                            animation: false,
+                            scales: {
+                                x: { title: { display: true, text: '收益率 (bp)' } },
+                                y: { title: { display: true, text: '样本数' }, beginAtZero: true }
+                            },
+                            plugins: {
+                                tooltip: {
+                                    callbacks: {
+                                        title: items => {
+                                            const bin = dist.bins[items[0].dataIndex];
+                                            return bp(bin.from) + ' ~ ' + bp(bin.to) + ' bp';
+                                        },
+                                        label: ctx => ctx.dataset.label + ': ' + (ctx.dataset.type === 'line' ?
+                                            ctx.parsed.y.toFixed(1) : ctx.parsed.y)
+                                    }
+                                }
+                            }
+                        }
+                    });
+                })
+                .catch(error => {
+                    stats.textContent = '计算失败: ' + error.message;
+                });
+        }
+
+        // 更新图表数据
+        function updateChart() {
+            document.getElementById('status').textContent = '正在加载数据...';
+            
+            fetch('/data?raw=' + (rawMode ? '1' : '0') + regimeParam() + vwapParam() + exactParam() +
+                  (currentRange ? '&range=' + encodeURIComponent(currentRange) : ''))
+                .then(response => {
+                    if (!response.ok) {
+                        throw new Error('Network response was not ok');
+                    }
+                    return response.json();
+                })
+                .then(data => {
+                    if (data.empty) {
+                        document.getElementById('status').textContent = '没有数据';
+                        hideErrorBanner();
+                        showEmptyState(data.empty);
+                        return;
+                    }
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        showErrorBanner('数据加载失败: ' + data.error);
+                        return;
+                    }
+                    hideErrorBanner();
+                    hideEmptyState();
+
+                    chartData = data;
+                    zoomWindow = null;
+
+                    // 更新图表数据
+                    const labels = data.data.map(item => {
+                        const date = new Date(item.time);
+                        return date.toLocaleDateString('zh-CN', {
+                            month: '2-digit',
+                            day: '2-digit',
+                            hour: '2-digit',
+                            minute: '2-digit'
+                        });
+                    });
+                    
+                    const prices = seriesValues(data);
+                    const openInterests = data.data.map(item => item.open_interest);
+
+                    chart.data.labels = labels;
+                    setChartSeries(prices, openInterests);
+                    chart.update('none');
+                    updateFlowChart();
+                    loadOverlays();
+                    loadProfile();
+                    loadGhost();
+                    loadPivots();
+                    loadLevels();
+                    loadEvents();
+                    loadContract();
+                    loadSummary();
+
+                    // 更新统计信息
+                    updateStats(data.stats);
+                    
+                    // 更新状态
+                    document.getElementById('status').textContent = 
+                        '数据加载完成 | 最后更新: ' + new Date().toLocaleTimeString() + 
+                        ' | ' + describeMode(data.stats);
+                })
+                .catch(error => {
+                    console.error('Error:', error);
+                    document.getElementById('status').textContent = '数据获取失败: ' + error.message;
+                    showErrorBanner('数据获取失败: ' + error.message);
+                });
+        }
+
+        // 常驻的错误横幅：ClickHouse不可用、表为空等加载失败时显示，服务端不会退出，点击重试重新查询
+        function showErrorBanner(message) {
+            document.getElementById('errorBannerText').textContent = message;
+            document.getElementById('errorBanner').style.display = 'flex';
+        }
+
+        function hideErrorBanner() {
+            document.getElementById('errorBanner').style.display = 'none';
+        }
+
+        function retryLoad() {
+            hideErrorBanner();
+            updateChart();
+        }
+
+        // 查询没有结果时的空状态：说明原因和建议，列出可以改选的表或合约，点击后直接查询；
+        // "选择合约"切换到合约下拉框并加载该表的全部合约
+        function showEmptyState(empty) {
+            document.getElementById('emptyStateMessage').textContent = '没有数据：' + empty.message;
+            const hints = document.getElementById('emptyStateHints');
+            hints.innerHTML = '';
+            empty.hints.forEach(hint => {
+                const item = document.createElement('li');
+                item.textContent = hint;
+                hints.appendChild(item);
+            });
+            const suggestions = document.getElementById('emptyStateSuggestions');
+            suggestions.innerHTML = '';
+            if (empty.suggestions.length > 0) {
+                suggestions.appendChild(document.createTextNode(empty.suggest === 'table' ? '可选的表: ' : '可选的合约: '));
+            }
+            empty.suggestions.forEach(name => {
+                const button = document.createElement('button');
+                button.textContent = name.toUpperCase();
+                button.onclick = () => {
+                    if (empty.suggest === 'table') {
+                        document.getElementById('tableDropdownMode').checked = false;
+                        document.getElementById('tableInput').value = name;
+                        loadSymbols(name);
+                    } else {
+                        document.getElementById('symbolDropdownMode').checked = false;
+                        document.getElementById('symbolInput').value = name;
+                        queryData();
+                    }
+                };
+                suggestions.appendChild(button);
+            });
+            if (empty.suggest === 'symbol') {
+                const picker = document.createElement('button');
+                picker.textContent = '选择合约…';
+                picker.onclick = () => {
+                    const mode = document.getElementById('symbolDropdownMode');
+                    if (!mode.checked) {
+                        mode.click();
+                    }
+                    loadSymbols(empty.table);
+                    document.getElementById('symbolSelect').focus();
+                };
+                suggestions.appendChild(picker);
+            }
+            document.getElementById('emptyState').style.display = 'block';
+        }
+
+        function hideEmptyState() {
+            document.getElementById('emptyState').style.display = 'none';
+        }
+
+        // 更新统计信息
+        // 与服务端 webNumberFormat.Format 相同的数字格式：按字段取小数位，成交量和持仓量换算单位，按区域设置分组
+        const numberFormat = {{NUMBER_FORMAT}};
+
+        function formatNumber(value, field) {
+            if (value === null || value === undefined || !isFinite(value)) return '-';
+            let decimals = numberFormat.decimals[field] || 0;
+            let suffix = '';
+            if (field === 'volume' || field === 'oi') {
+                const unit = (numberFormat.units || []).find(u => Math.abs(value) >= u.scale);
+                if (unit) {
+                    value /= unit.scale;
+                    suffix = unit.suffix;
+                    decimals = 2;
+                }
+            }
+            const [intPart, frac] = Math.abs(value).toFixed(decimals).split('.');
+            return (value < 0 ? '-' : '') + intPart.replace(/\B(?=(\d{3})+(?!\d))/g, numberFormat.group) +
+                (frac ? numberFormat.decimal + frac : '') + suffix;
+        }
+
+        function updateStats(stats) {
+            document.getElementById('avgPrice').textContent = formatNumber(stats.avg_price, 'price');
+            document.getElementById('maxPrice').textContent = formatNumber(stats.max_price, 'price');
+            document.getElementById('minPrice').textContent = formatNumber(stats.min_price, 'price');
+            document.getElementById('avgOI').textContent = formatNumber(stats.avg_oi, 'oi');
+            document.getElementById('dataPoints').textContent = formatNumber(stats.data_points, 'count');
+
+            // 采样或聚合时注明统计来自图表上的点，有精确统计时在每项下方显示
+            const exact = stats.exact;
+            document.getElementById('avgPriceExact').textContent = exact ? '精确 ' + formatNumber(exact.avg_price, 'price') : '';
+            document.getElementById('maxPriceExact').textContent = exact ? '精确 ' + formatNumber(exact.max_price, 'price') : '';
+            document.getElementById('minPriceExact').textContent = exact ? '精确 ' + formatNumber(exact.min_price, 'price') : '';
+            document.getElementById('avgOIExact').textContent = exact ? '精确 ' + formatNumber(exact.avg_oi, 'oi') : '';
+            document.getElementById('dataPointsExact').textContent = exact ? '原始 ' + formatNumber(exact.data_points, 'count') : '';
+            const note = document.getElementById('statsNote');
+            if (stats.sampled) {
+                note.textContent = '以上统计基于图表上的 ' + formatNumber(stats.data_points, 'count') + ' 个采样点（可见范围共 ' +
+                    formatNumber(stats.window_records, 'count') + ' 条原始数据），' +
+                    (exact ? '绿色小字为按全部原始数据计算的精确值' : '可能与原始数据不同，点"精确统计"查看精确值');
+                note.style.display = 'block';
+            } else {
+                note.style.display = 'none';
+            }
+            updateModeBadge(stats);
+        }
+
+        function formatTickLabel(time) {
+            return new Date(time).toLocaleDateString('zh-CN', {
+                month: '2-digit',
+                day: '2-digit',
+                hour: '2-digit',
+                minute: '2-digit'
+            });
+        }
+
+        // 比较两个tick的位置 (time, datetime)
+        function tickAfter(tick, cursor) {
+            if (!cursor) return true;
+            if (tick.time !== cursor.time) return tick.time > cursor.time;
+            return tick.datetime > cursor.datetime;
+        }
+
+        function toggleLive() {
+            if (liveEnabled) {
+                stopLive();
+            } else {
+                startLive();
+            }
+        }
+
+        function startLive() {
+            const { table, symbol } = getCurrentInputs();
+            if (!symbol) {
+                showError('请输入或选择Symbol代码');
+                return;
+            }
+            liveEnabled = true;
+            liveTarget = { table, symbol };
+            liveAttempts = 0;
+            liveReconnects = 0;
+            liveUpstreamReconnects = 0;
+            // 从图表中已有的最后一条数据开始续传，避免和已加载的数据之间出现空档
+            const rows = chartData && chartData.data;
+            if (rows && rows.length > 0 && rows[0].symbol === symbol) {
+                const last = rows[rows.length - 1];
+                liveCursor = { time: last.time, datetime: last.datetime };
+            } else {
+                liveCursor = null;
+            }
+            document.getElementById('liveToggle').textContent = '停止实时';
+            setAutoFollow(true);
+            document.getElementById('followToggle').style.display = '';
+            connectLive();
+        }
+
+        function stopLive() {
+            liveEnabled = false;
+            clearTimeout(liveTimer);
+            if (liveSocket) {
+                liveSocket.close();
+                liveSocket = null;
+            }
+            liveState = '';
+            document.getElementById('liveToggle').textContent = '实时跟踪';
+            document.getElementById('followToggle').style.display = 'none';
+            document.getElementById('status').textContent = '实时跟踪已停止';
+        }
+
+        function connectLive() {
+            const scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            const socket = new WebSocket(scheme + location.host + '/ws');
+            liveSocket = socket;
+            liveState = '连接中';
+            updateLiveStatus();
+
+            socket.onopen = function() {
+                if (liveAttempts > 0) {
+                    liveReconnects++;
+                }
+                liveAttempts = 0;
+                liveState = '已连接';
+                const req = { sub: liveTarget.symbol, table: liveTarget.table };
+                if (liveCursor) {
+                    req.since = liveCursor.time;
+                    req.since_datetime = liveCursor.datetime;
+                }
+                socket.send(JSON.stringify(req));
+                updateLiveStatus();
+            };
+
+            socket.onmessage = function(event) {
+                const msg = JSON.parse(event.data);
+                switch (msg.type) {
+                    case 'snapshot':
+                    case 'backfill':
+                    case 'update':
+                        if (msg.reconnects !== undefined) {
+                            liveUpstreamReconnects = msg.reconnects;
+                        }
+                        if (msg.truncated) {
+                            showError('断线时间过长，仅补发了最近的部分数据');
+                        }
+                        appendLiveTicks(msg.data || []);
+                        break;
+                    case 'status':
+                        liveUpstreamReconnects = msg.reconnects;
+                        liveState = msg.state === 'live' ? '已连接' :
+                            '数据库重连中 (' + Math.round(msg.retry_in) + '秒后重试)';
+                        updateLiveStatus();
+                        break;
+                    case 'alert':
+                        if (msg.incident.kind === 'level') {
+                            showError('价位线告警 ' + msg.incident.time + ': 价格' + (msg.incident.side === 'up' ? '上穿 ' : '下穿 ') +
+                                msg.incident.level + (msg.incident.label ? '（' + msg.incident.label + '）' : '') +
+                                '，快照将保存为 ' + msg.incident.id);
+                            break;
+                        }
+                        showError('盘口失衡告警 ' + msg.incident.time + ': ' +
+                            (msg.incident.side === 'bid' ? '买盘' : '卖盘') + '占优 ' + msg.incident.imbalance.toFixed(2) +
+                            '，连续 ' + msg.incident.ticks + ' 笔，快照将保存为 ' + msg.incident.id);
+                        break;
+                    case 'lagged':
+                        showError('网络较慢，服务端丢弃了 ' + msg.dropped + ' 帧实时数据，图表可能不连续，可停止后重新开始实时跟踪');
+                        break;
+                    case 'error':
+                        showError(msg.error);
+                        break;
+                }
+            };
+
+            socket.onclose = function() {
+                if (!liveEnabled || socket !== liveSocket) {
+                    return;
+                }
+                const delay = Math.min(1000 * Math.pow(2, liveAttempts), LIVE_MAX_BACKOFF);
+                liveAttempts++;
+                liveState = '连接断开，' + Math.round(delay / 1000) + '秒后重连';
+                updateLiveStatus();
+                liveTimer = setTimeout(connectLive, delay);
+            };
+        }
+
+        // 追加实时数据，跳过游标之前的重复tick，图表保留最近 LIVE_MAX_POINTS 个点
+        function appendLiveTicks(ticks) {
+            const fresh = ticks.filter(tick => tickAfter(tick, liveCursor));
+            if (fresh.length > 0) {
+                const last = fresh[fresh.length - 1];
+                liveCursor = { time: last.time, datetime: last.datetime };
+
+                if (!chartData || !chartData.data || chartData.data.length === 0 ||
+                    chartData.data[0].symbol !== liveTarget.symbol) {
+                    chartData = { data: [], stats: (chartData && chartData.stats) || {} };
+                }
+
+                // 记录追加前的可见范围（按数据下标），未缩放时图表始终显示全部数据，无需调整
+                const zoomed = chart.isZoomedOrPanned();
+                const prevMin = chart.scales.x.min;
+                const prevMax = chart.scales.x.max;
+
+                chartData.data = chartData.data.concat(fresh);
+                let dropped = 0;
+                if (chartData.data.length > LIVE_MAX_POINTS) {
+                    dropped = chartData.data.length - LIVE_MAX_POINTS;
+                    chartData.data = chartData.data.slice(dropped);
+                }
+
+                chart.data.labels = chartData.data.map(item => formatTickLabel(item.time));
+                setChartSeries(seriesValues(chartData), chartData.data.map(item => item.open_interest));
+                chart.update('none');
+                updateFlowChart();
+
+                if (zoomed) {
+                    const last = chartData.data.length - 1;
+                    if (autoFollow) {
+                        chart.zoomScale('x', { min: last - (prevMax - prevMin), max: last }, 'none');
+                    } else {
+                        // 丢弃最早的数据后下标整体前移，保持看到的仍是同一段tick
+                        chart.zoomScale('x', { min: Math.max(0, prevMin - dropped), max: Math.max(0, prevMax - dropped) }, 'none');
+                    }
+                    syncXRange(chart, flowChart);
+                }
+                if (!autoFollow) {
+                    liveBehind += fresh.length;
+                }
+            }
+            updateLiveStatus();
+        }
+
+        function updateLiveStatus() {
+            if (!liveEnabled) return;
+            document.getElementById('status').textContent =
+                '实时: ' + liveTarget.symbol.toUpperCase() + ' ' + liveState +
+                ' | 连接重连: ' + liveReconnects + ' 次 | 数据库重连: ' + liveUpstreamReconnects + ' 次' +
+                ' | 最新tick: ' + (liveCursor ? liveCursor.time : '--') +
+                (autoFollow ? '' : ' | 自动跟随已关闭，新增 ' + liveBehind + ' 笔');
+        }
+
+        function setAutoFollow(on) {
+            autoFollow = on;
+            if (on) {
+                liveBehind = 0;
+            }
+            document.getElementById('followToggle').textContent = '自动跟随: ' + (on ? '开' : '关');
+            updateLiveStatus();
+        }
+
+        // 手动开启时立即把可见窗口移到最右端
+        function toggleFollow() {
+            setAutoFollow(!autoFollow);
+            if (autoFollow && chart.isZoomedOrPanned() && chartData && chartData.data) {
+                const last = chartData.data.length - 1;
+                const width = chart.scales.x.max - chart.scales.x.min;
+                chart.zoomScale('x', { min: last - width, max: last }, 'none');
+                syncXRange(chart, flowChart);
+            }
+        }
+
+        // 实时模式下平移/缩放结束后，按可见窗口是否到达最右端决定是否自动跟随
+        function updateFollowFromView() {
+            if (!liveEnabled || !chartData || !chartData.data) return;
+            const atRightEdge = chart.scales.x.max >= chartData.data.length - 1;
+            if (atRightEdge !== autoFollow) {
+                setAutoFollow(atRightEdge);
+            }
+        }
+
+        // 当前显示模式和数据点数的说明，缓存过期时附加后台更新提示
+        function describeMode(stats) {
+            const mode = describeSampling(stats);
+            return stats.stale ? mode + ' | 缓存数据，后台更新中' : mode;
+        }
+
+        function describeSampling(stats) {
+            const shown = stats.data_points.toLocaleString();
+            const total = stats.total_records.toLocaleString();
+            if (stats.mode === 'zoom') {
+                return '缩放窗口 ' + (stats.level === 'raw' ? '原始数据' : stats.level + ' 聚合') + ' ' + shown + ' 点';
+            }
+            if (stats.mode === 'raw') {
+                return '原始数据 ' + shown + ' 点';
+            }
+            if (stats.mode === 'capped') {
+                return '原始数据超过上限 ' + stats.max_raw_points.toLocaleString() + ' 点，已采样为 ' + shown + ' / ' + total + ' 点';
+            }
+            return '采样显示 ' + shown + ' / ' + total + ' 点';
+        }
+
+        function updateModeBadge(stats) {
+            const badge = document.getElementById('modeBadge');
+            badge.className = 'mode-badge ' + stats.mode;
+            badge.textContent = describeMode(stats);
+            updateParseWarning(stats.skipped_rows || 0);
+        }
+
+        // 解析时跳过的行数提示，明细从 /api/v1/parse-errors 按错误类型加载
+        function updateParseWarning(skipped) {
+            const warning = document.getElementById('parseWarning');
+            if (skipped === 0) {
+                warning.style.display = 'none';
+                return;
+            }
+            document.getElementById('parseWarningText').textContent =
+                '已跳过 ' + skipped.toLocaleString() + ' 行无法解析的数据';
+            warning.style.display = 'block';
+            if (document.getElementById('parseErrorList').style.display !== 'none') {
+                loadParseErrors();
+            }
+        }
+
+        function toggleParseErrors() {
+            const list = document.getElementById('parseErrorList');
+            if (list.style.display === 'none') {
+                list.style.display = 'block';
+                loadParseErrors();
+            } else {
+                list.style.display = 'none';
+            }
+        }
+
+        function loadParseErrors() {
+            fetch('/api/v1/parse-errors')
+                .then(response => response.json())
+                .then(result => {
+                    const list = document.getElementById('parseErrorList');
+                    list.innerHTML = '';
+                    result.by_type.forEach(entry => {
+                        const item = document.createElement('li');
+                        item.textContent = entry.description + ': ' + entry.count.toLocaleString() +
+                            ' 行，最近 ' + entry.last_seen + '，' + entry.last_error + ' ';
+                        const sample = document.createElement('code');
+                        sample.textContent = entry.sample;
+                        item.appendChild(sample);
+                        list.appendChild(item);
+                    });
+                })
+                .catch(error => console.error('Error:', error));
+        }
+
+        // 切换采样/原始数据并重新加载
+        function toggleRaw() {
+            rawMode = !rawMode;
+            document.getElementById('rawToggle').textContent = rawMode ? '显示采样数据' : '显示原始数据';
+            refreshData();
+        }
+
+        // 缩放窗口：缩放或平移结束后按可见范围向服务端请求预聚合金字塔中合适层级的数据，
+        // 替换图表数据后复位图表自身的缩放；zoomWindow 为空表示显示完整数据
+        const ZOOM_POINTS = 2000;
+        let zoomWindow = null;
+        let zoomTimer = null;
+        let applyingZoomWindow = false;
+
+        function scheduleZoomFetch() {
+            if (applyingZoomWindow || liveEnabled || !chartData || !chartData.data) return;
+            clearTimeout(zoomTimer);
+            zoomTimer = setTimeout(() => {
+                const rows = chartData.data;
+                const x = chart.scales.x;
+                const lo = Math.max(0, Math.floor(x.min));
+                const hi = Math.min(rows.length - 1, Math.ceil(x.max));
+                if (hi <= lo) return;
+                loadZoomWindow({ from: rows[lo].time, to: rows[hi].time });
+            }, 300);
+        }
+
+        function pad2(n) {
+            return String(n).padStart(2, '0');
+        }
+
+        function formatWallTime(date) {
+            return date.getFullYear() + '-' + pad2(date.getMonth() + 1) + '-' + pad2(date.getDate()) + ' ' +
+                pad2(date.getHours()) + ':' + pad2(date.getMinutes()) + ':' + pad2(date.getSeconds());
+        }
+
+        // 加载指定窗口的数据，win 为空时恢复完整数据
+        function loadZoomWindow(win) {
+            let url = '/data?raw=' + (rawMode ? '1' : '0') + regimeParam() + vwapParam() + exactParam();
+            if (win) {
+                url += '&from=' + encodeURIComponent(win.from) + '&to=' + encodeURIComponent(win.to) + '&points=' + ZOOM_POINTS;
+            }
+            fetch(url)
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        showError(data.error);
+                        return;
+                    }
+                    zoomWindow = win;
+                    chartData = data;
+                    chart.data.labels = data.data.map(item => formatTickLabel(item.time));
+                    setChartSeries(seriesValues(data), data.data.map(item => item.open_interest));
+                    applyingZoomWindow = true;
+                    chart.resetZoom('none');
+                    flowChart.resetZoom('none');
+                    updateFlowChart();
+                    applyingZoomWindow = false;
+                    applyValueMode();
+                    chart.update('none');
+                    loadOverlays();
+                    loadProfile();
+                    loadGhost();
+                    loadPivots();
+                    loadLevels();
+                    updateStats(data.stats);
+                    document.getElementById('status').textContent = (win ? '缩放窗口 ' + win.from + ' ~ ' + win.to : '完整数据') +
+                        ' | ' + describeMode(data.stats);
+                })
+                .catch(error => showError('加载缩放窗口失败: ' + error.message));
+        }
+
+        // 缩放功能
+        function zoomIn() {
+            chart.zoom(1.2);
+            syncXRange(chart, flowChart);
+            onViewChanged();
+        }
+
+        // 已在缩放窗口中时以窗口中心为基准把范围扩大一倍，由服务端换用更粗的层级
+        function zoomOut() {
+            if (!zoomWindow) {
+                chart.zoom(0.8);
+                syncXRange(chart, flowChart);
+                rebasePercent();
+                return;
+            }
+            const from = new Date(zoomWindow.from.replace(' ', 'T'));
+            const to = new Date(zoomWindow.to.replace(' ', 'T'));
+            const half = (to - from) / 2;
+            loadZoomWindow({ from: formatWallTime(new Date(from - half)), to: formatWallTime(new Date(to.getTime() + half)) });
+        }
+
+        function resetZoom() {
+            if (zoomWindow) {
+                loadZoomWindow(null);
+                return;
+            }
+            chart.resetZoom();
+            flowChart.resetZoom();
+            // 缩放插件复位时会恢复所有坐标轴最初的范围设置，需要重新应用纵轴上下限
+            applyValueMode();
+            chart.update('none');
+        }
+
+        // 切换数据显示
+        function togglePrice() {
+            const dataset = chart.data.datasets[0];
+            dataset.hidden = !dataset.hidden;
+            chart.update();
+        }
+
+        function toggleOI() {
+            const dataset = chart.data.datasets[1];
+            dataset.hidden = !dataset.hidden;
+            chart.update();
+        }
+
+        // 显示错误消息
+        function showError(message) {
+            const errorDiv = document.getElementById('errorMessage');
+            errorDiv.textContent = message;
+            errorDiv.style.display = 'block';
+            errorDiv.className = 'error-message';
+            setTimeout(() => {
+                errorDiv.style.display = 'none';
+            }, 5000);
+        }
+
+        // 显示成功消息
+        function showSuccess(message) {
+            const errorDiv = document.getElementById('errorMessage');
+            errorDiv.textContent = message;
+            errorDiv.style.display = 'block';
+            errorDiv.className = 'success-message';
+            setTimeout(() => {
+                errorDiv.style.display = 'none';
+            }, 3000);
+        }
+
+        // 加载所有表
+        function loadTables() {
+            fetch('/tables')
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        console.error('加载表失败:', data.error);
+                        return;
+                    }
+                    
+                    // 更新下拉框
+                    const tableSelect = document.getElementById('tableSelect');
+                    tableSelect.innerHTML = '<option value="">请选择数据表</option>';
+                    
+                    // 更新datalist
+                    const tableList = document.getElementById('tableList');
+                    tableList.innerHTML = '';
+                    
+                    data.tables.forEach(table => {
+                        // 下拉框选项
+                        const option = document.createElement('option');
+                        option.value = table;
+                        option.textContent = table.toUpperCase();
+                        tableSelect.appendChild(option);
+                        
+                        // datalist选项
+                        const dataOption = document.createElement('option');
+                        dataOption.value = table;
+                        tableList.appendChild(dataOption);
+                    });
+                })
+                .catch(error => {
+                    console.error('加载表失败:', error);
+                    showError('加载表列表失败: ' + error.message);
+                });
+        }
+        
+        // 加载指定表的symbols
+        function loadSymbols(table) {
+            if (!table) {
+                const symbolSelect = document.getElementById('symbolSelect');
+                symbolSelect.innerHTML = '<option value="">请先选择数据表</option>';
+                const symbolList = document.getElementById('symbolList');
+                symbolList.innerHTML = '';
+                return;
+            }
+            
+            const symbolSelect = document.getElementById('symbolSelect');
+            symbolSelect.innerHTML = '<option value="">正在加载...</option>';
+            loadColumnHints(table);
+            
+            fetch('/symbols?table=' + encodeURIComponent(table))
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        symbolSelect.innerHTML = '<option value="">加载失败</option>';
+                        console.error('加载symbols失败:', data.error);
+                        showError('加载symbols失败: ' + data.error);
+                        return;
+                    }
+                    
+                    // 更新下拉框
+                    symbolSelect.innerHTML = '<option value="">请选择Symbol</option>';
+                    
+                    // 更新datalist
+                    const symbolList = document.getElementById('symbolList');
+                    symbolList.innerHTML = '';
+                    
+                    data.symbols.forEach(symbol => {
+                        // 下拉框选项
+                        const option = document.createElement('option');
+                        option.value = symbol;
+                        option.textContent = symbol;
+                        symbolSelect.appendChild(option);
+                        
+                        // datalist选项
+                        const dataOption = document.createElement('option');
+                        dataOption.value = symbol;
+                        if (data.labels && data.labels[symbol]) {
+                            dataOption.label = data.labels[symbol];
+                        }
+                        symbolList.appendChild(dataOption);
+                    });
+                })
+                .catch(error => {
+                    symbolSelect.innerHTML = '<option value="">加载失败</option>';
+                    console.error('加载symbols失败:', error);
+                    showError('加载symbols失败: ' + error.message);
+                });
+        }
+
+        // 按列统计禁用当前表画不出来的序列：买一卖一全为空或恒定时中间价和价差没有意义
+        const seriesColumns = { price: ['price'], mid: ['bid_1', 'ask_1'], spread: ['bid_1', 'ask_1'] };
+        function loadColumnHints(table) {
+            fetch('/api/v1/describe?table=' + encodeURIComponent(table))
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        console.error('加载列统计失败:', data.error);
+                        return;
+                    }
+                    const plottable = new Set(data.columns.filter(col => col.plottable).map(col => col.name));
+                    const select = document.getElementById('seriesSelect');
+                    Array.from(select.options).forEach(option => {
+                        const ok = seriesColumns[option.value].every(name => plottable.has(name));
+                        option.disabled = !ok;
+                        option.title = ok ? '' : '该表的 ' + seriesColumns[option.value].join('/') + ' 列没有可画的数据';
+                    });
+                    if (select.selectedOptions[0] && select.selectedOptions[0].disabled) {
+                        select.value = 'price';
+                        setSeries('price');
+                    }
+                })
+                .catch(error => console.error('加载列统计失败:', error));
+        }
+
+        // 输入symbol时由服务端按代码、中文名或拼音模糊过滤，只刷新datalist
+        let symbolFilterTimer = null;
+        function filterSymbolList() {
+            clearTimeout(symbolFilterTimer);
+            symbolFilterTimer = setTimeout(() => {
+                const table = document.getElementById('tableInput').value.trim();
+                const q = document.getElementById('symbolInput').value.trim();
+                if (!table) {
+                    return;
+                }
+
+                fetch('/symbols?table=' + encodeURIComponent(table) + '&q=' + encodeURIComponent(q) + '&limit=50')
+                    .then(response => response.json())
+                    .then(data => {
+                        if (data.error) {
+                            return;
+                        }
+                        const symbolList = document.getElementById('symbolList');
+                        symbolList.innerHTML = '';
+                        data.symbols.forEach(symbol => {
+                            const dataOption = document.createElement('option');
+                            dataOption.value = symbol;
+                            if (data.labels && data.labels[symbol]) {
+                                dataOption.label = data.labels[symbol];
+                            }
+                            symbolList.appendChild(dataOption);
+                        });
+                    })
+                    .catch(error => console.error('过滤symbols失败:', error));
+            }, 250);
+        }
+
+        // 获取当前输入的表名和symbol
+        function getCurrentInputs() {
+            const tableDropdownMode = document.getElementById('tableDropdownMode').checked;
+            const symbolDropdownMode = document.getElementById('symbolDropdownMode').checked;
+            
+            const table = tableDropdownMode ? 
+                document.getElementById('tableSelect').value : 
+                document.getElementById('tableInput').value.trim();
+                
+            const symbol = symbolDropdownMode ? 
+                document.getElementById('symbolSelect').value : 
+                document.getElementById('symbolInput').value.trim();
+                
+            return { table, symbol };
+        }
+
+        // 查询数据
+        function queryData() {
+            const { table, symbol } = getCurrentInputs();
+            
+            if (!table) {
+                showError('请输入或选择数据表名');
+                return;
+            }
+            
+            if (!symbol) {
+                showError('请输入或选择Symbol代码');
+                return;
+            }
+            
+            document.getElementById('status').textContent = '正在查询数据...';
+            
+            // 更新图表标题
+            chart.options.plugins.title.text = symbol.toUpperCase() + ' 交互式数据图表';
+            chart.update('none');
+            
+            // 先由异步查询任务在后台查询并显示进度，完成后从 /data?job= 取回结果
+            const range = currentRange || 'all';
+            const seq = ++querySeq;
+            runQueryJob(table, symbol, range, preview => {
+                if (seq === querySeq) renderPreview(preview, table, symbol);
+            })
+                .then(jobId => fetch('/data?table=' + encodeURIComponent(table) + '&symbol=' + encodeURIComponent(symbol) +
+                  '&range=' + encodeURIComponent(range) + '&job=' + jobId + '&raw=' + (rawMode ? '1' : '0') + regimeParam() + vwapParam() + exactParam()))
+                .then(response => {
+                    if (!response.ok) {
+                        throw new Error('Network response was not ok');
+                    }
+                    return response.json();
+                })
+                .then(data => {
+                    if (seq !== querySeq) return;
+                    if (data.empty) {
+                        showEmptyState(data.empty);
+                        document.getElementById('status').textContent = '没有数据';
+                        return;
+                    }
+                    if (data.error) {
+                        showError(data.error);
+                        document.getElementById('status').textContent = '查询失败';
+                        return;
+                    }
+                    hideEmptyState();
+
+                    chartData = data;
+                    zoomWindow = null;
+
+                    // 更新图表数据
+                    const labels = data.data.map(item => {
+                        const date = new Date(item.time);
+                        return date.toLocaleDateString('zh-CN', {
+                            month: '2-digit',
+                            day: '2-digit',
+                            hour: '2-digit',
+                            minute: '2-digit'
+                        });
+                    });
+                    
+                    const prices = seriesValues(data);
+                    const openInterests = data.data.map(item => item.open_interest);
+
+                    chart.data.labels = labels;
+                    setChartSeries(prices, openInterests);
+                    chart.update('none');
+                    updateFlowChart();
+                    loadOverlays();
+                    loadProfile();
+                    loadGhost();
+                    loadPivots();
+                    loadLevels();
+                    loadEvents();
+                    loadContract();
+                    loadSummary();
+
+                    // 更新统计信息
+                    updateStats(data.stats);
+                    
+                    // 显示成功消息
+                    showSuccess('数据查询成功！');
+                    
+                    // 更新状态
+                    document.getElementById('status').textContent = 
+                        '数据查询完成 | 表: ' + table.toUpperCase() + ' | Symbol: ' + symbol.toUpperCase() +
+                        ' | 范围: ' + (currentRange || 'all') + ' | 最后更新: ' + new Date().toLocaleTimeString() + 
+                        ' | ' + describeMode(data.stats);
+                })
+                .catch(error => {
+                    if (seq !== querySeq) return;
+                    if (error.empty) {
+                        showEmptyState(error.empty);
+                        document.getElementById('status').textContent = '没有数据';
+                        return;
+                    }
+                    console.error('Error:', error);
+                    showError('数据查询失败: ' + error.message);
+                    document.getElementById('status').textContent = '查询失败';
+                });
+        }
+
+        // 创建异步查询任务并轮询进度直到完成，返回任务ID。新的查询开始时取消上一个尚未完成的任务。
+        // 传入 onPartial 时，每当接收到新的数据就取回已解析部分的预览交给它先画出来
+        function runQueryJob(table, symbol, range, onPartial) {
+            const params = new URLSearchParams({ table: table, symbol: symbol, range: range });
+            let previewRows = 0;
+            // range=all 的数据量过大时服务端要求确认，确认后带 confirm=1 重新创建任务
+            const create = () => fetch('/api/v1/jobs?' + params.toString(), { method: 'POST' })
+                .then(response => response.json())
+                .then(job => {
+                    if (job.estimate && job.estimate.needs_confirm && !params.has('confirm')) {
+                        const size = job.estimate.rows.toLocaleString() + ' 行、约 ' + (job.estimate.bytes / 1048576).toFixed(1) + ' MB';
+                        if (!confirm('预计加载 ' + size + '，确定继续吗？')) return { error: '已取消加载' };
+                        params.set('confirm', '1');
+                        return create();
+                    }
+                    return job;
+                });
+            return cancelQueryJob()
+                .then(create)
+                .then(job => new Promise((resolve, reject) => {
+                    const poll = job => {
+                        if (!job.id) {
+                            hideJobProgress();
+                            reject(new Error(job.error || '创建查询任务失败'));
+                            return;
+                        }
+                        if (job.state === 'done') {
+                            if (currentJobId === job.id) currentJobId = null;
+                            hideJobProgress();
+                            resolve(job.id);
+                            return;
+                        }
+                        if (job.state !== 'running') {
+                            if (currentJobId === job.id) currentJobId = null;
+                            hideJobProgress();
+                            const error = new Error(job.error || '查询任务已结束');
+                            error.empty = job.empty;
+                            reject(error);
+                            return;
+                        }
+                        currentJobId = job.id;
+                        showJobProgress(job);
+                        const next = () => setTimeout(() => {
+                            fetch('/api/v1/jobs/' + job.id)
+                                .then(response => response.json())
+                                .then(poll)
+                                .catch(error => {
+                                    hideJobProgress();
+                                    reject(error);
+                                });
+                        }, JOB_POLL_MS);
+                        if (!onPartial || job.rows_received <= previewRows) {
+                            next();
+                            return;
+                        }
+                        // 预览失败不影响查询本身，继续轮询
+                        previewRows = job.rows_received;
+                        fetch('/api/v1/jobs/' + job.id + '/partial?points=' + PREVIEW_POINTS)
+                            .then(response => response.json())
+                            .then(preview => {
+                                if (preview.partial && preview.data && preview.data.length >= 2) onPartial(preview);
+                            })
+                            .catch(() => {})
+                            .then(next);
+                    };
+                    poll(job);
+                }));
+        }
+
+        // 查询任务运行中先画出已接收的部分，完成后由完整结果替换（统计、叠加和副图等到那时再更新）
+        function renderPreview(preview, table, symbol) {
+            hideEmptyState();
+            chartData = preview;
+            zoomWindow = null;
+            chart.data.labels = preview.data.map(item => {
+                const date = new Date(item.time);
+                return date.toLocaleDateString('zh-CN', {
+                    month: '2-digit',
+                    day: '2-digit',
+                    hour: '2-digit',
+                    minute: '2-digit'
+                });
+            });
+            chart.data.datasets.length = 2;
+            chart.data.datasets[0].values = seriesValues(preview);
+            chart.data.datasets[1].values = preview.data.map(item => item.open_interest);
+            applyValueMode();
+            chart.update('none');
+
+            const badge = document.getElementById('modeBadge');
+            badge.className = 'mode-badge sampled';
+            badge.textContent = '预览 ' + preview.data.length.toLocaleString() + ' 点 / 已接收 ' + preview.rows.toLocaleString() + ' 行';
+            document.getElementById('status').textContent =
+                '正在加载 | 表: ' + table.toUpperCase() + ' | Symbol: ' + symbol.toUpperCase() +
+                ' | 已显示到 ' + preview.data[preview.data.length - 1].time;
+        }
+
+        function cancelQueryJob() {
+            const id = currentJobId;
+            currentJobId = null;
+            hideJobProgress();
+            if (!id) return Promise.resolve();
+            return fetch('/api/v1/jobs/' + id, { method: 'DELETE' }).catch(() => {});
+        }
+
+        function showJobProgress(job) {
+            const percent = Math.round(job.progress * 100);
+            document.getElementById('jobProgress').style.display = 'flex';
+            document.getElementById('jobProgressBar').style.width = percent + '%';
+            let text = '查询中 ' + percent + '%';
+            if (job.total_rows > 0) {
+                text += ' | 已扫描 ' + job.rows_read.toLocaleString() + ' / ' + job.total_rows.toLocaleString() + ' 行';
+            }
+            if (job.rows_received > 0) {
+                text += ' | 已接收 ' + job.rows_received.toLocaleString() + ' 行';
+            }
+            text += ' | ' + (job.elapsed_ms / 1000).toFixed(1) + ' 秒';
+            document.getElementById('jobProgressText').textContent = text;
+        }
+
+        function hideJobProgress() {
+            document.getElementById('jobProgress').style.display = 'none';
+        }
+
+        // 导出当前查询范围的完整分辨率数据 (Arrow IPC流)；先预估行数和大小，过大时需要确认，超过上限时不导出
+        function exportArrow() {
+            const { table, symbol } = getCurrentInputs();
+            const params = new URLSearchParams();
+            if (table && symbol) {
+                params.set('table', table);
+                params.set('symbol', symbol);
+                params.set('range', currentRange || 'all');
+            }
+            fetch('/api/v1/export/estimate?' + params.toString())
+                .then(response => response.json())
+                .then(estimate => {
+                    if (estimate.error) {
+                        showError('导出: ' + estimate.error);
+                        return;
+                    }
+                    const size = estimate.rows.toLocaleString() + ' 行、约 ' + (estimate.bytes / 1048576).toFixed(1) + ' MB';
+                    if (estimate.too_large) {
+                        showError('预计导出 ' + size + '，超过上限 ' + (estimate.max_bytes / 1048576).toFixed(1) + ' MB，请缩小时间范围');
+                        return;
+                    }
+                    if (estimate.needs_confirm) {
+                        if (!confirm('预计导出 ' + size + '，确定继续吗？')) return;
+                        params.set('confirm', '1');
+                    }
+                    const query = params.toString();
+                    window.location.href = '/export.arrow' + (query ? '?' + query : '');
+                })
+                .catch(error => showError('导出: ' + error.message));
+        }
+
+        function openDom() {
+            const { table, symbol } = getCurrentInputs();
+            window.open('/dom?table=' + encodeURIComponent(table || '') + '&symbol=' + encodeURIComponent(symbol || ''));
+        }
+
+        // 下载服务端按当前状态渲染的PNG：数据集、序列、可见窗口、纵轴范围和隐藏的曲线都作为参数传给 /download/chart.png
+        function downloadSnapshot() {
+            const params = new URLSearchParams();
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            if (dataset) {
+                params.set('table', dataset[1]);
+                params.set('symbol', dataset[2]);
+                params.set('range', dataset[3]);
+            }
+            params.set('series', currentSeries);
+            if (rawMode) params.set('raw', '1');
+            if (showRegimes) params.set('regimes', '1');
+            if (showVWAP) params.set('vwap', '1');
+
+            // 可见窗口：图表自身的缩放/平移优先，其次为服务端返回的缩放窗口
+            const rows = chartData && chartData.data;
+            if (rows && rows.length > 1 && chart.isZoomedOrPanned()) {
+                const lo = Math.max(0, Math.floor(chart.scales.x.min));
+                const hi = Math.min(rows.length - 1, Math.ceil(chart.scales.x.max));
+                params.set('from', rows[lo].time);
+                params.set('to', rows[hi].time);
+                params.set('points', String(hi - lo + 1));
+            } else if (zoomWindow) {
+                params.set('from', zoomWindow.from);
+                params.set('to', zoomWindow.to);
+                params.set('points', String(ZOOM_POINTS));
+            }
+
+            // 手动设置或锁定了纵轴范围时按当前显示的范围渲染，否则由服务端自动缩放
+            if (!percentMode && (scaleLock || yBounds.min !== null || yBounds.max !== null)) {
+                params.set('y_min', String(chart.scales.y.min));
+                params.set('y_max', String(chart.scales.y.max));
+            }
+            const hidden = [];
+            if (!chart.isDatasetVisible(0)) hidden.push('price');
+            if (!chart.isDatasetVisible(1)) hidden.push('oi');
+            if (hidden.length > 0) params.set('hide', hidden.join(','));
+
+            window.location.href = '/download/chart.png?' + params.toString();
+        }
+
+        // 选择相对时间范围并重新查询
+        function setRange(range) {
+            currentRange = range;
+            document.querySelectorAll('.range-btn').forEach(btn => {
+                btn.classList.toggle('active', btn.dataset.range === range);
+            });
+            refreshData();
+        }
+
+        // 按交易时段前后切换：由服务端按实际数据找到相邻的交易日，再以 session:YYYY-MM-DD 为时间范围重新查询，
+        // 而不是在已加载的采样数据内平移。当前不是交易时段范围时以最新数据所在的交易日为基准
+        function stepSession(step) {
+            let { table, symbol } = getCurrentInputs();
+            const dataset = chartData && chartData.dataset && chartData.dataset.match(/^([^/]+)\/(.+)@(.+)$/);
+            if ((!table || !symbol) && dataset) {
+                table = dataset[1];
+                symbol = dataset[2];
+            }
+            if (!symbol) {
+                showError('请先选择合约');
+                return;
+            }
+
+            const params = new URLSearchParams({ table: table || '', symbol: symbol, step: String(step) });
+            if (currentRange && currentRange.startsWith('session:')) {
+                params.set('date', currentRange.slice('session:'.length));
+            }
+            fetch('/api/v1/session?' + params.toString())
+                .then(response => response.json())
+                .then(session => {
+                    if (session.error) {
+                        showError(session.error);
+                        return;
+                    }
+                    setRange(session.range);
+                })
+                .catch(error => showError('切换交易时段失败: ' + error.message));
+        }
+
+        // 刷新数据
+        function refreshData() {
+            const { table, symbol } = getCurrentInputs();
+            if (table && symbol) {
+                queryData();
+            } else {
+                updateChart();
+            }
+        }
+        
+        // 切换输入模式
+        function toggleInputMode(type) {
+            const isTable = type === 'table';
+            const checkbox = document.getElementById(isTable ? 'tableDropdownMode' : 'symbolDropdownMode');
+            const input = document.getElementById(isTable ? 'tableInput' : 'symbolInput');
+            const select = document.getElementById(isTable ? 'tableSelect' : 'symbolSelect');
+            
+            if (checkbox.checked) {
+                input.style.display = 'none';
+                select.style.display = 'block';
+            } else {
+                input.style.display = 'block';
+                select.style.display = 'none';
+            }
+        }
+        
+        // 同步输入框和下拉框的值
+        function syncInputValues(type) {
+            const isTable = type === 'table';
+            const checkbox = document.getElementById(isTable ? 'tableDropdownMode' : 'symbolDropdownMode');
+            const input = document.getElementById(isTable ? 'tableInput' : 'symbolInput');
+            const select = document.getElementById(isTable ? 'tableSelect' : 'symbolSelect');
+            
+            if (checkbox.checked) {
+                // 从输入框同步到下拉框
+                const inputValue = input.value.trim();
+                if (inputValue) {
+                    // 查找匹配的选项
+                    for (let option of select.options) {
+                        if (option.value === inputValue) {
+                            select.value = inputValue;
+                            break;
+                        }
+                    }
+                }
+            } else {
+                // 从下拉框同步到输入框
+                if (select.value) {
+                    input.value = select.value;
+                }
+            }
+        }
+        
+        // 表输入变化时自动加载symbols
+        function handleTableInputChange() {
+            const tableDropdownMode = document.getElementById('tableDropdownMode').checked;
+            const table = tableDropdownMode ? 
+                document.getElementById('tableSelect').value : 
+                document.getElementById('tableInput').value.trim();
+            
+            if (table) {
+                loadSymbols(table);
+            }
+        }
+        
+        // 事件监听器
+        document.getElementById('tableDropdownMode').addEventListener('change', function() {
+            syncInputValues('table');
+            toggleInputMode('table');
+        });
+        
+        document.getElementById('symbolDropdownMode').addEventListener('change', function() {
+            syncInputValues('symbol');
+            toggleInputMode('symbol');
+        });
+        
+        document.getElementById('tableSelect').addEventListener('change', handleTableInputChange);
+        document.getElementById('tableInput').addEventListener('input', handleTableInputChange);
+        document.getElementById('symbolInput').addEventListener('input', filterSymbolList);
+        
+        // 支持回车键查询
+        document.getElementById('tableInput').addEventListener('keypress', function(event) {
+            if (event.key === 'Enter') {
+                queryData();
+            }
+        });
+        
+        document.getElementById('symbolInput').addEventListener('keypress', function(event) {
+            if (event.key === 'Enter') {
+                queryData();
+            }
+        });
+
+        // 键盘快捷键：按键分配由服务端注入，可以在 -config 文件的 shortcuts 中修改或禁用，热加载后经 /updates 推送
+        const shortcutHandlers = {
+            zoom_in: zoomIn,
+            zoom_out: zoomOut,
+            reset_zoom: resetZoom,
+            refresh: refreshData,
+            prev_session: () => stepSession(-1),
+            next_session: () => stepSession(1),
+            prev_range: () => stepRange(-1),
+            next_range: () => stepRange(1),
+            toggle_price: togglePrice,
+            toggle_oi: toggleOI,
+            toggle_flow: toggleFlow,
+            next_series: cycleSeries
+        };
+        let shortcutKeys = {};
+
+        // 按键 → 动作，同时把按键写进对应按钮的提示
+        function setShortcuts(shortcuts) {
+            shortcutKeys = {};
+            Object.entries(shortcuts).forEach(([action, keys]) => keys.forEach(key => shortcutKeys[key] = action));
+            document.querySelectorAll('[data-shortcut]').forEach(btn => {
+                if (btn.dataset.title === undefined) btn.dataset.title = btn.title || btn.textContent;
+                const keys = shortcuts[btn.dataset.shortcut] || [];
+                btn.title = btn.dataset.title + (keys.length ? ' (' + keys.join(' / ') + ')' : '');
+            });
+        }
+        setShortcuts({{SHORTCUTS}});
+
+        document.addEventListener('keydown', function(event) {
+            // 输入框中的按键用于输入和移动光标，带 Ctrl/Alt/Meta 的组合键留给浏览器
+            if (['INPUT', 'SELECT', 'TEXTAREA'].includes(event.target.tagName) || event.ctrlKey || event.altKey || event.metaKey) {
+                return;
+            }
+            const action = shortcutKeys[event.key.length === 1 ? event.key.toLowerCase() : event.key];
+            if (!action) {
+                return;
+            }
+            event.preventDefault();
+            shortcutHandlers[action]();
+        });
+
+        // 在时间范围按钮之间前后切换，到两端时停止；当前为交易时段范围时从两端开始
+        function stepRange(step) {
+            const ranges = Array.from(document.querySelectorAll('.range-btn')).map(btn => btn.dataset.range);
+            let i = ranges.indexOf(currentRange);
+            i = i < 0 ? (step > 0 ? 0 : ranges.length - 1) : Math.min(ranges.length - 1, Math.max(0, i + step));
+            if (ranges[i] !== currentRange) {
+                setRange(ranges[i]);
+            }
+        }
+
+        // 依次切换最新价、中间价、价差
+        function cycleSeries() {
+            const select = document.getElementById('seriesSelect');
+            select.selectedIndex = (select.selectedIndex + 1) % select.options.length;
+            setSeries(select.value);
+        }
+
+        // 服务端刷新完数据集后通过 /updates 推送通知，当前显示的正是该数据集时重新获取；
+        // 配置文件修改配色时也通过这里推送
+        function subscribeUpdates() {
+            const source = new EventSource('/updates');
+            source.onmessage = function(event) {
+                const msg = JSON.parse(event.data);
+                if (msg.type === 'config') {
+                    document.body.className = 'theme-' + msg.theme;
+                    setShortcuts(msg.shortcuts);
+                    return;
+                }
+                if (msg.type === 'profile') {
+                    profileChanged(msg.profile);
+                    return;
+                }
+                if (msg.type === 'levels') {
+                    if (msg.symbol === levelSymbol()) {
+                        chartLevels = msg.levels || [];
+                        chart.update('none');
+                    }
+                    return;
+                }
+                if (msg.type !== 'dataset' || liveEnabled || zoomWindow || !chartData || chartData.dataset !== msg.key) {
+                    return;
+                }
+                loadZoomWindow(null);
+            };
+        }
+
+        // 指标开关：开启的指标保存到会话，服务端同时写入 -state-file，新会话和重启后从上次的选择开始
+        const indicatorToggles = {
+            percent: { get: () => percentMode, set: on => { percentMode = on; }, button: 'percentToggle', on: '价格坐标', off: '百分比坐标' },
+            regimes: { get: () => showRegimes, set: on => { showRegimes = on; }, button: 'regimeToggle', on: '取消波动率着色', off: '波动率着色' },
+            vwap: { get: () => showVWAP, set: on => { showVWAP = on; }, button: 'vwapToggle', on: '隐藏VWAP带', off: 'VWAP带' },
+            pivots: { get: () => showPivots, set: on => { showPivots = on; }, button: 'pivotToggle', on: '隐藏高低点', off: '高低点' },
+            profile: { get: () => profileEnabled, set: on => { profileEnabled = on; }, button: 'profileToggle', on: '隐藏均值带', off: '日内均值带' },
+            exact: { get: () => exactStats, set: on => { exactStats = on; }, button: 'exactToggle', on: '取消精确统计', off: '精确统计' }
+        };
+
+        function saveIndicators() {
+            const enabled = Object.keys(indicatorToggles).filter(name => indicatorToggles[name].get());
+            fetch('/session?indicators=' + encodeURIComponent(enabled.join(',')), { method: 'POST' })
+                .catch(error => console.error('保存会话失败:', error));
+        }
+
+        // 只设置开关和按钮文字，随后加载数据时各指标按开关加载
+        function restoreIndicators(names) {
+            Object.keys(indicatorToggles).forEach(name => {
+                const toggle = indicatorToggles[name];
+                toggle.set((names || []).includes(name));
+                document.getElementById(toggle.button).textContent = toggle.get() ? toggle.on : toggle.off;
+            });
+        }
+
+        // 恢复本会话（cookie）上次选择的表、symbol、时间范围和显示偏好，多个用户互不影响。
+        // 地址栏带 table、symbol、range 参数时（如从日统计页点击某个交易日打开）以参数为准
+        function restoreSession() {
+            const link = new URLSearchParams(location.search);
+            const linked = link.get('table') && link.get('symbol');
+            fetch('/session')
+                .then(response => response.json())
+                .then(session => {
+                    if (linked) {
+                        session.table = link.get('table');
+                        session.symbol = link.get('symbol');
+                        session.range = link.get('range') || session.range;
+                    }
+                    document.getElementById('tableInput').value = session.table;
+                    document.getElementById('symbolInput').value = session.symbol;
+                    currentRange = session.range;
+                    document.querySelectorAll('.range-btn').forEach(btn => {
+                        btn.classList.toggle('active', btn.dataset.range === session.range);
+                    });
+                    rawMode = session.raw;
+                    document.getElementById('rawToggle').textContent = rawMode ? '显示采样数据' : '显示原始数据';
+                    document.getElementById('seriesSelect').value = session.series;
+                    currentSeries = session.series;
+                    flowColor = session.flow_color || 'sign';
+                    document.getElementById('flowColorSelect').value = flowColor;
+                    restoreIndicators(session.indicators);
+                    chart.data.datasets[0].label = seriesLabels[currentSeries];
+                    chart.options.scales.y.title.text = seriesLabels[currentSeries];
+                    chart.options.plugins.title.text = session.symbol.toUpperCase() + ' 交互式数据图表';
+                    document.getElementById('yMinInput').value = session.y_min === null ? '' : session.y_min;
+                    document.getElementById('yMaxInput').value = session.y_max === null ? '' : session.y_max;
+                    setYBounds();
+                    loadSymbols(session.table);
+                })
+                .catch(error => console.error('恢复会话失败:', error))
+                .finally(() => linked ? queryData() : updateChart());
+        }
+
+        // ClickHouse连接配置：配置文件中定义了多个时显示下拉框
+        function loadProfiles() {
+            fetch('/api/v1/profile')
+                .then(response => response.json())
+                .then(data => {
+                    const select = document.getElementById('profileSelect');
+                    select.innerHTML = '';
+                    data.profiles.forEach(p => {
+                        const option = document.createElement('option');
+                        option.value = p.name;
+                        option.textContent = p.name;
+                        option.title = p.url + ' ' + p.database;
+                        select.appendChild(option);
+                    });
+                    select.value = data.active;
+                    select.disabled = !data.can_switch;
+                    select.title = data.can_switch ? '' : '只有管理员可以切换ClickHouse配置';
+                    document.getElementById('profileGroup').style.display = data.profiles.length > 1 ? '' : 'none';
+                })
+                .catch(error => console.error('加载ClickHouse配置失败:', error));
+        }
+
+        // 切换对服务端的所有页面生效，其他页面通过 /updates 收到通知；只有管理员可以切换
+        function switchProfile(name) {
+            fetch('/api/v1/profile?name=' + encodeURIComponent(name), {method: 'POST'})
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        alert('切换配置失败: ' + data.error);
+                        loadProfiles();
+                        return;
+                    }
+                    profileChanged(data.active);
+                })
+                .catch(error => alert('切换配置失败: ' + error));
+        }
+
+        // 切换后表和合约列表都来自新的库，重新加载列表和当前数据集
+        function profileChanged(name) {
+            document.getElementById('profileSelect').value = name;
+            loadTables();
+            loadSymbols(document.getElementById('tableInput').value);
+            queryData();
+        }
+
+        // 页面加载完成后初始化
+        window.onload = function() {
+            initChart();
+            initFlowChart();
+            loadProfiles();
+            loadTables();
+            restoreSession();
+            subscribeUpdates();
+        };
+    </script>
+</body>
+</html>`
+
+// 主页处理器 - 显示JavaScript图表页面
+func webIndexHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("index.html")
+
+	webConfigMutex.Lock()
+	theme := webTheme
+	shortcuts, _ := json.Marshal(webShortcuts)
+	webConfigMutex.Unlock()
+	numbers, _ := json.Marshal(webNumbers)
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(strings.NewReplacer("{{THEME}}", theme, "{{SHORTCUTS}}", string(shortcuts),
+		"{{NUMBER_FORMAT}}", string(numbers)).Replace(tmpl)))
+}
+
+// 窗口对比页面的HTML模板 (templates/compare.html)
+const webCompareTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>时间窗口对比</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+            margin-bottom: 20px;
+        }
+        th, td {
+            border: 1px solid #dee2e6;
+            padding: 8px;
+            text-align: right;
+        }
+        th:first-child, td:first-child {
+            text-align: left;
+        }
+        #chartContainer {
+            position: relative;
+            height: 500px;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>时间窗口对比</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" value="jm"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>窗口A 开始</label><input id="aFrom" type="datetime-local" step="1"></div>
+            <div><label>窗口A 结束</label><input id="aTo" type="datetime-local" step="1"></div>
+            <div><label>窗口B 开始</label><input id="bFrom" type="datetime-local" step="1"></div>
+            <div><label>窗口B 结束</label><input id="bTo" type="datetime-local" step="1"></div>
+            <button onclick="compare()">对比</button>
+        </div>
+        <table>
+            <thead><tr><th>统计量</th><th>窗口A</th><th>窗口B</th><th>差值 (B-A)</th></tr></thead>
+            <tbody id="statsBody"></tbody>
+        </table>
+        <div id="chartContainer"><canvas id="pathChart"></canvas></div>
+        <div class="status" id="status">选择两个时间窗口后点击对比</div>
+    </div>
+    <script>
+        const rows = [
+            ['count', '数据点数', 0],
+            ['mean', '均价', 2],
+            ['stddev', '价格标准差', 2],
+            ['high', '最高价', 2],
+            ['low', '最低价', 2],
+            ['change_pct', '涨跌幅 (%)', 2],
+            ['volume', '成交量', 0],
+            ['oi_change', '持仓变化', 0]
+        ];
+
+        const chart = new Chart(document.getElementById('pathChart').getContext('2d'), {
+            type: 'line',
+            data: { datasets: [] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                parsing: false,
+                elements: { point: { radius: 0 } },
+                scales: {
+                    x: { type: 'linear', title: { display: true, text: '距窗口开始 (分钟)' } },
+                    y: { title: { display: true, text: '归一化价格 (起点=100)' } }
+                }
+            }
+        });
+
+        function compare() {
+            const params = new URLSearchParams();
+            ['table', 'symbol', 'aFrom', 'aTo', 'bFrom', 'bTo'].forEach(id => {
+                params.set(id.replace(/[A-Z]/, c => '_' + c.toLowerCase()), document.getElementById(id).value);
+            });
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/compare/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+
+                    const a = data.windows[0].stats, b = data.windows[1].stats;
+                    document.getElementById('statsBody').innerHTML = rows.map(([key, label, digits]) =>
+                        '<tr><td>' + label + '</td><td>' + a[key].toFixed(digits) + '</td><td>' +
+                        b[key].toFixed(digits) + '</td><td>' + (b[key] - a[key]).toFixed(digits) + '</td></tr>'
+                    ).join('');
+
+                    chart.data.datasets = data.windows.map((win, i) => ({
+                        label: (i === 0 ? 'A: ' : 'B: ') + win.from + ' ~ ' + win.to,
+                        data: win.path,
+                        borderColor: i === 0 ? 'rgb(75, 192, 192)' : 'rgb(255, 99, 132)',
+                        borderWidth: 2
+                    }));
+                    chart.update();
+                    document.getElementById('status').textContent = '对比完成';
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+    </script>
+</body>
+</html>`
+
+// 窗口对比页面：同一合约的两个时间段并排比较统计量，并叠加归一化价格路径
+func webCompareHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("compare.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 对比视图中归一化价格路径的最大点数
+const COMPARE_PATH_POINTS = 500
+
+type webWindowStats struct {
+	Count     int     `json:"count"`
+	Mean      float64 `json:"mean"`
+	StdDev    float64 `json:"stddev"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	ChangePct float64 `json:"change_pct"`
+	Volume    float64 `json:"volume"`
+	OIChange  float64 `json:"oi_change"`
+}
+
+// 计算窗口统计量：价格均值/标准差/高低点/涨跌幅，成交量为 diff_vol 之和，持仓变化为首尾持仓之差
+func webComputeWindowStats(data []WebMarketData) webWindowStats {
+	stats := webWindowStats{Count: len(data)}
+	if len(data) == 0 {
+		return stats
+	}
+
+	prices := make([]float64, len(data))
+	for i, record := range data {
+		prices[i] = webPriceValue(record.Price, record.Symbol)
+		stats.Volume += float64(record.DiffVol)
+	}
+
+	stats.Mean = webCalculateAverage(prices)
+	stats.High = webFindMax(prices)
+	stats.Low = webFindMin(prices)
+
+	// 与均值、高低点一样跳过 NaN/Inf，避免单条坏数据让整个统计结果无法编码为JSON
+	variance, valid := 0.0, 0
+	for _, p := range prices {
+		if math.IsNaN(p) || math.IsInf(p, 0) {
+			continue
+		}
+		variance += (p - stats.Mean) * (p - stats.Mean)
+		valid++
+	}
+	if valid > 0 {
+		stats.StdDev = math.Sqrt(variance / float64(valid))
+	}
+
+	first, last := prices[0], prices[len(prices)-1]
+	if first != 0 && !math.IsNaN(first) && !math.IsInf(first, 0) && !math.IsNaN(last) && !math.IsInf(last, 0) {
+		stats.ChangePct = (last - first) / first * 100
+	}
+	stats.OIChange = float64(data[len(data)-1].OpenInterest) - float64(data[0].OpenInterest)
+	return stats
+}
+
+// 价格类统计量按价格格式舍入，均值和标准差多保留两位
+func (s webWindowStats) roundPrices(pf webPriceFormat) webWindowStats {
+	s.Mean = pf.round(s.Mean, 2)
+	s.StdDev = pf.round(s.StdDev, 2)
+	s.High = pf.round(s.High, 0)
+	s.Low = pf.round(s.Low, 0)
+	return s
+}
+
+// 以窗口起点价格为100的归一化价格路径，x 为距窗口开始的分钟数
+func webNormalizedPath(data []WebMarketData, from time.Time) []map[string]float64 {
+	data = webSampleData(data, COMPARE_PATH_POINTS)
+	if len(data) == 0 || data[0].Price == 0 {
+		return []map[string]float64{}
+	}
+
+	loc := webServerLocation()
+	base := webPriceValue(data[0].Price, data[0].Symbol)
+	path := make([]map[string]float64, 0, len(data))
+	for _, record := range data {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", record.Time, loc)
+		if err != nil {
+			continue
+		}
+		y := webPriceValue(record.Price, record.Symbol) / base * 100
+		if math.IsNaN(y) || math.IsInf(y, 0) {
+			continue
+		}
+		path = append(path, map[string]float64{
+			"x": t.Sub(from).Minutes(),
+			"y": y,
+		})
+	}
+	return path
+}
+
+// 解析页面传入的时间，支持 datetime-local 控件格式和 ClickHouse 的 DateTime 格式
+func webParseWallTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, webServerLocation()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("时间格式无效: %q", value)
+}
+
+// 查询 [from, to) 时间段的数据
+func webQueryMarketDataBetween(ctx context.Context, table, symbol string, from, to time.Time) ([]WebMarketData, error) {
+	if webDemoMode() {
+		return webDemoTicks(symbol, from, to), nil
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	query, err := webSelect(ctx, webMarketDataColumns...).
+		FromBars(table, to.Sub(from)).
+		Symbol(symbol).
+		TimeRange(from, to).
+		OrderBy("time ASC", "datetime ASC").
+		Format(webResultFormat()).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteSharedQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	return webParseMarketData(result)
+}
+
+// 窗口对比数据接口：/compare/data?table=jm&symbol=jm2509&a_from=...&a_to=...&b_from=...&b_to=...
+func webCompareDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if table == "" || symbol == "" {
+		fail("缺少table或symbol参数")
+		return
+	}
+
+	priceFormat, err := webParsePriceFormat(r, symbol)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	var windows []map[string]interface{}
+	for _, prefix := range []string{"a", "b"} {
+		from, err := webParseWallTime(q.Get(prefix + "_from"))
+		if err != nil {
+			fail(fmt.Sprintf("窗口%s开始%v", strings.ToUpper(prefix), err))
+			return
+		}
+		to, err := webParseWallTime(q.Get(prefix + "_to"))
+		if err != nil {
+			fail(fmt.Sprintf("窗口%s结束%v", strings.ToUpper(prefix), err))
+			return
+		}
+		if !to.After(from) {
+			fail(fmt.Sprintf("窗口%s的结束时间必须晚于开始时间", strings.ToUpper(prefix)))
+			return
+		}
+
+		data, err := webQueryMarketDataBetween(r.Context(), table, symbol, from, to)
+		if err != nil {
+			fail(fmt.Sprintf("查询窗口%s失败: %v", strings.ToUpper(prefix), err))
+			return
+		}
+
+		windows = append(windows, map[string]interface{}{
+			"from":  from.Format("2006-01-02 15:04:05"),
+			"to":    to.Format("2006-01-02 15:04:05"),
+			"stats": webComputeWindowStats(data).roundPrices(priceFormat),
+			"path":  webNormalizedPath(data, from),
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":   table,
+		"symbol":  symbol,
+		"windows": windows,
+	})
+}
+
+// 叠加序列数据：/overlay/data?table=i&symbol=i2509&from=2025-07-01 09:00:00&to=2025-07-01 15:00:00&points=2000
+// 返回 [from, to] 内按点数上限等间隔抽样的 {time, price}，供主图叠加其它合约或指数
+func webOverlayDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	from, err := webParseWallTime(q.Get("from"))
+	if err != nil {
+		fail("开始" + err.Error())
+		return
+	}
+	to, err := webParseWallTime(q.Get("to"))
+	if err != nil {
+		fail("结束" + err.Error())
+		return
+	}
+	points := WEB_ZOOM_POINTS
+	if n, err := strconv.Atoi(q.Get("points")); err == nil && n > 0 && n < points {
+		points = n
+	}
+
+	series, err := webOverlaySeries(r.Context(), table, symbol, from, to, points)
+	if err != nil {
+		fail(fmt.Sprintf("查询 %s 失败: %v", symbol, err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":  table,
+		"symbol": symbol,
+		"data":   series,
+	})
+}
+
+type webOverlayPoint struct {
+	Time  string  `json:"time"`
+	Price float64 `json:"price"`
+}
+
+// 查询 [from, to] 内的价格并按点数上限抽样，叠加序列和联动仪表盘的面板共用
+func webOverlaySeries(ctx context.Context, table, symbol string, from, to time.Time, points int) ([]webOverlayPoint, error) {
+	data, err := webQueryMarketDataBetween(ctx, table, symbol, from, to.Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	series := []webOverlayPoint{}
+	for _, record := range webSampleData(data, points) {
+		price := webPriceValue(record.Price, record.Symbol)
+		if math.IsNaN(price) || math.IsInf(price, 0) {
+			continue
+		}
+		series = append(series, webOverlayPoint{record.Time, price})
+	}
+	return series, nil
+}
+
+// 单次最多返回的事件数，避免长时间范围下标记过密
+const EVENTS_MAX_ROWS = 1000
+
+type webEvent struct {
+	Time     string `json:"time"`
+	Title    string `json:"title"`
+	Severity string `json:"severity"`
+}
+
+// 查询 [from, to] 时间段内的事件，按时间升序
+func webQueryEvents(ctx context.Context, from, to time.Time) ([]webEvent, error) {
+	query, err := webSelect(ctx, "toString(timestamp) AS time", "toString(title) AS title", "toString(severity) AS severity").
+		FromReference(webEventsTable).
+		Where("timestamp >= " + webDateTime(from)).
+		Where("timestamp <= " + webDateTime(to)).
+		OrderBy("timestamp ASC").
+		Limit(EVENTS_MAX_ROWS).
+		Format("JSONEachRow").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	events := []webEvent{}
+	for _, line := range strings.Split(result, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var event webEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, fmt.Errorf("failed to parse event row: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// 事件标注接口：/events?from=2025-07-01T09:00&to=2025-07-02T15:00，未配置 -events-table 时返回空列表
+func webEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	if webEventsTable == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false, "events": []webEvent{}})
+		return
+	}
+
+	q := r.URL.Query()
+	from, err := webParseWallTime(q.Get("from"))
+	if err != nil {
+		fail("开始" + err.Error())
+		return
+	}
+	to, err := webParseWallTime(q.Get("to"))
+	if err != nil {
+		fail("结束" + err.Error())
+		return
+	}
+
+	events, err := webQueryEvents(r.Context(), from, to)
+	if err != nil {
+		fail(fmt.Sprintf("查询事件失败: %v", err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":   true,
+		"events":    events,
+		"truncated": len(events) >= EVENTS_MAX_ROWS,
+	})
+}
+
+// 合约信息：交易所、最后交易日、剩余天数和保证金率。内置的品种表只能按交易所规则估算最后交易日（不考虑节假日），
+// 配置 -calendar-table 时以该表中的记录为准，保证金率也只来自该表
+const CONTRACT_EXPIRY_WARN_DAYS = 30 // 距最后交易日不超过该天数时页面提示换月
+
+// 品种所属交易所
+var webProductExchanges = map[string]string{
+	"a": "DCE", "b": "DCE", "c": "DCE", "cs": "DCE", "eb": "DCE", "eg": "DCE", "i": "DCE", "j": "DCE", "jd": "DCE",
+	"jm": "DCE", "l": "DCE", "lh": "DCE", "m": "DCE", "p": "DCE", "pg": "DCE", "pp": "DCE", "rr": "DCE", "v": "DCE", "y": "DCE",
+	"ag": "SHFE", "al": "SHFE", "ao": "SHFE", "au": "SHFE", "br": "SHFE", "bu": "SHFE", "cu": "SHFE", "fu": "SHFE", "hc": "SHFE",
+	"ni": "SHFE", "pb": "SHFE", "rb": "SHFE", "ru": "SHFE", "sn": "SHFE", "sp": "SHFE", "ss": "SHFE", "wr": "SHFE", "zn": "SHFE",
+	"ap": "CZCE", "cf": "CZCE", "cj": "CZCE", "cy": "CZCE", "fg": "CZCE", "ma": "CZCE", "oi": "CZCE", "pf": "CZCE", "pk": "CZCE",
+	"px": "CZCE", "rm": "CZCE", "sa": "CZCE", "sf": "CZCE", "sh": "CZCE", "sm": "CZCE", "sr": "CZCE", "ta": "CZCE", "ur": "CZCE",
+	"bc": "INE", "ec": "INE", "lu": "INE", "nr": "INE", "sc": "INE",
+	"lc": "GFEX", "ps": "GFEX", "si": "GFEX",
+	"ic": "CFFEX", "if": "CFFEX", "ih": "CFFEX", "im": "CFFEX", "t": "CFFEX", "tf": "CFFEX", "tl": "CFFEX", "ts": "CFFEX",
+}
+
+var webExchangeNames = map[string]string{
+	"DCE": "大连商品交易所", "SHFE": "上海期货交易所", "CZCE": "郑州商品交易所",
+	"INE": "上海国际能源交易中心", "GFEX": "广州期货交易所", "CFFEX": "中国金融期货交易所",
+}
+
+type webContractInfo struct {
+	Symbol       string   `json:"symbol"`
+	Product      string   `json:"product"`
+	Exchange     string   `json:"exchange"`
+	ExchangeName string   `json:"exchange_name"`
+	Expiry       string   `json:"expiry"`
+	DaysToExpiry int      `json:"days_to_expiry"`
+	Margin       *float64 `json:"margin"`    // 保证金率，如 0.12；没有日历表记录时为 null
+	Source       string   `json:"source"`    // calendar：来自日历表；registry：按内置品种表估算
+	Estimated    bool     `json:"estimated"` // 最后交易日按规则估算，没有考虑节假日
+	NearExpiry   bool     `json:"near_expiry"`
+	Expired      bool     `json:"expired"`
+}
+
+// 第 n 个工作日（周一至周五）
+func webNthWeekday(year int, month time.Month, n int) time.Time {
+	day := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	for count := 0; ; day = day.AddDate(0, 0, 1) {
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			if count++; count == n {
+				return day
+			}
+		}
+	}
+}
+
+// 当月第 n 个星期 weekday
+func webNthWeekdayOf(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	day := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	day = day.AddDate(0, 0, (int(weekday)-int(day.Weekday())+7)%7)
+	return day.AddDate(0, 0, 7*(n-1))
+}
+
+// 按交易所规则估算最后交易日：大商所、郑商所、广期所为合约月份第10个交易日；上期所和能源中心为合约月份15日，
+// 遇周末顺延，原油为合约月份前一个月的最后一个交易日；中金所股指为合约月份第三个周五，国债为第二个周五
+func webEstimateExpiry(exchange, product string, year int, month time.Month) time.Time {
+	switch {
+	case product == "sc":
+		day := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+		for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			day = day.AddDate(0, 0, -1)
+		}
+		return day
+	case exchange == "SHFE" || exchange == "INE":
+		day := time.Date(year, month, 15, 0, 0, 0, 0, time.UTC)
+		for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day
+	case exchange == "CFFEX" && strings.HasPrefix(product, "t"):
+		return webNthWeekdayOf(year, month, time.Friday, 2)
+	case exchange == "CFFEX":
+		return webNthWeekdayOf(year, month, time.Friday, 3)
+	default:
+		return webNthWeekday(year, month, 10)
+	}
+}
+
+// 按内置品种表解析合约代码：jm2509 为2025年9月；郑商所的三位代码 ma509 取离 now 最近的年份
+func webRegistryContract(symbol string, now time.Time) (*webContractInfo, error) {
+	lower := strings.ToLower(symbol)
+	product := strings.TrimRight(lower, "0123456789")
+	digits := lower[len(product):]
+	exchange, ok := webProductExchanges[product]
+	if !ok {
+		return nil, fmt.Errorf("unknown product %q", product)
+	}
+
+	var year, month int
+	switch len(digits) {
+	case 4:
+		year, month = 2000+int(digits[0]-'0')*10+int(digits[1]-'0'), int(digits[2]-'0')*10+int(digits[3]-'0')
+	case 3:
+		year, month = now.Year()/10*10+int(digits[0]-'0'), int(digits[1]-'0')*10+int(digits[2]-'0')
+		if year < now.Year()-5 {
+			year += 10
+		} else if year > now.Year()+5 {
+			year -= 10
+		}
+	default:
+		return nil, fmt.Errorf("symbol %q has no contract month", symbol)
+	}
+	if month < 1 || month > 12 {
+		return nil, fmt.Errorf("symbol %q has an invalid contract month", symbol)
+	}
+
+	expiry := webEstimateExpiry(exchange, product, year, time.Month(month))
+	return &webContractInfo{
+		Symbol: lower, Product: product, Exchange: exchange,
+		Expiry: expiry.Format("2006-01-02"), Source: "registry", Estimated: true,
+	}, nil
+}
+
+// 从 -calendar-table 读取合约信息，表中需要 symbol、exchange、expire_date、margin_rate 四列；没有记录时返回 nil
+func webCalendarContract(ctx context.Context, symbol string) (*webContractInfo, error) {
+	query, err := webSelect(ctx, "toString(exchange) AS exchange", "toString(expire_date) AS expiry", "toFloat64(margin_rate) AS margin").
+		FromReference(webCalendarTable).
+		Symbol(symbol).
+		Limit(1).
+		Format("JSONEachRow").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	if strings.TrimSpace(result) == "" {
+		return nil, nil
+	}
+	info := &webContractInfo{Symbol: strings.ToLower(symbol), Product: strings.ToLower(strings.TrimRight(symbol, "0123456789")), Source: "calendar"}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(result)), info); err != nil {
+		return nil, fmt.Errorf("failed to parse calendar row: %w", err)
+	}
+	info.Exchange = strings.ToUpper(info.Exchange)
+	return info, nil
+}
+
+// 合约信息：日历表中有记录时以其为准，否则按内置品种表估算；剩余天数按 now 所在的自然日计算
+func webLookupContract(ctx context.Context, symbol string, now time.Time) (*webContractInfo, error) {
+	var info *webContractInfo
+	if webCalendarTable != "" {
+		var err error
+		if info, err = webCalendarContract(ctx, symbol); err != nil {
+			return nil, err
+		}
+	}
+	if info == nil {
+		var err error
+		if info, err = webRegistryContract(symbol, now); err != nil {
+			return nil, err
+		}
+	}
+
+	expiry, err := time.Parse("2006-01-02", info.Expiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry date %q for %s", info.Expiry, symbol)
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	info.DaysToExpiry = int(expiry.Sub(today).Hours() / 24)
+	info.Expired = info.DaysToExpiry < 0
+	info.NearExpiry = !info.Expired && info.DaysToExpiry <= CONTRACT_EXPIRY_WARN_DAYS
+	info.ExchangeName = webExchangeNames[info.Exchange]
+	return info, nil
+}
+
+// 合约信息接口：/api/v1/contract?symbol=jm2509
+func webContractHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	symbol := r.URL.Query().Get("symbol")
+	if symbol == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "缺少symbol参数"})
+		return
+	}
+	info, err := webLookupContract(r.Context(), symbol, time.Now().In(webServerLocation()))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("无法确定 %s 的合约信息: %v", symbol, err)})
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// 持仓变化热力图的默认时段粒度和最大日期跨度
+const (
+	HEATMAP_DEFAULT_SLOT = 30 * time.Minute
+	HEATMAP_MAX_DAYS     = 366
+)
+
+type webHeatmapCell struct {
+	Day   string  `json:"day"`
+	Slot  string  `json:"slot"`
+	OI    float64 `json:"oi"`
+	Ticks uint64  `json:"ticks"`
+}
+
+// 在ClickHouse中按 交易日 × 日内时段 汇总 diff_oi，时段以 slot 为粒度对齐到整点
+func webQueryOIHeatmap(ctx context.Context, table, symbol string, from, to time.Time, slot time.Duration) ([]webHeatmapCell, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	if webDemoMode() {
+		return webDemoHeatmap(symbol, from, to, slot), nil
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	query, err := webSelect(ctx,
+		"toString(toDate(time)) AS day",
+		"formatDateTime("+webIntervalStart("time", slot)+", '%H:%M') AS slot",
+		"toFloat64(sum(diff_oi)) AS oi",
+		"count() AS ticks").
+		FromBars(table, to.Sub(from)).
+		Symbol(symbol).
+		TimeRange(from, to).
+		GroupBy("day", "slot").
+		OrderBy("day ASC", "slot ASC").
+		Settings("output_format_json_quote_64bit_integers = 0").
+		Format("JSONEachRow").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	cells := []webHeatmapCell{}
+	for _, line := range strings.Split(result, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var cell webHeatmapCell
+		if err := json.Unmarshal([]byte(line), &cell); err != nil {
+			return nil, fmt.Errorf("failed to parse heatmap row: %w", err)
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+// 把查询结果排成 日期 × 时段 的矩阵，没有成交的格子为 null；另外给出每个时段的日均持仓变化
+func webBuildHeatmap(cells []webHeatmapCell) map[string]interface{} {
+	var days, slots []string
+	dayIndex := map[string]int{}
+	slotIndex := map[string]int{}
+	for _, cell := range cells {
+		if _, ok := dayIndex[cell.Day]; !ok {
+			dayIndex[cell.Day] = len(days)
+			days = append(days, cell.Day)
+		}
+		if _, ok := slotIndex[cell.Slot]; !ok {
+			slotIndex[cell.Slot] = 0
+			slots = append(slots, cell.Slot)
+		}
+	}
+	sort.Strings(slots)
+	for i, slot := range slots {
+		slotIndex[slot] = i
+	}
+
+	values := make([][]*float64, len(days))
+	for i := range values {
+		values[i] = make([]*float64, len(slots))
+	}
+	sums := make([]float64, len(slots))
+	counts := make([]int, len(slots))
+	maxAbs := 0.0
+	for _, cell := range cells {
+		oi := cell.OI
+		j := slotIndex[cell.Slot]
+		values[dayIndex[cell.Day]][j] = &oi
+		sums[j] += oi
+		counts[j]++
+		if math.Abs(oi) > maxAbs {
+			maxAbs = math.Abs(oi)
+		}
+	}
+	avg := make([]float64, len(slots))
+	for j := range avg {
+		if counts[j] > 0 {
+			avg[j] = sums[j] / float64(counts[j])
+		}
+	}
+
+	return map[string]interface{}{
+		"days":     days,
+		"slots":    slots,
+		"values":   values,
+		"slot_avg": avg,
+		"max_abs":  maxAbs,
+	}
+}
+
+// 持仓变化热力图数据：/heatmap/data?table=jm&symbol=jm2509&from=2025-06-01&to=2025-06-30&slot=30m
+// from/to 为日期（含两端），slot 必须能整除一天
+func webHeatmapDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	loc := webServerLocation()
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("开始日期格式无效: %q", q.Get("from")))
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("结束日期格式无效: %q", q.Get("to")))
+		return
+	}
+	to = to.AddDate(0, 0, 1)
+	if !to.After(from) {
+		fail("结束日期不能早于开始日期")
+		return
+	}
+	if to.Sub(from) > HEATMAP_MAX_DAYS*24*time.Hour {
+		fail(fmt.Sprintf("日期跨度不能超过%d天", HEATMAP_MAX_DAYS))
+		return
+	}
+
+	slot := HEATMAP_DEFAULT_SLOT
+	if s := q.Get("slot"); s != "" {
+		if slot, err = webParseRelativeRange(s); err != nil || slot < time.Minute || (24*time.Hour)%slot != 0 {
+			fail("slot参数无效，需为能整除一天的时段，如 5m、15m、30m、1h")
+			return
+		}
+	}
+
+	cells, err := webQueryOIHeatmap(r.Context(), table, symbol, from, to, slot)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+
+	heatmap := webBuildHeatmap(cells)
+	heatmap["table"] = table
+	heatmap["symbol"] = symbol
+	heatmap["slot"] = slot.String()
+	json.NewEncoder(w).Encode(heatmap)
+}
+
+// 持仓变化热力图页面的HTML模板 (templates/heatmap.html)
+const webHeatmapTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>持仓变化热力图</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        .heatmap-wrapper {
+            overflow-x: auto;
+        }
+        table {
+            border-collapse: collapse;
+            font-size: 11px;
+        }
+        th, td {
+            border: 1px solid #eee;
+            padding: 4px;
+            text-align: center;
+            white-space: nowrap;
+        }
+        td.empty {
+            background-color: #fafafa;
+        }
+        tr.avg td {
+            border-top: 2px solid #333;
+            font-weight: bold;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>持仓变化热力图</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" placeholder="默认取symbol字母前缀"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>开始日期</label><input id="from" type="date"></div>
+            <div><label>结束日期</label><input id="to" type="date"></div>
+            <div><label>时段</label>
+                <select id="slot">
+                    <option value="5m">5分钟</option>
+                    <option value="15m">15分钟</option>
+                    <option value="30m" selected>30分钟</option>
+                    <option value="1h">1小时</option>
+                </select>
+            </div>
+            <button onclick="loadHeatmap()">生成</button>
+        </div>
+        <div class="heatmap-wrapper"><table id="heatmap"></table></div>
+        <div class="status" id="status">选择合约和日期范围后点击生成</div>
+    </div>
+    <script>
+        const today = new Date();
+        const monthAgo = new Date(today.getTime() - 30 * 24 * 3600 * 1000);
+        document.getElementById('to').value = today.toISOString().slice(0, 10);
+        document.getElementById('from').value = monthAgo.toISOString().slice(0, 10);
+
+        function cellColor(value, maxAbs) {
+            if (!maxAbs) return 'white';
+            const alpha = Math.min(1, Math.abs(value) / maxAbs).toFixed(2);
+            return value >= 0 ? 'rgba(220, 53, 69, ' + alpha + ')' : 'rgba(40, 167, 69, ' + alpha + ')';
+        }
+
+        function cell(value, maxAbs, title) {
+            const td = document.createElement('td');
+            if (value === null) {
+                td.className = 'empty';
+                return td;
+            }
+            td.textContent = Math.round(value).toLocaleString();
+            td.style.backgroundColor = cellColor(value, maxAbs);
+            td.title = title + ' 持仓变化 ' + Math.round(value).toLocaleString();
+            return td;
+        }
+
+        function loadHeatmap() {
+            const params = new URLSearchParams();
+            ['table', 'symbol', 'from', 'to', 'slot'].forEach(id => params.set(id, document.getElementById(id).value));
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/heatmap/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+
+                    const table = document.getElementById('heatmap');
+                    table.innerHTML = '';
+                    const head = table.insertRow();
+                    head.appendChild(document.createElement('th')).textContent = '日期 \\ 时段';
+                    data.slots.forEach(slot => head.appendChild(document.createElement('th')).textContent = slot);
+
+                    data.days.forEach((day, i) => {
+                        const row = table.insertRow();
+                        row.appendChild(document.createElement('th')).textContent = day;
+                        data.values[i].forEach((value, j) => row.appendChild(cell(value, data.max_abs, day + ' ' + data.slots[j])));
+                    });
+
+                    // 日均行单独按自身最大值着色，否则会被个别极端交易日压得看不出规律
+                    const avgMax = Math.max(0, ...data.slot_avg.map(Math.abs));
+                    const avg = table.insertRow();
+                    avg.className = 'avg';
+                    avg.appendChild(document.createElement('th')).textContent = '日均';
+                    data.slot_avg.forEach((value, j) => avg.appendChild(cell(value, avgMax, '日均 ' + data.slots[j])));
+
+                    document.getElementById('status').textContent = data.symbol.toUpperCase() + ' | ' + data.days.length +
+                        ' 个交易日 | 时段 ' + data.slot + ' | 单格最大绝对变化 ' + Math.round(data.max_abs).toLocaleString();
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+    </script>
+</body>
+</html>`
+
+// 持仓变化热力图页面：纵轴为交易日，横轴为日内时段，增仓红、减仓绿，颜色深浅按全表最大绝对值归一
+func webHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("heatmap.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 日统计表：每个交易日一行，默认最近20个交易日
+const (
+	DAILY_DEFAULT_DAYS = 20
+	DAILY_MAX_DAYS     = 250
+)
+
+// 一个交易日的汇总。OIChange 为当日 diff_oi 之和，OpenInterest 为收盘时的持仓量；
+// Settle 为结算价，与交易所的算法相同取全天成交量加权平均价，没有成交量时取收盘价；
+// Change/ChangePct 相对前一交易日收盘，最早一天没有前收时为 null
+type webDailyStats struct {
+	Day          string   `json:"day"`
+	Open         float64  `json:"open"`
+	High         float64  `json:"high"`
+	Low          float64  `json:"low"`
+	Close        float64  `json:"close"`
+	Settle       float64  `json:"settle"`
+	Volume       int64    `json:"volume"`
+	OIChange     int64    `json:"oi_change"`
+	OpenInterest int64    `json:"open_interest"`
+	Ticks        uint64   `json:"ticks"`
+	First        string   `json:"first"`
+	Last         string   `json:"last"`
+	Range        float64  `json:"range"`
+	RangePct     float64  `json:"range_pct"`
+	Change       *float64 `json:"change"`
+	ChangePct    *float64 `json:"change_pct"`
+}
+
+// ClickHouse中 time 所属交易日的表达式，与 webTradingDay 一致：20:00以后归入次日，周六、周日顺延到周一
+func webTradingDayExpr(column string) string {
+	shifted := fmt.Sprintf("toDate(%s + INTERVAL %d HOUR)", column, 24-SESSION_CUTOFF_HOUR)
+	return fmt.Sprintf("%s + multiIf(toDayOfWeek(%s) = 6, 2, toDayOfWeek(%s) = 7, 1, 0)", shifted, shifted, shifted)
+}
+
+// 查询最近 days 个交易日的日统计，按交易日降序。一条 GROUP BY 查询完成，多取一天只用来计算首日的涨跌
+func webQueryDailyStats(ctx context.Context, table, symbol string, days int) ([]webDailyStats, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	var rows []webDailyStats
+	if webDemoMode() {
+		rows = webDemoDailyStats(symbol, days+1)
+	} else {
+		if err := webCheckCatalog(ctx, table, symbol); err != nil {
+			return nil, err
+		}
+		if err := webValidateSchema(ctx, table); err != nil {
+			return nil, err
+		}
+		latest, err := webAdjacentTickTime(ctx, table, symbol, time.Time{}, true)
+		if err != nil {
+			return nil, err
+		}
+		if latest.IsZero() {
+			return []webDailyStats{}, nil
+		}
+
+		// 按每周5个交易日折算日历天数，再留出节假日的余量，避免扫描整张表
+		from := webTradingDay(latest).AddDate(0, 0, -(days+1)*7/5-20)
+		query, err := webSelect(ctx,
+			"toString("+webTradingDayExpr("time")+") AS day",
+			"toFloat64(argMin(price, (time, datetime))) AS open",
+			"toFloat64(max(price)) AS high",
+			"toFloat64(min(price)) AS low",
+			"toFloat64(argMax(price, (time, datetime))) AS close",
+			"toFloat64(if(sum(diff_vol) > 0, sum(price * diff_vol) / sum(diff_vol), argMax(price, (time, datetime)))) AS settle",
+			"toInt64(sum(diff_vol)) AS volume",
+			"toInt64(sum(diff_oi)) AS oi_change",
+			"toInt64(argMax(open_interest, (time, datetime))) AS open_interest",
+			"count() AS ticks",
+			"toString(min(time)) AS first",
+			"toString(max(time)) AS last").
+			From(table).
+			Symbol(symbol).
+			TimeRange(from, latest.Add(time.Second)).
+			GroupBy("day").
+			OrderBy("day DESC").
+			Limit(days + 1).
+			Settings("output_format_json_quote_64bit_integers = 0").
+			Format("JSONEachRow").
+			Build()
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := webExecuteQueryContext(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("query failed: %w", err)
+		}
+		for _, line := range strings.Split(result, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			var row webDailyStats
+			if err := json.Unmarshal([]byte(line), &row); err != nil {
+				return nil, fmt.Errorf("failed to parse daily row: %w", err)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return webFinishDailyStats(rows, symbol, days), nil
+}
+
+// 补上振幅和涨跌（rows 按交易日降序），价格按最小变动价位取整，只保留最近 days 天
+func webFinishDailyStats(rows []webDailyStats, symbol string, days int) []webDailyStats {
+	for i := range rows {
+		row := &rows[i]
+		for _, p := range []*float64{&row.Open, &row.High, &row.Low, &row.Close, &row.Settle} {
+			*p = webPriceValue(float32(*p), symbol)
+		}
+		row.Range = row.High - row.Low
+		if row.Low > 0 {
+			row.RangePct = row.Range / row.Low * 100
+		}
+		if i+1 < len(rows) && rows[i+1].Close != 0 {
+			prev := webPriceValue(float32(rows[i+1].Close), symbol)
+			change := row.Close - prev
+			pct := change / prev * 100
+			row.Change, row.ChangePct = &change, &pct
+		}
+	}
+	if len(rows) > days {
+		rows = rows[:days]
+	}
+	if rows == nil {
+		rows = []webDailyStats{}
+	}
+	return rows
+}
+
+// 日统计数据：/daily/data?table=jm&symbol=jm2509&days=20
+func webDailyDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	days := DAILY_DEFAULT_DAYS
+	if s := q.Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > DAILY_MAX_DAYS {
+			fail(fmt.Sprintf("days参数无效，需为1到%d之间的整数", DAILY_MAX_DAYS))
+			return
+		}
+		days = n
+	}
+
+	rows, err := webQueryDailyStats(r.Context(), table, symbol, days)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":  table,
+		"symbol": symbol,
+		"days":   rows,
+	})
+}
+
+// 日统计页面的HTML模板 (templates/daily.html)
+const webDailyTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>交易日统计</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        .table-wrapper {
+            overflow-x: auto;
+        }
+        table {
+            border-collapse: collapse;
+            width: 100%;
+            font-size: 13px;
+        }
+        th, td {
+            border-bottom: 1px solid #eee;
+            padding: 6px 10px;
+            text-align: right;
+            white-space: nowrap;
+        }
+        th:first-child, td:first-child {
+            text-align: left;
+        }
+        tbody tr {
+            cursor: pointer;
+        }
+        tbody tr:hover {
+            background-color: #f0f6ff;
+        }
+        .up {
+            color: #dc3545;
+        }
+        .down {
+            color: #28a745;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>交易日统计</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" placeholder="默认取symbol字母前缀"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>交易日数</label><input id="days" type="number" min="1" max="250" value="20"></div>
+            <button onclick="loadDaily()">查询</button>
+        </div>
+        <div class="table-wrapper">
+            <table>
+                <thead>
+                    <tr>
+                        <th>交易日</th><th>开盘</th><th>最高</th><th>最低</th><th>收盘</th><th>结算</th><th>涨跌</th><th>涨跌幅</th>
+                        <th>振幅</th><th>振幅%</th><th>成交量</th><th>持仓变化</th><th>收盘持仓</th><th>tick数</th>
+                    </tr>
+                </thead>
+                <tbody id="rows"></tbody>
+            </table>
+        </div>
+        <div class="status" id="status">点击任意一行在主页面查看该交易日的tick图</div>
+    </div>
+    <script>
+        const params = new URLSearchParams(location.search);
+        ['table', 'symbol', 'days'].forEach(id => {
+            if (params.get(id)) document.getElementById(id).value = params.get(id);
+        });
+
+        const num = v => Number(v).toLocaleString();
+        const signed = (v, digits) => v === null ? '—' : (v > 0 ? '+' : '') + (digits === undefined ? num(v) : v.toFixed(digits));
+        const trend = v => v > 0 ? 'up' : (v < 0 ? 'down' : '');
+
+        function addCell(row, text, className) {
+            const td = row.insertCell();
+            td.textContent = text;
+            if (className) td.className = className;
+        }
+
+        function loadDaily() {
+            const query = new URLSearchParams();
+            ['table', 'symbol', 'days'].forEach(id => query.set(id, document.getElementById(id).value.trim()));
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/daily/data?' + query.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+
+                    const tbody = document.getElementById('rows');
+                    tbody.innerHTML = '';
+                    data.days.forEach(day => {
+                        const row = tbody.insertRow();
+                        row.title = day.first + ' ~ ' + day.last + '，点击查看该交易日的tick图';
+                        row.onclick = () => window.open('/?' + new URLSearchParams({
+                            table: data.table, symbol: data.symbol, range: 'session:' + day.day
+                        }).toString());
+                        addCell(row, day.day);
+                        [day.open, day.high, day.low, day.close, day.settle].forEach(v => addCell(row, num(v)));
+                        addCell(row, signed(day.change), trend(day.change));
+                        addCell(row, day.change_pct === null ? '—' : signed(day.change_pct, 2) + '%', trend(day.change_pct));
+                        addCell(row, num(day.range));
+                        addCell(row, day.range_pct.toFixed(2) + '%');
+                        addCell(row, num(day.volume));
+                        addCell(row, signed(day.oi_change), trend(day.oi_change));
+                        addCell(row, num(day.open_interest));
+                        addCell(row, num(day.ticks));
+                    });
+
+                    document.getElementById('status').textContent = data.symbol.toUpperCase() + ' | ' + data.days.length +
+                        ' 个交易日 | 点击任意一行在主页面查看该交易日的tick图';
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+
+        loadDaily();
+    </script>
+</body>
+</html>`
+
+// 日统计页面：每行一个交易日，点击行在主页面打开该交易日的tick图（range=session:日期）
+func webDailyHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("daily.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 日盘收盘时间，之后到当晚夜盘开始前摘要横幅显示当日的收盘和结算
+const SESSION_CLOSE_HOUR = 15
+
+// 开盘/收盘摘要横幅：当前交易日还没有成交时（盘前）显示上一交易日的结算和收盘，交易中显示开盘相对前结算的跳空、
+// 当日区间和持仓相对上一交易日收盘的变化，日盘收盘后补上当日结算价。数据来自 webQueryDailyStats 的按交易日汇总
+type webSessionSummary struct {
+	Symbol       string   `json:"symbol"`
+	Day          string   `json:"day"`   // 当前交易日
+	Phase        string   `json:"phase"` // pre_open 盘前、open 交易中、closed 日盘已收盘
+	PrevDay      string   `json:"prev_day,omitempty"`
+	PrevSettle   *float64 `json:"prev_settle"`
+	PrevClose    *float64 `json:"prev_close"`
+	Open         *float64 `json:"open"`
+	Gap          *float64 `json:"gap"` // 开盘价减前结算
+	GapPct       *float64 `json:"gap_pct"`
+	High         *float64 `json:"high"`
+	Low          *float64 `json:"low"`
+	Last         *float64 `json:"last"`
+	Settle       *float64 `json:"settle"` // 收盘后才有
+	OpenInterest *int64   `json:"open_interest"`
+	OIChange     *int64   `json:"oi_change"`
+}
+
+// 由按交易日降序的日统计得到 now 时刻的摘要，rows[0] 是当前交易日时为交易中或已收盘，否则为盘前
+func webBuildSessionSummary(symbol string, rows []webDailyStats, now time.Time) webSessionSummary {
+	today := webTradingDay(now)
+	summary := webSessionSummary{Symbol: symbol, Day: today.Format("2006-01-02"), Phase: "pre_open"}
+	var cur, prev *webDailyStats
+	if len(rows) > 0 && rows[0].Day == summary.Day {
+		cur = &rows[0]
+		if len(rows) > 1 {
+			prev = &rows[1]
+		}
+	} else if len(rows) > 0 {
+		prev = &rows[0]
+	}
+
+	if prev != nil {
+		settle, prevClose, oi := prev.Settle, prev.Close, prev.OpenInterest
+		summary.PrevDay = prev.Day
+		summary.PrevSettle, summary.PrevClose, summary.OpenInterest = &settle, &prevClose, &oi
+	}
+	if cur == nil {
+		return summary
+	}
+
+	summary.Phase = "open"
+	if !now.Before(today.Add(SESSION_CLOSE_HOUR * time.Hour)) {
+		summary.Phase = "closed"
+		settle := cur.Settle
+		summary.Settle = &settle
+	}
+	open, high, low, last, oi := cur.Open, cur.High, cur.Low, cur.Close, cur.OpenInterest
+	summary.Open, summary.High, summary.Low, summary.Last, summary.OpenInterest = &open, &high, &low, &last, &oi
+	if prev != nil {
+		if prev.Settle != 0 {
+			gap := webPriceValue(float32(open-prev.Settle), symbol)
+			pct := gap / prev.Settle * 100
+			summary.Gap, summary.GapPct = &gap, &pct
+		}
+		change := cur.OpenInterest - prev.OpenInterest
+		summary.OIChange = &change
+	}
+	return summary
+}
+
+// 开盘/收盘摘要：/summary/data?table=jm&symbol=jm2509
+func webSummaryDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "缺少symbol参数"})
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	rows, err := webQueryDailyStats(r.Context(), table, symbol, 2)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("查询失败: %v", err)})
+		return
+	}
+	json.NewEncoder(w).Encode(webBuildSessionSummary(symbol, rows, time.Now().In(webServerLocation())))
+}
+
+// 日内均值带：最近N个交易日在每个日内时段相对当日开盘的平均涨跌幅和成交量，叠加在当天的走势上
+const (
+	PROFILE_DEFAULT_SESSIONS = 20
+	PROFILE_MAX_SESSIONS     = 120
+	PROFILE_DEFAULT_SLOT     = 5 * time.Minute
+)
+
+// 一个交易日的一个日内时段：时段内第一笔和最后一笔的价格，以及成交量
+type webProfileBucket struct {
+	Day    string  `json:"day"`
+	Slot   string  `json:"slot"`
+	Open   float64 `json:"open"`
+	Close  float64 `json:"close"`
+	Volume int64   `json:"volume"`
+}
+
+// 一个日内时段的历史均值。价格为时段收盘相对当日开盘的涨跌幅（%），CumVolumeMean 为截至该时段末的平均累计成交量；
+// Today* 为目标交易日的实际值，还没有走到的时段为 null
+type webProfileSlot struct {
+	Slot           string   `json:"slot"`
+	Sessions       int      `json:"sessions"`
+	PriceMean      float64  `json:"price_mean"`
+	PriceStd       float64  `json:"price_std"`
+	VolumeMean     float64  `json:"volume_mean"`
+	CumVolumeMean  float64  `json:"cum_volume_mean"`
+	TodayPrice     *float64 `json:"today_price"`
+	TodayCumVolume *int64   `json:"today_cum_volume"`
+}
+
+type webProfile struct {
+	Table         string           `json:"table"`
+	Symbol        string           `json:"symbol"`
+	Day           string           `json:"day"`
+	SessionFrom   string           `json:"session_from"`
+	SessionTo     string           `json:"session_to"`
+	SlotMinutes   int              `json:"slot_minutes"`
+	Open          *float64         `json:"open"`
+	Sessions      []string         `json:"sessions"`
+	Slots         []webProfileSlot `json:"slots"`
+	LatestSlot    string           `json:"latest_slot"`
+	TodayVolume   int64            `json:"today_volume"`
+	TypicalVolume float64          `json:"typical_volume"`
+}
+
+// 日内时段在交易日内的先后：夜盘（20:00以后）排在日盘之前
+func webProfileSlotOrder(slot string) int {
+	var hour, minute int
+	fmt.Sscanf(slot, "%d:%d", &hour, &minute)
+	return (hour*60 + minute + (24-SESSION_CUTOFF_HOUR)*60) % (24 * 60)
+}
+
+// 在ClickHouse中按 交易日 × 日内时段 汇总首末价格和成交量，一条 GROUP BY 查询完成
+func webQueryProfileBuckets(ctx context.Context, table, symbol string, from, to time.Time, slot time.Duration) ([]webProfileBucket, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	if webDemoMode() {
+		return webDemoProfileBuckets(symbol, from, to, slot), nil
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	query, err := webSelect(ctx,
+		"toString("+webTradingDayExpr("time")+") AS day",
+		"formatDateTime("+webIntervalStart("time", slot)+", '%H:%M') AS slot",
+		"toFloat64(argMin(price, (time, datetime))) AS open",
+		"toFloat64(argMax(price, (time, datetime))) AS close",
+		"toInt64(sum(diff_vol)) AS volume").
+		From(table).
+		Symbol(symbol).
+		TimeRange(from, to).
+		GroupBy("day", "slot").
+		OrderBy("day ASC", "slot ASC").
+		Settings("output_format_json_quote_64bit_integers = 0").
+		Format("JSONEachRow").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	buckets := []webProfileBucket{}
+	for _, line := range strings.Split(result, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var bucket webProfileBucket
+		if err := json.Unmarshal([]byte(line), &bucket); err != nil {
+			return nil, fmt.Errorf("failed to parse profile row: %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// 用目标交易日 day 之前最近 sessions 个交易日计算各时段的均值，并附上 day 当天的实际值。
+// 每个交易日的涨跌幅以当日第一个时段的开盘价为基准，不同价位的交易日可以直接平均
+func webBuildProfile(buckets []webProfileBucket, day string, sessions int) *webProfile {
+	byDay := map[string][]webProfileBucket{}
+	slotSet := map[string]bool{}
+	var history []string
+	for _, bucket := range buckets {
+		if bucket.Day > day {
+			continue
+		}
+		if _, ok := byDay[bucket.Day]; !ok && bucket.Day < day {
+			history = append(history, bucket.Day)
+		}
+		byDay[bucket.Day] = append(byDay[bucket.Day], bucket)
+		slotSet[bucket.Slot] = true
+	}
+	sort.Strings(history)
+	if len(history) > sessions {
+		history = history[len(history)-sessions:]
+	}
+
+	slots := make([]string, 0, len(slotSet))
+	for slot := range slotSet {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return webProfileSlotOrder(slots[i]) < webProfileSlotOrder(slots[j]) })
+
+	// 每个交易日在各时段的涨跌幅（没有成交的时段缺失）和累计成交量（沿用上一个时段的值）
+	type sessionProfile struct {
+		prices    map[string]float64
+		volumes   map[string]int64
+		cumVolume []int64
+		last      int
+	}
+	profileOf := func(rows []webProfileBucket) *sessionProfile {
+		sort.Slice(rows, func(i, j int) bool { return webProfileSlotOrder(rows[i].Slot) < webProfileSlotOrder(rows[j].Slot) })
+		p := &sessionProfile{prices: map[string]float64{}, volumes: map[string]int64{}, cumVolume: make([]int64, len(slots)), last: -1}
+		if len(rows) == 0 || rows[0].Open == 0 {
+			return p
+		}
+		open := rows[0].Open
+		for _, row := range rows {
+			p.prices[row.Slot] = (row.Close/open - 1) * 100
+			p.volumes[row.Slot] = row.Volume
+		}
+		var cum int64
+		for j, slot := range slots {
+			if v, ok := p.volumes[slot]; ok {
+				cum += v
+				p.last = j
+			}
+			p.cumVolume[j] = cum
+		}
+		return p
+	}
+
+	profiles := make([]*sessionProfile, len(history))
+	for i, d := range history {
+		profiles[i] = profileOf(byDay[d])
+	}
+	today := profileOf(byDay[day])
+
+	profile := &webProfile{Day: day, Sessions: history, Slots: make([]webProfileSlot, len(slots))}
+	if rows := byDay[day]; len(rows) > 0 {
+		open := rows[0].Open
+		profile.Open = &open
+	}
+	for j, slot := range slots {
+		s := webProfileSlot{Slot: slot}
+		var sum, sumSq, volume, cumVolume float64
+		for _, p := range profiles {
+			cumVolume += float64(p.cumVolume[j])
+			price, ok := p.prices[slot]
+			if !ok {
+				continue
+			}
+			s.Sessions++
+			sum += price
+			sumSq += price * price
+			volume += float64(p.volumes[slot])
+		}
+		if s.Sessions > 0 {
+			n := float64(s.Sessions)
+			s.PriceMean = sum / n
+			s.PriceStd = math.Sqrt(math.Max(0, sumSq/n-s.PriceMean*s.PriceMean))
+			s.VolumeMean = volume / n
+		}
+		if len(profiles) > 0 {
+			s.CumVolumeMean = cumVolume / float64(len(profiles))
+		}
+		if j <= today.last {
+			if price, ok := today.prices[slot]; ok {
+				s.TodayPrice = &price
+			}
+			cum := today.cumVolume[j]
+			s.TodayCumVolume = &cum
+		}
+		profile.Slots[j] = s
+	}
+	if today.last >= 0 {
+		latest := profile.Slots[today.last]
+		profile.LatestSlot = latest.Slot
+		profile.TodayVolume = *latest.TodayCumVolume
+		profile.TypicalVolume = latest.CumVolumeMean
+	}
+	return profile
+}
+
+// 日内均值带数据：/profile/data?table=jm&symbol=jm2509&sessions=20&slot=5m&at=2025-07-01 10:30:00
+// at 所在的交易日为目标交易日（默认取最新一笔数据），均值取其之前的 sessions 个交易日
+func webProfileDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	sessions := PROFILE_DEFAULT_SESSIONS
+	if s := q.Get("sessions"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > PROFILE_MAX_SESSIONS {
+			fail(fmt.Sprintf("sessions参数无效，需为1到%d之间的整数", PROFILE_MAX_SESSIONS))
+			return
+		}
+		sessions = n
+	}
+	slot := PROFILE_DEFAULT_SLOT
+	if s := q.Get("slot"); s != "" {
+		var err error
+		if slot, err = webParseRelativeRange(s); err != nil || slot < time.Minute || (24*time.Hour)%slot != 0 {
+			fail("slot参数无效，需为能整除一天的时段，如 1m、5m、15m、30m")
+			return
+		}
+	}
+
+	var at time.Time
+	if s := q.Get("at"); s != "" {
+		var err error
+		if at, err = webParseWallTime(s); err != nil {
+			fail(err.Error())
+			return
+		}
+	} else {
+		latest, err := webAdjacentTickTime(r.Context(), table, symbol, time.Time{}, true)
+		if err != nil {
+			fail(fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		if latest.IsZero() {
+			fail(fmt.Sprintf("%s 没有数据", symbol))
+			return
+		}
+		at = latest
+	}
+
+	// 按每周5个交易日折算日历天数，再留出节假日的余量
+	day := webTradingDay(at)
+	from, _ := webSessionBounds(day.AddDate(0, 0, -sessions*7/5-20))
+	sessionFrom, sessionTo := webSessionBounds(day)
+	buckets, err := webQueryProfileBuckets(r.Context(), table, symbol, from, sessionTo, slot)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+
+	profile := webBuildProfile(buckets, day.Format("2006-01-02"), sessions)
+	profile.Table, profile.Symbol = table, symbol
+	profile.SessionFrom = sessionFrom.Format("2006-01-02 15:04:05")
+	profile.SessionTo = sessionTo.Format("2006-01-02 15:04:05")
+	profile.SlotMinutes = int(slot / time.Minute)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// 日盘最早在该时刻之前开始，交易日当天更早的tick属于夜盘的凌晨部分
+const GHOST_DAY_START_HOUR = 8
+
+// 把参考交易日 refDay 的tick时间按时刻平移到目标交易日 day：日盘对应目标交易日当天，
+// 夜盘按距夜盘开始的日历天数对应目标交易日的夜盘（周一的夜盘在上周五，凌晨部分在周六）
+func webShiftToSession(t, refDay, day time.Time) time.Time {
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	base, target := refDay, day
+	if t.Before(refDay.Add(GHOST_DAY_START_HOUR * time.Hour)) {
+		refFrom, _ := webSessionBounds(refDay)
+		from, _ := webSessionBounds(day)
+		base = time.Date(refFrom.Year(), refFrom.Month(), refFrom.Day(), 0, 0, 0, 0, t.Location())
+		target = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, t.Location())
+	}
+	offset := int(math.Round(date.Sub(base).Hours() / 24))
+	return target.AddDate(0, 0, offset).Add(t.Sub(date))
+}
+
+// 参考交易日影子线：/ghost/data?table=jm&symbol=jm2509&date=2025-06-27&at=2025-07-01 10:30:00
+// 把 date 交易日的走势按时刻平移到 at 所在的交易日（默认取最新一笔数据），页面按主图每个点的时间 as-of 对齐，
+// 并以 open（参考日第一笔价格）为基准平移到当天的开盘价，实时跟踪时可以直接看出当天相对参考日的走法
+func webGhostDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if q.Get("date") == "" {
+		fail("缺少date参数（参考交易日，如 2025-06-27）")
+		return
+	}
+	refDay, _, err := webParseSessionRange(SESSION_RANGE_PREFIX + q.Get("date"))
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	var at time.Time
+	if s := q.Get("at"); s != "" {
+		if at, err = webParseWallTime(s); err != nil {
+			fail(err.Error())
+			return
+		}
+	} else {
+		latest, err := webAdjacentTickTime(r.Context(), table, symbol, time.Time{}, true)
+		if err != nil {
+			fail(fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		if latest.IsZero() {
+			fail(fmt.Sprintf("%s 没有数据", symbol))
+			return
+		}
+		at = latest
+	}
+	day := webTradingDay(at)
+	if day.Equal(refDay) {
+		fail("参考交易日不能是当前交易日")
+		return
+	}
+
+	refFrom, refTo := webSessionBounds(refDay)
+	data, err := webQueryMarketDataBetween(r.Context(), table, symbol, refFrom, refTo)
+	if err != nil {
+		fail(fmt.Sprintf("查询 %s 失败: %v", symbol, err))
+		return
+	}
+
+	type ghostPoint struct {
+		Time  string  `json:"time"`
+		Price float64 `json:"price"`
+	}
+	series := []ghostPoint{}
+	for _, record := range webSampleData(data, WEB_ZOOM_POINTS) {
+		price := webPriceValue(record.Price, record.Symbol)
+		t, err := webParseWallTime(record.Time)
+		if err != nil || math.IsNaN(price) || math.IsInf(price, 0) {
+			continue
+		}
+		series = append(series, ghostPoint{webShiftToSession(t, refDay, day).Format("2006-01-02 15:04:05"), price})
+	}
+	if len(series) == 0 {
+		fail(fmt.Sprintf("参考交易日 %s 没有 %s 的数据", refDay.Format("2006-01-02"), symbol))
+		return
+	}
+
+	sessionFrom, sessionTo := webSessionBounds(day)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":        table,
+		"symbol":       symbol,
+		"date":         refDay.Format("2006-01-02"),
+		"day":          day.Format("2006-01-02"),
+		"session_from": sessionFrom.Format("2006-01-02 15:04:05"),
+		"session_to":   sessionTo.Format("2006-01-02 15:04:05"),
+		"open":         series[0].Price,
+		"close":        series[len(series)-1].Price,
+		"data":         series,
+	})
+}
+
+// 波动率锥：不同回看窗口的已实现波动率在历史上的分位数分布，与当前值对比，判断眼下的波动处于历史什么位置
+const (
+	VOLCONE_DEFAULT_WINDOWS = "5,10,20,40,60,120"
+	VOLCONE_MAX_WINDOWS     = 12
+	VOLCONE_MAX_DAYS        = 3 * 366
+	VOLCONE_TRADING_DAYS    = 252 // 年化使用的每年交易日数
+)
+
+// 波动率锥绘制的分位数（%）
+var webVolConePercentiles = []float64{0, 10, 25, 50, 75, 90, 100}
+
+// 一根K线的收盘价
+type webBarClose struct {
+	Time  time.Time
+	Close float64
+}
+
+type webVolCone struct {
+	Windows     []int     `json:"windows"`
+	Percentiles []float64 `json:"percentiles"`
+	// Cone[i][j] 为第 i 个分位数在第 j 个窗口上的年化波动率（%），样本不足时为 null
+	Cone    [][]*float64 `json:"cone"`
+	Current []*float64   `json:"current"`
+	// 每个窗口可用的滚动样本数
+	Samples []int `json:"samples"`
+}
+
+// 按 bucket 粒度查询同一张表中若干合约的收盘价（每个区间最后一笔的价格），时间为区间起点。
+// 汇总在ClickHouse中完成，一张表只查询一次
+func webQueryBarCloses(ctx context.Context, table string, symbols []string, from, to time.Time, bucket time.Duration) (map[string][]webBarClose, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	closes := make(map[string][]webBarClose)
+	if webDemoMode() {
+		for _, symbol := range symbols {
+			var bars []webBarClose
+			for _, md := range webDemoTicks(symbol, from, to) {
+				t, _ := time.ParseInLocation("2006-01-02 15:04:05", md.Time, time.Local)
+				dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+				start := dayStart.Add(t.Sub(dayStart) / bucket * bucket)
+				if n := len(bars); n > 0 && bars[n-1].Time.Equal(start) {
+					bars[n-1].Close = float64(md.Price)
+				} else {
+					bars = append(bars, webBarClose{start, float64(md.Price)})
+				}
+			}
+			closes[symbol] = bars
+		}
+		return closes, nil
+	}
+	if err := webCheckCatalog(ctx, table, symbols...); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	query, err := webSelect(ctx,
+		"symbol",
+		"toString("+webIntervalStart("time", bucket)+") AS bucket",
+		"toFloat64(argMax(price, datetime)) AS close").
+		FromBars(table, to.Sub(from)).
+		Symbols(symbols).
+		TimeRange(from, to).
+		Where("price > 0").
+		GroupBy("symbol", "bucket").
+		OrderBy("symbol ASC", "bucket ASC").
+		Format("TabSeparated").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	loc := webServerLocation()
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", fields[1], loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bar time %q: %w", fields[1], err)
+		}
+		price, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bar close %q: %w", fields[2], err)
+		}
+		closes[fields[0]] = append(closes[fields[0]], webBarClose{t, price})
+	}
+	return closes, nil
+}
+
+// 把小时收盘价合并为交易日收盘价（夜盘归入下一交易日），时间为交易日零点
+func webTradingDayCloses(closes []webBarClose) []webBarClose {
+	var days []webBarClose
+	for _, c := range closes {
+		day := webTradingDay(c.Time)
+		if n := len(days); n > 0 && days[n-1].Time.Equal(day) {
+			days[n-1].Close = c.Close
+		} else {
+			days = append(days, webBarClose{day, c.Close})
+		}
+	}
+	return days
+}
+
+// 已排序样本的 p 分位数（0-100），相邻样本之间线性插值
+func webPercentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (sorted[lo+1]-sorted[lo])*(pos-float64(lo))
+}
+
+// 计算波动率锥：每个窗口 n 在全部历史上滚动计算 n 个对数收益率的样本标准差，按 periodsPerYear 年化，
+// 取各分位数；Current 为截至最后一根K线的窗口波动率
+func webVolatilityCone(closes []float64, windows []int, periodsPerYear float64) webVolCone {
+	cone := webVolCone{
+		Windows:     windows,
+		Percentiles: webVolConePercentiles,
+		Cone:        make([][]*float64, len(webVolConePercentiles)),
+		Current:     make([]*float64, len(windows)),
+		Samples:     make([]int, len(windows)),
+	}
+	for i := range cone.Cone {
+		cone.Cone[i] = make([]*float64, len(windows))
+	}
+
+	var returns []float64
+	for i := 1; i < len(closes); i++ {
+		if closes[i-1] > 0 && closes[i] > 0 {
+			returns = append(returns, math.Log(closes[i]/closes[i-1]))
+		}
+	}
+	// 前缀和，滚动窗口的方差 O(1) 计算
+	sum := make([]float64, len(returns)+1)
+	sumSq := make([]float64, len(returns)+1)
+	for i, r := range returns {
+		sum[i+1] = sum[i] + r
+		sumSq[i+1] = sumSq[i] + r*r
+	}
+
+	for j, n := range windows {
+		if n < 2 || len(returns) < n {
+			continue
+		}
+		vols := make([]float64, 0, len(returns)-n+1)
+		for end := n; end <= len(returns); end++ {
+			s, sq := sum[end]-sum[end-n], sumSq[end]-sumSq[end-n]
+			variance := (sq - s*s/float64(n)) / float64(n-1)
+			if variance < 0 {
+				variance = 0
+			}
+			vols = append(vols, math.Sqrt(variance*periodsPerYear)*100)
+		}
+		current := vols[len(vols)-1]
+		cone.Current[j] = &current
+		cone.Samples[j] = len(vols)
+		sort.Float64s(vols)
+		for i, p := range webVolConePercentiles {
+			v := webPercentile(vols, p)
+			cone.Cone[i][j] = &v
+		}
+	}
+	return cone
+}
+
+// 解析回看窗口列表，如 "5,10,20,60"，去重后按升序排列
+func webParseVolConeWindows(spec string) ([]int, error) {
+	if spec == "" {
+		spec = VOLCONE_DEFAULT_WINDOWS
+	}
+	seen := map[int]bool{}
+	var windows []int
+	for _, part := range strings.Split(spec, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 2 || n > 1000 {
+			return nil, fmt.Errorf("windows参数无效 %q，每个窗口为 2-1000 根K线", part)
+		}
+		if !seen[n] {
+			seen[n] = true
+			windows = append(windows, n)
+		}
+	}
+	if len(windows) > VOLCONE_MAX_WINDOWS {
+		return nil, fmt.Errorf("windows参数最多 %d 个窗口", VOLCONE_MAX_WINDOWS)
+	}
+	sort.Ints(windows)
+	return windows, nil
+}
+
+// 波动率锥数据：/volcone/data?table=jm&symbol=jm2509&from=2024-07-01&to=2025-06-30&bar=1d&windows=5,10,20,60
+func webVolConeDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	loc := webServerLocation()
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("开始日期格式无效: %q", q.Get("from")))
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("结束日期格式无效: %q", q.Get("to")))
+		return
+	}
+	to = to.AddDate(0, 0, 1)
+	if !to.After(from) {
+		fail("结束日期不能早于开始日期")
+		return
+	}
+	if to.Sub(from) > VOLCONE_MAX_DAYS*24*time.Hour {
+		fail(fmt.Sprintf("日期跨度不能超过%d天", VOLCONE_MAX_DAYS))
+		return
+	}
+
+	bar, barSpec := 24*time.Hour, "1d"
+	if s := q.Get("bar"); s != "" {
+		barSpec = s
+		if bar, err = webParseRelativeRange(s); err != nil || bar < time.Minute || (24*time.Hour)%bar != 0 {
+			fail("bar参数无效，需为 1d 或能整除一天的周期，如 5m、15m、1h")
+			return
+		}
+	}
+	windows, err := webParseVolConeWindows(q.Get("windows"))
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	// 日线按交易日归并小时收盘价，夜盘计入下一交易日
+	bucket := bar
+	if bar == 24*time.Hour {
+		bucket = time.Hour
+	}
+	bySymbol, err := webQueryBarCloses(r.Context(), table, []string{symbol}, from, to, bucket)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+	closes := bySymbol[symbol]
+	days := webTradingDayCloses(closes)
+	if bar == 24*time.Hour {
+		closes = days
+	}
+	if len(closes) < 3 {
+		fail(fmt.Sprintf("未找到表 %s 中 symbol = %s 足够的数据", table, symbol))
+		return
+	}
+
+	// 日内周期按实际的每日K线数年化，不同品种的交易时长不同
+	periodsPerYear := float64(VOLCONE_TRADING_DAYS)
+	if bar < 24*time.Hour {
+		periodsPerYear *= float64(len(closes)) / float64(len(days))
+	}
+	prices := make([]float64, len(closes))
+	for i, c := range closes {
+		prices[i] = c.Close
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":            table,
+		"symbol":           symbol,
+		"bar":              barSpec,
+		"from":             closes[0].Time.Format("2006-01-02 15:04:05"),
+		"to":               closes[len(closes)-1].Time.Format("2006-01-02 15:04:05"),
+		"bars":             len(closes),
+		"periods_per_year": periodsPerYear,
+		"cone":             webVolatilityCone(prices, windows, periodsPerYear),
+	})
+}
+
+// 波动率锥页面的HTML模板 (templates/volcone.html)
+const webVolConeTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>波动率锥</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        #chartContainer {
+            position: relative;
+            height: 450px;
+            margin-bottom: 20px;
+        }
+        table {
+            border-collapse: collapse;
+            margin: 0 auto 20px auto;
+            font-size: 13px;
+        }
+        th, td {
+            border: 1px solid #ddd;
+            padding: 6px 10px;
+            text-align: right;
+        }
+        th {
+            background-color: #f8f9fa;
+        }
+        tr.current td {
+            color: #dc3545;
+            font-weight: bold;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>波动率锥</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" placeholder="默认取symbol字母前缀"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>开始日期</label><input id="from" type="date"></div>
+            <div><label>结束日期</label><input id="to" type="date"></div>
+            <div><label>K线周期</label>
+                <select id="bar">
+                    <option value="1d" selected>日线</option>
+                    <option value="1h">1小时</option>
+                    <option value="15m">15分钟</option>
+                    <option value="5m">5分钟</option>
+                </select>
+            </div>
+            <div><label>回看窗口 (K线数)</label><input id="windows" value="5,10,20,40,60,120"></div>
+            <button onclick="loadCone()">生成</button>
+        </div>
+        <div id="chartContainer"><canvas id="coneChart"></canvas></div>
+        <table id="coneTable"></table>
+        <div class="status" id="status">选择合约和日期范围后点击生成</div>
+    </div>
+    <script>
+        const today = new Date();
+        const yearAgo = new Date(today.getTime() - 365 * 24 * 3600 * 1000);
+        document.getElementById('to').value = today.toISOString().slice(0, 10);
+        document.getElementById('from').value = yearAgo.toISOString().slice(0, 10);
+
+        // 对称的分位数使用相同颜色，越靠近中位数颜色越深
+        const percentileStyles = {
+            0: { color: 'rgba(108, 117, 125, 0.6)', dash: [4, 4] },
+            10: { color: 'rgba(0, 123, 255, 0.5)', dash: [] },
+            25: { color: 'rgba(0, 123, 255, 0.8)', dash: [] },
+            50: { color: 'rgb(52, 58, 64)', dash: [] },
+            75: { color: 'rgba(0, 123, 255, 0.8)', dash: [] },
+            90: { color: 'rgba(0, 123, 255, 0.5)', dash: [] },
+            100: { color: 'rgba(108, 117, 125, 0.6)', dash: [4, 4] }
+        };
+
+        function percentileLabel(p) {
+            return p === 0 ? '最小值' : p === 100 ? '最大值' : p === 50 ? '中位数' : p + '%分位';
+        }
+
+        const chart = new Chart(document.getElementById('coneChart').getContext('2d'), {
+            type: 'line',
+            data: { labels: [], datasets: [] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                spanGaps: false,
+                scales: {
+                    x: { title: { display: true, text: '回看窗口 (K线数)' } },
+                    y: { title: { display: true, text: '年化波动率 (%)' } }
+                },
+                plugins: {
+                    tooltip: {
+                        callbacks: {
+                            label: ctx => ctx.dataset.label + ': ' + (ctx.parsed.y === null ? '-' : ctx.parsed.y.toFixed(2) + '%')
+                        }
+                    }
+                }
+            }
+        });
+
+        function format(value) {
+            return value === null ? '-' : value.toFixed(2);
+        }
+
+        function loadCone() {
+            const params = new URLSearchParams();
+            ['table', 'symbol', 'from', 'to', 'bar', 'windows'].forEach(id => params.set(id, document.getElementById(id).value));
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/volcone/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+
+                    const cone = data.cone;
+                    chart.data.labels = cone.windows.map(String);
+                    chart.data.datasets = cone.percentiles.map((p, i) => ({
+                        label: percentileLabel(p),
+                        data: cone.cone[i],
+                        borderColor: percentileStyles[p].color,
+                        borderDash: percentileStyles[p].dash,
+                        borderWidth: p === 50 ? 2 : 1,
+                        pointRadius: 0,
+                        fill: false
+                    }));
+                    chart.data.datasets.push({
+                        label: '当前',
+                        data: cone.current,
+                        borderColor: 'rgb(220, 53, 69)',
+                        backgroundColor: 'rgb(220, 53, 69)',
+                        borderWidth: 3,
+                        pointRadius: 4
+                    });
+                    chart.update();
+
+                    const table = document.getElementById('coneTable');
+                    table.innerHTML = '';
+                    const head = table.insertRow();
+                    head.appendChild(document.createElement('th')).textContent = '窗口';
+                    cone.windows.forEach(n => head.appendChild(document.createElement('th')).textContent = n);
+                    cone.percentiles.forEach((p, i) => {
+                        const row = table.insertRow();
+                        row.appendChild(document.createElement('th')).textContent = percentileLabel(p);
+                        cone.cone[i].forEach(v => row.insertCell().textContent = format(v));
+                    });
+                    const current = table.insertRow();
+                    current.className = 'current';
+                    current.appendChild(document.createElement('th')).textContent = '当前';
+                    cone.current.forEach(v => current.insertCell().textContent = format(v));
+                    const samples = table.insertRow();
+                    samples.appendChild(document.createElement('th')).textContent = '样本数';
+                    cone.samples.forEach(n => samples.insertCell().textContent = n);
+
+                    document.getElementById('status').textContent = data.symbol.toUpperCase() + ' | ' + data.bars + ' 根K线 (' +
+                        data.bar + ') | ' + data.from + ' ~ ' + data.to + ' | 年化系数 ' + Math.round(data.periods_per_year);
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+    </script>
+</body>
+</html>`
+
+// 波动率锥页面：横轴为回看窗口，各分位数连成锥形，当前波动率单独标出
+func webVolConeHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("volcone.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 相关性矩阵：一篮子合约按相同的K线周期对齐后，两两计算对数收益率的相关系数
+const (
+	CORR_DEFAULT_BUCKET = 5 * time.Minute
+	CORR_MAX_SYMBOLS    = 20
+	CORR_MAX_BUCKETS    = 100000 // 时间跨度/周期的上限，避免分钟线跨多年时数据量过大
+)
+
+type webCorrelationMatrix struct {
+	Symbols []string `json:"symbols"`
+	// Matrix[i][j] 为合约 i 与 j 的收益率相关系数，共同样本不足或收益率恒定时为 null
+	Matrix [][]*float64 `json:"matrix"`
+	// Counts[i][j] 为参与计算的共同收益率个数
+	Counts [][]int `json:"counts"`
+}
+
+// 在所有合约收盘价时间的并集上对齐：相邻两个时间点都有收盘价时计算对数收益率，否则记为缺失。
+// 每对合约只使用双方都有收益率的时间点（成对删除），不同品种的夜盘时长不同也不影响其他配对
+func webComputeCorrelationMatrix(symbols []string, closes map[string][]webBarClose) webCorrelationMatrix {
+	var times []time.Time
+	seen := map[time.Time]bool{}
+	for _, symbol := range symbols {
+		for _, bar := range closes[symbol] {
+			if !seen[bar.Time] {
+				seen[bar.Time] = true
+				times = append(times, bar.Time)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	index := make(map[time.Time]int, len(times))
+	for i, t := range times {
+		index[t] = i
+	}
+
+	returns := make([][]float64, len(symbols))
+	for k, symbol := range symbols {
+		grid := make([]float64, len(times))
+		for i := range grid {
+			grid[i] = math.NaN()
+		}
+		for _, bar := range closes[symbol] {
+			if bar.Close > 0 {
+				grid[index[bar.Time]] = bar.Close
+			}
+		}
+		returns[k] = make([]float64, len(times))
+		returns[k][0] = math.NaN()
+		for i := 1; i < len(times); i++ {
+			returns[k][i] = math.Log(grid[i] / grid[i-1]) // 任一端缺失时为NaN
+		}
+	}
+
+	m := webCorrelationMatrix{
+		Symbols: symbols,
+		Matrix:  make([][]*float64, len(symbols)),
+		Counts:  make([][]int, len(symbols)),
+	}
+	for i := range symbols {
+		m.Matrix[i] = make([]*float64, len(symbols))
+		m.Counts[i] = make([]int, len(symbols))
+	}
+	for i := range symbols {
+		for j := i; j < len(symbols); j++ {
+			n := 0
+			for t := range times {
+				if !math.IsNaN(returns[i][t]) && !math.IsNaN(returns[j][t]) {
+					n++
+				}
+			}
+			m.Counts[i][j], m.Counts[j][i] = n, n
+			if c := webLaggedCorrelation(returns[i], returns[j], 0); !math.IsNaN(c) {
+				if i == j {
+					c = 1
+				}
+				m.Matrix[i][j], m.Matrix[j][i] = &c, &c
+			}
+		}
+	}
+	return m
+}
+
+// 解析合约列表 "jm2509,j2509,i/i2509"：表名默认取合约代码的字母前缀，按表分组以便每张表只查询一次
+func webParseSymbolBasket(spec string) (symbols []string, tables map[string][]string, order []string, err error) {
+	tables = make(map[string][]string)
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		table, symbol, ok := strings.Cut(item, "/")
+		if !ok {
+			table, symbol = strings.ToLower(strings.TrimRight(item, "0123456789")), item
+		}
+		if !webIsIdentifier(table) || symbol == "" {
+			return nil, nil, nil, fmt.Errorf("无效的合约 %q，格式为 symbol 或 table/symbol", item)
+		}
+		if seen[symbol] {
+			continue
+		}
+		seen[symbol] = true
+		if _, ok := tables[table]; !ok {
+			order = append(order, table)
+		}
+		tables[table] = append(tables[table], symbol)
+		symbols = append(symbols, symbol)
+	}
+	if len(symbols) < 2 {
+		return nil, nil, nil, fmt.Errorf("至少需要两个合约")
+	}
+	if len(symbols) > CORR_MAX_SYMBOLS {
+		return nil, nil, nil, fmt.Errorf("合约数量不能超过%d个", CORR_MAX_SYMBOLS)
+	}
+	return symbols, tables, order, nil
+}
+
+// 相关性矩阵数据：/correlation/data?symbols=jm2509,j2509,i2509&from=2025-06-01&to=2025-06-30&bucket=5m
+func webCorrelationDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	symbols, tables, order, err := webParseSymbolBasket(q.Get("symbols"))
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	loc := webServerLocation()
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("开始日期格式无效: %q", q.Get("from")))
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("结束日期格式无效: %q", q.Get("to")))
+		return
+	}
+	to = to.AddDate(0, 0, 1)
+	if !to.After(from) {
+		fail("结束日期不能早于开始日期")
+		return
+	}
+
+	bucket, bucketSpec := CORR_DEFAULT_BUCKET, "5m"
+	if s := q.Get("bucket"); s != "" {
+		bucketSpec = s
+		if bucket, err = webParseRelativeRange(s); err != nil || bucket < time.Minute || (24*time.Hour)%bucket != 0 {
+			fail("bucket参数无效，需为 1d 或能整除一天的周期，如 1m、5m、1h")
+			return
+		}
+	}
+	if n := to.Sub(from) / bucket; n > CORR_MAX_BUCKETS {
+		fail(fmt.Sprintf("时间跨度内的K线过多 (%d)，请缩短日期范围或增大bucket", n))
+		return
+	}
+
+	// 日线按交易日归并小时收盘价，夜盘计入下一交易日
+	queryBucket := bucket
+	if bucket == 24*time.Hour {
+		queryBucket = time.Hour
+	}
+	closes := make(map[string][]webBarClose)
+	for _, table := range order {
+		bySymbol, err := webQueryBarCloses(r.Context(), table, tables[table], from, to, queryBucket)
+		if err != nil {
+			fail(fmt.Sprintf("查询表 %s 失败: %v", table, err))
+			return
+		}
+		for symbol, bars := range bySymbol {
+			if bucket == 24*time.Hour {
+				bars = webTradingDayCloses(bars)
+			}
+			closes[symbol] = bars
+		}
+	}
+	var missing []string
+	for _, symbol := range symbols {
+		if len(closes[symbol]) < 2 {
+			missing = append(missing, symbol)
+		}
+	}
+	if len(missing) > 0 {
+		fail(fmt.Sprintf("以下合约在该日期范围内数据不足: %s", strings.Join(missing, ", ")))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":        from.Format("2006-01-02"),
+		"to":          to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"bucket":      bucketSpec,
+		"correlation": webComputeCorrelationMatrix(symbols, closes),
+	})
+}
+
+// 相关性矩阵页面的HTML模板 (templates/correlation.html)
+const webCorrelationTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>相关性矩阵</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        #symbols {
+            width: 320px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        .matrix-wrapper {
+            overflow-x: auto;
+            display: flex;
+            justify-content: center;
+        }
+        table {
+            border-collapse: collapse;
+            font-size: 12px;
+        }
+        th, td {
+            border: 1px solid #eee;
+            padding: 8px;
+            text-align: center;
+            white-space: nowrap;
+            min-width: 48px;
+        }
+        td.empty {
+            background-color: #fafafa;
+            color: #aaa;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>相关性矩阵</h1>
+        <div class="query-controls">
+            <div><label>合约 (逗号分隔，可写 table/symbol)</label><input id="symbols" value="jm2509,j2509,i2509"></div>
+            <div><label>开始日期</label><input id="from" type="date"></div>
+            <div><label>结束日期</label><input id="to" type="date"></div>
+            <div><label>K线周期</label>
+                <select id="bucket">
+                    <option value="1m">1分钟</option>
+                    <option value="5m" selected>5分钟</option>
+                    <option value="15m">15分钟</option>
+                    <option value="1h">1小时</option>
+                    <option value="1d">日线</option>
+                </select>
+            </div>
+            <button onclick="loadMatrix()">生成</button>
+        </div>
+        <div class="matrix-wrapper"><table id="matrix"></table></div>
+        <div class="status" id="status">输入合约和日期范围后点击生成</div>
+    </div>
+    <script>
+        const today = new Date();
+        const monthAgo = new Date(today.getTime() - 30 * 24 * 3600 * 1000);
+        document.getElementById('to').value = today.toISOString().slice(0, 10);
+        document.getElementById('from').value = monthAgo.toISOString().slice(0, 10);
+        const initialSymbols = new URLSearchParams(window.location.search).get('symbols');
+        if (initialSymbols) document.getElementById('symbols').value = initialSymbols;
+
+        function cellColor(value) {
+            const alpha = Math.min(1, Math.abs(value)).toFixed(2);
+            return value >= 0 ? 'rgba(220, 53, 69, ' + alpha + ')' : 'rgba(0, 123, 255, ' + alpha + ')';
+        }
+
+        function loadMatrix() {
+            const params = new URLSearchParams();
+            ['symbols', 'from', 'to', 'bucket'].forEach(id => params.set(id, document.getElementById(id).value));
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/correlation/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+
+                    const corr = data.correlation;
+                    const names = corr.symbols.map(s => s.toUpperCase());
+                    const table = document.getElementById('matrix');
+                    table.innerHTML = '';
+                    const head = table.insertRow();
+                    head.appendChild(document.createElement('th'));
+                    names.forEach(name => head.appendChild(document.createElement('th')).textContent = name);
+
+                    corr.matrix.forEach((values, i) => {
+                        const row = table.insertRow();
+                        row.appendChild(document.createElement('th')).textContent = names[i];
+                        values.forEach((value, j) => {
+                            const td = row.insertCell();
+                            td.title = names[i] + ' / ' + names[j] + ' | 共同样本 ' + corr.counts[i][j].toLocaleString();
+                            if (value === null) {
+                                td.className = 'empty';
+                                td.textContent = '-';
+                                return;
+                            }
+                            td.textContent = value.toFixed(2);
+                            td.style.backgroundColor = cellColor(value);
+                            if (Math.abs(value) > 0.6) td.style.color = 'white';
+                        });
+                    });
+
+                    document.getElementById('status').textContent = names.length + ' 个合约 | ' + data.from + ' ~ ' + data.to +
+                        ' | ' + data.bucket + ' 对数收益率';
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+    </script>
+</body>
+</html>`
+
+// 相关性矩阵页面：正相关红色、负相关蓝色，颜色深浅按相关系数绝对值
+func webCorrelationHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("correlation.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 基差图：期货收盘价减去同一时间的现货/指数价格，现货序列来自另一张表（与行情表结构相同）
+const BASIS_MAX_BARS = 100000
+
+// 各品种默认的现货序列，由 -basis-spot 配置，键为期货的表名
+var webBasisSpot = map[string]webDatasetKey{}
+
+// 解析 -basis-spot：jm=spot/jm_tangshan,i=spot/i_pb62，等号左边为期货表名，右边为现货的 table/symbol
+func webParseBasisSpot(list string) (map[string]webDatasetKey, error) {
+	spots := make(map[string]webDatasetKey)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		product, spec, ok := strings.Cut(item, "=")
+		if !ok || !webIsIdentifier(product) {
+			return nil, fmt.Errorf("invalid basis spot %q, expected product=table/symbol", item)
+		}
+		table, symbol, ok := strings.Cut(spec, "/")
+		if !ok || !webIsIdentifier(table) || symbol == "" {
+			return nil, fmt.Errorf("invalid basis spot %q, expected product=table/symbol", item)
+		}
+		spots[product] = webDatasetKey{table, symbol, "all"}
+	}
+	return spots, nil
+}
+
+type webBasisPoint struct {
+	Time    string  `json:"time"`
+	Futures float64 `json:"futures"`
+	Spot    float64 `json:"spot"`
+	Basis   float64 `json:"basis"`
+}
+
+type webBasisStats struct {
+	Count  int     `json:"count"`
+	Latest float64 `json:"latest"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	// 最新基差相对区间均值的标准分，以及区间内不高于最新基差的样本占比（%）
+	ZScore     float64 `json:"zscore"`
+	Percentile float64 `json:"percentile"`
+	// 最新基差占现货价格的比例（%）
+	LatestRatePct float64 `json:"latest_rate_pct"`
+}
+
+// 按期货K线时间对齐现货：取不晚于该时间的最近一个现货价格（现货通常按日发布，频率低于期货），
+// 第一个现货价格之前的期货K线不计算基差
+func webComputeBasis(futures, spot []webBarClose, layout string) ([]webBasisPoint, webBasisStats) {
+	points := []webBasisPoint{}
+	var stats webBasisStats
+	j := -1
+	for _, bar := range futures {
+		for j+1 < len(spot) && !spot[j+1].Time.After(bar.Time) {
+			j++
+		}
+		if j < 0 || spot[j].Close <= 0 {
+			continue
+		}
+		points = append(points, webBasisPoint{
+			Time:    bar.Time.Format(layout),
+			Futures: bar.Close,
+			Spot:    spot[j].Close,
+			Basis:   bar.Close - spot[j].Close,
+		})
+	}
+	if len(points) == 0 {
+		return points, stats
+	}
+
+	stats.Count = len(points)
+	stats.Min, stats.Max = math.Inf(1), math.Inf(-1)
+	var sum, sumSq float64
+	for _, p := range points {
+		sum += p.Basis
+		sumSq += p.Basis * p.Basis
+		stats.Min = math.Min(stats.Min, p.Basis)
+		stats.Max = math.Max(stats.Max, p.Basis)
+	}
+	n := float64(len(points))
+	stats.Mean = sum / n
+	stats.StdDev = math.Sqrt(math.Max(sumSq/n-stats.Mean*stats.Mean, 0))
+
+	last := points[len(points)-1]
+	stats.Latest = last.Basis
+	stats.LatestRatePct = last.Basis / last.Spot * 100
+	if stats.StdDev > 0 {
+		stats.ZScore = (last.Basis - stats.Mean) / stats.StdDev
+	}
+	below := 0
+	for _, p := range points {
+		if p.Basis <= last.Basis {
+			below++
+		}
+	}
+	stats.Percentile = float64(below) / n * 100
+	return points, stats
+}
+
+// 基差数据：/basis/data?table=jm&symbol=jm2509&spot=spot/jm_tangshan&from=2025-01-01&to=2025-06-30&bar=1d
+// spot 缺省时使用 -basis-spot 中该品种的配置
+func webBasisDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if !webIsIdentifier(table) {
+		fail(fmt.Sprintf("无效的表名 %q", table))
+		return
+	}
+
+	spot, ok := webBasisSpot[table]
+	if spec := q.Get("spot"); spec != "" {
+		spotTable, spotSymbol, found := strings.Cut(spec, "/")
+		if !found || !webIsIdentifier(spotTable) || spotSymbol == "" {
+			fail(fmt.Sprintf("spot参数无效 %q，格式为 table/symbol", spec))
+			return
+		}
+		spot, ok = webDatasetKey{spotTable, spotSymbol, "all"}, true
+	}
+	if !ok {
+		fail(fmt.Sprintf("品种 %s 没有配置现货序列，请用 spot=table/symbol 指定或在启动时配置 -basis-spot", table))
+		return
+	}
+
+	priceFormat, err := webParsePriceFormat(r, symbol)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	loc := webServerLocation()
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("开始日期格式无效: %q", q.Get("from")))
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), loc)
+	if err != nil {
+		fail(fmt.Sprintf("结束日期格式无效: %q", q.Get("to")))
+		return
+	}
+	to = to.AddDate(0, 0, 1)
+	if !to.After(from) {
+		fail("结束日期不能早于开始日期")
+		return
+	}
+
+	bar, barSpec := 24*time.Hour, "1d"
+	if s := q.Get("bar"); s != "" {
+		barSpec = s
+		if bar, err = webParseRelativeRange(s); err != nil || bar < time.Minute || (24*time.Hour)%bar != 0 {
+			fail("bar参数无效，需为 1d 或能整除一天的周期，如 5m、15m、1h")
+			return
+		}
+	}
+	if n := to.Sub(from) / bar; n > BASIS_MAX_BARS {
+		fail(fmt.Sprintf("时间跨度内的K线过多 (%d)，请缩短日期范围或增大bar", n))
+		return
+	}
+
+	// 日线按交易日归并小时收盘价，夜盘计入下一交易日；现货序列同样处理，两边按交易日对齐
+	bucket, layout := bar, "2006-01-02 15:04"
+	if bar == 24*time.Hour {
+		bucket, layout = time.Hour, "2006-01-02"
+	}
+	closes := make(map[webDatasetKey][]webBarClose)
+	for _, key := range []webDatasetKey{{table, symbol, "all"}, spot} {
+		bySymbol, err := webQueryBarCloses(r.Context(), key.table, []string{key.symbol}, from, to, bucket)
+		if err != nil {
+			fail(fmt.Sprintf("查询 %s/%s 失败: %v", key.table, key.symbol, err))
+			return
+		}
+		bars := bySymbol[key.symbol]
+		if bar == 24*time.Hour {
+			bars = webTradingDayCloses(bars)
+		}
+		if len(bars) == 0 {
+			fail(fmt.Sprintf("%s/%s 在该日期范围内没有数据", key.table, key.symbol))
+			return
+		}
+		closes[key] = bars
+	}
+
+	points, stats := webComputeBasis(closes[webDatasetKey{table, symbol, "all"}], closes[spot], layout)
+	for i := range points {
+		points[i].Futures = priceFormat.round(points[i].Futures, 0)
+		points[i].Spot = priceFormat.round(points[i].Spot, 0)
+		points[i].Basis = priceFormat.round(points[i].Basis, 0)
+	}
+	stats.Latest = priceFormat.round(stats.Latest, 0)
+	stats.Min = priceFormat.round(stats.Min, 0)
+	stats.Max = priceFormat.round(stats.Max, 0)
+	stats.Mean = priceFormat.round(stats.Mean, 2)
+	stats.StdDev = priceFormat.round(stats.StdDev, 2)
+	stats.ZScore = math.Round(stats.ZScore*100) / 100
+	stats.Percentile = math.Round(stats.Percentile*10) / 10
+	stats.LatestRatePct = math.Round(stats.LatestRatePct*100) / 100
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":  table,
+		"symbol": symbol,
+		"spot":   spot.table + "/" + spot.symbol,
+		"from":   from.Format("2006-01-02"),
+		"to":     to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"bar":    barSpec,
+		"data":   points,
+		"stats":  stats,
+	})
+}
+
+// 基差页面的HTML模板 (templates/basis.html)
+const webBasisTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>基差</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        #chartContainer {
+            position: relative;
+            height: 450px;
+            margin-bottom: 20px;
+        }
+        .stats {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 10px;
+            margin-bottom: 10px;
+        }
+        .stat {
+            background-color: #f8f9fa;
+            border-radius: 5px;
+            padding: 8px 14px;
+            text-align: center;
+            min-width: 90px;
+        }
+        .stat .label {
+            font-size: 12px;
+            color: #6c757d;
+        }
+        .stat .value {
+            font-size: 16px;
+            font-weight: bold;
+            color: #333;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>基差</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" placeholder="默认取symbol字母前缀"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>现货/指数 (table/symbol)</label><input id="spot" placeholder="默认按 -basis-spot 配置"></div>
+            <div><label>开始日期</label><input id="from" type="date"></div>
+            <div><label>结束日期</label><input id="to" type="date"></div>
+            <div><label>K线周期</label>
+                <select id="bar">
+                    <option value="1d" selected>日线</option>
+                    <option value="1h">1小时</option>
+                    <option value="15m">15分钟</option>
+                    <option value="5m">5分钟</option>
+                </select>
+            </div>
+            <button onclick="loadBasis()">生成</button>
+        </div>
+        <div class="stats" id="stats"></div>
+        <div id="chartContainer"><canvas id="basisChart"></canvas></div>
+        <div class="status" id="status">选择合约和日期范围后点击生成</div>
+    </div>
+    <script>
+        const today = new Date();
+        const halfYearAgo = new Date(today.getTime() - 182 * 24 * 3600 * 1000);
+        document.getElementById('to').value = today.toISOString().slice(0, 10);
+        document.getElementById('from').value = halfYearAgo.toISOString().slice(0, 10);
+
+        const chart = new Chart(document.getElementById('basisChart').getContext('2d'), {
+            data: { labels: [], datasets: [] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                interaction: { mode: 'index', intersect: false },
+                scales: {
+                    x: { ticks: { maxTicksLimit: 12 } },
+                    y: { position: 'left', title: { display: true, text: '价格' } },
+                    basis: { position: 'right', title: { display: true, text: '基差 (期货-现货)' }, grid: { drawOnChartArea: false } }
+                }
+            }
+        });
+
+        function renderStats(stats) {
+            const items = [
+                ['最新基差', stats.latest], ['基差率', stats.latest_rate_pct + '%'], ['均值', stats.mean],
+                ['标准差', stats.stddev], ['最小', stats.min], ['最大', stats.max],
+                ['Z分数', stats.zscore], ['历史分位', stats.percentile + '%'], ['样本数', stats.count]
+            ];
+            const container = document.getElementById('stats');
+            container.innerHTML = '';
+            items.forEach(([label, value]) => {
+                const item = container.appendChild(document.createElement('div'));
+                item.className = 'stat';
+                item.appendChild(document.createElement('div')).className = 'label';
+                item.lastChild.textContent = label;
+                item.appendChild(document.createElement('div')).className = 'value';
+                item.lastChild.textContent = value;
+            });
+        }
+
+        function loadBasis() {
+            const params = new URLSearchParams();
+            ['table', 'symbol', 'spot', 'from', 'to', 'bar'].forEach(id => {
+                const value = document.getElementById(id).value.trim();
+                if (value) params.set(id, value);
+            });
+            document.getElementById('status').textContent = '正在查询...';
+
+            fetch('/basis/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+                    if (data.data.length === 0) {
+                        document.getElementById('status').textContent = '期货和现货序列在该日期范围内没有重叠';
+                        return;
+                    }
+
+                    chart.data.labels = data.data.map(p => p.time);
+                    chart.data.datasets = [
+                        {
+                            type: 'bar',
+                            label: '基差',
+                            yAxisID: 'basis',
+                            data: data.data.map(p => p.basis),
+                            backgroundColor: data.data.map(p => p.basis >= 0 ? 'rgba(220, 53, 69, 0.35)' : 'rgba(40, 167, 69, 0.35)'),
+                            order: 2
+                        },
+                        {
+                            type: 'line',
+                            label: data.symbol.toUpperCase() + ' 期货',
+                            yAxisID: 'y',
+                            data: data.data.map(p => p.futures),
+                            borderColor: 'rgb(0, 123, 255)',
+                            borderWidth: 1.5,
+                            pointRadius: 0,
+                            order: 1
+                        },
+                        {
+                            type: 'line',
+                            label: data.spot + ' 现货',
+                            yAxisID: 'y',
+                            data: data.data.map(p => p.spot),
+                            borderColor: 'rgb(255, 140, 0)',
+                            borderWidth: 1.5,
+                            pointRadius: 0,
+                            stepped: true,
+                            order: 1
+                        }
+                    ];
+                    chart.update();
+                    renderStats(data.stats);
+
+                    document.getElementById('status').textContent = data.symbol.toUpperCase() + ' - ' + data.spot + ' | ' +
+                        data.stats.count + ' 根K线 (' + data.bar + ') | ' + data.from + ' ~ ' + data.to;
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+    </script>
+</body>
+</html>`
+
+// 基差页面：期货和现货价格使用左侧坐标轴，基差单独使用右侧坐标轴
+func webBasisHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("basis.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 期限结构：同一品种所有在市合约在某一时刻的价格按交割月份排列，相邻合约之间计算年化展期收益率
+const (
+	TERM_DEFAULT_LOOKBACK = 3 * 24 * time.Hour // 快照取每个合约在该时长内的最后一笔成交，覆盖周末
+	TERM_MAX_LOOKBACK     = 30 * 24 * time.Hour
+)
+
+// 一个合约在快照时刻的最新成交
+type webTermQuote struct {
+	Symbol       string
+	Price        float64
+	OpenInterest uint64
+	LastTime     string
+}
+
+type webTermPoint struct {
+	Symbol       string  `json:"symbol"`
+	Expiry       string  `json:"expiry"`
+	Price        float64 `json:"price"`
+	OpenInterest uint64  `json:"open_interest"`
+	LastTime     string  `json:"last_time"`
+	// 相对前一个合约的年化展期收益率（%），近月价格高于远月（升水结构）时为正；第一个合约为 null
+	RollYieldPct *float64 `json:"roll_yield_pct"`
+}
+
+type webTermStructure struct {
+	At     string         `json:"at"`
+	Points []webTermPoint `json:"points"`
+	// 最近月到最远月的年化展期收益率（%）
+	FrontBackRollPct *float64 `json:"front_back_roll_pct"`
+	// backwardation（逐月递减）、contango（逐月递增）、mixed 或 flat
+	Shape string `json:"shape"`
+}
+
+// 合约代码中的交割月份：jm2509 为2025年9月；郑商所的三位代码 SA509 只有年份末位，取 ref 起十年内对应的那一年
+func webContractExpiry(symbol string, ref time.Time) (time.Time, bool) {
+	_, code := webSplitSymbolCode(strings.ToLower(symbol))
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var year, month int
+	switch len(code) {
+	case 4:
+		year, month = 2000+n/100, n%100
+	case 3:
+		year, month = ref.Year()+(n/100-ref.Year()%10+10)%10, n%100
+	default:
+		return time.Time{}, false
+	}
+	if month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, ref.Location()), true
+}
+
+// 按交割月份排序并计算展期收益率。回看时长内有成交的合约都视为在市，无法识别交割月份的报价（如指数）不参与
+func webBuildTermStructure(quotes []webTermQuote, at time.Time) webTermStructure {
+	type dated struct {
+		quote  webTermQuote
+		expiry time.Time
+	}
+	var contracts []dated
+	for _, q := range quotes {
+		expiry, ok := webContractExpiry(q.Symbol, at)
+		if !ok || q.Price <= 0 {
+			continue
+		}
+		contracts = append(contracts, dated{q, expiry})
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i].expiry.Before(contracts[j].expiry) })
+
+	months := func(a, b time.Time) int {
+		return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+	}
+	rollYield := func(near, far dated) *float64 {
+		m := months(near.expiry, far.expiry)
+		if m <= 0 {
+			return nil
+		}
+		v := math.Log(near.quote.Price/far.quote.Price) * 12 / float64(m) * 100
+		return &v
+	}
+
+	ts := webTermStructure{At: at.Format("2006-01-02 15:04:05"), Points: []webTermPoint{}, Shape: "flat"}
+	rising, falling := false, false
+	for i, c := range contracts {
+		point := webTermPoint{
+			Symbol:       c.quote.Symbol,
+			Expiry:       c.expiry.Format("2006-01"),
+			Price:        c.quote.Price,
+			OpenInterest: c.quote.OpenInterest,
+			LastTime:     c.quote.LastTime,
+		}
+		if i > 0 {
+			point.RollYieldPct = rollYield(contracts[i-1], c)
+			rising = rising || c.quote.Price > contracts[i-1].quote.Price
+			falling = falling || c.quote.Price < contracts[i-1].quote.Price
+		}
+		ts.Points = append(ts.Points, point)
+	}
+	if len(contracts) >= 2 {
+		ts.FrontBackRollPct = rollYield(contracts[0], contracts[len(contracts)-1])
+	}
+	switch {
+	case rising && falling:
+		ts.Shape = "mixed"
+	case rising:
+		ts.Shape = "contango"
+	case falling:
+		ts.Shape = "backwardation"
+	}
+	return ts
+}
+
+// 查询 (at-lookback, at] 内每个合约的最后一笔成交，整个品种只用一次按合约分组的查询
+func webQueryTermQuotes(ctx context.Context, table string, at time.Time, lookback time.Duration) ([]webTermQuote, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	var quotes []webTermQuote
+	if webDemoMode() {
+		for _, symbol := range webDemoSymbols[table] {
+			ticks := webDemoTicks(symbol, at.Add(-lookback), at.Add(time.Second))
+			if len(ticks) == 0 {
+				continue
+			}
+			last := ticks[len(ticks)-1]
+			quotes = append(quotes, webTermQuote{symbol, webPriceValue(last.Price, symbol), uint64(last.OpenInterest), last.Time})
+		}
+		return quotes, nil
+	}
+	if err := webCheckCatalog(ctx, table); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	query, err := webSelect(ctx,
+		"symbol",
+		"toFloat64(argMax(price, datetime)) AS last_price",
+		"toUInt64(argMax(open_interest, datetime)) AS last_oi",
+		"toString(max(time)) AS last_time").
+		FromBars(table, lookback).
+		Where("time > " + webDateTime(at.Add(-lookback))).
+		Where("time <= " + webDateTime(at)).
+		Where("price > 0").
+		GroupBy("symbol").
+		Format("TabSeparated").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		price, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse price %q: %w", fields[1], err)
+		}
+		oi, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse open interest %q: %w", fields[2], err)
+		}
+		quotes = append(quotes, webTermQuote{fields[0], webPriceValue(float32(price), fields[0]), oi, fields[3]})
+	}
+	return quotes, nil
+}
+
+// 表中最新的成交时间，作为默认的快照时刻
+func webLatestTickTime(ctx context.Context, table string) (time.Time, error) {
+	if webDemoMode() {
+		return time.Now().Truncate(time.Second), nil
+	}
+	if err := webCheckCatalog(ctx, table); err != nil {
+		return time.Time{}, err
+	}
+	query, err := webSelect(ctx, "toString(max(time))").From(table).Format("TabSeparated").Build()
+	if err != nil {
+		return time.Time{}, err
+	}
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query failed: %w", err)
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", strings.TrimSpace(result), webServerLocation())
+}
+
+// 期限结构快照：/termstructure/data?table=jm&at=2025-07-01 15:00:00&lookback=3d，at 缺省为表中最新的成交时间
+func webTermStructureDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table := q.Get("table")
+	if !webIsIdentifier(table) {
+		fail(fmt.Sprintf("无效的表名 %q", table))
+		return
+	}
+
+	lookback := TERM_DEFAULT_LOOKBACK
+	if s := q.Get("lookback"); s != "" {
+		d, err := webParseRelativeRange(s)
+		if err != nil || d <= 0 || d > TERM_MAX_LOOKBACK {
+			fail(fmt.Sprintf("lookback参数无效 %q，应为 1h-30d，如 1d、3d", s))
+			return
+		}
+		lookback = d
+	}
+
+	var at time.Time
+	var err error
+	if s := q.Get("at"); s != "" {
+		at, err = webParseWallTime(s)
+	} else {
+		at, err = webLatestTickTime(r.Context(), table)
+	}
+	if err != nil {
+		fail(fmt.Sprintf("快照时间无效: %v", err))
+		return
+	}
+
+	quotes, err := webQueryTermQuotes(r.Context(), table, at, lookback)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+
+	ts := webBuildTermStructure(quotes, at)
+	round := func(v *float64) {
+		if v != nil {
+			*v = math.Round(*v*100) / 100
+		}
+	}
+	for _, point := range ts.Points {
+		round(point.RollYieldPct)
+	}
+	round(ts.FrontBackRollPct)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":     table,
+		"lookback":  lookback.String(),
+		"structure": ts,
+	})
+}
+
+// 期限结构页面的HTML模板 (templates/termstructure.html)
+const webTermStructureTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>期限结构</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        .player {
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            gap: 10px;
+            margin-bottom: 20px;
+        }
+        #stepSlider {
+            width: 50%;
+        }
+        #chartContainer {
+            position: relative;
+            height: 450px;
+            margin-bottom: 20px;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>期限结构</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" value="jm"></div>
+            <div><label>回看时长</label><input id="lookback" value="3d" size="4"></div>
+            <button onclick="loadLatest()">最新</button>
+            <div><label>开始时间</label><input id="from" type="datetime-local"></div>
+            <div><label>结束时间</label><input id="to" type="datetime-local"></div>
+            <div><label>步长</label>
+                <select id="step">
+                    <option value="3600">1小时</option>
+                    <option value="14400">4小时</option>
+                    <option value="86400" selected>1天</option>
+                    <option value="604800">1周</option>
+                </select>
+            </div>
+            <button onclick="buildSteps()">生成时间轴</button>
+        </div>
+        <div class="player">
+            <button onclick="stepBy(-1)">◀</button>
+            <button onclick="togglePlay()" id="playButton">播放</button>
+            <button onclick="stepBy(1)">▶</button>
+            <input type="range" id="stepSlider" min="0" max="0" value="0" oninput="showStep(Number(this.value))">
+            <span id="stepLabel"></span>
+        </div>
+        <div id="chartContainer"><canvas id="termChart"></canvas></div>
+        <div class="status" id="status">加载中...</div>
+    </div>
+    <script>
+        const PLAY_INTERVAL_MS = 800;
+        const shapeLabels = { backwardation: '升水结构 (近高远低)', contango: '贴水结构 (近低远高)', mixed: '混合结构', flat: '平坦' };
+        let steps = [];
+        let currentStep = 0;
+        let playTimer = null;
+        const snapshots = new Map();
+
+        function localInput(date) {
+            return new Date(date.getTime() - date.getTimezoneOffset() * 60000).toISOString().slice(0, 16);
+        }
+        const now = new Date();
+        document.getElementById('to').value = localInput(now);
+        document.getElementById('from').value = localInput(new Date(now.getTime() - 30 * 24 * 3600 * 1000));
+
+        const chart = new Chart(document.getElementById('termChart').getContext('2d'), {
+            data: { labels: [], datasets: [] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                animation: { duration: 300 },
+                interaction: { mode: 'index', intersect: false },
+                scales: {
+                    x: { title: { display: true, text: '交割月份' } },
+                    y: { position: 'left', title: { display: true, text: '价格' } },
+                    roll: { position: 'right', title: { display: true, text: '年化展期收益率 (%)' }, grid: { drawOnChartArea: false } }
+                },
+                plugins: {
+                    tooltip: {
+                        callbacks: {
+                            afterBody: items => {
+                                const point = items.length ? items[0].chart.termPoints[items[0].dataIndex] : null;
+                                return point ? '最新成交 ' + point.last_time + ' | 持仓 ' + point.open_interest.toLocaleString() : '';
+                            }
+                        }
+                    }
+                }
+            }
+        });
+
+        function fetchSnapshot(at) {
+            const key = at || 'latest';
+            if (snapshots.has(key)) return Promise.resolve(snapshots.get(key));
+            const params = new URLSearchParams({
+                table: document.getElementById('table').value.trim(),
+                lookback: document.getElementById('lookback').value.trim()
+            });
+            if (at) params.set('at', at);
+            return fetch('/termstructure/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (!data.error) snapshots.set(key, data);
+                    return data;
+                });
+        }
+
+        function render(data) {
+            if (data.error) {
+                document.getElementById('status').textContent = '错误: ' + data.error;
+                return;
+            }
+            const ts = data.structure;
+            chart.termPoints = ts.points;
+            chart.data.labels = ts.points.map(p => p.symbol.toUpperCase() + ' (' + p.expiry + ')');
+            chart.data.datasets = [
+                {
+                    type: 'line',
+                    label: '价格',
+                    yAxisID: 'y',
+                    data: ts.points.map(p => p.price),
+                    borderColor: 'rgb(0, 123, 255)',
+                    backgroundColor: 'rgb(0, 123, 255)',
+                    pointRadius: 4,
+                    order: 1
+                },
+                {
+                    type: 'bar',
+                    label: '相对前一合约的年化展期收益率',
+                    yAxisID: 'roll',
+                    data: ts.points.map(p => p.roll_yield_pct),
+                    backgroundColor: ts.points.map(p => p.roll_yield_pct >= 0 ? 'rgba(220, 53, 69, 0.4)' : 'rgba(40, 167, 69, 0.4)'),
+                    order: 2
+                }
+            ];
+            chart.update();
+
+            let text = data.table.toUpperCase() + ' | ' + ts.at + ' | ' + ts.points.length + ' 个合约 | ' + shapeLabels[ts.shape];
+            if (ts.front_back_roll_pct !== null) text += ' | 近远月年化展期收益率 ' + ts.front_back_roll_pct.toFixed(2) + '%';
+            document.getElementById('status').textContent = text;
+        }
+
+        function loadLatest() {
+            stopPlay();
+            snapshots.clear();
+            document.getElementById('status').textContent = '正在查询...';
+            fetchSnapshot(null).then(render).catch(error => {
+                document.getElementById('status').textContent = '查询失败: ' + error.message;
+            });
+        }
+
+        function buildSteps() {
+            stopPlay();
+            snapshots.clear();
+            const from = new Date(document.getElementById('from').value);
+            const to = new Date(document.getElementById('to').value);
+            const step = Number(document.getElementById('step').value) * 1000;
+            steps = [];
+            for (let t = from.getTime(); t <= to.getTime() && steps.length < 1000; t += step) {
+                steps.push(localInput(new Date(t)).replace('T', ' ') + ':00');
+            }
+            const slider = document.getElementById('stepSlider');
+            slider.max = Math.max(steps.length - 1, 0);
+            if (steps.length > 0) showStep(0);
+        }
+
+        function showStep(i) {
+            if (i < 0 || i >= steps.length) return Promise.resolve();
+            currentStep = i;
+            document.getElementById('stepSlider').value = i;
+            document.getElementById('stepLabel').textContent = (i + 1) + '/' + steps.length + ' ' + steps[i];
+            return fetchSnapshot(steps[i]).then(data => {
+                if (i === currentStep) render(data);
+            }).catch(error => {
+                document.getElementById('status').textContent = '查询失败: ' + error.message;
+            });
+        }
+
+        function stepBy(delta) {
+            stopPlay();
+            showStep(currentStep + delta);
+        }
+
+        // 自动播放时等上一个快照加载完再前进，查询较慢时不会积压请求
+        function togglePlay() {
+            if (playTimer !== null) {
+                stopPlay();
+                return;
+            }
+            if (steps.length === 0) buildSteps();
+            if (currentStep >= steps.length - 1) currentStep = -1;
+            document.getElementById('playButton').textContent = '暂停';
+            const tick = () => {
+                if (currentStep >= steps.length - 1) {
+                    stopPlay();
+                    return;
+                }
+                showStep(currentStep + 1).then(() => {
+                    if (playTimer !== null) playTimer = setTimeout(tick, PLAY_INTERVAL_MS);
+                });
+            };
+            playTimer = setTimeout(tick, 0);
+        }
+
+        function stopPlay() {
+            if (playTimer !== null) clearTimeout(playTimer);
+            playTimer = null;
+            document.getElementById('playButton').textContent = '播放';
+        }
+
+        const initialTable = new URLSearchParams(window.location.search).get('table');
+        if (initialTable) document.getElementById('table').value = initialTable;
+        loadLatest();
+    </script>
+</body>
+</html>`
+
+// 期限结构页面：默认显示最新时刻，选择时间范围和步长后可以逐步或自动播放各时刻的快照
+func webTermStructureHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("termstructure.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 盘口阶梯的参数：默认显示最新价上下各 DOM_DEFAULT_LEVELS 个价位，盘口最多识别到 DOM_MAX_DEPTH 档
+const (
+	DOM_DEFAULT_LEVELS = 10
+	DOM_MAX_LEVELS     = 50
+	DOM_MAX_DEPTH      = 10
+)
+
+// 一档挂单
+type webBookLevel struct {
+	Price  float64 `json:"price"`
+	Volume uint64  `json:"volume"`
+}
+
+// 某一时刻的盘口：Bids 从买一开始向下，Asks 从卖一开始向上
+type webBook struct {
+	Symbol string
+	Time   string
+	Price  float64
+	Depth  int
+	Bids   []webBookLevel
+	Asks   []webBookLevel
+}
+
+// 盘口阶梯中的一个价位
+type webLadderRow struct {
+	Price   float64 `json:"price"`
+	BidSize uint64  `json:"bid_size"`
+	AskSize uint64  `json:"ask_size"`
+	Last    bool    `json:"last,omitempty"`
+	BestBid bool    `json:"best_bid,omitempty"`
+	BestAsk bool    `json:"best_ask,omitempty"`
+}
+
+var (
+	webBookDepths      = make(map[string]int)
+	webBookDepthsMutex sync.Mutex
+)
+
+// 表中完整的盘口档数：从1开始连续存在 bid_k、bid_volumn_k、ask_k、ask_volumn_k 四列的最大 k。
+// 只有一档行情的表返回1，扩展了多档盘口列的表返回实际档数，结果按表缓存
+func webBookDepth(ctx context.Context, table string) (int, error) {
+	webBookDepthsMutex.Lock()
+	depth, ok := webBookDepths[table]
+	webBookDepthsMutex.Unlock()
+	if ok {
+		return depth, nil
+	}
+
+	types, err := webDescribeTable(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	for depth < DOM_MAX_DEPTH {
+		k := depth + 1
+		complete := true
+		for _, col := range []string{"bid_%d", "bid_volumn_%d", "ask_%d", "ask_volumn_%d"} {
+			if _, ok := types[fmt.Sprintf(col, k)]; !ok {
+				complete = false
+			}
+		}
+		if !complete {
+			break
+		}
+		depth = k
+	}
+	if depth == 0 {
+		return 0, fmt.Errorf("table %s has no bid_1/ask_1 book columns", webQualifiedTable(table))
+	}
+
+	webBookDepthsMutex.Lock()
+	webBookDepths[table] = depth
+	webBookDepthsMutex.Unlock()
+	return depth, nil
+}
+
+// 查询symbol最新一笔的盘口，按表中实际存在的档数读取各档价格和挂单量
+func webQueryBook(ctx context.Context, table, symbol string) (*webBook, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	if webDemoMode() {
+		if book := webDemoBook(symbol); book != nil {
+			return book, nil
+		}
+		return nil, fmt.Errorf("未找到表 %s 中 symbol = %s 的数据", table, symbol)
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+	depth, err := webBookDepth(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for k := 1; k <= depth; k++ {
+		columns = append(columns,
+			fmt.Sprintf("toFloat64(bid_%d) AS bid_%d", k, k),
+			fmt.Sprintf("toUInt64(bid_volumn_%d) AS bid_volumn_%d", k, k),
+			fmt.Sprintf("toFloat64(ask_%d) AS ask_%d", k, k),
+			fmt.Sprintf("toUInt64(ask_volumn_%d) AS ask_volumn_%d", k, k))
+	}
+	query, err := webSelect(ctx, append([]string{"symbol", "toString(time) AS time", "toFloat64(price) AS price"}, columns...)...).
+		From(table).
+		Symbol(symbol).
+		OrderBy("time DESC", "datetime DESC").
+		Limit(1).
+		Settings("output_format_json_quote_64bit_integers = 0").
+		Format("JSONEachRow").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	result = strings.TrimSpace(result)
+	if result == "" {
+		return nil, fmt.Errorf("未找到表 %s 中 symbol = %s 的数据", table, symbol)
+	}
+
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(result), &row); err != nil {
+		return nil, fmt.Errorf("failed to parse book row: %w", err)
+	}
+	book := &webBook{Depth: depth}
+	json.Unmarshal(row["symbol"], &book.Symbol)
+	json.Unmarshal(row["time"], &book.Time)
+	json.Unmarshal(row["price"], &book.Price)
+	for k := 1; k <= depth; k++ {
+		var bid, ask webBookLevel
+		json.Unmarshal(row[fmt.Sprintf("bid_%d", k)], &bid.Price)
+		json.Unmarshal(row[fmt.Sprintf("bid_volumn_%d", k)], &bid.Volume)
+		json.Unmarshal(row[fmt.Sprintf("ask_%d", k)], &ask.Price)
+		json.Unmarshal(row[fmt.Sprintf("ask_volumn_%d", k)], &ask.Volume)
+		// 价格为0表示该档没有挂单
+		if bid.Price > 0 {
+			book.Bids = append(book.Bids, bid)
+		}
+		if ask.Price > 0 {
+			book.Asks = append(book.Asks, ask)
+		}
+	}
+	return book, nil
+}
+
+// 以最新价为中心、上下各 levels 个最小变动价位排成价格阶梯（从高到低），在对应价位填入各档挂单量
+func webBuildLadder(book *webBook, tick float64, levels int) []webLadderRow {
+	center := int64(math.Round(book.Price / tick))
+	bids := make(map[int64]uint64)
+	asks := make(map[int64]uint64)
+	for _, level := range book.Bids {
+		bids[int64(math.Round(level.Price/tick))] += level.Volume
+	}
+	for _, level := range book.Asks {
+		asks[int64(math.Round(level.Price/tick))] += level.Volume
+	}
+	var bestBid, bestAsk int64
+	if len(book.Bids) > 0 {
+		bestBid = int64(math.Round(book.Bids[0].Price / tick))
+	}
+	if len(book.Asks) > 0 {
+		bestAsk = int64(math.Round(book.Asks[0].Price / tick))
+	}
+
+	rows := make([]webLadderRow, 0, 2*levels+1)
+	for i := levels; i >= -levels; i-- {
+		ticks := center + int64(i)
+		rows = append(rows, webLadderRow{
+			Price:   webTicksToPrice(ticks, tick),
+			BidSize: bids[ticks],
+			AskSize: asks[ticks],
+			Last:    i == 0,
+			BestBid: len(book.Bids) > 0 && ticks == bestBid,
+			BestAsk: len(book.Asks) > 0 && ticks == bestAsk,
+		})
+	}
+	return rows
+}
+
+// 盘口阶梯数据：/dom/data?table=jm&symbol=jm2509&levels=10，返回最新一笔的盘口排成的价格阶梯
+func webDomDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	levels := DOM_DEFAULT_LEVELS
+	if s := q.Get("levels"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > DOM_MAX_LEVELS {
+			fail(fmt.Sprintf("levels参数无效 (1-%d)", DOM_MAX_LEVELS))
+			return
+		}
+		levels = n
+	}
+
+	book, err := webQueryBook(r.Context(), table, symbol)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+
+	tick := webTickSizeFor(symbol)
+	if tick <= 0 {
+		prices := []float64{book.Price}
+		for _, level := range append(book.Bids, book.Asks...) {
+			prices = append(prices, level.Price)
+		}
+		if tick = webEstimateTickSize(prices); tick <= 0 {
+			fail(fmt.Sprintf("品种 %s 的最小变动价位未知，可以用 -tick-size 指定", symbol))
+			return
+		}
+	}
+	rows := webBuildLadder(book, tick, levels)
+	var maxSize uint64
+	for _, row := range rows {
+		if row.BidSize > maxSize {
+			maxSize = row.BidSize
+		}
+		if row.AskSize > maxSize {
+			maxSize = row.AskSize
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":     table,
+		"symbol":    book.Symbol,
+		"time":      book.Time,
+		"price":     book.Price,
+		"tick_size": tick,
+		"depth":     book.Depth,
+		"bids":      book.Bids,
+		"asks":      book.Asks,
+		"rows":      rows,
+		"max_size":  maxSize,
+	})
+}
+
+// 盘口阶梯页面的HTML模板 (templates/dom.html)
+const webDomTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>盘口阶梯</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 700px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+            width: 120px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 13px;
+            font-family: monospace;
+        }
+        th, td {
+            border-bottom: 1px solid #eee;
+            padding: 3px 8px;
+        }
+        td.size {
+            width: 40%;
+            position: relative;
+        }
+        td.bid {
+            text-align: right;
+        }
+        td.price {
+            text-align: center;
+            font-weight: bold;
+        }
+        .bar {
+            position: absolute;
+            top: 2px;
+            bottom: 2px;
+            opacity: 0.35;
+        }
+        td.bid .bar {
+            right: 0;
+            background-color: #28a745;
+        }
+        td.ask .bar {
+            left: 0;
+            background-color: #dc3545;
+        }
+        .size-text {
+            position: relative;
+        }
+        tr.last td.price {
+            background-color: #ffc107;
+        }
+        tr.best-bid td.bid, tr.best-ask td.ask {
+            font-weight: bold;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>盘口阶梯</h1>
+        <div class="query-controls">
+            <div><label>数据表名</label><input id="table" placeholder="默认取symbol字母前缀"></div>
+            <div><label>Symbol</label><input id="symbol" value="jm2509"></div>
+            <div><label>上下价位数</label><input id="levels" type="number" value="10" min="1" max="50"></div>
+            <button onclick="loadLadder()">查询</button>
+            <button onclick="toggleLive()" id="liveToggle">实时跟踪</button>
+        </div>
+        <table id="ladder"></table>
+        <div class="status" id="status">输入合约后点击查询</div>
+    </div>
+    <script>
+        const LIVE_INTERVAL = 1000;
+        let liveTimer = null;
+
+        function sizeCell(side, size, maxSize) {
+            const td = document.createElement('td');
+            td.className = 'size ' + side;
+            if (size > 0) {
+                const bar = document.createElement('div');
+                bar.className = 'bar';
+                bar.style.width = (maxSize ? size / maxSize * 100 : 0) + '%';
+                td.appendChild(bar);
+                const text = document.createElement('span');
+                text.className = 'size-text';
+                text.textContent = size.toLocaleString();
+                td.appendChild(text);
+            }
+            return td;
+        }
+
+        function loadLadder() {
+            const params = new URLSearchParams();
+            ['table', 'symbol', 'levels'].forEach(id => params.set(id, document.getElementById(id).value));
+
+            return fetch('/dom/data?' + params.toString())
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+                    const decimals = (String(data.tick_size).split('.')[1] || '').length;
+                    const table = document.getElementById('ladder');
+                    table.innerHTML = '';
+                    const head = table.insertRow();
+                    ['买量', '价格', '卖量'].forEach(name => head.appendChild(document.createElement('th')).textContent = name);
+                    data.rows.forEach(row => {
+                        const tr = table.insertRow();
+                        tr.className = [row.last ? 'last' : '', row.best_bid ? 'best-bid' : '', row.best_ask ? 'best-ask' : ''].join(' ');
+                        tr.appendChild(sizeCell('bid', row.bid_size, data.max_size));
+                        const price = tr.appendChild(document.createElement('td'));
+                        price.className = 'price';
+                        price.textContent = row.price.toFixed(decimals);
+                        tr.appendChild(sizeCell('ask', row.ask_size, data.max_size));
+                    });
+                    document.getElementById('status').textContent = data.symbol.toUpperCase() + ' | ' + data.time +
+                        ' | 最新价 ' + data.price.toFixed(decimals) + ' | 盘口 ' + data.depth + ' 档' +
+                        (liveTimer ? ' | 实时刷新中' : '');
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '查询失败: ' + error.message;
+                });
+        }
+
+        // 实时模式：上一次请求完成后再等待 LIVE_INTERVAL 发起下一次，慢查询时不会堆积请求
+        function poll() {
+            loadLadder().finally(() => {
+                if (liveTimer) {
+                    liveTimer = setTimeout(poll, LIVE_INTERVAL);
+                }
+            });
+        }
+
+        function toggleLive() {
+            if (liveTimer) {
+                clearTimeout(liveTimer);
+                liveTimer = null;
+                document.getElementById('liveToggle').textContent = '实时跟踪';
+                return;
+            }
+            document.getElementById('liveToggle').textContent = '停止实时';
+            liveTimer = setTimeout(poll, 0);
+        }
+
+        const params = new URLSearchParams(location.search);
+        ['table', 'symbol'].forEach(id => {
+            if (params.get(id)) document.getElementById(id).value = params.get(id);
+        });
+        if (params.get('symbol')) loadLadder();
+    </script>
+</body>
+</html>`
+
+// 盘口阶梯页面：中间一列为价格，左侧买量、右侧卖量，挂单量用横条表示，最新价所在行高亮；实时模式下每秒刷新
+func webDomHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("dom.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 领先滞后分析的默认参数：按1分钟对齐，最多计算前后30个周期
+const (
+	LEADLAG_DEFAULT_BUCKET  = time.Minute
+	LEADLAG_DEFAULT_MAX_LAG = 30
+	LEADLAG_MAX_BUCKETS     = 200000
+)
+
+// 可以参与相关性分析的字段
+func webSeriesValue(md WebMarketData, field string) (float64, bool) {
+	switch field {
+	case "price":
+		return webPriceValue(md.Price, md.Symbol), true
+	case "open_interest":
+		return float64(md.OpenInterest), true
+	case "vol":
+		return float64(md.Vol), true
+	case "diff_vol":
+		return float64(md.DiffVol), true
+	case "diff_oi":
+		return float64(md.DiffOI), true
+	case "bid_1":
+		return webPriceValue(md.Bid1, md.Symbol), true
+	case "ask_1":
+		return webPriceValue(md.Ask1, md.Symbol), true
+	}
+	return 0, false
+}
+
+// 把序列按 bucket 对齐到 [start, end] 的时间网格上，每格取不晚于格末的最后一个值（as-of），首个值之前为NaN
+func webResampleSeries(data []WebMarketData, field string, start time.Time, buckets int, bucket time.Duration) []float64 {
+	loc := webServerLocation()
+	values := make([]float64, buckets)
+	last := math.NaN()
+	j := 0
+	for i := range values {
+		bucketEnd := start.Add(time.Duration(i+1) * bucket)
+		for ; j < len(data); j++ {
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", data[j].Time, loc)
+			if err != nil {
+				continue
+			}
+			if !t.Before(bucketEnd) {
+				break
+			}
+			last, _ = webSeriesValue(data[j], field)
+		}
+		values[i] = last
+	}
+	return values
+}
+
+// 一阶差分，电平序列直接做相关会因共同趋势得到虚高的相关系数
+func webDiffSeries(values []float64) []float64 {
+	if len(values) < 2 {
+		return nil
+	}
+	diffs := make([]float64, len(values)-1)
+	for i := 1; i < len(values); i++ {
+		diffs[i-1] = values[i] - values[i-1]
+	}
+	return diffs
+}
+
+// a[t] 与 b[t+lag] 的皮尔逊相关系数，跳过NaN；有效样本不足时返回NaN
+func webLaggedCorrelation(a, b []float64, lag int) float64 {
+	var n, sumA, sumB, sumAA, sumBB, sumAB float64
+	for i := range a {
+		j := i + lag
+		if j < 0 || j >= len(b) || math.IsNaN(a[i]) || math.IsNaN(b[j]) {
+			continue
+		}
+		n++
+		sumA += a[i]
+		sumB += b[j]
+		sumAA += a[i] * a[i]
+		sumBB += b[j] * b[j]
+		sumAB += a[i] * b[j]
+	}
+	if n < 3 {
+		return math.NaN()
+	}
+	cov := sumAB/n - sumA/n*sumB/n
+	varA := sumAA/n - sumA/n*sumA/n
+	varB := sumBB/n - sumB/n*sumB/n
+	if varA <= 0 || varB <= 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(varA*varB)
+}
+
+// 领先滞后分析：/leadlag?symbol_a=jm2509&field_a=price&symbol_b=i2509&field_b=price&range=1d&bucket=1m&max_lag=30
+// 计算A在t时刻的变化与B在t+lag时刻变化的相关系数，最大值出现在正lag表示A领先B。
+// table_a/table_b 默认取合约代码的字母前缀；format=png 时返回滞后相关性曲线图
+func webLeadLagHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fail := func(msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	type seriesSpec struct {
+		table, symbol, field string
+	}
+	var specs [2]seriesSpec
+	for i, suffix := range []string{"_a", "_b"} {
+		spec := seriesSpec{q.Get("table" + suffix), q.Get("symbol" + suffix), q.Get("field" + suffix)}
+		if spec.symbol == "" {
+			fail("缺少symbol" + suffix + "参数")
+			return
+		}
+		if spec.table == "" {
+			spec.table = strings.ToLower(strings.TrimRight(spec.symbol, "0123456789"))
+		}
+		if spec.field == "" {
+			spec.field = "price"
+		}
+		if _, ok := webSeriesValue(WebMarketData{}, spec.field); !ok {
+			fail(fmt.Sprintf("不支持的字段 %s", spec.field))
+			return
+		}
+		specs[i] = spec
+	}
+
+	span, err := webParseRelativeRange(q.Get("range"))
+	if err != nil {
+		fail(fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+	bucket := LEADLAG_DEFAULT_BUCKET
+	if s := q.Get("bucket"); s != "" {
+		if bucket, err = webParseRelativeRange(s); err != nil || bucket <= 0 {
+			fail("bucket参数无效")
+			return
+		}
+	}
+	maxLag := LEADLAG_DEFAULT_MAX_LAG
+	if s := q.Get("max_lag"); s != "" {
+		if maxLag, err = strconv.Atoi(s); err != nil || maxLag < 1 || maxLag > 1000 {
+			fail("max_lag参数无效 (1-1000)")
+			return
+		}
+	}
+
+	var series [2][]WebMarketData
+	for i, spec := range specs {
+		if series[i], err = webQueryMarketDataDynamic(r.Context(), spec.table, spec.symbol, span); err != nil {
+			fail(fmt.Sprintf("查询 %s 失败: %v", spec.symbol, err))
+			return
+		}
+		if len(series[i]) < 2 {
+			fail(fmt.Sprintf("%s 数据不足", spec.symbol))
+			return
+		}
+	}
+
+	// 取两个序列时间上的重叠部分作为网格
+	loc := webServerLocation()
+	var start, end time.Time
+	for i := range series {
+		first, err1 := time.ParseInLocation("2006-01-02 15:04:05", series[i][0].Time, loc)
+		last, err2 := time.ParseInLocation("2006-01-02 15:04:05", series[i][len(series[i])-1].Time, loc)
+		if err1 != nil || err2 != nil {
+			fail("无法解析数据时间")
+			return
+		}
+		if i == 0 || first.After(start) {
+			start = first
+		}
+		if i == 0 || last.Before(end) {
+			end = last
+		}
+	}
+	start = start.Truncate(bucket)
+	buckets := int(end.Sub(start)/bucket) + 1
+	if buckets < maxLag+3 {
+		fail("两个序列的重叠时间太短，请扩大时间范围或缩小bucket")
+		return
+	}
+	if buckets > LEADLAG_MAX_BUCKETS {
+		fail(fmt.Sprintf("对齐后的数据点过多 (%d)，请增大bucket", buckets))
+		return
+	}
+
+	a := webDiffSeries(webResampleSeries(series[0], specs[0].field, start, buckets, bucket))
+	b := webDiffSeries(webResampleSeries(series[1], specs[1].field, start, buckets, bucket))
+
+	lags := make([]float64, 0, 2*maxLag+1)
+	corrs := make([]float64, 0, 2*maxLag+1)
+	bestLag, bestCorr := 0, 0.0
+	for lag := -maxLag; lag <= maxLag; lag++ {
+		c := webLaggedCorrelation(a, b, lag)
+		if math.IsNaN(c) {
+			continue
+		}
+		lags = append(lags, float64(lag))
+		corrs = append(corrs, c)
+		if math.Abs(c) > math.Abs(bestCorr) {
+			bestLag, bestCorr = lag, c
+		}
+	}
+	if len(lags) < 2 {
+		fail("有效数据不足，无法计算相关性")
+		return
+	}
+
+	title := fmt.Sprintf("%s %s vs %s %s (bucket %v)", strings.ToUpper(specs[0].symbol), specs[0].field,
+		strings.ToUpper(specs[1].symbol), specs[1].field, bucket)
+
+	if q.Get("format") == "png" {
+		graph := chart.Chart{
+			Font:   webChartFont(),
+			Title:  title,
+			Width:  600,
+			Height: 300,
+			TitleStyle: chart.Style{
+				FontSize: 10,
+			},
+			Background: chart.Style{
+				Padding: chart.Box{Top: 40, Left: 20, Right: 20, Bottom: 20},
+			},
+			XAxis: chart.XAxis{
+				Name:  "Lag (buckets, +: A leads)",
+				Style: chart.Style{FontSize: 8},
+			},
+			YAxis: chart.YAxis{
+				Name:  "Correlation",
+				Style: chart.Style{FontSize: 8},
+			},
+			Series: []chart.Series{
+				chart.ContinuousSeries{
+					Style: chart.Style{
+						StrokeColor: drawing.ColorBlue,
+						StrokeWidth: 2,
+						DotColor:    drawing.ColorBlue,
+						DotWidth:    2,
+					},
+					XValues: lags,
+					YValues: corrs,
+				},
+			},
+		}
+
+		webApplyNiceAxis(&graph.YAxis, webFindMin(corrs), webFindMax(corrs), webAxisPadding, false)
+
+		w.Header().Set("Content-Type", "image/png")
+		if err := graph.Render(chart.PNG, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"title":     title,
+		"bucket":    bucket.String(),
+		"points":    len(a),
+		"lags":      lags,
+		"corr":      corrs,
+		"best_lag":  bestLag,
+		"best_corr": bestCorr,
+	})
+}
+
+// 收益率诊断的默认参数：1分钟收益率，ADF回归带1阶滞后差分
+const (
+	DIAG_DEFAULT_BUCKET   = time.Minute
+	DIAG_DEFAULT_ADF_LAGS = 1
+	DIAG_MAX_LAG          = 500
+)
+
+var webDiagDefaultLags = []int{1, 2, 5, 10, 20, 60}
+
+// Dickey-Fuller 检验（含常数项、无趋势项）的渐近临界值
+var webADFCriticalValues = []struct {
+	Level string  `json:"level"`
+	Value float64 `json:"value"`
+}{
+	{"1%", -3.43},
+	{"5%", -2.86},
+	{"10%", -2.57},
+}
+
+// 对数收益率，跳过NaN和非正价格；对应的对数价格序列一并返回供ADF检验使用
+func webLogReturns(values []float64) (returns, levels []float64) {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v <= 0 {
+			continue
+		}
+		level := math.Log(v)
+		if len(levels) > 0 {
+			returns = append(returns, level-levels[len(levels)-1])
+		}
+		levels = append(levels, level)
+	}
+	return returns, levels
+}
+
+// 最小二乘回归 y = X·beta，返回系数及其标准误；X'X奇异或自由度不足时 ok 为 false
+func webOLS(x [][]float64, y []float64) (beta, se []float64, ok bool) {
+	n := len(y)
+	if n == 0 {
+		return nil, nil, false
+	}
+	k := len(x[0])
+	if n <= k {
+		return nil, nil, false
+	}
+
+	// 增广矩阵 [X'X | I]，高斯-约当消元求逆
+	m := make([][]float64, k)
+	for i := range m {
+		m[i] = make([]float64, 2*k)
+		m[i][k+i] = 1
+	}
+	xty := make([]float64, k)
+	for r, row := range x {
+		for i := 0; i < k; i++ {
+			xty[i] += row[i] * y[r]
+			for j := 0; j < k; j++ {
+				m[i][j] += row[i] * row[j]
+			}
+		}
+	}
+	for col := 0; col < k; col++ {
+		pivot := col
+		for r := col + 1; r < k; r++ {
+			if math.Abs(m[r][col]) > math.Abs(m[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		p := m[col][col]
+		for j := range m[col] {
+			m[col][j] /= p
+		}
+		for r := 0; r < k; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			for j := range m[r] {
+				m[r][j] -= f * m[col][j]
+			}
+		}
+	}
+
+	beta = make([]float64, k)
+	for i := 0; i < k; i++ {
+		for j := 0; j < k; j++ {
+			beta[i] += m[i][k+j] * xty[j]
+		}
+	}
+	var rss float64
+	for r, row := range x {
+		fitted := 0.0
+		for i := range row {
+			fitted += row[i] * beta[i]
+		}
+		rss += (y[r] - fitted) * (y[r] - fitted)
+	}
+	sigma2 := rss / float64(n-k)
+	se = make([]float64, k)
+	for i := range se {
+		se[i] = math.Sqrt(sigma2 * m[i][k+i])
+	}
+	return beta, se, true
+}
+
+// 增广Dickey-Fuller检验：Δy_t = a + b·y_{t-1} + Σ c_i·Δy_{t-i}，返回 b 的t统计量和参与回归的样本数
+func webADFStatistic(levels []float64, lags int) (float64, int, bool) {
+	if len(levels) < lags+3 {
+		return 0, 0, false
+	}
+	diffs := webDiffSeries(levels)
+	var x [][]float64
+	var y []float64
+	for t := lags; t < len(diffs); t++ {
+		row := []float64{1, levels[t]}
+		for i := 1; i <= lags; i++ {
+			row = append(row, diffs[t-i])
+		}
+		x = append(x, row)
+		y = append(y, diffs[t])
+	}
+	beta, se, ok := webOLS(x, y)
+	if !ok || se[1] == 0 {
+		return 0, 0, false
+	}
+	return beta[1] / se[1], len(y), true
+}
+
+// 查询数据集并按 bucket 对齐价格，返回对数收益率和对数价格，供收益率诊断和收益率分布使用
+func webBucketedLogReturns(ctx context.Context, key webDatasetKey, bucket time.Duration) (returns, levels []float64, err error) {
+	data, err := webFetchDataset(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("查询 %s 失败: %w", key.symbol, err)
+	}
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("%s 数据不足", key.symbol)
+	}
+
+	loc := webServerLocation()
+	start, err1 := time.ParseInLocation("2006-01-02 15:04:05", data[0].Time, loc)
+	end, err2 := time.ParseInLocation("2006-01-02 15:04:05", data[len(data)-1].Time, loc)
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("无法解析数据时间")
+	}
+	start = start.Truncate(bucket)
+	buckets := int(end.Sub(start)/bucket) + 1
+	if buckets > LEADLAG_MAX_BUCKETS {
+		return nil, nil, fmt.Errorf("对齐后的数据点过多 (%d)，请增大bucket", buckets)
+	}
+
+	returns, levels = webLogReturns(webResampleSeries(data, "price", start, buckets, bucket))
+	return returns, levels, nil
+}
+
+// 收益率诊断接口：/api/v1/diagnostics?table=jm&symbol=jm2509&range=1d&bucket=1m&lags=1,5,10&adf_lags=1
+// 在按 bucket 对齐的价格网格上计算对数收益率各阶自相关系数，并对对数价格做ADF平稳性检验
+func webDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+
+	if err := webValidateDatasetRange(q.Get("range")); err != nil {
+		fail(fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+	bucket := DIAG_DEFAULT_BUCKET
+	if s := q.Get("bucket"); s != "" {
+		var err error
+		if bucket, err = webParseRelativeRange(s); err != nil || bucket <= 0 {
+			fail("bucket参数无效")
+			return
+		}
+	}
+	lags := webDiagDefaultLags
+	if s := q.Get("lags"); s != "" {
+		lags = nil
+		for _, part := range strings.Split(s, ",") {
+			lag, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || lag < 1 || lag > DIAG_MAX_LAG {
+				fail(fmt.Sprintf("lags参数无效 (1-%d)", DIAG_MAX_LAG))
+				return
+			}
+			lags = append(lags, lag)
+		}
+	}
+	adfLags := DIAG_DEFAULT_ADF_LAGS
+	if s := q.Get("adf_lags"); s != "" {
+		var err error
+		if adfLags, err = strconv.Atoi(s); err != nil || adfLags < 0 || adfLags > 20 {
+			fail("adf_lags参数无效 (0-20)")
+			return
+		}
+	}
+
+	returns, levels, err := webBucketedLogReturns(r.Context(), webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))}, bucket)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if len(returns) < 10 {
+		fail("有效收益率样本不足，请扩大时间范围或缩小bucket")
+		return
+	}
+
+	// 自相关系数为NaN（样本不足或序列恒定）时输出null
+	acf := make([]map[string]interface{}, 0, len(lags))
+	for _, lag := range lags {
+		var value interface{}
+		if c := webLaggedCorrelation(returns, returns, lag); !math.IsNaN(c) {
+			value = c
+		}
+		acf = append(acf, map[string]interface{}{"lag": lag, "acf": value})
+	}
+
+	adf := map[string]interface{}{"lags": adfLags, "critical": webADFCriticalValues}
+	if stat, n, ok := webADFStatistic(levels, adfLags); ok {
+		rejected := ""
+		for _, cv := range webADFCriticalValues {
+			if stat < cv.Value {
+				rejected = cv.Level
+				break
+			}
+		}
+		adf["statistic"] = stat
+		adf["observations"] = n
+		adf["stationary_at"] = rejected
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":    table,
+		"symbol":   symbol,
+		"bucket":   bucket.String(),
+		"returns":  len(returns),
+		"acf":      acf,
+		"acf_band": 1.96 / math.Sqrt(float64(len(returns))),
+		"adf":      adf,
+	})
+}
+
+// 收益率分布：直方图的默认/最大区间数，直方图范围限制在均值 ±DIST_CLIP_SIGMA 个标准差内，
+// 之外的极端收益率计入两端的区间，避免少数跳空把主体压成一根柱子
+const (
+	DIST_DEFAULT_BINS = 50
+	DIST_MAX_BINS     = 200
+	DIST_CLIP_SIGMA   = 6
+)
+
+type webHistogramBin struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+	// 同均值、同标准差的正态分布在该区间的期望样本数
+	Normal float64 `json:"normal"`
+}
+
+type webReturnDistribution struct {
+	Count          int     `json:"count"`
+	Mean           float64 `json:"mean"`
+	StdDev         float64 `json:"stddev"`
+	Min            float64 `json:"min"`
+	Max            float64 `json:"max"`
+	Skew           float64 `json:"skew"`
+	ExcessKurtosis float64 `json:"excess_kurtosis"`
+	// Jarque-Bera 正态性检验统计量及其p值（自由度为2的卡方分布）
+	JarqueBera  float64           `json:"jarque_bera"`
+	JarqueBeraP float64           `json:"jarque_bera_p"`
+	Clipped     int               `json:"clipped"`
+	Bins        []webHistogramBin `json:"bins"`
+}
+
+// 计算收益率的矩统计量和直方图；偏度、超额峰度使用总体矩（g1、g2）。方差为0时 ok 为 false
+func webComputeReturnDistribution(returns []float64, bins int) (webReturnDistribution, bool) {
+	dist := webReturnDistribution{Count: len(returns)}
+	if len(returns) < 2 || bins < 1 {
+		return dist, false
+	}
+	n := float64(len(returns))
+	dist.Mean = webCalculateAverage(returns)
+	dist.Min, dist.Max = returns[0], returns[0]
+	var m2, m3, m4 float64
+	for _, r := range returns {
+		d := r - dist.Mean
+		m2 += d * d
+		m3 += d * d * d
+		m4 += d * d * d * d
+		dist.Min = math.Min(dist.Min, r)
+		dist.Max = math.Max(dist.Max, r)
+	}
+	m2, m3, m4 = m2/n, m3/n, m4/n
+	if m2 == 0 {
+		return dist, false
+	}
+	dist.StdDev = math.Sqrt(m2)
+	dist.Skew = m3 / math.Pow(m2, 1.5)
+	dist.ExcessKurtosis = m4/(m2*m2) - 3
+	dist.JarqueBera = n / 6 * (dist.Skew*dist.Skew + dist.ExcessKurtosis*dist.ExcessKurtosis/4)
+	dist.JarqueBeraP = math.Exp(-dist.JarqueBera / 2)
+
+	lo := math.Max(dist.Min, dist.Mean-DIST_CLIP_SIGMA*dist.StdDev)
+	hi := math.Min(dist.Max, dist.Mean+DIST_CLIP_SIGMA*dist.StdDev)
+	width := (hi - lo) / float64(bins)
+	cdf := func(x float64) float64 {
+		return 0.5 * math.Erfc(-(x-dist.Mean)/(dist.StdDev*math.Sqrt2))
+	}
+	dist.Bins = make([]webHistogramBin, bins)
+	for i := range dist.Bins {
+		from, to := lo+float64(i)*width, lo+float64(i+1)*width
+		dist.Bins[i] = webHistogramBin{From: from, To: to, Normal: n * (cdf(to) - cdf(from))}
+	}
+	for _, r := range returns {
+		if r < lo || r > hi {
+			dist.Clipped++
+		}
+		i := int((r - lo) / width)
+		if i < 0 {
+			i = 0
+		}
+		if i >= bins {
+			i = bins - 1
+		}
+		dist.Bins[i].Count++
+	}
+	return dist, true
+}
+
+// 把直方图画成柱子的自定义序列（go-chart 的 BarChart 不能与折线叠加）
+type webHistogramSeries struct {
+	Name  string
+	Style chart.Style
+	Bins  []webHistogramBin
+	Scale float64 // 区间边界的换算倍数，与横轴单位一致
+}
+
+func (s webHistogramSeries) GetName() string           { return s.Name }
+func (s webHistogramSeries) GetYAxis() chart.YAxisType { return chart.YAxisPrimary }
+func (s webHistogramSeries) GetStyle() chart.Style     { return s.Style }
+func (s webHistogramSeries) Validate() error           { return nil }
+
+func (s webHistogramSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	for _, bin := range s.Bins {
+		if bin.Count == 0 {
+			continue
+		}
+		left := canvasBox.Left + xrange.Translate(bin.From*s.Scale)
+		right := canvasBox.Left + xrange.Translate(bin.To*s.Scale)
+		if right > left+1 {
+			right-- // 相邻柱子之间留出1像素间隔
+		}
+		top := canvasBox.Bottom - yrange.Translate(float64(bin.Count))
+		chart.Draw.Box(r, chart.Box{Top: top, Left: left, Right: right, Bottom: canvasBox.Bottom}, s.Style)
+	}
+}
+
+// 收益率分布接口：/api/v1/distribution?table=jm&symbol=jm2509&range=5d&bucket=1m&bins=50[&format=png]
+// 按 bucket 对齐的对数收益率直方图，叠加同均值同标准差的正态分布，给出偏度、超额峰度和Jarque-Bera检验
+func webDistributionHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	png := q.Get("format") == "png"
+	fail := func(msg string) {
+		if png {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if err := webValidateDatasetRange(q.Get("range")); err != nil {
+		fail(fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+	bucket := DIAG_DEFAULT_BUCKET
+	if s := q.Get("bucket"); s != "" {
+		var err error
+		if bucket, err = webParseRelativeRange(s); err != nil || bucket <= 0 {
+			fail("bucket参数无效")
+			return
+		}
+	}
+	bins := DIST_DEFAULT_BINS
+	if s := q.Get("bins"); s != "" {
+		var err error
+		if bins, err = strconv.Atoi(s); err != nil || bins < 5 || bins > DIST_MAX_BINS {
+			fail(fmt.Sprintf("bins参数无效 (5-%d)", DIST_MAX_BINS))
+			return
+		}
+	}
+
+	returns, _, err := webBucketedLogReturns(r.Context(), webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))}, bucket)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if len(returns) < 10 {
+		fail("有效收益率样本不足，请扩大时间范围或缩小bucket")
+		return
+	}
+	dist, ok := webComputeReturnDistribution(returns, bins)
+	if !ok {
+		fail("收益率没有变化，无法计算分布")
+		return
+	}
+
+	if !png {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"table":        table,
+			"symbol":       symbol,
+			"range":        webNormalizeRange(q.Get("range")),
+			"bucket":       bucket.String(),
+			"distribution": dist,
+		})
+		return
+	}
+
+	// PNG 横轴以基点 (bp) 为单位；正态曲线在每个区间中点取期望样本数
+	const bp = 10000
+	var xs, ys []float64
+	maxCount := 0.0
+	for _, bin := range dist.Bins {
+		xs = append(xs, (bin.From+bin.To)/2*bp)
+		ys = append(ys, bin.Normal)
+		maxCount = math.Max(maxCount, math.Max(float64(bin.Count), bin.Normal))
+	}
+	graph := chart.Chart{
+		Font:   webChartFont(),
+		Title:  fmt.Sprintf("%s %v log returns (n=%d, skew %.2f, excess kurtosis %.2f)", strings.ToUpper(symbol), bucket, dist.Count, dist.Skew, dist.ExcessKurtosis),
+		Width:  800,
+		Height: 400,
+		TitleStyle: chart.Style{
+			FontSize: 10,
+		},
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: chart.XAxis{
+			Name:  "Return (bp)",
+			Style: chart.Style{FontSize: 8},
+			Range: &chart.ContinuousRange{Min: dist.Bins[0].From * bp, Max: dist.Bins[len(dist.Bins)-1].To * bp},
+		},
+		YAxis: chart.YAxis{
+			Name:  "Count",
+			Style: chart.Style{FontSize: 8},
+			Range: &chart.ContinuousRange{Min: 0, Max: maxCount * 1.1},
+		},
+		Series: []chart.Series{
+			webHistogramSeries{
+				Name:  "Returns",
+				Style: chart.Style{FillColor: drawing.Color{R: 75, G: 192, B: 192, A: 180}, StrokeWidth: 0},
+				Bins:  dist.Bins,
+				Scale: bp,
+			},
+			chart.ContinuousSeries{
+				Name:    "Normal",
+				Style:   chart.Style{StrokeColor: drawing.Color{R: 220, G: 53, B: 69, A: 255}, StrokeWidth: 2},
+				XValues: xs,
+				YValues: ys,
+			},
+		},
+	}
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := graph.Render(chart.PNG, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 价格纵轴的固定范围，NaN 表示该端按数据自动缩放
+type webYRange struct {
+	Min float64
+	Max float64
+}
+
+// 解析 "min,max" 形式的纵轴范围，任一端可以留空，整体为空表示完全自动
+func webParseYRange(spec string) (webYRange, error) {
+	yr := webYRange{math.NaN(), math.NaN()}
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "," {
+		return yr, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) != 2 {
+		return yr, fmt.Errorf("纵轴范围格式应为 min,max: %q", spec)
+	}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return yr, fmt.Errorf("纵轴范围无效: %q", part)
+		}
+		if i == 0 {
+			yr.Min = v
+		} else {
+			yr.Max = v
+		}
+	}
+	if yr.Min >= yr.Max {
+		return yr, fmt.Errorf("纵轴下限必须小于上限: %q", spec)
+	}
+	return yr, nil
+}
+
+// 绘图使用的纵轴上下限，未固定的一端取数据的最值；两端都未固定时 ok 为 false，交给 go-chart 自动缩放
+func (yr webYRange) bounds(values []float64) (lo, hi float64, ok bool) {
+	if math.IsNaN(yr.Min) && math.IsNaN(yr.Max) {
+		return 0, 0, false
+	}
+	lo, hi = yr.Min, yr.Max
+	if math.IsNaN(lo) {
+		lo = webFindMin(values)
+	}
+	if math.IsNaN(hi) {
+		hi = webFindMax(values)
+	}
+	// 数据整体落在固定端之外时，自动的一端向外留出一个单位
+	if hi <= lo {
+		if math.IsNaN(yr.Min) {
+			lo = hi - 1
+		} else {
+			hi = lo + 1
+		}
+	}
+	return lo, hi, true
+}
+
+// NaN 在JSON中输出为 null
+func webNullableFloat(v float64) interface{} {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return v
+}
+
+// PNG图表纵轴最多的刻度数
+const PNG_AXIS_TICKS = 8
+
+// 不小于 span/(maxTicks-1) 的整齐步长，取 1、2、2.5、5 × 10^n
+func webNiceStep(span float64, maxTicks int) float64 {
+	raw := span / float64(maxTicks-1)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 2.5, 5} {
+		if m*mag >= raw*(1-1e-9) {
+			return m * mag
+		}
+	}
+	return 10 * mag
+}
+
+// 覆盖 [lo, hi] 的整齐刻度：两端先各留出 padding 比例的空白，再向外取整到步长的整数倍。
+// 返回刻度值和刻度标签应保留的小数位数
+func webNiceTicks(lo, hi, padding float64, maxTicks int) ([]float64, int) {
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	if hi == lo {
+		// 常数序列按数值量级展开，保证有可以分刻度的范围
+		delta := math.Abs(lo) * 0.01
+		if delta == 0 {
+			delta = 1
+		}
+		lo, hi = lo-delta, hi+delta
+	}
+	pad := (hi - lo) * padding
+	lo, hi = lo-pad, hi+pad
+
+	step := webNiceStep(hi-lo, maxTicks)
+	// 按12位有效数字规整步长，消除 0.1*3 这类浮点尾数后再计算小数位数
+	step, _ = strconv.ParseFloat(strconv.FormatFloat(step, 'g', 12, 64), 64)
+	decimals := 0
+	if s := strconv.FormatFloat(step, 'f', -1, 64); strings.Contains(s, ".") {
+		decimals = len(s) - strings.Index(s, ".") - 1
+	}
+
+	first := math.Floor(lo/step + 1e-9)
+	last := math.Ceil(hi/step - 1e-9)
+	ticks := make([]float64, 0, int(last-first)+1)
+	scale := math.Pow(10, float64(decimals))
+	for i := first; i <= last; i++ {
+		ticks = append(ticks, math.Round(i*step*scale)/scale)
+	}
+	return ticks, decimals
+}
+
+// 带固定刻度的纵轴范围。go-chart v2.1.2 按主轴的 YAxis.Ticks 计算副轴范围，副轴设置 Ticks 会把
+// 持仓量画到画布之外并使渲染卡死，因此刻度通过 Range 实现的 TicksProvider 提供
+type webTickRange struct {
+	*chart.ContinuousRange
+	ticks []chart.Tick
+}
+
+func (r webTickRange) GetTicks(chart.Renderer, chart.Style, chart.ValueFormatter) []chart.Tick {
+	return r.ticks
+}
+
+// 给go-chart纵轴设置整齐刻度和对应的范围；fixed 为 true 时 [lo, hi] 是用户固定的范围，不留白也不外扩，只取落在范围内的刻度
+func webApplyNiceAxis(axis *chart.YAxis, lo, hi, padding float64, fixed bool) {
+	if fixed {
+		padding = 0
+	}
+	ticks, decimals := webNiceTicks(lo, hi, padding, PNG_AXIS_TICKS)
+	r := webTickRange{ContinuousRange: &chart.ContinuousRange{Min: ticks[0], Max: ticks[len(ticks)-1]}}
+	if fixed {
+		r.ContinuousRange = &chart.ContinuousRange{Min: lo, Max: hi}
+	}
+	for _, v := range ticks {
+		if fixed && (v < lo || v > hi) {
+			continue
+		}
+		r.ticks = append(r.ticks, chart.Tick{Value: v, Label: strconv.FormatFloat(v, 'f', decimals, 64)})
+	}
+	axis.Range = r
+	axis.Ticks = nil
+}
+
+// 图表处理器 (生成PNG图表)，?y_min=&y_max= 固定价格纵轴范围，不带参数时使用 -y-range 配置；
+// ?padding= 覆盖 -axis-padding 的纵轴留白比例，?format=svg 输出SVG矢量图
+func webChartHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	renderer, contentType := chart.PNG, "image/png"
+	switch q.Get("format") {
+	case "", "png":
+	case "svg":
+		renderer, contentType = chart.SVG, "image/svg+xml"
+	default:
+		http.Error(w, "format参数无效 (png/svg)", http.StatusBadRequest)
+		return
+	}
+	yRange, padding, err := webParseAxisParams(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regimes, err := webParseVolRegimeParams(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, session := webGetSession(r)
+	if err := webAuthorizeDataset(r, session.key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	view, err := webGetView(webAuditContext(r), session.key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询失败: %v", err), http.StatusBadGateway)
+		return
+	}
+	if len(view.sampled) < 2 {
+		http.Error(w, "Insufficient data", http.StatusInternalServerError)
+		return
+	}
+
+	graph := webPriceChart(view, yRange, padding, regimes)
+	w.Header().Set("Content-Type", contentType)
+	if err := graph.Render(renderer, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 解析 y_min/y_max 和 padding 参数，缺省时使用 -y-range 和 -axis-padding 的配置
+func webParseAxisParams(q url.Values) (webYRange, float64, error) {
+	yRange := webDefaultYRange
+	if q.Has("y_min") || q.Has("y_max") {
+		var err error
+		if yRange, err = webParseYRange(q.Get("y_min") + "," + q.Get("y_max")); err != nil {
+			return yRange, 0, err
+		}
+	}
+	padding := webAxisPadding
+	if s := q.Get("padding"); s != "" {
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p < 0 || p >= 1 {
+			return yRange, 0, fmt.Errorf("padding参数无效 (0-1)")
+		}
+		padding = p
+	}
+	return yRange, padding, nil
+}
+
+// 快照下载的默认和最大图片尺寸（像素）
+const (
+	SNAPSHOT_DEFAULT_WIDTH  = 1400
+	SNAPSHOT_DEFAULT_HEIGHT = 800
+	SNAPSHOT_MAX_SIZE       = 4000
+)
+
+// 快照下载：/download/chart.png 按页面当前状态在服务端渲染静态图片并作为附件下载。
+// table/symbol/range 指定数据集（缺省为本会话当前的数据集），series 为 price/mid/spread，
+// from/to 为可见时间窗口（与 /data 的缩放窗口相同，按 points 选择预聚合层级），raw=1 使用原始数据，
+// y_min/y_max/padding 与 /chart 相同，hide=price,oi 隐藏对应曲线，width/height 指定图片尺寸
+func webDownloadChartHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	yRange, padding, err := webParseAxisParams(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regimes, err := webParseVolRegimeParams(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vwapBands, err := webParseVWAPParams(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := webChartOptions{
+		series:  "price",
+		yRange:  yRange,
+		padding: padding,
+		width:   SNAPSHOT_DEFAULT_WIDTH,
+		height:  SNAPSHOT_DEFAULT_HEIGHT,
+		regimes: regimes,
+	}
+	if series := q.Get("series"); series != "" {
+		if _, ok := webSeriesLabels[series]; !ok {
+			http.Error(w, fmt.Sprintf("series参数无效 %q (price/mid/spread)", series), http.StatusBadRequest)
+			return
+		}
+		opts.series = series
+	}
+	for _, name := range strings.Split(q.Get("hide"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "price":
+			opts.hidePrice = true
+		case "oi":
+			opts.hideOI = true
+		default:
+			http.Error(w, fmt.Sprintf("hide参数无效 %q (price/oi)", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if opts.hidePrice && opts.hideOI {
+		http.Error(w, "价格和持仓量不能同时隐藏", http.StatusBadRequest)
+		return
+	}
+	for _, size := range []struct {
+		name string
+		dst  *int
+	}{{"width", &opts.width}, {"height", &opts.height}} {
+		if s := q.Get(size.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 200 || n > SNAPSHOT_MAX_SIZE {
+				http.Error(w, fmt.Sprintf("%s参数无效 (200-%d)", size.name, SNAPSHOT_MAX_SIZE), http.StatusBadRequest)
+				return
+			}
+			*size.dst = n
+		}
+	}
+
+	_, session := webGetSession(r)
+	key := session.key
+	if table, symbol := q.Get("table"), q.Get("symbol"); table != "" && symbol != "" {
+		if err := webValidateDatasetRange(q.Get("range")); err != nil {
+			http.Error(w, fmt.Sprintf("时间范围无效: %v", err), http.StatusBadRequest)
+			return
+		}
+		key = webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))}
+	}
+	if err := webAuthorizeDataset(r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	view, err := webGetView(webAuditContext(r), key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询失败: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// 与 /data 相同的数据选择：缩放窗口 > 原始数据 > 采样数据
+	data := view.sampled
+	if q.Get("raw") == "1" {
+		data = view.all
+		if len(data) > webMaxRawPoints {
+			data = webSampleData(data, webMaxRawPoints)
+		}
+	}
+	if q.Get("from") != "" || q.Get("to") != "" {
+		from, err := webParseWallTime(q.Get("from"))
+		var to time.Time
+		if err == nil {
+			to, err = webParseWallTime(q.Get("to"))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("缩放窗口无效: %v", err), http.StatusBadRequest)
+			return
+		}
+		points := WEB_ZOOM_POINTS
+		if n, err := strconv.Atoi(q.Get("points")); err == nil && n > 0 {
+			points = n
+		}
+		if points > webMaxRawPoints {
+			points = webMaxRawPoints
+		}
+		data, _ = webZoomWindow(view.all, view.pyramid,
+			from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), points, webCurrentDownsampling())
+	}
+	if len(data) < 2 {
+		http.Error(w, "Insufficient data", http.StatusUnprocessableEntity)
+		return
+	}
+	if vwapBands != nil {
+		bands := webSessionVWAP(view.all, data, vwapBands, webRawPriceFormat)
+		opts.vwap = &bands
+	}
+	opts.levels = webLevelsFor(key.symbol)
+
+	graph, _, _ := webBuildPriceChart(data, opts)
+	first, last := data[0].Time, data[len(data)-1].Time
+	graph.Title = fmt.Sprintf("%s %s  %s ~ %s (%s点)", strings.ToUpper(key.symbol), webSeriesLabels[opts.series], first, last,
+		webNumbers.Format(float64(len(data)), "count"))
+	// 一天以内的窗口刻度精确到秒，缩放到几分钟时刻度不会重复
+	start, startErr := webParseWallTime(first)
+	end, endErr := webParseWallTime(last)
+	if startErr == nil && endErr == nil && end.Sub(start) < 24*time.Hour {
+		graph.XAxis.ValueFormatter = chart.TimeValueFormatterWithFormat("15:04:05")
+	}
+
+	compact := strings.NewReplacer("-", "", ":", "", " ", "_")
+	filename := fmt.Sprintf("%s_%s_%s-%s.png", key.symbol, opts.series, compact.Replace(first), compact.Replace(last))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if err := graph.Render(chart.PNG, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 缩略走势图的默认和最大尺寸（像素）
+const (
+	SPARKLINE_DEFAULT_WIDTH  = 120
+	SPARKLINE_DEFAULT_HEIGHT = 30
+	SPARKLINE_MAX_WIDTH      = 1000
+	SPARKLINE_MAX_HEIGHT     = 300
+)
+
+// 缩略走势图：/sparkline.png?symbol=jm2509&range=1d&w=120&h=30 输出不带坐标轴、标题和图例的价格折线，
+// 供wiki和监控看板按合约嵌入。table 缺省为合约代码的字母前缀，点数按宽度抽样；
+// 区间上涨为红色、下跌为绿色，与页面上的涨跌配色一致
+func webSparklineHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		http.Error(w, "缺少symbol参数", http.StatusBadRequest)
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if err := webValidateDatasetRange(q.Get("range")); err != nil {
+		http.Error(w, fmt.Sprintf("时间范围无效: %v", err), http.StatusBadRequest)
+		return
+	}
+	width, height := SPARKLINE_DEFAULT_WIDTH, SPARKLINE_DEFAULT_HEIGHT
+	for _, size := range []struct {
+		name string
+		max  int
+		dst  *int
+	}{{"w", SPARKLINE_MAX_WIDTH, &width}, {"h", SPARKLINE_MAX_HEIGHT, &height}} {
+		if s := q.Get(size.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 10 || n > size.max {
+				http.Error(w, fmt.Sprintf("%s参数无效 (10-%d)", size.name, size.max), http.StatusBadRequest)
+				return
+			}
+			*size.dst = n
+		}
+	}
+
+	key := webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))}
+	if err := webAuthorizeDataset(r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	view, err := webGetView(webAuditContext(r), key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询失败: %v", err), http.StatusBadGateway)
+		return
+	}
+	graph, err := webBuildSparkline(view.sampled, width, height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := graph.Render(chart.PNG, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// 按宽度抽样后构建缩略走势图，每个像素列最多一个点
+func webBuildSparkline(data []WebMarketData, width, height int) (chart.Chart, error) {
+	data = webSampleData(data, width)
+	xValues := make([]time.Time, 0, len(data))
+	priceValues := make([]float64, 0, len(data))
+	for _, record := range data {
+		t, err := webParseWallTime(record.Time)
+		if err != nil {
+			continue
+		}
+		xValues = append(xValues, t)
+		priceValues = append(priceValues, webDisplaySeriesValue(record, "price"))
+	}
+	if len(priceValues) < 2 {
+		return chart.Chart{}, errors.New("Insufficient data")
+	}
+
+	color := drawing.ColorFromHex("dc3545")
+	if priceValues[len(priceValues)-1] < priceValues[0] {
+		color = drawing.ColorFromHex("28a745")
+	}
+	// 价格不变时上下各留一点空间，避免纵轴范围为0
+	lo, hi := webFindMin(priceValues), webFindMax(priceValues)
+	if lo == hi {
+		lo, hi = lo-1, hi+1
+	}
+	return chart.Chart{
+		Font:           webChartFont(),
+		Width:          width,
+		Height:         height,
+		Background:     chart.Style{Padding: chart.NewBox(1, 1, 1, 1)},
+		XAxis:          chart.XAxis{Style: chart.Hidden()},
+		YAxis:          chart.YAxis{Style: chart.Hidden(), Range: &chart.ContinuousRange{Min: lo, Max: hi}},
+		YAxisSecondary: chart.YAxis{Style: chart.Hidden()},
+		Series: []chart.Series{
+			chart.TimeSeries{
+				Style:   chart.Style{StrokeColor: color, StrokeWidth: 1},
+				XValues: xValues,
+				YValues: priceValues,
+			},
+		},
+	}, nil
+}
+
+// 价格/持仓量双轴图。字体使用go-chart内嵌的默认字体，输出不依赖系统字体，同样的数据总是得到同样的图片
+func webPriceChart(view *webView, yRange webYRange, padding float64, regimes *webVolRegimeParams) chart.Chart {
+	data := view.sampled
+	graph, priceValues, oiValues := webBuildPriceChart(data, webChartOptions{
+		series:  "price",
+		yRange:  yRange,
+		padding: padding,
+		width:   SNAPSHOT_DEFAULT_WIDTH,
+		height:  SNAPSHOT_DEFAULT_HEIGHT,
+		regimes: regimes,
+		levels:  webLevelsFor(view.key.symbol),
+	})
+
+	// 计算统计信息
+	graph.Title = fmt.Sprintf("JM2509 - 全数据视图 (%s条采样数据，共%s条记录)\n平均价格: %s | 最高: %s | 最低: %s | 平均持仓量: %s",
+		webNumbers.Format(float64(len(data)), "count"), webNumbers.Format(float64(len(view.all)), "count"),
+		webNumbers.Format(webCalculateAverage(priceValues), "price"), webNumbers.Format(webFindMax(priceValues), "price"),
+		webNumbers.Format(webFindMin(priceValues), "price"), webNumbers.Format(webCalculateAverage(oiValues), "oi"))
+	return graph
+}
+
+// 服务端渲染图表的显示选项，与页面上的序列、纵轴范围和图例开关对应
+type webChartOptions struct {
+	series    string // price、mid 或 spread
+	yRange    webYRange
+	padding   float64
+	hidePrice bool
+	hideOI    bool
+	width     int
+	height    int
+	regimes   *webVolRegimeParams // 非空时按波动率状态给背景着色
+	vwap      *webVWAPBands       // 非空时在价格下方绘制交易时段VWAP带
+	levels    []webPriceLevel     // 价位线，画在价格曲线上方
+}
+
+// 按显示选项构建价格/持仓量图表（不含标题），同时返回绘制的价格序列和持仓量，供调用方生成标题。
+// 隐藏价格时持仓量改用主纵轴
+func webBuildPriceChart(data []WebMarketData, opts webChartOptions) (chart.Chart, []float64, []float64) {
+	// 准备数据
+	xValues := make([]time.Time, len(data))
+	priceValues := make([]float64, len(data))
+	oiValues := make([]float64, len(data))
+
+	for i, record := range data {
+		// 解析时间字符串
+		parsedTime, err := time.Parse("2006-01-02 15:04:05", record.Time)
+		if err != nil {
+			log.Printf("Failed to parse time %s: %v", record.Time, err)
+			continue
+		}
+		xValues[i] = parsedTime
+		priceValues[i] = webDisplaySeriesValue(record, opts.series)
+		oiValues[i] = float64(record.OpenInterest)
+	}
+
+	priceName := webSeriesLabels[opts.series]
+	priceSeries := chart.TimeSeries{
+		Name: priceName,
+		Style: chart.Style{
+			StrokeColor: drawing.ColorGreen,
+			StrokeWidth: 2,
+		},
+		XValues: xValues,
+		YValues: priceValues,
+	}
+	oiSeries := chart.TimeSeries{
+		Name: "持仓量",
+		Style: chart.Style{
+			StrokeColor: drawing.ColorRed,
+			StrokeWidth: 2,
+		},
+		YAxis:   chart.YAxisSecondary,
+		XValues: xValues,
+		YValues: oiValues,
+	}
+
+	// 创建图表
+	graph := chart.Chart{
+		Font: webChartFont(),
+		TitleStyle: chart.Style{
+			FontSize: 14,
+		},
+		Width:  opts.width,
+		Height: opts.height,
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top:    80,
+				Left:   80,
+				Right:  80,
+				Bottom: 80,
+			},
+		},
+		XAxis: chart.XAxis{
+			Name: "日期时间",
+			Style: chart.Style{
+				FontSize: 12,
+			},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("01-02 15:04"),
+		},
+		YAxis: chart.YAxis{
+			Name: priceName,
+			Style: chart.Style{
+				FontSize: 12,
+			},
+		},
+		YAxisSecondary: chart.YAxis{
+			Name: "持仓量",
+			Style: chart.Style{
+				FontSize: 12,
+			},
+		},
+	}
+
+	switch {
+	case opts.hidePrice:
+		oiSeries.YAxis = chart.YAxisPrimary
+		graph.YAxis.Name = "持仓量"
+		graph.Series = []chart.Series{oiSeries}
+		webApplyNiceAxis(&graph.YAxis, webFindMin(oiValues), webFindMax(oiValues), opts.padding, false)
+	default:
+		graph.Series = []chart.Series{priceSeries}
+		if !opts.hideOI {
+			graph.Series = append(graph.Series, oiSeries)
+			webApplyNiceAxis(&graph.YAxisSecondary, webFindMin(oiValues), webFindMax(oiValues), opts.padding, false)
+		}
+		if lo, hi, ok := opts.yRange.bounds(priceValues); ok {
+			webApplyNiceAxis(&graph.YAxis, lo, hi, opts.padding, true)
+		} else {
+			webApplyNiceAxis(&graph.YAxis, webFindMin(priceValues), webFindMax(priceValues), opts.padding, false)
+		}
+	}
+
+	// 价位线画在最上面；VWAP带在价格曲线之前绘制；价差的单位是跳，都不叠加
+	if len(opts.levels) > 0 && !opts.hidePrice && opts.series != "spread" {
+		graph.Series = append(graph.Series, webLevelSeries{Name: "价位线", Levels: opts.levels})
+	}
+	if opts.vwap != nil && !opts.hidePrice && opts.series != "spread" {
+		graph.Series = append([]chart.Series{webVWAPSeries{Name: "VWAP", XValues: xValues, Bands: *opts.vwap}}, graph.Series...)
+	}
+
+	// 波动率状态底色放在最前面，先于曲线绘制
+	if opts.regimes != nil {
+		if regimes, _ := webVolRegimes(data, *opts.regimes); len(regimes) > 0 {
+			graph.Series = append([]chart.Series{
+				webVolRegimeSeries{Name: "低波动", Regime: "low", Regimes: regimes},
+				webVolRegimeSeries{Name: "高波动", Regime: "high", Regimes: regimes},
+			}, graph.Series...)
+		}
+	}
+
+	// 添加图例
+	graph.Elements = []chart.Renderable{
+		chart.Legend(&graph),
+	}
+	return graph, priceValues, oiValues
+}
+
+// 与页面上序列下拉框一致的名称
+var webSeriesLabels = map[string]string{
+	"price":  "价格",
+	"mid":    "中间价",
+	"spread": "价差 (跳)",
+}
+
+// 按页面上选择的序列计算绘图值，与页面的 seriesValues 相同：先换算成tick数再计算，
+// 没有有效报价时中间价退回最新价，价差记为0。最小变动价位未知时用原始价格计算，价差的单位是价格
+func webDisplaySeriesValue(md WebMarketData, series string) float64 {
+	quoted := md.Bid1 > 0 && md.Ask1 > 0
+	tick := webTickSizeFor(md.Symbol)
+	if tick <= 0 {
+		switch {
+		case series == "mid" && quoted:
+			return webRawPrice(float32((webRawPrice(md.Bid1) + webRawPrice(md.Ask1)) / 2))
+		case series == "spread" && quoted:
+			return webRawPrice(float32(webRawPrice(md.Ask1) - webRawPrice(md.Bid1)))
+		case series == "spread":
+			return 0
+		}
+		return webPriceValue(md.Price, md.Symbol)
+	}
+	bidTicks, askTicks := webPriceToTicks(md.Bid1, tick), webPriceToTicks(md.Ask1, tick)
+	switch {
+	case series == "mid" && quoted:
+		scale := math.Pow10(webTickDecimals(tick) + 1)
+		return math.Round(float64(bidTicks+askTicks)*tick/2*scale) / scale
+	case series == "spread" && quoted:
+		return float64(askTicks - bidTicks)
+	case series == "spread":
+		return 0
+	}
+	return webPriceValue(md.Price, md.Symbol)
+}
+
+// 波动率状态的默认参数：滚动窗口为20个点，低于中位数的0.7倍为低波动，高于1.5倍为高波动
+const (
+	VOL_DEFAULT_WINDOW = 20
+	VOL_DEFAULT_LOW    = 0.7
+	VOL_DEFAULT_HIGH   = 1.5
+)
+
+// 波动率状态划分参数：滚动窗口点数，以及相对于本段数据滚动波动率中位数的低/高阈值倍数。
+// 阈值按中位数的倍数给出，采样数据、原始tick和缩放窗口的点间隔不同也可以使用同一组参数
+type webVolRegimeParams struct {
+	window int
+	low    float64
+	high   float64
+}
+
+// 通过 -vol-window/-vol-low/-vol-high 配置的默认参数，请求中的 vol_window/vol_low/vol_high 可以覆盖
+var webVolRegimeDefaults = webVolRegimeParams{VOL_DEFAULT_WINDOW, VOL_DEFAULT_LOW, VOL_DEFAULT_HIGH}
+
+func (p webVolRegimeParams) validate() error {
+	if p.window < 2 {
+		return fmt.Errorf("vol_window必须至少为2")
+	}
+	if p.low <= 0 || p.high <= p.low {
+		return fmt.Errorf("波动率阈值无效: 需要 0 < vol_low < vol_high")
+	}
+	return nil
+}
+
+// 解析 regimes=1 及可选的 vol_window/vol_low/vol_high；未请求波动率状态时返回 nil
+func webParseVolRegimeParams(q url.Values) (*webVolRegimeParams, error) {
+	if q.Get("regimes") != "1" {
+		return nil, nil
+	}
+	params := webVolRegimeDefaults
+	if s := q.Get("vol_window"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("vol_window参数无效: %q", s)
+		}
+		params.window = n
+	}
+	for _, f := range []struct {
+		name string
+		dst  *float64
+	}{{"vol_low", &params.low}, {"vol_high", &params.high}} {
+		if s := q.Get(f.name); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("%s参数无效: %q", f.name, s)
+			}
+			*f.dst = v
+		}
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// 各状态的底色，页面和PNG使用相同的颜色；正常波动不着色
+var webVolRegimeColors = map[string]drawing.Color{
+	"low":    {R: 23, G: 162, B: 184, A: 40},
+	"normal": {R: 0, G: 0, B: 0, A: 0},
+	"high":   {R: 220, G: 53, B: 69, A: 40},
+}
+
+// 一段连续处于同一波动率状态的区间，字段与 chartjs-plugin-annotation 的 box 标注一致，
+// xMin/xMax 为数据点的时间，vol 为区间内滚动波动率的均值
+type webVolRegime struct {
+	Type            string  `json:"type"`
+	XMin            string  `json:"xMin"`
+	XMax            string  `json:"xMax"`
+	Regime          string  `json:"regime"`
+	Vol             float64 `json:"vol"`
+	BackgroundColor string  `json:"backgroundColor"`
+}
+
+// 计算每个点的滚动波动率（之前 window 个对数收益率的标准差），按与中位数的比值划分为 low/normal/high，
+// 并把相邻的同状态点合并成区间；前 window 个点没有足够的收益率，不划分状态。
+// 区间的 xMax 取下一段的第一个点，着色时各段首尾相接
+func webVolRegimes(data []WebMarketData, params webVolRegimeParams) ([]webVolRegime, float64) {
+	if len(data) <= params.window {
+		return nil, 0
+	}
+	returns := make([]float64, len(data))
+	for i := 1; i < len(data); i++ {
+		prev, cur := float64(data[i-1].Price), float64(data[i].Price)
+		if prev > 0 && cur > 0 && !math.IsInf(prev, 0) && !math.IsInf(cur, 0) {
+			returns[i] = math.Log(cur / prev)
+		}
+	}
+
+	vols := make([]float64, len(data))
+	var defined []float64
+	for i := params.window; i < len(data); i++ {
+		window := returns[i-params.window+1 : i+1]
+		mean := webCalculateAverage(window)
+		sum := 0.0
+		for _, r := range window {
+			sum += (r - mean) * (r - mean)
+		}
+		vols[i] = math.Sqrt(sum / float64(len(window)))
+		defined = append(defined, vols[i])
+	}
+	sort.Float64s(defined)
+	median := defined[len(defined)/2]
+	if len(defined)%2 == 0 {
+		median = (defined[len(defined)/2-1] + defined[len(defined)/2]) / 2
+	}
+	if median == 0 {
+		return nil, 0
+	}
+
+	regimeOf := func(vol float64) string {
+		switch {
+		case vol < params.low*median:
+			return "low"
+		case vol > params.high*median:
+			return "high"
+		}
+		return "normal"
+	}
+
+	var regimes []webVolRegime
+	start := params.window
+	for i := params.window + 1; i <= len(data); i++ {
+		if i < len(data) && regimeOf(vols[i]) == regimeOf(vols[start]) {
+			continue
+		}
+		end := i
+		if end == len(data) {
+			end = len(data) - 1
+		}
+		regime := regimeOf(vols[start])
+		c := webVolRegimeColors[regime]
+		regimes = append(regimes, webVolRegime{
+			Type:            "box",
+			XMin:            data[start].Time,
+			XMax:            data[end].Time,
+			Regime:          regime,
+			Vol:             webCalculateAverage(vols[start:i]),
+			BackgroundColor: fmt.Sprintf("rgba(%d, %d, %d, %.2f)", c.R, c.G, c.B, float64(c.A)/255),
+		})
+		start = i
+	}
+	return regimes, median
+}
+
+// /data 响应中的波动率状态：参数、中位数和各区间的标注
+func webVolRegimesJSON(data []WebMarketData, params webVolRegimeParams) map[string]interface{} {
+	regimes, median := webVolRegimes(data, params)
+	if regimes == nil {
+		regimes = []webVolRegime{}
+	}
+	return map[string]interface{}{
+		"window":      params.window,
+		"low":         params.low,
+		"high":        params.high,
+		"median_vol":  median,
+		"annotations": regimes,
+	}
+}
+
+// PNG图表上的波动率状态底色：作为第一个序列绘制，位于价格和持仓量曲线下方，不参与纵轴范围计算
+type webVolRegimeSeries struct {
+	Name    string
+	Regime  string
+	Regimes []webVolRegime
+}
+
+func (s webVolRegimeSeries) GetName() string           { return s.Name }
+func (s webVolRegimeSeries) GetYAxis() chart.YAxisType { return chart.YAxisPrimary }
+func (s webVolRegimeSeries) Validate() error           { return nil }
+
+func (s webVolRegimeSeries) GetStyle() chart.Style {
+	c := webVolRegimeColors[s.Regime]
+	return chart.Style{StrokeColor: c.WithAlpha(160), StrokeWidth: 8}
+}
+
+func (s webVolRegimeSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	style := chart.Style{FillColor: webVolRegimeColors[s.Regime], StrokeWidth: 0}
+	for _, regime := range s.Regimes {
+		if regime.Regime != s.Regime {
+			continue
+		}
+		from, errFrom := time.Parse("2006-01-02 15:04:05", regime.XMin)
+		to, errTo := time.Parse("2006-01-02 15:04:05", regime.XMax)
+		if errFrom != nil || errTo != nil {
+			continue
+		}
+		left := canvasBox.Left + xrange.Translate(chart.TimeToFloat64(from))
+		right := canvasBox.Left + xrange.Translate(chart.TimeToFloat64(to))
+		if right <= left {
+			right = left + 1
+		}
+		chart.Draw.Box(r, chart.Box{Top: canvasBox.Top, Left: left, Right: right, Bottom: canvasBox.Bottom}, style)
+	}
+}
+
+// 交易时段VWAP带：默认画 ±1σ 和 ±2σ 两条带，vwap_k 最多指定的带数
+const WEB_VWAP_MAX_BANDS = 3
+
+var webVWAPDefaultBands = []float64{1, 2}
+
+// 解析 vwap=1 及可选的 vwap_k=1,2（各带的标准差倍数，按从小到大排列）；未请求VWAP带时返回 nil
+func webParseVWAPParams(q url.Values) ([]float64, error) {
+	if q.Get("vwap") != "1" {
+		return nil, nil
+	}
+	raw := q.Get("vwap_k")
+	if raw == "" {
+		return webVWAPDefaultBands, nil
+	}
+	var bands []float64
+	for _, s := range strings.Split(raw, ",") {
+		k, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || math.IsNaN(k) || math.IsInf(k, 0) || k <= 0 {
+			return nil, fmt.Errorf("vwap_k参数无效: %q", s)
+		}
+		bands = append(bands, k)
+	}
+	if len(bands) > WEB_VWAP_MAX_BANDS {
+		return nil, fmt.Errorf("vwap_k最多%d个", WEB_VWAP_MAX_BANDS)
+	}
+	sort.Float64s(bands)
+	return bands, nil
+}
+
+// 与图表上的点一一对应的VWAP及各带的上下沿，Upper[j]/Lower[j] 为 VWAP ± Bands[j]·σ；
+// 所在交易时段还没有成交的点为 null
+type webVWAPBands struct {
+	Bands []float64    `json:"bands"`
+	VWAP  []*float64   `json:"vwap"`
+	Upper [][]*float64 `json:"upper"`
+	Lower [][]*float64 `json:"lower"`
+}
+
+// 按交易时段累计成交量加权均价和成交量加权标准差 σ，每个交易日（从夜盘开始）重新累计。
+// all 为全部原始tick，points 为图表上的点（采样、聚合或原始数据，按时间升序），每个点取 all 中不晚于该点时间的累计值，
+// 采样后的图表也基于完整的成交计算。以 diff_vol 为权重，没有成交或价格无效的tick不参与；
+// 方差相对于交易时段第一笔成交价累计，避免价格较大时 Σv·p² − (Σv·p)²/Σv 的相消误差
+func webSessionVWAP(all, points []WebMarketData, bands []float64, pf webPriceFormat) webVWAPBands {
+	result := webVWAPBands{
+		Bands: bands,
+		VWAP:  make([]*float64, len(points)),
+		Upper: make([][]*float64, len(bands)),
+		Lower: make([][]*float64, len(bands)),
+	}
+	for j := range bands {
+		result.Upper[j] = make([]*float64, len(points))
+		result.Lower[j] = make([]*float64, len(points))
+	}
+
+	var sumV, sumDV, sumD2V, ref float64
+	var hour string // 上一笔的日期和小时，变化时才需要重新判断交易日
+	var day time.Time
+	i := 0
+	for k, point := range points {
+		for ; i < len(all) && all[i].Time <= point.Time; i++ {
+			record := all[i]
+			if len(record.Time) >= 13 && record.Time[:13] != hour {
+				hour = record.Time[:13]
+				if t, err := time.Parse("2006-01-02 15:04:05", record.Time); err == nil {
+					if d := webTradingDay(t); !d.Equal(day) {
+						day = d
+						sumV, sumDV, sumD2V = 0, 0, 0
+					}
+				}
+			}
+			price := float64(record.Price)
+			if record.DiffVol <= 0 || math.IsNaN(price) || math.IsInf(price, 0) || price <= 0 {
+				continue
+			}
+			if sumV == 0 {
+				ref = price
+			}
+			v, d := float64(record.DiffVol), price-ref
+			sumV += v
+			sumDV += v * d
+			sumD2V += v * d * d
+		}
+		if sumV == 0 {
+			continue
+		}
+		mean := sumDV / sumV
+		sigma := math.Sqrt(math.Max(sumD2V/sumV-mean*mean, 0))
+		vwap := pf.round(ref+mean, 2)
+		result.VWAP[k] = &vwap
+		for j, band := range bands {
+			upper, lower := pf.round(ref+mean+band*sigma, 2), pf.round(ref+mean-band*sigma, 2)
+			result.Upper[j][k], result.Lower[j][k] = &upper, &lower
+		}
+	}
+	return result
+}
+
+// 页面和PNG上VWAP线和带的颜色
+var webVWAPColor = drawing.Color{R: 0, G: 123, B: 255, A: 255}
+
+// PNG图表上的VWAP带：由外向内填充各带（内侧的带颜色叠加更深），再画VWAP虚线。
+// 不参与纵轴范围计算，超出绘图区的部分截断在边缘
+type webVWAPSeries struct {
+	Name    string
+	XValues []time.Time
+	Bands   webVWAPBands
+}
+
+func (s webVWAPSeries) GetName() string           { return s.Name }
+func (s webVWAPSeries) GetYAxis() chart.YAxisType { return chart.YAxisPrimary }
+func (s webVWAPSeries) Validate() error           { return nil }
+
+func (s webVWAPSeries) GetStyle() chart.Style {
+	return chart.Style{StrokeColor: webVWAPColor, StrokeWidth: 2, StrokeDashArray: []float64{6, 4}}
+}
+
+func (s webVWAPSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	x := func(k int) int { return canvasBox.Left + xrange.Translate(chart.TimeToFloat64(s.XValues[k])) }
+	y := func(v float64) int {
+		py := canvasBox.Bottom - yrange.Translate(v)
+		if py < canvasBox.Top {
+			return canvasBox.Top
+		}
+		if py > canvasBox.Bottom {
+			return canvasBox.Bottom
+		}
+		return py
+	}
+	// 连续有值的一段点 [start, end)，没有成交的点把线和带断开
+	segments := func(values []*float64, draw func(start, end int)) {
+		for start := 0; start < len(values); {
+			if values[start] == nil {
+				start++
+				continue
+			}
+			end := start
+			for end < len(values) && values[end] != nil {
+				end++
+			}
+			draw(start, end)
+			start = end
+		}
+	}
+
+	for j := len(s.Bands.Bands) - 1; j >= 0; j-- {
+		upper, lower := s.Bands.Upper[j], s.Bands.Lower[j]
+		segments(upper, func(start, end int) {
+			r.SetFillColor(webVWAPColor.WithAlpha(24))
+			r.SetStrokeWidth(0)
+			r.MoveTo(x(start), y(*upper[start]))
+			for k := start + 1; k < end; k++ {
+				r.LineTo(x(k), y(*upper[k]))
+			}
+			for k := end - 1; k >= start; k-- {
+				r.LineTo(x(k), y(*lower[k]))
+			}
+			r.Close()
+			r.Fill()
+		})
+	}
+	segments(s.Bands.VWAP, func(start, end int) {
+		r.SetStrokeColor(webVWAPColor)
+		r.SetStrokeWidth(1.5)
+		r.SetStrokeDashArray([]float64{6, 4})
+		r.MoveTo(x(start), y(*s.Bands.VWAP[start]))
+		for k := start + 1; k < end; k++ {
+			r.LineTo(x(k), y(*s.Bands.VWAP[k]))
+		}
+		r.Stroke()
+	})
+	r.SetStrokeDashArray(nil)
+}
+
+// 高低点识别：默认反转超过10跳确认一个高低点，一次最多返回的高低点数
+const (
+	PIVOT_DEFAULT_TICKS = 10
+	PIVOT_MAX_POINTS    = 500
+)
+
+// 一个摆动高点或低点。change_ticks 为相对前一个高低点的价格变化（跳），seconds 为相隔的秒数；
+// 最后一个极值还没有出现足够幅度的反转时 confirmed 为 false，之后的行情可能把它推得更高或更低
+type webPivot struct {
+	Time        string  `json:"time"`
+	Price       float64 `json:"price"`
+	Kind        string  `json:"kind"` // high 或 low
+	ChangeTicks float64 `json:"change_ticks"`
+	Seconds     int64   `json:"seconds"`
+	Confirmed   bool    `json:"confirmed"`
+}
+
+// 按反转幅度识别摆动高低点（ZigZag）：价格从最近的极值反向移动 ticks 跳以上时确认该极值为高点或低点，
+// 高低点交替出现，ticks 越小越灵敏。开始时方向未定，先被反转确认的一侧成为第一个高低点；价格无效的tick跳过
+func webFindPivots(data []WebMarketData, ticks int, tick float64) []webPivot {
+	if tick <= 0 {
+		return nil
+	}
+	threshold := float64(ticks) * tick
+	price := func(i int) float64 { return webPriceValue(data[i].Price, data[i].Symbol) }
+
+	var pivots []webPivot
+	add := func(i int, kind string, confirmed bool) {
+		p := webPivot{Time: data[i].Time, Price: price(i), Kind: kind, Confirmed: confirmed}
+		if n := len(pivots); n > 0 {
+			prev := pivots[n-1]
+			p.ChangeTicks = math.Round((p.Price - prev.Price) / tick)
+			from, errFrom := time.Parse("2006-01-02 15:04:05", prev.Time)
+			to, errTo := time.Parse("2006-01-02 15:04:05", p.Time)
+			if errFrom == nil && errTo == nil {
+				p.Seconds = int64(to.Sub(from) / time.Second)
+			}
+		}
+		pivots = append(pivots, p)
+	}
+
+	dir, hi, lo := 0, -1, -1 // dir 为当前摆动的方向：1 寻找高点，-1 寻找低点
+	for i := range data {
+		p := price(i)
+		if math.IsNaN(p) || math.IsInf(p, 0) || p <= 0 {
+			continue
+		}
+		if hi < 0 {
+			hi, lo = i, i
+			continue
+		}
+		switch dir {
+		case 0:
+			if p > price(hi) {
+				hi = i
+			}
+			if p < price(lo) {
+				lo = i
+			}
+			if price(hi)-p >= threshold {
+				add(hi, "high", true)
+				dir, lo = -1, i
+			} else if p-price(lo) >= threshold {
+				add(lo, "low", true)
+				dir, hi = 1, i
+			}
+		case 1:
+			if p > price(hi) {
+				hi = i
+			} else if price(hi)-p >= threshold {
+				add(hi, "high", true)
+				dir, lo = -1, i
+			}
+		case -1:
+			if p < price(lo) {
+				lo = i
+			} else if p-price(lo) >= threshold {
+				add(lo, "low", true)
+				dir, hi = 1, i
+			}
+		}
+	}
+	switch dir {
+	case 1:
+		add(hi, "high", false)
+	case -1:
+		add(lo, "low", false)
+	}
+	return pivots
+}
+
+// 高低点接口：/api/v1/pivots?table=jm&symbol=jm2509&range=1d&from=...&to=...&ticks=10
+// 在数据集的可见范围（from/to，省略时为整个数据集）内按全部原始tick识别摆动高低点，供页面标注和下游程序使用。
+// 超过 PIVOT_MAX_POINTS 个时只返回最近的部分并标记 truncated
+func webPivotsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if err := webValidateDatasetRange(q.Get("range")); err != nil {
+		fail(fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+	ticks := PIVOT_DEFAULT_TICKS
+	if s := q.Get("ticks"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			fail(fmt.Sprintf("ticks参数无效: %q", s))
+			return
+		}
+		ticks = n
+	}
+
+	key := webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))}
+	view, err := webGetView(webAuditContext(r), key)
+	if err != nil {
+		fail(fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+	window := view.all
+	from, to := q.Get("from"), q.Get("to")
+	if from != "" || to != "" {
+		start, err := webParseWallTime(from)
+		var end time.Time
+		if err == nil {
+			end, err = webParseWallTime(to)
+		}
+		if err != nil {
+			fail(fmt.Sprintf("可见范围无效: %v", err))
+			return
+		}
+		from, to = start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05")
+		window = webSliceWindow(view.all, from, to)
+	}
+
+	tick := webTickSizeFor(symbol)
+	if tick <= 0 {
+		prices := make([]float64, len(window))
+		for i, record := range window {
+			prices[i] = webRawPrice(record.Price)
+		}
+		tick = webEstimateTickSize(prices)
+	}
+	pivots := webFindPivots(window, ticks, tick)
+	truncated := len(pivots) > PIVOT_MAX_POINTS
+	if truncated {
+		pivots = pivots[len(pivots)-PIVOT_MAX_POINTS:]
+	}
+	if pivots == nil {
+		pivots = []webPivot{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":     table,
+		"symbol":    symbol,
+		"range":     key.rangeSpec,
+		"from":      from,
+		"to":        to,
+		"ticks":     ticks,
+		"tick_size": tick,
+		"records":   len(window),
+		"truncated": truncated,
+		"pivots":    pivots,
+	})
+}
+
+// 价位线（支撑/压力位）：页面上添加的按合约保存在 -levels-file 中，配置文件 levels 中的只读；
+// 两者合并后画在页面、PNG图表、终端查看器和ASCII图上，实时跟踪时价格穿越价位线触发告警
+type webPriceLevel struct {
+	ID     string  `json:"id"`
+	Price  float64 `json:"price"`
+	Label  string  `json:"label,omitempty"`
+	Source string  `json:"source,omitempty"` // config 为配置文件中的价位线，不能在页面删除
+}
+
+var (
+	webLevelsPath   = "levels.json"
+	webLevels       = map[string][]webPriceLevel{} // 页面添加的价位线，按小写合约代码
+	webConfigLevels = map[string][]webPriceLevel{} // 配置文件 levels 中的价位线
+	webLevelsMutex  sync.Mutex
+)
+
+// 读取价位线文件 {"jm2509": [{"id": "...", "price": 1012.5, "label": "前高"}]}，文件不存在时为空
+func webLoadLevels(path string) (map[string][]webPriceLevel, error) {
+	levels := map[string][]webPriceLevel{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return levels, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read levels %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &levels); err != nil {
+		return nil, fmt.Errorf("invalid levels %s: %w", path, err)
+	}
+	return levels, nil
+}
+
+// 写入价位线文件：先写临时文件再改名，写到一半退出时不会留下损坏的文件。调用方持有 webLevelsMutex
+func webSaveLevels() error {
+	data, err := json.MarshalIndent(webLevels, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := webLevelsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, webLevelsPath)
+}
+
+// 合约的全部价位线（配置文件中的和页面添加的），按价格升序
+func webLevelsFor(symbol string) []webPriceLevel {
+	symbol = strings.ToLower(symbol)
+	webLevelsMutex.Lock()
+	levels := append(append([]webPriceLevel{}, webConfigLevels[symbol]...), webLevels[symbol]...)
+	webLevelsMutex.Unlock()
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].Price < levels[j].Price })
+	return levels
+}
+
+// 配置文件 levels 中的价位线：{"jm2509": [{"price": 1000, "label": "前低"}]}，合约代码不区分大小写
+func webParseConfigLevels(levels map[string][]webPriceLevel) (map[string][]webPriceLevel, error) {
+	parsed := make(map[string][]webPriceLevel, len(levels))
+	for symbol, list := range levels {
+		key := strings.ToLower(symbol)
+		if !webIsIdentifier(key) {
+			return nil, fmt.Errorf("invalid symbol %q", symbol)
+		}
+		for i, level := range list {
+			if math.IsNaN(level.Price) || math.IsInf(level.Price, 0) || level.Price <= 0 {
+				return nil, fmt.Errorf("%s: invalid price %v", symbol, level.Price)
+			}
+			parsed[key] = append(parsed[key], webPriceLevel{
+				ID:     fmt.Sprintf("config-%d", i+1),
+				Price:  level.Price,
+				Label:  level.Label,
+				Source: "config",
+			})
+		}
+	}
+	return parsed, nil
+}
+
+// 价位线的价格列表，用于比较配置的差异
+func webLevelPrices(levels []webPriceLevel) string {
+	if len(levels) == 0 {
+		return "none"
+	}
+	prices := make([]string, len(levels))
+	for i, level := range levels {
+		prices[i] = strconv.FormatFloat(level.Price, 'f', -1, 64)
+	}
+	return strings.Join(prices, " ")
+}
+
+// 价位线接口：GET /api/v1/levels?symbol=jm2509 列出，POST ?symbol=&price=&label= 添加，
+// DELETE ?symbol=&id= 删除；添加和删除保存到 -levels-file 并通过 /updates 通知已打开的页面
+func webLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+	q := r.URL.Query()
+	symbol := strings.ToLower(q.Get("symbol"))
+	if !webIsIdentifier(symbol) {
+		fail(http.StatusBadRequest, "缺少symbol参数或格式无效")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		price, err := strconv.ParseFloat(q.Get("price"), 64)
+		if err != nil || math.IsNaN(price) || math.IsInf(price, 0) || price <= 0 {
+			fail(http.StatusBadRequest, fmt.Sprintf("price参数无效: %q", q.Get("price")))
+			return
+		}
+		for _, level := range webLevelsFor(symbol) {
+			if level.Price == price {
+				fail(http.StatusConflict, fmt.Sprintf("价位线 %v 已存在", price))
+				return
+			}
+		}
+		level := webPriceLevel{
+			ID:    strconv.FormatInt(time.Now().UnixNano(), 36),
+			Price: price,
+			Label: strings.TrimSpace(q.Get("label")),
+		}
+		webLevelsMutex.Lock()
+		webLevels[symbol] = append(webLevels[symbol], level)
+		err = webSaveLevels()
+		webLevelsMutex.Unlock()
+		if err != nil {
+			log.Printf("Failed to save levels: %v", err)
+			fail(http.StatusInternalServerError, fmt.Sprintf("保存价位线失败: %v", err))
+			return
+		}
+		log.Printf("Added level %v (%s) for %s", level.Price, level.Label, symbol)
+	case http.MethodDelete:
+		id := q.Get("id")
+		webLevelsMutex.Lock()
+		list := webLevels[symbol]
+		index := -1
+		for i, level := range list {
+			if level.ID == id {
+				index = i
+			}
+		}
+		var err error
+		if index >= 0 {
+			webLevels[symbol] = append(list[:index:index], list[index+1:]...)
+			if len(webLevels[symbol]) == 0 {
+				delete(webLevels, symbol)
+			}
+			err = webSaveLevels()
+		}
+		webLevelsMutex.Unlock()
+		switch {
+		case index < 0 && strings.HasPrefix(id, "config-"):
+			fail(http.StatusBadRequest, "配置文件中的价位线不能在页面删除，请修改配置文件")
+			return
+		case index < 0:
+			fail(http.StatusNotFound, fmt.Sprintf("价位线 %q 不存在", id))
+			return
+		case err != nil:
+			log.Printf("Failed to save levels: %v", err)
+			fail(http.StatusInternalServerError, fmt.Sprintf("保存价位线失败: %v", err))
+			return
+		}
+		log.Printf("Removed level %s for %s", id, symbol)
+	default:
+		fail(http.StatusMethodNotAllowed, "只支持 GET、POST 和 DELETE")
+		return
+	}
+
+	levels := webLevelsFor(symbol)
+	if r.Method != http.MethodGet {
+		webBroadcastMessage(map[string]interface{}{"type": "levels", "symbol": symbol, "levels": levels})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"symbol": symbol, "levels": levels})
+}
+
+// 页面和PNG上价位线的颜色
+var webLevelColor = drawing.Color{R: 255, G: 140, B: 0, A: 255}
+
+// PNG图表上的价位线：横跨绘图区的虚线，说明和价格标在右端；纵轴范围之外的价位线不画
+type webLevelSeries struct {
+	Name   string
+	Levels []webPriceLevel
+}
+
+func (s webLevelSeries) GetName() string           { return s.Name }
+func (s webLevelSeries) GetYAxis() chart.YAxisType { return chart.YAxisPrimary }
+func (s webLevelSeries) Validate() error           { return nil }
+
+func (s webLevelSeries) GetStyle() chart.Style {
+	return chart.Style{StrokeColor: webLevelColor, StrokeWidth: 1, StrokeDashArray: []float64{4, 4}}
+}
+
+func (s webLevelSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	textStyle := chart.Style{FontColor: webLevelColor, FontSize: 9}.InheritFrom(defaults)
+	for _, level := range s.Levels {
+		if level.Price < yrange.GetMin() || level.Price > yrange.GetMax() {
+			continue
+		}
+		y := canvasBox.Bottom - yrange.Translate(level.Price)
+		r.SetStrokeColor(webLevelColor)
+		r.SetStrokeWidth(1)
+		r.SetStrokeDashArray([]float64{4, 4})
+		r.MoveTo(canvasBox.Left, y)
+		r.LineTo(canvasBox.Right, y)
+		r.Stroke()
+		r.SetStrokeDashArray(nil)
+
+		text := strconv.FormatFloat(level.Price, 'f', -1, 64)
+		if level.Label != "" {
+			text = level.Label + " " + text
+		}
+		textStyle.WriteToRenderer(r)
+		width := r.MeasureText(text).Width()
+		chart.Draw.Text(r, text, canvasBox.Right-width-4, y-3, textStyle)
+	}
+}
+
+// 服务端缓存的数据集，按 表/symbol/时间范围 区分
+type webDatasetKey struct {
+	table     string
+	symbol    string
+	rangeSpec string
+}
+
+func (k webDatasetKey) String() string {
+	return k.table + "/" + k.symbol + "@" + k.rangeSpec
+}
+
+type webDataset struct {
+	data       []WebMarketData
+	fetchedAt  time.Time
+	usedAt     time.Time
+	pinned     bool // watchlist（-refresh-symbols 或配置文件）中的数据集不会因闲置被淘汰
+	refreshing bool // 已过期、正在后台重新查询
+}
+
+// 闲置超过该刷新周期数的数据集不再定时刷新
+const WEB_DATASET_IDLE_INTERVALS = 10
+
+var (
+	webDatasets      = make(map[webDatasetKey]*webDataset)
+	webDatasetsMutex sync.Mutex
+
+	// 连接配置的代数，切换配置时在 webDatasetsMutex 下加一。查询前记下代数，写回缓存或展示数据时
+	// 代数已经变化，说明结果来自切换前的集群，直接丢弃
+	webProfileGeneration atomic.Uint64
+
+	// 启动时加载的数据集，也是新会话默认显示的数据集
+	webDefaultKey = webDatasetKey{"jm", "jm2509", "all"}
+
+	// 缓存未命中、正在查询的数据集，受 webDatasetsMutex 保护
+	webDatasetCalls = make(map[webDatasetKey]*webDatasetCall)
+)
+
+// 一次正在进行的数据集查询：同一数据集同时未命中的请求等待它的结果，只向ClickHouse查询一次
+type webDatasetCall struct {
+	done chan struct{}
+	gen  uint64
+	data []WebMarketData
+	err  error
+}
+
+// 解析 table/symbol[@range] 形式的数据集列表，range 默认为 all
+func webParseDatasetKeys(list string) ([]webDatasetKey, error) {
+	var keys []webDatasetKey
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		rangeSpec := "all"
+		if i := strings.Index(item, "@"); i >= 0 {
+			item, rangeSpec = item[:i], item[i+1:]
+		}
+		table, symbol, ok := strings.Cut(item, "/")
+		if !ok || !webIsIdentifier(table) || symbol == "" {
+			return nil, fmt.Errorf("invalid dataset %q, expected table/symbol[@range]", item)
+		}
+		if err := webValidateDatasetRange(rangeSpec); err != nil {
+			return nil, err
+		}
+		keys = append(keys, webDatasetKey{table, symbol, webNormalizeRange(rangeSpec)})
+	}
+	return keys, nil
+}
+
+func webNormalizeRange(spec string) string {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" {
+		return "all"
+	}
+	return spec
+}
+
+func webFetchDataset(ctx context.Context, key webDatasetKey) ([]WebMarketData, error) {
+	if day, ok, err := webParseSessionRange(key.rangeSpec); ok {
+		if err != nil {
+			return nil, err
+		}
+		from, to := webSessionBounds(day)
+		return webQueryMarketDataBetween(ctx, key.table, key.symbol, from, to)
+	}
+	span, err := webParseRelativeRange(key.rangeSpec)
+	if err != nil {
+		return nil, err
+	}
+	return webQueryMarketDataDynamic(ctx, key.table, key.symbol, span)
+}
+
+// 启用定时刷新或缓存有效期时，数据集查询结果按 表/symbol/时间范围 缓存。
+// 两个设置可以通过 -config 热加载修改，读写都在 webDatasetsMutex 下进行
+func webCacheEnabled() bool {
+	webDatasetsMutex.Lock()
+	defer webDatasetsMutex.Unlock()
+	return webRefreshInterval > 0 || webCacheTTL > 0
+}
+
+// 数据集是否已在缓存中，命中时 webGetDataset 不会重新查询
+func webDatasetCached(key webDatasetKey) bool {
+	webDatasetsMutex.Lock()
+	defer webDatasetsMutex.Unlock()
+	_, ok := webDatasets[key]
+	return ok && (webRefreshInterval > 0 || webCacheTTL > 0)
+}
+
+// 获取数据集：启用缓存时优先使用缓存，由后台刷新保证数据新鲜度；缓存超过 -cache-ttl 时
+// 立即返回旧数据（stale 为 true）并在后台重新查询，完成后通过 /updates 通知页面。未启用缓存时直接查询。
+// 同一数据集同时未命中的请求合并为一次查询
+func webGetDataset(ctx context.Context, key webDatasetKey) (data []WebMarketData, stale bool, err error) {
+	// 缓存在用户之间共享，命中时不经过查询构造器，先在这里检查权限
+	if u := webContextUser(ctx); !u.allows(key.table, key.symbol) {
+		return nil, false, u.denied(key.table, key.symbol)
+	}
+
+	for {
+		webDatasetsMutex.Lock()
+		cacheEnabled := webRefreshInterval > 0 || webCacheTTL > 0
+		if ds, ok := webDatasets[key]; ok && cacheEnabled {
+			ds.usedAt = time.Now()
+			stale = webCacheTTL > 0 && time.Since(ds.fetchedAt) > webCacheTTL
+			if stale && !ds.refreshing {
+				ds.refreshing = true
+				go webRevalidateDataset(key)
+			}
+			webDatasetsMutex.Unlock()
+			return ds.data, stale, nil
+		}
+		gen := webProfileGeneration.Load()
+		if call, ok := webDatasetCalls[key]; ok && call.gen == gen {
+			webDatasetsMutex.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+			// 发起查询的请求被取消（页面关闭）时，等待的请求自己重新查询
+			if errors.Is(call.err, context.Canceled) && ctx.Err() == nil {
+				continue
+			}
+			return call.data, false, call.err
+		}
+		call := &webDatasetCall{done: make(chan struct{}), gen: gen, err: errors.New("dataset query aborted")}
+		webDatasetCalls[key] = call
+		webDatasetsMutex.Unlock()
+
+		// 查询中panic时也要唤醒等待的请求
+		defer func() {
+			webDatasetsMutex.Lock()
+			if webDatasetCalls[key] == call {
+				delete(webDatasetCalls, key)
+			}
+			webDatasetsMutex.Unlock()
+			close(call.done)
+		}()
+		call.data, call.err = webFetchDataset(ctx, key)
+		if call.err == nil && cacheEnabled {
+			webStoreDataset(key, call.data, false, gen)
+		}
+		return call.data, false, call.err
+	}
+}
+
+// 后台重新查询过期的数据集，更新缓存和共享的展示数据后通知订阅了 /updates 的页面
+func webRevalidateDataset(key webDatasetKey) {
+	start := time.Now()
+	gen := webProfileGeneration.Load()
+	data, err := webFetchDataset(context.Background(), key)
+
+	webDatasetsMutex.Lock()
+	if ds, ok := webDatasets[key]; ok {
+		ds.refreshing = false
+	}
+	webDatasetsMutex.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to revalidate %s: %v", key, err)
+		return
+	}
+	if !webStoreDataset(key, data, false, gen) {
+		log.Printf("Dropped revalidated %s: ClickHouse profile switched during the query", key)
+		return
+	}
+
+	webDataMutex.RLock()
+	_, loaded := webViews[key]
+	webDataMutex.RUnlock()
+	if loaded && len(data) > 0 {
+		webSetLoadedData(key, data, gen)
+	}
+
+	fmt.Printf("Revalidated %s in %v (%d records)\n", key, time.Since(start), len(data))
+	webBroadcastUpdate(key)
+}
+
+// 写入缓存，gen 为查询开始时的配置代数；之后切换过配置时不写入并返回 false
+func webStoreDataset(key webDatasetKey, data []WebMarketData, pinned bool, gen uint64) bool {
+	webDatasetsMutex.Lock()
+	defer webDatasetsMutex.Unlock()
+
+	if gen != webProfileGeneration.Load() {
+		return false
+	}
+	now := time.Now()
+	ds, ok := webDatasets[key]
+	if !ok {
+		ds = &webDataset{usedAt: now}
+		webDatasets[key] = ds
+	}
+	ds.data = data
+	ds.fetchedAt = now
+	ds.pinned = ds.pinned || pinned
+
+	// 没有定时刷新时由这里淘汰长时间未被请求的数据集
+	if webRefreshInterval <= 0 {
+		idle := now.Add(-WEB_DATASET_IDLE_INTERVALS * webCacheTTL)
+		for key, ds := range webDatasets {
+			if !ds.pinned && ds.usedAt.Before(idle) {
+				delete(webDatasets, key)
+			}
+		}
+	}
+	return true
+}
+
+// /updates 的订阅者，数据集刷新完成后推送 {"type":"dataset","key":...}
+var (
+	webUpdateSubscribers      = make(map[chan string]struct{})
+	webUpdateSubscribersMutex sync.Mutex
+)
+
+func webBroadcastUpdate(key webDatasetKey) {
+	message, _ := json.Marshal(map[string]interface{}{
+		"type":       "dataset",
+		"key":        key.String(),
+		"fetched_at": time.Now().Format("2006-01-02 15:04:05"),
+	})
+
+	webUpdateSubscribersMutex.Lock()
+	defer webUpdateSubscribersMutex.Unlock()
+	for ch := range webUpdateSubscribers {
+		select {
+		case ch <- string(message):
+		default: // 客户端处理不过来时丢弃，下一次刷新还会再通知
+		}
+	}
+}
+
+// 数据集更新通知 (Server-Sent Events)：页面据此在后台刷新完成后重新获取当前数据
+func webUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan string, 16)
+	webUpdateSubscribersMutex.Lock()
+	webUpdateSubscribers[ch] = struct{}{}
+	webUpdateSubscribersMutex.Unlock()
+	defer func() {
+		webUpdateSubscribersMutex.Lock()
+		delete(webUpdateSubscribers, ch)
+		webUpdateSubscribersMutex.Unlock()
+	}()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", message)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// 一个已加载数据集的展示数据：原始数据、默认采样和预聚合金字塔
+type webView struct {
+	key     webDatasetKey
+	all     []WebMarketData
+	sampled []WebMarketData
+	pyramid []webPyramidLevel
+}
+
+// 为数据集构建展示数据（重新采样并重建预聚合金字塔），供所有显示该数据集的会话共享；
+// 数据没有变化（同一份缓存）时直接复用已有的展示数据。gen 为查询开始时的配置代数，
+// 之后切换过配置时只返回展示数据而不共享
+func webSetLoadedData(key webDatasetKey, data []WebMarketData, gen uint64) *webView {
+	webDataMutex.RLock()
+	existing, ok := webViews[key]
+	webDataMutex.RUnlock()
+	if ok && len(existing.all) == len(data) && (len(data) == 0 || &existing.all[0] == &data[0]) {
+		return existing
+	}
+
+	view := &webView{
+		key:     key,
+		all:     data,
+		sampled: webDownsample(data, WEB_SAMPLE_SIZE, webCurrentDownsampling()),
+		pyramid: webBuildPyramid(data),
+	}
+
+	webDataMutex.Lock()
+	if gen == webProfileGeneration.Load() {
+		webViews[key] = view
+	}
+	webDataMutex.Unlock()
+	return view
+}
+
+// 获取数据集的展示数据，尚未加载（或已被淘汰）时重新查询。展示数据在用户之间共享，按 ctx 中的用户检查权限
+func webGetView(ctx context.Context, key webDatasetKey) (*webView, error) {
+	if u := webContextUser(ctx); !u.allows(key.table, key.symbol) {
+		return nil, u.denied(key.table, key.symbol)
+	}
+	webDataMutex.RLock()
+	view, ok := webViews[key]
+	webDataMutex.RUnlock()
+	if ok {
+		return view, nil
+	}
+
+	gen := webProfileGeneration.Load()
+	data, _, err := webGetDataset(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, webEmptyDatasetError(key.table, key.symbol)
+	}
+	return webSetLoadedData(key, data, gen), nil
+}
+
+const (
+	WEB_SESSION_COOKIE = "chart_session"
+	// 闲置超过该时间的会话被清理，其显示的数据集如果没有其他会话使用也一并释放
+	WEB_SESSION_IDLE = 24 * time.Hour
+	// 清理闲置会话的间隔
+	WEB_SESSION_PRUNE_INTERVAL = 10 * time.Minute
+)
+
+// 每个浏览器会话（cookie）独立的选择：数据集（表、symbol、时间范围）和显示偏好，
+// 数据本身通过 webViews 按查询键共享
+type webSession struct {
+	key        webDatasetKey
+	series     string
+	raw        bool
+	flowColor  string   // 成交/增仓副图的柱子着色方式，见 webFlowColorModes
+	indicators []string // 开启的指标，见 webIndicatorNames
+	usedAt     time.Time
+}
+
+// 成交/增仓副图的着色方式：sign 成交量柱统一颜色、持仓变化柱按正负着色；oi 成交量柱按同一根柱子的持仓变化着色，
+// 增仓（开仓为主）为红、减仓（平仓为主）为绿，颜色深浅为持仓变化占成交量的比例；volume 成交量柱按成交强度由浅到深着色
+var webFlowColorModes = map[string]bool{"sign": true, "oi": true, "volume": true}
+
+var (
+	webSessions      = make(map[string]*webSession)
+	webSessionsMutex sync.Mutex
+)
+
+// 界面状态文件（-state-file），与终端查看器和 simple_chart 共用：记录最近一次使用的数据集、价格序列、配色和开启的指标，
+// 重启后新会话从这里开始；窗口大小和滚动位置由终端查看器写入，这里原样保留
+type webUIState struct {
+	Table      string   `json:"table,omitempty"`
+	Symbol     string   `json:"symbol,omitempty"`
+	Range      string   `json:"range,omitempty"`
+	Series     string   `json:"series,omitempty"`
+	Theme      string   `json:"theme,omitempty"`
+	Indicators []string `json:"indicators,omitempty"`
+	WindowSize int      `json:"window_size,omitempty"`
+	WindowEnd  string   `json:"window_end,omitempty"`
+	Follow     bool     `json:"follow,omitempty"`
+	SavedAt    string   `json:"saved_at,omitempty"`
+	SavedBy    string   `json:"saved_by,omitempty"`
+}
+
+// 定期保存界面状态的间隔，收到 SIGINT/SIGTERM 退出时另外保存一次
+const WEB_STATE_SAVE_INTERVAL = 30 * time.Second
+
+// 页面上可以开关的指标，保存在会话和界面状态中
+var webIndicatorNames = map[string]bool{"percent": true, "regimes": true, "vwap": true, "pivots": true, "profile": true, "exact": true}
+
+var (
+	webStatePath = "ui_state.json"
+	// 新会话的初始选择，启动时从 -state-file 恢复，运行期间不变
+	webStartState = webUIState{Table: "jm", Symbol: "jm2509", Range: "all", Series: "price"}
+	// 最近一次使用的选择，由保存循环写入 -state-file
+	webLastState  = webStartState
+	webStateDirty bool
+	webStateMutex sync.Mutex
+)
+
+// 读取界面状态文件，文件不存在时为空
+func webLoadUIState(path string) (webUIState, error) {
+	var state webUIState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return webUIState{}, fmt.Errorf("invalid state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// 解析开启的指标列表（逗号分隔），去掉重复项
+func webParseIndicators(list string) ([]string, error) {
+	indicators := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if !webIndicatorNames[name] {
+			return nil, fmt.Errorf("unknown indicator %q", name)
+		}
+		seen[name] = true
+		indicators = append(indicators, name)
+	}
+	return indicators, nil
+}
+
+// 用状态文件中的选择作为新会话的初始值，无效的字段保留默认值
+func webRestoreUIState(state webUIState) {
+	webStateMutex.Lock()
+	defer webStateMutex.Unlock()
+	if webIsIdentifier(state.Table) && webIsIdentifier(state.Symbol) {
+		webStartState.Table, webStartState.Symbol = state.Table, state.Symbol
+		if state.Range != "" && webValidateDatasetRange(state.Range) == nil {
+			webStartState.Range = webNormalizeRange(state.Range)
+		}
+	}
+	if state.Series == "price" || state.Series == "mid" || state.Series == "spread" {
+		webStartState.Series = state.Series
+	}
+	if indicators, err := webParseIndicators(strings.Join(state.Indicators, ",")); err == nil {
+		webStartState.Indicators = indicators
+	}
+	webLastState = webStartState
+}
+
+// 新会话的初始选择
+func webSessionDefaults() webSession {
+	webStateMutex.Lock()
+	defer webStateMutex.Unlock()
+	return webSession{
+		key:        webDatasetKey{webStartState.Table, webStartState.Symbol, webStartState.Range},
+		series:     webStartState.Series,
+		indicators: webStartState.Indicators,
+		flowColor:  "sign",
+	}
+}
+
+// 记录会话当前的选择为最近一次使用的状态，由保存循环写入文件
+func webRememberSession(session webSession) {
+	webStateMutex.Lock()
+	defer webStateMutex.Unlock()
+	webLastState.Table, webLastState.Symbol, webLastState.Range = session.key.table, session.key.symbol, session.key.rangeSpec
+	webLastState.Series = session.series
+	webLastState.Indicators = session.indicators
+	webStateDirty = true
+}
+
+// 把最近一次使用的状态合并进状态文件：先读出其他查看器写入的字段，再写临时文件并改名。
+// 合约变化时清除终端查看器的滚动位置，它属于原来的合约
+func webSaveUIState() error {
+	webStateMutex.Lock()
+	defer webStateMutex.Unlock()
+	state, err := webLoadUIState(webStatePath)
+	if err != nil {
+		log.Printf("Overwriting unreadable state file: %v", err)
+		state = webUIState{}
+	}
+	if !strings.EqualFold(state.Symbol, webLastState.Symbol) {
+		state.WindowEnd, state.Follow = "", false
+	}
+	state.Table, state.Symbol, state.Range = webLastState.Table, webLastState.Symbol, webLastState.Range
+	state.Series = webLastState.Series
+	state.Indicators = webLastState.Indicators
+	webConfigMutex.Lock()
+	state.Theme = webTheme
+	webConfigMutex.Unlock()
+	state.SavedAt = time.Now().Format("2006-01-02 15:04:05")
+	state.SavedBy = "web"
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := webStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, webStatePath); err != nil {
+		return err
+	}
+	webStateDirty = false
+	return nil
+}
+
+// 有改动时定期保存界面状态
+func webStateSaveLoop() {
+	ticker := time.NewTicker(WEB_STATE_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		webStateMutex.Lock()
+		dirty := webStateDirty
+		webStateMutex.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := webSaveUIState(); err != nil {
+			log.Printf("Failed to save UI state: %v", err)
+		}
+	}
+}
+
+// 收到 SIGINT/SIGTERM 时保存界面状态后退出
+func webSaveUIStateOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, saving UI state before exit", sig)
+		if err := webSaveUIState(); err != nil {
+			log.Printf("Failed to save UI state: %v", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+// 返回请求所属会话的ID和状态快照；没有有效cookie时返回空ID和新会话的初始选择，不创建会话。
+// 只读的请求（画图、导出、读取当前数据）使用它，不带cookie的爬虫、监控和脚本请求不会留下会话
+func webGetSession(r *http.Request) (string, webSession) {
+	webSessionsMutex.Lock()
+	defer webSessionsMutex.Unlock()
+	if id, session, ok := webLookupSessionLocked(r); ok {
+		return id, session
+	}
+	return "", webSessionDefaults()
+}
+
+func webLookupSessionLocked(r *http.Request) (string, webSession, bool) {
+	cookie, err := r.Cookie(WEB_SESSION_COOKIE)
+	if err != nil {
+		return "", webSession{}, false
+	}
+	session, ok := webSessions[cookie.Value]
+	if !ok {
+		return "", webSession{}, false
+	}
+	session.usedAt = time.Now()
+	return cookie.Value, *session, true
+}
+
+// 修改会话状态的请求使用：没有有效cookie时创建新会话并下发cookie，需要在写出响应之前调用
+func webEnsureSession(w http.ResponseWriter, r *http.Request) (string, webSession) {
+	webSessionsMutex.Lock()
+	defer webSessionsMutex.Unlock()
+	if id, session, ok := webLookupSessionLocked(r); ok {
+		return id, session
+	}
+
+	now := time.Now()
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	session := &webSession{}
+	*session = webSessionDefaults()
+	session.usedAt = now
+	webSessions[id] = session
+	http.SetCookie(w, &http.Cookie{
+		Name:     WEB_SESSION_COOKIE,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, *session
+}
+
+func webUpdateSession(id string, update func(*webSession)) {
+	webSessionsMutex.Lock()
+	defer webSessionsMutex.Unlock()
+	if session, ok := webSessions[id]; ok {
+		update(session)
+	}
+}
+
+// 定期清理闲置会话，不依赖有新会话创建
+func webSessionPruneLoop() {
+	ticker := time.NewTicker(WEB_SESSION_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		webSessionsMutex.Lock()
+		webPruneSessionsLocked(now)
+		webSessionsMutex.Unlock()
+	}
+}
+
+// 清理闲置会话，并释放不再被任何会话使用的展示数据（默认数据集始终保留）
+func webPruneSessionsLocked(now time.Time) {
+	used := map[webDatasetKey]bool{webDefaultKey: true}
+	for id, session := range webSessions {
+		if now.Sub(session.usedAt) > WEB_SESSION_IDLE {
+			delete(webSessions, id)
+			continue
+		}
+		used[session.key] = true
+	}
+
+	webDataMutex.Lock()
+	for key := range webViews {
+		if !used[key] {
+			delete(webViews, key)
+		}
+	}
+	webDataMutex.Unlock()
+}
+
+// 会话状态接口：GET 返回本会话当前的表、symbol、时间范围和显示偏好，
+// POST ?series=mid&raw=1&flow_color=oi&indicators=vwap,pivots 保存显示偏好，页面刷新后据此恢复；
+// indicators 为空时关闭全部指标，省略时不变
+func webSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, session := webGetSession(r)
+
+	if r.Method == http.MethodPost {
+		series := r.URL.Query().Get("series")
+		if series != "" && series != "price" && series != "mid" && series != "spread" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("unknown series %q", series)})
+			return
+		}
+		flowColor := r.URL.Query().Get("flow_color")
+		if flowColor != "" && !webFlowColorModes[flowColor] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("unknown flow_color %q (sign, oi or volume)", flowColor)})
+			return
+		}
+		var indicators []string
+		if r.URL.Query().Has("indicators") {
+			var err error
+			if indicators, err = webParseIndicators(r.URL.Query().Get("indicators")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+				return
+			}
+		}
+		raw := r.URL.Query().Get("raw")
+		id, _ = webEnsureSession(w, r)
+		webUpdateSession(id, func(s *webSession) {
+			if series != "" {
+				s.series = series
+			}
+			if raw != "" {
+				s.raw = raw == "1"
+			}
+			if flowColor != "" {
+				s.flowColor = flowColor
+			}
+			if indicators != nil {
+				s.indicators = indicators
+			}
+			session = *s
+		})
+		webRememberSession(session)
+	}
+
+	indicators := session.indicators
+	if indicators == nil {
+		indicators = []string{}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":      session.key.table,
+		"symbol":     session.key.symbol,
+		"range":      session.key.rangeSpec,
+		"series":     session.series,
+		"raw":        session.raw,
+		"flow_color": session.flowColor,
+		"indicators": indicators,
+		"y_min":      webNullableFloat(webDefaultYRange.Min),
+		"y_max":      webNullableFloat(webDefaultYRange.Max),
+	})
+}
+
+// 重新查询指定的数据集，keys 为空时刷新所有缓存的数据集和所有会话正在显示的数据集，返回每个数据集的错误
+func webRefreshDatasets(keys []webDatasetKey) map[string]string {
+	webDataMutex.RLock()
+	loaded := make(map[webDatasetKey]bool, len(webViews))
+	for key := range webViews {
+		loaded[key] = true
+	}
+	webDataMutex.RUnlock()
+
+	if len(keys) == 0 {
+		for key := range loaded {
+			keys = append(keys, key)
+		}
+		webDatasetsMutex.Lock()
+		for key := range webDatasets {
+			if !loaded[key] {
+				keys = append(keys, key)
+			}
+		}
+		webDatasetsMutex.Unlock()
+	}
+
+	results := webFetchEach(context.Background(), len(keys), func(ctx context.Context, i int) error {
+		key := keys[i]
+		gen := webProfileGeneration.Load()
+		data, err := webFetchDataset(ctx, key)
+		if err != nil {
+			return err
+		}
+		if webCacheEnabled() {
+			webStoreDataset(key, data, false, gen)
+		}
+		if loaded[key] && len(data) > 0 {
+			webSetLoadedData(key, data, gen)
+			webBroadcastUpdate(key)
+		}
+		return nil
+	})
+	errs := make(map[string]string)
+	for i, err := range results {
+		if err != nil {
+			errs[keys[i].String()] = err.Error()
+		}
+	}
+	return errs
+}
+
+// 预加载 watchlist（-refresh-symbols 或配置文件）中的数据集并常驻缓存
+func webPreloadDatasets(keys []webDatasetKey) {
+	results := webFetchEach(context.Background(), len(keys), func(ctx context.Context, i int) error {
+		gen := webProfileGeneration.Load()
+		data, err := webFetchDataset(ctx, keys[i])
+		if err == nil {
+			webStoreDataset(keys[i], data, true, gen)
+		}
+		return err
+	})
+	for i, err := range results {
+		if err != nil {
+			log.Printf("Failed to preload %s: %v", keys[i], err)
+		}
+	}
+}
+
+// 同时查询多个合约时的并发上限（-fetch-concurrency），watchlist 预加载、定时刷新和联动仪表盘共用
+var webFetchConcurrency = 4
+
+// 并发执行 n 个查询，同时最多 webFetchConcurrency 个，返回与下标一一对应的错误。
+// 一个查询失败（包括panic）不影响其他查询，调用方按合约分别处理；ctx 取消后还没开始的查询不再执行
+func webFetchEach(ctx context.Context, n int, fetch func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	sem := make(chan struct{}, max(webFetchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("Fetch %d of %d panicked: %v\n%s", i+1, n, err, debug.Stack())
+					errs[i] = fmt.Errorf("服务器内部错误: %v", err)
+				}
+			}()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = fetch(ctx, i)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// 刷新间隔被热加载修改时通知 webRefreshLoop 按新的间隔重新计时
+var webRefreshReset = make(chan struct{}, 1)
+
+// 定时刷新所有缓存的数据集，淘汰长时间未被请求的非固定数据集。刷新间隔为 0 时空闲等待，
+// 直到配置文件把它改为正数
+func webRefreshLoop() {
+	for {
+		webDatasetsMutex.Lock()
+		interval := webRefreshInterval
+		webDatasetsMutex.Unlock()
+
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+		select {
+		case <-webRefreshReset:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-tick:
+		}
+
+		webDatasetsMutex.Lock()
+		idle := time.Now().Add(-WEB_DATASET_IDLE_INTERVALS * interval)
+		for key, ds := range webDatasets {
+			if !ds.pinned && ds.usedAt.Before(idle) {
+				delete(webDatasets, key)
+			}
+		}
+		webDatasetsMutex.Unlock()
+
+		start := time.Now()
+		errs := webRefreshDatasets(nil)
+		for key, err := range errs {
+			log.Printf("Failed to refresh %s: %v", key, err)
+		}
+		fmt.Printf("Scheduled refresh finished in %v (%d errors)\n", time.Since(start), len(errs))
+	}
+}
+
+// POST /refresh：强制服务端重新查询数据集，需要 Authorization: Bearer <token>。
+// ?symbols=jm/jm2509,jm/j2509@1d 指定数据集，省略时刷新所有缓存的数据集和各会话正在显示的数据集
+func webRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "只支持POST请求"})
+		return
+	}
+	if webRefreshToken == "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "刷新接口未启用，请使用 -refresh-token 启动"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+webRefreshToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "认证失败"})
+		return
+	}
+
+	keys, err := webParseDatasetKeys(r.URL.Query().Get("symbols"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	start := time.Now()
+	errs := webRefreshDatasets(keys)
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors":   errs,
+		"duration": time.Since(start).String(),
+	})
+}
+
+// 均匀采样到不超过 size 个点，数据量不超过 size 时原样返回
+func webSampleData(data []WebMarketData, size int) []WebMarketData {
+	if len(data) <= size {
+		return data
+	}
+	step := (len(data) + size - 1) / size
+	sampled := make([]WebMarketData, 0, len(data)/step+1)
+	for i := 0; i < len(data); i += step {
+		sampled = append(sampled, data[i])
+	}
+	return sampled
+}
+
+// 降采样策略：把一个桶内某个序列的原始值归约成采样点上的一个值。values 中的非有限值（NaN/Inf）由各策略自行处理，
+// at 为采样点本身在桶内的下标
+type webDownsampler interface {
+	Reduce(values []float64, at int) float64
+}
+
+type webReduceFunc func(values []float64, at int) float64
+
+func (f webReduceFunc) Reduce(values []float64, at int) float64 { return f(values, at) }
+
+// 桶内有限值的归约，没有有限值时返回 NaN
+func webReduceFinite(reduce func(acc, v float64) float64, mean bool) webReduceFunc {
+	return func(values []float64, at int) float64 {
+		acc, n := math.NaN(), 0
+		for _, v := range values {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			if n == 0 {
+				acc = v
+			} else {
+				acc = reduce(acc, v)
+			}
+			n++
+		}
+		if mean && n > 0 {
+			acc /= float64(n)
+		}
+		return acc
+	}
+}
+
+// 可选的降采样策略。sample 为采样点本身的值（均匀采样），last 为桶内最后一笔，max 保留尖峰（适合成交量），
+// mean 适合持仓量这类平滑序列，sum 保留桶内的累计增量
+var webDownsamplers = map[string]webDownsampler{
+	"sample": webReduceFunc(func(values []float64, at int) float64 { return values[at] }),
+	"last":   webReduceFunc(func(values []float64, at int) float64 { return values[len(values)-1] }),
+	"mean":   webReduceFinite(func(acc, v float64) float64 { return acc + v }, true),
+	"min":    webReduceFinite(math.Min, false),
+	"max":    webReduceFinite(math.Max, false),
+	"sum":    webReduceFinite(func(acc, v float64) float64 { return acc + v }, false),
+}
+
+// 可以分别选择降采样策略的序列，其余字段（时间、盘口）取采样点本身的值
+var webDownsampleSeries = []struct {
+	name string
+	get  func(WebMarketData) float64
+	set  func(*WebMarketData, float64)
+}{
+	{"price", func(r WebMarketData) float64 { return float64(r.Price) }, func(r *WebMarketData, v float64) { r.Price = float32(v) }},
+	{"open_interest", func(r WebMarketData) float64 { return float64(r.OpenInterest) }, func(r *WebMarketData, v float64) { r.OpenInterest = uint32(math.Round(v)) }},
+	{"diff_vol", func(r WebMarketData) float64 { return float64(r.DiffVol) }, func(r *WebMarketData, v float64) { r.DiffVol = int32(math.Round(v)) }},
+	{"diff_oi", func(r WebMarketData) float64 { return float64(r.DiffOI) }, func(r *WebMarketData, v float64) { r.DiffOI = int32(math.Round(v)) }},
+}
+
+// 各序列的降采样策略名，序列 → webDownsamplers 中的策略
+type webDownsampleStrategy map[string]string
+
+// 默认：价格和持仓取采样点的值，diff_vol/diff_oi 累计桶内增量，采样后的每个点相当于一根柱子
+func webDefaultDownsampling() webDownsampleStrategy {
+	return webDownsampleStrategy{"price": "sample", "open_interest": "sample", "diff_vol": "sum", "diff_oi": "sum"}
+}
+
+// 把 overrides 覆盖到 base 上，返回新的策略（不修改 base），base 中没有的序列使用默认策略
+func webMergeDownsampling(base webDownsampleStrategy, overrides map[string]string) (webDownsampleStrategy, error) {
+	merged := webFullDownsampling(base)
+	for series, name := range overrides {
+		known := false
+		for _, s := range webDownsampleSeries {
+			known = known || s.name == series
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown series %q (price, open_interest, diff_vol or diff_oi)", series)
+		}
+		if _, ok := webDownsamplers[name]; !ok {
+			return nil, fmt.Errorf("unknown downsampler %q for %s (sample, last, mean, min, max or sum)", name, series)
+		}
+		merged[series] = name
+	}
+	return merged, nil
+}
+
+// 补全没有给出的序列，使用默认策略
+func webFullDownsampling(strategy webDownsampleStrategy) webDownsampleStrategy {
+	full := webDefaultDownsampling()
+	for series, name := range strategy {
+		full[series] = name
+	}
+	return full
+}
+
+// 解析 ?downsample=diff_vol:max,open_interest:mean，覆盖到 base 上
+func webParseDownsampleParam(raw string, base webDownsampleStrategy) (webDownsampleStrategy, error) {
+	overrides := make(map[string]string)
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		series, name, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid downsample %q, expected series:strategy", item)
+		}
+		overrides[strings.TrimSpace(series)] = strings.TrimSpace(name)
+	}
+	return webMergeDownsampling(base, overrides)
+}
+
+func (s webDownsampleStrategy) String() string {
+	parts := make([]string, 0, len(webDownsampleSeries))
+	for _, series := range webDownsampleSeries {
+		parts = append(parts, series.name+":"+s[series.name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// 与 webSampleData 取相同的点，每个点代表自上一个采样点之后（不含）到该点的一桶记录，最后一个采样点之后的记录并入最后一桶；
+// 各序列在桶内按 strategy 归约
+func webDownsample(data []WebMarketData, size int, strategy webDownsampleStrategy) []WebMarketData {
+	if len(data) <= size {
+		return data
+	}
+	step := (len(data) + size - 1) / size
+	reducers := make([]webDownsampler, len(webDownsampleSeries))
+	for i, series := range webDownsampleSeries {
+		reducers[i] = webDownsamplers[strategy[series.name]]
+		if reducers[i] == nil {
+			reducers[i] = webDownsamplers["sample"]
+		}
+	}
+
+	var points []int
+	for i := 0; i < len(data); i += step {
+		points = append(points, i)
+	}
+	sampled := make([]WebMarketData, len(points))
+	values := make([]float64, 0, 2*step)
+	for k, at := range points {
+		lo, hi := 0, at+1
+		if k > 0 {
+			lo = points[k-1] + 1
+		}
+		if k == len(points)-1 {
+			hi = len(data)
+		}
+		record := data[at]
+		for i, series := range webDownsampleSeries {
+			values = values[:0]
+			for _, r := range data[lo:hi] {
+				values = append(values, series.get(r))
+			}
+			series.set(&record, reducers[i].Reduce(values, at-lo))
+		}
+		sampled[k] = record
+	}
+	return sampled
+}
+
+// 当前的默认降采样策略，可以在 -config 文件的 downsampling 中修改，在 webConfigMutex 下读写
+var webDownsampling = webDefaultDownsampling()
+
+func webCurrentDownsampling() webDownsampleStrategy {
+	webConfigMutex.Lock()
+	defer webConfigMutex.Unlock()
+	return webDownsampling
+}
+
+// 预聚合金字塔的层级，由细到粗
+var webPyramidIntervals = []struct {
+	label    string
+	interval int64 // 秒
+}{
+	{"1s", 1},
+	{"10s", 10},
+	{"1m", 60},
+	{"10m", 600},
+}
+
+// 缩放窗口默认返回的最大点数
+const WEB_ZOOM_POINTS = 2000
+
+// 金字塔的一层：每个周期一条记录，时间为周期起点，价格、持仓和盘口取周期内最后一笔，diff_vol/diff_oi 求和
+type webPyramidLevel struct {
+	label    string
+	interval int64
+	data     []WebMarketData
+}
+
+// 从原始tick逐层聚合出 1s/10s/1m/10m 各层，每层由上一层聚合而来；时间无法解析时不构建金字塔
+func webBuildPyramid(data []WebMarketData) []webPyramidLevel {
+	start := time.Now()
+
+	seconds := make([]int64, len(data))
+	for i, record := range data {
+		t, err := time.Parse("2006-01-02 15:04:05", record.Time)
+		if err != nil {
+			log.Printf("Skipping pyramid build, unparseable time %q: %v", record.Time, err)
+			return nil
+		}
+		seconds[i] = t.Unix()
+	}
+
+	levels := make([]webPyramidLevel, 0, len(webPyramidIntervals))
+	prev, prevSeconds := data, seconds
+	for _, spec := range webPyramidIntervals {
+		var level []WebMarketData
+		var levelSeconds []int64
+		for i, record := range prev {
+			bucket := prevSeconds[i] - prevSeconds[i]%spec.interval
+			n := len(level)
+			if n == 0 || levelSeconds[n-1] != bucket {
+				record.Time = time.Unix(bucket, 0).UTC().Format("2006-01-02 15:04:05")
+				level = append(level, record)
+				levelSeconds = append(levelSeconds, bucket)
+				continue
+			}
+			last := &level[n-1]
+			diffVol, diffOI := last.DiffVol, last.DiffOI
+			*last = record
+			last.Time = time.Unix(bucket, 0).UTC().Format("2006-01-02 15:04:05")
+			last.DiffVol = diffVol + record.DiffVol
+			last.DiffOI = diffOI + record.DiffOI
+		}
+		levels = append(levels, webPyramidLevel{label: spec.label, interval: spec.interval, data: level})
+		prev, prevSeconds = level, levelSeconds
+	}
+
+	fmt.Printf("Built pyramid for %d records in %v (%s: %d, %s: %d)\n", len(data), time.Since(start),
+		levels[0].label, len(levels[0].data), levels[len(levels)-1].label, len(levels[len(levels)-1].data))
+	return levels
+}
+
+// 截取时间在 [from, to] 内的记录，时间均为 "2006-01-02 15:04:05" 格式，可直接按字符串比较
+func webSliceWindow(data []WebMarketData, from, to string) []WebMarketData {
+	lo := sort.Search(len(data), func(i int) bool { return data[i].Time >= from })
+	hi := sort.Search(len(data), func(i int) bool { return data[i].Time > to })
+	return data[lo:hi]
+}
+
+// 为缩放窗口选择最细的、点数不超过 points 的层级；原始数据足够少时直接返回原始数据，
+// 最粗的一层仍然超过时对其均匀采样
+func webZoomWindow(all []WebMarketData, pyramid []webPyramidLevel, from, to string, points int, strategy webDownsampleStrategy) ([]WebMarketData, string) {
+	window := webSliceWindow(all, from, to)
+	if len(window) <= points || len(pyramid) == 0 {
+		if len(window) > points {
+			return webDownsample(window, points, strategy), "raw"
+		}
+		return window, "raw"
+	}
+	start, err := time.Parse("2006-01-02 15:04:05", from)
+	if err != nil {
+		return webDownsample(window, points, strategy), "raw"
+	}
+	for _, level := range pyramid {
+		// 周期起点早于 from 的那根也包含窗口内的数据，一并返回
+		aligned := start.Unix() - start.Unix()%level.interval
+		window = webSliceWindow(level.data, time.Unix(aligned, 0).UTC().Format("2006-01-02 15:04:05"), to)
+		if len(window) <= points {
+			return window, level.label
+		}
+	}
+	return webDownsample(window, points, strategy), pyramid[len(pyramid)-1].label
+}
+
+// 数据API返回的基本统计：价格均值、高低点和平均持仓量，无效值记为0
+func webSummaryStats(data []WebMarketData) (avgPrice, maxPrice, minPrice, avgOI float64) {
+	priceValues := make([]float64, len(data))
+	oiValues := make([]float64, len(data))
+	for i, record := range data {
+		priceValues[i] = webPriceValue(record.Price, record.Symbol)
+		oiValues[i] = float64(record.OpenInterest)
+	}
+
+	avgPrice = webCalculateAverage(priceValues)
+	maxPrice = webFindMax(priceValues)
+	minPrice = webFindMin(priceValues)
+	avgOI = webCalculateAverage(oiValues)
+
+	// 确保所有统计值都是有效的
+	for _, v := range []*float64{&avgPrice, &maxPrice, &minPrice, &avgOI} {
+		if math.IsInf(*v, 0) || math.IsNaN(*v) {
+			*v = 0
+		}
+	}
+	return avgPrice, maxPrice, minPrice, avgOI
+}
+
+// 数据API处理器
+func webDataHandler(w http.ResponseWriter, r *http.Request) {
+	// 获取查询参数
+	table := r.URL.Query().Get("table")
+	symbol := r.URL.Query().Get("symbol")
+	rangeSpec := r.URL.Query().Get("range")
+
+	if err := webValidateDatasetRange(rangeSpec); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": fmt.Sprintf("时间范围无效: %v", err),
+		})
+		return
+	}
+
+	// 只有切换数据集或修改 raw 时才需要会话，只读取当前数据的请求不创建会话
+	sessionID, session := webGetSession(r)
+	ensureSession := func() {
+		if sessionID == "" {
+			sessionID, _ = webEnsureSession(w, r)
+		}
+	}
+	stale := false
+
+	// 只指定了时间范围时，使用会话当前的表和symbol
+	if rangeSpec != "" && table == "" && symbol == "" {
+		table, symbol = session.key.table, session.key.symbol
+	}
+	if raw := r.URL.Query().Get("raw"); raw != "" {
+		ensureSession()
+		webUpdateSession(sessionID, func(s *webSession) { s.raw = raw == "1" })
+	}
+
+	// 如果有查询参数，执行动态查询
+	if table != "" && symbol != "" {
+		key := webDatasetKey{table, symbol, webNormalizeRange(rangeSpec)}
+		var data []WebMarketData
+		var err error
+		gen := webProfileGeneration.Load()
+		if jobID := r.URL.Query().Get("job"); jobID != "" {
+			// 使用已完成的异步查询任务的结果，不再重新查询
+			if err = webAuthorizeDataset(r, key); err == nil {
+				data, err = webJobResult(jobID, key)
+			}
+		} else {
+			var estimate *webExportEstimate
+			if estimate, err = webEstimateRawRange(webAuditContext(r), key); err == nil && estimate != nil {
+				if status, msg := estimate.refusal("加载", r.URL.Query().Get("confirm") == "1"); status != 0 {
+					webRawRangeDeny(w, status, msg, estimate)
+					return
+				}
+			}
+			if err == nil {
+				data, stale, err = webGetDataset(webAuditContext(r), key)
+			}
+		}
+		var denied *webACLError
+		if errors.As(err, &denied) {
+			webACLDeny(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(webDataErrorResponse(r, "查询失败: ", err, rangeSpec))
+			return
+		}
+
+		if len(data) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(webDataErrorResponse(r, "", webEmptyDatasetError(table, symbol), rangeSpec))
+			return
+		}
+
+		// 更新共享的展示数据，并切换本会话显示的数据集
+		view := webSetLoadedData(key, data, gen)
+		ensureSession()
+		webUpdateSession(sessionID, func(s *webSession) { s.key = key })
+		session.key = key
+		webRememberSession(session)
+
+		fmt.Printf("Dynamic query: table=%s, symbol=%s, range=%s, found %d records, sampled %d\n",
+			table, symbol, rangeSpec, len(data), len(view.sampled))
+	}
+
+	// 返回本会话当前显示的数据
+	if err := webAuthorizeDataset(r, session.key); err != nil {
+		webACLDeny(w, http.StatusForbidden, err.Error())
+		return
+	}
+	view, err := webGetView(webAuditContext(r), session.key)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webDataErrorResponse(r, "查询失败: ", err, session.key.rangeSpec))
+		return
+	}
+	data := view.sampled
+	allData := view.all
+	pyramid := view.pyramid
+	loadedSymbol := view.key.symbol
+
+	priceFormat, err := webParsePriceFormat(r, loadedSymbol)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	regimes, err := webParseVolRegimeParams(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	vwapBands, err := webParseVWAPParams(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// 降采样策略：默认使用配置中的策略，?downsample=diff_vol:max 按序列覆盖，此时重新采样而不使用共享的采样结果
+	downsampling := webCurrentDownsampling()
+	if raw := r.URL.Query().Get("downsample"); raw != "" {
+		if downsampling, err = webParseDownsampleParam(raw, downsampling); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("降采样策略无效: %v", err)})
+			return
+		}
+		data = webDownsample(allData, WEB_SAMPLE_SIZE, downsampling)
+	}
+
+	// 显示模式：sampled 为均匀采样，raw 为全部原始数据，capped 为请求原始数据但超过上限后按上限采样
+	mode := "sampled"
+	if len(data) == len(allData) {
+		mode = "raw"
+	}
+	if r.URL.Query().Get("raw") == "1" {
+		data, mode = allData, "raw"
+		if len(allData) > webMaxRawPoints {
+			data, mode = webDownsample(allData, webMaxRawPoints, downsampling), "capped"
+		}
+	}
+
+	// 缩放窗口：?from=...&to=...[&points=2000]，从预聚合金字塔中选择合适的层级，不重新扫描原始tick；
+	// window 为可见范围内的全部原始数据，用于判断统计是否基于采样以及计算精确统计
+	level := ""
+	window := allData
+	if r.URL.Query().Get("from") != "" || r.URL.Query().Get("to") != "" {
+		from, err := webParseWallTime(r.URL.Query().Get("from"))
+		if err == nil {
+			var to time.Time
+			to, err = webParseWallTime(r.URL.Query().Get("to"))
+			if err == nil {
+				points := WEB_ZOOM_POINTS
+				if n, convErr := strconv.Atoi(r.URL.Query().Get("points")); convErr == nil && n > 0 {
+					points = n
+				}
+				if points > webMaxRawPoints {
+					points = webMaxRawPoints
+				}
+				data, level = webZoomWindow(allData, pyramid,
+					from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), points, downsampling)
+				window = webSliceWindow(allData, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"))
+				mode = "zoom"
+			}
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": fmt.Sprintf("缩放窗口无效: %v", err),
+			})
+			return
+		}
+	}
+
+	fmt.Printf("Retrieved data: %d current, %d total\n", len(data), len(allData))
+
+	if len(data) == 0 {
+		fmt.Printf("No data available, returning error\n")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "No data available",
+		})
+		return
+	}
+
+	fmt.Printf("Data available, proceeding with stats calculation\n")
+
+	// 计算统计信息
+	fmt.Printf("Starting to calculate stats for %d data points\n", len(data))
+	avgPrice, maxPrice, minPrice, avgOI := webSummaryStats(data)
+
+	stats := map[string]interface{}{
+		"avg_price":      priceFormat.round(avgPrice, 2),
+		"max_price":      priceFormat.round(maxPrice, 0),
+		"min_price":      priceFormat.round(minPrice, 0),
+		"avg_oi":         avgOI,
+		"data_points":    len(data),
+		"total_records":  len(allData),
+		"mode":           mode,
+		"max_raw_points": webMaxRawPoints,
+		"tick_size":      webTickSizeFor(loadedSymbol),
+	}
+	if level != "" {
+		stats["level"] = level
+	}
+	if stale {
+		stats["stale"] = true
+	}
+	if _, skipped := webParseErrorSummary(); skipped > 0 {
+		stats["skipped_rows"] = skipped
+	}
+	// 统计基于图表上绘制的点：采样或聚合后与可见范围内的原始数据不一致时标记出来，
+	// exact=1 时另外按可见范围内的全部原始数据计算一份精确统计
+	if len(data) != len(window) {
+		stats["sampled"] = true
+		stats["window_records"] = len(window)
+		// 金字塔层级是按时间桶预聚合的，不受降采样策略影响
+		if level == "" || level == "raw" {
+			stats["downsampling"] = downsampling
+		}
+	}
+	if r.URL.Query().Get("exact") == "1" && len(window) > 0 {
+		exactAvg, exactMax, exactMin, exactOI := webSummaryStats(window)
+		stats["exact"] = map[string]interface{}{
+			"avg_price":   priceFormat.round(exactAvg, 2),
+			"max_price":   priceFormat.round(exactMax, 0),
+			"min_price":   priceFormat.round(exactMin, 0),
+			"avg_oi":      exactOI,
+			"data_points": len(window),
+		}
+	}
+
+	fmt.Printf("Calculated stats: avg_price=%.2f, data_points=%d\n", avgPrice, len(data))
+
+	// 简化响应，避免time.Time可能的JSON编码问题；记录中的NaN/Inf由 WebMarketData.MarshalJSON 编码为 null
+	response := map[string]interface{}{
+		"data":      webFormattedRecords{data, priceFormat},
+		"stats":     stats,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		"dataset":   view.key.String(),
+	}
+	if regimes != nil {
+		response["vol_regimes"] = webVolRegimesJSON(data, *regimes)
+	}
+	if vwapBands != nil {
+		response["vwap"] = webSessionVWAP(allData, data, vwapBands, priceFormat)
+	}
+
+	fmt.Printf("Created response object\n")
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// 添加调试信息
+	fmt.Printf("Encoding JSON response with %d data points\n", len(data))
+
+	jsonBytes, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("JSON encoding error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": fmt.Sprintf("JSON编码失败: %v", err),
+		})
+		return
+	}
+
+	w.Write(jsonBytes)
+	fmt.Printf("JSON response sent successfully\n")
+}
+
+// 动态查询市场数据，span 大于0时只查询该symbol最近一段时间的数据
+func webQueryMarketDataDynamic(ctx context.Context, table, symbol string, span time.Duration) ([]WebMarketData, error) {
+	if webDemoMode() {
+		var from time.Time
+		if span > 0 {
+			from = time.Now().Add(-span)
+		}
+		return webDemoTicks(symbol, from, time.Now()), nil
+	}
+
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	if err := webValidateSchema(ctx, table); err != nil {
+		return nil, err
+	}
+
+	q := webSelect(ctx, webMarketDataColumns...).FromBars(table, span).Symbol(symbol)
+	if span > 0 {
+		condition, err := webTimeRangePredicate(ctx, table, symbol, span)
+		if err != nil {
+			return nil, err
+		}
+		q.Where(condition)
+	}
+	query, err := q.OrderBy("time ASC").Format(webResultFormat()).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteSharedQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	return webParseMarketData(result)
+}
+
+// 行情数据来源：clickhouse 查询 xm.local 上的ClickHouse，demo 在本地生成模拟行情，新用户和CI环境不需要数据库
+const (
+	SOURCE_CLICKHOUSE = "clickhouse"
+	SOURCE_DEMO       = "demo"
+)
+
+var webMarketSource = SOURCE_CLICKHOUSE
+
+func webDemoMode() bool {
+	return webMarketSource == SOURCE_DEMO
+}
+
+// 演示行情从启动前两天的零点开始每2秒一笔，一直生成到当前时间，页面的实时订阅可以持续收到新tick
+const (
+	DEMO_TICK_INTERVAL = 2 * time.Second
+	DEMO_HISTORY_DAYS  = 2
+)
+
+var webDemoStart = func() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -DEMO_HISTORY_DAYS)
+}()
+
+// 演示模式下 /tables 和 /symbols 列出的表和合约；其它合约代码同样可以直接查询
+var webDemoSymbols = map[string][]string{
+	"jm": {"jm2509", "jm2601"},
+	"j":  {"j2509", "j2601"},
+	"i":  {"i2509", "i2601"},
+	"rb": {"rb2510", "rb2601"},
+}
+
+// 生成 [from, to) 内的模拟tick：价格按最小变动价位随机游走，偶尔放量，持仓随成交量增减，盘口为一到两个tick的价差。
+// 随机数种子由合约代码决定，同一合约每次生成相同的序列，时间范围只影响返回哪一段
+func webDemoTicks(symbol string, from, to time.Time) []WebMarketData {
+	h := fnv.New64a()
+	h.Write([]byte(symbol))
+	rng := mathrand.New(mathrand.NewSource(int64(h.Sum64())))
+	tick := webDemoTickSize(symbol)
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+
+	last := int64(2000 + rng.Intn(6000)) // 价格，单位为最小变动价位
+	vol, oi := uint32(0), int64(80000+rng.Intn(120000))
+	var data []WebMarketData
+	for t := webDemoStart; t.Before(to); t = t.Add(DEMO_TICK_INTERVAL) {
+		last += int64(math.Round(rng.NormFloat64() * 0.8))
+		diffVol := int32(1 + rng.Intn(12))
+		if rng.Intn(50) == 0 {
+			diffVol *= int32(5 + rng.Intn(10))
+		}
+		diffOI := int32(math.Round(rng.NormFloat64() * float64(diffVol) * 0.4))
+		if oi+int64(diffOI) < 0 {
+			diffOI = int32(-oi)
+		}
+		vol += uint32(diffVol)
+		oi += int64(diffOI)
+
+		spread := int64(1)
+		if rng.Intn(10) == 0 {
+			spread = 2
+		}
+		bid, ask := last, last+spread
+		if rng.Intn(2) == 0 {
+			bid, ask = last-spread, last
+		}
+		bidVolumn, askVolumn := uint32(1+rng.Intn(200)), uint32(1+rng.Intn(200))
+
+		// 随机数在过滤之前取完，保证不同时间范围得到的是同一条序列
+		if t.Before(from) {
+			continue
+		}
+		data = append(data, WebMarketData{
+			Symbol:       symbol,
+			Time:         t.Format("2006-01-02 15:04:05"),
+			Price:        float32(webTicksToPrice(last, tick)),
+			Vol:          vol,
+			OpenInterest: uint32(oi),
+			DiffVol:      diffVol,
+			DiffOI:       diffOI,
+			Bid1:         float32(webTicksToPrice(bid, tick)),
+			BidVolumn1:   bidVolumn,
+			Ask1:         float32(webTicksToPrice(ask, tick)),
+			AskVolumn1:   askVolumn,
+			DateTime:     uint64(t.UnixMilli()),
+		})
+	}
+	return data
+}
+
+// 实时订阅的演示数据：lastTime 为空时返回最近的快照，否则返回 (lastTime, lastDateTime) 之后生成的tick
+func webDemoFeedTicks(symbol, lastTime string, lastDateTime uint64) ([]WebMarketData, error) {
+	if lastTime == "" {
+		data := webDemoTicks(symbol, time.Now().Add(-WS_SNAPSHOT_TICKS*DEMO_TICK_INTERVAL), time.Now())
+		return data, nil
+	}
+	from, err := time.ParseInLocation("2006-01-02 15:04:05", lastTime, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	var ticks []WebMarketData
+	for _, md := range webDemoTicks(symbol, from, time.Now()) {
+		if md.DateTime > lastDateTime {
+			ticks = append(ticks, md)
+		}
+	}
+	return ticks, nil
+}
+
+// 与ClickHouse中的热力图聚合相同：按自然日和日内时段汇总 diff_oi
+func webDemoHeatmap(symbol string, from, to time.Time, slot time.Duration) []webHeatmapCell {
+	index := make(map[[2]string]int)
+	cells := []webHeatmapCell{}
+	for _, md := range webDemoTicks(symbol, from, to) {
+		t, _ := time.ParseInLocation("2006-01-02 15:04:05", md.Time, time.Local)
+		dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+		slotStart := dayStart.Add(t.Sub(dayStart) / slot * slot)
+		key := [2]string{dayStart.Format("2006-01-02"), slotStart.Format("15:04")}
+		i, ok := index[key]
+		if !ok {
+			i = len(cells)
+			index[key] = i
+			cells = append(cells, webHeatmapCell{Day: key[0], Slot: key[1]})
+		}
+		cells[i].OI += float64(md.DiffOI)
+		cells[i].Ticks++
+	}
+	return cells
+}
+
+// 与ClickHouse中的日统计聚合相同：按交易日汇总，最近的交易日在前，最多 days 天
+func webDemoDailyStats(symbol string, days int) []webDailyStats {
+	now := time.Now()
+	index := make(map[string]int)
+	rows := []webDailyStats{}
+	turnover := make(map[string]float64)
+	for _, md := range webDemoTicks(symbol, webDemoStart, now) {
+		t, _ := time.ParseInLocation("2006-01-02 15:04:05", md.Time, time.Local)
+		day := webTradingDay(t).Format("2006-01-02")
+		price := float64(md.Price)
+		i, ok := index[day]
+		if !ok {
+			i = len(rows)
+			index[day] = i
+			rows = append(rows, webDailyStats{Day: day, Open: price, High: price, Low: price, First: md.Time})
+		}
+		row := &rows[i]
+		row.High = math.Max(row.High, price)
+		row.Low = math.Min(row.Low, price)
+		row.Close = price
+		row.Volume += int64(md.DiffVol)
+		row.OIChange += int64(md.DiffOI)
+		row.OpenInterest = int64(md.OpenInterest)
+		row.Ticks++
+		row.Last = md.Time
+		turnover[day] += price * float64(md.DiffVol)
+	}
+	for i := range rows {
+		row := &rows[i]
+		row.Settle = row.Close
+		if row.Volume > 0 {
+			row.Settle = turnover[row.Day] / float64(row.Volume)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Day > rows[j].Day })
+	if len(rows) > days {
+		rows = rows[:days]
+	}
+	return rows
+}
+
+// 与ClickHouse中的日内均值带聚合相同：按交易日和日内时段汇总首末价格和成交量
+func webDemoProfileBuckets(symbol string, from, to time.Time, slot time.Duration) []webProfileBucket {
+	index := make(map[[2]string]int)
+	buckets := []webProfileBucket{}
+	for _, md := range webDemoTicks(symbol, from, to) {
+		t, _ := time.ParseInLocation("2006-01-02 15:04:05", md.Time, time.Local)
+		dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+		slotStart := dayStart.Add(t.Sub(dayStart) / slot * slot)
+		key := [2]string{webTradingDay(t).Format("2006-01-02"), slotStart.Format("15:04")}
+		i, ok := index[key]
+		if !ok {
+			i = len(buckets)
+			index[key] = i
+			buckets = append(buckets, webProfileBucket{Day: key[0], Slot: key[1], Open: float64(md.Price)})
+		}
+		buckets[i].Close = float64(md.Price)
+		buckets[i].Volume += int64(md.DiffVol)
+	}
+	return buckets
+}
+
+// 演示行情的盘口档数：一档沿用模拟tick的买一卖一，其余各档价格逐档外移，挂单量按合约和时间确定性生成
+const DEMO_BOOK_DEPTH = 5
+
+// 模拟行情需要价格网格，最小变动价位未知的品种按1生成
+func webDemoTickSize(symbol string) float64 {
+	if tick := webTickSizeFor(symbol); tick > 0 {
+		return tick
+	}
+	return 1
+}
+
+func webDemoBook(symbol string) *webBook {
+	now := time.Now()
+	ticks := webDemoTicks(symbol, now.Add(-time.Minute), now)
+	if len(ticks) == 0 {
+		return nil
+	}
+	last := ticks[len(ticks)-1]
+	tick := webDemoTickSize(symbol)
+
+	h := fnv.New64a()
+	h.Write([]byte(symbol + last.Time))
+	rng := mathrand.New(mathrand.NewSource(int64(h.Sum64())))
+
+	book := &webBook{Symbol: last.Symbol, Time: last.Time, Price: webPriceValue(last.Price, symbol), Depth: DEMO_BOOK_DEPTH}
+	bidTicks, askTicks := webPriceToTicks(last.Bid1, tick), webPriceToTicks(last.Ask1, tick)
+	for k := 0; k < DEMO_BOOK_DEPTH; k++ {
+		bidVol, askVol := uint64(last.BidVolumn1), uint64(last.AskVolumn1)
+		if k > 0 {
+			bidVol, askVol = uint64(1+rng.Intn(200)), uint64(1+rng.Intn(200))
+		}
+		book.Bids = append(book.Bids, webBookLevel{Price: webTicksToPrice(bidTicks-int64(k), tick), Volume: bidVol})
+		book.Asks = append(book.Asks, webBookLevel{Price: webTicksToPrice(askTicks+int64(k), tick), Volume: askVol})
+	}
+	return book
+}
+
+// 查询所需的列及其兼容的ClickHouse类型族
+var webExpectedColumns = []struct {
+	name     string
+	families []string
+}{
+	{"symbol", []string{"String", "FixedString"}},
+	{"time", []string{"DateTime"}},
+	{"price", []string{"Float", "Decimal"}},
+	{"vol", []string{"UInt", "Int"}},
+	{"open_interest", []string{"UInt", "Int"}},
+	{"diff_vol", []string{"Int", "UInt"}},
+	{"diff_oi", []string{"Int", "UInt"}},
+	{"bid_1", []string{"Float", "Decimal"}},
+	{"bid_volumn_1", []string{"UInt", "Int"}},
+	{"ask_1", []string{"Float", "Decimal"}},
+	{"ask_volumn_1", []string{"UInt", "Int"}},
+	{"datetime", []string{"UInt", "Int"}},
+}
+
+var (
+	webValidatedTables      = make(map[string]bool)
+	webValidatedTablesMutex sync.Mutex
+)
+
+type webColumn struct {
+	Name string
+	Type string
+}
+
+// 通过 DESCRIBE 获取表的列，保持表定义中的顺序
+func webDescribeColumns(ctx context.Context, table string) ([]webColumn, error) {
+	if !webIsIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	result, err := webExecuteQueryContext(webWithoutJob(ctx), fmt.Sprintf("DESCRIBE TABLE %s FORMAT TabSeparated", webQualifiedTable(table)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %w", webQualifiedTable(table), err)
+	}
+
+	var columns []webColumn
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 {
+			columns = append(columns, webColumn{fields[0], fields[1]})
+		}
+	}
+	return columns, nil
+}
+
+// 去掉 Nullable(...) / LowCardinality(...) 包装，得到用于比较类型族的基础类型
+func webBaseType(typ string) string {
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		for strings.HasPrefix(typ, wrapper) {
+			typ = strings.TrimSuffix(strings.TrimPrefix(typ, wrapper), ")")
+		}
+	}
+	return typ
+}
+
+// 通过 DESCRIBE 获取表的 列名 -> 类型
+func webDescribeTable(ctx context.Context, table string) (map[string]string, error) {
+	columns, err := webDescribeColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string, len(columns))
+	for _, col := range columns {
+		types[col.Name] = col.Type
+	}
+	return types, nil
+}
+
+// 通过 DESCRIBE 检查表结构，缺少列或类型不兼容时返回列出具体列名的错误，
+// 避免解析时静默跳过所有行后只报 "No data found"。校验通过的表会被缓存，不再重复 DESCRIBE
+func webValidateSchema(ctx context.Context, table string) error {
+	if webDemoMode() {
+		return nil
+	}
+
+	webValidatedTablesMutex.Lock()
+	validated := webValidatedTables[table]
+	webValidatedTablesMutex.Unlock()
+	if validated {
+		return nil
+	}
+
+	types, err := webDescribeTable(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	// 映射到其他列时检查被映射的列；映射为表达式时无法从表结构判断类型，跳过
+	var missing, mismatched []string
+	for _, col := range webExpectedColumns {
+		name := col.name
+		if source, ok := webFieldMaps[table][col.name]; ok {
+			if !webIsIdentifier(source) {
+				continue
+			}
+			name = source
+		}
+		typ, ok := types[name]
+		if !ok {
+			if name != col.name {
+				missing = append(missing, fmt.Sprintf("%s (mapped to %s)", col.name, name))
+			} else {
+				missing = append(missing, col.name)
+			}
+			continue
+		}
+
+		base := webBaseType(typ)
+		compatible := false
+		for _, family := range col.families {
+			if strings.HasPrefix(base, family) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			mismatched = append(mismatched, fmt.Sprintf("%s is %s (expected %s)", name, typ, strings.Join(col.families, "/")))
+		}
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		webValidatedTablesMutex.Lock()
+		webValidatedTables[table] = true
+		webValidatedTablesMutex.Unlock()
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		problems = append(problems, "incompatible types: "+strings.Join(mismatched, "; "))
+	}
+	return fmt.Errorf("table %s does not match the expected schema: %s", webQualifiedTable(table), strings.Join(problems, "; "))
+}
+
+// 解析相对时间范围，支持 s/m/h/d/w 单位，如 30m、2h、1d、5d；空字符串或 all 表示全部历史
+func webParseRelativeRange(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" || spec == "all" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	unit, ok := units[spec[len(spec)-1]]
+	n, err := strconv.Atoi(spec[:len(spec)-1])
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q: expected forms like 30m, 2h, 1d, 5d or all", spec)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// 按交易时段查询的时间范围写作 session:YYYY-MM-DD（交易日）。
+// 国内期货的一个交易日从上一交易日20:00开始（夜盘），到当天20:00之前结束（日盘15:00收盘），
+// 周五夜盘和周末归入下周一；节假日前没有夜盘，按实际数据跳过没有成交的日期
+const (
+	SESSION_RANGE_PREFIX = "session:"
+	SESSION_CUTOFF_HOUR  = 20
+)
+
+// tick所属的交易日（当天零点）
+func webTradingDay(t time.Time) time.Time {
+	shifted := t.Add(time.Duration(24-SESSION_CUTOFF_HOUR) * time.Hour)
+	day := time.Date(shifted.Year(), shifted.Month(), shifted.Day(), 0, 0, 0, 0, t.Location())
+	switch day.Weekday() {
+	case time.Saturday:
+		day = day.AddDate(0, 0, 2)
+	case time.Sunday:
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// 交易日的时间窗口 [from, to)：周一从上周五20:00开始，其余从前一天20:00开始
+func webSessionBounds(day time.Time) (time.Time, time.Time) {
+	prev := day.AddDate(0, 0, -1)
+	if day.Weekday() == time.Monday {
+		prev = day.AddDate(0, 0, -3)
+	}
+	cutoff := time.Duration(SESSION_CUTOFF_HOUR) * time.Hour
+	return prev.Add(cutoff), day.Add(cutoff)
+}
+
+// 解析 session:YYYY-MM-DD，不是交易时段形式时 ok 为 false
+func webParseSessionRange(spec string) (day time.Time, ok bool, err error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if !strings.HasPrefix(spec, SESSION_RANGE_PREFIX) {
+		return time.Time{}, false, nil
+	}
+	day, err = time.ParseInLocation("2006-01-02", strings.TrimPrefix(spec, SESSION_RANGE_PREFIX), webServerLocation())
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("invalid session range %q: expected session:YYYY-MM-DD", spec)
+	}
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return time.Time{}, true, fmt.Errorf("invalid session range %q: %s is not a trading day", spec, day.Weekday())
+	}
+	return day, true, nil
+}
+
+// 数据集的时间范围：相对范围（30m、1d、all）或交易时段（session:2025-07-01）
+func webValidateDatasetRange(spec string) error {
+	if _, ok, err := webParseSessionRange(spec); ok {
+		return err
+	}
+	_, err := webParseRelativeRange(spec)
+	return err
+}
+
+// 查询一个时间点之前的最后一笔或之后（含）的第一笔tick的时间，没有数据时返回零值
+func webAdjacentTickTime(ctx context.Context, table, symbol string, at time.Time, before bool) (time.Time, error) {
+	if webDemoMode() {
+		now := time.Now()
+		if at.IsZero() {
+			return now, nil
+		}
+		if before && at.After(webDemoStart) {
+			return at.Add(-DEMO_TICK_INTERVAL), nil
+		}
+		if !before && at.Before(now) {
+			return at, nil
+		}
+		return time.Time{}, nil
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return time.Time{}, err
+	}
+
+	// at 为零值时查询最新一笔
+	q := webSelect(ctx, "toString(time)").From(table).Symbol(symbol)
+	switch {
+	case at.IsZero():
+		q.OrderBy("time DESC")
+	case before:
+		q.Where("time < " + webDateTime(at)).OrderBy("time DESC")
+	default:
+		q.Where("time >= " + webDateTime(at)).OrderBy("time ASC")
+	}
+	query, err := q.Limit(1).Format("TabSeparated").Build()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query failed: %w", err)
+	}
+	if strings.TrimSpace(result) == "" {
+		return time.Time{}, nil
+	}
+	return webParseWallTime(strings.TrimSpace(result))
+}
+
+// 交易时段导航：/api/v1/session?table=jm&symbol=jm2509&date=2025-07-01&step=-1
+// 返回 date 所在交易日前一个（step=-1）或后一个（step=1）有数据的交易时段；
+// 不带 date 时以最新一笔数据所在的交易日为基准，step=0 返回该交易日本身
+func webSessionNavHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail("缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	step := 0
+	if s := q.Get("step"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < -1 || n > 1 {
+			fail("step参数无效 (-1、0、1)")
+			return
+		}
+		step = n
+	}
+
+	var day time.Time
+	if date := q.Get("date"); date != "" {
+		d, _, err := webParseSessionRange(SESSION_RANGE_PREFIX + date)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		day = d
+	} else {
+		latest, err := webAdjacentTickTime(r.Context(), table, symbol, time.Time{}, true)
+		if err != nil {
+			fail(fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		if latest.IsZero() {
+			fail(fmt.Sprintf("未找到表 %s 中 symbol = %s 的数据", table, symbol))
+			return
+		}
+		day = webTradingDay(latest)
+	}
+
+	if step != 0 {
+		from, to := webSessionBounds(day)
+		at, before := to, false
+		if step < 0 {
+			at, before = from, true
+		}
+		tick, err := webAdjacentTickTime(r.Context(), table, symbol, at, before)
+		if err != nil {
+			fail(fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		if tick.IsZero() {
+			if step < 0 {
+				fail("没有更早的交易时段")
+			} else {
+				fail("没有更晚的交易时段")
+			}
+			return
+		}
+		day = webTradingDay(tick)
+	}
+
+	from, to := webSessionBounds(day)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":  table,
+		"symbol": symbol,
+		"date":   day.Format("2006-01-02"),
+		"from":   from.Format("2006-01-02 15:04:05"),
+		"to":     to.Format("2006-01-02 15:04:05"),
+		"range":  SESSION_RANGE_PREFIX + day.Format("2006-01-02"),
+	})
+}
+
+// 买卖价差统计，单位为最小变动价位（跳）；只统计买一、卖一都有效的报价
+type webSpreadStats struct {
+	Quoted     int     `json:"quoted"`
+	AvgTicks   float64 `json:"avg_ticks"`
+	MaxTicks   int64   `json:"max_ticks"`
+	OneTickPct float64 `json:"one_tick_pct"`
+}
+
+// 最小变动价位未知（tick 为0）时按买卖价估计tick
+func webComputeSpreadStats(data []WebMarketData, tick float64) webSpreadStats {
+	var stats webSpreadStats
+	if tick <= 0 {
+		var prices []float64
+		for _, record := range data {
+			if record.Bid1 > 0 && record.Ask1 > 0 {
+				prices = append(prices, webRawPrice(record.Bid1), webRawPrice(record.Ask1))
+			}
+		}
+		if tick = webEstimateTickSize(prices); tick <= 0 {
+			return stats
+		}
+	}
+	var total, oneTick int64
+	for _, record := range data {
+		if record.Bid1 <= 0 || record.Ask1 <= 0 || record.Ask1 < record.Bid1 {
+			continue
+		}
+		spread := webPriceToTicks(record.Ask1, tick) - webPriceToTicks(record.Bid1, tick)
+		stats.Quoted++
+		total += spread
+		if spread > stats.MaxTicks {
+			stats.MaxTicks = spread
+		}
+		if spread == 1 {
+			oneTick++
+		}
+	}
+	if stats.Quoted > 0 {
+		stats.AvgTicks = float64(total) / float64(stats.Quoted)
+		stats.OneTickPct = float64(oneTick) / float64(stats.Quoted) * 100
+	}
+	return stats
+}
+
+// 交易日日报：OHLC、成交量、持仓变化、价差统计，以及该交易时段内的事件标注和盘口失衡告警
+type webDailyReport struct {
+	Table     string         `json:"table"`
+	Symbol    string         `json:"symbol"`
+	Date      string         `json:"date"`
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	FirstTick string         `json:"first_tick"`
+	LastTick  string         `json:"last_tick"`
+	Ticks     int            `json:"ticks"`
+	Open      float64        `json:"open"`
+	High      float64        `json:"high"`
+	Low       float64        `json:"low"`
+	Close     float64        `json:"close"`
+	Change    float64        `json:"change"`
+	ChangePct float64        `json:"change_pct"`
+	Volume    float64        `json:"volume"`
+	OIOpen    uint32         `json:"oi_open"`
+	OIClose   uint32         `json:"oi_close"`
+	OIChange  float64        `json:"oi_change"`
+	TickSize  float64        `json:"tick_size"`
+	Spread    webSpreadStats `json:"spread"`
+	Events    []webEvent     `json:"events"`
+	Alerts    []webIncident  `json:"alerts"`
+}
+
+func webBuildDailyReport(table, symbol string, day time.Time, data []WebMarketData) webDailyReport {
+	from, to := webSessionBounds(day)
+	tick := webTickSizeFor(symbol)
+	pf := webRawPriceFormat
+	if tick > 0 {
+		pf.decimals = webTickDecimals(tick)
+	}
+	stats := webComputeWindowStats(data)
+	first, last := data[0], data[len(data)-1]
+
+	report := webDailyReport{
+		Table:     table,
+		Symbol:    symbol,
+		Date:      day.Format("2006-01-02"),
+		From:      from.Format("2006-01-02 15:04:05"),
+		To:        to.Format("2006-01-02 15:04:05"),
+		FirstTick: first.Time,
+		LastTick:  last.Time,
+		Ticks:     len(data),
+		Open:      webPriceValue(first.Price, symbol),
+		High:      stats.High,
+		Low:       stats.Low,
+		Close:     webPriceValue(last.Price, symbol),
+		Volume:    stats.Volume,
+		OIOpen:    first.OpenInterest,
+		OIClose:   last.OpenInterest,
+		OIChange:  stats.OIChange,
+		TickSize:  tick,
+		Spread:    webComputeSpreadStats(data, tick),
+		Events:    []webEvent{},
+		Alerts:    []webIncident{},
+	}
+	report.Change = pf.round(report.Close-report.Open, 0)
+	report.ChangePct = math.Round(stats.ChangePct*100) / 100
+	report.Spread.AvgTicks = math.Round(report.Spread.AvgTicks*100) / 100
+	report.Spread.OneTickPct = math.Round(report.Spread.OneTickPct*10) / 10
+	return report
+}
+
+// 日报的Markdown格式，可以直接发到聊天机器人
+func (report webDailyReport) markdown() string {
+	decimals := -1 // 最小变动价位未知时按最短表示输出
+	if report.TickSize > 0 {
+		decimals = webTickDecimals(report.TickSize)
+	}
+	price := func(v float64) string { return strconv.FormatFloat(v, 'f', decimals, 64) }
+	signed := func(v float64, text string) string {
+		if v > 0 {
+			return "+" + text
+		}
+		return text
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s 日报 %s\n\n", strings.ToUpper(report.Symbol), report.Date)
+	fmt.Fprintf(&b, "交易时段 %s ~ %s，共 %d 笔（%s ~ %s）\n\n", report.From, report.To, report.Ticks, report.FirstTick, report.LastTick)
+	b.WriteString("| 开盘 | 最高 | 最低 | 收盘 | 涨跌 | 涨跌幅 |\n|---|---|---|---|---|---|\n")
+	fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s%% |\n\n", price(report.Open), price(report.High), price(report.Low), price(report.Close),
+		signed(report.Change, price(report.Change)), signed(report.ChangePct, strconv.FormatFloat(report.ChangePct, 'f', 2, 64)))
+	fmt.Fprintf(&b, "- 成交量: %.0f 手\n", report.Volume)
+	fmt.Fprintf(&b, "- 持仓量: %d → %d (%s)\n", report.OIOpen, report.OIClose, signed(report.OIChange, strconv.FormatFloat(report.OIChange, 'f', 0, 64)))
+	if report.Spread.Quoted > 0 {
+		fmt.Fprintf(&b, "- 买卖价差: 平均 %.2f 跳，最大 %d 跳，一跳占比 %.1f%%（有效报价 %d 笔）\n",
+			report.Spread.AvgTicks, report.Spread.MaxTicks, report.Spread.OneTickPct, report.Spread.Quoted)
+	} else {
+		b.WriteString("- 买卖价差: 无有效报价\n")
+	}
+
+	if len(report.Events) > 0 {
+		b.WriteString("\n### 事件\n\n")
+		for _, event := range report.Events {
+			fmt.Fprintf(&b, "- %s [%s] %s\n", event.Time, event.Severity, event.Title)
+		}
+	}
+	if len(report.Alerts) > 0 {
+		b.WriteString("\n### 盘口失衡告警\n\n")
+		for _, alert := range report.Alerts {
+			side := "买盘"
+			if alert.Side == "ask" {
+				side = "卖盘"
+			}
+			fmt.Fprintf(&b, "- %s %s占优 %.2f（买一 %d / 卖一 %d，连续 %d 笔）\n",
+				alert.Time, side, alert.Imbalance, alert.BidVolume, alert.AskVolume, alert.Ticks)
+		}
+	}
+	return b.String()
+}
+
+// 交易日日报：/api/v1/report?symbol=jm2509&date=2025-07-01[&format=md]
+// date 为交易日（含前一晚的夜盘），缺省为最新一笔数据所在的交易日；format=md 返回Markdown
+func webReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	markdown := false
+	switch q.Get("format") {
+	case "", "json":
+	case "md", "markdown":
+		markdown = true
+	default:
+		http.Error(w, "format参数无效 (json/md)", http.StatusBadRequest)
+		return
+	}
+	fail := func(status int, msg string) {
+		if markdown {
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	table, symbol := q.Get("table"), q.Get("symbol")
+	if symbol == "" {
+		fail(http.StatusBadRequest, "缺少symbol参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if !webIsIdentifier(table) {
+		fail(http.StatusBadRequest, fmt.Sprintf("无效的表名: %q", table))
+		return
+	}
+
+	var day time.Time
+	if date := q.Get("date"); date != "" {
+		d, _, err := webParseSessionRange(SESSION_RANGE_PREFIX + date)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		day = d
+	} else {
+		latest, err := webAdjacentTickTime(r.Context(), table, symbol, time.Time{}, true)
+		if err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		if latest.IsZero() {
+			fail(http.StatusNotFound, fmt.Sprintf("未找到表 %s 中 symbol = %s 的数据", table, symbol))
+			return
+		}
+		day = webTradingDay(latest)
+	}
+
+	from, to := webSessionBounds(day)
+	data, err := webQueryMarketDataBetween(r.Context(), table, symbol, from, to)
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+	if len(data) == 0 {
+		fail(http.StatusNotFound, fmt.Sprintf("%s 在交易日 %s 没有数据", symbol, day.Format("2006-01-02")))
+		return
+	}
+
+	report := webBuildDailyReport(table, symbol, day, data)
+	if webEventsTable != "" {
+		events, err := webQueryEvents(r.Context(), from, to)
+		if err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("查询事件失败: %v", err))
+			return
+		}
+		report.Events = events
+	}
+	incidents, err := webListIncidents()
+	if err != nil {
+		log.Printf("Failed to list incidents for the report: %v", err)
+	}
+	for _, incident := range incidents {
+		if incident.Symbol == symbol && incident.Time >= report.From && incident.Time < report.To && webRequestUser(r).allows(incident.Table, incident.Symbol) {
+			report.Alerts = append(report.Alerts, incident)
+		}
+	}
+	// 告警按时间正序排列，与事件一致
+	sort.Slice(report.Alerts, func(i, j int) bool { return report.Alerts[i].Time < report.Alerts[j].Time })
+
+	if markdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		io.WriteString(w, report.markdown())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// 异步查询任务：大范围数据集的查询可能持续几十秒，页面先 POST /api/v1/jobs 创建任务，轮询
+// /api/v1/jobs/{id} 显示进度，完成后用 /data?job={id} 或 /api/v1/jobs/{id}/result 取回结果，
+// HTTP处理器不会因为慢查询长时间占用连接
+const (
+	JOB_MAX_ACTIVE    = 4                // 同时运行的任务上限，超出时返回429
+	JOB_RETENTION     = 10 * time.Minute // 任务结束后保留结果的时长
+	JOB_PROGRESS_POLL = time.Second      // 从 system.processes 读取服务端扫描进度的间隔
+
+	// /partial 预览默认和最多返回的点数，预览只用来先画出大致走势
+	JOB_PREVIEW_POINTS     = 2000
+	JOB_PREVIEW_MAX_POINTS = 20000
+)
+
+const (
+	JOB_RUNNING  = "running"
+	JOB_DONE     = "done"
+	JOB_FAILED   = "failed"
+	JOB_CANCELED = "canceled"
+)
+
+type webJob struct {
+	ID      string `json:"id"`
+	Dataset string `json:"dataset"`
+	State   string `json:"state"`
+	// 0-1，运行中按ClickHouse已扫描行数/预计扫描行数估算，完成时为1
+	Progress float64 `json:"progress"`
+	// ClickHouse已扫描和预计扫描的行数
+	RowsRead  int64 `json:"rows_read"`
+	TotalRows int64 `json:"total_rows"`
+	// 已接收的结果行数（TabSeparated格式按行计数）和字节数
+	RowsReceived  int64  `json:"rows_received"`
+	BytesReceived int64  `json:"bytes_received"`
+	Rows          int    `json:"rows"`
+	Error         string `json:"error,omitempty"`
+	// 因为没有数据而失败时的空状态，页面据此显示建议而不是错误
+	Empty     *webEmptyState `json:"empty,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	ElapsedMs int64          `json:"elapsed_ms"`
+
+	key        webDatasetKey
+	data       []WebMarketData
+	stream     *webStreamParser // 运行中边接收边解析的行数和采样，供 /partial 预览；RowBinary格式时为 nil
+	cancel     context.CancelFunc
+	canceled   bool
+	finishedAt time.Time
+	queries    int
+	generation uint64 // 创建时的连接配置代数，切换配置后结果不再使用
+}
+
+var (
+	webJobs      = make(map[string]*webJob)
+	webJobsMutex sync.Mutex
+)
+
+type webJobContextKey struct{}
+
+func webJobFromContext(ctx context.Context) *webJob {
+	job, _ := ctx.Value(webJobContextKey{}).(*webJob)
+	return job
+}
+
+// 元数据查询（DESCRIBE、EXISTS）随任务取消，但不计入任务的接收进度
+func webWithoutJob(ctx context.Context) context.Context {
+	return context.WithValue(ctx, webJobContextKey{}, (*webJob)(nil))
+}
+
+// 任务内每次查询的 query_id 为 任务ID-序号，进度轮询按前缀汇总
+func (job *webJob) nextQueryID() string {
+	webJobsMutex.Lock()
+	defer webJobsMutex.Unlock()
+	job.queries++
+	return fmt.Sprintf("%s-%d", job.ID, job.queries)
+}
+
+// 统计任务查询结果的接收进度
+type webJobReader struct {
+	reader io.Reader
+	job    *webJob
+}
+
+func (r *webJobReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		webJobsMutex.Lock()
+		r.job.BytesReceived += int64(n)
+		if !webUseRowBinary {
+			r.job.RowsReceived += int64(bytes.Count(p[:n], []byte{'\n'}))
+		}
+		stream := r.job.stream
+		webJobsMutex.Unlock()
+		if stream != nil {
+			stream.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// 返回任务状态的副本，调用方需持有 webJobsMutex
+func (job *webJob) snapshotLocked(now time.Time) webJob {
+	snapshot := *job
+	snapshot.data, snapshot.cancel = nil, nil
+	end := job.finishedAt
+	if end.IsZero() {
+		end = now
+	}
+	snapshot.ElapsedMs = end.Sub(job.CreatedAt).Milliseconds()
+	switch {
+	case job.State == JOB_DONE:
+		snapshot.Progress = 1
+	case job.TotalRows > 0:
+		snapshot.Progress = math.Min(float64(job.RowsRead)/float64(job.TotalRows), 0.99)
+	}
+	return snapshot
+}
+
+// 清理结束超过 JOB_RETENTION 的任务，调用方需持有 webJobsMutex
+func webPruneJobsLocked(now time.Time) {
+	for id, job := range webJobs {
+		if !job.finishedAt.IsZero() && now.Sub(job.finishedAt) > JOB_RETENTION {
+			delete(webJobs, id)
+		}
+	}
+}
+
+// 创建查询任务；同一数据集已有运行中的任务时直接返回该任务
+func webStartJob(base context.Context, key webDatasetKey) (webJob, error) {
+	// 相同数据集的任务在用户之间共享，复用已有任务时不经过查询构造器，先检查权限
+	if u := webContextUser(base); !u.allows(key.table, key.symbol) {
+		return webJob{}, u.denied(key.table, key.symbol)
+	}
+	webJobsMutex.Lock()
+	defer webJobsMutex.Unlock()
+
+	now := time.Now()
+	webPruneJobsLocked(now)
+	gen := webProfileGeneration.Load()
+	active := 0
+	for _, job := range webJobs {
+		if job.State == JOB_RUNNING {
+			if job.key == key && !job.canceled && job.generation == gen {
+				return job.snapshotLocked(now), nil
+			}
+			active++
+		}
+	}
+	if active >= JOB_MAX_ACTIVE {
+		return webJob{}, fmt.Errorf("同时运行的查询任务已达上限 %d，请稍后重试", JOB_MAX_ACTIVE)
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	ctx, cancel := context.WithCancel(base)
+	job := &webJob{
+		ID:         hex.EncodeToString(buf),
+		Dataset:    key.String(),
+		State:      JOB_RUNNING,
+		CreatedAt:  now,
+		key:        key,
+		cancel:     cancel,
+		generation: gen,
+	}
+	if !webUseRowBinary {
+		job.stream = &webStreamParser{}
+	}
+	webJobs[job.ID] = job
+	go webRunJob(context.WithValue(ctx, webJobContextKey{}, job), job)
+	return job.snapshotLocked(now), nil
+}
+
+func webRunJob(ctx context.Context, job *webJob) {
+	stop := make(chan struct{})
+	if !webDemoMode() {
+		go webPollJobProgress(job, stop)
+	}
+	data, err := webFetchDataset(ctx, job.key)
+	close(stop)
+	job.cancel()
+	// 空状态的候选合约可能要查询目录，在加锁前准备好
+	empty := webEmptyStateFor(err, job.key.rangeSpec)
+
+	webJobsMutex.Lock()
+	job.finishedAt = time.Now()
+	job.stream = nil
+	switch {
+	case errors.Is(err, context.Canceled):
+		job.State, job.Error = JOB_CANCELED, "任务已取消"
+	case err != nil:
+		job.State, job.Error, job.Empty = JOB_FAILED, err.Error(), empty
+	default:
+		job.State, job.data, job.Rows = JOB_DONE, data, len(data)
+	}
+	webJobsMutex.Unlock()
+
+	if err != nil {
+		log.Printf("Query job %s (%s) %s: %v", job.ID, job.Dataset, job.State, err)
+		return
+	}
+	if webCacheEnabled() {
+		webStoreDataset(job.key, data, false, job.generation)
+	}
+	fmt.Printf("Query job %s (%s) finished: %d records\n", job.ID, job.Dataset, len(data))
+}
+
+// 运行期间定时从 system.processes 读取该任务查询的扫描进度
+func webPollJobProgress(job *webJob, stop <-chan struct{}) {
+	ticker := time.NewTicker(JOB_PROGRESS_POLL)
+	defer ticker.Stop()
+	query, _ := webSelect(context.Background(), "sum(read_rows)", "sum(total_rows_approx)").
+		FromSystem("processes").
+		Where("query_id LIKE " + webQuoteString(job.ID+"-%")).
+		Format("TabSeparated").
+		Build()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		result, err := webExecuteQuery(query)
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(result)
+		if len(fields) != 2 {
+			continue
+		}
+		read, err1 := strconv.ParseInt(fields[0], 10, 64)
+		total, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil || total == 0 {
+			continue
+		}
+		webJobsMutex.Lock()
+		job.RowsRead, job.TotalRows = read, total
+		webJobsMutex.Unlock()
+	}
+}
+
+// 取已完成任务的结果，key 非空时要求与任务的数据集一致
+func webJobResult(id string, key webDatasetKey) ([]WebMarketData, error) {
+	webJobsMutex.Lock()
+	defer webJobsMutex.Unlock()
+	job, ok := webJobs[id]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("查询任务 %s 不存在或已过期", id)
+	case key != (webDatasetKey{}) && job.key != key:
+		return nil, fmt.Errorf("查询任务 %s 的数据集为 %s，与请求的 %s 不一致", id, job.Dataset, key)
+	case job.State == JOB_RUNNING:
+		return nil, fmt.Errorf("查询任务 %s 尚未完成", id)
+	case job.State != JOB_DONE:
+		return nil, fmt.Errorf("查询任务 %s %s: %s", id, job.State, job.Error)
+	case job.generation != webProfileGeneration.Load():
+		return nil, fmt.Errorf("查询任务 %s 的结果来自切换前的ClickHouse配置，请重新查询", id)
+	}
+	return job.data, nil
+}
+
+// 任务的预览：运行中为流式解析到目前为止的数据，完成后为完整结果，都均匀采样到不超过 points 个点。
+// 数据按时间升序到达，预览是从最早的数据开始逐渐向右延伸的前缀
+type webJobPreviewData struct {
+	ID      string          `json:"id"`
+	State   string          `json:"state"`
+	Rows    int             `json:"rows"`
+	Partial bool            `json:"partial"`
+	Data    []WebMarketData `json:"data"`
+	Stats   struct {
+		TickSize float64 `json:"tick_size"`
+	} `json:"stats"`
+}
+
+func webJobPreview(id string, points int) (*webJobPreviewData, error) {
+	webJobsMutex.Lock()
+	job, ok := webJobs[id]
+	if !ok {
+		webJobsMutex.Unlock()
+		return nil, fmt.Errorf("查询任务 %s 不存在或已过期", id)
+	}
+	preview := &webJobPreviewData{ID: id, State: job.State, Partial: job.State == JOB_RUNNING}
+	preview.Stats.TickSize = webTickSizeFor(job.key.symbol)
+	stream, data := job.stream, job.data
+	webJobsMutex.Unlock()
+
+	if stream != nil {
+		preview.Rows, preview.Data = stream.snapshot(points)
+	} else {
+		preview.Rows, preview.Data = len(data), webSampleData(data, points)
+	}
+	if preview.Data == nil {
+		preview.Data = []WebMarketData{}
+	}
+	return preview, nil
+}
+
+// 查询任务列表和创建：GET /api/v1/jobs 列出任务，POST /api/v1/jobs?table=jm&symbol=jm2509&range=30d 创建任务
+func webJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webJobsMutex.Lock()
+		now := time.Now()
+		webPruneJobsLocked(now)
+		jobs := make([]webJob, 0, len(webJobs))
+		for _, job := range webJobs {
+			if webRequestUser(r).allows(job.key.table, job.key.symbol) {
+				jobs = append(jobs, job.snapshotLocked(now))
+			}
+		}
+		webJobsMutex.Unlock()
+		for i := range jobs {
+			jobs[i].Empty = jobs[i].Empty.forUser(webRequestUser(r))
+		}
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+		return
+	case http.MethodPost:
+	default:
+		fail(http.StatusMethodNotAllowed, "只支持GET和POST请求")
+		return
+	}
+
+	table, symbol, rangeSpec := r.FormValue("table"), r.FormValue("symbol"), r.FormValue("range")
+	if table == "" || symbol == "" {
+		fail(http.StatusBadRequest, "缺少table或symbol参数")
+		return
+	}
+	if !webIsIdentifier(table) {
+		fail(http.StatusBadRequest, fmt.Sprintf("无效的表名: %q", table))
+		return
+	}
+	if err := webValidateDatasetRange(rangeSpec); err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+
+	key := webDatasetKey{table, symbol, webNormalizeRange(rangeSpec)}
+	estimate, err := webEstimateRawRange(webAuditContext(r), key)
+	if err == nil && estimate != nil {
+		if status, msg := estimate.refusal("加载", r.FormValue("confirm") == "1"); status != 0 {
+			webRawRangeDeny(w, status, msg, estimate)
+			return
+		}
+	}
+	var denied *webACLError
+	if errors.As(err, &denied) {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Sprintf("预估数据大小失败: %v", err))
+		return
+	}
+
+	// 任务在创建它的请求返回后继续运行，只保留请求的用户和发起方，不随请求取消
+	job, err := webStartJob(context.WithoutCancel(webAuditContext(r)), key)
+	if errors.As(err, &denied) {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		fail(http.StatusTooManyRequests, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// 单个查询任务：GET /api/v1/jobs/{id} 查询进度，DELETE 取消，GET /api/v1/jobs/{id}/result 获取结果，
+// GET /api/v1/jobs/{id}/partial?points=2000 获取已接收部分的采样预览
+func webJobHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/"), "/")
+	webJobsMutex.Lock()
+	if job, ok := webJobs[id]; ok {
+		if err := webAuthorizeDataset(r, job.key); err != nil {
+			webJobsMutex.Unlock()
+			fail(http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	webJobsMutex.Unlock()
+	if sub == "result" {
+		if r.Method != http.MethodGet {
+			fail(http.StatusMethodNotAllowed, "只支持GET请求")
+			return
+		}
+		data, err := webJobResult(id, webDatasetKey{})
+		if err != nil {
+			fail(http.StatusConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "rows": len(data), "data": data})
+		return
+	}
+	if sub == "partial" {
+		if r.Method != http.MethodGet {
+			fail(http.StatusMethodNotAllowed, "只支持GET请求")
+			return
+		}
+		points := JOB_PREVIEW_POINTS
+		if raw := r.URL.Query().Get("points"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 2 || n > JOB_PREVIEW_MAX_POINTS {
+				fail(http.StatusBadRequest, fmt.Sprintf("points 必须在 2-%d 之间", JOB_PREVIEW_MAX_POINTS))
+				return
+			}
+			points = n
+		}
+		preview, err := webJobPreview(id, points)
+		if err != nil {
+			fail(http.StatusNotFound, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(preview)
+		return
+	}
+	if sub != "" {
+		fail(http.StatusNotFound, "未知的任务接口")
+		return
+	}
+
+	webJobsMutex.Lock()
+	job, ok := webJobs[id]
+	var snapshot webJob
+	if ok {
+		if r.Method == http.MethodDelete && job.State == JOB_RUNNING {
+			job.cancel()
+			job.canceled = true
+		}
+		snapshot = job.snapshotLocked(time.Now())
+	}
+	webJobsMutex.Unlock()
+	snapshot.Empty = snapshot.Empty.forUser(webRequestUser(r))
+
+	switch {
+	case !ok:
+		fail(http.StatusNotFound, fmt.Sprintf("查询任务 %s 不存在或已过期", id))
+	case r.Method != http.MethodGet && r.Method != http.MethodDelete:
+		fail(http.StatusMethodNotAllowed, "只支持GET和DELETE请求")
+	default:
+		json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+// 将相对时间范围转换为ClickHouse时间条件，以该symbol的最新数据时间为基准
+func webTimeRangePredicate(ctx context.Context, table, symbol string, d time.Duration) (string, error) {
+	latest, err := webSelect(ctx, "max(time)").From(table).Symbol(symbol).Build()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("time >= (%s) - INTERVAL %d SECOND", latest, int64(d/time.Second)), nil
+}
+
+// 宽时间范围（超过1天或全部历史）优先读取 market_cli.go bars build 生成的分钟线表
+const BAR_TABLE_MIN_RANGE = 24 * time.Hour
+
+// 返回查询应使用的数据源，分钟线表不存在时回退到原始tick表
+func webPreferBarTable(ctx context.Context, table string, span time.Duration) string {
+	if span > 0 && span <= BAR_TABLE_MIN_RANGE {
+		return table
+	}
+
+	barTable := table + "_bars_1m"
+	result, err := webExecuteQueryContext(webWithoutJob(ctx), "EXISTS TABLE "+webQualifiedTable(barTable))
+	if err != nil || strings.TrimSpace(result) != "1" {
+		return table
+	}
+
+	fmt.Printf("Using minute bar table %s for a wide time range\n", webQualifiedTable(barTable))
+	return barTable + " FINAL"
+}
+
+func webNormalizeToRange(source, target []float64) []float64 {
+	if len(source) == 0 || len(target) == 0 {
+		return source
+	}
+
+	sourceMin := webFindMin(source)
+	sourceMax := webFindMax(source)
+	targetMin := webFindMin(target)
+	targetMax := webFindMax(target)
+
+	if sourceMax == sourceMin {
+		return source
+	}
+
+	normalized := make([]float64, len(source))
+	for i, val := range source {
+		// 将source数据从[sourceMin, sourceMax]映射到[targetMin, targetMax]
+		normalized[i] = targetMin + (val-sourceMin)*(targetMax-targetMin)/(sourceMax-sourceMin)
+	}
+
+	return normalized
+}
+
+func webFindMax(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var max float64
+	hasValidValue := false
+
+	for _, val := range data {
+		if !math.IsInf(val, 0) && !math.IsNaN(val) {
+			if !hasValidValue || val > max {
+				max = val
+				hasValidValue = true
+			}
+		}
+	}
+
+	if !hasValidValue {
+		return 0
+	}
+	return max
+}
+
+func webFindMin(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var min float64
+	hasValidValue := false
+
+	for _, val := range data {
+		if !math.IsInf(val, 0) && !math.IsNaN(val) {
+			if !hasValidValue || val < min {
+				min = val
+				hasValidValue = true
+			}
+		}
+	}
+
+	if !hasValidValue {
+		return 0
+	}
+	return min
+}
+
+func webCalculateAverage(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	sum := 0.0
+	validCount := 0
+	for _, val := range data {
+		if !math.IsInf(val, 0) && !math.IsNaN(val) {
+			sum += val
+			validCount++
+		}
+	}
+	if validCount == 0 {
+		return 0
+	}
+	return sum / float64(validCount)
+}
+
+// 表和合约目录：缓存 SHOW TABLES 和各表的 DISTINCT symbol，超过 -catalog-ttl 后先返回旧目录并在后台刷新。
+// 用户传入的表名和合约代码都先在目录中校验，目录中没有的直接拒绝，不会拼进行情查询
+const CATALOG_MISS_REFRESH = 30 * time.Second // 目录中找不到时，距上次加载超过该时长才同步重新加载一次（新建的表、新上市的合约）
+
+var webCatalogTTL = 5 * time.Minute // 可以通过 -config 热加载修改，在 webCatalogMutex 下读写
+
+type webCatalogEntry struct {
+	names      []string
+	set        map[string]bool
+	loadedAt   time.Time
+	refreshing bool
+}
+
+var (
+	// 键为空字符串的是表列表，其余为各表的合约列表
+	webCatalog      = make(map[string]*webCatalogEntry)
+	webCatalogMutex sync.Mutex
+)
+
+func webLoadCatalogTables() ([]string, error) {
+	if webDemoMode() {
+		var tables []string
+		for table := range webDemoSymbols {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		return tables, nil
+	}
+	result, err := webExecuteSharedQuery(context.Background(), "SHOW TABLES")
+	if err != nil {
+		return nil, fmt.Errorf("获取表列表失败: %w", err)
+	}
+	return webSplitLines(result), nil
+}
+
+func webLoadCatalogSymbols(table string) ([]string, error) {
+	if webDemoMode() {
+		if symbols, ok := webDemoSymbols[table]; ok {
+			return symbols, nil
+		}
+		return nil, fmt.Errorf("表 %s 不存在或无法访问", table)
+	}
+	// 目录在用户之间共享，按服务端身份查询全部合约，列出时再按用户过滤
+	query, err := webSelect(context.Background(), "DISTINCT symbol").From(table).OrderBy("symbol").Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := webExecuteSharedQuery(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("获取symbol列表失败: %w", err)
+	}
+	return webSplitLines(result), nil
+}
+
+func webSplitLines(result string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func webCatalogLoader(key string) func() ([]string, error) {
+	if key == "" {
+		return webLoadCatalogTables
+	}
+	return func() ([]string, error) { return webLoadCatalogSymbols(key) }
+}
+
+// 同步加载目录项并替换缓存
+func webCatalogLoad(key string) (webCatalogEntry, error) {
+	names, err := webCatalogLoader(key)()
+	if err != nil {
+		return webCatalogEntry{}, err
+	}
+	entry := &webCatalogEntry{names: names, set: make(map[string]bool, len(names)), loadedAt: time.Now()}
+	for _, name := range names {
+		entry.set[name] = true
+	}
+	webCatalogMutex.Lock()
+	webCatalog[key] = entry
+	webCatalogMutex.Unlock()
+	return *entry, nil
+}
+
+// 读取目录项：没有缓存时同步加载，过期时返回旧目录并在后台刷新
+func webCatalogGet(key string) (webCatalogEntry, error) {
+	webCatalogMutex.Lock()
+	entry, ok := webCatalog[key]
+	if !ok {
+		webCatalogMutex.Unlock()
+		return webCatalogLoad(key)
+	}
+	if time.Since(entry.loadedAt) > webCatalogTTL && !entry.refreshing {
+		entry.refreshing = true
+		go func() {
+			if _, err := webCatalogLoad(key); err != nil {
+				log.Printf("Catalog refresh for %q failed, keeping the cached list: %v", key, err)
+				webCatalogMutex.Lock()
+				entry.refreshing = false
+				webCatalogMutex.Unlock()
+			}
+		}()
+	}
+	snapshot := *entry
+	webCatalogMutex.Unlock()
+	return snapshot, nil
+}
+
+func webCatalogContains(key, name string) (bool, error) {
+	entry, err := webCatalogGet(key)
+	if err != nil {
+		return false, err
+	}
+	if entry.set[name] || time.Since(entry.loadedAt) < CATALOG_MISS_REFRESH {
+		return entry.set[name], nil
+	}
+	if entry, err = webCatalogLoad(key); err != nil {
+		return false, err
+	}
+	return entry.set[name], nil
+}
+
+// 用目录校验表名和合约代码。演示模式可以生成任意合约的行情，不做校验
+func webCheckCatalog(ctx context.Context, table string, symbols ...string) error {
+	if webDemoMode() {
+		return nil
+	}
+	if !webIsIdentifier(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	// 先按用户检查权限（与 webQuery 的规则相同），不向无权访问的用户透露表和合约是否存在
+	u := webContextUser(ctx)
+	if !u.allowsTable(table) {
+		return u.denied(table, "")
+	}
+	for _, symbol := range symbols {
+		if !u.allows(table, symbol) {
+			return u.denied(table, symbol)
+		}
+	}
+	ok, err := webCatalogContains("", table)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &webNoDataError{table: table, msg: fmt.Sprintf("表 %s 不存在", table)}
+	}
+	for _, symbol := range symbols {
+		ok, err := webCatalogContains(table, symbol)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &webNoDataError{table: table, symbol: symbol, msg: fmt.Sprintf("表 %s 中没有合约 %s", table, symbol)}
+		}
+	}
+	return nil
+}
+
+// 查询没有结果：表不存在、表中没有该合约，或该合约在所选时间范围内没有数据。
+// 这不是故障，接口据此返回空状态（原因、建议和可以改选的合约），页面照常可用
+type webNoDataError struct {
+	table, symbol string // symbol 为空表示表本身不存在
+	msg           string
+}
+
+func (e *webNoDataError) Error() string { return e.msg }
+
+func webEmptyDatasetError(table, symbol string) error {
+	return &webNoDataError{table: table, symbol: symbol, msg: fmt.Sprintf("未找到表 %s 中 symbol = %s 的数据", table, symbol)}
+}
+
+// 空状态中最多列出的候选表或合约数
+const EMPTY_STATE_SUGGESTIONS = 8
+
+// 页面显示的空状态。suggest 说明 suggestions 是候选的表还是合约
+type webEmptyState struct {
+	Table       string   `json:"table"`
+	Symbol      string   `json:"symbol,omitempty"`
+	Message     string   `json:"message"`
+	Hints       []string `json:"hints"`
+	Suggest     string   `json:"suggest"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// err 是（或包装了）webNoDataError 时返回对应的空状态，否则返回 nil。
+// 候选合约取自目录：同品种的合约在前，其次是表中的其他合约；目录加载失败时只给出提示
+func webEmptyStateFor(err error, rangeSpec string) *webEmptyState {
+	var noData *webNoDataError
+	if !errors.As(err, &noData) {
+		return nil
+	}
+	state := &webEmptyState{Table: noData.table, Symbol: noData.symbol, Message: noData.msg, Hints: []string{}, Suggestions: []string{}}
+	if noData.symbol == "" {
+		state.Suggest = "table"
+		state.Hints = append(state.Hints, "检查表名是否正确，或从下面的表中选择")
+		if entry, err := webCatalogGet(""); err == nil {
+			state.Suggestions = append(state.Suggestions, entry.names...)
+		}
+	} else {
+		state.Suggest = "symbol"
+		product := strings.ToLower(strings.TrimRight(noData.symbol, "0123456789"))
+		var same, other []string
+		if entry, err := webCatalogGet(noData.table); err == nil {
+			for _, name := range entry.names {
+				switch {
+				case name == noData.symbol:
+				case strings.ToLower(strings.TrimRight(name, "0123456789")) == product:
+					same = append(same, name)
+				default:
+					other = append(other, name)
+				}
+			}
+			if len(entry.names) == 0 {
+				state.Hints = append(state.Hints, fmt.Sprintf("表 %s 中还没有任何合约的数据", noData.table))
+			} else if !entry.set[noData.symbol] {
+				state.Hints = append(state.Hints, "检查合约代码是否正确（如 jm2509），或从下面的合约中选择")
+			}
+		}
+		state.Suggestions = append(same, other...)
+		if rangeSpec != "" && webNormalizeRange(rangeSpec) != "all" {
+			state.Hints = append(state.Hints, fmt.Sprintf("所选时间范围 %s 内可能没有成交（休市、节假日或夜盘开始前），可以改为“全部”或按交易日查看", rangeSpec))
+		}
+	}
+	if len(state.Suggestions) > EMPTY_STATE_SUGGESTIONS {
+		state.Suggestions = state.Suggestions[:EMPTY_STATE_SUGGESTIONS]
+	}
+	return state
+}
+
+// 去掉用户无权访问的候选表或合约，返回副本
+func (s *webEmptyState) forUser(user *webACLUser) *webEmptyState {
+	if s == nil || user == nil {
+		return s
+	}
+	filtered := *s
+	if s.Suggest == "table" {
+		filtered.Suggestions = webACLFilter(user, "", s.Suggestions)
+	} else {
+		filtered.Suggestions = webACLFilter(user, s.Table, s.Suggestions)
+	}
+	return &filtered
+}
+
+// 数据接口的错误响应：没有数据时带上空状态
+func webDataErrorResponse(r *http.Request, prefix string, err error, rangeSpec string) map[string]interface{} {
+	response := map[string]interface{}{"error": prefix + err.Error()}
+	if empty := webEmptyStateFor(err, rangeSpec); empty != nil {
+		response["empty"] = empty.forUser(webRequestUser(r))
+	}
+	return response
+}
+
+// 目录接口：/api/v1/catalog?table=jm,i&refresh=1
+// 返回表列表和已缓存的各表合约列表；table 指定的表没有缓存时先加载，refresh=1 时重新加载表列表和指定的表
+func webCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	refresh := q.Get("refresh") == "1"
+	get := webCatalogGet
+	if refresh {
+		get = webCatalogLoad
+	}
+
+	tables, err := get("")
+	if err != nil {
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+	for _, table := range strings.Split(q.Get("table"), ",") {
+		if table = strings.TrimSpace(table); table == "" {
+			continue
+		}
+		if !tables.set[table] {
+			fail(http.StatusNotFound, fmt.Sprintf("表 %s 不存在", table))
+			return
+		}
+		if _, err := get(table); err != nil {
+			fail(http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	type catalogSymbols struct {
+		Symbols     []string `json:"symbols"`
+		RefreshedAt string   `json:"refreshed_at"`
+	}
+	user := webRequestUser(r)
+	symbols := make(map[string]catalogSymbols)
+	webCatalogMutex.Lock()
+	for key, entry := range webCatalog {
+		if key != "" && tables.set[key] && user.allowsTable(key) {
+			symbols[key] = catalogSymbols{webACLFilter(user, key, entry.names), entry.loadedAt.Format(time.RFC3339)}
+		}
+	}
+	ttl := webCatalogTTL
+	webCatalogMutex.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tables":       webACLFilter(user, "", tables.names),
+		"refreshed_at": tables.loadedAt.Format(time.RFC3339),
+		"ttl":          ttl.String(),
+		"symbols":      symbols,
+	})
+}
+
+// 列统计：/api/v1/describe 返回每列的类型、最小最大值、空值比例和基数，页面据此判断哪些列可以画图，
+// 也方便熟悉陌生的表。统计在ClickHouse中用一条聚合查询完成，基数用 uniq 估算
+type webColumnStats struct {
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	Kind        string  `json:"kind"`
+	Min         string  `json:"min,omitempty"`
+	Max         string  `json:"max,omitempty"`
+	NullRatio   float64 `json:"null_ratio"`
+	Cardinality uint64  `json:"cardinality"`
+	Plottable   bool    `json:"plottable"`
+}
+
+type webTableStats struct {
+	Table   string           `json:"table"`
+	Symbol  string           `json:"symbol,omitempty"`
+	Rows    uint64           `json:"rows"`
+	Columns []webColumnStats `json:"columns"`
+}
+
+// 演示行情的表结构，与 webMarketDataColumns 的顺序一致
+var webDemoColumnTypes = []string{
+	"String", "DateTime", "Float32", "UInt32", "UInt32", "Int32", "Int32",
+	"Float32", "UInt32", "Float32", "UInt32", "UInt64",
+}
+
+// 按基础类型把列分为 numeric、time、string 和 other，other 类型（数组、Map 等）不统计最小最大值
+func webColumnKind(typ string) string {
+	base := webBaseType(typ)
+	switch {
+	case strings.HasPrefix(base, "Int"), strings.HasPrefix(base, "UInt"),
+		strings.HasPrefix(base, "Float"), strings.HasPrefix(base, "Decimal"):
+		return "numeric"
+	case strings.HasPrefix(base, "Date"):
+		return "time"
+	case strings.HasPrefix(base, "String"), strings.HasPrefix(base, "FixedString"), strings.HasPrefix(base, "Enum"):
+		return "string"
+	}
+	return "other"
+}
+
+// 数值列有两个以上不同取值且不全为空时可以画图；datetime 是毫秒时间戳，虽是整数也不作为序列
+func webColumnPlottable(col webColumnStats) bool {
+	return col.Kind == "numeric" && col.Name != "datetime" && col.Cardinality > 1 && col.NullRatio < 1
+}
+
+func webQueryTableStats(ctx context.Context, table, symbol string) (*webTableStats, error) {
+	if webDemoMode() {
+		return webDemoTableStats(table, symbol)
+	}
+	var symbols []string
+	if symbol != "" {
+		symbols = append(symbols, symbol)
+	}
+	if err := webCheckCatalog(ctx, table, symbols...); err != nil {
+		return nil, err
+	}
+
+	described, err := webDescribeColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	stats := &webTableStats{Table: table, Symbol: symbol}
+	exprs := []string{"count()"}
+	for _, col := range described {
+		kind := webColumnKind(col.Type)
+		stats.Columns = append(stats.Columns, webColumnStats{Name: col.Name, Type: col.Type, Kind: kind})
+		name := "`" + col.Name + "`"
+		if kind == "other" {
+			exprs = append(exprs, "''", "''")
+		} else {
+			exprs = append(exprs, "toString(min("+name+"))", "toString(max("+name+"))")
+		}
+		exprs = append(exprs, "countIf(isNull("+name+"))", "uniq("+name+")")
+	}
+
+	q := webSelect(ctx, exprs...).From(table).Format("TabSeparated")
+	if symbol != "" {
+		q.Symbol(symbol)
+	}
+	query, err := q.Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := webExecuteSharedQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute column statistics for %s: %w", webQualifiedTable(table), err)
+	}
+
+	// 结果只有一行：count() 之后每列依次为 min、max、空值数、基数
+	fields := strings.Split(strings.TrimRight(result, "\n"), "\t")
+	if len(fields) != 1+4*len(stats.Columns) {
+		return nil, fmt.Errorf("unexpected column statistics: got %d fields for %d columns", len(fields), len(stats.Columns))
+	}
+	if stats.Rows, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid row count %q", fields[0])
+	}
+	for i := range stats.Columns {
+		col := &stats.Columns[i]
+		f := fields[1+4*i : 5+4*i]
+		nulls, err := strconv.ParseUint(f[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid null count %q for column %s", f[2], col.Name)
+		}
+		if col.Cardinality, err = strconv.ParseUint(f[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid cardinality %q for column %s", f[3], col.Name)
+		}
+		if stats.Rows > 0 {
+			col.Min, col.Max = f[0], f[1]
+			col.NullRatio = float64(nulls) / float64(stats.Rows)
+		}
+		col.Plottable = webColumnPlottable(*col)
+	}
+	return stats, nil
+}
+
+// 演示模式按模拟tick精确计算，不指定合约时统计 webDemoSymbols 中该表的全部合约
+func webDemoTableStats(table, symbol string) (*webTableStats, error) {
+	symbols := webDemoSymbols[table]
+	if symbol != "" {
+		symbols = []string{symbol}
+	}
+	if len(symbols) == 0 {
+		return nil, fmt.Errorf("表 %s 不存在", table)
+	}
+
+	stats := &webTableStats{Table: table, Symbol: symbol}
+	distinct := make([]map[string]bool, len(webMarketDataColumns))
+	numbers := make([][2]float64, len(webMarketDataColumns))
+	for i, name := range webMarketDataColumns {
+		typ := webDemoColumnTypes[i]
+		stats.Columns = append(stats.Columns, webColumnStats{Name: name, Type: typ, Kind: webColumnKind(typ)})
+		distinct[i] = make(map[string]bool)
+	}
+	for _, s := range symbols {
+		for _, md := range webDemoTicks(s, time.Time{}, time.Now()) {
+			values := []string{
+				md.Symbol, md.Time, strconv.FormatFloat(float64(md.Price), 'f', -1, 32),
+				strconv.FormatUint(uint64(md.Vol), 10), strconv.FormatUint(uint64(md.OpenInterest), 10),
+				strconv.Itoa(int(md.DiffVol)), strconv.Itoa(int(md.DiffOI)),
+				strconv.FormatFloat(float64(md.Bid1), 'f', -1, 32), strconv.FormatUint(uint64(md.BidVolumn1), 10),
+				strconv.FormatFloat(float64(md.Ask1), 'f', -1, 32), strconv.FormatUint(uint64(md.AskVolumn1), 10),
+				strconv.FormatUint(md.DateTime, 10),
+			}
+			for i, v := range values {
+				col := &stats.Columns[i]
+				distinct[i][v] = true
+				if col.Kind == "numeric" {
+					x, _ := strconv.ParseFloat(v, 64)
+					if stats.Rows == 0 || x < numbers[i][0] {
+						numbers[i][0], col.Min = x, v
+					}
+					if stats.Rows == 0 || x > numbers[i][1] {
+						numbers[i][1], col.Max = x, v
+					}
+				} else {
+					if stats.Rows == 0 || v < col.Min {
+						col.Min = v
+					}
+					if v > col.Max {
+						col.Max = v
+					}
+				}
+			}
+			stats.Rows++
+		}
+	}
+	for i := range stats.Columns {
+		stats.Columns[i].Cardinality = uint64(len(distinct[i]))
+		stats.Columns[i].Plottable = webColumnPlottable(stats.Columns[i])
+	}
+	return stats, nil
+}
+
+// 列统计接口：/api/v1/describe?table=jm[&symbol=jm2509]
+func webDescribeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	table := q.Get("table")
+	if table == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "缺少table参数"})
+		return
+	}
+	stats, err := webQueryTableStats(r.Context(), table, q.Get("symbol"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// 自定义查询：用户输入或从预设中选择一条返回 (时间, 数值[, 序列名]) 的查询，页面按列画成时间序列，
+// 可以画任意表的统计结果而不限于行情表结构。需要启动时加 -enable-query
+const (
+	QUERY_MAX_ROWS   = 200000
+	QUERY_MAX_SERIES = 20
+)
+
+var (
+	webQueryEnabled bool
+	webQueryPresets = []webQueryPreset{
+		{"分钟均价", "SELECT toStartOfMinute(time) AS t, avg(price) AS price\nFROM feature.jm\nWHERE symbol = 'jm2509' AND time >= now() - INTERVAL 1 DAY\nGROUP BY t ORDER BY t"},
+		{"各合约日成交量", "SELECT toDate(time) AS day, sum(diff_vol) AS volume, symbol\nFROM feature.jm\nWHERE time >= today() - 30\nGROUP BY day, symbol ORDER BY day"},
+		{"每小时写入行数", "SELECT toStartOfHour(time) AS t, count() AS rows\nFROM feature.jm\nWHERE time >= now() - INTERVAL 7 DAY\nGROUP BY t ORDER BY t"},
+	}
+)
+
+type webQueryPreset struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql"`
+}
+
+// 读取 -query-presets 指定的预设查询文件：[{"name": "...", "sql": "..."}]，替换内置的示例
+func webLoadQueryPresets(path string) ([]webQueryPreset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read query presets: %w", err)
+	}
+	var presets []webQueryPreset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse query presets %s: %w", path, err)
+	}
+	for _, preset := range presets {
+		if preset.Name == "" || strings.TrimSpace(preset.SQL) == "" {
+			return nil, fmt.Errorf("invalid query preset in %s: name and sql are required", path)
+		}
+	}
+	return presets, nil
+}
+
+type webQuerySeries struct {
+	Name   string     `json:"name"`
+	Values []*float64 `json:"values"`
+}
+
+// 各序列按时间对齐：Labels 是所有序列时间的并集，序列在没有数据的时间点为 null
+type webQueryResult struct {
+	Columns   []string         `json:"columns"`
+	Labels    []string         `json:"labels"`
+	Series    []webQuerySeries `json:"series"`
+	Rows      int              `json:"rows"`
+	Truncated bool             `json:"truncated"`
+}
+
+// 时间列可以是 Date、DateTime、DateTime64，或秒/毫秒级的Unix时间戳
+func webParseQueryTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("第一列 %q 不是时间", s)
+	}
+	if n > 1e11 {
+		return time.UnixMilli(n), nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// 解析 TabSeparatedWithNames 格式的查询结果。数值为 NULL 或 nan 时记为空值，画图时断开
+func webParseQueryResult(result string) (*webQueryResult, error) {
+	lines := strings.Split(strings.TrimRight(result, "\n"), "\n")
+	columns := strings.Split(lines[0], "\t")
+	if len(columns) < 2 || len(columns) > 3 {
+		return nil, fmt.Errorf("查询应返回 (时间, 数值[, 序列名]) 两到三列，实际为 %d 列", len(columns))
+	}
+	res := &webQueryResult{Columns: columns}
+	rows := lines[1:]
+	if len(rows) > QUERY_MAX_ROWS {
+		rows, res.Truncated = rows[:QUERY_MAX_ROWS], true
+	}
+
+	type point struct {
+		t     time.Time
+		value *float64
+	}
+	var names []string
+	points := make(map[string][]point)
+	times := make(map[time.Time]bool)
+	for i, line := range rows {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(columns) {
+			return nil, fmt.Errorf("第 %d 行有 %d 列，表头为 %d 列", i+1, len(fields), len(columns))
+		}
+		t, err := webParseQueryTime(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", i+1, err)
+		}
+		var value *float64
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			value = &v
+		} else if fields[1] != `\N` && !strings.EqualFold(fields[1], "nan") {
+			return nil, fmt.Errorf("第 %d 行: 第二列 %q 不是数值", i+1, fields[1])
+		}
+		name := columns[1]
+		if len(fields) == 3 {
+			name = fields[2]
+		}
+		if _, ok := points[name]; !ok {
+			if len(names) == QUERY_MAX_SERIES {
+				return nil, fmt.Errorf("序列超过 %d 个，请在查询中缩小第三列的取值范围", QUERY_MAX_SERIES)
+			}
+			names = append(names, name)
+		}
+		points[name] = append(points[name], point{t, value})
+		times[t] = true
+		res.Rows++
+	}
+
+	sorted := make([]time.Time, 0, len(times))
+	for t := range times {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	// 时间都在零点时（按日汇总）只显示日期
+	layout := "2006-01-02"
+	for _, t := range sorted {
+		if !t.Equal(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)) {
+			layout = "2006-01-02 15:04:05"
+			break
+		}
+	}
+	index := make(map[time.Time]int, len(sorted))
+	res.Labels = make([]string, len(sorted))
+	for i, t := range sorted {
+		index[t] = i
+		res.Labels[i] = t.Format(layout)
+	}
+	for _, name := range names {
+		series := webQuerySeries{Name: name, Values: make([]*float64, len(sorted))}
+		for _, p := range points[name] {
+			series.Values[index[p.t]] = p.value
+		}
+		res.Series = append(res.Series, series)
+	}
+	return res, nil
+}
+
+func webRunUserQuery(ctx context.Context, sql string) (*webQueryResult, error) {
+	if !webQueryEnabled {
+		return nil, fmt.Errorf("自定义查询未启用，启动时加 -enable-query")
+	}
+	if webDemoMode() {
+		return nil, fmt.Errorf("演示模式没有ClickHouse，不支持自定义查询")
+	}
+	// 多取一行用于判断结果是否被截断
+	query, err := webSelect(ctx, "*").FromUserQuery(sql).Limit(QUERY_MAX_ROWS + 1).Format("TabSeparatedWithNames").Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(result) == "" {
+		return nil, fmt.Errorf("查询没有返回列")
+	}
+	return webParseQueryResult(result)
+}
+
+// 自定义查询数据接口：/query/data?sql=...（长查询用POST表单）或 /query/data?preset=分钟均价；
+// 不带参数时返回预设列表
+func webQueryDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	if u := webRequestUser(r); u != nil && !u.Query {
+		fail(fmt.Sprintf("用户 %s 无权执行自定义查询", u.Name))
+		return
+	}
+	sql := r.FormValue("sql")
+	if name := r.FormValue("preset"); name != "" {
+		for _, preset := range webQueryPresets {
+			if preset.Name == name {
+				sql = preset.SQL
+			}
+		}
+		if sql == "" {
+			fail(fmt.Sprintf("预设查询 %s 不存在", name))
+			return
+		}
+	}
+	if sql == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": webQueryEnabled, "presets": webQueryPresets})
+		return
+	}
+
+	res, err := webRunUserQuery(r.Context(), sql)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// 自定义查询页面的HTML模板 (templates/query.html)
+const webQueryTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>自定义查询</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .query-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .query-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .query-controls input, .query-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        textarea {
+            width: 100%;
+            box-sizing: border-box;
+            height: 140px;
+            padding: 8px;
+            font-family: monospace;
+            font-size: 13px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+            margin-bottom: 10px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        #chartContainer {
+            position: relative;
+            height: 450px;
+            margin-bottom: 20px;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>自定义查询</h1>
+        <textarea id="sql" spellcheck="false" placeholder="SELECT toStartOfMinute(time) AS t, avg(price) AS price FROM feature.jm WHERE symbol = 'jm2509' GROUP BY t ORDER BY t"></textarea>
+        <div class="query-controls">
+            <div><label>预设查询</label>
+                <select id="preset" onchange="pickPreset()">
+                    <option value="">自定义</option>
+                </select>
+            </div>
+            <button onclick="runQuery()">执行</button>
+        </div>
+        <div id="chartContainer"><canvas id="queryChart"></canvas></div>
+        <div class="status" id="status">查询第一列为时间，第二列为数值，可选的第三列为序列名（每个取值画一条线）</div>
+    </div>
+    <script>
+        const colors = ['#007bff', '#dc3545', '#28a745', '#fd7e14', '#6f42c1', '#20c997', '#e83e8c', '#6c757d', '#17a2b8', '#ffc107'];
+        let presets = [];
+
+        const chart = new Chart(document.getElementById('queryChart').getContext('2d'), {
+            type: 'line',
+            data: { labels: [], datasets: [] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                animation: false,
+                interaction: { mode: 'index', intersect: false },
+                scales: {
+                    x: { ticks: { maxTicksLimit: 12 } },
+                    y: { title: { display: true, text: '' } }
+                }
+            }
+        });
+
+        function pickPreset() {
+            const preset = presets.find(p => p.name === document.getElementById('preset').value);
+            if (preset) {
+                document.getElementById('sql').value = preset.sql;
+                runQuery();
+            }
+        }
+
+        function runQuery() {
+            const sql = document.getElementById('sql').value.trim();
+            if (!sql) {
+                return;
+            }
+            document.getElementById('status').textContent = '正在查询...';
+            fetch('/query/data', { method: 'POST', body: new URLSearchParams({ sql: sql }) })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
+                    }
+                    chart.data.labels = data.labels;
+                    chart.data.datasets = data.series.map((series, i) => ({
+                        label: series.name,
+                        data: series.values,
+                        borderColor: colors[i % colors.length],
+                        backgroundColor: colors[i % colors.length],
+                        borderWidth: 1.5,
+                        pointRadius: data.labels.length > 200 ? 0 : 2,
+                        spanGaps: false
+                    }));
+                    chart.options.scales.y.title.text = data.columns[1];
+                    chart.update();
+                    let status = data.rows + ' 行，' + data.series.length + ' 个序列';
+                    if (data.truncated) {
+                        status += '；结果超过行数上限已截断，请在查询中聚合或缩小时间范围';
+                    }
+                    document.getElementById('status').textContent = status;
+                })
+                .catch(error => {
+                    document.getElementById('status').textContent = '错误: ' + error.message;
+                });
+        }
+
+        document.getElementById('sql').addEventListener('keydown', event => {
+            if (event.key === 'Enter' && (event.ctrlKey || event.metaKey)) {
+                runQuery();
+            }
+        });
+
+        fetch('/query/data')
+            .then(response => response.json())
+            .then(data => {
+                if (!data.enabled) {
+                    document.getElementById('status').textContent = '自定义查询未启用，启动时加 -enable-query';
+                }
+                presets = data.presets || [];
+                const select = document.getElementById('preset');
+                presets.forEach(preset => {
+                    const option = select.appendChild(document.createElement('option'));
+                    option.value = preset.name;
+                    option.textContent = preset.name;
+                });
+                const name = new URLSearchParams(location.search).get('preset');
+                if (name) {
+                    select.value = name;
+                    pickPreset();
+                }
+            });
+    </script>
+</body>
+</html>`
+
+func webQueryHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("query.html")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
+
+// 获取所有表的API处理器
+func webTablesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	catalog, err := webCatalogGet("")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	names := webACLFilter(webRequestUser(r), "", catalog.names)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tables": webFilterList(names, r),
+		"total":  len(names),
+	})
+}
+
+// 获取指定表的所有symbol的API处理器
+func webSymbolsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "缺少table参数",
+		})
+		return
+	}
+
+	if err := webCheckCatalog(r.Context(), table); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	catalog, err := webCatalogGet(table)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	names := webACLFilter(webRequestUser(r), table, catalog.names)
+	total := len(names)
+	symbols := webFilterList(names, r)
+
+	labels := make(map[string]string)
+	for _, symbol := range symbols {
+		if label := webSymbolLabel(symbol); label != "" {
+			labels[symbol] = label
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"table":   table,
+		"symbols": symbols,
+		"labels":  labels,
+		"total":   total,
+	})
+}
+
+// 去掉用户无权访问的表（table 为空时）或该表中无权访问的symbol
+func webACLFilter(user *webACLUser, table string, items []string) []string {
+	if user == nil {
+		return items
+	}
+	allowed := make([]string, 0, len(items))
+	for _, item := range items {
+		if (table == "" && user.allowsTable(item)) || (table != "" && user.allows(table, item)) {
+			allowed = append(allowed, item)
+		}
+	}
+	return allowed
+}
+
+// 按 ?q= 模糊过滤列表（合约代码、品种中文名或拼音），?limit= 限制返回条数，合约很多时由服务端过滤
+func webFilterList(items []string, r *http.Request) []string {
+	if q := r.URL.Query().Get("q"); q != "" {
+		items = webFilterSymbols(items, q)
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+// 常见期货品种的中文名和拼音，用于合约搜索时按中文或拼音匹配
+var webProductNames = map[string][2]string{
+	"a":  {"豆一", "dou yi"},
+	"ag": {"白银", "bai yin"},
+	"al": {"铝", "lv"},
+	"ap": {"苹果", "ping guo"},
+	"au": {"黄金", "huang jin"},
+	"bu": {"沥青", "li qing"},
+	"c":  {"玉米", "yu mi"},
+	"cf": {"棉花", "mian hua"},
+	"cu": {"铜", "tong"},
+	"eb": {"苯乙烯", "ben yi xi"},
+	"eg": {"乙二醇", "yi er chun"},
+	"fg": {"玻璃", "bo li"},
+	"fu": {"燃料油", "ran liao you"},
+	"hc": {"热卷", "re juan"},
+	"i":  {"铁矿石", "tie kuang shi"},
+	"j":  {"焦炭", "jiao tan"},
+	"jm": {"焦煤", "jiao mei"},
+	"l":  {"塑料", "su liao"},
+	"lc": {"碳酸锂", "tan suan li"},
+	"lh": {"生猪", "sheng zhu"},
+	"m":  {"豆粕", "dou po"},
+	"ma": {"甲醇", "jia chun"},
+	"ni": {"镍", "nie"},
+	"oi": {"菜油", "cai you"},
+	"p":  {"棕榈油", "zong lv you"},
+	"pg": {"液化气", "ye hua qi"},
+	"pp": {"聚丙烯", "ju bing xi"},
+	"rb": {"螺纹钢", "luo wen gang"},
+	"rm": {"菜粕", "cai po"},
+	"ru": {"橡胶", "xiang jiao"},
+	"sa": {"纯碱", "chun jian"},
+	"sc": {"原油", "yuan you"},
+	"sf": {"硅铁", "gui tie"},
+	"si": {"工业硅", "gong ye gui"},
+	"sm": {"锰硅", "meng gui"},
+	"sp": {"纸浆", "zhi jiang"},
+	"sr": {"白糖", "bai tang"},
+	"ss": {"不锈钢", "bu xiu gang"},
+	"ta": {"PTA", "p t a"},
+	"ur": {"尿素", "niao su"},
+	"v":  {"PVC", "p v c"},
+	"y":  {"豆油", "dou you"},
+	"zn": {"锌", "xin"},
+}
+
+// 合约代码的品种部分（字母前缀）和月份部分
+func webSplitSymbolCode(symbol string) (string, string) {
+	i := strings.IndexFunc(symbol, func(r rune) bool { return r >= '0' && r <= '9' })
+	if i < 0 {
+		return symbol, ""
+	}
+	return symbol[:i], symbol[i:]
+}
+
+// 计算合约与搜索词的匹配得分，0 表示不匹配。
+// 依次尝试：前缀、子串、品种中文名/拼音/拼音首字母（可带月份，如 jiaomei25）、按顺序出现的模糊匹配
+func webSymbolMatchScore(symbol, query string) int {
+	q := strings.ToLower(strings.TrimSpace(query))
+	s := strings.ToLower(symbol)
+	if q == "" {
+		return 1
+	}
+	if strings.HasPrefix(s, q) {
+		return 100
+	}
+	if strings.Contains(s, q) {
+		return 80
+	}
+
+	product, month := webSplitSymbolCode(s)
+	if names, ok := webProductNames[product]; ok {
+		if strings.Contains(names[0], query) {
+			return 70
+		}
+
+		syllables := strings.Fields(names[1])
+		initials := ""
+		for _, syllable := range syllables {
+			initials += syllable[:1]
+		}
+		qProduct, qMonth := webSplitSymbolCode(q)
+		if strings.HasPrefix(month, qMonth) && qProduct != "" &&
+			(strings.HasPrefix(strings.Join(syllables, ""), qProduct) || strings.HasPrefix(initials, qProduct)) {
+			return 60
+		}
+	}
+
+	// 子序列模糊匹配，字符间隔越小得分越高
+	pos, gaps := 0, 0
+	for _, c := range q {
+		i := strings.IndexRune(s[pos:], c)
+		if i < 0 {
+			return 0
+		}
+		gaps += i
+		pos += i + 1
+	}
+	if score := 40 - gaps; score > 1 {
+		return score
+	}
+	return 1
+}
+
+// 合约的显示标签：品种中文名、拼音和拼音首字母，如 "焦煤 jiaomei jm"。
+// 浏览器按输入内容过滤datalist选项时也会匹配标签，因此中文和拼音搜索的结果不会被隐藏
+func webSymbolLabel(symbol string) string {
+	product, _ := webSplitSymbolCode(strings.ToLower(symbol))
+	names, ok := webProductNames[product]
+	if !ok {
+		return ""
+	}
+	initials := ""
+	for _, syllable := range strings.Fields(names[1]) {
+		initials += syllable[:1]
+	}
+	return fmt.Sprintf("%s %s %s", names[0], strings.ReplaceAll(names[1], " ", ""), initials)
+}
+
+// 按匹配得分过滤并排序，得分相同的保持原有顺序
+func webFilterSymbols(symbols []string, query string) []string {
+	type match struct {
+		symbol string
+		score  int
+	}
+	var matches []match
+	for _, symbol := range symbols {
+		if score := webSymbolMatchScore(symbol, query); score > 0 {
+			matches = append(matches, match{symbol, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	result := make([]string, len(matches))
+	for i, m := range matches {
+		result[i] = m.symbol
+	}
+	return result
+}
+
+// Arrow IPC 流式导出，每个RecordBatch的最大行数
+const ARROW_BATCH_ROWS = 65536
+
+// 导出大小预估：按行数乘以每行的Arrow编码字节数估算，用于在导出前确认或拒绝过大的请求
+type webExportEstimate struct {
+	Rows         int64 `json:"rows"`
+	Bytes        int64 `json:"bytes"`
+	ConfirmBytes int64 `json:"confirm_bytes"`
+	MaxBytes     int64 `json:"max_bytes"`
+	NeedsConfirm bool  `json:"needs_confirm"`
+	TooLarge     bool  `json:"too_large"`
+}
+
+// 每行Arrow数据的字节数：定长列按位宽计，symbol 列为4字节偏移加字符串本身
+func webArrowRowBytes(symbol string) int64 {
+	var size int64
+	for _, col := range webArrowColumns {
+		if col.typeType == 5 {
+			size += 4 + int64(len(symbol))
+			continue
+		}
+		size += int64(col.bitWidth / 8)
+	}
+	return size
+}
+
+func webNewExportEstimate(rows int64, symbol string) webExportEstimate {
+	e := webExportEstimate{
+		Rows:         rows,
+		Bytes:        rows * webArrowRowBytes(symbol),
+		ConfirmBytes: webExportConfirmBytes,
+		MaxBytes:     webExportMaxBytes,
+	}
+	e.TooLarge = webExportMaxBytes > 0 && e.Bytes > webExportMaxBytes
+	e.NeedsConfirm = !e.TooLarge && webExportConfirmBytes > 0 && e.Bytes > webExportConfirmBytes
+	return e
+}
+
+// 超过上限或需要确认而请求没有带 confirm=1 时返回对应的状态码和提示，可以继续时 status 为0；action 为"导出"或"加载"
+func (e webExportEstimate) refusal(action string, confirmed bool) (status int, msg string) {
+	size := fmt.Sprintf("%d 行、约 %.1f MB", e.Rows, float64(e.Bytes)/(1<<20))
+	switch {
+	case e.TooLarge:
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("预计%s %s，超过上限 %.1f MB (-export-max-bytes)，请缩小时间范围后重试",
+			action, size, float64(e.MaxBytes)/(1<<20))
+	case e.NeedsConfirm && !confirmed:
+		return http.StatusConflict, fmt.Sprintf("预计%s %s，超过 %.1f MB，确认后带 confirm=1 重新请求",
+			action, size, float64(e.ConfirmBytes)/(1<<20))
+	}
+	return 0, ""
+}
+
+// 整个合约的原始数据（range=all）可能有几GB：数据集不在缓存中时先用 count() 预估，
+// 与Arrow导出使用同样的确认和上限。其他范围有明确的起止时间，不需要预估，返回nil
+func webEstimateRawRange(ctx context.Context, key webDatasetKey) (*webExportEstimate, error) {
+	if key.rangeSpec != "all" || webDatasetCached(key) {
+		return nil, nil
+	}
+	rows, err := webCountDataset(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	estimate := webNewExportEstimate(rows, key.symbol)
+	return &estimate, nil
+}
+
+// 拒绝加载原始数据范围：返回提示和预估，页面据 estimate.needs_confirm 询问后带 confirm=1 重新请求
+func webRawRangeDeny(w http.ResponseWriter, status int, msg string, estimate *webExportEstimate) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg, "estimate": estimate})
+}
+
+// 用 count() 统计数据集的行数，数据源与 webFetchDataset 相同（宽范围时为分钟线表），不传输数据本身
+func webCountDataset(ctx context.Context, key webDatasetKey) (int64, error) {
+	if webDemoMode() {
+		data, err := webFetchDataset(ctx, key)
+		return int64(len(data)), err
+	}
+	if err := webCheckCatalog(ctx, key.table, key.symbol); err != nil {
+		return 0, err
+	}
+
+	var q *webQuery
+	if day, ok, err := webParseSessionRange(key.rangeSpec); ok {
+		if err != nil {
+			return 0, err
+		}
+		from, to := webSessionBounds(day)
+		q = webSelect(ctx, "count()").FromBars(key.table, to.Sub(from)).Symbol(key.symbol).TimeRange(from, to)
+	} else {
+		span, err := webParseRelativeRange(key.rangeSpec)
+		if err != nil {
+			return 0, err
+		}
+		q = webSelect(ctx, "count()").FromBars(key.table, span).Symbol(key.symbol)
+		if span > 0 {
+			condition, err := webTimeRangePredicate(ctx, key.table, key.symbol, span)
+			if err != nil {
+				return 0, err
+			}
+			q.Where(condition)
+		}
+	}
+	query, err := q.Build()
+	if err != nil {
+		return 0, err
+	}
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("count query failed: %w", err)
+	}
+	rows, err := strconv.ParseInt(strings.TrimSpace(result), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid count result %q: %w", strings.TrimSpace(result), err)
+	}
+	return rows, nil
+}
+
+// 导出大小预估接口：/api/v1/export/estimate 的参数与 /export.arrow 相同，页面据此提示确认或拒绝
+func webExportEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+	q := r.URL.Query()
+	if err := webValidateDatasetRange(q.Get("range")); err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("时间范围无效: %v", err))
+		return
+	}
+
+	var estimate webExportEstimate
+	if table, symbol := q.Get("table"), q.Get("symbol"); table != "" && symbol != "" {
+		rows, err := webCountDataset(webAuditContext(r), webDatasetKey{table, symbol, webNormalizeRange(q.Get("range"))})
+		if err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("预估导出大小失败: %v", err))
+			return
+		}
+		estimate = webNewExportEstimate(rows, symbol)
+	} else {
+		_, session := webGetSession(r)
+		if err := webAuthorizeDataset(r, session.key); err != nil {
+			fail(http.StatusForbidden, err.Error())
+			return
+		}
+		view, err := webGetView(webAuditContext(r), session.key)
+		if err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("查询失败: %v", err))
+			return
+		}
+		estimate = webNewExportEstimate(int64(len(view.all)), session.key.symbol)
+	}
+	json.NewEncoder(w).Encode(estimate)
+}
+
+// Arrow IPC 导出处理器，Python/R 可直接读取：
+// pyarrow.ipc.open_stream(...) / polars.read_ipc_stream(...) / arrow::read_ipc_stream(...)
+// 带 table/symbol/range 参数时重新查询完整分辨率数据，否则导出当前已加载的数据，
+// sampled=1 时导出图表上实际绘制的采样点。重新查询前先用 count() 预估大小，过大时拒绝或要求 confirm=1。
+func webExportArrowHandler(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+	symbol := r.URL.Query().Get("symbol")
+
+	if err := webValidateDatasetRange(r.URL.Query().Get("range")); err != nil {
+		http.Error(w, fmt.Sprintf("时间范围无效: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	confirmed := r.URL.Query().Get("confirm") == "1"
+	var data []WebMarketData
+	if table != "" && symbol != "" {
+		key := webDatasetKey{table, symbol, webNormalizeRange(r.URL.Query().Get("range"))}
+		rows, err := webCountDataset(webAuditContext(r), key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("预估导出大小失败: %v", err), http.StatusBadGateway)
+			return
+		}
+		if status, msg := webNewExportEstimate(rows, symbol).refusal("导出", confirmed); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		data, err = webFetchDataset(webAuditContext(r), key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询失败: %v", err), http.StatusBadGateway)
+			return
+		}
+	} else {
+		_, session := webGetSession(r)
+		if err := webAuthorizeDataset(r, session.key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		view, err := webGetView(webAuditContext(r), session.key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询失败: %v", err), http.StatusBadGateway)
+			return
+		}
+		if r.URL.Query().Get("sampled") == "1" {
+			data = view.sampled
+		} else {
+			data = view.all
+		}
+		if status, msg := webNewExportEstimate(int64(len(data)), session.key.symbol).refusal("导出", confirmed); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+	}
+
+	filename := "market_data"
+	if len(data) > 0 {
+		filename = data[0].Symbol
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.arrow.stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.arrows"`, filename))
+
+	if err := webWriteArrowStream(w, data); err != nil {
+		log.Printf("Arrow export failed: %v", err)
+		return
+	}
+	fmt.Printf("Arrow export: %d records\n", len(data))
+}
+
+// 写出完整的Arrow IPC流：Schema消息、若干RecordBatch消息和结束标记
+func webWriteArrowStream(w io.Writer, data []WebMarketData) error {
+	flusher, _ := w.(http.Flusher)
+
+	if err := webWriteArrowMessage(w, webArrowSchemaMessage(), nil); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(data); start += ARROW_BATCH_ROWS {
+		end := start + ARROW_BATCH_ROWS
+		if end > len(data) {
+			end = len(data)
+		}
+
+		meta, body := webArrowRecordBatch(data[start:end])
+		if err := webWriteArrowMessage(w, meta, body); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// 流结束标记：continuation + 0长度
+	_, err := w.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+	return err
+}
+
+// 按IPC封装格式写出一条消息：continuation标记、8字节对齐的元数据长度、元数据、消息体
+func webWriteArrowMessage(w io.Writer, meta, body []byte) error {
+	padded := (len(meta) + 8 + 7) &^ 7
+	header := make([]byte, padded)
+	binary.LittleEndian.PutUint32(header[0:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(header[4:], uint32(padded-8))
+	copy(header[8:], meta)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// Arrow 列定义，顺序与 WebMarketData 的JSON字段一致
+var webArrowColumns = []struct {
+	name     string
+	typeType byte // Type union: Int=2, FloatingPoint=3, Utf8=5, Timestamp=10
+	bitWidth int32
+	signed   bool
+}{
+	{"symbol", 5, 0, false},
+	{"time", 10, 64, true},
+	{"price", 3, 32, true},
+	{"vol", 2, 32, false},
+	{"open_interest", 2, 32, false},
+	{"diff_vol", 2, 32, true},
+	{"diff_oi", 2, 32, true},
+	{"bid_1", 3, 32, true},
+	{"bid_volumn_1", 2, 32, false},
+	{"ask_1", 3, 32, true},
+	{"ask_volumn_1", 2, 32, false},
+	{"datetime", 2, 64, false},
+}
+
+// Message.version 使用 MetadataVersion.V5
+const arrowMetadataV5 = 4
+
+func webArrowSchemaMessage() []byte {
+	b := newArrowFB()
+
+	fields := make([]int, len(webArrowColumns))
+	for i, col := range webArrowColumns {
+		name := b.createString(col.name)
+		children := b.createOffsetVector(nil)
+
+		var typeOffset int
+		switch col.typeType {
+		case 2: // Int { bitWidth, is_signed }
+			b.startTable(2)
+			b.addInt32(0, col.bitWidth)
+			b.addBool(1, col.signed)
+			typeOffset = b.endTable()
+		case 3: // FloatingPoint { precision: SINGLE }
+			b.startTable(1)
+			b.addInt16(0, 1)
+			typeOffset = b.endTable()
+		case 10: // Timestamp { unit: MILLISECOND }，时间按本地墙上时间保存，不带时区
+			b.startTable(2)
+			b.addInt16(0, 1)
+			typeOffset = b.endTable()
+		default: // Utf8 {}
+			b.startTable(0)
+			typeOffset = b.endTable()
+		}
+
+		// Field { name, nullable, type_type, type, dictionary, children }
+		b.startTable(6)
+		b.addOffset(0, name)
+		b.addOffset(3, typeOffset)
+		b.addOffset(5, children)
+		b.addBool(1, false)
+		b.addUint8(2, col.typeType)
+		fields[i] = b.endTable()
+	}
+	fieldVector := b.createOffsetVector(fields)
+
+	// Schema { endianness: Little, fields }
+	b.startTable(2)
+	b.addOffset(1, fieldVector)
+	b.addInt16(0, 0)
+	schema := b.endTable()
+
+	return b.finish(webArrowMessage(b, 1, schema, 0))
+}
+
+// 构建RecordBatch的元数据和消息体，所有列都不含空值，因此validity缓冲区长度为0
+func webArrowRecordBatch(rows []WebMarketData) ([]byte, []byte) {
+	var body []byte
+	var buffers [][2]int64
+
+	appendBuffer := func(p []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(p))})
+		body = append(body, p...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	n := len(rows)
+	for _, col := range webArrowColumns {
+		appendBuffer(nil) // validity
+
+		switch col.name {
+		case "symbol":
+			offsets := make([]byte, 4*(n+1))
+			var values []byte
+			for i, row := range rows {
+				values = append(values, row.Symbol...)
+				binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(values)))
+			}
+			appendBuffer(offsets)
+			appendBuffer(values)
+			continue
+		}
+
+		values := make([]byte, n*int(col.bitWidth/8))
+		for i, row := range rows {
+			switch col.name {
+			case "time":
+				t, _ := time.Parse("2006-01-02 15:04:05", row.Time)
+				binary.LittleEndian.PutUint64(values[8*i:], uint64(t.UnixMilli()))
+			case "price":
+				binary.LittleEndian.PutUint32(values[4*i:], math.Float32bits(row.Price))
+			case "vol":
+				binary.LittleEndian.PutUint32(values[4*i:], row.Vol)
+			case "open_interest":
+				binary.LittleEndian.PutUint32(values[4*i:], row.OpenInterest)
+			case "diff_vol":
+				binary.LittleEndian.PutUint32(values[4*i:], uint32(row.DiffVol))
+			case "diff_oi":
+				binary.LittleEndian.PutUint32(values[4*i:], uint32(row.DiffOI))
+			case "bid_1":
+				binary.LittleEndian.PutUint32(values[4*i:], math.Float32bits(row.Bid1))
+			case "bid_volumn_1":
+				binary.LittleEndian.PutUint32(values[4*i:], row.BidVolumn1)
+			case "ask_1":
+				binary.LittleEndian.PutUint32(values[4*i:], math.Float32bits(row.Ask1))
+			case "ask_volumn_1":
+				binary.LittleEndian.PutUint32(values[4*i:], row.AskVolumn1)
+			case "datetime":
+				binary.LittleEndian.PutUint64(values[8*i:], row.DateTime)
+			}
+		}
+		appendBuffer(values)
+	}
+
+	nodes := make([][2]int64, len(webArrowColumns))
+	for i := range nodes {
+		nodes[i] = [2]int64{int64(n), 0}
+	}
+
+	b := newArrowFB()
+	bufferVector := b.createStructVector(buffers)
+	nodeVector := b.createStructVector(nodes)
+
+	// RecordBatch { length, nodes, buffers }
+	b.startTable(3)
+	b.addInt64(0, int64(n))
+	b.addOffset(1, nodeVector)
+	b.addOffset(2, bufferVector)
+	batch := b.endTable()
+
+	return b.finish(webArrowMessage(b, 3, batch, int64(len(body)))), body
+}
+
+// Message { version, header_type, header, bodyLength }
+func webArrowMessage(b *arrowFB, headerType byte, header int, bodyLength int64) int {
+	b.startTable(4)
+	b.addInt64(3, bodyLength)
+	b.addOffset(2, header)
+	b.addInt16(0, arrowMetadataV5)
+	b.addUint8(1, headerType)
+	return b.endTable()
+}
+
+// 最小化的FlatBuffers构建器，只实现Arrow元数据需要的部分。
+// 与官方实现一样从缓冲区尾部向前写入，偏移量以距离缓冲区末尾的字节数表示。
+type arrowFB struct {
+	buf       []byte
+	head      int
+	minAlign  int
+	vtable    []int
+	objectEnd int
+}
+
+func newArrowFB() *arrowFB {
+	b := &arrowFB{buf: make([]byte, 1024), minAlign: 1}
+	b.head = len(b.buf)
+	return b
+}
+
+func (b *arrowFB) offset() int {
+	return len(b.buf) - b.head
+}
+
+func (b *arrowFB) grow(n int) {
+	for b.head < n {
+		nb := make([]byte, len(b.buf)*2)
+		copy(nb[len(nb)-b.offset():], b.buf[b.head:])
+		b.head += len(nb) - len(b.buf)
+		b.buf = nb
+	}
+}
+
+func (b *arrowFB) put(p []byte) {
+	b.grow(len(p))
+	b.head -= len(p)
+	copy(b.buf[b.head:], p)
+}
+
+// 填充对齐，使得再写入additional字节后，下一个size字节的值是对齐的
+func (b *arrowFB) prep(size, additional int) {
+	if size > b.minAlign {
+		b.minAlign = size
+	}
+	b.put(make([]byte, (-(b.offset() + additional))&(size-1)))
+}
+
+func (b *arrowFB) prependUint8(v uint8) {
+	b.prep(1, 0)
+	b.put([]byte{v})
+}
+
+func (b *arrowFB) prependUint16(v uint16) {
+	b.prep(2, 0)
+	b.put(binary.LittleEndian.AppendUint16(nil, v))
+}
+
+func (b *arrowFB) prependUint32(v uint32) {
+	b.prep(4, 0)
+	b.put(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (b *arrowFB) prependUint64(v uint64) {
+	b.prep(8, 0)
+	b.put(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (b *arrowFB) prependUOffset(off int) {
+	b.prep(4, 0)
+	b.put(binary.LittleEndian.AppendUint32(nil, uint32(b.offset()-off+4)))
+}
+
+func (b *arrowFB) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.put([]byte{0})
+	b.put([]byte(s))
+	b.put(binary.LittleEndian.AppendUint32(nil, uint32(len(s))))
+	return b.offset()
+}
+
+func (b *arrowFB) createOffsetVector(offsets []int) int {
+	b.prep(4, 4*len(offsets))
+	for i := len(offsets) - 1; i >= 0; i-- {
+		b.prependUOffset(offsets[i])
+	}
+	b.put(binary.LittleEndian.AppendUint32(nil, uint32(len(offsets))))
+	return b.offset()
+}
+
+// 写入由两个int64组成的结构体向量 (FieldNode / Buffer)
+func (b *arrowFB) createStructVector(items [][2]int64) int {
+	b.prep(4, 16*len(items))
+	b.prep(8, 16*len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		b.prependUint64(uint64(items[i][1]))
+		b.prependUint64(uint64(items[i][0]))
+	}
+	b.put(binary.LittleEndian.AppendUint32(nil, uint32(len(items))))
+	return b.offset()
+}
+
+func (b *arrowFB) startTable(numFields int) {
+	b.vtable = make([]int, numFields)
+	b.objectEnd = b.offset()
+}
+
+func (b *arrowFB) addBool(slot int, v bool) {
+	var u uint8
+	if v {
+		u = 1
+	}
+	b.addUint8(slot, u)
+}
+
+func (b *arrowFB) addUint8(slot int, v uint8) {
+	b.prependUint8(v)
+	b.vtable[slot] = b.offset()
+}
+
+func (b *arrowFB) addInt16(slot int, v int16) {
+	b.prependUint16(uint16(v))
+	b.vtable[slot] = b.offset()
+}
+
+func (b *arrowFB) addInt32(slot int, v int32) {
+	b.prependUint32(uint32(v))
+	b.vtable[slot] = b.offset()
+}
+
+func (b *arrowFB) addInt64(slot int, v int64) {
+	b.prependUint64(uint64(v))
+	b.vtable[slot] = b.offset()
+}
+
+func (b *arrowFB) addOffset(slot int, off int) {
+	b.prependUOffset(off)
+	b.vtable[slot] = b.offset()
+}
+
+// 结束表：写入指向vtable的soffset，再在其前面写入vtable
+func (b *arrowFB) endTable() int {
+	b.prependUint32(0)
+	object := b.offset()
+
+	for i := len(b.vtable) - 1; i >= 0; i-- {
+		var fieldOffset uint16
+		if b.vtable[i] != 0 {
+			fieldOffset = uint16(object - b.vtable[i])
+		}
+		b.prependUint16(fieldOffset)
+	}
+	b.prependUint16(uint16(object - b.objectEnd))
+	b.prependUint16(uint16((len(b.vtable) + 2) * 2))
+
+	vtable := b.offset()
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-object:], uint32(vtable-object))
+	b.vtable = nil
+	return object
+}
+
+func (b *arrowFB) finish(root int) []byte {
+	b.prep(b.minAlign, 4)
+	b.prependUOffset(root)
+	return b.buf[b.head:]
+}
+
+// WebSocket 订阅推送的轮询间隔、订阅时发送的快照条数、断线续传最多补发的tick数，
+// 以及上游查询失败后的最长退避时间
+const (
+	WS_FEED_INTERVAL    = 2 * time.Second
+	WS_SNAPSHOT_TICKS   = 200
+	WS_BACKFILL_TICKS   = 20000
+	WS_FEED_MAX_BACKOFF = time.Minute
+)
+
+// 每个连接的发送队列长度（帧数）、服务端ping间隔、多久收不到任何消息（包括pong）视为断线，
+// 以及单帧写出的超时：超时说明客户端长时间不读数据，直接断开
+const (
+	WS_SEND_BUFFER   = 64
+	WS_PING_INTERVAL = 30 * time.Second
+	WS_PONG_TIMEOUT  = 75 * time.Second
+	WS_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// 客户端消息（所有分片合计）的大小上限，订阅消息只有几十字节
+const WS_MAX_MESSAGE = 1 << 20
+
+// 关闭码 (RFC 6455 7.4.1)：1002 协议错误，1009 消息过大
+const (
+	WS_CLOSE_PROTOCOL_ERROR = 1002
+	WS_CLOSE_TOO_BIG        = 1009
+)
+
+// 客户端违反协议或超出限制，读循环据此发送带关闭码的关闭帧后断开
+type webWSCloseError struct {
+	code   uint16
+	reason string
+}
+
+func (e *webWSCloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", e.code, e.reason)
+}
+
+// 一个WebSocket连接，可以同时订阅多个symbol。
+// 数据帧先进入发送队列，由 writeLoop 单独写出，慢客户端只会丢自己的帧，不会拖住广播方
+type webWSClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	remote    string
+	connected time.Time
+	user      *webACLUser // 访问控制启用时为握手请求的用户
+
+	queueMu   sync.Mutex
+	queue     []webWSFrame
+	ready     chan struct{} // 容量为1，队列有新帧时通知 writeLoop
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	lagged  atomic.Int64 // 上次通知客户端之后又丢弃的帧数
+}
+
+// 发送队列中的一帧。只有增量tick（update）可以在队列满时丢弃，丢了之后下一批tick仍然接得上，页面收到 lagged 提示；
+// 快照、补发、状态、告警和请求的回复丢了页面就无法恢复，必须送达
+type webWSFrame struct {
+	payload   []byte
+	droppable bool
+}
+
+// 所有WebSocket连接和累计计数，供 /api/v1/ws/stats 查看
+var (
+	webWSClients          = map[*webWSClient]bool{}
+	webWSClientsMutex     sync.Mutex
+	webWSFramesSent       atomic.Int64
+	webWSFramesDropped    atomic.Int64
+	webWSSlowDisconnects  atomic.Int64
+	webWSTimedOutReaders  atomic.Int64
+	webWSTotalConnections atomic.Int64
+)
+
+func newWebWSClient(conn net.Conn, reader *bufio.Reader) *webWSClient {
+	return &webWSClient{
+		conn:      conn,
+		reader:    reader,
+		remote:    conn.RemoteAddr().String(),
+		connected: time.Now(),
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// 按 表+symbol 共享的数据源：同一个合约无论有多少个订阅者，每个周期只查询一次ClickHouse
+type webSymbolFeed struct {
+	table        string
+	symbol       string
+	lastTime     string
+	lastDateTime uint64
+	clients      map[*webWSClient]bool
+
+	// 上游查询连续失败次数、下次重试时间和累计恢复次数；
+	// 游标在失败期间保持不变，恢复后的第一次查询即补齐断线期间的数据
+	failures   int
+	retryAt    time.Time
+	reconnects int
+
+	// -imbalance-watch 或配置文件 alerts 中的常驻数据源：没有订阅者时也不删除，并对新tick运行失衡检测
+	pinned    bool
+	imbalance *webImbalanceDetector
+
+	// 上一批tick的最后价格，用于检测价位线穿越；只在数据源自己的协程里读写
+	levelPrice float64
+}
+
+// 数据源的键：不同表中的同名合约是不同的数据，权限也按表授予，不能共用一个数据源
+type webFeedKey struct {
+	table, symbol string
+}
+
+var (
+	webFeeds      = map[webFeedKey]*webSymbolFeed{}
+	webFeedsMutex sync.Mutex
+)
+
+// 订阅消息：{"sub":"jm2509"} / {"unsub":"jm2509"}，table 缺省时取symbol的字母前缀，取消订阅时需要带上订阅时的 table；
+// 断线重连时带上 since/since_datetime（客户端收到的最后一条tick），服务端从该位置补发；
+// {"replay":"房间名"} / {"leave":"房间名"} 加入或离开共享回放房间，{"link":"组名"} / {"unlink":"组名"} 加入或离开联动组
+type webWSRequest struct {
+	Sub           string `json:"sub"`
+	Unsub         string `json:"unsub"`
+	Table         string `json:"table"`
+	Since         string `json:"since"`
+	SinceDateTime uint64 `json:"since_datetime"`
+	Replay        string `json:"replay"`
+	Leave         string `json:"leave"`
+	Link          string `json:"link"`
+	Unlink        string `json:"unlink"`
+}
+
+// WebSocket处理器：完成握手后循环读取订阅/取消订阅消息
+func webWSHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := webWSUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.user = webRequestUser(r)
+	webWSClientsMutex.Lock()
+	webWSClients[client] = true
+	webWSClientsMutex.Unlock()
+	webWSTotalConnections.Add(1)
+	go client.writeLoop()
+
+	defer func() {
+		webUnsubscribeAll(client)
+		webLeaveAllReplays(client)
+		webLeaveAllRangeLinks(client)
+		webWSClientsMutex.Lock()
+		delete(webWSClients, client)
+		webWSClientsMutex.Unlock()
+		client.close()
+	}()
+
+	for {
+		// 浏览器会自动回复服务端的ping，超过 WS_PONG_TIMEOUT 没有任何消息说明连接已经失效
+		client.conn.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+		opcode, payload, err := client.readMessage()
+		if err != nil {
+			var closeErr *webWSCloseError
+			if errors.As(err, &closeErr) {
+				log.Printf("WebSocket client %s: %v", client.remote, err)
+				client.writeFrame(0x8, append(binary.BigEndian.AppendUint16(nil, closeErr.code), closeErr.reason...))
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				webWSTimedOutReaders.Add(1)
+				log.Printf("WebSocket client %s missed heartbeat for %v, closing", client.remote, WS_PONG_TIMEOUT)
+			}
+			return
+		}
+
+		switch opcode {
+		case 0x8: // close
+			client.writeFrame(0x8, nil)
+			return
+		case 0x9: // ping
+			client.writeFrame(0xA, payload)
+			continue
+		case 0xA: // pong，读超时已在上面顺延
+			continue
+		case 0x1: // text
+		default:
+			continue
+		}
+
+		var req webWSRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			client.sendJSON(map[string]interface{}{"type": "error", "error": "无效的订阅消息: " + err.Error()})
+			continue
+		}
+
+		if req.Sub != "" {
+			if err := webSubscribe(client, req.Table, req.Sub, req.Since, req.SinceDateTime); err != nil {
+				client.sendJSON(map[string]interface{}{"type": "error", "symbol": req.Sub, "error": err.Error()})
+			}
+		}
+		if req.Unsub != "" {
+			table := webUnsubscribe(client, req.Table, req.Unsub)
+			client.sendJSON(map[string]interface{}{"type": "unsubscribed", "table": table, "symbol": req.Unsub})
+		}
+		if req.Replay != "" {
+			if err := webJoinReplay(client, req.Replay); err != nil {
+				client.sendJSON(map[string]interface{}{"type": "error", "room": req.Replay, "error": err.Error()})
+			}
+		}
+		if req.Leave != "" {
+			webLeaveReplay(client, req.Leave)
+		}
+		if req.Link != "" {
+			if err := webJoinRangeLink(client, req.Link); err != nil {
+				client.sendJSON(map[string]interface{}{"type": "error", "link": req.Link, "error": err.Error()})
+			}
+		}
+		if req.Unlink != "" {
+			webLeaveRangeLink(client, req.Unlink)
+		}
+	}
+}
+
+// 按RFC 6455完成握手并接管底层连接
+func webWSUpgrade(w http.ResponseWriter, r *http.Request) (*webWSClient, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("expected websocket upgrade")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("websocket not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// 接管后的连接会保留服务器设置的读写超时，长连接需要清除
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newWebWSClient(conn, rw.Reader), nil
+}
+
+// 读取一条完整消息，合并分片帧；控制帧直接返回
+func (c *webWSClient) readMessage() (byte, []byte, error) {
+	var message []byte
+	var messageOpcode byte
+
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		// 客户端发出的帧必须掩码 (RFC 6455 5.1)
+		if !masked {
+			return 0, nil, &webWSCloseError{WS_CLOSE_PROTOCOL_ERROR, "client frames must be masked"}
+		}
+
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		// 控制帧最长125字节；数据帧的分片累加到 message 中，按整条消息的大小限制，而不只是单帧
+		if opcode >= 0x8 && length > 125 {
+			return 0, nil, &webWSCloseError{WS_CLOSE_PROTOCOL_ERROR, "control frame too long"}
+		}
+		if opcode < 0x8 && length > uint64(WS_MAX_MESSAGE-len(message)) {
+			return 0, nil, &webWSCloseError{WS_CLOSE_TOO_BIG, fmt.Sprintf("message exceeds %d bytes", WS_MAX_MESSAGE)}
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		if opcode >= 0x8 {
+			return opcode, payload, nil
+		}
+		if opcode != 0 {
+			messageOpcode = opcode
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+// 写出一个未掩码的服务端帧
+func (c *webWSClient) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// 把必须送达的一帧放入发送队列，不会阻塞。队列已满时先丢弃最旧的增量tick帧；
+// 队列里全是必须送达的帧时说明客户端已经跟不上，断开连接，页面重连后从最后收到的tick续传。连接已关闭时返回错误
+func (c *webWSClient) sendJSON(v interface{}) error {
+	return c.enqueue(v, false)
+}
+
+// 把增量tick帧放入发送队列：队列已满时丢弃最旧的增量帧，给最新的数据让位
+func (c *webWSClient) sendUpdate(v interface{}) error {
+	return c.enqueue(v, true)
+}
+
+func (c *webWSClient) enqueue(v interface{}, droppable bool) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.queueMu.Lock()
+	select {
+	case <-c.done:
+		c.queueMu.Unlock()
+		return net.ErrClosed
+	default:
+	}
+	if len(c.queue) >= WS_SEND_BUFFER {
+		oldest := -1
+		for i, frame := range c.queue {
+			if frame.droppable {
+				oldest = i
+				break
+			}
+		}
+		switch {
+		case oldest >= 0:
+			c.queue = append(c.queue[:oldest], c.queue[oldest+1:]...)
+		case droppable:
+			// 队列里全是必须送达的帧，丢弃这一帧增量数据
+			c.queueMu.Unlock()
+			c.recordDrop()
+			return nil
+		default:
+			c.queueMu.Unlock()
+			webWSSlowDisconnects.Add(1)
+			log.Printf("WebSocket client %s has %d undelivered frames, closing", c.remote, WS_SEND_BUFFER)
+			c.close()
+			return fmt.Errorf("发送队列已满（%d帧），连接已断开", WS_SEND_BUFFER)
+		}
+		c.recordDrop()
+	}
+	c.queue = append(c.queue, webWSFrame{payload: payload, droppable: droppable})
+	c.queueMu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *webWSClient) recordDrop() {
+	c.dropped.Add(1)
+	c.lagged.Add(1)
+	webWSFramesDropped.Add(1)
+}
+
+// 取出队首的帧，同时返回取出后队列中剩余的帧数；队列为空时返回 nil
+func (c *webWSClient) next() ([]byte, int) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if len(c.queue) == 0 {
+		return nil, 0
+	}
+	frame := c.queue[0]
+	c.queue = c.queue[1:]
+	return frame.payload, len(c.queue)
+}
+
+func (c *webWSClient) queued() int {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return len(c.queue)
+}
+
+// 依次写出发送队列中的帧，并定期发送ping；队列清空后如果期间丢过帧，
+// 补发一条 {"type":"lagged"} 通知，页面据此提示数据可能不连续
+func (c *webWSClient) writeLoop() {
+	ping := time.NewTicker(WS_PING_INTERVAL)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case <-c.ready:
+			for err == nil {
+				payload, remaining := c.next()
+				if payload == nil {
+					break
+				}
+				if err = c.writeFrame(0x1, payload); err != nil {
+					break
+				}
+				c.sent.Add(1)
+				webWSFramesSent.Add(1)
+				if remaining == 0 {
+					if n := c.lagged.Swap(0); n > 0 {
+						notice, _ := json.Marshal(map[string]interface{}{"type": "lagged", "dropped": n, "total_dropped": c.dropped.Load()})
+						err = c.writeFrame(0x1, notice)
+					}
+				}
+			}
+		case <-ping.C:
+			err = c.writeFrame(0x9, nil)
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				webWSSlowDisconnects.Add(1)
+				log.Printf("WebSocket client %s stopped reading for %v, closing", c.remote, WS_WRITE_TIMEOUT)
+			}
+			c.close()
+			return
+		}
+	}
+}
+
+// 关闭连接并停止 writeLoop，可重复调用；读循环随之出错退出并清理订阅
+func (c *webWSClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// WebSocket连接统计：当前连接及每个连接的队列长度、已发送和丢弃的帧数，以及累计计数。
+// 包含各连接的远端地址，只对管理员开放
+func webWSStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := webRequireAdmin(r, "WebSocket连接统计"); err != nil {
+		webACLDeny(w, http.StatusForbidden, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	webWSClientsMutex.Lock()
+	clients := make([]map[string]interface{}, 0, len(webWSClients))
+	for c := range webWSClients {
+		clients = append(clients, map[string]interface{}{
+			"remote":    c.remote,
+			"connected": c.connected.Format("2006-01-02 15:04:05"),
+			"queued":    c.queued(),
+			"sent":      c.sent.Load(),
+			"dropped":   c.dropped.Load(),
+		})
+	}
+	webWSClientsMutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i]["connected"].(string) < clients[j]["connected"].(string)
+	})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connections":        len(clients),
+		"total_connections":  webWSTotalConnections.Load(),
+		"frames_sent":        webWSFramesSent.Load(),
+		"frames_dropped":     webWSFramesDropped.Load(),
+		"slow_disconnects":   webWSSlowDisconnects.Load(),
+		"heartbeat_timeouts": webWSTimedOutReaders.Load(),
+		"send_buffer":        WS_SEND_BUFFER,
+		"clients":            clients,
+	})
+}
+
+// 订阅symbol：先发送最近的快照（或从 since 开始的补发数据），之后由 webFeedLoop 推送增量数据
+func webSubscribe(client *webWSClient, table, symbol, since string, sinceDateTime uint64) error {
+	if table == "" {
+		table = strings.TrimRight(symbol, "0123456789")
+	}
+	if !webIsIdentifier(table) {
+		return fmt.Errorf("无效的表名: %q", table)
+	}
+	if !client.user.allows(table, symbol) {
+		return client.user.denied(table, symbol)
+	}
+
+	frameType := "snapshot"
+	truncated := false
+	if since != "" {
+		if _, err := time.Parse("2006-01-02 15:04:05", since); err != nil {
+			return fmt.Errorf("无效的续传位置 %q，格式应为 YYYY-MM-DD HH:MM:SS", since)
+		}
+		frameType = "backfill"
+	}
+
+	ticks, err := webQueryFeedTicks(webWithUser(context.Background(), client.user), table, symbol, since, sinceDateTime)
+	if err != nil {
+		return fmt.Errorf("订阅 %s 失败: %w", symbol, err)
+	}
+	if len(ticks) > WS_BACKFILL_TICKS {
+		ticks = ticks[len(ticks)-WS_BACKFILL_TICKS:]
+		truncated = true
+	}
+
+	webFeedsMutex.Lock()
+	key := webFeedKey{table, symbol}
+	feed, ok := webFeeds[key]
+	if !ok {
+		feed = &webSymbolFeed{table: table, symbol: symbol, clients: map[*webWSClient]bool{}}
+		if len(ticks) > 0 {
+			last := ticks[len(ticks)-1]
+			feed.lastTime, feed.lastDateTime = last.Time, last.DateTime
+		} else if since != "" {
+			feed.lastTime, feed.lastDateTime = since, sinceDateTime
+		}
+		webFeeds[key] = feed
+	}
+	feed.clients[client] = true
+	reconnects := feed.reconnects
+	webFeedsMutex.Unlock()
+
+	return client.sendJSON(map[string]interface{}{
+		"type":       frameType,
+		"table":      table,
+		"symbol":     symbol,
+		"data":       ticks,
+		"truncated":  truncated,
+		"reconnects": reconnects,
+	})
+}
+
+// 向某个symbol的所有订阅者发送一帧；发送只是放入各连接的队列，慢客户端不会拖住其他订阅者
+func (feed *webSymbolFeed) broadcast(frame map[string]interface{}) {
+	for _, client := range feed.subscribers() {
+		if err := client.sendJSON(frame); err != nil {
+			client.close()
+		}
+	}
+}
+
+// 向所有订阅者推送增量tick，慢客户端的队列满时丢弃最旧的增量帧
+func (feed *webSymbolFeed) broadcastUpdate(ticks []WebMarketData) {
+	frame := map[string]interface{}{
+		"type":   "update",
+		"table":  feed.table,
+		"symbol": feed.symbol,
+		"data":   ticks,
+	}
+	for _, client := range feed.subscribers() {
+		if err := client.sendUpdate(frame); err != nil {
+			client.close()
+		}
+	}
+}
+
+func (feed *webSymbolFeed) subscribers() []*webWSClient {
+	webFeedsMutex.Lock()
+	defer webFeedsMutex.Unlock()
+	clients := make([]*webWSClient, 0, len(feed.clients))
+	for client := range feed.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// 上游查询失败后的退避时间：从轮询间隔开始逐次翻倍，不超过 WS_FEED_MAX_BACKOFF
+func webFeedBackoff(failures int) time.Duration {
+	delay := WS_FEED_INTERVAL
+	for i := 1; i < failures && delay < WS_FEED_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > WS_FEED_MAX_BACKOFF {
+		delay = WS_FEED_MAX_BACKOFF
+	}
+	return delay
+}
+
+// 取消订阅 table 中的 symbol，table 的缺省值与订阅时相同；返回实际使用的表名
+func webUnsubscribe(client *webWSClient, table, symbol string) string {
+	if table == "" {
+		table = strings.TrimRight(symbol, "0123456789")
+	}
+	webFeedsMutex.Lock()
+	defer webFeedsMutex.Unlock()
+
+	key := webFeedKey{table, symbol}
+	if feed, ok := webFeeds[key]; ok {
+		delete(feed.clients, client)
+		if len(feed.clients) == 0 && !feed.pinned {
+			delete(webFeeds, key)
+		}
+	}
+	return table
+}
+
+func webUnsubscribeAll(client *webWSClient) {
+	webFeedsMutex.Lock()
+	defer webFeedsMutex.Unlock()
+
+	for key, feed := range webFeeds {
+		delete(feed.clients, client)
+		if len(feed.clients) == 0 && !feed.pinned {
+			delete(webFeeds, key)
+		}
+	}
+}
+
+// 定期为每个有订阅者的symbol查询新数据，并按订阅关系分发更新帧
+func webFeedLoop() {
+	ticker := time.NewTicker(WS_FEED_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		webFeedsMutex.Lock()
+		feeds := make([]*webSymbolFeed, 0, len(webFeeds))
+		for _, feed := range webFeeds {
+			feeds = append(feeds, feed)
+		}
+		webFeedsMutex.Unlock()
+
+		now := time.Now()
+		for _, feed := range feeds {
+			webFeedsMutex.Lock()
+			lastTime, lastDateTime := feed.lastTime, feed.lastDateTime
+			waiting := now.Before(feed.retryAt)
+			webFeedsMutex.Unlock()
+			if waiting {
+				continue
+			}
+
+			ticks, err := webQueryFeedTicks(context.Background(), feed.table, feed.symbol, lastTime, lastDateTime)
+			if err != nil {
+				webFeedsMutex.Lock()
+				feed.failures++
+				delay := webFeedBackoff(feed.failures)
+				feed.retryAt = now.Add(delay)
+				failures, reconnects := feed.failures, feed.reconnects
+				webFeedsMutex.Unlock()
+
+				log.Printf("Feed update for %s failed (attempt %d, retry in %v): %v", feed.symbol, failures, delay, err)
+				feed.broadcast(map[string]interface{}{
+					"type":       "status",
+					"table":      feed.table,
+					"symbol":     feed.symbol,
+					"state":      "reconnecting",
+					"error":      err.Error(),
+					"failures":   failures,
+					"retry_in":   delay.Seconds(),
+					"reconnects": reconnects,
+				})
+				continue
+			}
+
+			webFeedsMutex.Lock()
+			recovered := feed.failures > 0
+			if recovered {
+				feed.failures = 0
+				feed.retryAt = time.Time{}
+				feed.reconnects++
+			}
+			reconnects := feed.reconnects
+			imbalance := feed.imbalance
+			if len(ticks) > 0 {
+				last := ticks[len(ticks)-1]
+				feed.lastTime, feed.lastDateTime = last.Time, last.DateTime
+			}
+			webFeedsMutex.Unlock()
+
+			if recovered {
+				log.Printf("Feed for %s recovered, backfilled %d ticks", feed.symbol, len(ticks))
+				feed.broadcast(map[string]interface{}{
+					"type":       "status",
+					"table":      feed.table,
+					"symbol":     feed.symbol,
+					"state":      "live",
+					"backfilled": len(ticks),
+					"reconnects": reconnects,
+				})
+			}
+			if len(ticks) == 0 {
+				continue
+			}
+			if imbalance != nil {
+				webCheckImbalance(feed, imbalance, ticks)
+			}
+			webCheckLevels(feed, ticks)
+
+			feed.broadcastUpdate(ticks)
+		}
+	}
+}
+
+// 查询 (lastTime, lastDateTime) 之后的新tick；lastTime 为空时返回最近的快照
+func webQueryFeedTicks(ctx context.Context, table, symbol, lastTime string, lastDateTime uint64) ([]WebMarketData, error) {
+	if webDemoMode() {
+		return webDemoFeedTicks(symbol, lastTime, lastDateTime)
+	}
+	if err := webCheckCatalog(ctx, table, symbol); err != nil {
+		return nil, err
+	}
+	var q *webQuery
+	if lastTime == "" {
+		latest := webSelect(ctx, webMarketDataColumns...).
+			From(table).
+			Symbol(symbol).
+			OrderBy("time DESC", "datetime DESC").
+			Limit(WS_SNAPSHOT_TICKS)
+		q = webSelect(ctx, "*").FromSubquery(latest)
+	} else {
+		q = webSelect(ctx, webMarketDataColumns...).
+			From(table).
+			Symbol(symbol).
+			Where(fmt.Sprintf("(time, datetime) > (toDateTime(%s), %d)", webQuoteString(lastTime), lastDateTime))
+	}
+	query, err := q.OrderBy("time ASC", "datetime ASC").Format(webResultFormat()).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := webExecuteQueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return webParseMarketData(result)
+}
+
+// 盘口失衡告警的默认参数；事故目录中最多列出最近 INCIDENTS_MAX_LIST 条
+const (
+	IMBALANCE_DEFAULT_THRESHOLD = 0.6
+	IMBALANCE_DEFAULT_TICKS     = 5
+	INCIDENT_DEFAULT_WINDOW     = 2 * time.Minute
+	INCIDENTS_MAX_LIST          = 200
+)
+
+var (
+	// 买一/卖一挂单量失衡 |bid-ask|/(bid+ask) 的告警阈值，以及需要连续超过阈值的tick数
+	webImbalanceThreshold float64
+	webImbalanceTicks     int
+	// 告警快照的保存目录和触发点前后截取的时间窗口
+	webIncidentsDir   string
+	webIncidentWindow time.Duration
+)
+
+// 盘口失衡：(买一量-卖一量)/(买一量+卖一量)，取值 [-1, 1]，正数表示买盘占优；双边都没有挂单时无意义
+func webBookImbalance(md WebMarketData) (float64, bool) {
+	total := float64(md.BidVolumn1) + float64(md.AskVolumn1)
+	if total == 0 {
+		return 0, false
+	}
+	return (float64(md.BidVolumn1) - float64(md.AskVolumn1)) / total, true
+}
+
+// 按tick顺序检测同一方向的失衡连续 ticks 笔超过阈值；触发一次后，失衡回落到阈值以内或换边才重新计数，
+// 持续失衡期间不会每笔都告警
+type webImbalanceDetector struct {
+	threshold float64
+	ticks     int
+
+	run   int // 当前方向连续超过阈值的笔数
+	side  int // 1 买盘占优，-1 卖盘占优，0 未失衡
+	fired bool
+}
+
+func (d *webImbalanceDetector) observe(md WebMarketData) (float64, bool) {
+	imbalance, ok := webBookImbalance(md)
+	if !ok || math.Abs(imbalance) < d.threshold {
+		d.run, d.side, d.fired = 0, 0, false
+		return imbalance, false
+	}
+	side := 1
+	if imbalance < 0 {
+		side = -1
+	}
+	if side != d.side {
+		d.run, d.side, d.fired = 0, side, false
+	}
+	d.run++
+	if d.run >= d.ticks && !d.fired {
+		d.fired = true
+		return imbalance, true
+	}
+	return imbalance, false
+}
+
+// 一次失衡告警，保存为事故目录下的 incident.json
+type webIncident struct {
+	ID        string   `json:"id"`
+	Table     string   `json:"table"`
+	Symbol    string   `json:"symbol"`
+	Time      string   `json:"time"`
+	Kind      string   `json:"kind,omitempty"` // 空为失衡告警，"level" 为价位线穿越
+	Side      string   `json:"side"`
+	Level     float64  `json:"level,omitempty"`
+	Label     string   `json:"label,omitempty"`
+	Imbalance float64  `json:"imbalance"`
+	Threshold float64  `json:"threshold"`
+	Ticks     int      `json:"ticks"`
+	Price     float32  `json:"price"`
+	BidVolume uint32   `json:"bid_volumn_1"`
+	AskVolume uint32   `json:"ask_volumn_1"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Rows      int      `json:"rows"`
+	Files     []string `json:"files"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// 为 -imbalance-watch 中的合约创建常驻数据源：没有页面订阅时也按 WS_FEED_INTERVAL 轮询新tick并检测失衡。
+// 先取一次最新位置作为游标，历史快照不参与检测，避免启动时对旧数据告警。
+// 阈值和tick数可以通过 -config 热加载修改，读写都在 webFeedsMutex 下进行
+func webWatchImbalance(key webDatasetKey) {
+	feed := &webSymbolFeed{
+		table:   key.table,
+		symbol:  key.symbol,
+		clients: map[*webWSClient]bool{},
+		pinned:  true,
+	}
+	if ticks, err := webQueryFeedTicks(context.Background(), key.table, key.symbol, "", 0); err != nil {
+		log.Printf("Imbalance watch for %s: initial query failed, starting from the latest snapshot: %v", key.symbol, err)
+	} else if len(ticks) > 0 {
+		last := ticks[len(ticks)-1]
+		feed.lastTime, feed.lastDateTime = last.Time, last.DateTime
+	}
+
+	webFeedsMutex.Lock()
+	detector := &webImbalanceDetector{
+		threshold: webImbalanceThreshold,
+		ticks:     webImbalanceTicks,
+	}
+	if existing, ok := webFeeds[webFeedKey{key.table, key.symbol}]; ok {
+		existing.pinned = true
+		existing.imbalance = detector
+	} else {
+		feed.imbalance = detector
+		webFeeds[webFeedKey{key.table, key.symbol}] = feed
+	}
+	webFeedsMutex.Unlock()
+	log.Printf("Watching %s/%s for book imbalance >= %.2f over %d ticks, incidents saved to %s",
+		key.table, key.symbol, detector.threshold, detector.ticks, webIncidentsDir)
+}
+
+// 在数据源的新tick上运行失衡检测：触发时记录日志、向该symbol的订阅者推送告警帧，
+// 等待触发点之后的窗口走完再截取前后数据保存快照
+func webCheckImbalance(feed *webSymbolFeed, detector *webImbalanceDetector, ticks []WebMarketData) {
+	for _, tick := range ticks {
+		imbalance, fired := detector.observe(tick)
+		if !fired {
+			continue
+		}
+		side := "bid"
+		if imbalance < 0 {
+			side = "ask"
+		}
+		incident := webIncident{
+			ID:        fmt.Sprintf("%s_%s_%d", feed.symbol, strings.NewReplacer("-", "", ":", "", " ", "_").Replace(tick.Time), tick.DateTime),
+			Table:     feed.table,
+			Symbol:    feed.symbol,
+			Time:      tick.Time,
+			Side:      side,
+			Imbalance: imbalance,
+			Threshold: detector.threshold,
+			Ticks:     detector.ticks,
+			Price:     tick.Price,
+			BidVolume: tick.BidVolumn1,
+			AskVolume: tick.AskVolumn1,
+		}
+		log.Printf("Book imbalance alert %s: %s side %.2f for %d ticks at %s (bid %d / ask %d)",
+			incident.ID, side, imbalance, incident.Ticks, tick.Time, tick.BidVolumn1, tick.AskVolumn1)
+		feed.broadcast(map[string]interface{}{
+			"type":     "alert",
+			"symbol":   feed.symbol,
+			"incident": incident,
+		})
+		time.AfterFunc(webIncidentWindow, func() {
+			if err := webCaptureIncident(incident); err != nil {
+				log.Printf("Failed to capture incident %s: %v", incident.ID, err)
+			}
+		})
+	}
+}
+
+// 检测新tick是否穿越该symbol的价位线：价格从线的一侧到达或越过另一侧时告警一次，
+// 告警的推送和快照保存与失衡告警相同。数据源的第一批tick只记录起点，历史快照不触发告警
+func webCheckLevels(feed *webSymbolFeed, ticks []WebMarketData) {
+	if len(ticks) == 0 {
+		return
+	}
+	if feed.levelPrice == 0 {
+		feed.levelPrice = float64(ticks[len(ticks)-1].Price)
+		return
+	}
+	levels := webLevelsFor(feed.symbol)
+	for _, tick := range ticks {
+		prev, cur := feed.levelPrice, float64(tick.Price)
+		feed.levelPrice = cur
+		for _, level := range levels {
+			side := ""
+			switch {
+			case prev < level.Price && cur >= level.Price:
+				side = "up"
+			case prev > level.Price && cur <= level.Price:
+				side = "down"
+			default:
+				continue
+			}
+			incident := webIncident{
+				ID:     fmt.Sprintf("%s_level_%s_%d_%s", feed.symbol, strings.NewReplacer("-", "", ":", "", " ", "_").Replace(tick.Time), tick.DateTime, level.ID),
+				Table:  feed.table,
+				Symbol: feed.symbol,
+				Time:   tick.Time,
+				Kind:   "level",
+				Side:   side,
+				Level:  level.Price,
+				Label:  level.Label,
+				Price:  tick.Price,
+			}
+			log.Printf("Price level alert %s: %s crossed %v %s at %s (price %v)",
+				incident.ID, feed.symbol, level.Price, side, tick.Time, tick.Price)
+			feed.broadcast(map[string]interface{}{
+				"type":     "alert",
+				"symbol":   feed.symbol,
+				"incident": incident,
+			})
+			time.AfterFunc(webIncidentWindow, func() {
+				if err := webCaptureIncident(incident); err != nil {
+					log.Printf("Failed to capture incident %s: %v", incident.ID, err)
+				}
+			})
+		}
+	}
+}
+
+// 把触发点前后 webIncidentWindow 内的tick保存为 ticks.csv，并渲染 chart.png；
+// 查询失败时仍写出 incident.json（带 error 字段），告警本身不会丢失
+func webCaptureIncident(incident webIncident) error {
+	at, err := webParseWallTime(incident.Time)
+	if err != nil {
+		return err
+	}
+	from, to := at.Add(-webIncidentWindow), at.Add(webIncidentWindow)
+	incident.From = from.Format("2006-01-02 15:04:05")
+	incident.To = to.Format("2006-01-02 15:04:05")
+
+	dir := filepath.Join(webIncidentsDir, incident.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create incident directory: %w", err)
+	}
+
+	data, err := webQueryMarketDataBetween(context.Background(), incident.Table, incident.Symbol, from, to)
+	if err != nil {
+		incident.Error = err.Error()
+	} else {
+		incident.Rows = len(data)
+		if err := webWriteIncidentCSV(filepath.Join(dir, "ticks.csv"), data); err != nil {
+			incident.Error = err.Error()
+		} else {
+			incident.Files = append(incident.Files, "ticks.csv")
+		}
+		if len(data) >= 2 {
+			if err := webWriteIncidentPNG(filepath.Join(dir, "chart.png"), incident, at, data); err != nil {
+				incident.Error = err.Error()
+			} else {
+				incident.Files = append(incident.Files, "chart.png")
+			}
+		}
+	}
+
+	meta, err := json.MarshalIndent(incident, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "incident.json"), meta, 0644); err != nil {
+		return fmt.Errorf("failed to write incident.json: %w", err)
+	}
+	log.Printf("Captured incident %s: %d ticks in %s", incident.ID, incident.Rows, dir)
+	return nil
+}
+
+func webWriteIncidentCSV(path string, data []WebMarketData) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"symbol", "time", "price", "vol", "open_interest", "diff_vol", "diff_oi",
+		"bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "datetime", "imbalance"})
+	for _, record := range data {
+		imbalance := ""
+		if v, ok := webBookImbalance(record); ok {
+			imbalance = strconv.FormatFloat(v, 'f', 4, 64)
+		}
+		w.Write([]string{
+			record.Symbol,
+			record.Time,
+			strconv.FormatFloat(float64(record.Price), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.Vol), 10),
+			strconv.FormatUint(uint64(record.OpenInterest), 10),
+			strconv.FormatInt(int64(record.DiffVol), 10),
+			strconv.FormatInt(int64(record.DiffOI), 10),
+			strconv.FormatFloat(float64(record.Bid1), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.BidVolumn1), 10),
+			strconv.FormatFloat(float64(record.Ask1), 'f', -1, 32),
+			strconv.FormatUint(uint64(record.AskVolumn1), 10),
+			strconv.FormatUint(record.DateTime, 10),
+			imbalance,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// 事故快照图：价格/持仓量双轴图，在触发时刻的价格上标注失衡方向和数值
+func webWriteIncidentPNG(path string, incident webIncident, at time.Time, data []WebMarketData) error {
+	graph, _, _ := webBuildPriceChart(data, webChartOptions{
+		series:  "price",
+		yRange:  webYRange{math.NaN(), math.NaN()},
+		padding: webAxisPadding,
+		width:   SNAPSHOT_DEFAULT_WIDTH,
+		height:  SNAPSHOT_DEFAULT_HEIGHT,
+		levels:  webLevelsFor(incident.Symbol),
+	})
+	graph.Title = fmt.Sprintf("%s imbalance %s %.2f (>= %.2f x %d ticks)  %s ~ %s",
+		strings.ToUpper(incident.Symbol), incident.Side, incident.Imbalance, incident.Threshold, incident.Ticks,
+		data[0].Time, data[len(data)-1].Time)
+	label := fmt.Sprintf("%s %.2f", incident.Side, incident.Imbalance)
+	if incident.Kind == "level" {
+		level := webNumbers.Format(incident.Level, "price")
+		graph.Title = fmt.Sprintf("%s crossed level %s %s  %s ~ %s",
+			strings.ToUpper(incident.Symbol), level, incident.Side, data[0].Time, data[len(data)-1].Time)
+		label = fmt.Sprintf("%s %s", incident.Side, level)
+	}
+	graph.XAxis.ValueFormatter = chart.TimeValueFormatterWithFormat("15:04:05")
+	graph.Series = append(graph.Series, chart.AnnotationSeries{
+		Annotations: []chart.Value2{{
+			XValue: chart.TimeToFloat64(at),
+			YValue: float64(incident.Price),
+			Label:  label,
+		}},
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := graph.Render(chart.PNG, f); err != nil {
+		return fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// 事故列表：GET /api/v1/incidents 读取事故目录下各快照的 incident.json，按触发时间倒序返回，只包含用户有权访问的合约；
+// 快照文件本身通过 /incidents/<id>/ticks.csv、/incidents/<id>/chart.png 访问
+func webIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	all, err := webListIncidents()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	user := webRequestUser(r)
+	incidents := []webIncident{}
+	for _, incident := range all {
+		if user.allows(incident.Table, incident.Symbol) {
+			incidents = append(incidents, incident)
+		}
+	}
+	if len(incidents) > INCIDENTS_MAX_LIST {
+		incidents = incidents[:INCIDENTS_MAX_LIST]
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dir":       webIncidentsDir,
+		"threshold": webImbalanceThreshold,
+		"ticks":     webImbalanceTicks,
+		"incidents": incidents,
+	})
+}
+
+// 快照文件：/incidents/<id>/<文件名>。先按快照的 incident.json 检查用户能否访问该合约，再读取文件，不列出目录
+func webIncidentFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/incidents/"), "/")
+	for _, part := range []string{id, name} {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	dir := filepath.Join(webIncidentsDir, id)
+	meta, err := os.ReadFile(filepath.Join(dir, "incident.json"))
+	var incident webIncident
+	if err != nil || json.Unmarshal(meta, &incident) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if u := webRequestUser(r); !u.allows(incident.Table, incident.Symbol) {
+		webACLDeny(w, http.StatusForbidden, u.denied(incident.Table, incident.Symbol).Error())
+		return
+	}
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// 读取事故目录下所有快照的 incident.json，按触发时间倒序；目录不存在时返回空列表
+func webListIncidents() ([]webIncident, error) {
+	entries, err := os.ReadDir(webIncidentsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	incidents := []webIncident{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		meta, err := os.ReadFile(filepath.Join(webIncidentsDir, entry.Name(), "incident.json"))
+		if err != nil {
+			continue
+		}
+		var incident webIncident
+		if json.Unmarshal(meta, &incident) == nil {
+			incidents = append(incidents, incident)
+		}
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].Time > incidents[j].Time
+	})
+	return incidents, nil
+}
+
+// 告警快照的保留策略 (-incident-retention)：按合约保留最近 Days 天、最多 MaxBytes 字节的快照，0 表示不限制。
+// 长期运行的监控会不断写入快照，后台每 -incident-prune-interval 按策略从最早的快照开始删除
+type webRetentionPolicy struct {
+	Days     int   `json:"days,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// 一次清理的结果，GET /api/v1/incidents/usage 中的 last_prune
+type webIncidentPruneResult struct {
+	Time    string `json:"time"`
+	Removed int    `json:"removed"`
+	Bytes   int64  `json:"bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// 某个合约的快照占用的磁盘空间
+type webIncidentUsage struct {
+	Symbol    string              `json:"symbol"`
+	Incidents int                 `json:"incidents"`
+	Bytes     int64               `json:"bytes"`
+	Oldest    string              `json:"oldest"`
+	Newest    string              `json:"newest"`
+	Policy    *webRetentionPolicy `json:"policy,omitempty"`
+}
+
+// 快照目录：按 incident.json 的写入时间计算保存时长，还没写完 incident.json 的目录不参与统计和清理
+type webIncidentEntry struct {
+	dir    string
+	table  string
+	symbol string
+	saved  time.Time
+	bytes  int64
+}
+
+const INCIDENT_DEFAULT_PRUNE_INTERVAL = 10 * time.Minute
+
+var (
+	// 键为小写的symbol，"*" 为没有单独配置的合约
+	webIncidentRetention     = map[string]webRetentionPolicy{}
+	webIncidentPruneInterval time.Duration
+	webIncidentPruneMutex    sync.Mutex
+	webIncidentLastPrune     *webIncidentPruneResult
+)
+
+// 解析 -incident-retention：*=30d,jm2509=7d/500MB，右边为保留天数 (Nd) 和/或容量 (KB/MB/GB)，用 / 分隔
+func webParseRetention(list string) (map[string]webRetentionPolicy, error) {
+	policies := map[string]webRetentionPolicy{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		symbol, rules, ok := strings.Cut(item, "=")
+		symbol = strings.ToLower(strings.TrimSpace(symbol))
+		if !ok || symbol == "" || strings.TrimSpace(rules) == "" {
+			return nil, fmt.Errorf("invalid incident retention %q, expected symbol=7d, symbol=500MB or symbol=7d/500MB", item)
+		}
+		var policy webRetentionPolicy
+		for _, rule := range strings.Split(rules, "/") {
+			rule = strings.ToUpper(strings.TrimSpace(rule))
+			if days, ok := strings.CutSuffix(rule, "D"); ok && policy.Days == 0 {
+				if n, err := strconv.Atoi(days); err == nil && n > 0 {
+					policy.Days = n
+					continue
+				}
+			}
+			if size, ok := webParseByteSize(rule); ok && policy.MaxBytes == 0 {
+				policy.MaxBytes = size
+				continue
+			}
+			return nil, fmt.Errorf("invalid incident retention %q: %q is not a day count (7d) or size (500MB)", item, rule)
+		}
+		policies[symbol] = policy
+	}
+	return policies, nil
+}
+
+// 解析 512KB、500MB、2GB 这样的容量
+func webParseByteSize(s string) (int64, bool) {
+	for _, unit := range []struct {
+		suffix string
+		scale  int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}} {
+		if digits, ok := strings.CutSuffix(s, unit.suffix); ok {
+			n, err := strconv.ParseInt(digits, 10, 64)
+			if err != nil || n <= 0 {
+				return 0, false
+			}
+			return n * unit.scale, true
+		}
+	}
+	return 0, false
+}
+
+// 合约使用的保留策略：单独配置的优先，否则用 "*"
+func webRetentionFor(symbol string) (webRetentionPolicy, bool) {
+	if policy, ok := webIncidentRetention[strings.ToLower(symbol)]; ok {
+		return policy, true
+	}
+	policy, ok := webIncidentRetention["*"]
+	return policy, ok
+}
+
+// 扫描事故目录下的快照及其大小，按保存时间从早到晚排序
+func webScanIncidents() ([]webIncidentEntry, error) {
+	dirs, err := os.ReadDir(webIncidentsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var entries []webIncidentEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(webIncidentsDir, d.Name())
+		meta, err := os.ReadFile(filepath.Join(dir, "incident.json"))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, "incident.json"))
+		var incident webIncident
+		if err != nil || json.Unmarshal(meta, &incident) != nil {
+			continue
+		}
+		entry := webIncidentEntry{dir: d.Name(), table: incident.Table, symbol: incident.Symbol, saved: info.ModTime()}
+		filepath.WalkDir(dir, func(path string, f fs.DirEntry, err error) error {
+			if err == nil && !f.IsDir() {
+				if info, err := f.Info(); err == nil {
+					entry.bytes += info.Size()
+				}
+			}
+			return nil
+		})
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].saved.Before(entries[j].saved)
+	})
+	return entries, nil
+}
+
+// 按保留策略清理快照：先删除超过保留天数的，再从最早的开始删除直到该合约的总大小不超过容量
+func webPruneIncidents(now time.Time) webIncidentPruneResult {
+	webIncidentPruneMutex.Lock()
+	defer webIncidentPruneMutex.Unlock()
+
+	result := webIncidentPruneResult{Time: now.Format("2006-01-02 15:04:05")}
+	entries, err := webScanIncidents()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	bySymbol := map[string][]webIncidentEntry{}
+	for _, entry := range entries {
+		bySymbol[entry.symbol] = append(bySymbol[entry.symbol], entry)
+	}
+	for symbol, list := range bySymbol {
+		policy, ok := webRetentionFor(symbol)
+		if !ok {
+			continue
+		}
+		var total int64
+		for _, entry := range list {
+			total += entry.bytes
+		}
+		for _, entry := range list {
+			expired := policy.Days > 0 && now.Sub(entry.saved) > time.Duration(policy.Days)*24*time.Hour
+			if !expired && (policy.MaxBytes == 0 || total <= policy.MaxBytes) {
+				break
+			}
+			if err := os.RemoveAll(filepath.Join(webIncidentsDir, entry.dir)); err != nil {
+				result.Error = err.Error()
+				continue
+			}
+			total -= entry.bytes
+			result.Removed++
+			result.Bytes += entry.bytes
+		}
+	}
+	webIncidentLastPrune = &result
+	return result
+}
+
+// 后台按 -incident-prune-interval 清理快照，只在配置了 -incident-retention 时启动
+func webIncidentPruneLoop() {
+	for {
+		result := webPruneIncidents(time.Now())
+		if result.Error != "" {
+			log.Printf("Incident pruning in %s failed: %s", webIncidentsDir, result.Error)
+		}
+		if result.Removed > 0 {
+			log.Printf("Pruned %d incidents (%d bytes) from %s", result.Removed, result.Bytes, webIncidentsDir)
+		}
+		time.Sleep(webIncidentPruneInterval)
+	}
+}
+
+// 快照磁盘占用：GET /api/v1/incidents/usage 按合约返回快照个数、大小、最早/最新保存时间和生效的保留策略，
+// 只统计用户有权访问的合约；POST 立即按策略清理一次。启用访问控制时只有管理员可以清理
+func webIncidentUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if u := webRequestUser(r); u != nil && !u.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("用户 %s 无权清理告警快照", u.Name)})
+			return
+		}
+		if len(webIncidentRetention) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "未配置保留策略 (-incident-retention)"})
+			return
+		}
+		webPruneIncidents(time.Now())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "只支持GET和POST请求"})
+		return
+	}
+
+	scanned, err := webScanIncidents()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	user := webRequestUser(r)
+	var entries []webIncidentEntry
+	for _, entry := range scanned {
+		if user.allows(entry.table, entry.symbol) {
+			entries = append(entries, entry)
+		}
+	}
+	usage := map[string]*webIncidentUsage{}
+	var total int64
+	for _, entry := range entries {
+		u, ok := usage[entry.symbol]
+		if !ok {
+			u = &webIncidentUsage{Symbol: entry.symbol, Oldest: entry.saved.Format("2006-01-02 15:04:05")}
+			if policy, ok := webRetentionFor(entry.symbol); ok {
+				u.Policy = &policy
+			}
+			usage[entry.symbol] = u
+		}
+		u.Incidents++
+		u.Bytes += entry.bytes
+		u.Newest = entry.saved.Format("2006-01-02 15:04:05")
+		total += entry.bytes
+	}
+	symbols := make([]*webIncidentUsage, 0, len(usage))
+	for _, u := range usage {
+		symbols = append(symbols, u)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Bytes > symbols[j].Bytes
+	})
+
+	webIncidentPruneMutex.Lock()
+	lastPrune := webIncidentLastPrune
+	webIncidentPruneMutex.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dir":            webIncidentsDir,
+		"incidents":      len(entries),
+		"bytes":          total,
+		"symbols":        symbols,
+		"retention":      webIncidentRetention,
+		"prune_interval": webIncidentPruneInterval.String(),
+		"last_prune":     lastPrune,
+	})
+}
+
+// 表名等标识符只允许字母、数字和下划线
+func webIsIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// 共享回放：复盘时由服务端维护回放时钟，同一个回放房间里的所有页面和终端查看器通过WebSocket
+// 收到同样的时钟，各自只显示时钟之前的数据，任何人暂停、拖动或调速，所有人同步看到。
+// 房间通过 /api/v1/replay 创建和控制，客户端发送 {"replay":"房间名"} 加入
+const (
+	REPLAY_BROADCAST_INTERVAL = 500 * time.Millisecond
+	REPLAY_MAX_ROOMS          = 20
+	REPLAY_MAX_SPEED          = 1000
+	// 没有观众的房间保留的时间，过后自动关闭
+	REPLAY_IDLE_TIMEOUT = 30 * time.Minute
+)
+
+type webReplayRoom struct {
+	name          string
+	table, symbol string
+	day           time.Time
+	from, to      time.Time
+	speed         float64
+	playing       bool
+	// 时钟在 base 时刻的位置；播放时当前时钟 = clock + (now-base)*speed
+	clock     time.Time
+	base      time.Time
+	clients   map[*webWSClient]bool
+	idleSince time.Time
+}
+
+// 广播给客户端和 /api/v1/replay 返回的房间状态
+type webReplayState struct {
+	Type    string  `json:"type"`
+	Room    string  `json:"room"`
+	Table   string  `json:"table"`
+	Symbol  string  `json:"symbol"`
+	Date    string  `json:"date"`
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Clock   string  `json:"clock"`
+	Speed   float64 `json:"speed"`
+	Playing bool    `json:"playing"`
+	Viewers int     `json:"viewers"`
+}
+
+var (
+	webReplayRooms = map[string]*webReplayRoom{}
+	webReplayMutex sync.Mutex
+)
+
+// 房间名只允许字母、数字、- 和 _，便于放进URL
+func webValidReplayRoom(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// 推进时钟到 now，播放到交易时段结束时自动暂停
+func (room *webReplayRoom) advanceLocked(now time.Time) {
+	if room.playing {
+		room.clock = room.clock.Add(time.Duration(float64(now.Sub(room.base)) * room.speed))
+		if !room.clock.Before(room.to) {
+			room.clock, room.playing = room.to, false
+		}
+	}
+	room.base = now
+}
+
+func (room *webReplayRoom) stateLocked() webReplayState {
+	const layout = "2006-01-02 15:04:05"
+	return webReplayState{
+		Type:    "replay",
+		Room:    room.name,
+		Table:   room.table,
+		Symbol:  room.symbol,
+		Date:    room.day.Format("2006-01-02"),
+		From:    room.from.Format(layout),
+		To:      room.to.Format(layout),
+		Clock:   room.clock.Format(layout),
+		Speed:   room.speed,
+		Playing: room.playing,
+		Viewers: len(room.clients),
+	}
+}
+
+// 向房间里的所有客户端发送当前状态；发送只是放入各连接的队列，慢客户端不会拖住其他观众
+func webBroadcastReplay(room *webReplayRoom, frame interface{}) {
+	webReplayMutex.Lock()
+	clients := make([]*webWSClient, 0, len(room.clients))
+	for client := range room.clients {
+		clients = append(clients, client)
+	}
+	webReplayMutex.Unlock()
+
+	for _, client := range clients {
+		if err := client.sendJSON(frame); err != nil {
+			client.close()
+		}
+	}
+}
+
+// 定期推进各房间的时钟并广播，客户端以收到的时钟为准，不需要自己计时；同时关闭长时间没有观众的房间
+func webReplayLoop() {
+	ticker := time.NewTicker(REPLAY_BROADCAST_INTERVAL)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		type update struct {
+			room  *webReplayRoom
+			state webReplayState
+		}
+		var updates []update
+		webReplayMutex.Lock()
+		for name, room := range webReplayRooms {
+			if len(room.clients) == 0 {
+				if now.Sub(room.idleSince) > REPLAY_IDLE_TIMEOUT {
+					delete(webReplayRooms, name)
+				}
+				continue
+			}
+			room.advanceLocked(now)
+			updates = append(updates, update{room, room.stateLocked()})
+		}
+		webReplayMutex.Unlock()
+
+		for _, u := range updates {
+			webBroadcastReplay(u.room, u.state)
+		}
+	}
+}
+
+// 加入房间后立即收到一次当前状态
+func webJoinReplay(client *webWSClient, name string) error {
+	webReplayMutex.Lock()
+	room, ok := webReplayRooms[name]
+	if ok && !client.user.allows(room.table, room.symbol) {
+		webReplayMutex.Unlock()
+		return client.user.denied(room.table, room.symbol)
+	}
+	var state webReplayState
+	if ok {
+		room.clients[client] = true
+		room.advanceLocked(time.Now())
+		state = room.stateLocked()
+	}
+	webReplayMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("回放房间 %s 不存在", name)
+	}
+	return client.sendJSON(state)
+}
+
+func webLeaveReplay(client *webWSClient, name string) {
+	webReplayMutex.Lock()
+	defer webReplayMutex.Unlock()
+	if room, ok := webReplayRooms[name]; ok {
+		delete(room.clients, client)
+		if len(room.clients) == 0 {
+			room.idleSince = time.Now()
+		}
+	}
+}
+
+func webLeaveAllReplays(client *webWSClient) {
+	webReplayMutex.Lock()
+	defer webReplayMutex.Unlock()
+	for _, room := range webReplayRooms {
+		if room.clients[client] {
+			delete(room.clients, client)
+			if len(room.clients) == 0 {
+				room.idleSince = time.Now()
+			}
+		}
+	}
+}
+
+// 回放房间列表和创建：GET /api/v1/replay 列出用户有权访问的房间；
+// POST /api/v1/replay?room=pm-0701&table=jm&symbol=jm2509&date=2025-07-01&speed=10 创建房间，
+// 时钟停在该交易时段的第一笔tick，处于暂停状态
+func webReplaysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+	user := webRequestUser(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		webReplayMutex.Lock()
+		now := time.Now()
+		rooms := make([]webReplayState, 0, len(webReplayRooms))
+		for _, room := range webReplayRooms {
+			if !user.allows(room.table, room.symbol) {
+				continue
+			}
+			room.advanceLocked(now)
+			rooms = append(rooms, room.stateLocked())
+		}
+		webReplayMutex.Unlock()
+		sort.Slice(rooms, func(i, j int) bool { return rooms[i].Room < rooms[j].Room })
+		json.NewEncoder(w).Encode(map[string]interface{}{"rooms": rooms})
+		return
+	case http.MethodPost:
+	default:
+		fail(http.StatusMethodNotAllowed, "只支持GET和POST请求")
+		return
+	}
+
+	table, symbol, date := r.FormValue("table"), r.FormValue("symbol"), r.FormValue("date")
+	if symbol == "" || date == "" {
+		fail(http.StatusBadRequest, "缺少symbol或date参数")
+		return
+	}
+	if table == "" {
+		table = strings.ToLower(strings.TrimRight(symbol, "0123456789"))
+	}
+	if !user.allows(table, symbol) {
+		fail(http.StatusForbidden, user.denied(table, symbol).Error())
+		return
+	}
+	name := r.FormValue("room")
+	if name == "" {
+		name = symbol + "-" + date
+	}
+	if !webValidReplayRoom(name) {
+		fail(http.StatusBadRequest, "房间名只能包含字母、数字、- 和 _")
+		return
+	}
+	speed := 1.0
+	if s := r.FormValue("speed"); s != "" {
+		var err error
+		if speed, err = strconv.ParseFloat(s, 64); err != nil || speed <= 0 || speed > REPLAY_MAX_SPEED {
+			fail(http.StatusBadRequest, fmt.Sprintf("speed参数无效 (0-%d]", REPLAY_MAX_SPEED))
+			return
+		}
+	}
+	day, _, err := webParseSessionRange(SESSION_RANGE_PREFIX + date)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to := webSessionBounds(day)
+	first, err := webAdjacentTickTime(r.Context(), table, symbol, from, false)
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Sprintf("查询失败: %v", err))
+		return
+	}
+	if first.IsZero() || !first.Before(to) {
+		fail(http.StatusNotFound, fmt.Sprintf("%s 在交易日 %s 没有数据", symbol, date))
+		return
+	}
+
+	now := time.Now()
+	room := &webReplayRoom{
+		name: name, table: table, symbol: symbol, day: day, from: from, to: to,
+		speed: speed, clock: first, base: now, clients: map[*webWSClient]bool{}, idleSince: now,
+	}
+	// 房间放入列表后会被 webReplayLoop 和加入的观众修改，状态在锁内取出
+	webReplayMutex.Lock()
+	_, exists := webReplayRooms[name]
+	full := len(webReplayRooms) >= REPLAY_MAX_ROOMS
+	if !exists && !full {
+		webReplayRooms[name] = room
+	}
+	state := room.stateLocked()
+	webReplayMutex.Unlock()
+	switch {
+	case exists:
+		fail(http.StatusConflict, fmt.Sprintf("回放房间 %s 已存在", name))
+	case full:
+		fail(http.StatusTooManyRequests, fmt.Sprintf("回放房间已达上限 %d 个", REPLAY_MAX_ROOMS))
+	default:
+		w.Header().Set("Location", "/api/v1/replay/"+name)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// 单个回放房间：GET /api/v1/replay/{room} 查看状态，DELETE 关闭；
+// POST ?action=play|pause|seek|speed 控制，seek 带 at=2025-07-01 10:30:00，speed 带 speed=N。
+// 控制后立即向房间广播新状态。查看、控制和关闭都要求用户有权访问房间回放的合约
+func webReplayHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/replay/")
+	var at time.Time
+	speed := 0.0
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "play", "pause":
+		case "seek":
+			var err error
+			if at, err = webParseWallTime(r.FormValue("at")); err != nil {
+				fail(http.StatusBadRequest, "at"+err.Error())
+				return
+			}
+		case "speed":
+			var err error
+			if speed, err = strconv.ParseFloat(r.FormValue("speed"), 64); err != nil || speed <= 0 || speed > REPLAY_MAX_SPEED {
+				fail(http.StatusBadRequest, fmt.Sprintf("speed参数无效 (0-%d]", REPLAY_MAX_SPEED))
+				return
+			}
+		default:
+			fail(http.StatusBadRequest, "action参数无效 (play、pause、seek、speed)")
+			return
+		}
+	} else if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		fail(http.StatusMethodNotAllowed, "只支持GET、POST和DELETE请求")
+		return
+	}
+
+	user := webRequestUser(r)
+	webReplayMutex.Lock()
+	room, ok := webReplayRooms[name]
+	if ok && !user.allows(room.table, room.symbol) {
+		webReplayMutex.Unlock()
+		fail(http.StatusForbidden, user.denied(room.table, room.symbol).Error())
+		return
+	}
+	var state webReplayState
+	if ok {
+		room.advanceLocked(time.Now())
+		switch r.FormValue("action") {
+		case "play":
+			// 已经播放到结尾时从头开始
+			if !room.clock.Before(room.to) {
+				room.clock = room.from
+			}
+			room.playing = true
+		case "pause":
+			room.playing = false
+		case "seek":
+			switch {
+			case at.Before(room.from):
+				at = room.from
+			case at.After(room.to):
+				at = room.to
+			}
+			room.clock = at
+		case "speed":
+			room.speed = speed
+		}
+		if r.Method == http.MethodDelete {
+			delete(webReplayRooms, name)
+		}
+		state = room.stateLocked()
+	}
+	webReplayMutex.Unlock()
+
+	if !ok {
+		fail(http.StatusNotFound, fmt.Sprintf("回放房间 %s 不存在", name))
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		webBroadcastReplay(room, state)
+	case http.MethodDelete:
+		webBroadcastReplay(room, map[string]interface{}{"type": "replay_closed", "room": name})
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+// 共享回放页面的HTML模板 (templates/replay.html)
+const webReplayTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>共享回放</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
             text-align: center;
-            margin-bottom: 20px;
             color: #333;
         }
-        .stats {
+        .replay-controls {
             display: flex;
-            justify-content: space-around;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
             margin-bottom: 20px;
-            padding: 15px;
-            background-color: #f8f9fa;
-            border-radius: 5px;
         }
-        .stat-item {
-            text-align: center;
-        }
-        .stat-value {
-            font-size: 1.5em;
+        .replay-controls label {
+            display: block;
             font-weight: bold;
-            color: #007bff;
-        }
-        .stat-label {
-            font-size: 0.9em;
-            color: #666;
-        }
-        #chartContainer {
-            position: relative;
-            height: 700px;
-            margin-bottom: 20px;
+            color: #495057;
+            margin-bottom: 4px;
         }
-        .controls {
-            text-align: center;
-            margin-bottom: 20px;
+        .replay-controls input, .replay-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
         }
         button {
             padding: 10px 20px;
-            margin: 0 5px;
             border: none;
             border-radius: 5px;
             background-color: #007bff;
             color: white;
             cursor: pointer;
-            font-size: 14px;
-        }
-        button:hover {
-            background-color: #0056b3;
-        }
-        .status {
-            text-align: center;
-            padding: 10px;
-            background-color: #d4edda;
-            border: 1px solid #c3e6cb;
-            border-radius: 5px;
-            color: #155724;
-            margin-top: 20px;
-        }
-        .info {
-            background-color: #e7f3ff;
-            border: 1px solid #bee5eb;
-            border-radius: 5px;
-            padding: 15px;
-            margin: 20px 0;
-            text-align: center;
-        }
-        .query-controls {
-            display: flex;
-            justify-content: center;
-            align-items: center;
-            gap: 20px;
-            margin-bottom: 20px;
-            padding: 15px;
-            background-color: #f8f9fa;
-            border-radius: 5px;
-            border: 1px solid #dee2e6;
-        }
-        .control-group {
-            display: flex;
-            flex-direction: column;
-            align-items: center;
-        }
-        .control-group label {
-            font-weight: bold;
-            margin-bottom: 5px;
-            color: #495057;
-            font-size: 14px;
-        }
-        .control-group select,
-        .control-group input {
-            padding: 8px 12px;
-            border: 1px solid #ced4da;
-            border-radius: 4px;
-            font-size: 14px;
-            min-width: 150px;
-        }
-        .control-group select:focus,
-        .control-group input:focus {
-            outline: none;
-            border-color: #007bff;
-            box-shadow: 0 0 0 2px rgba(0,123,255,0.25);
-        }
-        .query-btn {
-            background-color: #28a745 !important;
-            padding: 8px 20px !important;
-            margin-top: 20px !important;
+            align-self: flex-end;
         }
-        .query-btn:hover {
-            background-color: #218838 !important;
-        }
-        .input-mode-toggle {
-            margin-top: 5px;
-            font-size: 12px;
-        }
-        .input-mode-toggle label {
-            display: flex;
-            align-items: center;
-            gap: 5px;
-            font-weight: normal !important;
-            cursor: pointer;
+        button:disabled {
+            background-color: #adb5bd;
+            cursor: default;
         }
-        .input-mode-toggle input[type="checkbox"] {
-            width: auto;
-            min-width: auto;
+        #seek {
+            width: 100%;
+            margin-bottom: 10px;
         }
-        .error-message {
-            background-color: #f8d7da;
-            border: 1px solid #f5c6cb;
-            color: #721c24;
-            padding: 10px;
-            border-radius: 4px;
-            margin-top: 10px;
-            text-align: center;
-            font-weight: bold;
+        #chartContainer {
+            position: relative;
+            height: 450px;
+            margin-bottom: 20px;
         }
-        .success-message {
-            background-color: #d4edda;
-            border: 1px solid #c3e6cb;
-            color: #155724;
-            padding: 10px;
-            border-radius: 4px;
-            margin-top: 10px;
+        .status {
             text-align: center;
-            font-weight: bold;
-        }
-        datalist {
-            background-color: white;
+            padding: 10px;
+            color: #555;
         }
     </style>
 </head>
 <body>
     <div class="container">
-        <div class="header">
-            <h1>实时市场数据图表</h1>
-            <p>JavaScript交互式图表 - 支持缩放、平移和详细数据查看</p>
-        </div>
-        
-        <div class="query-controls">
-            <div class="control-group">
-                <label for="tableInput">数据表名:</label>
-                <input type="text" id="tableInput" placeholder="例如: jm, SA, MA, rb" list="tableList">
-                <datalist id="tableList">
-                    <!-- 动态加载的表选项 -->
-                </datalist>
-                <div class="input-mode-toggle">
-                    <label>
-                        <input type="checkbox" id="tableDropdownMode"> 使用下拉选择
-                    </label>
-                </div>
-                <select id="tableSelect" style="display: none;">
-                    <option value="">正在加载...</option>
-                </select>
-            </div>
-            <div class="control-group">
-                <label for="symbolInput">Symbol代码:</label>
-                <input type="text" id="symbolInput" placeholder="例如: jm2509, SA509, MA509" list="symbolList">
-                <datalist id="symbolList">
-                    <!-- 动态加载的symbol选项 -->
-                </datalist>
-                <div class="input-mode-toggle">
-                    <label>
-                        <input type="checkbox" id="symbolDropdownMode"> 使用下拉选择
-                    </label>
-                </div>
-                <select id="symbolSelect" style="display: none;">
-                    <option value="">请先选择数据表</option>
-                </select>
+        <h1>共享回放</h1>
+        <div class="replay-controls">
+            <div><label>房间</label>
+                <select id="rooms"><option value="">新建房间</option></select>
             </div>
-            <div class="control-group">
-                <button onclick="queryData()" class="query-btn">查询数据</button>
-            </div>
-            <div class="error-message" id="errorMessage" style="display: none;"></div>
+            <div><label>房间名</label><input id="room" placeholder="默认 合约-日期"></div>
+            <div><label>合约</label><input id="symbol" value="jm2509"></div>
+            <div><label>交易日</label><input id="date" type="date"></div>
+            <button onclick="joinOrCreate()">加入</button>
         </div>
-        
-        <div class="stats" id="stats">
-            <div class="stat-item">
-                <div class="stat-value" id="avgPrice">--</div>
-                <div class="stat-label">平均价格</div>
-            </div>
-            <div class="stat-item">
-                <div class="stat-value" id="maxPrice">--</div>
-                <div class="stat-label">最高价格</div>
-            </div>
-            <div class="stat-item">
-                <div class="stat-value" id="minPrice">--</div>
-                <div class="stat-label">最低价格</div>
-            </div>
-            <div class="stat-item">
-                <div class="stat-value" id="avgOI">--</div>
-                <div class="stat-label">平均持仓量</div>
-            </div>
-            <div class="stat-item">
-                <div class="stat-value" id="dataPoints">--</div>
-                <div class="stat-label">数据点数</div>
+        <div class="replay-controls">
+            <button id="playBtn" onclick="control({ action: state && state.playing ? 'pause' : 'play' })" disabled>播放</button>
+            <div><label>速度</label>
+                <select id="speed" onchange="control({ action: 'speed', speed: this.value })" disabled>
+                    <option value="1">1x</option>
+                    <option value="5">5x</option>
+                    <option value="10">10x</option>
+                    <option value="30">30x</option>
+                    <option value="60">60x</option>
+                    <option value="300">300x</option>
+                </select>
             </div>
         </div>
+        <input id="seek" type="range" min="0" max="1000" value="0" disabled>
+        <div id="chartContainer"><canvas id="replayChart"></canvas></div>
+        <div class="status" id="status">选择已有房间或填写合约和交易日新建房间，同一房间的所有人看到同一个回放进度</div>
+    </div>
+    <script>
+        let socket = null;
+        let state = null;
+        let points = [];
+        let loadedKey = '';
 
-        <div class="info">
-            <p><strong>操作说明：</strong></p>
-            <p>• 鼠标滚轮：缩放图表 | 拖拽：平移查看不同时间段 | 双击：重置缩放</p>
-            <p>• 点击图例：显示/隐藏对应数据线 | 悬停：查看详细数据</p>
-        </div>
-
-        <div class="controls">
-            <button onclick="resetZoom()">重置缩放</button>
-            <button onclick="zoomIn()">放大</button>
-            <button onclick="zoomOut()">缩小</button>
-            <button onclick="togglePrice()">显示/隐藏价格</button>
-            <button onclick="toggleOI()">显示/隐藏持仓量</button>
-            <button onclick="refreshData()">刷新数据</button>
-        </div>
+        // 在当前回放时钟的位置画一条竖线
+        const clockLine = {
+            id: 'clockLine',
+            afterDatasetsDraw(chart) {
+                const index = visibleCount() - 1;
+                if (index < 0) {
+                    return;
+                }
+                const x = chart.scales.x.getPixelForValue(index);
+                const ctx = chart.ctx;
+                ctx.save();
+                ctx.strokeStyle = '#dc3545';
+                ctx.beginPath();
+                ctx.moveTo(x, chart.chartArea.top);
+                ctx.lineTo(x, chart.chartArea.bottom);
+                ctx.stroke();
+                ctx.restore();
+            }
+        };
 
-        <div id="chartContainer">
-            <canvas id="myChart"></canvas>
-        </div>
+        const chart = new Chart(document.getElementById('replayChart').getContext('2d'), {
+            type: 'line',
+            data: { labels: [], datasets: [{ label: '', data: [], borderColor: '#007bff', borderWidth: 1.5, pointRadius: 0, spanGaps: false }] },
+            options: {
+                responsive: true,
+                maintainAspectRatio: false,
+                animation: false,
+                interaction: { mode: 'index', intersect: false },
+                scales: { x: { ticks: { maxTicksLimit: 12 } } }
+            },
+            plugins: [clockLine]
+        });
 
-        <div class="status" id="status">
-            正在加载数据...
-        </div>
-    </div>
+        // 时钟之前（含）的点数；时间格式相同，可以直接按字符串比较
+        function visibleCount() {
+            if (!state) {
+                return 0;
+            }
+            let n = 0;
+            while (n < points.length && points[n].time.slice(0, 19) <= state.clock) {
+                n++;
+            }
+            return n;
+        }
 
-    <script>
-        let chart;
-        let chartData = null;
+        function render() {
+            const n = visibleCount();
+            chart.data.datasets[0].data = points.map((p, i) => i < n ? p.price : null);
+            chart.update();
+            const span = new Date(state.to.replace(' ', 'T')) - new Date(state.from.replace(' ', 'T'));
+            const pos = new Date(state.clock.replace(' ', 'T')) - new Date(state.from.replace(' ', 'T'));
+            const seek = document.getElementById('seek');
+            if (document.activeElement !== seek) {
+                seek.value = span > 0 ? Math.round(pos / span * 1000) : 0;
+            }
+            document.getElementById('playBtn').textContent = state.playing ? '暂停' : '播放';
+            document.getElementById('speed').value = String(state.speed);
+            document.getElementById('status').textContent = '房间 ' + state.room + '  ' + state.symbol + '  ' + state.clock +
+                '  ' + state.speed + 'x' + (state.playing ? '' : '（已暂停）') + '  ' + state.viewers + ' 人在看';
+        }
 
-        // 初始化图表
-        function initChart() {
-            // 注册缩放插件
-            Chart.register(ChartZoom);
-            
-            const ctx = document.getElementById('myChart').getContext('2d');
-            chart = new Chart(ctx, {
-                type: 'line',
-                data: {
-                    labels: [],
-                    datasets: [{
-                        label: '价格',
-                        data: [],
-                        borderColor: '#28a745',
-                        backgroundColor: 'rgba(40, 167, 69, 0.1)',
-                        tension: 0.1,
-                        yAxisID: 'y',
-                        pointRadius: 0,
-                        pointHoverRadius: 4,
-                        borderWidth: 2
-                    }, {
-                        label: '持仓量',
-                        data: [],
-                        borderColor: '#dc3545',
-                        backgroundColor: 'rgba(220, 53, 69, 0.1)',
-                        tension: 0.1,
-                        yAxisID: 'y1',
-                        pointRadius: 0,
-                        pointHoverRadius: 4,
-                        borderWidth: 2
-                    }]
-                },
-                options: {
-                    responsive: true,
-                    maintainAspectRatio: false,
-                    interaction: {
-                        mode: 'index',
-                        intersect: false,
-                    },
-                    scales: {
-                        x: {
-                            display: true,
-                            title: {
-                                display: true,
-                                text: '日期时间',
-                                font: {
-                                    size: 14
-                                }
-                            },
-                            ticks: {
-                                font: {
-                                    size: 12
-                                }
-                            }
-                        },
-                        y: {
-                            type: 'linear',
-                            display: true,
-                            position: 'left',
-                            title: {
-                                display: true,
-                                text: '价格',
-                                font: {
-                                    size: 14
-                                }
-                            },
-                            ticks: {
-                                font: {
-                                    size: 12
-                                }
-                            }
-                        },
-                        y1: {
-                            type: 'linear',
-                            display: true,
-                            position: 'right',
-                            title: {
-                                display: true,
-                                text: '持仓量',
-                                font: {
-                                    size: 14
-                                }
-                            },
-                            grid: {
-                                drawOnChartArea: false,
-                            },
-                            ticks: {
-                                font: {
-                                    size: 12
-                                }
-                            }
-                        }
-                    },
-                    plugins: {
-                        legend: {
-                            display: true,
-                            position: 'top',
-                            labels: {
-                                font: {
-                                    size: 14
-                                }
-                            }
-                        },
-                        title: {
-                            display: true,
-                            text: 'JM2509 交互式数据图表',
-                            font: {
-                                size: 16
-                            }
-                        },
-                        zoom: {
-                            pan: {
-                                enabled: true,
-                                mode: 'x'
-                            },
-                            zoom: {
-                                wheel: {
-                                    enabled: true,
-                                },
-                                pinch: {
-                                    enabled: true
-                                },
-                                mode: 'x',
-                            }
-                        }
-                    },
-                    elements: {
-                        point: {
-                            radius: 0
-                        }
+        // 房间的合约或交易日变化时重新加载当日数据
+        function loadSession() {
+            const key = state.table + '/' + state.symbol + '/' + state.date;
+            if (key === loadedKey) {
+                render();
+                return;
+            }
+            loadedKey = key;
+            const params = new URLSearchParams({ table: state.table, symbol: state.symbol, from: state.from, to: state.to, points: 2000 });
+            fetch('/overlay/data?' + params)
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
+                        return;
                     }
+                    points = data.data;
+                    chart.data.labels = points.map(p => p.time.slice(11, 19));
+                    chart.data.datasets[0].label = state.symbol + ' ' + state.date;
+                    render();
+                });
+        }
+
+        function connect(room) {
+            if (socket) {
+                socket.onclose = null;
+                socket.close();
+            }
+            const proto = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            socket = new WebSocket(proto + location.host + '/ws');
+            socket.onopen = () => socket.send(JSON.stringify({ replay: room }));
+            socket.onmessage = event => {
+                const msg = JSON.parse(event.data);
+                if (msg.type === 'replay') {
+                    state = msg;
+                    ['playBtn', 'speed', 'seek'].forEach(id => document.getElementById(id).disabled = false);
+                    loadSession();
+                } else if (msg.type === 'replay_closed') {
+                    document.getElementById('status').textContent = '房间 ' + msg.room + ' 已关闭';
+                    ['playBtn', 'speed', 'seek'].forEach(id => document.getElementById(id).disabled = true);
+                    socket.onclose = null;
+                    socket.close();
+                } else if (msg.type === 'error') {
+                    document.getElementById('status').textContent = '错误: ' + msg.error;
                 }
-            });
+            };
+            // 断线后自动重连，重新加入后会收到最新进度
+            socket.onclose = () => setTimeout(() => connect(room), 2000);
         }
 
-        // 更新图表数据
-        function updateChart() {
-            document.getElementById('status').textContent = '正在加载数据...';
-            
-            fetch('/data')
-                .then(response => {
-                    if (!response.ok) {
-                        throw new Error('Network response was not ok');
+        function control(params) {
+            if (!state) {
+                return;
+            }
+            fetch('/api/v1/replay/' + encodeURIComponent(state.room), { method: 'POST', body: new URLSearchParams(params) })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.error) {
+                        document.getElementById('status').textContent = '错误: ' + data.error;
                     }
-                    return response.json();
-                })
+                });
+        }
+
+        function joinOrCreate() {
+            const existing = document.getElementById('rooms').value;
+            if (existing) {
+                history.replaceState(null, '', '?room=' + encodeURIComponent(existing));
+                connect(existing);
+                return;
+            }
+            const params = new URLSearchParams({
+                room: document.getElementById('room').value.trim(),
+                symbol: document.getElementById('symbol').value.trim(),
+                date: document.getElementById('date').value
+            });
+            fetch('/api/v1/replay', { method: 'POST', body: params })
+                .then(response => response.json())
                 .then(data => {
                     if (data.error) {
                         document.getElementById('status').textContent = '错误: ' + data.error;
                         return;
                     }
+                    history.replaceState(null, '', '?room=' + encodeURIComponent(data.room));
+                    connect(data.room);
+                });
+        }
 
-                    chartData = data;
+        document.getElementById('seek').addEventListener('change', event => {
+            const from = new Date(state.from.replace(' ', 'T')).getTime();
+            const to = new Date(state.to.replace(' ', 'T')).getTime();
+            const at = new Date(from + (to - from) * event.target.value / 1000);
+            const pad = v => String(v).padStart(2, '0');
+            control({ action: 'seek', at: at.getFullYear() + '-' + pad(at.getMonth() + 1) + '-' + pad(at.getDate()) + ' ' +
+                pad(at.getHours()) + ':' + pad(at.getMinutes()) + ':' + pad(at.getSeconds()) });
+        });
 
-                    // 更新图表数据
-                    const labels = data.data.map(item => {
-                        const date = new Date(item.time);
-                        return date.toLocaleDateString('zh-CN', {
-                            month: '2-digit',
-                            day: '2-digit',
-                            hour: '2-digit',
-                            minute: '2-digit'
-                        });
-                    });
-                    
-                    const prices = data.data.map(item => item.price);
-                    const openInterests = data.data.map(item => item.open_interest);
+        fetch('/api/v1/replay')
+            .then(response => response.json())
+            .then(data => {
+                const select = document.getElementById('rooms');
+                (data.rooms || []).forEach(room => {
+                    const option = select.appendChild(document.createElement('option'));
+                    option.value = room.room;
+                    option.textContent = room.room + '（' + room.viewers + ' 人）';
+                });
+                const room = new URLSearchParams(location.search).get('room');
+                if (room) {
+                    select.value = room;
+                    connect(room);
+                }
+            });
+        document.getElementById('date').value = new Date().toISOString().slice(0, 10);
+    </script>
+</body>
+</html>`
 
-                    chart.data.labels = labels;
-                    chart.data.datasets[0].data = prices;
-                    chart.data.datasets[1].data = openInterests;
-                    chart.update('none');
+// 共享回放页面：创建或加入回放房间，按服务端广播的时钟逐步显示当日走势
+func webReplayPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("replay.html")
 
-                    // 更新统计信息
-                    updateStats(data.stats);
-                    
-                    // 更新状态
-                    document.getElementById('status').textContent = 
-                        '数据加载完成 | 最后更新: ' + new Date().toLocaleTimeString() + 
-                        ' | 显示 ' + data.stats.data_points + ' 条采样数据，共 ' + data.stats.total_records + ' 条原始记录';
-                })
-                .catch(error => {
-                    console.error('Error:', error);
-                    document.getElementById('status').textContent = '数据获取失败: ' + error.message;
-                });
-        }
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
 
-        // 更新统计信息
-        function updateStats(stats) {
-            document.getElementById('avgPrice').textContent = stats.avg_price.toFixed(2);
-            document.getElementById('maxPrice').textContent = stats.max_price.toFixed(2);
-            document.getElementById('minPrice').textContent = stats.min_price.toFixed(2);
-            document.getElementById('avgOI').textContent = Math.round(stats.avg_oi).toLocaleString();
-            document.getElementById('dataPoints').textContent = stats.data_points.toLocaleString();
-        }
+// 联动时间范围：仪表盘的多个面板（可以分布在不同的浏览器里）加入同一个联动组，
+// 任一面板缩放或平移后把可见范围写到服务端，服务端通过WebSocket推送给组内所有客户端。
+// 客户端发送 {"link":"组名"} 加入，{"unlink":"组名"} 离开
+const RANGE_MAX_LINKS = 100
 
-        // 缩放功能
-        function zoomIn() {
-            chart.zoom(1.2);
-        }
+type webRangeLink struct {
+	from, to time.Time
+	// 每次修改递增，客户端据此丢弃过期的推送
+	version int
+	// 发起修改的客户端标识，发起者收到自己的推送时不再重复应用
+	source  string
+	clients map[*webWSClient]bool
+}
 
-        function zoomOut() {
-            chart.zoom(0.8);
-        }
+type webRangeState struct {
+	Type    string `json:"type"`
+	Link    string `json:"link"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Version int    `json:"version"`
+	Source  string `json:"source,omitempty"`
+}
 
-        function resetZoom() {
-            chart.resetZoom();
-        }
+var (
+	webRangeLinks = map[string]*webRangeLink{}
+	webRangeMutex sync.Mutex
+)
 
-        // 切换数据显示
-        function togglePrice() {
-            const dataset = chart.data.datasets[0];
-            dataset.hidden = !dataset.hidden;
-            chart.update();
-        }
+func (link *webRangeLink) stateLocked(name string) webRangeState {
+	state := webRangeState{Type: "range", Link: name, Version: link.version, Source: link.source}
+	if !link.from.IsZero() {
+		state.From = link.from.Format("2006-01-02 15:04:05")
+		state.To = link.to.Format("2006-01-02 15:04:05")
+	}
+	return state
+}
 
-        function toggleOI() {
-            const dataset = chart.data.datasets[1];
-            dataset.hidden = !dataset.hidden;
-            chart.update();
-        }
+// 取得联动组，不存在时创建；组数达到上限时返回nil
+func webRangeLinkLocked(name string) *webRangeLink {
+	link, ok := webRangeLinks[name]
+	if !ok {
+		if len(webRangeLinks) >= RANGE_MAX_LINKS {
+			return nil
+		}
+		link = &webRangeLink{clients: map[*webWSClient]bool{}}
+		webRangeLinks[name] = link
+	}
+	return link
+}
 
-        // 显示错误消息
-        function showError(message) {
-            const errorDiv = document.getElementById('errorMessage');
-            errorDiv.textContent = message;
-            errorDiv.style.display = 'block';
-            errorDiv.className = 'error-message';
-            setTimeout(() => {
-                errorDiv.style.display = 'none';
-            }, 5000);
+// 加入联动组后立即收到一次当前范围（还没有人设置时 from/to 为空）
+func webJoinRangeLink(client *webWSClient, name string) error {
+	if !webValidReplayRoom(name) {
+		return fmt.Errorf("联动组名只能包含字母、数字、- 和 _")
+	}
+	webRangeMutex.Lock()
+	link := webRangeLinkLocked(name)
+	var state webRangeState
+	if link != nil {
+		link.clients[client] = true
+		state = link.stateLocked(name)
+	}
+	webRangeMutex.Unlock()
+	if link == nil {
+		return fmt.Errorf("联动组已达上限 %d 个", RANGE_MAX_LINKS)
+	}
+	return client.sendJSON(state)
+}
+
+// 离开联动组，没有客户端且从未设置范围的组直接删除
+func webLeaveRangeLink(client *webWSClient, name string) {
+	webRangeMutex.Lock()
+	defer webRangeMutex.Unlock()
+	if link, ok := webRangeLinks[name]; ok {
+		delete(link.clients, client)
+		if len(link.clients) == 0 && link.from.IsZero() {
+			delete(webRangeLinks, name)
+		}
+	}
+}
+
+func webLeaveAllRangeLinks(client *webWSClient) {
+	webRangeMutex.Lock()
+	var names []string
+	for name, link := range webRangeLinks {
+		if link.clients[client] {
+			names = append(names, name)
+		}
+	}
+	webRangeMutex.Unlock()
+	for _, name := range names {
+		webLeaveRangeLink(client, name)
+	}
+}
+
+// 联动范围：GET /api/v1/range/{组} 查询当前范围；
+// POST /api/v1/range/{组}?from=2025-07-01 09:00:00&to=2025-07-01 11:30:00&source=客户端标识 设置范围并推送给组内所有客户端
+func webRangeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/range/")
+	if !webValidReplayRoom(name) {
+		fail(http.StatusBadRequest, "联动组名只能包含字母、数字、- 和 _")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webRangeMutex.Lock()
+		state := webRangeState{Type: "range", Link: name}
+		if link, ok := webRangeLinks[name]; ok {
+			state = link.stateLocked(name)
+		}
+		webRangeMutex.Unlock()
+		json.NewEncoder(w).Encode(state)
+		return
+	case http.MethodPost:
+	default:
+		fail(http.StatusMethodNotAllowed, "只支持GET和POST请求")
+		return
+	}
+
+	from, err := webParseWallTime(r.FormValue("from"))
+	if err != nil {
+		fail(http.StatusBadRequest, "开始"+err.Error())
+		return
+	}
+	to, err := webParseWallTime(r.FormValue("to"))
+	if err != nil {
+		fail(http.StatusBadRequest, "结束"+err.Error())
+		return
+	}
+	if !from.Before(to) {
+		fail(http.StatusBadRequest, "开始时间必须早于结束时间")
+		return
+	}
+
+	webRangeMutex.Lock()
+	link := webRangeLinkLocked(name)
+	var state webRangeState
+	var clients []*webWSClient
+	if link != nil {
+		link.from, link.to, link.source = from, to, r.FormValue("source")
+		link.version++
+		state = link.stateLocked(name)
+		for client := range link.clients {
+			clients = append(clients, client)
+		}
+	}
+	webRangeMutex.Unlock()
+	if link == nil {
+		fail(http.StatusTooManyRequests, fmt.Sprintf("联动组已达上限 %d 个", RANGE_MAX_LINKS))
+		return
+	}
+
+	for _, client := range clients {
+		if err := client.sendJSON(state); err != nil {
+			client.close()
+		}
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+// 联动仪表盘的HTML模板 (templates/dashboard.html)
+const webDashboardTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>联动仪表盘</title>
+    <script src="/assets/js/chart.umd.js"></script>
+    <script src="/assets/js/hammer.min.js"></script>
+    <script src="/assets/js/chartjs-plugin-zoom.min.js"></script>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .dashboard-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .dashboard-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .dashboard-controls input {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        #panels {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(600px, 1fr));
+            gap: 15px;
+        }
+        .panel {
+            border: 1px solid #dee2e6;
+            border-radius: 6px;
+            padding: 10px;
+        }
+        .panel-header {
+            display: flex;
+            justify-content: space-between;
+            font-weight: bold;
+            color: #495057;
+        }
+        .panel-chart {
+            position: relative;
+            height: 300px;
+        }
+        .panel-error {
+            color: #dc3545;
+            font-weight: normal;
+            margin-left: 10px;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
         }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>联动仪表盘</h1>
+        <div class="dashboard-controls">
+            <div><label>合约（逗号分隔）</label><input id="symbols" size="40" value="jm2509,j2509,i2509"></div>
+            <div><label>联动组</label><input id="link" value="default"></div>
+            <button onclick="reopen()">打开</button>
+        </div>
+        <div id="panels"></div>
+        <div class="status" id="status">滚轮缩放、拖动平移；勾选"联动"的面板共享同一时间范围，同一联动组的其他浏览器也会同步</div>
+    </div>
+    <script>
+        const clientId = Math.random().toString(36).slice(2);
+        const params = new URLSearchParams(location.search);
+        const linkName = params.get('link') || 'default';
+        const symbols = (params.get('symbols') || 'jm2509,j2509,i2509').split(',').map(s => s.trim()).filter(s => s);
+        document.getElementById('symbols').value = symbols.join(',');
+        document.getElementById('link').value = linkName;
 
-        // 显示成功消息
-        function showSuccess(message) {
-            const errorDiv = document.getElementById('errorMessage');
-            errorDiv.textContent = message;
-            errorDiv.style.display = 'block';
-            errorDiv.className = 'success-message';
-            setTimeout(() => {
-                errorDiv.style.display = 'none';
-            }, 3000);
+        let socket = null;
+        let linkVersion = 0;
+        let pushTimer = null;
+
+        const pad = v => String(v).padStart(2, '0');
+        const parseWall = s => new Date(s.replace(' ', 'T')).getTime();
+        function formatWall(ms) {
+            const d = new Date(ms);
+            return d.getFullYear() + '-' + pad(d.getMonth() + 1) + '-' + pad(d.getDate()) + ' ' +
+                pad(d.getHours()) + ':' + pad(d.getMinutes()) + ':' + pad(d.getSeconds());
         }
 
-        // 加载所有表
-        function loadTables() {
-            fetch('/tables')
-                .then(response => response.json())
-                .then(data => {
-                    if (data.error) {
-                        console.error('加载表失败:', data.error);
-                        return;
-                    }
-                    
-                    // 更新下拉框
-                    const tableSelect = document.getElementById('tableSelect');
-                    tableSelect.innerHTML = '<option value="">请选择数据表</option>';
-                    
-                    // 更新datalist
-                    const tableList = document.getElementById('tableList');
-                    tableList.innerHTML = '';
-                    
-                    data.tables.forEach(table => {
-                        // 下拉框选项
-                        const option = document.createElement('option');
-                        option.value = table;
-                        option.textContent = table.toUpperCase();
-                        tableSelect.appendChild(option);
-                        
-                        // datalist选项
-                        const dataOption = document.createElement('option');
-                        dataOption.value = table;
-                        tableList.appendChild(dataOption);
-                    });
-                })
-                .catch(error => {
-                    console.error('加载表失败:', error);
-                    showError('加载表列表失败: ' + error.message);
-                });
+        function reopen() {
+            location.search = '?' + new URLSearchParams({
+                symbols: document.getElementById('symbols').value,
+                link: document.getElementById('link').value.trim() || 'default'
+            });
         }
-        
-        // 加载指定表的symbols
-        function loadSymbols(table) {
-            if (!table) {
-                const symbolSelect = document.getElementById('symbolSelect');
-                symbolSelect.innerHTML = '<option value="">请先选择数据表</option>';
-                const symbolList = document.getElementById('symbolList');
-                symbolList.innerHTML = '';
+
+        const panels = symbols.map((symbol, i) => {
+            const el = document.getElementById('panels').appendChild(document.createElement('div'));
+            el.className = 'panel';
+            el.innerHTML = '<div class="panel-header"><div><span></span><span class="panel-error"></span></div><label><input type="checkbox" checked> 联动</label></div>' +
+                '<div class="panel-chart"><canvas></canvas></div>';
+            el.querySelector('span').textContent = symbol.toUpperCase();
+            const panel = { symbol: symbol, linked: el.querySelector('input'), error: el.querySelector('.panel-error'), from: 0, to: 0, seq: 0 };
+            panel.chart = new Chart(el.querySelector('canvas').getContext('2d'), {
+                type: 'line',
+                data: { datasets: [{ label: symbol, data: [], borderColor: '#007bff', borderWidth: 1.5, pointRadius: 0 }] },
+                options: {
+                    responsive: true,
+                    maintainAspectRatio: false,
+                    animation: false,
+                    parsing: false,
+                    interaction: { mode: 'nearest', axis: 'x', intersect: false },
+                    scales: {
+                        x: { type: 'linear', ticks: { maxTicksLimit: 8, callback: value => formatWall(value).slice(5, 16) } }
+                    },
+                    plugins: {
+                        legend: { display: false },
+                        tooltip: { callbacks: { title: items => formatWall(items[0].parsed.x) } },
+                        zoom: {
+                            pan: { enabled: true, mode: 'x', onPanComplete: () => panelMoved(panel) },
+                            zoom: { wheel: { enabled: true }, pinch: { enabled: true }, mode: 'x', onZoomComplete: () => panelMoved(panel) }
+                        }
+                    }
+                }
+            });
+            panel.linked.addEventListener('change', () => {
+                // 重新勾选联动时回到组内当前范围
+                if (panel.linked.checked) {
+                    fetch('/api/v1/range/' + encodeURIComponent(linkName))
+                        .then(response => response.json())
+                        .then(state => state.from && loadPanel(panel, parseWall(state.from), parseWall(state.to)));
+                }
+            });
+            return panel;
+        });
+
+        // 按范围重新取数，缩放后得到该范围内的完整分辨率：多个面板合并成一次 /dashboard/data 请求，
+        // 服务端并发查询各合约，某个合约出错只显示在它自己的面板上；较早发出的请求晚到时丢弃
+        function loadPanels(list, from, to) {
+            if (!list.length) {
                 return;
             }
-            
-            const symbolSelect = document.getElementById('symbolSelect');
-            symbolSelect.innerHTML = '<option value="">正在加载...</option>';
-            
-            fetch('/symbols?table=' + encodeURIComponent(table))
+            const seqs = list.map(panel => {
+                panel.from = from;
+                panel.to = to;
+                return ++panel.seq;
+            });
+            const query = new URLSearchParams({ symbols: list.map(panel => panel.symbol).join(','), from: formatWall(from), to: formatWall(to), points: 1000 });
+            fetch('/dashboard/data?' + query)
                 .then(response => response.json())
                 .then(data => {
                     if (data.error) {
-                        symbolSelect.innerHTML = '<option value="">加载失败</option>';
-                        console.error('加载symbols失败:', data.error);
-                        showError('加载symbols失败: ' + data.error);
+                        document.getElementById('status').textContent = '错误: ' + data.error;
                         return;
                     }
-                    
-                    // 更新下拉框
-                    symbolSelect.innerHTML = '<option value="">请选择Symbol</option>';
-                    
-                    // 更新datalist
-                    const symbolList = document.getElementById('symbolList');
-                    symbolList.innerHTML = '';
-                    
-                    data.symbols.forEach(symbol => {
-                        // 下拉框选项
-                        const option = document.createElement('option');
-                        option.value = symbol;
-                        option.textContent = symbol;
-                        symbolSelect.appendChild(option);
-                        
-                        // datalist选项
-                        const dataOption = document.createElement('option');
-                        dataOption.value = symbol;
-                        symbolList.appendChild(dataOption);
+                    list.forEach((panel, i) => {
+                        const result = data.panels[i];
+                        if (seqs[i] !== panel.seq || !result) {
+                            return;
+                        }
+                        panel.error.textContent = result.error || '';
+                        if (result.error) {
+                            return;
+                        }
+                        panel.chart.data.datasets[0].data = result.data.map(p => ({ x: parseWall(p.time.slice(0, 19)), y: p.price }));
+                        panel.chart.options.scales.x.min = from;
+                        panel.chart.options.scales.x.max = to;
+                        panel.chart.update('none');
                     });
-                })
-                .catch(error => {
-                    symbolSelect.innerHTML = '<option value="">加载失败</option>';
-                    console.error('加载symbols失败:', error);
-                    showError('加载symbols失败: ' + error.message);
                 });
         }
 
-        // 获取当前输入的表名和symbol
-        function getCurrentInputs() {
-            const tableDropdownMode = document.getElementById('tableDropdownMode').checked;
-            const symbolDropdownMode = document.getElementById('symbolDropdownMode').checked;
-            
-            const table = tableDropdownMode ? 
-                document.getElementById('tableSelect').value : 
-                document.getElementById('tableInput').value.trim();
-                
-            const symbol = symbolDropdownMode ? 
-                document.getElementById('symbolSelect').value : 
-                document.getElementById('symbolInput').value.trim();
-                
-            return { table, symbol };
+        function loadPanel(panel, from, to) {
+            loadPanels([panel], from, to);
         }
 
-        // 查询数据
-        function queryData() {
-            const { table, symbol } = getCurrentInputs();
-            
-            if (!table) {
-                showError('请输入或选择数据表名');
-                return;
-            }
-            
-            if (!symbol) {
-                showError('请输入或选择Symbol代码');
+        function applyRange(from, to, except) {
+            loadPanels(panels.filter(panel => panel !== except && panel.linked.checked), from, to);
+            document.getElementById('status').textContent = '联动组 ' + linkName + '：' + formatWall(from) + ' - ' + formatWall(to);
+        }
+
+        // 面板缩放或平移结束：自己按新范围取数，联动时同步到其他面板并写到服务端
+        function panelMoved(panel) {
+            const from = Math.round(panel.chart.scales.x.min);
+            const to = Math.round(panel.chart.scales.x.max);
+            loadPanel(panel, from, to);
+            if (!panel.linked.checked) {
                 return;
             }
-            
-            document.getElementById('status').textContent = '正在查询数据...';
-            
-            // 更新图表标题
-            chart.options.plugins.title.text = symbol.toUpperCase() + ' 交互式数据图表';
-            chart.update('none');
-            
-            // 发送查询请求
-            fetch('/data?table=' + encodeURIComponent(table) + '&symbol=' + encodeURIComponent(symbol))
-                .then(response => {
-                    if (!response.ok) {
-                        throw new Error('Network response was not ok');
+            applyRange(from, to, panel);
+            clearTimeout(pushTimer);
+            pushTimer = setTimeout(() => pushRange(from, to), 200);
+        }
+
+        function pushRange(from, to) {
+            fetch('/api/v1/range/' + encodeURIComponent(linkName), {
+                method: 'POST',
+                body: new URLSearchParams({ from: formatWall(from), to: formatWall(to), source: clientId })
+            })
+                .then(response => response.json())
+                .then(state => {
+                    if (state.error) {
+                        document.getElementById('status').textContent = '错误: ' + state.error;
+                    } else {
+                        linkVersion = Math.max(linkVersion, state.version);
                     }
-                    return response.json();
-                })
-                .then(data => {
-                    if (data.error) {
-                        showError(data.error);
-                        document.getElementById('status').textContent = '查询失败';
+                });
+        }
+
+        // 联动组还没有范围时，用第一个合约最近的交易时段初始化
+        function initRange() {
+            const symbol = symbols[0];
+            const query = new URLSearchParams({ table: symbol.replace(/[0-9]+$/, '').toLowerCase(), symbol: symbol });
+            fetch('/api/v1/session?' + query)
+                .then(response => response.json())
+                .then(session => {
+                    if (session.error) {
+                        document.getElementById('status').textContent = '错误: ' + session.error;
                         return;
                     }
+                    applyRange(parseWall(session.from), parseWall(session.to), null);
+                    pushRange(parseWall(session.from), parseWall(session.to));
+                });
+        }
 
-                    chartData = data;
+        function connect() {
+            const proto = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            socket = new WebSocket(proto + location.host + '/ws');
+            socket.onopen = () => socket.send(JSON.stringify({ link: linkName }));
+            socket.onmessage = event => {
+                const msg = JSON.parse(event.data);
+                if (msg.type === 'error') {
+                    document.getElementById('status').textContent = '错误: ' + msg.error;
+                    return;
+                }
+                if (msg.type !== 'range' || msg.link !== linkName) {
+                    return;
+                }
+                if (!msg.from) {
+                    initRange();
+                    return;
+                }
+                // 丢弃过期或已经应用过的推送；自己发起的修改已经在本地应用过
+                if (msg.version <= linkVersion) {
+                    return;
+                }
+                linkVersion = msg.version;
+                if (msg.source !== clientId) {
+                    applyRange(parseWall(msg.from), parseWall(msg.to), null);
+                }
+            };
+            // 断线后自动重连，重新加入后收到组内最新范围
+            socket.onclose = () => setTimeout(connect, 2000);
+        }
+        connect();
+    </script>
+</body>
+</html>`
 
-                    // 更新图表数据
-                    const labels = data.data.map(item => {
-                        const date = new Date(item.time);
-                        return date.toLocaleDateString('zh-CN', {
-                            month: '2-digit',
-                            day: '2-digit',
-                            hour: '2-digit',
-                            minute: '2-digit'
-                        });
-                    });
-                    
-                    const prices = data.data.map(item => item.price);
-                    const openInterests = data.data.map(item => item.open_interest);
+// 联动仪表盘：每个合约一个面板，勾选联动的面板共享服务端的时间范围，
+// 在任一面板（或打开同一联动组的其他浏览器）里缩放、平移，其余面板跟着切换到同样的范围
+func webDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := webTemplate("dashboard.html")
 
-                    chart.data.labels = labels;
-                    chart.data.datasets[0].data = prices;
-                    chart.data.datasets[1].data = openInterests;
-                    chart.update('none');
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
 
-                    // 更新统计信息
-                    updateStats(data.stats);
-                    
-                    // 显示成功消息
-                    showSuccess('数据查询成功！');
-                    
-                    // 更新状态
-                    document.getElementById('status').textContent = 
-                        '数据查询完成 | 表: ' + table.toUpperCase() + ' | Symbol: ' + symbol.toUpperCase() + ' | 最后更新: ' + new Date().toLocaleTimeString() + 
-                        ' | 显示 ' + data.stats.data_points + ' 条采样数据，共 ' + data.stats.total_records + ' 条原始记录';
-                })
-                .catch(error => {
-                    console.error('Error:', error);
-                    showError('数据查询失败: ' + error.message);
-                    document.getElementById('status').textContent = '查询失败';
-                });
-        }
+type webDashboardPanel struct {
+	Table  string            `json:"table"`
+	Symbol string            `json:"symbol"`
+	Data   []webOverlayPoint `json:"data"`
+	Error  string            `json:"error,omitempty"`
+}
 
-        // 刷新数据
-        function refreshData() {
-            const { table, symbol } = getCurrentInputs();
-            if (table && symbol) {
-                queryData();
-            } else {
-                updateChart();
-            }
+// 联动仪表盘批量取数：/dashboard/data?symbols=jm2509,j2509&from=2025-07-01 09:00:00&to=2025-07-01 15:00:00&points=1000
+// 合约可写成 table/symbol 或只写合约（按字母前缀推断表），各合约并发查询（-fetch-concurrency），
+// 某个合约失败只在它自己的面板里返回 error，不影响其他面板
+func webDashboardDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(msg string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+
+	q := r.URL.Query()
+	panels := []webDashboardPanel{}
+	for _, item := range strings.Split(q.Get("symbols"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		table, symbol, ok := strings.Cut(item, "/")
+		if !ok {
+			table, symbol = strings.ToLower(strings.TrimRight(item, "0123456789")), item
+		}
+		panels = append(panels, webDashboardPanel{Table: table, Symbol: symbol, Data: []webOverlayPoint{}})
+	}
+	if len(panels) == 0 {
+		fail("缺少symbols参数")
+		return
+	}
+	from, err := webParseWallTime(q.Get("from"))
+	if err != nil {
+		fail("开始" + err.Error())
+		return
+	}
+	to, err := webParseWallTime(q.Get("to"))
+	if err != nil {
+		fail("结束" + err.Error())
+		return
+	}
+	points := WEB_ZOOM_POINTS
+	if n, err := strconv.Atoi(q.Get("points")); err == nil && n > 0 && n < points {
+		points = n
+	}
+
+	errs := webFetchEach(r.Context(), len(panels), func(ctx context.Context, i int) error {
+		panel := &panels[i]
+		if err := webAuthorizeDataset(r, webDatasetKey{table: panel.Table, symbol: panel.Symbol}); err != nil {
+			return err
+		}
+		series, err := webOverlaySeries(ctx, panel.Table, panel.Symbol, from, to, points)
+		if err != nil {
+			return fmt.Errorf("查询 %s 失败: %w", panel.Symbol, err)
+		}
+		panel.Data = series
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			panels[i].Error = err.Error()
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":   from.Format("2006-01-02 15:04:05"),
+		"to":     to.Format("2006-01-02 15:04:05"),
+		"panels": panels,
+	})
+}
+
+// 查询审计记录：按用户、来源、查询文本（子串，不区分大小写）、最小耗时和是否出错过滤，
+// 默认按时间倒序，sort=duration 按耗时倒序，方便找出最慢的查询。启用访问控制时只有管理员可以查看
+func webAuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	}
+	if err := webRequireAdmin(r, "查询审计"); err != nil {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	minMs := 0.0
+	if s := q.Get("min_ms"); s != "" {
+		var err error
+		if minMs, err = strconv.ParseFloat(s, 64); err != nil || minMs < 0 {
+			fail(http.StatusBadRequest, "min_ms参数无效")
+			return
+		}
+	}
+	limit := AUDIT_PAGE_LIMIT
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > AUDIT_RECENT {
+			fail(http.StatusBadRequest, fmt.Sprintf("limit参数无效 (1-%d)", AUDIT_RECENT))
+			return
+		}
+		limit = n
+	}
+	sortBy := q.Get("sort")
+	if sortBy != "" && sortBy != "time" && sortBy != "duration" {
+		fail(http.StatusBadRequest, "sort参数无效 (time/duration)")
+		return
+	}
+	user, source, text := q.Get("user"), q.Get("source"), strings.ToLower(q.Get("q"))
+	errorsOnly := q.Get("errors") == "1"
+
+	webAuditMutex.Lock()
+	buffered := len(webAuditRecent)
+	entries := make([]webAuditEntry, 0, limit)
+	for i := len(webAuditRecent) - 1; i >= 0; i-- {
+		e := webAuditRecent[i]
+		if (user != "" && e.User != user) || (source != "" && !strings.Contains(e.Source, source)) ||
+			(text != "" && !strings.Contains(strings.ToLower(e.Query), text)) ||
+			e.DurationMs < minMs || (errorsOnly && e.Error == "") {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	webAuditMutex.Unlock()
+
+	matched := len(entries)
+	if sortBy == "duration" {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].DurationMs > entries[j].DurationMs })
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":  entries,
+		"matched":  matched,
+		"buffered": buffered,
+		"log_file": webAuditPath,
+	})
+}
+
+// 查询审计页面的HTML模板 (templates/audit.html)
+const webAuditTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>查询审计</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
         }
-        
-        // 切换输入模式
-        function toggleInputMode(type) {
-            const isTable = type === 'table';
-            const checkbox = document.getElementById(isTable ? 'tableDropdownMode' : 'symbolDropdownMode');
-            const input = document.getElementById(isTable ? 'tableInput' : 'symbolInput');
-            const select = document.getElementById(isTable ? 'tableSelect' : 'symbolSelect');
-            
-            if (checkbox.checked) {
-                input.style.display = 'none';
-                select.style.display = 'block';
-            } else {
-                input.style.display = 'block';
-                select.style.display = 'none';
-            }
+        .container {
+            max-width: 1400px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            text-align: center;
+            color: #333;
+        }
+        .audit-controls {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 15px;
+            margin-bottom: 20px;
+        }
+        .audit-controls label {
+            display: block;
+            font-weight: bold;
+            color: #495057;
+            margin-bottom: 4px;
+        }
+        .audit-controls input, .audit-controls select {
+            padding: 8px;
+            border: 1px solid #ced4da;
+            border-radius: 4px;
+        }
+        button {
+            padding: 10px 20px;
+            border: none;
+            border-radius: 5px;
+            background-color: #007bff;
+            color: white;
+            cursor: pointer;
+            align-self: flex-end;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 13px;
+        }
+        th, td {
+            border-bottom: 1px solid #dee2e6;
+            padding: 6px 8px;
+            text-align: left;
+            vertical-align: top;
+        }
+        th {
+            background-color: #f8f9fa;
+        }
+        td.num {
+            text-align: right;
+            white-space: nowrap;
         }
-        
-        // 同步输入框和下拉框的值
-        function syncInputValues(type) {
-            const isTable = type === 'table';
-            const checkbox = document.getElementById(isTable ? 'tableDropdownMode' : 'symbolDropdownMode');
-            const input = document.getElementById(isTable ? 'tableInput' : 'symbolInput');
-            const select = document.getElementById(isTable ? 'tableSelect' : 'symbolSelect');
-            
-            if (checkbox.checked) {
-                // 从输入框同步到下拉框
-                const inputValue = input.value.trim();
-                if (inputValue) {
-                    // 查找匹配的选项
-                    for (let option of select.options) {
-                        if (option.value === inputValue) {
-                            select.value = inputValue;
-                            break;
-                        }
-                    }
-                }
-            } else {
-                // 从下拉框同步到输入框
-                if (select.value) {
-                    input.value = select.value;
-                }
-            }
+        td.sql {
+            font-family: monospace;
+            max-width: 600px;
+            overflow: hidden;
+            text-overflow: ellipsis;
+            white-space: nowrap;
+            cursor: pointer;
         }
-        
-        // 表输入变化时自动加载symbols
-        function handleTableInputChange() {
-            const tableDropdownMode = document.getElementById('tableDropdownMode').checked;
-            const table = tableDropdownMode ? 
-                document.getElementById('tableSelect').value : 
-                document.getElementById('tableInput').value.trim();
-            
-            if (table) {
-                loadSymbols(table);
-            }
+        td.sql.expanded {
+            white-space: pre-wrap;
+            word-break: break-all;
         }
-        
-        // 事件监听器
-        document.getElementById('tableDropdownMode').addEventListener('change', function() {
-            syncInputValues('table');
-            toggleInputMode('table');
-        });
-        
-        document.getElementById('symbolDropdownMode').addEventListener('change', function() {
-            syncInputValues('symbol');
-            toggleInputMode('symbol');
-        });
-        
-        document.getElementById('tableSelect').addEventListener('change', handleTableInputChange);
-        document.getElementById('tableInput').addEventListener('input', handleTableInputChange);
-        
-        // 支持回车键查询
-        document.getElementById('tableInput').addEventListener('keypress', function(event) {
-            if (event.key === 'Enter') {
-                queryData();
-            }
-        });
-        
-        document.getElementById('symbolInput').addEventListener('keypress', function(event) {
-            if (event.key === 'Enter') {
-                queryData();
+        tr.failed td {
+            color: #dc3545;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>查询审计</h1>
+        <div class="audit-controls">
+            <div><label for="user">用户</label><input id="user" placeholder="全部"></div>
+            <div><label for="source">来源</label><input id="source" placeholder="如 /data"></div>
+            <div><label for="text">查询包含</label><input id="text" placeholder="如 feature.jm"></div>
+            <div><label for="minMs">最小耗时 (ms)</label><input id="minMs" type="number" min="0" value="0"></div>
+            <div><label for="sort">排序</label>
+                <select id="sort"><option value="time">最新在前</option><option value="duration">最慢在前</option></select></div>
+            <div><label for="errorsOnly">只看失败</label><input id="errorsOnly" type="checkbox"></div>
+            <button onclick="loadAudit()">查询</button>
+        </div>
+        <div class="status" id="status"></div>
+        <table>
+            <thead><tr><th>时间</th><th>用户</th><th>来源</th><th>耗时 (ms)</th><th>结果行数</th><th>扫描行数</th><th>字节</th><th>查询 / 错误</th></tr></thead>
+            <tbody id="rows"></tbody>
+        </table>
+    </div>
+    <script>
+        function cell(row, text, className) {
+            const td = document.createElement('td');
+            td.textContent = text;
+            if (className) {
+                td.className = className;
             }
-        });
+            row.appendChild(td);
+            return td;
+        }
 
-        // 键盘快捷键
-        document.addEventListener('keydown', function(event) {
-            switch(event.key) {
-                case '+':
-                case '=':
-                    zoomIn();
-                    break;
-                case '-':
-                    zoomOut();
-                    break;
-                case '0':
-                    resetZoom();
-                    break;
-                case 'r':
-                case 'R':
-                    refreshData();
-                    break;
+        async function loadAudit() {
+            const params = new URLSearchParams({
+                user: document.getElementById('user').value.trim(),
+                source: document.getElementById('source').value.trim(),
+                q: document.getElementById('text').value.trim(),
+                min_ms: document.getElementById('minMs').value || '0',
+                sort: document.getElementById('sort').value,
+                errors: document.getElementById('errorsOnly').checked ? '1' : '0'
+            });
+            const status = document.getElementById('status');
+            const response = await fetch('/api/v1/audit?' + params);
+            const result = await response.json();
+            if (result.error) {
+                status.textContent = result.error;
+                return;
             }
-        });
+            const tbody = document.getElementById('rows');
+            tbody.innerHTML = '';
+            for (const e of result.entries) {
+                const row = document.createElement('tr');
+                if (e.error) {
+                    row.className = 'failed';
+                }
+                cell(row, e.time);
+                cell(row, e.user || '-');
+                cell(row, e.source);
+                cell(row, e.duration_ms.toFixed(1), 'num');
+                cell(row, e.error ? '-' : e.rows.toLocaleString(), 'num');
+                cell(row, e.read_rows ? e.read_rows.toLocaleString() : '-', 'num');
+                cell(row, e.bytes.toLocaleString(), 'num');
+                const sql = cell(row, e.error ? e.error + '\n' + e.query : e.query, 'sql');
+                sql.title = '点击展开/收起';
+                sql.onclick = () => sql.classList.toggle('expanded');
+                tbody.appendChild(row);
+            }
+            status.textContent = '匹配 ' + result.matched + ' 条，显示 ' + result.entries.length + ' 条；内存中保留最近 ' +
+                result.buffered + ' 条' + (result.log_file ? '，完整记录见 ' + result.log_file : '');
+        }
 
-        // 页面加载完成后初始化
-        window.onload = function() {
-            initChart();
-            loadTables();
-            updateChart();
-        };
+        loadAudit();
     </script>
 </body>
 </html>`
 
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(tmpl))
-}
-
-// 图表处理器 (生成PNG图表)
-func webChartHandler(w http.ResponseWriter, r *http.Request) {
-	webDataMutex.RLock()
-	data := webCurrentData
-	webDataMutex.RUnlock()
-
-	if len(data) < 2 {
-		http.Error(w, "Insufficient data", http.StatusInternalServerError)
+// 查询审计页面：筛选并列出最近的ClickHouse查询，点击查询文本展开全文
+func webAuditPageHandler(w http.ResponseWriter, r *http.Request) {
+	if err := webRequireAdmin(r, "查询审计"); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
+	tmpl := webTemplate("audit.html")
 
-	// 准备数据
-	xValues := make([]time.Time, len(data))
-	priceValues := make([]float64, len(data))
-	oiValues := make([]float64, len(data))
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
+}
 
-	for i, record := range data {
-		// 解析时间字符串
-		parsedTime, err := time.Parse("2006-01-02 15:04:05", record.Time)
-		if err != nil {
-			log.Printf("Failed to parse time %s: %v", record.Time, err)
-			continue
-		}
-		xValues[i] = parsedTime
-		priceValues[i] = float64(record.Price)
-		oiValues[i] = float64(record.OpenInterest)
-	}
+// 运行时配置 (-config)：定期检查文件的修改时间和大小，变化后重新加载并只应用有差异的部分，
+// 已加载的数据集、会话和WebSocket连接都保留。文件无效时继续使用之前的设置，错误显示在 /admin/config
+const (
+	CONFIG_POLL_INTERVAL = 2 * time.Second
+	CONFIG_HISTORY       = 50 // /admin/config 保留的最近加载记录数
+)
 
-	// 计算统计信息
-	avgPrice := webCalculateAverage(priceValues)
-	maxPrice := webFindMax(priceValues)
-	minPrice := webFindMin(priceValues)
-	avgOI := webCalculateAverage(oiValues)
+// 可以热加载的设置
+type webSettings struct {
+	Watchlist       []webDatasetKey // 预加载并常驻缓存的数据集，同 -refresh-symbols
+	AlertSymbols    []webDatasetKey // 盘口失衡监控的合约，同 -imbalance-watch
+	AlertThreshold  float64
+	AlertTicks      int
+	RefreshInterval time.Duration
+	CacheTTL        time.Duration
+	CatalogTTL      time.Duration
+	Theme           string
+	Shortcuts       map[string][]string             // 主页快捷键，动作名 → 按键
+	Profiles        map[string]webClickHouseProfile // ClickHouse连接配置，按名称
+	Downsampling    webDownsampleStrategy           // 各序列的降采样策略
+	Levels          map[string][]webPriceLevel      // 只读的价位线，按小写合约代码
+}
 
-	// 创建图表
-	graph := chart.Chart{
-		Title: fmt.Sprintf("JM2509 - 全数据视图 (%d条采样数据，共%d条记录)\n平均价格: %.2f | 最高: %.2f | 最低: %.2f | 平均持仓量: %.0f",
-			len(data), len(webAllData), avgPrice, maxPrice, minPrice, avgOI),
-		TitleStyle: chart.Style{
-			FontSize: 14,
-		},
-		Width:  1400,
-		Height: 800,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top:    80,
-				Left:   80,
-				Right:  80,
-				Bottom: 80,
-			},
-		},
-		XAxis: chart.XAxis{
-			Name: "日期时间",
-			Style: chart.Style{
-				FontSize: 12,
-			},
-			ValueFormatter: chart.TimeValueFormatterWithFormat("01-02 15:04"),
-		},
-		YAxis: chart.YAxis{
-			Name: "价格",
-			Style: chart.Style{
-				FontSize: 12,
-			},
-		},
-		YAxisSecondary: chart.YAxis{
-			Name: "持仓量",
-			Style: chart.Style{
-				FontSize: 12,
-			},
-		},
-		Series: []chart.Series{
-			chart.TimeSeries{
-				Name: "价格",
-				Style: chart.Style{
-					StrokeColor: drawing.ColorGreen,
-					StrokeWidth: 2,
-				},
-				XValues: xValues,
-				YValues: priceValues,
-			},
-			chart.TimeSeries{
-				Name: "持仓量",
-				Style: chart.Style{
-					StrokeColor: drawing.ColorRed,
-					StrokeWidth: 2,
-				},
-				YAxis:   chart.YAxisSecondary,
-				XValues: xValues,
-				YValues: oiValues,
-			},
-		},
-	}
+// 一次加载的结果：成功时列出变化的设置，失败时记录错误
+type webConfigReload struct {
+	Time    string   `json:"time"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
 
-	// 添加图例
-	graph.Elements = []chart.Renderable{
-		chart.Legend(&graph),
-	}
+// 主页的键盘快捷键。按键为浏览器 KeyboardEvent.key 的取值，单个字母不区分大小写；
+// 配置文件中某个动作的按键列表为空时禁用该动作，省略的动作保持默认
+var webShortcutActions = []struct {
+	name, desc string
+	keys       []string
+}{
+	{"zoom_in", "放大", []string{"+", "="}},
+	{"zoom_out", "缩小", []string{"-"}},
+	{"reset_zoom", "重置缩放", []string{"0"}},
+	{"refresh", "刷新数据", []string{"r"}},
+	{"prev_session", "上一交易日", []string{"ArrowLeft"}},
+	{"next_session", "下一交易日", []string{"ArrowRight"}},
+	{"prev_range", "上一个时间范围", []string{"["}},
+	{"next_range", "下一个时间范围", []string{"]"}},
+	{"toggle_price", "显示/隐藏价格", []string{"p"}},
+	{"toggle_oi", "显示/隐藏持仓量", []string{"o"}},
+	{"toggle_flow", "显示/隐藏成交增仓", []string{"f"}},
+	{"next_series", "切换价格序列", []string{"s"}},
+}
 
-	w.Header().Set("Content-Type", "image/png")
-	err := graph.Render(chart.PNG, w)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func webDefaultShortcuts() map[string][]string {
+	shortcuts := make(map[string][]string, len(webShortcutActions))
+	for _, action := range webShortcutActions {
+		shortcuts[action.name] = action.keys
 	}
+	return shortcuts
 }
 
-// 数据API处理器
-func webDataHandler(w http.ResponseWriter, r *http.Request) {
-	// 获取查询参数
-	table := r.URL.Query().Get("table")
-	symbol := r.URL.Query().Get("symbol")
-
-	// 如果有查询参数，执行动态查询
-	if table != "" && symbol != "" {
-		data, err := webQueryMarketDataDynamic(table, symbol)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": fmt.Sprintf("查询失败: %v", err),
-			})
-			return
+// 把配置文件中的快捷键覆盖到 base 上，返回新的映射（不修改 base）。同一个按键不能分配给两个动作
+func webMergeShortcuts(base map[string][]string, overrides map[string][]string) (map[string][]string, error) {
+	merged := make(map[string][]string, len(webShortcutActions))
+	for name, keys := range base {
+		merged[name] = keys
+	}
+	for name, keys := range overrides {
+		known := false
+		for _, action := range webShortcutActions {
+			known = known || action.name == name
 		}
-
-		if len(data) == 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": fmt.Sprintf("未找到表 %s 中 symbol = %s 的数据", table, symbol),
-			})
-			return
+		if !known {
+			return nil, fmt.Errorf("unknown shortcut action %q", name)
 		}
-
-		// 更新全局数据
-		webDataMutex.Lock()
-		webAllData = data
-
-		// 对数据进行采样
-		sampleSize := 100
-		if len(data) > sampleSize {
-			step := len(data) / sampleSize
-			webCurrentData = make([]WebMarketData, 0, sampleSize)
-			for i := 0; i < len(data); i += step {
-				webCurrentData = append(webCurrentData, data[i])
+		normalized := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if key == "" {
+				return nil, fmt.Errorf("empty key for shortcut %s", name)
 			}
-		} else {
-			webCurrentData = data
+			if len([]rune(key)) == 1 {
+				key = strings.ToLower(key)
+			}
+			normalized = append(normalized, key)
 		}
-		webDataMutex.Unlock()
-
-		fmt.Printf("Dynamic query: table=%s, symbol=%s, found %d records, sampled %d\n",
-			table, symbol, len(data), len(webCurrentData))
+		merged[name] = normalized
 	}
 
-	// 返回当前数据
-	webDataMutex.RLock()
-	data := webCurrentData
-	allData := webAllData
-	webDataMutex.RUnlock()
-
-	fmt.Printf("Retrieved data: %d current, %d total\n", len(data), len(allData))
-
-	if len(data) == 0 {
-		fmt.Printf("No data available, returning error\n")
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": "No data available",
-		})
-		return
+	owner := map[string]string{}
+	for _, action := range webShortcutActions {
+		for _, key := range merged[action.name] {
+			if other, ok := owner[key]; ok {
+				return nil, fmt.Errorf("key %q is bound to both %s and %s", key, other, action.name)
+			}
+			owner[key] = action.name
+		}
 	}
+	return merged, nil
+}
 
-	fmt.Printf("Data available, proceeding with stats calculation\n")
+var (
+	webTheme     = "light"               // 主页配色，在 webConfigMutex 下读写
+	webShortcuts = webDefaultShortcuts() // 主页快捷键，在 webConfigMutex 下读写
 
-	// 计算统计信息
-	priceValues := make([]float64, len(data))
-	oiValues := make([]float64, len(data))
+	webConfigPath     string
+	webConfigBase     webSettings // 命令行参数给出的设置，配置文件中省略的字段回到这些值
+	webConfigCurrent  webSettings
+	webConfigLoadedAt time.Time
+	webConfigHistory  []webConfigReload
+	webConfigMutex    sync.Mutex
+)
 
-	fmt.Printf("Starting to calculate stats for %d data points\n", len(data))
+// 读取配置文件并覆盖到 base 上：
+//
+//	{"watchlist": ["jm/jm2509@1d"], "alerts": {"symbols": ["jm/jm2509"], "threshold": 0.8, "ticks": 5},
+//	 "refresh_interval": "30s", "cache_ttl": "1m", "catalog_ttl": "5m", "theme": "dark",
+//	 "shortcuts": {"refresh": ["F5"], "toggle_flow": []},
+//	 "profiles": {"prod": {"url": "http://ch-prod:8123", "database": "feature", "user": "reader", "password": "..."}},
+//	 "downsampling": {"diff_vol": "max", "open_interest": "mean"},
+//	 "levels": {"jm2509": [{"price": 1012.5, "label": "前高"}]}}
+//
+// 未知字段视为错误，避免拼错的键被静默忽略
+func webLoadSettings(path string, base webSettings) (webSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return base, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	var file struct {
+		Watchlist *[]string `json:"watchlist"`
+		Alerts    *struct {
+			Symbols   *[]string `json:"symbols"`
+			Threshold *float64  `json:"threshold"`
+			Ticks     *int      `json:"ticks"`
+		} `json:"alerts"`
+		RefreshInterval *string                         `json:"refresh_interval"`
+		CacheTTL        *string                         `json:"cache_ttl"`
+		CatalogTTL      *string                         `json:"catalog_ttl"`
+		Theme           *string                         `json:"theme"`
+		Shortcuts       map[string][]string             `json:"shortcuts"`
+		Profiles        map[string]webClickHouseProfile `json:"profiles"`
+		Downsampling    map[string]string               `json:"downsampling"`
+		Levels          map[string][]webPriceLevel      `json:"levels"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return base, fmt.Errorf("invalid config %s: %w", path, err)
+	}
 
-	for i, record := range data {
-		priceValues[i] = float64(record.Price)
-		oiValues[i] = float64(record.OpenInterest)
+	s := base
+	if file.Watchlist != nil {
+		if s.Watchlist, err = webParseDatasetKeys(strings.Join(*file.Watchlist, ",")); err != nil {
+			return base, fmt.Errorf("invalid config %s: watchlist: %w", path, err)
+		}
+	}
+	if a := file.Alerts; a != nil {
+		if a.Symbols != nil {
+			if s.AlertSymbols, err = webParseDatasetKeys(strings.Join(*a.Symbols, ",")); err != nil {
+				return base, fmt.Errorf("invalid config %s: alerts.symbols: %w", path, err)
+			}
+		}
+		if a.Threshold != nil {
+			s.AlertThreshold = *a.Threshold
+		}
+		if a.Ticks != nil {
+			s.AlertTicks = *a.Ticks
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value *string
+		dst   *time.Duration
+	}{
+		{"refresh_interval", file.RefreshInterval, &s.RefreshInterval},
+		{"cache_ttl", file.CacheTTL, &s.CacheTTL},
+		{"catalog_ttl", file.CatalogTTL, &s.CatalogTTL},
+	} {
+		if d.value == nil {
+			continue
+		}
+		v, err := time.ParseDuration(*d.value)
+		if err != nil || v < 0 {
+			return base, fmt.Errorf("invalid config %s: %s %q", path, d.name, *d.value)
+		}
+		*d.dst = v
+	}
+	if file.Theme != nil {
+		s.Theme = *file.Theme
+	}
+	if s.Shortcuts, err = webMergeShortcuts(base.Shortcuts, file.Shortcuts); err != nil {
+		return base, fmt.Errorf("invalid config %s: shortcuts: %w", path, err)
+	}
+	if s.Profiles, err = webMergeProfiles(base.Profiles, file.Profiles); err != nil {
+		return base, fmt.Errorf("invalid config %s: profiles: %w", path, err)
+	}
+	if file.Downsampling != nil {
+		if s.Downsampling, err = webMergeDownsampling(base.Downsampling, file.Downsampling); err != nil {
+			return base, fmt.Errorf("invalid config %s: downsampling: %w", path, err)
+		}
+	}
+	if file.Levels != nil {
+		if s.Levels, err = webParseConfigLevels(file.Levels); err != nil {
+			return base, fmt.Errorf("invalid config %s: levels: %w", path, err)
+		}
 	}
 
-	fmt.Printf("Calculated price and OI values\n")
+	switch {
+	case s.AlertThreshold <= 0 || s.AlertThreshold > 1:
+		return base, fmt.Errorf("invalid config %s: alerts.threshold %v must be in (0, 1]", path, s.AlertThreshold)
+	case s.AlertTicks < 1:
+		return base, fmt.Errorf("invalid config %s: alerts.ticks %d must be at least 1", path, s.AlertTicks)
+	case s.CatalogTTL <= 0:
+		return base, fmt.Errorf("invalid config %s: catalog_ttl must be positive", path)
+	case s.Theme != "light" && s.Theme != "dark":
+		return base, fmt.Errorf("invalid config %s: theme %q, expected light or dark", path, s.Theme)
+	}
+	return s, nil
+}
 
-	avgPrice := webCalculateAverage(priceValues)
-	maxPrice := webFindMax(priceValues)
-	minPrice := webFindMin(priceValues)
-	avgOI := webCalculateAverage(oiValues)
+// 在 b 中而不在 a 中的数据集
+func webMissingKeys(a, b []webDatasetKey) []webDatasetKey {
+	set := make(map[webDatasetKey]bool, len(a))
+	for _, key := range a {
+		set[key] = true
+	}
+	var missing []webDatasetKey
+	for _, key := range b {
+		if !set[key] {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
 
-	// 确保所有统计值都是有效的
-	if math.IsInf(avgPrice, 0) || math.IsNaN(avgPrice) {
-		avgPrice = 0
+// 列出两份设置之间的差异，用于日志和 /admin/config
+func webDiffSettings(old, s webSettings) []string {
+	var changes []string
+	for _, key := range webMissingKeys(old.Watchlist, s.Watchlist) {
+		changes = append(changes, "watchlist +"+key.String())
+	}
+	for _, key := range webMissingKeys(s.Watchlist, old.Watchlist) {
+		changes = append(changes, "watchlist -"+key.String())
+	}
+	for _, key := range webMissingKeys(old.AlertSymbols, s.AlertSymbols) {
+		changes = append(changes, "alerts.symbols +"+key.table+"/"+key.symbol)
+	}
+	for _, key := range webMissingKeys(s.AlertSymbols, old.AlertSymbols) {
+		changes = append(changes, "alerts.symbols -"+key.table+"/"+key.symbol)
+	}
+	if old.AlertThreshold != s.AlertThreshold {
+		changes = append(changes, fmt.Sprintf("alerts.threshold: %v → %v", old.AlertThreshold, s.AlertThreshold))
 	}
-	if math.IsInf(maxPrice, 0) || math.IsNaN(maxPrice) {
-		maxPrice = 0
+	if old.AlertTicks != s.AlertTicks {
+		changes = append(changes, fmt.Sprintf("alerts.ticks: %d → %d", old.AlertTicks, s.AlertTicks))
 	}
-	if math.IsInf(minPrice, 0) || math.IsNaN(minPrice) {
-		minPrice = 0
+	if old.RefreshInterval != s.RefreshInterval {
+		changes = append(changes, fmt.Sprintf("refresh_interval: %v → %v", old.RefreshInterval, s.RefreshInterval))
 	}
-	if math.IsInf(avgOI, 0) || math.IsNaN(avgOI) {
-		avgOI = 0
+	if old.CacheTTL != s.CacheTTL {
+		changes = append(changes, fmt.Sprintf("cache_ttl: %v → %v", old.CacheTTL, s.CacheTTL))
 	}
-
-	stats := map[string]interface{}{
-		"avg_price":     avgPrice,
-		"max_price":     maxPrice,
-		"min_price":     minPrice,
-		"avg_oi":        avgOI,
-		"data_points":   len(data),
-		"total_records": len(allData),
+	if old.CatalogTTL != s.CatalogTTL {
+		changes = append(changes, fmt.Sprintf("catalog_ttl: %v → %v", old.CatalogTTL, s.CatalogTTL))
 	}
-
-	fmt.Printf("Calculated stats: avg_price=%.2f, data_points=%d\n", avgPrice, len(data))
-
-	// 过滤数据中的无穷大和NaN值，并创建清理后的数据
-	cleanData := make([]WebMarketData, 0, len(data))
-	for _, record := range data {
-		// 创建一个新的记录，确保所有float字段都是有效的
-		cleanRecord := record
-
-		// 检查并清理Price字段
-		if math.IsInf(float64(record.Price), 0) || math.IsNaN(float64(record.Price)) {
-			cleanRecord.Price = 0
+	if old.Theme != s.Theme {
+		changes = append(changes, fmt.Sprintf("theme: %s → %s", old.Theme, s.Theme))
+	}
+	for _, action := range webShortcutActions {
+		before, after := webShortcutKeys(old.Shortcuts[action.name]), webShortcutKeys(s.Shortcuts[action.name])
+		if before != after {
+			changes = append(changes, fmt.Sprintf("shortcuts.%s: %s → %s", action.name, before, after))
 		}
-
-		// 检查并清理Bid1字段
-		if math.IsInf(float64(record.Bid1), 0) || math.IsNaN(float64(record.Bid1)) {
-			cleanRecord.Bid1 = 0
+	}
+	for _, name := range webSortedProfileNames(s.Profiles) {
+		before, ok := old.Profiles[name]
+		after := s.Profiles[name]
+		switch {
+		case !ok:
+			changes = append(changes, "profiles +"+name)
+		case before.String() != after.String():
+			changes = append(changes, fmt.Sprintf("profiles.%s: %s → %s", name, before, after))
+		case before.Password != after.Password:
+			changes = append(changes, fmt.Sprintf("profiles.%s: password changed", name))
 		}
-
-		// 检查并清理Ask1字段
-		if math.IsInf(float64(record.Ask1), 0) || math.IsNaN(float64(record.Ask1)) {
-			cleanRecord.Ask1 = 0
+	}
+	for _, name := range webSortedProfileNames(old.Profiles) {
+		if _, ok := s.Profiles[name]; !ok {
+			changes = append(changes, "profiles -"+name)
 		}
-
-		cleanData = append(cleanData, cleanRecord)
 	}
-
-	fmt.Printf("Cleaned data: %d records processed\n", len(cleanData))
-
-	// 简化响应，避免time.Time可能的JSON编码问题
-	response := map[string]interface{}{
-		"data":      cleanData,
-		"stats":     stats,
-		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	before, after := webFullDownsampling(old.Downsampling), webFullDownsampling(s.Downsampling)
+	for _, series := range webDownsampleSeries {
+		if before[series.name] != after[series.name] {
+			changes = append(changes, fmt.Sprintf("downsampling.%s: %s → %s", series.name, before[series.name], after[series.name]))
+		}
 	}
-
-	fmt.Printf("Created response object\n")
-
-	w.Header().Set("Content-Type", "application/json")
-
-	// 添加调试信息
-	fmt.Printf("Encoding JSON response with %d data points\n", len(cleanData))
-
-	// 使用自定义JSON编码来处理可能的无穷大值
-	jsonBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Printf("JSON encoding error: %v\n", err)
-		// 如果JSON编码失败，返回一个简化的响应
-		fallbackResponse := map[string]interface{}{
-			"error": "数据包含无效值，无法序列化",
-			"stats": map[string]interface{}{
-				"data_points": len(cleanData),
-				"message":     "请检查数据源",
-			},
+	for _, symbol := range webLevelSymbols(old.Levels, s.Levels) {
+		if before, after := webLevelPrices(old.Levels[symbol]), webLevelPrices(s.Levels[symbol]); before != after {
+			changes = append(changes, fmt.Sprintf("levels.%s: %s → %s", symbol, before, after))
 		}
-		json.NewEncoder(w).Encode(fallbackResponse)
-		return
 	}
+	return changes
+}
 
-	// 检查JSON中是否包含无穷大值
-	jsonStr := string(jsonBytes)
-	if strings.Contains(jsonStr, "Infinity") || strings.Contains(jsonStr, "NaN") {
-		fmt.Printf("JSON contains invalid values, returning error\n")
-		fallbackResponse := map[string]interface{}{
-			"error": "数据包含无穷大或NaN值",
-			"stats": map[string]interface{}{
-				"data_points": len(cleanData),
-				"message":     "数据已被过滤",
-			},
+// 两份配置中出现过价位线的合约，按代码排序
+func webLevelSymbols(a, b map[string][]webPriceLevel) []string {
+	seen := map[string]bool{}
+	var symbols []string
+	for _, levels := range []map[string][]webPriceLevel{a, b} {
+		for symbol := range levels {
+			if !seen[symbol] {
+				seen[symbol] = true
+				symbols = append(symbols, symbol)
+			}
 		}
-		json.NewEncoder(w).Encode(fallbackResponse)
-		return
 	}
+	sort.Strings(symbols)
+	return symbols
+}
 
-	w.Write(jsonBytes)
-	fmt.Printf("JSON response sent successfully\n")
+// 配置文件中的连接配置加到 base 上（同名的覆盖），返回新的映射。库名缺省为 feature
+func webMergeProfiles(base map[string]webClickHouseProfile, overrides map[string]webClickHouseProfile) (map[string]webClickHouseProfile, error) {
+	merged := make(map[string]webClickHouseProfile, len(base)+len(overrides))
+	for name, p := range base {
+		merged[name] = p
+	}
+	for name, p := range overrides {
+		if !webIsIdentifier(strings.ReplaceAll(name, "-", "_")) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: invalid url %q (expected e.g. http://ch-prod:8123)", name, p.URL)
+		}
+		p.URL = strings.TrimRight(p.URL, "/")
+		if p.Database == "" {
+			p.Database = WEB_DEFAULT_DATABASE
+		}
+		if !webIsIdentifier(p.Database) {
+			return nil, fmt.Errorf("%s: invalid database %q", name, p.Database)
+		}
+		merged[name] = p
+	}
+	return merged, nil
 }
 
-// 动态查询市场数据
-func webQueryMarketDataDynamic(table, symbol string) ([]WebMarketData, error) {
-	// 验证表名是否存在，防止SQL注入
-	checkQuery := fmt.Sprintf("SELECT 1 FROM feature.%s LIMIT 1", table)
-	_, err := webExecuteQuery(checkQuery)
-	if err != nil {
-		return nil, fmt.Errorf("表 %s 不存在或无法访问: %w", table, err)
-	}
-
-	query := fmt.Sprintf(`
-		SELECT 
-			symbol, 
-			time, 
-			price, 
-			vol, 
-			open_interest, 
-			diff_vol, 
-			diff_oi, 
-			bid_1, 
-			bid_volumn_1, 
-			ask_1, 
-			ask_volumn_1, 
-			datetime
-		FROM feature.%s 
-		WHERE symbol = '%s'
-		ORDER BY time ASC 
-		FORMAT TabSeparated
-	`, table, strings.ReplaceAll(symbol, "'", "''")) // 简单的SQL转义
-
-	result, err := webExecuteQuery(query)
-	if err != nil {
-		return nil, fmt.Errorf("query failed: %w", err)
+// 连接配置的可读形式，不含密码
+func (p webClickHouseProfile) String() string {
+	desc := p.URL + " " + p.Database
+	if p.User != "" {
+		desc += " (" + p.User + ")"
 	}
+	return desc
+}
 
-	return webParseTabSeparatedData(result)
+func webSortedProfileNames(profiles map[string]webClickHouseProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func webNormalizeToRange(source, target []float64) []float64 {
-	if len(source) == 0 || len(target) == 0 {
-		return source
+func webShortcutKeys(keys []string) string {
+	if len(keys) == 0 {
+		return "none"
 	}
+	return strings.Join(keys, " ")
+}
 
-	sourceMin := webFindMin(source)
-	sourceMax := webFindMax(source)
-	targetMin := webFindMin(target)
-	targetMax := webFindMax(target)
+// 替换各项设置对应的全局变量，每个变量在其读取方使用的锁下修改
+func webUseSettings(s webSettings) {
+	webDatasetsMutex.Lock()
+	webRefreshInterval, webCacheTTL = s.RefreshInterval, s.CacheTTL
+	webDatasetsMutex.Unlock()
 
-	if sourceMax == sourceMin {
-		return source
-	}
+	webCatalogMutex.Lock()
+	webCatalogTTL = s.CatalogTTL
+	webCatalogMutex.Unlock()
 
-	normalized := make([]float64, len(source))
-	for i, val := range source {
-		// 将source数据从[sourceMin, sourceMax]映射到[targetMin, targetMax]
-		normalized[i] = targetMin + (val-sourceMin)*(targetMax-targetMin)/(sourceMax-sourceMin)
-	}
+	webFeedsMutex.Lock()
+	webImbalanceThreshold, webImbalanceTicks = s.AlertThreshold, s.AlertTicks
+	webFeedsMutex.Unlock()
 
-	return normalized
+	webConfigMutex.Lock()
+	webTheme, webShortcuts = s.Theme, s.Shortcuts
+	webDownsampling = webFullDownsampling(s.Downsampling)
+	webConfigMutex.Unlock()
+
+	webLevelsMutex.Lock()
+	webConfigLevels = s.Levels
+	webLevelsMutex.Unlock()
 }
 
-func webFindMax(data []float64) float64 {
-	if len(data) == 0 {
-		return 0
+// 把运行中的服务从 old 调整到 s：刷新循环按新间隔重新计时；新加入 watchlist 的数据集在后台预加载，
+// 移出的只取消常驻，仍按闲置规则淘汰；失衡监控按新的合约列表增删，阈值变化时重新开始计数；
+// 配色和快捷键变化通过 /updates 推送给已打开的页面；降采样策略变化时重新采样已加载的展示数据
+func webApplySettings(old, s webSettings) {
+	webUseSettings(s)
+
+	if strategy := webFullDownsampling(s.Downsampling); strategy.String() != webFullDownsampling(old.Downsampling).String() {
+		webDataMutex.Lock()
+		for key, view := range webViews {
+			resampled := *view
+			resampled.sampled = webDownsample(view.all, WEB_SAMPLE_SIZE, strategy)
+			webViews[key] = &resampled
+		}
+		webDataMutex.Unlock()
 	}
 
-	var max float64
-	hasValidValue := false
+	if old.RefreshInterval != s.RefreshInterval {
+		select {
+		case webRefreshReset <- struct{}{}:
+		default:
+		}
+	}
 
-	for _, val := range data {
-		if !math.IsInf(val, 0) && !math.IsNaN(val) {
-			if !hasValidValue || val > max {
-				max = val
-				hasValidValue = true
+	webDatasetsMutex.Lock()
+	for _, key := range webMissingKeys(s.Watchlist, old.Watchlist) {
+		if ds, ok := webDatasets[key]; ok {
+			ds.pinned = false
+		}
+	}
+	var preload []webDatasetKey
+	if s.RefreshInterval > 0 || s.CacheTTL > 0 {
+		for _, key := range s.Watchlist {
+			if ds, ok := webDatasets[key]; ok {
+				ds.pinned = true
+			} else {
+				preload = append(preload, key)
 			}
 		}
 	}
-
-	if !hasValidValue {
-		return 0
+	webDatasetsMutex.Unlock()
+	if len(preload) > 0 {
+		go webPreloadDatasets(preload)
 	}
-	return max
-}
 
-func webFindMin(data []float64) float64 {
-	if len(data) == 0 {
-		return 0
+	rulesChanged := old.AlertThreshold != s.AlertThreshold || old.AlertTicks != s.AlertTicks
+	watched := make(map[webFeedKey]bool, len(s.AlertSymbols))
+	for _, key := range s.AlertSymbols {
+		watched[webFeedKey{key.table, key.symbol}] = true
+	}
+	var start []webDatasetKey
+	webFeedsMutex.Lock()
+	for _, key := range s.AlertSymbols {
+		feed, ok := webFeeds[webFeedKey{key.table, key.symbol}]
+		if !ok || feed.imbalance == nil {
+			start = append(start, key)
+		} else if rulesChanged {
+			feed.imbalance = &webImbalanceDetector{threshold: s.AlertThreshold, ticks: s.AlertTicks}
+		}
+	}
+	for key, feed := range webFeeds {
+		if feed.imbalance != nil && !watched[key] {
+			feed.imbalance = nil
+			feed.pinned = false
+			if len(feed.clients) == 0 {
+				delete(webFeeds, key)
+			}
+		}
+	}
+	webFeedsMutex.Unlock()
+	for _, key := range start {
+		go webWatchImbalance(key)
 	}
 
-	var min float64
-	hasValidValue := false
+	changed := old.Theme != s.Theme
+	for _, action := range webShortcutActions {
+		changed = changed || webShortcutKeys(old.Shortcuts[action.name]) != webShortcutKeys(s.Shortcuts[action.name])
+	}
+	if changed {
+		webBroadcastMessage(map[string]interface{}{"type": "config", "theme": s.Theme, "shortcuts": s.Shortcuts})
+	}
+	for _, symbol := range webLevelSymbols(old.Levels, s.Levels) {
+		if webLevelPrices(old.Levels[symbol]) != webLevelPrices(s.Levels[symbol]) {
+			webBroadcastMessage(map[string]interface{}{"type": "levels", "symbol": symbol, "levels": webLevelsFor(symbol)})
+		}
+	}
 
-	for _, val := range data {
-		if !math.IsInf(val, 0) && !math.IsNaN(val) {
-			if !hasValidValue || val < min {
-				min = val
-				hasValidValue = true
-			}
+	// 正在使用的连接配置被修改时按新的配置重新连接，被删除时回到默认配置
+	webProfileMutex.RLock()
+	active := webActiveProfile
+	webProfileMutex.RUnlock()
+	before, existed := old.Profiles[active]
+	after, exists := s.Profiles[active]
+	if existed && exists && after != before {
+		webSwitchProfile(active, after)
+	} else if existed && !exists {
+		if p, ok := s.Profiles[WEB_DEFAULT_PROFILE]; ok {
+			webSwitchProfile(WEB_DEFAULT_PROFILE, p)
 		}
 	}
+}
 
-	if !hasValidValue {
-		return 0
+// 向所有 /updates 订阅者推送一条消息，处理不过来的客户端直接丢弃
+func webBroadcastMessage(msg map[string]interface{}) {
+	message, _ := json.Marshal(msg)
+	webUpdateSubscribersMutex.Lock()
+	defer webUpdateSubscribersMutex.Unlock()
+	for ch := range webUpdateSubscribers {
+		select {
+		case ch <- string(message):
+		default:
+		}
 	}
-	return min
 }
 
-func webCalculateAverage(data []float64) float64 {
-	if len(data) == 0 {
-		return 0
+// 重新加载配置文件并应用差异，返回本次加载记录
+func webReloadConfig(path string) webConfigReload {
+	webConfigMutex.Lock()
+	old := webConfigCurrent
+	webConfigMutex.Unlock()
+
+	reload := webConfigReload{Time: time.Now().Format("2006-01-02 15:04:05"), Changes: []string{}}
+	s, err := webLoadSettings(path, webConfigBase)
+	if err != nil {
+		reload.Error = err.Error()
+		log.Printf("Config reload failed, keeping the previous settings: %v", err)
+	} else {
+		reload.Changes = webDiffSettings(old, s)
+		webApplySettings(old, s)
+		log.Printf("Config %s reloaded: %d changes %v", path, len(reload.Changes), reload.Changes)
 	}
-	sum := 0.0
-	validCount := 0
-	for _, val := range data {
-		if !math.IsInf(val, 0) && !math.IsNaN(val) {
-			sum += val
-			validCount++
-		}
+
+	webConfigMutex.Lock()
+	if err == nil {
+		webConfigCurrent = s
+		webConfigLoadedAt = time.Now()
 	}
-	if validCount == 0 {
-		return 0
+	webConfigHistory = append(webConfigHistory, reload)
+	if len(webConfigHistory) > CONFIG_HISTORY {
+		webConfigHistory = webConfigHistory[len(webConfigHistory)-CONFIG_HISTORY:]
 	}
-	return sum / float64(validCount)
+	webConfigMutex.Unlock()
+	return reload
 }
 
-// 获取所有表的API处理器
-func webTablesHandler(w http.ResponseWriter, r *http.Request) {
-	query := "SHOW TABLES"
-	result, err := webExecuteQuery(query)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("获取表列表失败: %v", err),
-		})
-		return
+// 轮询配置文件的修改时间和大小，变化时重新加载。编辑器保存时常先删除再重建文件，
+// 文件暂时不存在时等下一次检查，不算作修改
+func webWatchConfig(path string) {
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
 	}
 
-	lines := strings.Split(strings.TrimSpace(result), "\n")
-	var tables []string
-	for _, line := range lines {
-		if line != "" {
-			tables = append(tables, strings.TrimSpace(line))
+	ticker := time.NewTicker(CONFIG_POLL_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+			continue
 		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		webReloadConfig(path)
 	}
+}
 
-	response := map[string]interface{}{
-		"tables": tables,
+// 设置的JSON表示，与配置文件的格式一致
+func (s webSettings) view() map[string]interface{} {
+	watchlist := make([]string, len(s.Watchlist))
+	for i, key := range s.Watchlist {
+		watchlist[i] = key.String()
+	}
+	alerts := make([]string, len(s.AlertSymbols))
+	for i, key := range s.AlertSymbols {
+		alerts[i] = key.table + "/" + key.symbol
+	}
+	levels := make(map[string]string, len(s.Levels))
+	for symbol, list := range s.Levels {
+		levels[symbol] = webLevelPrices(list)
+	}
+	// 密码不显示
+	profiles := make(map[string]interface{}, len(s.Profiles))
+	for name, p := range s.Profiles {
+		profiles[name] = map[string]string{"url": p.URL, "database": p.Database, "user": p.User}
 	}
+	return map[string]interface{}{
+		"watchlist": watchlist,
+		"alerts": map[string]interface{}{
+			"symbols":   alerts,
+			"threshold": s.AlertThreshold,
+			"ticks":     s.AlertTicks,
+		},
+		"refresh_interval": s.RefreshInterval.String(),
+		"cache_ttl":        s.CacheTTL.String(),
+		"catalog_ttl":      s.CatalogTTL.String(),
+		"theme":            s.Theme,
+		"shortcuts":        s.Shortcuts,
+		"profiles":         profiles,
+		"downsampling":     webFullDownsampling(s.Downsampling),
+		"levels":           levels,
+	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// 切换到另一个ClickHouse连接配置：之后的查询发往新的集群/数据库，已缓存的数据集、展示数据和表/合约目录
+// 都属于原来的配置，全部丢弃后按需重新查询（watchlist 在后台重新预加载）；已打开的页面通过 /updates 收到通知后重新加载
+func webSwitchProfile(name string, p webClickHouseProfile) {
+	webUseProfile(name, p)
+
+	webDatasetsMutex.Lock()
+	webProfileGeneration.Add(1)
+	webDatasets = make(map[webDatasetKey]*webDataset)
+	webDatasetsMutex.Unlock()
+	webDataMutex.Lock()
+	webViews = make(map[webDatasetKey]*webView)
+	webDataMutex.Unlock()
+	webCatalogMutex.Lock()
+	webCatalog = make(map[string]*webCatalogEntry)
+	webCatalogMutex.Unlock()
+
+	log.Printf("Switched to ClickHouse profile %s: %s", name, p)
+	if webCacheEnabled() {
+		webConfigMutex.Lock()
+		watchlist := webConfigCurrent.Watchlist
+		webConfigMutex.Unlock()
+		go webPreloadDatasets(watchlist)
+	}
+	webBroadcastMessage(map[string]interface{}{"type": "profile", "profile": name})
 }
 
-// 获取指定表的所有symbol的API处理器
-func webSymbolsHandler(w http.ResponseWriter, r *http.Request) {
-	table := r.URL.Query().Get("table")
-	if table == "" {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": "缺少table参数",
-		})
-		return
+// 替换当前连接配置对应的全局变量
+func webUseProfile(name string, p webClickHouseProfile) {
+	webProfileMutex.Lock()
+	webActiveProfile = name
+	webClickHouseURL, webClickHouseDatabase, webClickHouseUser, webClickHousePassword = p.URL, p.Database, p.User, p.Password
+	webProfileMutex.Unlock()
+}
+
+// 页面下拉框显示的连接配置列表，按名称排序，不含密码
+func webProfileList(profiles map[string]webClickHouseProfile) []map[string]string {
+	list := make([]map[string]string, 0, len(profiles))
+	for _, name := range webSortedProfileNames(profiles) {
+		p := profiles[name]
+		list = append(list, map[string]string{"name": name, "url": p.URL, "database": p.Database, "user": p.User})
 	}
+	return list
+}
 
-	// 验证表名是否存在，防止SQL注入
-	checkQuery := fmt.Sprintf("SELECT 1 FROM feature.%s LIMIT 1", table)
-	_, err := webExecuteQuery(checkQuery)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("表 %s 不存在或无法访问", table),
-		})
+// 连接配置接口：GET 返回当前使用的配置和可选的配置列表，POST ?name=prod 切换配置。
+// 切换对所有用户和页面生效，只有管理员可以切换；未启用访问控制时无法识别管理员，一律拒绝
+func webProfileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := webRequestUser(r)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if u == nil || !u.Admin {
+			msg := "切换ClickHouse配置需要启用访问控制 (-acl) 并使用管理员令牌"
+			if u != nil {
+				msg = fmt.Sprintf("用户 %s 无权切换ClickHouse配置", u.Name)
+			}
+			webACLDeny(w, http.StatusForbidden, msg)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		webConfigMutex.Lock()
+		p, ok := webConfigCurrent.Profiles[name]
+		webConfigMutex.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("未定义的配置 %q", name)})
+			return
+		}
+		webSwitchProfile(name, p)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "只支持GET和POST请求"})
 		return
 	}
 
-	query := fmt.Sprintf("SELECT DISTINCT symbol FROM feature.%s ORDER BY symbol", table)
-	result, err := webExecuteQuery(query)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("获取symbol列表失败: %v", err),
-		})
+	webConfigMutex.Lock()
+	profiles := webConfigCurrent.Profiles
+	webConfigMutex.Unlock()
+	webProfileMutex.RLock()
+	active := webActiveProfile
+	webProfileMutex.RUnlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active":     active,
+		"profiles":   webProfileList(profiles),
+		"can_switch": u != nil && u.Admin,
+	})
+}
+
+// 当前生效的设置、配置文件路径和最近的加载记录（最新在前）。启用访问控制时只有管理员可以查看
+func webConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if u := webRequestUser(r); u != nil && !u.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("用户 %s 无权查看运行时配置", u.Name)})
 		return
 	}
 
-	lines := strings.Split(strings.TrimSpace(result), "\n")
-	var symbols []string
-	for _, line := range lines {
-		if line != "" {
-			symbols = append(symbols, strings.TrimSpace(line))
-		}
+	webConfigMutex.Lock()
+	current := webConfigCurrent
+	history := make([]webConfigReload, 0, len(webConfigHistory))
+	for i := len(webConfigHistory) - 1; i >= 0; i-- {
+		history = append(history, webConfigHistory[i])
+	}
+	loadedAt := ""
+	if !webConfigLoadedAt.IsZero() {
+		loadedAt = webConfigLoadedAt.Format("2006-01-02 15:04:05")
 	}
+	webConfigMutex.Unlock()
 
-	response := map[string]interface{}{
-		"table":   table,
-		"symbols": symbols,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":      webConfigPath,
+		"loaded_at": loadedAt,
+		"settings":  current.view(),
+		"defaults":  webConfigBase.view(),
+		"reloads":   history,
+	})
+}
+
+// 运行时配置页面的HTML模板 (templates/config.html)
+const webConfigTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>运行时配置</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            margin: 0;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            max-width: 1100px;
+            margin: 0 auto;
+            background-color: white;
+            padding: 20px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1, h2 {
+            text-align: center;
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 13px;
+            margin-bottom: 20px;
+        }
+        th, td {
+            border-bottom: 1px solid #dee2e6;
+            padding: 6px 8px;
+            text-align: left;
+            vertical-align: top;
+        }
+        th {
+            background-color: #f8f9fa;
+        }
+        td.value {
+            font-family: monospace;
+        }
+        tr.overridden td {
+            background-color: #fff3cd;
+        }
+        tr.failed td {
+            color: #dc3545;
+        }
+        .status {
+            text-align: center;
+            padding: 10px;
+            color: #555;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>运行时配置</h1>
+        <div class="status" id="status"></div>
+        <table>
+            <thead><tr><th>设置</th><th>当前值</th><th>命令行参数</th></tr></thead>
+            <tbody id="settings"></tbody>
+        </table>
+        <h2>加载记录</h2>
+        <table>
+            <thead><tr><th>时间</th><th>变化 / 错误</th></tr></thead>
+            <tbody id="reloads"></tbody>
+        </table>
+    </div>
+    <script>
+        function cell(row, text, className) {
+            const td = document.createElement('td');
+            td.textContent = text;
+            if (className) {
+                td.className = className;
+            }
+            row.appendChild(td);
+        }
+
+        // 把嵌套的设置展开成 alerts.threshold 这样的键
+        function flatten(obj, prefix, out) {
+            for (const [key, value] of Object.entries(obj)) {
+                if (value !== null && typeof value === 'object' && !Array.isArray(value)) {
+                    flatten(value, prefix + key + '.', out);
+                } else {
+                    out[prefix + key] = Array.isArray(value) ? value.join(', ') || '-' : String(value);
+                }
+            }
+            return out;
+        }
+
+        async function loadConfig() {
+            const response = await fetch('/api/v1/config');
+            const result = await response.json();
+            const status = document.getElementById('status');
+            if (result.error) {
+                status.textContent = result.error;
+                return;
+            }
+            status.textContent = result.path
+                ? '配置文件 ' + result.path + '，最后成功加载于 ' + result.loaded_at + '，修改后自动生效'
+                : '未指定 -config，当前设置全部来自命令行参数';
+
+            const current = flatten(result.settings, '', {});
+            const defaults = flatten(result.defaults, '', {});
+            const settings = document.getElementById('settings');
+            settings.innerHTML = '';
+            for (const key of Object.keys(current)) {
+                const row = document.createElement('tr');
+                if (current[key] !== defaults[key]) {
+                    row.className = 'overridden';
+                }
+                cell(row, key);
+                cell(row, current[key], 'value');
+                cell(row, defaults[key], 'value');
+                settings.appendChild(row);
+            }
+
+            const reloads = document.getElementById('reloads');
+            reloads.innerHTML = '';
+            for (const reload of result.reloads) {
+                const row = document.createElement('tr');
+                if (reload.error) {
+                    row.className = 'failed';
+                }
+                cell(row, reload.time);
+                cell(row, reload.error || (reload.changes.length ? reload.changes.join('\n') : '无变化'), 'value');
+                row.lastChild.style.whiteSpace = 'pre-wrap';
+                reloads.appendChild(row);
+            }
+            if (!result.reloads.length) {
+                const row = document.createElement('tr');
+                cell(row, '-');
+                cell(row, '启动后还没有重新加载过');
+                reloads.appendChild(row);
+            }
+        }
+
+        loadConfig();
+        setInterval(loadConfig, 5000);
+    </script>
+</body>
+</html>`
+
+// 运行时配置页面：当前生效的设置（与命令行参数不同的项高亮）和每次重新加载改变了什么
+func webConfigPageHandler(w http.ResponseWriter, r *http.Request) {
+	if u := webRequestUser(r); u != nil && !u.Admin {
+		http.Error(w, fmt.Sprintf("用户 %s 无权查看运行时配置", u.Name), http.StatusForbidden)
+		return
 	}
+	tmpl := webTemplate("config.html")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(tmpl))
 }
@@ -0,0 +1,4568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var (
+	// go test ... -record http://xm.local:8123 把查询转发到真实的ClickHouse并录制响应
+	recordClickHouse = flag.String("record", "", "转发查询到该ClickHouse地址并把响应录制到 testdata/clickhouse")
+	// go test ... -update 用当前输出重新生成 testdata/golden 下的期望结果
+	updateGolden = flag.Bool("update", false, "重新生成 testdata/golden 下的期望输出")
+	// go test ... -bench . -bench-rows 100000 用较小的数据集快速试跑基准测试
+	benchRows = flag.Int("bench-rows", 1000000, "基准测试生成的tick行数")
+)
+
+// 假的ClickHouse HTTP服务：按规整空白后的查询文本的哈希，从 testdata/clickhouse/<hash>.tsv 读取录制的响应，
+// 同名 .sql 文件保存查询原文便于查看。没有录制的查询返回404并让测试失败，提示用 -record 录制
+type fakeClickHouse struct {
+	t      testing.TB
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests int
+}
+
+func newFakeClickHouse(t testing.TB) *fakeClickHouse {
+	t.Helper()
+	fake := &fakeClickHouse{t: t}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	oldURL := webClickHouseURL
+	webClickHouseURL = fake.server.URL
+	resetCatalog()
+	t.Cleanup(func() {
+		webClickHouseURL = oldURL
+		fake.server.Close()
+		resetCatalog()
+	})
+	return fake
+}
+
+// 表和合约目录按ClickHouse地址缓存，切换假服务器前后清空
+func resetCatalog() {
+	webCatalogMutex.Lock()
+	webCatalog = make(map[string]*webCatalogEntry)
+	webCatalogMutex.Unlock()
+}
+
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func fixturePath(query string) string {
+	sum := sha1.Sum([]byte(normalizeQuery(query)))
+	return filepath.Join("testdata", "clickhouse", hex.EncodeToString(sum[:6]))
+}
+
+func (f *fakeClickHouse) serve(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	path := fixturePath(query)
+	f.mu.Lock()
+	f.requests++
+	f.mu.Unlock()
+
+	if *recordClickHouse != "" {
+		resp, err := http.Get(*recordClickHouse + "/?" + r.URL.RawQuery)
+		if err != nil {
+			f.t.Errorf("record %q: %v", normalizeQuery(query), err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK {
+			os.MkdirAll(filepath.Dir(path), 0755)
+			os.WriteFile(path+".sql", []byte(normalizeQuery(query)+"\n"), 0644)
+			os.WriteFile(path+".tsv", body, 0644)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	body, err := os.ReadFile(path + ".tsv")
+	if err != nil {
+		f.t.Errorf("no recorded response for query (want %s.tsv, record with -record):\n%s", path, normalizeQuery(query))
+		http.Error(w, "no fixture", http.StatusNotFound)
+		return
+	}
+	w.Write(body)
+}
+
+// 与 testdata/golden/<name> 比较，-update 时改为写入
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file %s (generate with -update): %v", path, err)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	if filepath.Ext(name) == ".png" {
+		// 二进制图片不打印内容，把实际输出写到golden旁边的 <name>.actual.png，测试结束后仍可和golden图片对比查看
+		actual := strings.TrimSuffix(path, ".png") + ".actual.png"
+		if err := os.WriteFile(actual, got, 0644); err != nil {
+			t.Errorf("%s differs from golden output (%d bytes, want %d) and writing the actual output failed: %v", path, len(got), len(want), err)
+			return
+		}
+		t.Errorf("%s differs from golden output (%d bytes, want %d), actual output written to %s (regenerate with -update if intended)", path, len(got), len(want), actual)
+		return
+	}
+	t.Errorf("%s differs from golden output (regenerate with -update if intended)\n got: %s\nwant: %s", path, got, want)
+}
+
+// 去掉随请求时间变化的字段后缩进输出，便于在golden文件中查看差异
+func goldenJSON(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid JSON %s: %v", body, err)
+	}
+	delete(resp, "timestamp")
+	out, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(out, '\n')
+}
+
+// 与 WebMarketData 字段和标签相同但没有自定义 MarshalJSON，用来对照 encoding/json 的默认输出
+type webMarketDataPlain WebMarketData
+
+func TestWebMarketDataMarshalJSONMatchesDefault(t *testing.T) {
+	records := []WebMarketData{
+		{Symbol: "jm2509", Time: "2025-07-01 09:00:00", Price: 1234.5, Vol: 100, OpenInterest: 200000,
+			DiffVol: -3, DiffOI: 7, Bid1: 1234, BidVolumn1: 5, Ask1: 1235, AskVolumn1: 6, DateTime: 1751331600000},
+		{Symbol: "au\"2508\"", Time: "2025-07-01 09:00:01", Price: 0.0000001, Bid1: 1e22, Ask1: -2.25},
+		{},
+	}
+	for _, record := range records {
+		got, err := json.Marshal(record)
+		if err != nil {
+			t.Fatalf("Marshal(%+v): %v", record, err)
+		}
+		want, err := json.Marshal(webMarketDataPlain(record))
+		if err != nil {
+			t.Fatalf("Marshal plain(%+v): %v", record, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("Marshal(%+v)\n got %s\nwant %s", record, got, want)
+		}
+	}
+}
+
+func TestWebMarketDataMarshalJSONNonFinite(t *testing.T) {
+	record := WebMarketData{
+		Symbol: "jm2509",
+		Time:   "2025-07-01 09:00:00",
+		Price:  float32(math.NaN()),
+		Bid1:   float32(math.Inf(1)),
+		Ask1:   float32(math.Inf(-1)),
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	for _, field := range []string{"price", "bid_1", "ask_1"} {
+		if v, ok := decoded[field]; !ok || v != nil {
+			t.Errorf("%s = %v, want null", field, v)
+		}
+	}
+}
+
+func TestWebDataHandlerNonFiniteTick(t *testing.T) {
+	webMaxRawPoints = 1000
+	webSetLoadedData(webDefaultKey, []WebMarketData{
+		{Symbol: "NaN2509", Time: "2025-07-01 09:00:00", Price: 100, OpenInterest: 10},
+		{Symbol: "NaN2509", Time: "2025-07-01 09:00:01", Price: float32(math.NaN()), OpenInterest: 11},
+		{Symbol: "NaN2509", Time: "2025-07-01 09:00:02", Price: float32(math.Inf(1)), OpenInterest: 12},
+		{Symbol: "NaN2509", Time: "2025-07-01 09:00:03", Price: 102, OpenInterest: 13},
+	}, webProfileGeneration.Load())
+
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?raw=1", nil))
+
+	var resp struct {
+		Error string                   `json:"error"`
+		Data  []map[string]interface{} `json:"data"`
+		Stats map[string]interface{}   `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rec.Body.String(), err)
+	}
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(resp.Data) != 4 {
+		t.Fatalf("got %d records, want 4", len(resp.Data))
+	}
+	if resp.Data[1]["price"] != nil || resp.Data[2]["price"] != nil {
+		t.Errorf("non-finite prices = %v, %v, want null", resp.Data[1]["price"], resp.Data[2]["price"])
+	}
+	if resp.Stats["avg_price"] != 101.0 || resp.Stats["max_price"] != 102.0 {
+		t.Errorf("stats = %v, want avg 101 and max 102 from finite prices only", resp.Stats)
+	}
+}
+
+func TestWebComputeWindowStatsSkipsNonFinite(t *testing.T) {
+	stats := webComputeWindowStats([]WebMarketData{
+		{Price: 100},
+		{Price: float32(math.NaN())},
+		{Price: 102},
+	})
+	if _, err := json.Marshal(stats); err != nil {
+		t.Fatalf("Marshal(%+v): %v", stats, err)
+	}
+	if stats.Mean != 101 || stats.StdDev != 1 || stats.ChangePct != 2 {
+		t.Errorf("stats = %+v, want mean 101, stddev 1, change 2%%", stats)
+	}
+}
+
+func TestWebPriceFormat(t *testing.T) {
+	record := WebMarketData{Symbol: "jm2509", Price: 737.4, Bid1: 737, Ask1: float32(math.NaN())}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", `"price":737.4,`},
+		{"price_format=raw", `"price":737.4,`},
+		{"price_format=string", `"price":"737.4",`},
+		{"decimals=2", `"price":737.40,`},
+		{"price_format=string&decimals=0", `"price":"737",`},
+	}
+	for _, tt := range tests {
+		pf, err := webParsePriceFormat(httptest.NewRequest("GET", "/data?"+tt.query, nil), record.Symbol)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		b, err := json.Marshal(webFormattedRecords{[]WebMarketData{record}, pf})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if !json.Valid(b) || !strings.Contains(string(b), tt.want) || !strings.Contains(string(b), `"ask_1":null`) {
+			t.Errorf("%s: got %s, want it to contain %s and a null ask_1", tt.query, b, tt.want)
+		}
+	}
+
+	// 最小变动价位未知的品种默认保留完整精度，不按0位小数输出
+	unknown := WebMarketData{Symbol: "IF2509", Price: 3801.2, Bid1: 3801.2, Ask1: 3801.4}
+	for query, want := range map[string]string{
+		"":                    `"price":3801.2,"vol":0,"open_interest":0,"diff_vol":0,"diff_oi":0,"bid_1":3801.2,"bid_volumn_1":0,"ask_1":3801.4,`,
+		"price_format=string": `"price":"3801.2",`,
+		"decimals=0":          `"price":3801,`,
+	} {
+		pf, err := webParsePriceFormat(httptest.NewRequest("GET", "/data?"+query, nil), unknown.Symbol)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		b, _ := json.Marshal(webFormattedRecords{[]WebMarketData{unknown}, pf})
+		if !strings.Contains(string(b), want) {
+			t.Errorf("IF2509 %q: got %s, want it to contain %s", query, b, want)
+		}
+	}
+	if got := webPriceDecimals("IF2509"); got != -1 {
+		t.Errorf("webPriceDecimals(IF2509) = %d, want -1", got)
+	}
+
+	if _, err := webParsePriceFormat(httptest.NewRequest("GET", "/data?price_format=hex", nil), "jm2509"); err == nil {
+		t.Error("expected error for unknown price_format")
+	}
+}
+
+func TestWebPriceFormatRound(t *testing.T) {
+	price := float64(float32(737.4))
+	if got := (webPriceFormat{decimals: 1}).round(price, 0); got != 737.4 {
+		t.Errorf("round(%v) = %v, want 737.4", price, got)
+	}
+	if got := webRawPriceFormat.round(price, 0); got != 737.4 {
+		t.Errorf("raw round(%v) = %v, want 737.4", price, got)
+	}
+	if got := webPriceDecimals("au2508"); got != 2 {
+		t.Errorf("webPriceDecimals(au2508) = %d, want 2", got)
+	}
+}
+
+func TestWebPriceTicks(t *testing.T) {
+	tests := []struct {
+		price float32
+		tick  float64
+		ticks int64
+		value float64
+	}{
+		{737.4, 0.5, 1475, 737.5}, // 不在价位上的价格按最近的tick取整
+		{737.5, 0.5, 1475, 737.5},
+		{0.3, 0.1, 3, 0.3},
+		{456.78, 0.02, 22839, 456.78},
+		{68400, 10, 6840, 68400},
+	}
+	for _, tt := range tests {
+		ticks := webPriceToTicks(tt.price, tt.tick)
+		if ticks != tt.ticks {
+			t.Errorf("webPriceToTicks(%v, %v) = %d, want %d", tt.price, tt.tick, ticks, tt.ticks)
+		}
+		if got := webTicksToPrice(ticks, tt.tick); got != tt.value {
+			t.Errorf("webTicksToPrice(%d, %v) = %v, want %v", ticks, tt.tick, got, tt.value)
+		}
+	}
+
+	// 中间价使用半个tick，价差为精确整数
+	bid, ask := webPriceToTicks(0.1, 0.1), webPriceToTicks(0.2, 0.1)
+	if mid := webTicksToPrice(bid+ask, 0.05); mid != 0.15 {
+		t.Errorf("mid = %v, want 0.15", mid)
+	}
+	if got := webPriceValue(737.4, "i2509"); got != 737.5 {
+		t.Errorf("webPriceValue(737.4, i2509) = %v, want 737.5", got)
+	}
+	if got := webPriceValue(737.4, "c2509"); got != 737 {
+		t.Errorf("webPriceValue(737.4, c2509) = %v, want 737", got)
+	}
+}
+
+func TestWebUnknownTickSize(t *testing.T) {
+	// IF 不在品种表中：最小变动价位未知，价格保持原值而不是取整到1
+	if tick := webTickSizeFor("IF2509"); tick != 0 {
+		t.Fatalf("webTickSizeFor(IF2509) = %v, want 0", tick)
+	}
+	if got := webPriceValue(3801.2, "IF2509"); got != 3801.2 {
+		t.Errorf("webPriceValue(3801.2, IF2509) = %v, want 3801.2", got)
+	}
+	md := WebMarketData{Symbol: "IF2509", Price: 3801.2, Bid1: 3801.2, Ask1: 3801.4}
+	for series, want := range map[string]float64{"price": 3801.2, "mid": 3801.3, "spread": 0.2} {
+		if got := webDisplaySeriesValue(md, series); got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+
+	// 按跳计数的统计用数据中的最小价差估计tick
+	if got := webEstimateTickSize([]float64{3801.2, 3801.4, 3801.2, 3802, 0}); got != 0.2 {
+		t.Errorf("webEstimateTickSize = %v, want 0.2", got)
+	}
+	if got := webEstimateTickSize([]float64{3801.2}); got != 0 {
+		t.Errorf("webEstimateTickSize of one price = %v, want 0", got)
+	}
+	data := []WebMarketData{
+		{Symbol: "IF2509", Time: "2025-07-01 09:30:00", Price: 3801.2, Bid1: 3801.2, Ask1: 3801.4},
+		{Symbol: "IF2509", Time: "2025-07-01 09:30:01", Price: 3802.4, Bid1: 3801.8, Ask1: 3802.4},
+		{Symbol: "IF2509", Time: "2025-07-01 09:30:02", Price: 3801.4, Bid1: 3801.2, Ask1: 3801.4},
+	}
+	if stats := webComputeSpreadStats(data, 0); stats.Quoted != 3 || stats.MaxTicks != 3 || stats.AvgTicks != 5.0/3 {
+		t.Errorf("spread stats = %+v", stats)
+	}
+	report := webBuildDailyReport("if", "IF2509", time.Date(2025, 7, 1, 0, 0, 0, 0, time.Local), data)
+	if report.Open != 3801.2 || report.High != 3802.4 || report.Change != 0.2 || report.TickSize != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	if md := report.markdown(); !strings.Contains(md, "3801.2") || !strings.Contains(md, "3802.4") {
+		t.Errorf("markdown lost fractional prices:\n%s", md)
+	}
+	pivots := webFindPivots(data, 2, 0.2)
+	if len(pivots) == 0 || pivots[0].Price != 3801.2 {
+		t.Errorf("pivots = %+v", pivots)
+	}
+	if pivots := webFindPivots(data, 2, 0); pivots != nil {
+		t.Errorf("pivots without tick = %+v", pivots)
+	}
+}
+
+func TestWebBuildHeatmap(t *testing.T) {
+	heatmap := webBuildHeatmap([]webHeatmapCell{
+		{Day: "2025-07-01", Slot: "09:00", OI: 100},
+		{Day: "2025-07-01", Slot: "21:00", OI: -40},
+		{Day: "2025-07-02", Slot: "09:00", OI: 300},
+		{Day: "2025-07-02", Slot: "10:30", OI: -50},
+	})
+
+	slots := heatmap["slots"].([]string)
+	if strings.Join(slots, ",") != "09:00,10:30,21:00" {
+		t.Fatalf("slots = %v", slots)
+	}
+	values := heatmap["values"].([][]*float64)
+	if len(values) != 2 || values[0][1] != nil || *values[0][2] != -40 || *values[1][1] != -50 {
+		t.Errorf("unexpected matrix %v", values)
+	}
+	avg := heatmap["slot_avg"].([]float64)
+	if avg[0] != 200 || avg[1] != -50 || avg[2] != -40 {
+		t.Errorf("slot_avg = %v, want [200 -50 -40]", avg)
+	}
+	if heatmap["max_abs"] != 300.0 {
+		t.Errorf("max_abs = %v, want 300", heatmap["max_abs"])
+	}
+}
+
+func TestWebBuildLadder(t *testing.T) {
+	book := &webBook{
+		Price: 1000.5,
+		Bids:  []webBookLevel{{Price: 1000, Volume: 12}, {Price: 999.5, Volume: 30}},
+		Asks:  []webBookLevel{{Price: 1000.5, Volume: 8}, {Price: 1001.5, Volume: 5}},
+	}
+	rows := webBuildLadder(book, 0.5, 3)
+
+	if len(rows) != 7 || rows[0].Price != 1002 || rows[6].Price != 999 {
+		t.Fatalf("ladder should span 1002..999 from high to low, got %+v", rows)
+	}
+	// 最新价在中间一行，恰好也是卖一
+	if !rows[3].Last || !rows[3].BestAsk || rows[3].AskSize != 8 {
+		t.Errorf("middle row = %+v, want last price with ask 8", rows[3])
+	}
+	if rows[1].AskSize != 5 || rows[2].AskSize != 0 {
+		t.Errorf("ask sizes = %d, %d, want 5, 0", rows[1].AskSize, rows[2].AskSize)
+	}
+	if !rows[4].BestBid || rows[4].BidSize != 12 || rows[5].BidSize != 30 || rows[6].BidSize != 0 {
+		t.Errorf("bid rows = %+v", rows[4:])
+	}
+}
+
+func TestWebImbalanceDetector(t *testing.T) {
+	d := &webImbalanceDetector{threshold: 0.5, ticks: 3}
+	book := func(bid, ask uint32) WebMarketData {
+		return WebMarketData{BidVolumn1: bid, AskVolumn1: ask}
+	}
+
+	// 买盘占优连续3笔触发一次，之后持续失衡不重复告警；换边后重新计数
+	steps := []struct {
+		md    WebMarketData
+		fired bool
+	}{
+		{book(90, 10), false},
+		{book(80, 20), false},
+		{book(0, 0), false}, // 双边无挂单，连续计数中断
+		{book(90, 10), false},
+		{book(90, 10), false},
+		{book(85, 5), true},
+		{book(90, 10), false},
+		{book(10, 90), false},
+		{book(10, 90), false},
+		{book(5, 95), true},
+		{book(50, 50), false},
+	}
+	for i, step := range steps {
+		if _, fired := d.observe(step.md); fired != step.fired {
+			t.Errorf("step %d: fired = %v, want %v", i, fired, step.fired)
+		}
+	}
+
+	if v, ok := webBookImbalance(book(30, 10)); !ok || v != 0.5 {
+		t.Errorf("imbalance = %v, %v, want 0.5", v, ok)
+	}
+}
+
+func TestWebVolRegimes(t *testing.T) {
+	// 价格先小幅来回波动，中间一段大幅波动，最后几乎不动
+	var data []WebMarketData
+	start := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	step := func(n int, amplitude float32) {
+		for i := 0; i < n; i++ {
+			price := float32(1000)
+			if len(data)%2 == 1 {
+				price += amplitude
+			}
+			data = append(data, WebMarketData{
+				Time:  start.Add(time.Duration(len(data)) * 2 * time.Second).Format("2006-01-02 15:04:05"),
+				Price: price,
+			})
+		}
+	}
+	step(30, 1)
+	step(30, 8)
+	step(30, 0.1)
+
+	regimes, median := webVolRegimes(data, webVolRegimeParams{window: 5, low: 0.5, high: 2})
+	if median <= 0 {
+		t.Fatalf("median = %v, want > 0", median)
+	}
+	var got []string
+	for i, regime := range regimes {
+		got = append(got, regime.Regime)
+		if regime.Type != "box" || regime.XMin >= regime.XMax {
+			t.Errorf("regime %d = %+v", i, regime)
+		}
+		if i > 0 && regime.XMin != regimes[i-1].XMax {
+			t.Errorf("regime %d starts at %s, previous ends at %s", i, regime.XMin, regimes[i-1].XMax)
+		}
+	}
+	if strings.Join(got, ",") != "normal,high,low" {
+		t.Errorf("regimes = %v, want normal,high,low", got)
+	}
+	if regimes[0].XMin != data[5].Time || regimes[len(regimes)-1].XMax != data[len(data)-1].Time {
+		t.Errorf("regimes span %s ~ %s", regimes[0].XMin, regimes[len(regimes)-1].XMax)
+	}
+
+	if regimes, _ := webVolRegimes(data[:5], webVolRegimeParams{window: 5, low: 0.5, high: 2}); regimes != nil {
+		t.Errorf("too few points should produce no regimes, got %v", regimes)
+	}
+}
+
+func TestWebSessionVWAP(t *testing.T) {
+	// 7月1日交易日：成交价 100×1、102×3，VWAP 101.5，σ = √0.75；20:00 之后为7月2日交易日的夜盘，重新累计
+	all := []WebMarketData{
+		{Time: "2025-07-01 09:00:00", Price: 99, DiffVol: 0},
+		{Time: "2025-07-01 09:00:01", Price: 100, DiffVol: 1},
+		{Time: "2025-07-01 09:00:02", Price: 102, DiffVol: 3},
+		{Time: "2025-07-01 14:59:59", Price: float32(math.NaN()), DiffVol: 5},
+		{Time: "2025-07-01 21:00:00", Price: 110, DiffVol: 0},
+		{Time: "2025-07-01 21:00:01", Price: 110, DiffVol: 2},
+	}
+	bands := webSessionVWAP(all, all, []float64{1, 2}, webRawPriceFormat)
+	value := func(v *float64) string {
+		if v == nil {
+			return "null"
+		}
+		return strconv.FormatFloat(*v, 'f', 3, 64)
+	}
+	var got []string
+	for k := range all {
+		got = append(got, value(bands.VWAP[k])+"±"+value(bands.Upper[0][k]))
+	}
+	sigma := math.Sqrt(0.75)
+	want := []string{"null±null", "100.000±100.000", "101.500±" + strconv.FormatFloat(101.5+sigma, 'f', 3, 64),
+		"101.500±" + strconv.FormatFloat(101.5+sigma, 'f', 3, 64), "null±null", "110.000±110.000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("vwap = %v, want %v", got, want)
+	}
+	if *bands.Lower[1][2] != 101.5-2*sigma {
+		t.Errorf("-2σ = %v, want %v", *bands.Lower[1][2], 101.5-2*sigma)
+	}
+
+	// 采样后的点仍按全部tick累计
+	sampled := webSessionVWAP(all, []WebMarketData{all[0], all[3]}, []float64{1}, webRawPriceFormat)
+	if sampled.VWAP[0] != nil || *sampled.VWAP[1] != 101.5 {
+		t.Errorf("sampled vwap = %v %v", sampled.VWAP[0], sampled.VWAP[1])
+	}
+
+	for query, want := range map[string]string{
+		"":                      "<nil>",
+		"vwap=1":                "[1 2]",
+		"vwap=1&vwap_k=2.5,1":   "[1 2.5]",
+		"vwap=1&vwap_k=0":       "error",
+		"vwap=1&vwap_k=1,2,3,4": "error",
+	} {
+		q, _ := url.ParseQuery(query)
+		k, err := webParseVWAPParams(q)
+		got := fmt.Sprint(k)
+		if k == nil {
+			got = "<nil>"
+		}
+		if err != nil {
+			got = "error"
+		}
+		if got != want {
+			t.Errorf("%q: bands = %s, want %s", query, got, want)
+		}
+	}
+
+	// /data?vwap=1 返回与数据点一一对应的VWAP带
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01&vwap=1", nil))
+	var resp struct {
+		Data []WebMarketData `json:"data"`
+		VWAP webVWAPBands    `json:"vwap"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %.200s", err, rec.Body.String())
+	}
+	if len(resp.VWAP.VWAP) != len(resp.Data) || len(resp.VWAP.Upper) != 2 || resp.VWAP.VWAP[0] == nil || *resp.VWAP.VWAP[0] != 1001 {
+		t.Errorf("vwap = %+v", resp.VWAP)
+	}
+}
+
+func TestWebPivots(t *testing.T) {
+	// 反转3跳确认：低点100、高点103、低点99，最后的104还没有反转，未确认
+	var data []WebMarketData
+	for i, price := range []float32{100, 101, 103, 102, 100, 99, 101, 104, 103} {
+		data = append(data, WebMarketData{Symbol: "tst2509", Time: fmt.Sprintf("2025-07-01 09:00:%02d", i*2), Price: price})
+	}
+	var got []string
+	for _, p := range webFindPivots(data, 3, 1) {
+		got = append(got, fmt.Sprintf("%s %s %v %v %ds %v", p.Time[11:], p.Kind, p.Price, p.ChangeTicks, p.Seconds, p.Confirmed))
+	}
+	want := []string{
+		"09:00:00 low 100 0 0s true",
+		"09:00:04 high 103 3 4s true",
+		"09:00:10 low 99 -4 6s true",
+		"09:00:14 high 104 5 4s false",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pivots = %q, want %q", got, want)
+	}
+	// 灵敏度降低后小的摆动被忽略
+	if pivots := webFindPivots(data, 5, 1); len(pivots) != 2 || pivots[0].Kind != "low" || pivots[0].Price != 99 {
+		t.Errorf("pivots at 5 ticks = %+v", pivots)
+	}
+
+	// 接口按可见范围内的原始tick识别
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webPivotsHandler(rec, httptest.NewRequest("GET", "/api/v1/pivots?table=tst&symbol=tst2509&range=all&from=2025-07-01+09:00:20&to=2025-07-01+09:01:00&ticks=2", nil))
+	var resp struct {
+		From    string     `json:"from"`
+		Records int        `json:"records"`
+		Pivots  []webPivot `json:"pivots"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if resp.From != "2025-07-01 09:00:20" || resp.Records != 21 || len(resp.Pivots) < 2 {
+		t.Fatalf("resp = %s", rec.Body.String())
+	}
+	for i, p := range resp.Pivots {
+		if p.Time < "2025-07-01 09:00:20" || p.Time > "2025-07-01 09:01:00" || (i > 0 && p.Kind == resp.Pivots[i-1].Kind) {
+			t.Errorf("pivot %d = %+v", i, p)
+		}
+	}
+
+	for _, query := range []string{"table=tst&range=all", "symbol=tst2509&table=tst&range=all&ticks=0", "symbol=tst2509&table=tst&range=all&from=bad"} {
+		rec := httptest.NewRecorder()
+		webPivotsHandler(rec, httptest.NewRequest("GET", "/api/v1/pivots?"+query, nil))
+		if !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s: %s", query, rec.Body.String())
+		}
+	}
+}
+
+func TestWebPriceLevels(t *testing.T) {
+	oldPath, oldLevels, oldConfig := webLevelsPath, webLevels, webConfigLevels
+	webLevelsPath = filepath.Join(t.TempDir(), "levels.json")
+	webLevels = map[string][]webPriceLevel{}
+	webConfigLevels, _ = webParseConfigLevels(map[string][]webPriceLevel{"TST2509": {{Price: 1020, Label: "前高"}}})
+	defer func() { webLevelsPath, webLevels, webConfigLevels = oldPath, oldLevels, oldConfig }()
+
+	call := func(method, query string) (int, []webPriceLevel) {
+		rec := httptest.NewRecorder()
+		webLevelsHandler(rec, httptest.NewRequest(method, "/api/v1/levels?"+query, nil))
+		var resp struct {
+			Levels []webPriceLevel `json:"levels"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Levels
+	}
+	if code, levels := call("POST", "symbol=tst2509&price=1000&label=前低"); code != 200 || len(levels) != 2 || levels[0].Price != 1000 || levels[1].Source != "config" {
+		t.Fatalf("add: %d %+v", code, levels)
+	}
+	if code, _ := call("POST", "symbol=tst2509&price=1020"); code != http.StatusConflict {
+		t.Errorf("duplicate of config level: %d", code)
+	}
+	if code, _ := call("POST", "symbol=tst2509&price=abc"); code != http.StatusBadRequest {
+		t.Errorf("invalid price: %d", code)
+	}
+	if code, _ := call("DELETE", "symbol=tst2509&id=config-1"); code != http.StatusBadRequest {
+		t.Errorf("delete config level: %d", code)
+	}
+	// 页面添加的价位线写入文件，重新加载后不变
+	saved, err := webLoadLevels(webLevelsPath)
+	if err != nil || len(saved["tst2509"]) != 1 || saved["tst2509"][0].Label != "前低" {
+		t.Fatalf("saved = %+v, %v", saved, err)
+	}
+
+	// 实时数据穿越价位线时向订阅者推送告警：第一批tick只记录起点
+	oldWindow := webIncidentWindow
+	webIncidentWindow = time.Hour
+	defer func() { webIncidentWindow = oldWindow }()
+	client := &webWSClient{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	feed := &webSymbolFeed{table: "tst", symbol: "tst2509", clients: map[*webWSClient]bool{client: true}}
+	ticks := func(prices ...float32) []WebMarketData {
+		var data []WebMarketData
+		for i, price := range prices {
+			data = append(data, WebMarketData{Time: fmt.Sprintf("2025-07-01 09:00:%02d", i), Price: price})
+		}
+		return data
+	}
+	webCheckLevels(feed, ticks(990, 1010))
+	webCheckLevels(feed, ticks(1005, 1000, 1021, 1019))
+	var got []string
+	for payload, _ := client.next(); payload != nil; payload, _ = client.next() {
+		var frame struct {
+			Incident webIncident `json:"incident"`
+		}
+		json.Unmarshal(payload, &frame)
+		got = append(got, fmt.Sprintf("%s %s %v", frame.Incident.Kind, frame.Incident.Side, frame.Incident.Level))
+	}
+	if want := []string{"level down 1000", "level up 1020", "level down 1020"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alerts = %q, want %q", got, want)
+	}
+
+	if code, levels := call("DELETE", "symbol=tst2509&id="+saved["tst2509"][0].ID); code != 200 || len(levels) != 1 {
+		t.Errorf("delete: %d %+v", code, levels)
+	}
+	if code, _ := call("DELETE", "symbol=tst2509&id=missing"); code != http.StatusNotFound {
+		t.Errorf("delete missing: %d", code)
+	}
+}
+
+func TestWebExportEstimate(t *testing.T) {
+	newFakeClickHouse(t)
+	oldConfirm, oldMax := webExportConfirmBytes, webExportMaxBytes
+	defer func() { webExportConfirmBytes, webExportMaxBytes = oldConfirm, oldMax }()
+
+	rows, err := webCountDataset(context.Background(), webDatasetKey{"tst", "tst2509", "all"})
+	if err != nil || rows != 60 {
+		t.Fatalf("count = %d, %v", rows, err)
+	}
+	// 11个定长列共52字节，symbol 列为4字节偏移加7字节字符串
+	if got := webArrowRowBytes("tst2509"); got != 63 {
+		t.Errorf("row bytes = %d, want 63", got)
+	}
+
+	export := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		webExportArrowHandler(rec, httptest.NewRequest("GET", "/export.arrow?table=tst&symbol=tst2509&range=all"+query, nil))
+		return rec
+	}
+	webExportConfirmBytes, webExportMaxBytes = 1000, 0
+	rec := httptest.NewRecorder()
+	webExportEstimateHandler(rec, httptest.NewRequest("GET", "/api/v1/export/estimate?table=tst&symbol=tst2509&range=all", nil))
+	var estimate webExportEstimate
+	if err := json.Unmarshal(rec.Body.Bytes(), &estimate); err != nil || estimate.Rows != 60 || estimate.Bytes != 60*63 || !estimate.NeedsConfirm || estimate.TooLarge {
+		t.Fatalf("estimate = %s", rec.Body.String())
+	}
+	if rec := export(""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "confirm=1") {
+		t.Errorf("unconfirmed export: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := export("&confirm=1"); rec.Code != http.StatusOK || !bytes.HasPrefix(rec.Body.Bytes(), []byte{0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("confirmed export: %d", rec.Code)
+	}
+	// 超过上限时即使确认也拒绝
+	webExportMaxBytes = 3000
+	if rec := export("&confirm=1"); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "-export-max-bytes") {
+		t.Errorf("oversized export: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 加载整个合约的原始数据（range=all）在查询前同样预估，页面创建查询任务时也一样
+	load := func(handler http.HandlerFunc, method, target string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := load(webDataHandler, "GET", "/data?table=tst&symbol=tst2509&range=all&confirm=1"); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "预计加载") {
+		t.Errorf("oversized range: %d %s", code, body)
+	}
+	webExportMaxBytes = 0
+	code, body := load(webJobsHandler, "POST", "/api/v1/jobs?table=tst&symbol=tst2509&range=all")
+	var refused struct {
+		Estimate webExportEstimate `json:"estimate"`
+	}
+	if json.Unmarshal([]byte(body), &refused); code != http.StatusConflict || !refused.Estimate.NeedsConfirm || refused.Estimate.Rows != 60 {
+		t.Errorf("unconfirmed job: %d %s", code, body)
+	}
+	if code, body := load(webDataHandler, "GET", "/data?table=tst&symbol=tst2509&range=all"); code != http.StatusConflict {
+		t.Errorf("unconfirmed range: %d %s", code, body)
+	}
+	if code, body := load(webDataHandler, "GET", "/data?table=tst&symbol=tst2509&range=all&confirm=1"); code != http.StatusOK || strings.Contains(body, `"error"`) {
+		t.Errorf("confirmed range: %d %s", code, body)
+	}
+	// 有明确起止时间的范围不预估
+	if code, body := load(webDataHandler, "GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01"); code != http.StatusOK || strings.Contains(body, `"error"`) {
+		t.Errorf("session range: %d %s", code, body)
+	}
+}
+
+// 按 FlatBuffers 规范读取表字段，独立于 arrowFB 构建器，用来校验导出的 Arrow 元数据
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+func fbRoot(buf []byte) fbTable {
+	return fbTable{buf, int(binary.LittleEndian.Uint32(buf))}
+}
+
+// 字段在表中的位置，字段不存在（取默认值）时为0
+func (t fbTable) field(slot int) int {
+	vt := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	if 4+2*slot >= int(binary.LittleEndian.Uint16(t.buf[vt:])) {
+		return 0
+	}
+	if off := int(binary.LittleEndian.Uint16(t.buf[vt+4+2*slot:])); off != 0 {
+		return t.pos + off
+	}
+	return 0
+}
+
+func (t fbTable) uint8(slot int) uint8 {
+	if p := t.field(slot); p != 0 {
+		return t.buf[p]
+	}
+	return 0
+}
+
+func (t fbTable) int16(slot int) int16 {
+	if p := t.field(slot); p != 0 {
+		return int16(binary.LittleEndian.Uint16(t.buf[p:]))
+	}
+	return 0
+}
+
+func (t fbTable) int32(slot int) int32 {
+	if p := t.field(slot); p != 0 {
+		return int32(binary.LittleEndian.Uint32(t.buf[p:]))
+	}
+	return 0
+}
+
+func (t fbTable) int64(slot int) int64 {
+	if p := t.field(slot); p != 0 {
+		return int64(binary.LittleEndian.Uint64(t.buf[p:]))
+	}
+	return 0
+}
+
+func (t fbTable) deref(slot int) int {
+	p := t.field(slot)
+	if p == 0 {
+		return 0
+	}
+	return p + int(binary.LittleEndian.Uint32(t.buf[p:]))
+}
+
+func (t fbTable) table(slot int) fbTable {
+	return fbTable{t.buf, t.deref(slot)}
+}
+
+func (t fbTable) str(slot int) string {
+	p := t.deref(slot)
+	n := int(binary.LittleEndian.Uint32(t.buf[p:]))
+	return string(t.buf[p+4 : p+4+n])
+}
+
+// 向量的长度和第一个元素的位置
+func (t fbTable) vector(slot int) (n, start int) {
+	p := t.deref(slot)
+	if p == 0 {
+		return 0, 0
+	}
+	return int(binary.LittleEndian.Uint32(t.buf[p:])), p + 4
+}
+
+// 按 Arrow IPC 流格式读回 webWriteArrowStream 的输出：返回 schema 的列（名称:类型）和所有批次解码出的行
+func readArrowStream(t *testing.T, stream []byte) (columns []string, rows []WebMarketData) {
+	t.Helper()
+	var types []fbTable
+	for pos := 0; ; {
+		if binary.LittleEndian.Uint32(stream[pos:]) != 0xFFFFFFFF {
+			t.Fatalf("offset %d: missing continuation marker", pos)
+		}
+		metaLen := int(binary.LittleEndian.Uint32(stream[pos+4:]))
+		pos += 8
+		if metaLen == 0 {
+			if pos != len(stream) {
+				t.Fatalf("%d bytes after end-of-stream", len(stream)-pos)
+			}
+			return columns, rows
+		}
+		if (pos+metaLen)%8 != 0 {
+			t.Fatalf("offset %d: body not 8-byte aligned (metadata %d bytes)", pos, metaLen)
+		}
+		msg := fbRoot(stream[pos : pos+metaLen])
+		pos += metaLen
+		if v := msg.int16(0); v != 4 {
+			t.Fatalf("metadata version = %d, want V5", v)
+		}
+		bodyLen := int(msg.int64(3))
+		body := stream[pos : pos+bodyLen]
+		pos += bodyLen
+
+		switch header := msg.table(2); msg.uint8(1) {
+		case 1: // Schema
+			if header.int16(0) != 0 {
+				t.Fatal("schema is not little-endian")
+			}
+			n, start := header.vector(1)
+			for i := 0; i < n; i++ {
+				p := start + 4*i
+				field := fbTable{msg.buf, p + int(binary.LittleEndian.Uint32(msg.buf[p:]))}
+				typ := field.table(3)
+				var desc string
+				switch field.uint8(2) {
+				case 2:
+					desc = fmt.Sprintf("int%d", typ.int32(0))
+					if typ.uint8(1) == 0 {
+						desc = "u" + desc
+					}
+				case 3:
+					desc = fmt.Sprintf("float(precision=%d)", typ.int16(0))
+				case 5:
+					desc = "utf8"
+				case 10:
+					desc = fmt.Sprintf("timestamp(unit=%d)", typ.int16(0))
+				default:
+					desc = fmt.Sprintf("type%d", field.uint8(2))
+				}
+				columns = append(columns, field.str(0)+":"+desc)
+				types = append(types, typ)
+			}
+		case 3: // RecordBatch
+			length := int(header.int64(0))
+			nNodes, nodes := header.vector(1)
+			nBufs, bufs := header.vector(2)
+			if nNodes != len(columns) {
+				t.Fatalf("%d field nodes for %d columns", nNodes, len(columns))
+			}
+			buffer := func(i int) []byte {
+				off := int(binary.LittleEndian.Uint64(msg.buf[bufs+16*i:]))
+				size := int(binary.LittleEndian.Uint64(msg.buf[bufs+16*i+8:]))
+				if off%8 != 0 || off+size > len(body) {
+					t.Fatalf("buffer %d at %d+%d outside the %d byte body or unaligned", i, off, size, len(body))
+				}
+				return body[off : off+size]
+			}
+			for i := 0; i < nNodes; i++ {
+				if l, nulls := binary.LittleEndian.Uint64(msg.buf[nodes+16*i:]), binary.LittleEndian.Uint64(msg.buf[nodes+16*i+8:]); int(l) != length || nulls != 0 {
+					t.Fatalf("node %d: length %d nulls %d, want %d 0", i, l, nulls, length)
+				}
+			}
+			batch := make([]WebMarketData, length)
+			b := 0
+			for c, column := range columns {
+				name, _, _ := strings.Cut(column, ":")
+				b++ // validity
+				if name == "symbol" {
+					offsets, values := buffer(b), buffer(b+1)
+					b += 2
+					for i := range batch {
+						batch[i].Symbol = string(values[binary.LittleEndian.Uint32(offsets[4*i:]):binary.LittleEndian.Uint32(offsets[4*i+4:])])
+					}
+					continue
+				}
+				values := buffer(b)
+				b++
+				u32 := func(i int) uint32 { return binary.LittleEndian.Uint32(values[4*i:]) }
+				for i := range batch {
+					r := &batch[i]
+					switch name {
+					case "time":
+						r.Time = time.UnixMilli(int64(binary.LittleEndian.Uint64(values[8*i:]))).UTC().Format("2006-01-02 15:04:05")
+					case "price":
+						r.Price = math.Float32frombits(u32(i))
+					case "vol":
+						r.Vol = u32(i)
+					case "open_interest":
+						r.OpenInterest = u32(i)
+					case "diff_vol":
+						r.DiffVol = int32(u32(i))
+					case "diff_oi":
+						r.DiffOI = int32(u32(i))
+					case "bid_1":
+						r.Bid1 = math.Float32frombits(u32(i))
+					case "bid_volumn_1":
+						r.BidVolumn1 = u32(i)
+					case "ask_1":
+						r.Ask1 = math.Float32frombits(u32(i))
+					case "ask_volumn_1":
+						r.AskVolumn1 = u32(i)
+					case "datetime":
+						r.DateTime = binary.LittleEndian.Uint64(values[8*i:])
+					default:
+						t.Fatalf("unexpected column %s (%v)", name, types[c])
+					}
+				}
+			}
+			if b != nBufs {
+				t.Fatalf("decoded %d buffers, batch has %d", b, nBufs)
+			}
+			rows = append(rows, batch...)
+		default:
+			t.Fatalf("unexpected message type %d", msg.uint8(1))
+		}
+	}
+}
+
+func TestWebArrowStream(t *testing.T) {
+	wantColumns := []string{
+		"symbol:utf8", "time:timestamp(unit=1)", "price:float(precision=1)", "vol:uint32", "open_interest:uint32",
+		"diff_vol:int32", "diff_oi:int32", "bid_1:float(precision=1)", "bid_volumn_1:uint32", "ask_1:float(precision=1)",
+		"ask_volumn_1:uint32", "datetime:uint64",
+	}
+
+	// 超过一个批次，长度不同的symbol检查偏移量和8字节对齐
+	data := make([]WebMarketData, ARROW_BATCH_ROWS+3)
+	start := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	for i := range data {
+		data[i] = WebMarketData{
+			Symbol: []string{"tst2509", "i2509", "SA509x"}[i%3], Time: start.Add(time.Duration(i) * time.Second).Format("2006-01-02 15:04:05"),
+			Price: 1000.5 + float32(i%100), Vol: uint32(i), OpenInterest: uint32(50000 + i%7), DiffVol: int32(i % 5), DiffOI: int32(i%9 - 4),
+			Bid1: 1000, BidVolumn1: uint32(i % 11), Ask1: 1001.5, AskVolumn1: uint32(i % 13), DateTime: uint64(1751360400000 + i),
+		}
+	}
+	for _, rows := range [][]WebMarketData{data, data[:2], nil} {
+		var buf bytes.Buffer
+		if err := webWriteArrowStream(&buf, rows); err != nil {
+			t.Fatal(err)
+		}
+		columns, got := readArrowStream(t, buf.Bytes())
+		if !reflect.DeepEqual(columns, wantColumns) {
+			t.Fatalf("schema = %q", columns)
+		}
+		if len(got) != len(rows) {
+			t.Fatalf("%d rows, want %d", len(got), len(rows))
+		}
+		for i := range rows {
+			if got[i] != rows[i] {
+				t.Fatalf("row %d = %+v, want %+v", i, got[i], rows[i])
+			}
+		}
+	}
+}
+
+func TestWebNumberFormat(t *testing.T) {
+	tests := []struct {
+		locale, decimals, units string
+		value                   float64
+		field, want             string
+	}{
+		{"zh-CN", "", "none", 1005.5, "price", "1,005.50"},
+		{"zh-CN", "", "none", 52002.4, "oi", "52,002"},
+		{"de-DE", "price=1", "none", -1234567.26, "price", "-1.234.567,3"},
+		{"plain", "", "none", 1234567, "count", "1234567"},
+		{"zh-CN", "", "cn", 123456, "volume", "12.35万"},
+		{"zh-CN", "", "cn", 3.2e8, "oi", "3.20亿"},
+		{"en-US", "", "metric", 999, "oi", "999"},
+		{"en-US", "", "metric", 1500, "volume", "1.50k"},
+		{"en-US", "", "metric", 25000, "price", "25,000.00"}, // 价格不换算单位
+	}
+	for _, tt := range tests {
+		f, err := webParseNumberFormat(tt.locale, tt.decimals, tt.units)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Format(tt.value, tt.field); got != tt.want {
+			t.Errorf("%s/%s/%s Format(%v, %s) = %q, want %q", tt.locale, tt.decimals, tt.units, tt.value, tt.field, got, tt.want)
+		}
+	}
+	for _, bad := range [][3]string{{"fr-FR", "", "none"}, {"zh-CN", "price=x", "none"}, {"zh-CN", "count=1", "none"}, {"zh-CN", "", "kb"}} {
+		if _, err := webParseNumberFormat(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("webParseNumberFormat(%q) accepted", bad)
+		}
+	}
+}
+
+func TestWebAssets(t *testing.T) {
+	oldDir := webAssetsDir
+	defer func() { webAssetsDir = oldDir }()
+
+	// 导出后修改模板，-assets-dir 指向导出目录时页面使用修改后的版本
+	dir := t.TempDir()
+	written, skipped, err := webExportAssets(dir, false)
+	if err != nil || written < len(webTemplates)+1 || skipped != 0 {
+		t.Fatalf("export = %d written, %d skipped, %v", written, skipped, err)
+	}
+	if _, skipped, _ := webExportAssets(dir, false); skipped != written {
+		t.Errorf("second export skipped %d, want %d", skipped, written)
+	}
+	index := filepath.Join(dir, "templates", "index.html")
+	exported, err := os.ReadFile(index)
+	if err != nil || !strings.Contains(string(exported), "/assets/js/chart.umd.js") {
+		t.Fatalf("exported index.html: %v", err)
+	}
+	if err := os.WriteFile(index, append(exported, "<!-- custom -->"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(webTemplate("index.html"), "<!-- custom -->") {
+		t.Error("override used without -assets-dir")
+	}
+	webAssetsDir = dir
+	if !strings.Contains(webTemplate("index.html"), "<!-- custom -->") {
+		t.Error("override in -assets-dir not used")
+	}
+	if webTemplate("compare.html") != strings.TrimPrefix(webCompareTemplate, "\n") {
+		t.Error("compare.html should be the exported built-in copy")
+	}
+
+	// 导出的默认配置可以直接作为 -config 使用
+	if _, err := webLoadSettings(filepath.Join(dir, "config", "web.json"), webSettings{AlertThreshold: 0.8, AlertTicks: 3, CatalogTTL: time.Minute, Theme: "dark", Downsampling: webDefaultDownsampling()}); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+
+	// 目录中的JS库优先，没有时重定向到CDN，未知文件404
+	if err := os.WriteFile(filepath.Join(dir, "js", "hammer.min.js"), []byte("var Hammer;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{
+		"/assets/js/hammer.min.js":      http.StatusOK,
+		"/assets/js/chart.umd.js":       http.StatusFound,
+		"/assets/js/jquery.js":          http.StatusNotFound,
+		"/assets/js/../config/web.json": http.StatusNotFound,
+		"/assets/config/web.json":       http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		webAssetsHandler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, want)
+		}
+		if want == http.StatusFound && rec.Header().Get("Location") != webJSLibraries["chart.umd.js"] {
+			t.Errorf("%s: Location %q", path, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestWebIncidentRetention(t *testing.T) {
+	policies, err := webParseRetention("*=30d, JM2509=7d/1KB, i2509=2MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]webRetentionPolicy{"*": {Days: 30}, "jm2509": {Days: 7, MaxBytes: 1024}, "i2509": {MaxBytes: 2 << 20}}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("policies = %+v", policies)
+	}
+	for _, bad := range []string{"jm2509", "jm2509=", "jm2509=7", "jm2509=0d", "jm2509=7d/7d", "jm2509=5TB"} {
+		if _, err := webParseRetention(bad); err == nil {
+			t.Errorf("webParseRetention(%q) accepted", bad)
+		}
+	}
+
+	oldDir, oldRetention, oldLast := webIncidentsDir, webIncidentRetention, webIncidentLastPrune
+	defer func() { webIncidentsDir, webIncidentRetention, webIncidentLastPrune = oldDir, oldRetention, oldLast }()
+	webIncidentsDir, webIncidentRetention = t.TempDir(), policies
+
+	// jm2509 保留7天、最多1KB，其他合约保留30天
+	now := time.Date(2025, 7, 20, 12, 0, 0, 0, time.Local)
+	save := func(id, symbol string, age time.Duration, size int) {
+		dir := filepath.Join(webIncidentsDir, id)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, "ticks.csv"), bytes.Repeat([]byte("x"), size), 0o644)
+		meta, _ := json.Marshal(webIncident{ID: id, Symbol: symbol})
+		os.WriteFile(filepath.Join(dir, "incident.json"), meta, 0o644)
+		os.Chtimes(filepath.Join(dir, "incident.json"), now.Add(-age), now.Add(-age))
+	}
+	save("jm_old", "jm2509", 8*24*time.Hour, 100)
+	save("jm_mid", "jm2509", 2*24*time.Hour, 600)
+	save("jm_new", "jm2509", time.Hour, 300)
+	save("ag_old", "ag2512", 20*24*time.Hour, 5000)
+	save("ag_expired", "ag2512", 31*24*time.Hour, 100)
+	os.MkdirAll(filepath.Join(webIncidentsDir, "capturing"), 0o755) // 尚未写入 incident.json
+
+	result := webPruneIncidents(now)
+	if result.Removed != 3 || result.Error != "" {
+		t.Errorf("prune = %+v, want 3 removed", result)
+	}
+	var left []string
+	entries, _ := webScanIncidents()
+	for _, e := range entries {
+		left = append(left, e.dir)
+	}
+	if strings.Join(left, ",") != "ag_old,jm_new" {
+		t.Errorf("left = %v, want ag_old,jm_new", left)
+	}
+	if _, err := os.Stat(filepath.Join(webIncidentsDir, "capturing")); err != nil {
+		t.Error("incomplete incident directory removed")
+	}
+
+	rec := httptest.NewRecorder()
+	webIncidentUsageHandler(rec, httptest.NewRequest("GET", "/api/v1/incidents/usage", nil))
+	var usage struct {
+		Incidents int                    `json:"incidents"`
+		Symbols   []webIncidentUsage     `json:"symbols"`
+		LastPrune webIncidentPruneResult `json:"last_prune"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if usage.Incidents != 2 || len(usage.Symbols) != 2 || usage.Symbols[0].Symbol != "ag2512" || usage.Symbols[1].Policy.MaxBytes != 1024 || usage.LastPrune.Removed != 3 {
+		t.Errorf("usage = %s", rec.Body.String())
+	}
+}
+
+func TestWebIncidentACL(t *testing.T) {
+	oldDir := webIncidentsDir
+	defer func() { webIncidentsDir = oldDir }()
+	webIncidentsDir = t.TempDir()
+	for _, incident := range []webIncident{
+		{ID: "tst_a", Table: "tst", Symbol: "tst2509", Time: "2025-07-01 09:00:30"},
+		{ID: "jm_a", Table: "jm", Symbol: "jm2509", Time: "2025-07-01 09:00:40"},
+	} {
+		dir := filepath.Join(webIncidentsDir, incident.ID)
+		os.MkdirAll(dir, 0o755)
+		meta, _ := json.Marshal(incident)
+		os.WriteFile(filepath.Join(dir, "incident.json"), meta, 0o644)
+		os.WriteFile(filepath.Join(dir, "ticks.csv"), []byte(incident.Symbol+"\n"), 0o644)
+	}
+	os.WriteFile(filepath.Join(webIncidentsDir, "secret.txt"), []byte("x"), 0o644)
+
+	intern := &webACLUser{Name: "intern", Tables: []string{"tst"}}
+	do := func(handler http.HandlerFunc, target string, user *webACLUser) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req = req.WithContext(webWithUser(req.Context(), user))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	// 列表和占用统计只包含有权访问的合约
+	var list struct {
+		Incidents []webIncident `json:"incidents"`
+	}
+	json.Unmarshal(do(webIncidentsHandler, "/api/v1/incidents", intern).Body.Bytes(), &list)
+	if len(list.Incidents) != 1 || list.Incidents[0].ID != "tst_a" {
+		t.Errorf("intern incidents = %+v", list.Incidents)
+	}
+	json.Unmarshal(do(webIncidentsHandler, "/api/v1/incidents", nil).Body.Bytes(), &list)
+	if len(list.Incidents) != 2 {
+		t.Errorf("incidents without ACL = %+v", list.Incidents)
+	}
+	if body := do(webIncidentUsageHandler, "/api/v1/incidents/usage", intern).Body.String(); !strings.Contains(body, `"incidents":1,`) || strings.Contains(body, "jm2509") {
+		t.Errorf("intern usage = %s", body)
+	}
+
+	// 快照文件先检查权限，不能列目录或读取快照目录以外的文件
+	for _, tt := range []struct {
+		target string
+		user   *webACLUser
+		code   int
+	}{
+		{"/incidents/tst_a/ticks.csv", intern, http.StatusOK},
+		{"/incidents/jm_a/ticks.csv", intern, http.StatusForbidden},
+		{"/incidents/jm_a/ticks.csv", nil, http.StatusOK},
+		{"/incidents/tst_a/", intern, http.StatusNotFound},
+		{"/incidents/tst_a/missing.png", intern, http.StatusNotFound},
+		{"/incidents/secret.txt", nil, http.StatusNotFound},
+		{"/incidents/tst_a/../secret.txt", nil, http.StatusNotFound},
+	} {
+		if rec := do(webIncidentFileHandler, tt.target, tt.user); rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestWebGhost(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	day := func(s string) time.Time { return at(s + " 00:00") }
+	tests := []struct{ tick, ref, target, want string }{
+		{"2025-07-01 10:15", "2025-07-01", "2025-07-02", "2025-07-02 10:15"},
+		{"2025-06-30 21:30", "2025-07-01", "2025-07-02", "2025-07-01 21:30"},
+		{"2025-07-01 01:10", "2025-07-01", "2025-07-02", "2025-07-02 01:10"},
+		{"2025-07-01 21:30", "2025-07-02", "2025-07-07", "2025-07-04 21:30"}, // 周一的夜盘在上周五
+		{"2025-07-02 00:30", "2025-07-02", "2025-07-07", "2025-07-05 00:30"},
+		{"2025-07-04 22:00", "2025-07-07", "2025-07-02", "2025-07-01 22:00"},
+		{"2025-07-05 00:30", "2025-07-07", "2025-07-02", "2025-07-02 00:30"},
+	}
+	for _, tt := range tests {
+		if got := webShiftToSession(at(tt.tick), day(tt.ref), day(tt.target)); !got.Equal(at(tt.want)) {
+			t.Errorf("shift %s from %s to %s = %v, want %s", tt.tick, tt.ref, tt.target, got, tt.want)
+		}
+	}
+
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webGhostDataHandler(rec, httptest.NewRequest("GET", "/ghost/data?table=tst&symbol=tst2509&date=2025-07-01&at=2025-07-02+09:30:00", nil))
+	var resp struct {
+		Date        string  `json:"date"`
+		Day         string  `json:"day"`
+		SessionFrom string  `json:"session_from"`
+		Open        float64 `json:"open"`
+		Data        []struct {
+			Time  string  `json:"time"`
+			Price float64 `json:"price"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if resp.Date != "2025-07-01" || resp.Day != "2025-07-02" || resp.SessionFrom != "2025-07-01 20:00:00" || len(resp.Data) != 60 {
+		t.Fatalf("resp = %s", rec.Body.String())
+	}
+	if resp.Data[0].Time != "2025-07-02 09:00:00" || resp.Open != resp.Data[0].Price {
+		t.Errorf("first point = %+v, open %v", resp.Data[0], resp.Open)
+	}
+
+	for _, query := range []string{"symbol=tst2509&table=tst", "symbol=tst2509&table=tst&date=2025-07-01&at=2025-07-01+10:00:00", "symbol=tst2509&table=tst&date=bad&at=2025-07-02+10:00:00"} {
+		rec := httptest.NewRecorder()
+		webGhostDataHandler(rec, httptest.NewRequest("GET", "/ghost/data?"+query, nil))
+		if !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("%s: %s", query, rec.Body.String())
+		}
+	}
+}
+
+func TestWebUIState(t *testing.T) {
+	defer func(path string, start, last webUIState) {
+		webStatePath, webStartState, webLastState = path, start, last
+	}(webStatePath, webStartState, webLastState)
+	webStatePath = filepath.Join(t.TempDir(), "ui_state.json")
+	// 终端查看器写入的滚动位置，合约不变时保留
+	if err := os.WriteFile(webStatePath, []byte(`{"table": "tst", "symbol": "tst2509", "series": "mid", "indicators": ["vwap", "pivots"], "window_size": 400, "window_end": "2025-07-01 09:00:30"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := webLoadUIState(webStatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webRestoreUIState(state)
+
+	// 新会话从状态文件中的选择开始
+	type sessionResponse struct {
+		Symbol     string   `json:"symbol"`
+		Series     string   `json:"series"`
+		Indicators []string `json:"indicators"`
+	}
+	rec := httptest.NewRecorder()
+	webSessionHandler(rec, httptest.NewRequest("GET", "/session", nil))
+	var session sessionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Symbol != "tst2509" || session.Series != "mid" || strings.Join(session.Indicators, ",") != "vwap,pivots" {
+		t.Errorf("new session = %s", rec.Body.String())
+	}
+
+	// 只读取时不创建会话，第一次保存偏好时才下发cookie
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("GET /session created a session: %v", cookies)
+	}
+	var cookie *http.Cookie
+	post := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/session?"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		webSessionHandler(rec, req)
+		if cookies := rec.Result().Cookies(); cookie == nil && len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+		return rec
+	}
+	rec = post("indicators=percent,exact,percent")
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil || strings.Join(session.Indicators, ",") != "percent,exact" || cookie == nil {
+		t.Errorf("status %d: %s (cookie %v)", rec.Code, rec.Body.String(), cookie)
+	}
+	if rec := post("indicators=rainbow"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown indicator: status %d", rec.Code)
+	}
+	// 空列表关闭全部指标，省略时不变
+	post("indicators=")
+	if rec := post("series=price"); json.Unmarshal(rec.Body.Bytes(), &session) != nil || len(session.Indicators) != 0 || session.Series != "price" {
+		t.Errorf("session = %s", rec.Body.String())
+	}
+
+	post("indicators=regimes")
+	if err := webSaveUIState(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := webLoadUIState(webStatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Symbol != "tst2509" || saved.Series != "price" || strings.Join(saved.Indicators, ",") != "regimes" || saved.SavedBy != "web" {
+		t.Errorf("saved state = %+v", saved)
+	}
+	if saved.WindowSize != 400 || saved.WindowEnd != "2025-07-01 09:00:30" {
+		t.Errorf("terminal fields were not kept: %+v", saved)
+	}
+	if _, err := os.Stat(webStatePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// 换了合约后终端查看器的滚动位置不再适用
+	webRememberSession(webSession{key: webDatasetKey{"tst", "other2601", "all"}, series: "price"})
+	if err := webSaveUIState(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ = webLoadUIState(webStatePath); saved.Symbol != "other2601" || saved.WindowEnd != "" || saved.WindowSize != 400 {
+		t.Errorf("state after symbol change = %+v", saved)
+	}
+}
+
+func TestWebSessionLifecycle(t *testing.T) {
+	webSessionsMutex.Lock()
+	old := webSessions
+	webSessions = make(map[string]*webSession)
+	webSessionsMutex.Unlock()
+	defer func() {
+		webSessionsMutex.Lock()
+		webSessions = old
+		webSessionsMutex.Unlock()
+	}()
+	count := func() int {
+		webSessionsMutex.Lock()
+		defer webSessionsMutex.Unlock()
+		return len(webSessions)
+	}
+
+	// 不带cookie的只读请求拿到初始选择，不创建会话、不下发cookie
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data", nil))
+	if id, session := webGetSession(httptest.NewRequest("GET", "/chart", nil)); id != "" || session.flowColor != "sign" {
+		t.Errorf("read-only request got session %q %+v", id, session)
+	}
+	if count() != 0 || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("read-only request created %d sessions", count())
+	}
+
+	// 修改状态的请求创建会话，之后带cookie的只读请求使用同一个会话
+	rec = httptest.NewRecorder()
+	id, _ := webEnsureSession(rec, httptest.NewRequest("POST", "/session", nil))
+	cookies := rec.Result().Cookies()
+	if id == "" || count() != 1 || len(cookies) != 1 || cookies[0].Value != id {
+		t.Fatalf("ensure: id %q, %d sessions, cookies %v", id, count(), cookies)
+	}
+	req := httptest.NewRequest("GET", "/chart", nil)
+	req.AddCookie(cookies[0])
+	if got, _ := webGetSession(req); got != id {
+		t.Errorf("session with cookie = %q, want %q", got, id)
+	}
+	rec = httptest.NewRecorder()
+	if again, _ := webEnsureSession(rec, req); again != id || count() != 1 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("ensure with a valid cookie created another session")
+	}
+
+	// 闲置会话由定期清理删除，不需要等新会话创建
+	webSessionsMutex.Lock()
+	webPruneSessionsLocked(time.Now().Add(WEB_SESSION_IDLE - time.Minute))
+	kept := len(webSessions)
+	webPruneSessionsLocked(time.Now().Add(WEB_SESSION_IDLE + time.Minute))
+	webSessionsMutex.Unlock()
+	if kept != 1 || count() != 0 {
+		t.Errorf("prune kept %d then %d sessions", kept, count())
+	}
+}
+
+func TestWebSessionSummary(t *testing.T) {
+	rows := []webDailyStats{
+		{Day: "2025-07-01", Open: 1001, High: 1012, Low: 996, Close: 1008, Settle: 1005, OpenInterest: 52140},
+		{Day: "2025-06-30", Open: 1003, High: 1009, Low: 994, Close: 999, Settle: 998, OpenInterest: 52496},
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// 交易中：开盘相对前结算的跳空和相对上一交易日收盘持仓的变化，还没有当日结算
+	open := webBuildSessionSummary("tst2509", rows, at("2025-07-01 10:30"))
+	if open.Phase != "open" || open.Day != "2025-07-01" || *open.PrevSettle != 998 || *open.Gap != 3 || *open.OIChange != -356 || open.Settle != nil {
+		t.Errorf("open summary = %+v", open)
+	}
+	if math.Abs(*open.GapPct-0.3006) > 1e-3 {
+		t.Errorf("gap pct = %v", *open.GapPct)
+	}
+	// 前一晚的夜盘已经属于当前交易日
+	if night := webBuildSessionSummary("tst2509", rows, at("2025-06-30 21:30")); night.Phase != "open" || night.Day != "2025-07-01" {
+		t.Errorf("night session summary = %+v", night)
+	}
+
+	closed := webBuildSessionSummary("tst2509", rows, at("2025-07-01 15:30"))
+	if closed.Phase != "closed" || closed.Settle == nil || *closed.Settle != 1005 || *closed.Last != 1008 {
+		t.Errorf("closed summary = %+v", closed)
+	}
+
+	// 20:00以后属于下一交易日，夜盘开始前只有上一交易日的结算；周五晚上的下一交易日是周一
+	pre := webBuildSessionSummary("tst2509", rows, at("2025-07-04 20:30"))
+	if pre.Phase != "pre_open" || pre.Day != "2025-07-07" || pre.PrevDay != "2025-07-01" || *pre.PrevSettle != 1005 || *pre.PrevClose != 1008 || pre.Open != nil || pre.Gap != nil {
+		t.Errorf("pre-open summary = %+v", pre)
+	}
+
+	// 只有一个交易日时没有跳空和持仓变化
+	first := webBuildSessionSummary("tst2509", rows[:1], at("2025-07-01 10:30"))
+	if first.Phase != "open" || first.PrevSettle != nil || first.Gap != nil || first.OIChange != nil || *first.OpenInterest != 52140 {
+		t.Errorf("first day summary = %+v", first)
+	}
+	if empty := webBuildSessionSummary("tst2509", nil, at("2025-07-01 10:30")); empty.Phase != "pre_open" || empty.PrevSettle != nil {
+		t.Errorf("empty summary = %+v", empty)
+	}
+}
+
+func TestWebTradingDay(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct{ tick, day string }{
+		{"2025-07-01 09:30", "2025-07-01"},
+		{"2025-07-01 14:59", "2025-07-01"},
+		{"2025-06-30 21:05", "2025-07-01"}, // 夜盘归入下一个交易日
+		{"2025-07-02 01:30", "2025-07-02"},
+		{"2025-07-04 21:00", "2025-07-07"}, // 周五夜盘归入下周一
+		{"2025-07-05 01:00", "2025-07-07"},
+	}
+	for _, tt := range tests {
+		if got := webTradingDay(at(tt.tick)).Format("2006-01-02"); got != tt.day {
+			t.Errorf("webTradingDay(%s) = %s, want %s", tt.tick, got, tt.day)
+		}
+	}
+
+	from, to := webSessionBounds(at("2025-07-07 00:00"))
+	if from != at("2025-07-04 20:00") || to != at("2025-07-07 20:00") {
+		t.Errorf("Monday session = %v ~ %v, want Friday 20:00 ~ Monday 20:00", from, to)
+	}
+	from, to = webSessionBounds(at("2025-07-01 00:00"))
+	if from != at("2025-06-30 20:00") || to != at("2025-07-01 20:00") {
+		t.Errorf("Tuesday session = %v ~ %v", from, to)
+	}
+
+	for _, spec := range []string{"session:2025-07-05", "session:20250701", "session:"} {
+		if err := webValidateDatasetRange(spec); err == nil {
+			t.Errorf("webValidateDatasetRange(%q) should fail", spec)
+		}
+	}
+}
+
+func TestWebSessionNavEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"/api/v1/session?table=tst&symbol=tst2509", `"range":"session:2025-07-01"`},
+		{"/api/v1/session?table=tst&symbol=tst2509&date=2025-07-01&step=-1", "没有更早的交易时段"},
+		{"/api/v1/session?table=tst&symbol=tst2509&date=2025-07-02&step=-1", `"from":"2025-06-30 20:00:00","range":"session:2025-07-01"`},
+		{"/api/v1/session?table=tst&symbol=tst2509&step=2", "step参数无效"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		webSessionNavHandler(rec, httptest.NewRequest("GET", tt.query, nil))
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s = %s, want %s", tt.query, rec.Body.String(), tt.want)
+		}
+	}
+
+	// 交易时段范围按该交易日的时间窗口查询
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 1000
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01&raw=1", nil))
+	var resp struct {
+		Data    []WebMarketData `json:"data"`
+		Dataset string          `json:"dataset"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Data) != 60 {
+		t.Fatalf("session data = %d rows, %v: %.200s", len(resp.Data), err, rec.Body.String())
+	}
+	if resp.Dataset != "tst/tst2509@session:2025-07-01" {
+		t.Errorf("dataset = %q", resp.Dataset)
+	}
+}
+
+func TestWebSampleBars(t *testing.T) {
+	data := make([]WebMarketData, 1003)
+	var totalVol, totalOI int32
+	for i := range data {
+		data[i] = WebMarketData{Time: fmt.Sprintf("t%04d", i), DiffVol: int32(1 + i%7), DiffOI: int32(i%5 - 2)}
+		totalVol += data[i].DiffVol
+		totalOI += data[i].DiffOI
+	}
+
+	bars := webDownsample(data, 100, webDefaultDownsampling())
+	sampled := webSampleData(data, 100)
+	if len(bars) != len(sampled) {
+		t.Fatalf("%d bars, want the same %d points as webSampleData", len(bars), len(sampled))
+	}
+	var vol, oi int32
+	for i, bar := range bars {
+		if bar.Time != sampled[i].Time {
+			t.Fatalf("bar %d at %s, want %s", i, bar.Time, sampled[i].Time)
+		}
+		vol += bar.DiffVol
+		oi += bar.DiffOI
+	}
+	// 每根柱子累计了两个采样点之间的全部增量，总量守恒
+	if vol != totalVol || oi != totalOI {
+		t.Errorf("bars sum to vol %d oi %d, want %d %d", vol, oi, totalVol, totalOI)
+	}
+	// 采样步长为 ceil(1003/100) = 11，第二根柱子包含第1到第11笔
+	var want int32
+	for _, record := range data[1:12] {
+		want += record.DiffVol
+	}
+	if bars[1].DiffVol != want {
+		t.Errorf("bar 1 diff_vol = %d, want %d", bars[1].DiffVol, want)
+	}
+
+	if got := webDownsample(data[:50], 100, webDefaultDownsampling()); len(got) != 50 || &got[0] != &data[0] {
+		t.Error("short input should be returned unchanged")
+	}
+
+	// 副图着色方式保存在会话中
+	rec := httptest.NewRecorder()
+	webSessionHandler(rec, httptest.NewRequest("POST", "/session?flow_color=oi", nil))
+	var session struct {
+		FlowColor string `json:"flow_color"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil || session.FlowColor != "oi" {
+		t.Errorf("session = %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	webSessionHandler(rec, httptest.NewRequest("POST", "/session?flow_color=rainbow", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown flow_color: status %d", rec.Code)
+	}
+}
+
+func TestWebDownsampler(t *testing.T) {
+	// 成交量中的尖峰在 max 下保留，持仓量按 mean 平均，价格仍取采样点本身的值
+	data := make([]WebMarketData, 40)
+	for i := range data {
+		data[i] = WebMarketData{Time: fmt.Sprintf("t%02d", i), Price: float32(100 + i), OpenInterest: uint32(1000 + i), DiffVol: 1}
+	}
+	data[13].DiffVol = 50
+	strategy, err := webParseDownsampleParam("diff_vol:max, open_interest:mean", webDefaultDownsampling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strategy.String(); got != "price:sample,open_interest:mean,diff_vol:max,diff_oi:sum" {
+		t.Errorf("strategy = %s", got)
+	}
+	bars := webDownsample(data, 4, strategy)
+	if len(bars) != 4 {
+		t.Fatalf("%d bars", len(bars))
+	}
+	// 步长为10，第二个点 t10 的桶为第1到第10笔，第三个点 t20 的桶为第11到第20笔
+	if bars[2].DiffVol != 50 || bars[1].DiffVol != 1 {
+		t.Errorf("max diff_vol = %d %d, want 1 50", bars[1].DiffVol, bars[2].DiffVol)
+	}
+	if bars[2].Time != "t20" || bars[2].Price != 120 || bars[2].OpenInterest != 1016 {
+		t.Errorf("bar 2 = %+v, want t20 price 120 oi 1016", bars[2])
+	}
+	if bars[3].OpenInterest != 1030 {
+		t.Errorf("last bar oi = %d, want the mean of the trailing rows 1030", bars[3].OpenInterest)
+	}
+	if sum := webDownsample(data, 4, webDefaultDownsampling()); sum[2].DiffVol != 59 {
+		t.Errorf("sum diff_vol = %d, want 59", sum[2].DiffVol)
+	}
+
+	for raw, msg := range map[string]string{
+		"diff_vol:median": `unknown downsampler "median"`,
+		"volume:max":      `unknown series "volume"`,
+		"diff_vol":        "expected series:strategy",
+	} {
+		if _, err := webParseDownsampleParam(raw, webDefaultDownsampling()); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: err = %v, want %q", raw, err, msg)
+		}
+	}
+
+	// 配置文件中给出的序列覆盖默认策略，省略的保持默认
+	path := filepath.Join(t.TempDir(), "web.json")
+	base := webSettings{AlertThreshold: 0.8, AlertTicks: 3, CatalogTTL: time.Minute, Theme: "light", Downsampling: webDefaultDownsampling()}
+	if err := os.WriteFile(path, []byte(`{"downsampling": {"diff_vol": "max"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := webLoadSettings(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"downsampling.diff_vol: sum → max"}
+	if changes := webDiffSettings(base, s); !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %q, want %q", changes, want)
+	}
+	if err := os.WriteFile(path, []byte(`{"downsampling": {"diff_oi": "mode"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webLoadSettings(path, base); err == nil || !strings.Contains(err.Error(), "downsampling") {
+		t.Errorf("invalid downsampling: err = %v", err)
+	}
+
+	// /data?downsample= 按请求覆盖策略
+	newFakeClickHouse(t)
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 10
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01&raw=1&downsample=diff_vol:max", nil))
+	var resp struct {
+		Data  []WebMarketData `json:"data"`
+		Stats struct {
+			Mode         string            `json:"mode"`
+			Downsampling map[string]string `json:"downsampling"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %.200s", err, rec.Body.String())
+	}
+	if resp.Stats.Mode != "capped" || resp.Stats.Downsampling["diff_vol"] != "max" || resp.Stats.Downsampling["diff_oi"] != "sum" {
+		t.Errorf("stats = %+v", resp.Stats)
+	}
+	rec = httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01&downsample=diff_vol:loudest", nil))
+	if !strings.Contains(rec.Body.String(), "降采样策略无效") {
+		t.Errorf("invalid downsample = %.200s", rec.Body.String())
+	}
+}
+
+func TestWebSampleDataCap(t *testing.T) {
+	// 步长向上取整：数据量不足 2*size 时也不会原样返回
+	const size = 100
+	for _, n := range []int{size + 1, 2*size - 1, 2 * size, 3*size + 7} {
+		data := make([]WebMarketData, n)
+		if got := len(webSampleData(data, size)); got > size {
+			t.Errorf("webSampleData(%d rows, %d) = %d points", n, size, got)
+		}
+		if got := len(webDownsample(data, size, webDefaultDownsampling())); got > size {
+			t.Errorf("webDownsample(%d rows, %d) = %d points", n, size, got)
+		}
+	}
+}
+
+func TestWebDataExactStats(t *testing.T) {
+	newFakeClickHouse(t)
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 1000
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+
+	// 缩放窗口限制为10个点时统计基于采样点，exact=1 另外返回窗口内全部原始数据的统计
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01"+
+		"&from=2025-07-01+09:00:00&to=2025-07-01+09:00:59&points=10&exact=1", nil))
+	var resp struct {
+		Stats struct {
+			DataPoints    int  `json:"data_points"`
+			Sampled       bool `json:"sampled"`
+			WindowRecords int  `json:"window_records"`
+			Exact         *struct {
+				DataPoints int     `json:"data_points"`
+				AvgPrice   float64 `json:"avg_price"`
+			} `json:"exact"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %.200s", err, rec.Body.String())
+	}
+	st := resp.Stats
+	if !st.Sampled || st.DataPoints > 10 || st.Exact == nil || st.Exact.DataPoints != st.WindowRecords || st.WindowRecords <= st.DataPoints {
+		t.Fatalf("stats = %+v: %.300s", st, rec.Body.String())
+	}
+
+	// 不带 exact 时不计算精确统计；原始数据全部显示时不标记采样
+	rec = httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=session:2025-07-01&raw=1", nil))
+	if body := rec.Body.String(); strings.Contains(body, `"sampled"`) || strings.Contains(body, `"exact"`) {
+		t.Errorf("raw stats = %.300s", body)
+	}
+}
+
+func TestWebReplayRoom(t *testing.T) {
+	newFakeClickHouse(t)
+	defer func() { webReplayRooms = map[string]*webReplayRoom{} }()
+
+	do := func(method, target string) (int, webReplayState, string) {
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/api/v1/replay/") {
+			webReplayHandler(rec, httptest.NewRequest(method, target, nil))
+		} else {
+			webReplaysHandler(rec, httptest.NewRequest(method, target, nil))
+		}
+		var state webReplayState
+		json.Unmarshal(rec.Body.Bytes(), &state)
+		return rec.Code, state, rec.Body.String()
+	}
+
+	code, state, body := do("POST", "/api/v1/replay?table=tst&symbol=tst2509&date=2025-07-01&speed=60")
+	if code != http.StatusCreated || state.Room != "tst2509-2025-07-01" || state.Playing {
+		t.Fatalf("create = %d %s", code, body)
+	}
+	if state.From != "2025-06-30 20:00:00" || state.Clock < state.From || state.Clock >= state.To {
+		t.Errorf("clock %s not inside session %s - %s", state.Clock, state.From, state.To)
+	}
+	if code, _, _ := do("POST", "/api/v1/replay?table=tst&symbol=tst2509&date=2025-07-01"); code != http.StatusConflict {
+		t.Errorf("duplicate room = %d, want 409", code)
+	}
+	if code, _, _ := do("POST", "/api/v1/replay?symbol=tst2509&date=2025-07-01&room=a/b"); code != http.StatusBadRequest {
+		t.Errorf("invalid room name = %d, want 400", code)
+	}
+
+	// 拖动超出交易时段时夹到边界
+	name := "/api/v1/replay/" + state.Room
+	if _, s, body := do("POST", name+"?action=seek&at=2025-08-01+00:00:00"); s.Clock != state.To {
+		t.Errorf("seek past end = %s", body)
+	}
+	if _, s, body := do("POST", name+"?action=seek&at=2025-07-01+10:00:00"); s.Clock != "2025-07-01 10:00:00" {
+		t.Errorf("seek = %s", body)
+	}
+	if code, _, _ := do("POST", name+"?action=rewind"); code != http.StatusBadRequest {
+		t.Errorf("invalid action = %d, want 400", code)
+	}
+
+	// 播放时时钟按速度推进，到结尾自动暂停
+	room := webReplayRooms[state.Room]
+	start := time.Now()
+	room.clock, room.base, room.playing = room.to.Add(-2*time.Minute), start, true
+	room.advanceLocked(start.Add(time.Second))
+	if got := room.to.Sub(room.clock); got != time.Minute || !room.playing {
+		t.Errorf("after 1s at 60x: %v before end, playing=%v", got, room.playing)
+	}
+	room.advanceLocked(start.Add(5 * time.Second))
+	if !room.clock.Equal(room.to) || room.playing {
+		t.Errorf("clock %v playing=%v, want stopped at end", room.clock, room.playing)
+	}
+
+	// 无权访问该合约的用户看不到房间，也不能创建、查看、控制或关闭
+	other := &webACLUser{Name: "other", Tables: []string{"jm"}}
+	as := func(method, target string) (int, string) {
+		req := httptest.NewRequest(method, target, nil)
+		req = req.WithContext(webWithUser(req.Context(), other))
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/api/v1/replay/") {
+			webReplayHandler(rec, req)
+		} else {
+			webReplaysHandler(rec, req)
+		}
+		return rec.Code, rec.Body.String()
+	}
+	if _, body := as("GET", "/api/v1/replay"); !strings.Contains(body, `"rooms":[]`) {
+		t.Errorf("rooms for other user = %s", body)
+	}
+	if code, _ := as("POST", "/api/v1/replay?table=tst&symbol=tst2509&date=2025-07-01&room=mine"); code != http.StatusForbidden {
+		t.Errorf("create by other user = %d, want 403", code)
+	}
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		if code, _ := as(method, name+"?action=play"); code != http.StatusForbidden {
+			t.Errorf("%s by other user = %d, want 403", method, code)
+		}
+	}
+	if webReplayRooms[state.Room] == nil || webReplayRooms["mine"] != nil || room.playing {
+		t.Errorf("denied requests changed rooms")
+	}
+
+	if code, _, _ := do("DELETE", name); code != http.StatusOK {
+		t.Errorf("delete = %d", code)
+	}
+	if _, _, body := do("GET", "/api/v1/replay"); !strings.Contains(body, `"rooms":[]`) {
+		t.Errorf("rooms after delete = %s", body)
+	}
+}
+
+func TestWebRangeLink(t *testing.T) {
+	defer func() { webRangeLinks = map[string]*webRangeLink{} }()
+
+	do := func(method, target string) (int, webRangeState, string) {
+		rec := httptest.NewRecorder()
+		webRangeLinkHandler(rec, httptest.NewRequest(method, target, nil))
+		var state webRangeState
+		json.Unmarshal(rec.Body.Bytes(), &state)
+		return rec.Code, state, rec.Body.String()
+	}
+
+	// 还没有设置过的组返回空范围
+	if _, s, body := do("GET", "/api/v1/range/desk"); s.From != "" || s.Version != 0 {
+		t.Errorf("empty link = %s", body)
+	}
+	_, s, body := do("POST", "/api/v1/range/desk?from=2025-07-01+09:00:00&to=2025-07-01T11:30:00&source=a")
+	if s.From != "2025-07-01 09:00:00" || s.To != "2025-07-01 11:30:00" || s.Version != 1 || s.Source != "a" {
+		t.Errorf("set = %s", body)
+	}
+	if _, s, body := do("POST", "/api/v1/range/desk?from=2025-07-01+10:00:00&to=2025-07-01+10:30:00&source=b"); s.Version != 2 {
+		t.Errorf("second set = %s", body)
+	}
+	if _, s, body := do("GET", "/api/v1/range/desk"); s.From != "2025-07-01 10:00:00" || s.Source != "b" {
+		t.Errorf("get = %s", body)
+	}
+
+	for _, target := range []string{
+		"/api/v1/range/desk?from=2025-07-01+11:00:00&to=2025-07-01+10:00:00",
+		"/api/v1/range/desk?from=yesterday&to=2025-07-01+10:00:00",
+		"/api/v1/range/a.b?from=2025-07-01+09:00:00&to=2025-07-01+10:00:00",
+	} {
+		if code, _, body := do("POST", target); code != http.StatusBadRequest {
+			t.Errorf("%s = %d %s, want 400", target, code, body)
+		}
+	}
+}
+
+// 客户端帧：按 RFC 6455 编码，masked 为 false 时不掩码（违反协议）
+func wsClientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, maskBit|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, maskBit|127), uint64(n))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func TestWebWSReadLimits(t *testing.T) {
+	read := func(frames ...[]byte) (byte, []byte, error) {
+		server, peer := net.Pipe()
+		defer peer.Close()
+		client := newWebWSClient(server, bufio.NewReader(server))
+		defer client.close()
+		go func() {
+			for _, frame := range frames {
+				if _, err := peer.Write(frame); err != nil {
+					return
+				}
+			}
+		}()
+		return client.readMessage()
+	}
+	closeCode := func(err error) uint16 {
+		var closeErr *webWSCloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.code
+		}
+		return 0
+	}
+
+	// 分片的消息拼接后返回
+	opcode, message, err := read(wsClientFrame(false, 0x1, []byte(`{"sub":`), true), wsClientFrame(true, 0x0, []byte(`"jm2509"}`), true))
+	if err != nil || opcode != 0x1 || string(message) != `{"sub":"jm2509"}` {
+		t.Fatalf("fragmented message = %x %q %v", opcode, message, err)
+	}
+	// 每个分片都不超过单帧限制，但合计超过上限时以1009关闭，不会无限累积
+	half := bytes.Repeat([]byte("x"), WS_MAX_MESSAGE/2+1)
+	if _, _, err := read(wsClientFrame(false, 0x1, half, true), wsClientFrame(false, 0x0, half, true)); closeCode(err) != WS_CLOSE_TOO_BIG {
+		t.Errorf("oversized fragmented message: %v", err)
+	}
+	// 未掩码的客户端帧以1002关闭
+	if _, _, err := read(wsClientFrame(true, 0x1, []byte(`{"sub":"jm2509"}`), false)); closeCode(err) != WS_CLOSE_PROTOCOL_ERROR {
+		t.Errorf("unmasked frame: %v", err)
+	}
+	if _, _, err := read(wsClientFrame(true, 0x9, bytes.Repeat([]byte("p"), 126), true)); closeCode(err) != WS_CLOSE_PROTOCOL_ERROR {
+		t.Errorf("long ping: %v", err)
+	}
+}
+
+func TestWebWSBackpressure(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := newWebWSClient(server, bufio.NewReader(server))
+	defer client.close()
+
+	// 没有写出时队列写满，继续发送增量帧会丢弃最旧的增量帧而不是阻塞；
+	// 快照等必须送达的帧挤掉最旧的增量帧，自己不会被丢弃
+	if err := client.sendJSON(map[string]interface{}{"type": "snapshot"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < WS_SEND_BUFFER+1; i++ {
+		if err := client.sendUpdate(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.sendJSON(map[string]interface{}{"type": "backfill"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.dropped.Load(); got != 3 {
+		t.Fatalf("dropped = %d, want 3", got)
+	}
+
+	go client.writeLoop()
+	readFrame := func() map[string]interface{} {
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(peer, header); err != nil {
+			t.Fatal(err)
+		}
+		length := int(header[1] & 0x7F)
+		if length == 126 {
+			ext := make([]byte, 2)
+			io.ReadFull(peer, ext)
+			length = int(binary.BigEndian.Uint16(ext))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(peer, payload); err != nil {
+			t.Fatal(err)
+		}
+		var frame map[string]interface{}
+		json.Unmarshal(payload, &frame)
+		return frame
+	}
+	if frame := readFrame(); frame["type"] != "snapshot" {
+		t.Fatalf("first frame %v, want the snapshot", frame)
+	}
+	for i := 3; i < WS_SEND_BUFFER+1; i++ {
+		if frame := readFrame(); frame["n"] != float64(i) {
+			t.Fatalf("frame %v, want n=%d", frame, i)
+		}
+	}
+	if frame := readFrame(); frame["type"] != "backfill" {
+		t.Fatalf("frame %v, want the backfill", frame)
+	}
+	if frame := readFrame(); frame["type"] != "lagged" || frame["dropped"] != float64(3) {
+		t.Errorf("after draining got %v, want lagged notice", frame)
+	}
+
+	client.close()
+	if err := client.sendJSON(map[string]int{"n": 0}); err == nil {
+		t.Error("send on closed client succeeded")
+	}
+
+	// 队列里全是必须送达的帧时，新的增量帧被丢弃；再来必须送达的帧则断开连接，而不是丢掉其中任何一帧
+	server2, peer2 := net.Pipe()
+	defer peer2.Close()
+	stuck := newWebWSClient(server2, bufio.NewReader(server2))
+	for i := 0; i < WS_SEND_BUFFER; i++ {
+		if err := stuck.sendJSON(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stuck.sendUpdate(map[string]int{"n": -1}); err != nil || stuck.dropped.Load() != 1 || stuck.queued() != WS_SEND_BUFFER {
+		t.Fatalf("update on a full reliable queue: err %v, dropped %d, queued %d", err, stuck.dropped.Load(), stuck.queued())
+	}
+	if err := stuck.sendJSON(map[string]int{"n": WS_SEND_BUFFER}); err == nil {
+		t.Fatal("reliable frame on a full queue should disconnect the client")
+	}
+	select {
+	case <-stuck.done:
+	default:
+		t.Error("client still open after its reliable queue overflowed")
+	}
+
+	// 连接统计包含远端地址，只对管理员开放
+	for _, u := range []*webACLUser{nil, {Name: "alice"}, {Name: "root", Admin: true}} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/ws/stats", nil)
+		webWSStatsHandler(rec, req.WithContext(webWithUser(req.Context(), u)))
+		if want := map[bool]int{false: http.StatusForbidden, true: http.StatusOK}[u != nil && u.Admin]; rec.Code != want {
+			t.Errorf("ws stats for %+v: %d, want %d", u, rec.Code, want)
+		}
+	}
+}
+
+func TestWebReportEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+	oldDir := webIncidentsDir
+	webIncidentsDir = t.TempDir()
+	defer func() { webIncidentsDir = oldDir }()
+
+	// 同一交易日内的告警写入日报，其他合约和其他交易日的不写入
+	for _, incident := range []webIncident{
+		{ID: "a", Symbol: "tst2509", Time: "2025-07-01 09:00:30", Side: "bid", Imbalance: 0.82, Ticks: 5, BidVolume: 50, AskVolume: 5},
+		{ID: "b", Symbol: "tst2509", Time: "2025-07-02 09:00:30", Side: "ask", Imbalance: -0.7, Ticks: 5},
+		{ID: "c", Symbol: "other2509", Time: "2025-07-01 09:00:30", Side: "ask", Imbalance: -0.7, Ticks: 5},
+	} {
+		os.MkdirAll(filepath.Join(webIncidentsDir, incident.ID), 0755)
+		meta, _ := json.Marshal(incident)
+		os.WriteFile(filepath.Join(webIncidentsDir, incident.ID, "incident.json"), meta, 0644)
+	}
+
+	tests := []struct {
+		name, query string
+	}{
+		{"report.json", "/api/v1/report?table=tst&symbol=tst2509&date=2025-07-01"},
+		{"report.md", "/api/v1/report?table=tst&symbol=tst2509&date=2025-07-01&format=md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			webReportHandler(rec, httptest.NewRequest("GET", tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+			body := rec.Body.Bytes()
+			if filepath.Ext(tt.name) == ".json" {
+				body = goldenJSON(t, body)
+			}
+			checkGolden(t, tt.name, body)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	webReportHandler(rec, httptest.NewRequest("GET", "/api/v1/report?symbol=tst2509&date=2025-07-05", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("weekend date: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// 内存中的Redis替身，支持共享缓存用到的 AUTH/SELECT/PING/GET/SET [NX] [PX]/DEL（过期时间忽略），
+// EVAL 只支持释放锁的比较删除脚本
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu     sync.Mutex
+	values map[string]string
+	conns  []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRedis{listener: listener, password: password, values: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fake.mu.Lock()
+			fake.conns = append(fake.conns, conn)
+			fake.mu.Unlock()
+			go fake.serve(conn)
+		}
+	}()
+	t.Cleanup(fake.close)
+	return fake
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			header, _ := reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			buf := make([]byte, size+2)
+			io.ReadFull(reader, buf)
+			args[i] = string(buf[:size])
+		}
+
+		f.mu.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			if v, ok := f.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case cmd == "SET":
+			_, exists := f.values[args[1]]
+			if exists && len(args) > 3 && strings.ToUpper(args[3]) == "NX" {
+				reply = "$-1\r\n"
+			} else {
+				f.values[args[1]] = args[2]
+				reply = "+OK\r\n"
+			}
+		case cmd == "DEL":
+			delete(f.values, args[1])
+			reply = ":1\r\n"
+		case cmd == "EVAL" && args[1] == webSharedCacheUnlockScript:
+			reply = ":0\r\n"
+			if v, ok := f.values[args[3]]; ok && v == args[4] {
+				delete(f.values, args[3])
+				reply = ":1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func TestWebSharedCache(t *testing.T) {
+	clickhouse := newFakeClickHouse(t)
+	redis := newFakeRedis(t, "secret")
+	client, err := webParseRedisURL("redis://:secret@" + redis.listener.Addr().String() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCache, oldTTL := webSharedCache, webSharedCacheTTL
+	webSharedCache, webSharedCacheTTL = client, time.Minute
+	defer func() { webSharedCache, webSharedCacheTTL = oldCache, oldTTL }()
+
+	// 多个请求同时执行同一查询，只有一个访问ClickHouse，其余读取缓存
+	const query = "SELECT 1 FROM feature.tst LIMIT 1"
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	errs := make([]error, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = webExecuteSharedQuery(context.Background(), query)
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		if errs[i] != nil || results[i] != "1\n" {
+			t.Errorf("result %d = %q, %v", i, results[i], errs[i])
+		}
+	}
+	if clickhouse.requests != 1 {
+		t.Errorf("ClickHouse queried %d times, want 1", clickhouse.requests)
+	}
+
+	// 锁过期后被其他实例取得时，原来的持有者释放锁不会删掉它
+	redis.values["lock"] = "other"
+	webReleaseSharedCacheLock("lock", webSharedCacheToken())
+	if redis.values["lock"] != "other" {
+		t.Errorf("released a lock held by another instance")
+	}
+	webReleaseSharedCacheLock("lock", "other")
+	if _, ok := redis.values["lock"]; ok {
+		t.Errorf("lock not released by its holder")
+	}
+	for key := range redis.values {
+		if strings.HasSuffix(key, ":lock") {
+			t.Errorf("lock %s left behind after query", key)
+		}
+	}
+
+	// Redis不可用时直接查询ClickHouse
+	redis.close()
+	if result, err := webExecuteSharedQuery(context.Background(), query); err != nil || result != "1\n" {
+		t.Errorf("without redis: %q, %v", result, err)
+	}
+	if clickhouse.requests != 2 {
+		t.Errorf("ClickHouse queried %d times after redis went away, want 2", clickhouse.requests)
+	}
+
+	for _, raw := range []string{"http://localhost:6379", "redis://", "redis://localhost/abc"} {
+		if _, err := webParseRedisURL(raw); err == nil {
+			t.Errorf("webParseRedisURL(%q) should fail", raw)
+		}
+	}
+}
+
+func TestWebGetDatasetSingleflight(t *testing.T) {
+	clickhouse := newFakeClickHouse(t)
+	key := webDatasetKey{"tst", "tst2509", "all"}
+	oldTTL := webCacheTTL
+	webCacheTTL = time.Minute
+	defer func() {
+		webDatasetsMutex.Lock()
+		webCacheTTL = oldTTL
+		delete(webDatasets, key)
+		delete(webDatasetCalls, key)
+		webDatasetsMutex.Unlock()
+	}()
+	webDatasetsMutex.Lock()
+	delete(webDatasets, key)
+	webDatasetsMutex.Unlock()
+
+	// 同一数据集正在查询时，同时未命中的请求等待它的结果，不再访问ClickHouse
+	want := []WebMarketData{{Symbol: "tst2509", Price: 1}}
+	call := &webDatasetCall{done: make(chan struct{}), gen: webProfileGeneration.Load()}
+	webDatasetsMutex.Lock()
+	webDatasetCalls[key] = call
+	webDatasetsMutex.Unlock()
+	var wg sync.WaitGroup
+	results := make([][]WebMarketData, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = webGetDataset(context.Background(), key)
+		}(i)
+	}
+	call.data, call.err = want, nil
+	close(call.done)
+	wg.Wait()
+	for i, data := range results {
+		if len(data) != 1 || data[0] != want[0] {
+			t.Errorf("waiter %d got %v", i, data)
+		}
+	}
+	if clickhouse.requests != 0 {
+		t.Errorf("ClickHouse queried %d times while a query was in flight, want 0", clickhouse.requests)
+	}
+
+	// 发起查询的请求被取消时，等待的请求自己查询
+	call = &webDatasetCall{done: make(chan struct{}), gen: webProfileGeneration.Load()}
+	webDatasetsMutex.Lock()
+	webDatasetCalls[key] = call
+	webDatasetsMutex.Unlock()
+	done := make(chan []WebMarketData)
+	go func() {
+		data, _, err := webGetDataset(context.Background(), key)
+		if err != nil {
+			t.Errorf("after cancelled query: %v", err)
+		}
+		done <- data
+	}()
+	webDatasetsMutex.Lock()
+	call.err = context.Canceled
+	delete(webDatasetCalls, key)
+	webDatasetsMutex.Unlock()
+	close(call.done)
+	if data := <-done; len(data) != 60 || clickhouse.requests == 0 {
+		t.Errorf("after cancelled query: %d rows, %d ClickHouse requests", len(data), clickhouse.requests)
+	}
+}
+
+func TestWebQueryLimits(t *testing.T) {
+	var mu sync.Mutex
+	var settings url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		settings = r.URL.Query()
+		mu.Unlock()
+		switch r.URL.Query().Get("query") {
+		case "rows":
+			http.Error(w, "Code: 396. DB::Exception: Limit for result exceeded, max rows: 100.00, current rows: 65.41 thousand. (TOO_MANY_ROWS_OR_BYTES)", http.StatusInternalServerError)
+		case "streamed":
+			// 结果已经开始返回后才超限，异常追加在200响应末尾
+			io.WriteString(w, "tst2509\t720\nCode: 396. DB::Exception: Limit for result exceeded, max bytes: 1.00 KiB. (TOO_MANY_ROWS_OR_BYTES)\n")
+		case "large":
+			io.WriteString(w, strings.Repeat("tst2509\t720\n", 200))
+		case "slow":
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	oldURL, oldRows, oldBytes, oldTimeout := webClickHouseURL, webMaxQueryRows, webMaxQueryBytes, webQueryTimeout
+	webClickHouseURL, webMaxQueryRows, webMaxQueryBytes, webQueryTimeout = server.URL, 100, 1024, 100*time.Millisecond
+	defer func() {
+		webClickHouseURL, webMaxQueryRows, webMaxQueryBytes, webQueryTimeout = oldURL, oldRows, oldBytes, oldTimeout
+	}()
+
+	for _, tc := range []struct{ query, flag string }{
+		{"slow", "-query-timeout"},
+		{"rows", "-max-query-rows"},
+		{"streamed", "-max-query-bytes"},
+		{"large", "-max-query-bytes"},
+	} {
+		_, err := webExecuteQuery(tc.query)
+		var limitErr *webQueryLimitError
+		if !errors.As(err, &limitErr) || limitErr.flag != tc.flag {
+			t.Errorf("%s: err = %v, want limit error for %s", tc.query, err, tc.flag)
+			continue
+		}
+		if !strings.Contains(err.Error(), "缩小时间范围") {
+			t.Errorf("%s: error should suggest a narrower range: %v", tc.query, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if settings.Get("max_result_rows") != "100" || settings.Get("max_result_bytes") != "1024" || settings.Get("result_overflow_mode") != "throw" {
+		t.Errorf("limits not passed to ClickHouse: %v", settings)
+	}
+}
+
+func TestWebQueryClientDisconnect(t *testing.T) {
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		switch {
+		case query == "SHOW TABLES":
+			io.WriteString(w, "tst\n")
+		case strings.HasPrefix(query, "SELECT DISTINCT symbol"):
+			io.WriteString(w, "tst2509\n")
+		case strings.HasPrefix(query, "DESCRIBE"):
+			for _, col := range webExpectedColumns {
+				fmt.Fprintf(w, "%s\t%s\n", col.name, col.families[0])
+			}
+		case strings.HasPrefix(query, "EXISTS"):
+			io.WriteString(w, "0\n")
+		default:
+			// 数据查询一直不返回，直到客户端取消
+			started <- struct{}{}
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	oldURL, oldTimeout := webClickHouseURL, webQueryTimeout
+	webClickHouseURL, webQueryTimeout = server.URL, time.Minute
+	defer func() { webClickHouseURL, webQueryTimeout = oldURL, oldTimeout }()
+	resetCatalog()
+	defer func() {
+		resetCatalog()
+		webValidatedTablesMutex.Lock()
+		delete(webValidatedTables, "tst")
+		webValidatedTablesMutex.Unlock()
+	}()
+
+	// 页面关闭（请求的context取消）后，还在进行的ClickHouse查询随之中止，而不是等到 -query-timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=all", nil).WithContext(ctx))
+		done <- rec.Code
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("data query never reached ClickHouse")
+	}
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ClickHouse query was not canceled after the client went away")
+	}
+	<-done
+}
+
+func TestWebQueryJobEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 1000
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+
+	rec := httptest.NewRecorder()
+	webJobsHandler(rec, httptest.NewRequest("POST", "/api/v1/jobs?table=tst&symbol=tst2509&range=all", nil))
+	var job webJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || rec.Code != http.StatusAccepted || job.ID == "" {
+		t.Fatalf("create job: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Location") != "/api/v1/jobs/"+job.ID {
+		t.Errorf("Location = %q", rec.Header().Get("Location"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == JOB_RUNNING && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec = httptest.NewRecorder()
+		webJobHandler(rec, httptest.NewRequest("GET", "/api/v1/jobs/"+job.ID, nil))
+		job = webJob{}
+		json.Unmarshal(rec.Body.Bytes(), &job)
+	}
+	if job.State != JOB_DONE || job.Rows != 60 || job.RowsReceived != 60 || job.Progress != 1 || job.Dataset != "tst/tst2509@all" {
+		t.Fatalf("job = %+v", job)
+	}
+
+	rec = httptest.NewRecorder()
+	webJobHandler(rec, httptest.NewRequest("GET", "/api/v1/jobs/"+job.ID+"/result", nil))
+	var result struct {
+		Rows int             `json:"rows"`
+		Data []WebMarketData `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Rows != 60 || len(result.Data) != 60 {
+		t.Errorf("result = %d rows, %v: %.200s", result.Rows, err, rec.Body.String())
+	}
+
+	// /data?job= 直接使用任务结果；数据集不一致或任务不存在时报错
+	tests := []struct {
+		query, want string
+	}{
+		{"/data?table=tst&symbol=tst2509&range=all&raw=1&job=" + job.ID, `"dataset":"tst/tst2509@all"`},
+		{"/data?table=tst&symbol=tst2509&range=1d&job=" + job.ID, "与请求的 tst/tst2509@1d 不一致"},
+		{"/data?table=tst&symbol=tst2509&job=missing", "不存在或已过期"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		webDataHandler(rec, httptest.NewRequest("GET", tt.query, nil))
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s = %.300s, want %s", tt.query, rec.Body.String(), tt.want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	webJobHandler(rec, httptest.NewRequest("GET", "/api/v1/jobs/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing job status = %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	webJobsHandler(rec, httptest.NewRequest("POST", "/api/v1/jobs?table=tst&symbol=tst2509&range=bogus", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid range status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWebJobPreview(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "clickhouse", "1b5ce82ffd19.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := webParseTabSeparatedData(string(body))
+
+	// 按任意边界切开的数据块（包括截断在一行中间）逐块解析，结果与一次性解析相同
+	parser := &webStreamParser{}
+	for i := 0; i < len(body); i += 37 {
+		end := i + 37
+		if end > len(body) {
+			end = len(body)
+		}
+		parser.Write(body[i:end])
+		if rows, _ := parser.snapshot(JOB_PREVIEW_POINTS); rows > strings.Count(string(body[:end]), "\n") {
+			t.Fatalf("parsed %d rows before their line ended", rows)
+		}
+	}
+	rows, sampled := parser.snapshot(JOB_PREVIEW_POINTS)
+	if rows != len(want) || !reflect.DeepEqual(sampled, want) {
+		t.Fatalf("stream parsed %d rows, want %d", rows, len(want))
+	}
+	if _, sampled := parser.snapshot(10); len(sampled) > 2*10 || sampled[0] != want[0] {
+		t.Errorf("sampled preview = %d points", len(sampled))
+	}
+
+	// 大结果只保留有界的等间隔采样，行数仍按全部解析的行计
+	big := &webStreamParser{}
+	n := 3*STREAM_PREVIEW_ROWS + 5
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(big, "tst2509\t2025-07-01 09:00:00\t1001\t%d\t52002\t3\t2\t1000\t5\t1001\t4\t20250701090000000\n", i)
+	}
+	if big.count != n || len(big.rows) > STREAM_PREVIEW_ROWS || big.stride != 4 {
+		t.Fatalf("parsed %d rows, kept %d with stride %d", big.count, len(big.rows), big.stride)
+	}
+	for k, md := range big.rows {
+		if int(md.Vol) != k*big.stride {
+			t.Fatalf("kept row %d has vol %d, want %d", k, md.Vol, k*big.stride)
+		}
+	}
+	if rows, sampled := big.snapshot(JOB_PREVIEW_POINTS); rows != n || len(sampled) > JOB_PREVIEW_POINTS {
+		t.Errorf("snapshot = %d rows, %d points", rows, len(sampled))
+	}
+
+	// 运行中的任务返回已接收部分的预览
+	half := bytes.LastIndexByte(body[:len(body)/2], '\n') + 1
+	job := &webJob{ID: "preview", State: JOB_RUNNING, key: webDatasetKey{"tst", "tst2509", "all"}, stream: &webStreamParser{}}
+	job.stream.Write(body[:half])
+	webJobsMutex.Lock()
+	webJobs[job.ID] = job
+	webJobsMutex.Unlock()
+	defer func() {
+		webJobsMutex.Lock()
+		delete(webJobs, job.ID)
+		webJobsMutex.Unlock()
+	}()
+
+	get := func(query string) (int, webJobPreviewData) {
+		rec := httptest.NewRecorder()
+		webJobHandler(rec, httptest.NewRequest("GET", query, nil))
+		var preview webJobPreviewData
+		json.Unmarshal(rec.Body.Bytes(), &preview)
+		return rec.Code, preview
+	}
+	code, preview := get("/api/v1/jobs/preview/partial")
+	if code != http.StatusOK || !preview.Partial || preview.Rows != strings.Count(string(body[:half]), "\n") ||
+		len(preview.Data) != preview.Rows || preview.Data[0] != want[0] || preview.Stats.TickSize != 0 {
+		t.Fatalf("running preview = %d %+v", code, preview)
+	}
+
+	// 完成后返回完整结果
+	webJobsMutex.Lock()
+	job.State, job.stream, job.data = JOB_DONE, nil, want
+	webJobsMutex.Unlock()
+	if code, preview := get("/api/v1/jobs/preview/partial?points=10"); code != http.StatusOK || preview.Partial || preview.Rows != len(want) || len(preview.Data) > 2*10 {
+		t.Errorf("finished preview = %d %+v", code, preview)
+	}
+
+	for query, status := range map[string]int{
+		"/api/v1/jobs/preview/partial?points=1": http.StatusBadRequest,
+		"/api/v1/jobs/missing/partial":          http.StatusNotFound,
+	} {
+		if code, _ := get(query); code != status {
+			t.Errorf("%s: status %d, want %d", query, code, status)
+		}
+	}
+}
+
+func TestWebVolatilityCone(t *testing.T) {
+	// 对数收益率 ±a 交替：任意偶数窗口的样本标准差都是 a*sqrt(n/(n-1))，各分位数和当前值相同
+	const a = 0.01
+	closes := []float64{100}
+	for i := 0; i < 40; i++ {
+		sign := 1.0
+		if i%2 == 1 {
+			sign = -1
+		}
+		closes = append(closes, closes[len(closes)-1]*math.Exp(sign*a))
+	}
+	cone := webVolatilityCone(closes, []int{2, 10, 50}, 252)
+	for j, n := range []int{2, 10} {
+		want := a * math.Sqrt(float64(n)/float64(n-1)) * math.Sqrt(252) * 100
+		if cone.Current[j] == nil || math.Abs(*cone.Current[j]-want) > 1e-9 {
+			t.Errorf("window %d current = %v, want %v", n, cone.Current[j], want)
+		}
+		for i := range cone.Percentiles {
+			if v := cone.Cone[i][j]; v == nil || math.Abs(*v-want) > 1e-9 {
+				t.Errorf("window %d p%v = %v, want %v", n, cone.Percentiles[i], v, want)
+			}
+		}
+		if cone.Samples[j] != 40-n+1 {
+			t.Errorf("window %d samples = %d", n, cone.Samples[j])
+		}
+	}
+	// 收益率个数不足窗口长度时为空
+	if cone.Current[2] != nil || cone.Cone[0][2] != nil || cone.Samples[2] != 0 {
+		t.Errorf("window 50 should be empty: %+v", cone)
+	}
+
+	if got := webPercentile([]float64{1, 2, 3, 4, 5}, 25); got != 2 {
+		t.Errorf("p25 = %v, want 2", got)
+	}
+	if got := webPercentile([]float64{1, 2}, 90); math.Abs(got-1.9) > 1e-12 {
+		t.Errorf("p90 = %v, want 1.9", got)
+	}
+
+	// 夜盘的小时收盘价归入下一交易日，周五夜盘归入下周一
+	loc := time.UTC
+	hour := func(s string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15", s, loc)
+		return t
+	}
+	days := webTradingDayCloses([]webBarClose{
+		{hour("2025-07-03 14"), 1}, {hour("2025-07-03 21"), 2}, {hour("2025-07-04 14"), 3},
+		{hour("2025-07-04 22"), 4}, {hour("2025-07-07 10"), 5},
+	})
+	want := []webBarClose{{hour("2025-07-03 00"), 1}, {hour("2025-07-04 00"), 3}, {hour("2025-07-07 00"), 5}}
+	if len(days) != len(want) {
+		t.Fatalf("trading day closes = %v", days)
+	}
+	for i := range want {
+		if !days[i].Time.Equal(want[i].Time) || days[i].Close != want[i].Close {
+			t.Errorf("day %d = %v, want %v", i, days[i], want[i])
+		}
+	}
+
+	for _, spec := range []string{"1", "5,x", "5,10,20,30,40,50,60,70,80,90,100,110,120"} {
+		if _, err := webParseVolConeWindows(spec); err == nil {
+			t.Errorf("webParseVolConeWindows(%q) should fail", spec)
+		}
+	}
+	if windows, err := webParseVolConeWindows("20, 5,20"); err != nil || fmt.Sprint(windows) != "[5 20]" {
+		t.Errorf("windows = %v, %v", windows, err)
+	}
+}
+
+func TestWebCorrelationMatrix(t *testing.T) {
+	base := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	series := func(prices []float64, skip int) []webBarClose {
+		var bars []webBarClose
+		for i, p := range prices {
+			if i != skip {
+				bars = append(bars, webBarClose{Time: base.Add(time.Duration(i) * time.Minute), Close: p})
+			}
+		}
+		return bars
+	}
+	a := []float64{100, 101, 100, 102, 101, 103, 102}
+	b := make([]float64, len(a))
+	c := make([]float64, len(a))
+	for i, p := range a {
+		b[i] = p * p / 100   // 对数收益率是a的两倍：完全正相关
+		c[i] = 100 * 100 / p // 对数收益率是a的相反数：完全负相关
+	}
+	closes := map[string][]webBarClose{
+		"a": series(a, -1),
+		"b": series(b, 3), // 缺一根K线：丢掉两侧的两个收益率
+		"c": series(c, -1),
+		"d": series(a[:3], -1),
+	}
+	m := webComputeCorrelationMatrix([]string{"a", "b", "c", "d"}, closes)
+
+	check := func(i, j int, want float64, count int) {
+		t.Helper()
+		if v := m.Matrix[i][j]; v == nil || math.Abs(*v-want) > 1e-9 {
+			t.Errorf("corr[%d][%d] = %v, want %v", i, j, v, want)
+		}
+		if m.Counts[i][j] != count {
+			t.Errorf("count[%d][%d] = %d, want %d", i, j, m.Counts[i][j], count)
+		}
+	}
+	check(0, 0, 1, 6)
+	check(0, 1, 1, 4)
+	check(1, 0, 1, 4)
+	check(0, 2, -1, 6)
+	check(1, 2, -1, 4)
+	// 只有两个收益率时样本不足
+	if m.Matrix[0][3] != nil || m.Counts[0][3] != 2 {
+		t.Errorf("corr[0][3] = %v (n=%d), want null", m.Matrix[0][3], m.Counts[0][3])
+	}
+
+	symbols, tables, order, err := webParseSymbolBasket("jm2509, j2509,i/i2601,jm2509")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(symbols, ",") != "jm2509,j2509,i2601" || strings.Join(order, ",") != "jm,j,i" || tables["i"][0] != "i2601" {
+		t.Errorf("basket = %v %v %v", symbols, order, tables)
+	}
+	for _, spec := range []string{"jm2509", "jm2509,bad-table/x", ""} {
+		if _, _, _, err := webParseSymbolBasket(spec); err == nil {
+			t.Errorf("basket %q: expected error", spec)
+		}
+	}
+}
+
+func TestWebBasis(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, 7, d, 0, 0, 0, 0, time.UTC) }
+	futures := []webBarClose{{day(1), 1000}, {day(2), 1010}, {day(3), 1020}, {day(4), 990}, {day(7), 1000}}
+	// 现货从2日开始发布，4日没有报价时沿用3日的价格
+	spot := []webBarClose{{day(2), 1000}, {day(3), 1000}, {day(7), 1010}}
+	points, stats := webComputeBasis(futures, spot, "2006-01-02")
+
+	want := []webBasisPoint{
+		{"2025-07-02", 1010, 1000, 10},
+		{"2025-07-03", 1020, 1000, 20},
+		{"2025-07-04", 990, 1000, -10},
+		{"2025-07-07", 1000, 1010, -10},
+	}
+	if !reflect.DeepEqual(points, want) {
+		t.Fatalf("points = %+v, want %+v", points, want)
+	}
+	if stats.Count != 4 || stats.Latest != -10 || stats.Mean != 2.5 || stats.Min != -10 || stats.Max != 20 {
+		t.Errorf("stats = %+v", stats)
+	}
+	// 方差 (100+400+100+100)/4 - 2.5^2 = 168.75
+	if math.Abs(stats.StdDev-math.Sqrt(168.75)) > 1e-9 || math.Abs(stats.ZScore-(-12.5/math.Sqrt(168.75))) > 1e-9 {
+		t.Errorf("stddev = %v, zscore = %v", stats.StdDev, stats.ZScore)
+	}
+	if stats.Percentile != 50 || math.Abs(stats.LatestRatePct-(-10.0/1010*100)) > 1e-9 {
+		t.Errorf("percentile = %v, rate = %v", stats.Percentile, stats.LatestRatePct)
+	}
+
+	if points, stats := webComputeBasis(futures, nil, "2006-01-02"); len(points) != 0 || stats.Count != 0 {
+		t.Errorf("without spot: %+v %+v", points, stats)
+	}
+
+	spots, err := webParseBasisSpot("jm=spot/jm_tangshan, i=index/i_pb62")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spots["jm"] != (webDatasetKey{"spot", "jm_tangshan", "all"}) || spots["i"].table != "index" {
+		t.Errorf("spots = %v", spots)
+	}
+	for _, spec := range []string{"jm", "jm=spot", "jm=bad-table/x"} {
+		if _, err := webParseBasisSpot(spec); err == nil {
+			t.Errorf("basis spot %q: expected error", spec)
+		}
+	}
+}
+
+func TestWebTermStructure(t *testing.T) {
+	at := time.Date(2025, 7, 1, 15, 0, 0, 0, time.UTC)
+	for symbol, want := range map[string]string{"jm2509": "2025-09", "SA509": "2025-09", "SA601": "2026-01", "ap410": "2034-10"} {
+		if expiry, ok := webContractExpiry(symbol, at); !ok || expiry.Format("2006-01") != want {
+			t.Errorf("expiry(%s) = %v, %v; want %s", symbol, expiry, ok, want)
+		}
+	}
+	for _, symbol := range []string{"jm", "jm2513", "jm25091"} {
+		if _, ok := webContractExpiry(symbol, at); ok {
+			t.Errorf("expiry(%s): expected failure", symbol)
+		}
+	}
+
+	quotes := []webTermQuote{
+		{Symbol: "jm2601", Price: 1000},
+		{Symbol: "jm2509", Price: 1100},
+		{Symbol: "jm2603", Price: 0},
+		{Symbol: "jm2605", Price: 1000},
+		{Symbol: "jmindex", Price: 1050},
+	}
+	ts := webBuildTermStructure(quotes, at)
+	var symbols []string
+	for _, p := range ts.Points {
+		symbols = append(symbols, p.Symbol)
+	}
+	if strings.Join(symbols, ",") != "jm2509,jm2601,jm2605" {
+		t.Fatalf("points = %v", symbols)
+	}
+	if ts.Points[0].RollYieldPct != nil {
+		t.Errorf("front roll yield = %v, want null", *ts.Points[0].RollYieldPct)
+	}
+	// 相隔4个月：ln(1100/1000)*12/4
+	if want := math.Log(1.1) * 3 * 100; ts.Points[1].RollYieldPct == nil || math.Abs(*ts.Points[1].RollYieldPct-want) > 1e-9 {
+		t.Errorf("roll yield = %v, want %v", ts.Points[1].RollYieldPct, want)
+	}
+	if want := math.Log(1.1) * 12 / 8 * 100; ts.FrontBackRollPct == nil || math.Abs(*ts.FrontBackRollPct-want) > 1e-9 {
+		t.Errorf("front-back roll yield = %v, want %v", ts.FrontBackRollPct, want)
+	}
+	if ts.Shape != "backwardation" {
+		t.Errorf("shape = %s", ts.Shape)
+	}
+
+	quotes[3].Price = 1200
+	if ts := webBuildTermStructure(quotes, at); ts.Shape != "mixed" {
+		t.Errorf("shape = %s, want mixed", ts.Shape)
+	}
+	if ts := webBuildTermStructure(quotes[:1], at); ts.Shape != "flat" || ts.FrontBackRollPct != nil {
+		t.Errorf("single contract: %+v", ts)
+	}
+}
+
+func TestWebQueryBuilder(t *testing.T) {
+	from := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	query, err := webSelect(context.Background(), "symbol", "toString("+webIntervalStart("time", 5*time.Minute)+") AS bucket").
+		From("jm").
+		Symbols([]string{"jm2509", "j2509"}).
+		TimeRange(from, from.Add(time.Hour)).
+		Where("price > 0").
+		GroupBy("symbol", "bucket").
+		OrderBy("symbol ASC", "bucket ASC").
+		Limit(10).
+		Settings("max_threads = 1").
+		Format("TabSeparated").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT symbol, toString(toStartOfInterval(time, INTERVAL 300 SECOND)) AS bucket FROM feature.jm" +
+		" WHERE symbol IN ('jm2509', 'j2509') AND time >= toDateTime('2025-07-01 09:00:00') AND time < toDateTime('2025-07-01 10:00:00') AND price > 0" +
+		" GROUP BY symbol, bucket ORDER BY symbol ASC, bucket ASC LIMIT 10 SETTINGS max_threads = 1 FORMAT TabSeparated"
+	if query != want {
+		t.Errorf("query =\n%s\nwant\n%s", query, want)
+	}
+
+	// 字符串常量中的引号和反斜杠被转义，不能闭合字符串
+	query, err = webSelect(context.Background(), "*").FromSubquery(webSelect(context.Background(), "time").From("jm").Symbol(`x' OR 1=1 --\`)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `SELECT * FROM (SELECT time FROM feature.jm WHERE symbol = 'x\' OR 1=1 --\\')`; query != want {
+		t.Errorf("query = %s, want %s", query, want)
+	}
+
+	for _, q := range []*webQuery{
+		webSelect(context.Background(), "1").From("jm; DROP TABLE jm"),
+		webSelect(context.Background(), "1").FromSubquery(webSelect(context.Background(), "1").From("a.b")),
+		webSelect(context.Background(), "1").FromSystem("processes--"),
+		webSelect(context.Background(), "1"),
+	} {
+		if query, err := q.Build(); err == nil {
+			t.Errorf("expected error, got %s", query)
+		}
+	}
+}
+
+func TestWebFieldMap(t *testing.T) {
+	newFakeClickHouse(t)
+	defer func() { webFieldMaps = nil }()
+
+	path := filepath.Join(t.TempDir(), "fields.json")
+	os.WriteFile(path, []byte(`{"SA": {"vol": "volume", "bid_volumn_1": "bid_volume_1"}, "tst": {"diff_oi": "oi_change"}}`), 0644)
+	maps, err := webLoadFieldMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webFieldMaps = maps
+
+	// 映射的列在子查询中按标准列名补上，外层查询不变；分钟线表使用标准列名
+	query, err := webSelect(context.Background(), "time", "vol").From("SA").Symbol("SA509").OrderBy("time ASC").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT time, vol FROM (SELECT *, bid_volume_1 AS bid_volumn_1, volume AS vol FROM feature.SA) WHERE symbol = 'SA509' ORDER BY time ASC"
+	if query != want {
+		t.Errorf("query =\n%s\nwant\n%s", query, want)
+	}
+	if query, _ := webSelect(context.Background(), "time").From("jm").Build(); query != "SELECT time FROM feature.jm" {
+		t.Errorf("unmapped table query = %s", query)
+	}
+
+	// 表结构检查按映射后的列名查找
+	webValidatedTablesMutex.Lock()
+	delete(webValidatedTables, "tst")
+	webValidatedTablesMutex.Unlock()
+	if err := webValidateSchema(context.Background(), "tst"); err == nil || !strings.Contains(err.Error(), "diff_oi (mapped to oi_change)") {
+		t.Errorf("validate mapped schema = %v", err)
+	}
+
+	for _, content := range []string{
+		`{"SA": {"volume": "vol"}}`,
+		`{"SA": {"vol": ""}}`,
+		`{"S A": {"vol": "volume"}}`,
+	} {
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := webLoadFieldMap(path); err == nil {
+			t.Errorf("%s: expected error", content)
+		}
+	}
+}
+
+func TestWebACL(t *testing.T) {
+	newFakeClickHouse(t)
+	webMaxRawPoints = 1000
+	defer func() { webACL = nil }()
+
+	path := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(path, []byte(`{"users": [
+		{"name": "intern", "token": "t-intern", "tables": ["TST*"], "symbols": ["*2509"]},
+		{"name": "admin", "token": "t-admin", "query": true}
+	]}`), 0644)
+	users, err := webLoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webACL = users
+
+	do := func(target string, header map[string]string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		webWithACL(handler)(rec, req)
+		return rec
+	}
+	intern := map[string]string{"Authorization": "Bearer t-intern"}
+
+	if rec := do("/tables", nil, webTablesHandler); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: %d", rec.Code)
+	}
+	if rec := do("/tables", map[string]string{"Authorization": "Bearer wrong"}, webTablesHandler); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: %d", rec.Code)
+	}
+
+	// ?token= 登录后写入cookie，列表只包含允许的表
+	rec := do("/tables?token=t-intern", nil, webTablesHandler)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"tables":["tst"]`) {
+		t.Errorf("tables = %d %s", rec.Code, rec.Body.String())
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != WEB_TOKEN_COOKIE || cookies[0].Value != "t-intern" {
+		t.Errorf("login cookie = %v", cookies)
+	}
+	if rec := do("/data?table=tst&symbol=tst2509", map[string]string{"Cookie": WEB_TOKEN_COOKIE + "=t-intern"}, webDataHandler); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "error") {
+		t.Errorf("allowed dataset = %d %s", rec.Code, rec.Body.String())
+	}
+
+	for _, tt := range []struct {
+		target  string
+		handler http.HandlerFunc
+	}{
+		{"/data?table=jm&symbol=jm2509", webDataHandler},
+		{"/data?table=tst&symbol=tst2510", webDataHandler},
+		{"/heatmap/data?symbol=jm2509&from=2025-07-01&to=2025-07-02", webHeatmapDataHandler},
+		{"/leadlag?table_a=tst&symbol_a=tst2509&symbol_b=jm2509", webLeadLagHandler},
+		{"/correlation/data?symbols=jm/jm2509,tst2509&from=2025-07-01&to=2025-07-02", webCorrelationDataHandler},
+		{"/pivots?table=jm&symbol=jm2509", webPivotsHandler},
+		{"/overlay/data?symbol=tst2510&from=2025-07-01+09:00&to=2025-07-01+15:00", webOverlayDataHandler},
+	} {
+		if rec := do(tt.target, intern, tt.handler); !strings.Contains(rec.Body.String(), "无权访问") {
+			t.Errorf("%s: %d %s", tt.target, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := do("/data?table=jm&symbol=jm2509", intern, webDataHandler); rec.Code != http.StatusForbidden {
+		t.Errorf("/data denied: %d", rec.Code)
+	}
+
+	// 实时订阅按 表+symbol 区分数据源：只允许 tst 表的用户订阅 tst/tst2509 时不会加入 jm 表中同名合约的数据源
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := newWebWSClient(server, bufio.NewReader(server))
+	client.user = users[0]
+	defer client.close()
+	oldSource := webMarketSource
+	webMarketSource = SOURCE_DEMO
+	defer func() { webMarketSource = oldSource }()
+	other := &webSymbolFeed{table: "jm", symbol: "tst2509", clients: map[*webWSClient]bool{}, pinned: true}
+	webFeeds[webFeedKey{"jm", "tst2509"}] = other
+	defer delete(webFeeds, webFeedKey{"jm", "tst2509"})
+	if err := webSubscribe(client, "jm", "tst2509", "", 0); err == nil {
+		t.Error("subscribed to a denied table")
+	}
+	if err := webSubscribe(client, "tst", "tst2509", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	feed := webFeeds[webFeedKey{"tst", "tst2509"}]
+	if feed == nil || feed.table != "tst" || !feed.clients[client] || other.clients[client] {
+		t.Errorf("tst/tst2509 feed = %+v, jm/tst2509 clients = %v", feed, other.clients)
+	}
+	if table := webUnsubscribe(client, "", "tst2509"); table != "tst" || webFeeds[webFeedKey{"tst", "tst2509"}] != nil {
+		t.Errorf("unsubscribe left feed %v", webFeeds)
+	}
+
+	// 权限在查询构造器中检查：按请求的用户拒绝无权访问的表和合约，限制了合约的用户不能整表读取
+	ctx := webWithUser(context.Background(), users[0])
+	for _, q := range []*webQuery{
+		webSelect(ctx, "*").From("jm").Symbol("jm2509"),
+		webSelect(ctx, "*").From("tst").Symbol("tst2510"),
+		webSelect(ctx, "*").From("tst").Symbols([]string{"tst2509", "tst2510"}),
+		webSelect(ctx, "*").From("tst"),
+		webSelect(ctx, "*").FromSubquery(webSelect(ctx, "*").From("jm").Symbol("jm2509")),
+	} {
+		var denied *webACLError
+		if query, err := q.Build(); !errors.As(err, &denied) {
+			t.Errorf("%s: err = %v, want access denied", query, err)
+		}
+	}
+	if _, err := webSelect(ctx, "*").From("TST").Symbol("tst2509").Build(); err != nil {
+		t.Errorf("allowed query: %v", err)
+	}
+	if _, err := webSelect(context.Background(), "*").From("jm").Build(); err != nil {
+		t.Errorf("server query: %v", err)
+	}
+	// 不带参数时检查会话的数据集，初始为默认数据集
+	if rec := do("/data", intern, webDataHandler); rec.Code != http.StatusForbidden {
+		t.Errorf("default dataset: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("/query/data?sql=SELECT+1", intern, webQueryDataHandler); !strings.Contains(rec.Body.String(), "无权执行自定义查询") {
+		t.Errorf("custom query for intern = %s", rec.Body.String())
+	}
+	if rec := do("/data?table=jm&symbol=jm2509", map[string]string{"Authorization": "Bearer t-admin"}, func(w http.ResponseWriter, r *http.Request) {
+		if webRequestUser(r).Name != "admin" {
+			t.Errorf("request user = %+v", webRequestUser(r))
+		}
+	}); rec.Code != http.StatusOK {
+		t.Errorf("admin: %d", rec.Code)
+	}
+
+	for _, content := range []string{
+		`{"users": []}`,
+		`{"users": [{"name": "a", "token": "x"}, {"name": "b", "token": "x"}]}`,
+		`{"users": [{"name": "a"}]}`,
+		`{"users": [{"name": "a", "token": "x", "tables": ["[tst"]}]}`,
+	} {
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := webLoadACL(path); err == nil {
+			t.Errorf("%s: expected error", content)
+		}
+	}
+}
+
+func TestWebRefreshWithACL(t *testing.T) {
+	newFakeClickHouse(t)
+	webACL = []*webACLUser{{Name: "intern", Token: "t-intern"}}
+	oldToken := webRefreshToken
+	webRefreshToken = "r-token"
+	defer func() { webACL, webRefreshToken = nil, oldToken }()
+
+	// 启用 -acl 时 /refresh 仍只认 -refresh-token，ACL令牌不能触发刷新
+	for _, tt := range []struct {
+		token string
+		code  int
+	}{
+		{"r-token", http.StatusOK},
+		{"t-intern", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/refresh?symbols=tst/tst2509", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		webWrapHandler("/refresh", webRefreshHandler)(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("token %q: status %d, want %d: %s", tt.token, rec.Code, tt.code, rec.Body.String())
+		}
+	}
+
+	// 其他接口仍然要求ACL令牌
+	req := httptest.NewRequest("GET", "/tables", nil)
+	req.Header.Set("Authorization", "Bearer r-token")
+	rec := httptest.NewRecorder()
+	webWrapHandler("/tables", webTablesHandler)(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("/tables with the refresh token: status %d", rec.Code)
+	}
+}
+
+func TestWebAuditLog(t *testing.T) {
+	newFakeClickHouse(t)
+	webMaxRawPoints = 1000
+	path := filepath.Join(t.TempDir(), "audit.log")
+	oldMax, oldBackups := webAuditMaxSize, webAuditBackups
+	webAuditMaxSize, webAuditBackups, webAuditRecent = 600, 2, nil
+	if err := webOpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		webAuditFile.Close()
+		webAuditFile, webAuditPath, webAuditRecent = nil, "", nil
+		webAuditMaxSize, webAuditBackups = oldMax, oldBackups
+	}()
+
+	// 经 webHandle 的请求记录接口路径，数据集查询不随请求取消但仍带着发起方
+	rec := httptest.NewRecorder()
+	webWithAudit(webDataHandler)(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/data: %d %s", rec.Code, rec.Body.String())
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("query"), "nope") {
+			http.Error(w, "Code: 81. DB::Exception: Database nope does not exist", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("1\n"))
+	}))
+	defer upstream.Close()
+	webClickHouseURL = upstream.URL
+	webExecuteQuery("SELECT name FROM system.tables WHERE database = 'nope' FORMAT TabSeparated")
+
+	// 未启用访问控制时任何人都不能查看审计记录
+	rec = httptest.NewRecorder()
+	webAuditHandler(rec, httptest.NewRequest("GET", "/api/v1/audit", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("audit without -acl: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	webAuditPageHandler(rec, httptest.NewRequest("GET", "/admin/queries", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("audit page without -acl: %d", rec.Code)
+	}
+
+	admin := &webACLUser{Name: "root", Admin: true}
+	get := func(target string) (entries []webAuditEntry, body string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		webAuditHandler(rec, req.WithContext(webWithUser(req.Context(), admin)))
+		var result struct {
+			Entries []webAuditEntry `json:"entries"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result.Entries, rec.Body.String()
+	}
+	entries, body := get("/api/v1/audit?source=/data&q=FROM+feature.tst")
+	if len(entries) == 0 || entries[0].Rows == 0 || entries[0].Error != "" {
+		t.Fatalf("dataset query not audited: %s", body)
+	}
+	// 没有请求上下文的查询记录发起查询的函数，出错的查询记录错误
+	entries, body = get("/api/v1/audit?errors=1")
+	if len(entries) != 1 || entries[0].Source != "TestWebAuditLog" || !strings.Contains(entries[0].Query, "'nope'") {
+		t.Errorf("failed query entry = %s", body)
+	}
+	if entries, _ := get("/api/v1/audit?min_ms=100000"); len(entries) != 0 {
+		t.Errorf("min_ms filter returned %d entries", len(entries))
+	}
+	if _, body := get("/api/v1/audit?sort=rows"); !strings.Contains(body, "sort参数无效") {
+		t.Errorf("invalid sort = %s", body)
+	}
+
+	// 文件超过上限后轮转，最多保留 -audit-backups 个旧文件
+	for i := 0; i < 10; i++ {
+		webExecuteQuery("SELECT 1 FORMAT TabSeparated")
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("expected rotated file: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more backups than -audit-backups")
+	}
+	data, _ := os.ReadFile(path + ".1")
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e webAuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Query == "" {
+			t.Errorf("bad audit line %q", line)
+		}
+	}
+
+	webACL = []*webACLUser{{Name: "intern", Token: "t"}}
+	defer func() { webACL = nil }()
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/audit", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	webWithACL(webAuditHandler)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin audit access: %d", rec.Code)
+	}
+}
+
+func TestWebConfigReload(t *testing.T) {
+	saved := webSettings{
+		AlertThreshold: webImbalanceThreshold, AlertTicks: webImbalanceTicks,
+		RefreshInterval: webRefreshInterval, CacheTTL: webCacheTTL, CatalogTTL: webCatalogTTL, Theme: webTheme, Shortcuts: webShortcuts,
+	}
+	webConfigBase = webSettings{
+		Watchlist:      []webDatasetKey{{"tst", "tst2509", "all"}},
+		AlertSymbols:   []webDatasetKey{{"tst", "tst2509", "all"}, {"tst", "tst2510", "all"}},
+		AlertThreshold: 0.8, AlertTicks: 3, CatalogTTL: 5 * time.Minute, Theme: "light", Shortcuts: webDefaultShortcuts(),
+	}
+	webConfigCurrent, webConfigHistory = webConfigBase, nil
+	webUseSettings(webConfigBase)
+	for _, symbol := range []string{"tst2509", "tst2510"} {
+		webFeeds[webFeedKey{"tst", symbol}] = &webSymbolFeed{table: "tst", symbol: symbol, clients: map[*webWSClient]bool{}, pinned: true,
+			imbalance: &webImbalanceDetector{threshold: 0.8, ticks: 3}}
+	}
+	updates := make(chan string, 4)
+	webUpdateSubscribers[updates] = struct{}{}
+	defer func() {
+		delete(webUpdateSubscribers, updates)
+		delete(webFeeds, webFeedKey{"tst", "tst2509"})
+		delete(webFeeds, webFeedKey{"tst", "tst2510"})
+		webUseSettings(saved)
+		webConfigBase, webConfigCurrent, webConfigHistory = webSettings{}, webSettings{}, nil
+	}()
+
+	path := filepath.Join(t.TempDir(), "web.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"watchlist": ["tst/tst2509@1d"], "alerts": {"symbols": ["tst/tst2509"], "threshold": 0.9},
+		"catalog_ttl": "10m", "theme": "dark"}`)
+	reload := webReloadConfig(path)
+	want := []string{
+		"watchlist +tst/tst2509@1d", "watchlist -tst/tst2509@all", "alerts.symbols -tst/tst2510",
+		"alerts.threshold: 0.8 → 0.9", "catalog_ttl: 5m0s → 10m0s", "theme: light → dark",
+	}
+	if reload.Error != "" || !reflect.DeepEqual(reload.Changes, want) {
+		t.Fatalf("reload = %+v, want changes %q", reload, want)
+	}
+	// 移出监控的数据源没有订阅者时删除，保留的数据源按新阈值重新计数
+	if _, ok := webFeeds[webFeedKey{"tst", "tst2510"}]; ok {
+		t.Error("feed removed from alerts still running")
+	}
+	if d := webFeeds[webFeedKey{"tst", "tst2509"}].imbalance; d == nil || d.threshold != 0.9 || d.ticks != 3 {
+		t.Errorf("tst2509 detector = %+v", d)
+	}
+	if webCatalogTTL != 10*time.Minute || webTheme != "dark" {
+		t.Errorf("catalog ttl %v, theme %q", webCatalogTTL, webTheme)
+	}
+	select {
+	case msg := <-updates:
+		if !strings.HasPrefix(msg, `{"shortcuts":{`) || !strings.HasSuffix(msg, `},"theme":"dark","type":"config"}`) {
+			t.Errorf("theme update = %s", msg)
+		}
+	default:
+		t.Error("theme change not pushed to /updates")
+	}
+
+	// 无效的文件不生效，继续使用上一次成功加载的设置
+	write(`{"theme": "blue"}`)
+	if reload := webReloadConfig(path); !strings.Contains(reload.Error, `theme "blue"`) || webTheme != "dark" {
+		t.Errorf("invalid theme: %+v, theme %q", reload, webTheme)
+	}
+	write(`{"refresh": "30s"}`)
+	if reload := webReloadConfig(path); !strings.Contains(reload.Error, `unknown field "refresh"`) {
+		t.Errorf("unknown field: %+v", reload)
+	}
+
+	// 从文件中删除的字段回到命令行参数的值
+	write(`{"alerts": {"symbols": ["tst/tst2509"], "threshold": 0.9}}`)
+	if reload := webReloadConfig(path); !reflect.DeepEqual(reload.Changes, []string{
+		"watchlist +tst/tst2509@all", "watchlist -tst/tst2509@1d", "catalog_ttl: 10m0s → 5m0s", "theme: dark → light",
+	}) {
+		t.Errorf("removed fields: %+v", reload)
+	}
+
+	rec := httptest.NewRecorder()
+	webConfigHandler(rec, httptest.NewRequest("GET", "/api/v1/config", nil))
+	var result struct {
+		Settings map[string]interface{} `json:"settings"`
+		Reloads  []webConfigReload      `json:"reloads"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Reloads) != 4 || result.Reloads[1].Error == "" || result.Settings["theme"] != "light" {
+		t.Errorf("/api/v1/config = %s", rec.Body.String())
+	}
+}
+
+func TestWebClickHouseProfiles(t *testing.T) {
+	var got *http.Request
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		fmt.Fprintln(w, "1")
+	}))
+	defer staging.Close()
+
+	oldURL := webClickHouseURL
+	webConfigBase = webSettings{
+		AlertThreshold: 0.8, AlertTicks: 3, CatalogTTL: 5 * time.Minute, Theme: "light", Shortcuts: webDefaultShortcuts(),
+		Profiles: map[string]webClickHouseProfile{WEB_DEFAULT_PROFILE: {URL: oldURL, Database: WEB_DEFAULT_DATABASE}},
+	}
+	webConfigCurrent = webConfigBase
+	updates := make(chan string, 4)
+	webUpdateSubscribers[updates] = struct{}{}
+	defer func() {
+		delete(webUpdateSubscribers, updates)
+		webUseProfile(WEB_DEFAULT_PROFILE, webClickHouseProfile{URL: oldURL, Database: WEB_DEFAULT_DATABASE})
+		webConfigBase, webConfigCurrent, webConfigHistory = webSettings{}, webSettings{}, nil
+		resetCatalog()
+	}()
+
+	path := filepath.Join(t.TempDir(), "web.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"profiles": {"staging": {"url": "` + staging.URL + `/", "user": "reader", "password": "secret"}}}`)
+	reload := webReloadConfig(path)
+	if reload.Error != "" || !reflect.DeepEqual(reload.Changes, []string{"profiles +staging"}) {
+		t.Fatalf("reload = %+v", reload)
+	}
+	want := webClickHouseProfile{URL: staging.URL, Database: "feature", User: "reader", Password: "secret"}
+	if p := webConfigCurrent.Profiles["staging"]; p != want {
+		t.Errorf("staging = %+v, want %+v", p, want)
+	}
+
+	// 切换配置影响所有用户，只有管理员可以切换；未启用访问控制时无法识别管理员
+	post := func(target string, user *webACLUser) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, nil)
+		req = req.WithContext(webWithUser(req.Context(), user))
+		rec := httptest.NewRecorder()
+		webProfileHandler(rec, req)
+		return rec
+	}
+	for _, user := range []*webACLUser{nil, {Name: "intern"}} {
+		if rec := post("/api/v1/profile?name=staging", user); rec.Code != http.StatusForbidden {
+			t.Errorf("switch by %v: status %d", user, rec.Code)
+		}
+	}
+
+	// 切换前开始的查询在切换后才返回时，结果不写入缓存和展示数据
+	key := webDatasetKey{"tst", "tst2509", "all"}
+	gen := webProfileGeneration.Load()
+	admin := &webACLUser{Name: "root", Admin: true}
+	rec := post("/api/v1/profile?name=staging", admin)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"active":"staging"`) || strings.Contains(rec.Body.String(), "secret") {
+		t.Fatalf("switch: %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case msg := <-updates:
+		if msg != `{"profile":"staging","type":"profile"}` {
+			t.Errorf("profile update = %s", msg)
+		}
+	default:
+		t.Error("profile switch not pushed to /updates")
+	}
+	stale := []WebMarketData{{Symbol: "tst2509", Time: "2025-07-01 09:00:00", Price: 1}}
+	if webStoreDataset(key, stale, false, gen) {
+		t.Error("stored a dataset fetched before the switch")
+	}
+	webSetLoadedData(key, stale, gen)
+	webDatasetsMutex.Lock()
+	_, cached := webDatasets[key]
+	webDatasetsMutex.Unlock()
+	webDataMutex.RLock()
+	_, shown := webViews[key]
+	webDataMutex.RUnlock()
+	if cached || shown {
+		t.Errorf("stale data kept: cached %v, view %v", cached, shown)
+	}
+	if !webStoreDataset(key, stale, false, webProfileGeneration.Load()) {
+		t.Error("current generation not stored")
+	}
+	webDatasetsMutex.Lock()
+	delete(webDatasets, key)
+	webDatasetsMutex.Unlock()
+
+	if err := webTestConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.URL.Query().Get("database") != "feature" || got.Header.Get("X-ClickHouse-User") != "reader" || got.Header.Get("X-ClickHouse-Key") != "secret" {
+		t.Errorf("query after switch = %+v", got)
+	}
+
+	// 修改正在使用的配置时按新的库重新连接，删除时回到默认配置
+	write(`{"profiles": {"staging": {"url": "` + staging.URL + `", "database": "feature_stg", "user": "reader", "password": "secret"}}}`)
+	if reload := webReloadConfig(path); len(reload.Changes) != 1 || !strings.HasSuffix(reload.Changes[0], "feature_stg (reader)") {
+		t.Errorf("changed profile: %+v", reload)
+	}
+	if table := webQualifiedTable("jm"); table != "feature_stg.jm" {
+		t.Errorf("table = %s, want feature_stg.jm", table)
+	}
+	write(`{}`)
+	webReloadConfig(path)
+	if target := webClickHouseTarget(); target.URL != oldURL || target.Database != "feature" || target.User != "" {
+		t.Errorf("after removing the active profile: %+v", target)
+	}
+
+	for _, content := range []string{
+		`{"profiles": {"prod": {"url": "ftp://ch-prod"}}}`,
+		`{"profiles": {"prod": {"url": "http://ch-prod:8123", "database": "a-b"}}}`,
+		`{"profiles": {"prod": {"url": "http://ch-prod:8123", "cluster": "x"}}}`,
+	} {
+		write(content)
+		if reload := webReloadConfig(path); reload.Error == "" {
+			t.Errorf("%s: accepted", content)
+		}
+	}
+
+	if rec := post("/api/v1/profile?name=prod", admin); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown profile: status %d", rec.Code)
+	}
+}
+
+func TestWebShortcutConfig(t *testing.T) {
+	base := webSettings{AlertThreshold: 0.8, AlertTicks: 3, CatalogTTL: time.Minute, Theme: "light", Shortcuts: webDefaultShortcuts()}
+	path := filepath.Join(t.TempDir(), "web.json")
+	load := func(content string) (webSettings, error) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return webLoadSettings(path, base)
+	}
+
+	// 给出的动作替换默认按键，空列表禁用，单个字母统一为小写；省略的动作保持默认
+	s, err := load(`{"shortcuts": {"refresh": ["F5"], "toggle_flow": [], "next_series": ["S"]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Shortcuts["refresh"], []string{"F5"}) || len(s.Shortcuts["toggle_flow"]) != 0 ||
+		!reflect.DeepEqual(s.Shortcuts["next_series"], []string{"s"}) || !reflect.DeepEqual(s.Shortcuts["zoom_in"], []string{"+", "="}) {
+		t.Errorf("shortcuts = %v", s.Shortcuts)
+	}
+	if !reflect.DeepEqual(base.Shortcuts["refresh"], []string{"r"}) {
+		t.Error("loading a config modified the base shortcuts")
+	}
+	want := []string{"shortcuts.refresh: r → F5", "shortcuts.toggle_flow: f → none"}
+	if changes := webDiffSettings(base, s); !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %q, want %q", changes, want)
+	}
+
+	for content, msg := range map[string]string{
+		`{"shortcuts": {"refresh": ["p"]}}`:   `key "p" is bound to both refresh and toggle_price`,
+		`{"shortcuts": {"explode": ["x"]}}`:   `unknown shortcut action "explode"`,
+		`{"shortcuts": {"zoom_in": [""]}}`:    "empty key for shortcut zoom_in",
+		`{"shortcuts": {"refresh": ["Tab"]}}`: "",
+	} {
+		if _, err := load(content); (err == nil) != (msg == "") || (err != nil && !strings.Contains(err.Error(), msg)) {
+			t.Errorf("%s: err = %v, want %q", content, err, msg)
+		}
+	}
+
+	// 主页注入当前的快捷键
+	webConfigMutex.Lock()
+	saved := webShortcuts
+	webShortcuts = s.Shortcuts
+	webConfigMutex.Unlock()
+	defer func() {
+		webConfigMutex.Lock()
+		webShortcuts = saved
+		webConfigMutex.Unlock()
+	}()
+	rec := httptest.NewRecorder()
+	webIndexHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"refresh":["F5"]`) || strings.Contains(body, "{{SHORTCUTS}}") {
+		t.Error("index page does not embed the configured shortcuts")
+	}
+}
+
+func TestWebLongRunning(t *testing.T) {
+	// 日志超过上限时轮转，最多保留 backups 个旧文件
+	path := filepath.Join(t.TempDir(), "web.log")
+	out, err := newWebRotatingLog(path, 50, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(out, "line %d: 0123456789012345678\n", i)
+	}
+	out.file.Close()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if data, err := os.ReadFile(name); err != nil || len(data) == 0 || len(data) > 50 {
+			t.Errorf("%s: %q %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backups beyond -log-backups kept: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "line 5: 0123456789012345678\n" {
+		t.Errorf("current log = %q", data)
+	}
+
+	// 处理器panic时返回500，服务继续运行
+	recovered := webRecovered.Load()
+	rec := httptest.NewRecorder()
+	webWithRecover(func(w http.ResponseWriter, r *http.Request) {
+		var feeds map[string]*webSymbolFeed
+		feeds["jm2509"].pinned = true
+	})(rec, httptest.NewRequest("GET", "/data", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "nil pointer") || webRecovered.Load() != recovered+1 {
+		t.Errorf("recovered handler: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 后台循环崩溃后计数并重启，正常返回后不再重启
+	restarts := webLoopRestarts.Load()
+	var calls atomic.Int32
+	webSupervise("test loop", func() {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for webLoopRestarts.Load() == restarts && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if webLoopRestarts.Load() != restarts+1 {
+		t.Error("crashed loop was not restarted")
+	}
+
+	rec = httptest.NewRecorder()
+	webHealthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if !strings.Contains(rec.Body.String(), `"loop_restarts":`+strconv.FormatInt(restarts+1, 10)) {
+		t.Errorf("/healthz = %s", rec.Body.String())
+	}
+}
+
+func TestWebListenPortFallback(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	addr := busy.Addr().String()
+
+	// 端口被占用时改用其他端口，监听地址仍在同一主机上
+	l, err := webListen(addr)
+	if err != nil {
+		t.Fatalf("fallback listen: %v", err)
+	}
+	defer l.Close()
+	if host, _, _ := net.SplitHostPort(l.Addr().String()); l.Addr().String() == addr || host != "127.0.0.1" {
+		t.Errorf("fallback listener on %s (busy %s)", l.Addr(), addr)
+	}
+
+	webPortFallback = false
+	defer func() { webPortFallback = true }()
+	if _, err := webListen(addr); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("-port-fallback=false: err = %v", err)
+	}
+}
+
+func TestWebCatalog(t *testing.T) {
+	clickhouse := newFakeClickHouse(t)
+
+	rec := httptest.NewRecorder()
+	webCatalogHandler(rec, httptest.NewRequest("GET", "/api/v1/catalog?table=tst", nil))
+	var catalog struct {
+		Tables  []string `json:"tables"`
+		Symbols map[string]struct {
+			Symbols []string `json:"symbols"`
+		} `json:"symbols"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("catalog: %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Join(catalog.Tables, ",") != "tst" || strings.Join(catalog.Symbols["tst"].Symbols, ",") != "tst2509" {
+		t.Errorf("catalog = %+v", catalog)
+	}
+
+	rec = httptest.NewRecorder()
+	webCatalogHandler(rec, httptest.NewRequest("GET", "/api/v1/catalog?table=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown table: status %d", rec.Code)
+	}
+
+	// 目录中没有的表和合约在查询行情之前被拒绝
+	requests := clickhouse.requests
+	for query, want := range map[string]string{
+		"/data?table=missing&symbol=tst2509":               "表 missing 不存在",
+		"/data?table=tst&symbol=tst2510":                   "表 tst 中没有合约 tst2510",
+		"/data?table=tst&symbol=x'%20OR%20'1'='1&range=1d": "表 tst 中没有合约",
+		"/symbols?table=missing":                           "表 missing 不存在",
+	} {
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(query, "/symbols") {
+			webSymbolsHandler(rec, httptest.NewRequest("GET", query, nil))
+		} else {
+			webDataHandler(rec, httptest.NewRequest("GET", query, nil))
+		}
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s = %.200s, want %s", query, rec.Body.String(), want)
+		}
+	}
+	if clickhouse.requests != requests {
+		t.Errorf("rejected requests queried ClickHouse %d times", clickhouse.requests-requests)
+	}
+
+	// 过期后先返回旧目录，同时在后台重新加载
+	oldTTL := webCatalogTTL
+	webCatalogTTL = time.Nanosecond
+	defer func() { webCatalogTTL = oldTTL }()
+	if ok, err := webCatalogContains("", "tst"); !ok || err != nil {
+		t.Fatalf("contains = %v, %v", ok, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		clickhouse.mu.Lock()
+		n := clickhouse.requests
+		clickhouse.mu.Unlock()
+		if n > requests {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired catalog was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebEmptyState(t *testing.T) {
+	newFakeClickHouse(t)
+
+	for query, want := range map[string]webEmptyState{
+		"/data?table=tst&symbol=tst2510&range=1d": {Table: "tst", Symbol: "tst2510", Suggest: "symbol", Suggestions: []string{"tst2509"}},
+		"/data?table=missing&symbol=tst2509":      {Table: "missing", Suggest: "table", Suggestions: []string{"tst"}},
+	} {
+		rec := httptest.NewRecorder()
+		webDataHandler(rec, httptest.NewRequest("GET", query, nil))
+		var resp struct {
+			Error string         `json:"error"`
+			Empty *webEmptyState `json:"empty"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Empty == nil {
+			t.Fatalf("%s: no empty state in %s", query, rec.Body.String())
+		}
+		got := resp.Empty
+		if got.Table != want.Table || got.Symbol != want.Symbol || got.Suggest != want.Suggest ||
+			strings.Join(got.Suggestions, ",") != strings.Join(want.Suggestions, ",") || len(got.Hints) == 0 {
+			t.Errorf("%s: empty = %+v", query, got)
+		}
+	}
+
+	// 其他错误不是空结果
+	if empty := webEmptyStateFor(errors.New("connection refused"), "all"); empty != nil {
+		t.Errorf("empty state for a failure: %+v", empty)
+	}
+
+	// 无权访问的候选合约不出现在空状态中
+	user := &webACLUser{Name: "viewer", Tables: []string{"tst"}, Symbols: []string{"tst2510"}}
+	state := &webEmptyState{Table: "tst", Suggest: "symbol", Suggestions: []string{"tst2509"}}
+	if got := state.forUser(user); len(got.Suggestions) != 0 || len(state.Suggestions) != 1 {
+		t.Errorf("filtered = %v, original = %v", got.Suggestions, state.Suggestions)
+	}
+}
+
+func TestWebDescribe(t *testing.T) {
+	newFakeClickHouse(t)
+
+	rec := httptest.NewRecorder()
+	webDescribeHandler(rec, httptest.NewRequest("GET", "/api/v1/describe?table=tst&symbol=tst2509", nil))
+	var stats webTableStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || len(stats.Columns) != len(webMarketDataColumns) {
+		t.Fatalf("describe: %s", rec.Body.String())
+	}
+	if stats.Rows != 4 {
+		t.Errorf("rows = %d, want 4", stats.Rows)
+	}
+	var plottable []string
+	for _, col := range stats.Columns {
+		if col.Plottable {
+			plottable = append(plottable, col.Name)
+		}
+	}
+	// 录制的表没有盘口数据，bid_1/ask_1 恒为0；datetime 是时间戳，不作为序列
+	if got := strings.Join(plottable, ","); got != "price,vol,open_interest,diff_vol,diff_oi" {
+		t.Errorf("plottable = %s", got)
+	}
+	price := stats.Columns[2]
+	if price.Kind != "numeric" || price.Min != "1180.5" || price.Max != "1184" || price.Cardinality != 4 || price.NullRatio != 0 {
+		t.Errorf("price = %+v", price)
+	}
+	if stats.Columns[0].Kind != "string" || stats.Columns[1].Kind != "time" {
+		t.Errorf("kinds = %s, %s", stats.Columns[0].Kind, stats.Columns[1].Kind)
+	}
+
+	rec = httptest.NewRecorder()
+	webDescribeHandler(rec, httptest.NewRequest("GET", "/api/v1/describe?table=missing", nil))
+	if !strings.Contains(rec.Body.String(), "表 missing 不存在") {
+		t.Errorf("unknown table = %s", rec.Body.String())
+	}
+}
+
+func TestWebQueryResult(t *testing.T) {
+	res, err := webParseQueryResult("day\tvolume\tsymbol\n" +
+		"2025-07-01\t100\tjm2509\n" +
+		"2025-07-01\t40\tjm2601\n" +
+		"2025-07-02\t120\tjm2509\n" +
+		"2025-07-03\t\\N\tjm2509\n" +
+		"2025-07-03\t55\tjm2601\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Labels, ",") != "2025-07-01,2025-07-02,2025-07-03" || len(res.Series) != 2 || res.Rows != 5 {
+		t.Fatalf("result = %+v", res)
+	}
+	// 各序列按时间并集对齐，缺少的点和 NULL 都为空值
+	format := func(values []*float64) string {
+		var parts []string
+		for _, v := range values {
+			if v == nil {
+				parts = append(parts, "null")
+			} else {
+				parts = append(parts, strconv.FormatFloat(*v, 'f', -1, 64))
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	if got := format(res.Series[0].Values); res.Series[0].Name != "jm2509" || got != "100,120,null" {
+		t.Errorf("jm2509 = %s", got)
+	}
+	if got := format(res.Series[1].Values); got != "40,null,55" {
+		t.Errorf("jm2601 = %s", got)
+	}
+
+	if _, err := webParseQueryResult("t\n2025-07-01\n"); err == nil {
+		t.Error("single column accepted")
+	}
+	for _, sql := range []string{"", "DROP TABLE feature.jm", "SELECT 1; DROP TABLE feature.jm"} {
+		if _, err := webSelect(context.Background(), "*").FromUserQuery(sql).Build(); err == nil {
+			t.Errorf("%q accepted", sql)
+		}
+	}
+	if query, err := webSelect(context.Background(), "*").FromUserQuery("SELECT now(), 1 -- 注释;").Limit(10).Build(); err != nil || query != "SELECT * FROM (SELECT now(), 1 -- 注释\n) LIMIT 10" {
+		t.Errorf("query = %q, %v", query, err)
+	}
+}
+
+func TestWebReturnDistribution(t *testing.T) {
+	returns := []float64{-2, -1, 0, 1, 2}
+	dist, ok := webComputeReturnDistribution(returns, 5)
+	if !ok {
+		t.Fatal("distribution not computed")
+	}
+	// 对称样本偏度为0；m2=2、m4=6.8，超额峰度 6.8/4-3 = -1.3
+	if math.Abs(dist.Skew) > 1e-12 || math.Abs(dist.ExcessKurtosis+1.3) > 1e-12 || dist.StdDev != math.Sqrt(2) {
+		t.Errorf("moments = %+v", dist)
+	}
+	if want := 5.0 / 6 * (1.3 * 1.3 / 4); math.Abs(dist.JarqueBera-want) > 1e-12 {
+		t.Errorf("jarque_bera = %v, want %v", dist.JarqueBera, want)
+	}
+	for i, bin := range dist.Bins {
+		if bin.Count != 1 {
+			t.Errorf("bin %d = %+v, want 1 sample", i, bin)
+		}
+	}
+
+	// 超出 ±6σ 的极端值计入最外侧的区间，直方图范围不被拉宽
+	returns = nil
+	for i := 0; i < 2000; i++ {
+		returns = append(returns, float64(i%2*2-1))
+	}
+	returns = append(returns, 100)
+	dist, _ = webComputeReturnDistribution(returns, 10)
+	total := 0
+	for _, bin := range dist.Bins {
+		total += bin.Count
+	}
+	if dist.Clipped != 1 || total != len(returns) || dist.Max != 100 || dist.Bins[9].To >= 100 || dist.Bins[9].Count != 1 {
+		t.Errorf("clipped distribution = %+v", dist)
+	}
+
+	if _, ok := webComputeReturnDistribution([]float64{1, 1, 1}, 5); ok {
+		t.Error("constant returns should not produce a distribution")
+	}
+}
+
+func TestWebOLS(t *testing.T) {
+	// y = 2 + 3x，无噪声时系数精确、标准误为0
+	var x [][]float64
+	var y []float64
+	for i := 0; i < 10; i++ {
+		x = append(x, []float64{1, float64(i)})
+		y = append(y, 2+3*float64(i))
+	}
+	beta, se, ok := webOLS(x, y)
+	if !ok || math.Abs(beta[0]-2) > 1e-9 || math.Abs(beta[1]-3) > 1e-9 || se[1] > 1e-6 {
+		t.Errorf("webOLS = %v, %v, %v", beta, se, ok)
+	}
+	if _, _, ok := webOLS([][]float64{{1, 1}, {1, 1}, {1, 1}}, []float64{1, 2, 3}); ok {
+		t.Error("expected singular design to fail")
+	}
+}
+
+func TestWebADFStatistic(t *testing.T) {
+	// 均值回复序列应显著拒绝单位根，随机游走不应拒绝
+	meanReverting := make([]float64, 500)
+	walk := make([]float64, 500)
+	seed := uint32(1)
+	noise := func() float64 {
+		seed = seed*1664525 + 1013904223
+		return float64(seed)/float64(1<<32) - 0.5
+	}
+	for i := 1; i < len(walk); i++ {
+		meanReverting[i] = 0.2*meanReverting[i-1] + noise()
+		walk[i] = walk[i-1] + noise()
+	}
+	if stat, _, ok := webADFStatistic(meanReverting, 1); !ok || stat > -3.43 {
+		t.Errorf("mean-reverting ADF = %v, %v, want below -3.43", stat, ok)
+	}
+	if stat, _, ok := webADFStatistic(walk, 1); !ok || stat < -2.86 {
+		t.Errorf("random walk ADF = %v, %v, want above -2.86", stat, ok)
+	}
+
+	returns, levels := webLogReturns([]float64{math.NaN(), 100, 0, 110, 121})
+	if len(levels) != 3 || len(returns) != 2 || math.Abs(returns[1]-math.Log(1.1)) > 1e-12 {
+		t.Errorf("webLogReturns = %v, %v", returns, levels)
+	}
+}
+
+func TestWebParseYRange(t *testing.T) {
+	tests := []struct {
+		spec     string
+		min, max float64
+		wantErr  bool
+	}{
+		{"", math.NaN(), math.NaN(), false},
+		{"700,760", 700, 760, false},
+		{"700,", 700, math.NaN(), false},
+		{" ,760", math.NaN(), 760, false},
+		{"760,700", 0, 0, true},
+		{"700", 0, 0, true},
+		{"abc,760", 0, 0, true},
+	}
+	same := func(a, b float64) bool { return a == b || (math.IsNaN(a) && math.IsNaN(b)) }
+	for _, tt := range tests {
+		yr, err := webParseYRange(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("webParseYRange(%q) = %+v, want error", tt.spec, yr)
+			}
+			continue
+		}
+		if err != nil || !same(yr.Min, tt.min) || !same(yr.Max, tt.max) {
+			t.Errorf("webParseYRange(%q) = %+v, %v, want {%v %v}", tt.spec, yr, err, tt.min, tt.max)
+		}
+	}
+}
+
+func TestWebYRangeBounds(t *testing.T) {
+	values := []float64{710, 725, 718}
+	if _, _, ok := webDefaultYRange.bounds(values); ok {
+		t.Error("unset range should leave the axis automatic")
+	}
+	if lo, hi, ok := (webYRange{700, math.NaN()}).bounds(values); !ok || lo != 700 || hi != 725 {
+		t.Errorf("bounds = %v, %v, %v, want 700, 725", lo, hi, ok)
+	}
+	if lo, hi, ok := (webYRange{math.NaN(), 705}).bounds(values); !ok || lo != 704 || hi != 705 {
+		t.Errorf("bounds = %v, %v, %v, want 704, 705 when the data is above the fixed maximum", lo, hi, ok)
+	}
+}
+
+func TestWebNiceTicks(t *testing.T) {
+	tests := []struct {
+		lo, hi, padding float64
+		want            string
+		decimals        int
+	}{
+		{0, 10, 0, "0,2,4,6,8,10", 0},
+		{737.5, 741, 0, "737.5,738,738.5,739,739.5,740,740.5,741", 1},
+		{0.13, 0.57, 0, "0.1,0.2,0.3,0.4,0.5,0.6", 1},
+		{100, 180, 0.05, "80,100,120,140,160,180,200", 0},
+		{-0.33, 0.41, 0, "-0.4,-0.2,0,0.2,0.4,0.6", 1},
+		{212345, 215020, 0, "212000,212500,213000,213500,214000,214500,215000,215500", 0},
+		{5, 5, 0, "4.94,4.96,4.98,5,5.02,5.04,5.06", 2},
+	}
+	for _, tt := range tests {
+		ticks, decimals := webNiceTicks(tt.lo, tt.hi, tt.padding, PNG_AXIS_TICKS)
+		parts := make([]string, len(ticks))
+		for i, v := range ticks {
+			parts[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		if got := strings.Join(parts, ","); got != tt.want || decimals != tt.decimals {
+			t.Errorf("webNiceTicks(%v, %v, %v) = %s (%d decimals), want %s (%d decimals)",
+				tt.lo, tt.hi, tt.padding, got, decimals, tt.want, tt.decimals)
+		}
+	}
+}
+
+func TestWebDataEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 1000
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+
+	tests := []struct {
+		name, query string
+	}{
+		{"data_raw.json", "/data?table=tst&symbol=tst2509&range=all&raw=1"},
+		{"data_sampled.json", "/data?table=tst&symbol=tst2509&range=all"},
+		{"data_zoom.json", "/data?table=tst&symbol=tst2509&range=all&from=2025-07-01T09:00:00&to=2025-07-01T09:01:00&points=10"},
+		{"data_regimes.json", "/data?table=tst&symbol=tst2509&range=all&from=2025-07-01T09:00:00&to=2025-07-01T09:01:00&points=30&regimes=1&vol_window=4&vol_low=0.9&vol_high=1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			webDataHandler(rec, httptest.NewRequest("GET", tt.query, nil))
+			checkGolden(t, tt.name, goldenJSON(t, rec.Body.Bytes()))
+		})
+	}
+}
+
+func TestWebHeatmapEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webHeatmapDataHandler(rec, httptest.NewRequest("GET", "/heatmap/data?table=tst&symbol=tst2509&from=2025-07-01&to=2025-07-02&slot=1h", nil))
+	checkGolden(t, "heatmap.json", goldenJSON(t, rec.Body.Bytes()))
+}
+
+func TestWebFetchEach(t *testing.T) {
+	old := webFetchConcurrency
+	webFetchConcurrency = 2
+	defer func() { webFetchConcurrency = old }()
+
+	var inFlight, maxInFlight int32
+	errs := webFetchEach(context.Background(), 6, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		switch i {
+		case 1:
+			return errors.New("boom")
+		case 4:
+			panic("bad row")
+		}
+		return nil
+	})
+	if maxInFlight > 2 {
+		t.Errorf("max in flight = %d, want <= 2", maxInFlight)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 1 || i == 4) {
+			t.Errorf("errs[%d] = %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, err := range webFetchEach(ctx, 3, func(ctx context.Context, i int) error { return nil }) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled errs[%d] = %v", i, err)
+		}
+	}
+
+	// 仪表盘批量取数：不存在的合约只在自己的面板里报错
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webDashboardDataHandler(rec, httptest.NewRequest("GET", "/dashboard/data?symbols=tst/tst2509,tst2601&from=2025-06-30+20:00:00&to=2025-07-01+19:59:59&points=50", nil))
+	var resp struct {
+		Panels []webDashboardPanel `json:"panels"`
+		Error  string              `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error != "" || len(resp.Panels) != 2 {
+		t.Fatalf("dashboard data: %v %s", err, rec.Body.String())
+	}
+	if p := resp.Panels[0]; p.Symbol != "tst2509" || p.Error != "" || len(p.Data) == 0 {
+		t.Errorf("panel tst2509 = %+v", p)
+	}
+	if p := resp.Panels[1]; p.Table != "tst" || p.Error == "" {
+		t.Errorf("panel tst2601 = %+v", p)
+	}
+}
+
+func TestWebDailyStatsEndToEnd(t *testing.T) {
+	newFakeClickHouse(t)
+	rec := httptest.NewRecorder()
+	webDailyDataHandler(rec, httptest.NewRequest("GET", "/daily/data?table=tst&symbol=tst2509&days=3", nil))
+	checkGolden(t, "daily.json", goldenJSON(t, rec.Body.Bytes()))
+
+	var resp struct {
+		Days []webDailyStats `json:"days"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	// 多查的一天只用来计算最早一天的涨跌，不出现在结果里
+	if len(resp.Days) != 3 || resp.Days[0].Day != "2025-07-01" || resp.Days[2].Change == nil {
+		t.Fatalf("unexpected days %+v", resp.Days)
+	}
+
+	// 交易日表达式与 webTradingDay 一致：周五夜盘归入下周一
+	if expr := webTradingDayExpr("time"); !strings.Contains(expr, "INTERVAL 4 HOUR") || !strings.Contains(expr, "= 6, 2") {
+		t.Errorf("trading day expression = %s", expr)
+	}
+	rows := webFinishDailyStats([]webDailyStats{{Day: "2025-07-01", High: 1010, Low: 1000, Close: 1005}}, "tst2509", 3)
+	if rows[0].Range != 10 || rows[0].RangePct != 1 || rows[0].Change != nil {
+		t.Errorf("single day without previous close = %+v", rows[0])
+	}
+}
+
+func TestWebBuildProfile(t *testing.T) {
+	profile := webBuildProfile([]webProfileBucket{
+		{Day: "2025-06-27", Slot: "09:00", Open: 1000, Close: 1010, Volume: 100},
+		{Day: "2025-06-27", Slot: "21:00", Open: 1000, Close: 1000, Volume: 50},
+		{Day: "2025-06-30", Slot: "09:00", Open: 2000, Close: 2040, Volume: 300},
+		{Day: "2025-06-30", Slot: "21:00", Open: 2000, Close: 2000, Volume: 150},
+		{Day: "2025-06-30", Slot: "10:00", Open: 2040, Close: 2060, Volume: 200},
+		{Day: "2025-07-01", Slot: "21:00", Open: 500, Close: 505, Volume: 80},
+		{Day: "2025-07-02", Slot: "21:00", Open: 600, Close: 600, Volume: 10},
+	}, "2025-07-01", 20)
+
+	// 夜盘时段排在日盘之前，目标交易日之后的数据不参与
+	var slots []string
+	for _, s := range profile.Slots {
+		slots = append(slots, s.Slot)
+	}
+	if strings.Join(slots, ",") != "21:00,09:00,10:00" || strings.Join(profile.Sessions, ",") != "2025-06-27,2025-06-30" {
+		t.Fatalf("slots = %v, sessions = %v", slots, profile.Sessions)
+	}
+	// 涨跌幅以各自的开盘价为基准：+1% 和 +2% 的均值 1.5%，标准差 0.5%
+	nine := profile.Slots[1]
+	if nine.Sessions != 2 || math.Abs(nine.PriceMean-1.5) > 1e-9 || math.Abs(nine.PriceStd-0.5) > 1e-9 || nine.VolumeMean != 200 {
+		t.Errorf("09:00 slot = %+v", nine)
+	}
+	// 只有一个交易日有10:00的成交，累计成交量的均值仍按两个交易日平均
+	ten := profile.Slots[2]
+	if ten.Sessions != 1 || ten.CumVolumeMean != (150+650)/2.0 {
+		t.Errorf("10:00 slot = %+v", ten)
+	}
+	if profile.Open == nil || *profile.Open != 500 || profile.LatestSlot != "21:00" || profile.TodayVolume != 80 || profile.TypicalVolume != 100 {
+		t.Errorf("today = open %v latest %q volume %d typical %v", profile.Open, profile.LatestSlot, profile.TodayVolume, profile.TypicalVolume)
+	}
+	if nine.TodayPrice != nil || profile.Slots[0].TodayPrice == nil || math.Abs(*profile.Slots[0].TodayPrice-1) > 1e-9 {
+		t.Errorf("today's prices should only cover traded slots: %+v", profile.Slots)
+	}
+}
+
+func TestWebContractInfo(t *testing.T) {
+	now := time.Date(2025, 8, 20, 10, 0, 0, 0, time.UTC)
+	for _, c := range []struct{ symbol, exchange, expiry string }{
+		{"jm2509", "DCE", "2025-09-12"}, // 合约月份第10个交易日
+		{"rb2510", "SHFE", "2025-10-15"},
+		{"ru2511", "SHFE", "2025-11-17"}, // 15日是周六，顺延到周一
+		{"sc2510", "INE", "2025-09-30"},  // 合约月份前一个月的最后一个交易日
+		{"MA601", "CZCE", "2026-01-14"},  // 三位代码取最近的年份
+		{"IF2509", "CFFEX", "2025-09-19"},
+		{"T2509", "CFFEX", "2025-09-12"},
+	} {
+		info, err := webLookupContract(context.Background(), c.symbol, now)
+		if err != nil {
+			t.Errorf("%s: %v", c.symbol, err)
+			continue
+		}
+		if info.Exchange != c.exchange || info.Expiry != c.expiry || !info.Estimated || info.Margin != nil {
+			t.Errorf("%s = %+v, want %s expiring %s", c.symbol, info, c.exchange, c.expiry)
+		}
+	}
+	if info, _ := webLookupContract(context.Background(), "jm2509", now); info.DaysToExpiry != 23 || !info.NearExpiry || info.Expired {
+		t.Errorf("jm2509 days to expiry = %+v", info)
+	}
+	if info, _ := webLookupContract(context.Background(), "jm2601", now); info.NearExpiry || info.Expired {
+		t.Errorf("jm2601 should not warn: %+v", info)
+	}
+	if info, _ := webLookupContract(context.Background(), "jm2505", now); !info.Expired || info.NearExpiry {
+		t.Errorf("jm2505 should be expired: %+v", info)
+	}
+	for _, symbol := range []string{"zz2509", "jm", "jm2513"} {
+		if _, err := webLookupContract(context.Background(), symbol, now); err == nil {
+			t.Errorf("%s: expected an error", symbol)
+		}
+	}
+
+	// 配置了日历表时以表中记录为准，保证金率也来自该表
+	newFakeClickHouse(t)
+	webCalendarTable = "contracts"
+	defer func() { webCalendarTable = "" }()
+	rec := httptest.NewRecorder()
+	webContractHandler(rec, httptest.NewRequest("GET", "/api/v1/contract?symbol=tst2509", nil))
+	var info webContractInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid response %s: %v", rec.Body.String(), err)
+	}
+	if info.Source != "calendar" || info.Exchange != "DCE" || info.ExchangeName != "大连商品交易所" || info.Expiry != "2025-09-12" ||
+		info.Estimated || info.Margin == nil || *info.Margin != 0.12 {
+		t.Errorf("calendar contract = %s", rec.Body.String())
+	}
+}
+
+func TestWebChartGolden(t *testing.T) {
+	newFakeClickHouse(t)
+
+	// 先加载测试数据集，再用同一个会话请求图表
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=tst&symbol=tst2509&range=all", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("no session cookie from /data: %s", rec.Body.String())
+	}
+
+	tests := []struct {
+		name, query, contentType string
+	}{
+		{"chart.png", "/chart", "image/png"},
+		{"chart.svg", "/chart?format=svg", "image/svg+xml"},
+		{"chart_fixed_range.png", "/chart?y_min=990&y_max=1020", "image/png"},
+		{"chart_padding.svg", "/chart?format=svg&padding=0.3", "image/svg+xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.query, nil)
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			rec := httptest.NewRecorder()
+			webChartHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			checkGolden(t, tt.name, rec.Body.Bytes())
+		})
+	}
+
+	rec = httptest.NewRecorder()
+	webChartHandler(rec, httptest.NewRequest("GET", "/chart?format=gif", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("format=gif: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestWebDownloadChartGolden(t *testing.T) {
+	newFakeClickHouse(t)
+	oldMaxRaw := webMaxRawPoints
+	webMaxRawPoints = 1000
+	defer func() { webMaxRawPoints = oldMaxRaw }()
+
+	const dataset = "/download/chart.png?table=tst&symbol=tst2509&range=all"
+	tests := []struct {
+		name, query, filename string
+	}{
+		{"download_mid_zoom.png", dataset + "&series=mid&from=2025-07-01+09:00:20&to=2025-07-01+09:01:20&y_min=990&y_max=1020&hide=oi&width=800&height=500",
+			"tst2509_mid_20250701_090020-20250701_090120.png"},
+		{"download_oi_only.png", dataset + "&raw=1&hide=price&width=800&height=500",
+			"tst2509_price_20250701_090000-20250701_090158.png"},
+		{"download_regimes.png", dataset + "&raw=1&regimes=1&vol_window=4&vol_low=0.9&vol_high=1.1&hide=oi&width=800&height=500",
+			"tst2509_price_20250701_090000-20250701_090158.png"},
+		{"download_vwap.png", dataset + "&raw=1&vwap=1&hide=oi&width=800&height=500",
+			"tst2509_price_20250701_090000-20250701_090158.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			webDownloadChartHandler(rec, httptest.NewRequest("GET", tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", ct)
+			}
+			if cd, want := rec.Header().Get("Content-Disposition"), `attachment; filename="`+tt.filename+`"`; cd != want {
+				t.Errorf("Content-Disposition = %q, want %q", cd, want)
+			}
+			checkGolden(t, tt.name, rec.Body.Bytes())
+		})
+	}
+
+	for _, query := range []string{"&series=vwap", "&hide=price,oi", "&hide=volume", "&width=10", "&from=bad", "&regimes=1&vol_window=1", "&regimes=1&vol_low=2&vol_high=1", "&vwap=1&vwap_k=-1"} {
+		rec := httptest.NewRecorder()
+		webDownloadChartHandler(rec, httptest.NewRequest("GET", dataset+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWebSparkline(t *testing.T) {
+	newFakeClickHouse(t)
+
+	rec := httptest.NewRecorder()
+	webSparklineHandler(rec, httptest.NewRequest("GET", "/sparkline.png?symbol=tst2509&range=all&w=160&h=40", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", ct)
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("invalid png: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 160 || b.Dy() != 40 {
+		t.Errorf("size = %dx%d, want 160x40", b.Dx(), b.Dy())
+	}
+	checkGolden(t, "sparkline.png", rec.Body.Bytes())
+
+	for _, query := range []string{"range=all", "symbol=tst2509&range=all&w=5", "symbol=tst2509&range=all&h=abc", "symbol=tst2509&range=bad"} {
+		rec := httptest.NewRecorder()
+		webSparklineHandler(rec, httptest.NewRequest("GET", "/sparkline.png?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// 基准测试数据：固定种子的随机游走tick，每秒两笔，按行数只生成一次
+var (
+	benchOnce      sync.Once
+	benchData      []WebMarketData
+	benchTSV       string
+	benchRowBinary string
+)
+
+func benchFixtures(b *testing.B) ([]WebMarketData, string, string) {
+	b.Helper()
+	benchOnce.Do(func() {
+		benchData = benchTicks(*benchRows)
+		benchTSV = benchEncodeTSV(benchData)
+		benchRowBinary = benchEncodeRowBinary(benchData)
+	})
+	return benchData, benchTSV, benchRowBinary
+}
+
+func benchTicks(n int) []WebMarketData {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	data := make([]WebMarketData, n)
+	price, vol, oi := 1200.0, uint32(0), uint32(52000)
+	for i := range data {
+		price += float64(rng.Intn(3)-1) * 0.5
+		diffVol := int32(rng.Intn(20))
+		diffOI := int32(rng.Intn(11) - 5)
+		vol += uint32(diffVol)
+		oi = uint32(int32(oi) + diffOI)
+		t := start.Add(time.Duration(i) * 500 * time.Millisecond)
+		data[i] = WebMarketData{
+			Symbol:       "jm2509",
+			Time:         t.Format("2006-01-02 15:04:05"),
+			Price:        float32(price),
+			Vol:          vol,
+			OpenInterest: oi,
+			DiffVol:      diffVol,
+			DiffOI:       diffOI,
+			Bid1:         float32(price - 0.5),
+			BidVolumn1:   uint32(rng.Intn(50) + 1),
+			Ask1:         float32(price),
+			AskVolumn1:   uint32(rng.Intn(50) + 1),
+			DateTime:     uint64(t.UnixMilli()),
+		}
+	}
+	return data
+}
+
+func benchEncodeTSV(data []WebMarketData) string {
+	var sb strings.Builder
+	for _, md := range data {
+		fmt.Fprintf(&sb, "%s\t%s\t%g\t%d\t%d\t%d\t%d\t%g\t%d\t%g\t%d\t%d\n",
+			md.Symbol, md.Time, md.Price, md.Vol, md.OpenInterest, md.DiffVol, md.DiffOI,
+			md.Bid1, md.BidVolumn1, md.Ask1, md.AskVolumn1, md.DateTime)
+	}
+	return sb.String()
+}
+
+// 按 RowBinaryWithNamesAndTypes 编码，列类型与 feature.jm 表一致
+func benchEncodeRowBinary(data []WebMarketData) string {
+	names := []string{"symbol", "time", "price", "vol", "open_interest", "diff_vol", "diff_oi",
+		"bid_1", "bid_volumn_1", "ask_1", "ask_volumn_1", "datetime"}
+	types := []string{"String", "DateTime", "Float32", "UInt32", "UInt32", "Int32", "Int32",
+		"Float32", "UInt32", "Float32", "UInt32", "UInt64"}
+
+	var buf []byte
+	str := func(s string) {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		str(name)
+	}
+	for _, typ := range types {
+		str(typ)
+	}
+	for _, md := range data {
+		t, _ := time.ParseInLocation("2006-01-02 15:04:05", md.Time, time.UTC)
+		str(md.Symbol)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(t.Unix()))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(md.Price))
+		buf = binary.LittleEndian.AppendUint32(buf, md.Vol)
+		buf = binary.LittleEndian.AppendUint32(buf, md.OpenInterest)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(md.DiffVol))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(md.DiffOI))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(md.Bid1))
+		buf = binary.LittleEndian.AppendUint32(buf, md.BidVolumn1)
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(md.Ask1))
+		buf = binary.LittleEndian.AppendUint32(buf, md.AskVolumn1)
+		buf = binary.LittleEndian.AppendUint64(buf, md.DateTime)
+	}
+	return string(buf)
+}
+
+func BenchmarkWebParseTabSeparated(b *testing.B) {
+	_, tsv, _ := benchFixtures(b)
+	b.SetBytes(int64(len(tsv)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := webParseTabSeparatedData(tsv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWebParseRowBinary(b *testing.B) {
+	_, _, rowBinary := benchFixtures(b)
+	// RowBinary的DateTime按服务器时区还原，先用假服务确定时区，避免计时中访问真实的ClickHouse
+	newFakeClickHouse(b)
+	webServerLocation()
+	b.SetBytes(int64(len(rowBinary)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := webParseRowBinaryData(rowBinary); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 行转列：/export.arrow 把行数据转换为Arrow列式缓冲区
+func BenchmarkWebArrowRecordBatch(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		webArrowRecordBatch(data)
+	}
+}
+
+// 等步长采样，分别对应默认视图、对比路径和缩放窗口的点数
+func BenchmarkWebSampleData(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	for _, size := range []int{WEB_SAMPLE_SIZE, COMPARE_PATH_POINTS, WEB_ZOOM_POINTS} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				webSampleData(data, size)
+			}
+		})
+	}
+}
+
+func BenchmarkWebBuildPyramid(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		webBuildPyramid(data)
+	}
+}
+
+// 缩放窗口取中间10%的数据，从金字塔中选层级后采样
+func BenchmarkWebZoomWindow(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	pyramid := webBuildPyramid(data)
+	from, to := data[len(data)*45/100].Time, data[len(data)*55/100].Time
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		webZoomWindow(data, pyramid, from, to, WEB_ZOOM_POINTS, webDefaultDownsampling())
+	}
+}
+
+func BenchmarkWebComputeWindowStats(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		webComputeWindowStats(data)
+	}
+}
+
+// /data 的统计量：按tick换算价格后求均值和最值
+func BenchmarkWebDataStats(b *testing.B) {
+	data, _, _ := benchFixtures(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prices := make([]float64, len(data))
+		for j, record := range data {
+			prices[j] = webPriceValue(record.Price, record.Symbol)
+		}
+		webCalculateAverage(prices)
+		webFindMax(prices)
+		webFindMin(prices)
+	}
+}
+
+func TestWebDemoTicks(t *testing.T) {
+	from := webDemoStart.Add(time.Hour)
+	to := from.Add(10 * time.Minute)
+	data := webDemoTicks("jm2509", from, to)
+	if want := int(10 * time.Minute / DEMO_TICK_INTERVAL); len(data) != want {
+		t.Fatalf("got %d ticks, want %d", len(data), want)
+	}
+	if data[0].Time != from.Format("2006-01-02 15:04:05") {
+		t.Errorf("first tick at %s, want %s", data[0].Time, from.Format("2006-01-02 15:04:05"))
+	}
+
+	// 同一合约的序列与查询范围无关，不同合约的序列不同
+	wider := webDemoTicks("jm2509", from.Add(-time.Hour), to)
+	if got := wider[len(wider)-len(data):]; got[0] != data[0] || got[len(got)-1] != data[len(data)-1] {
+		t.Errorf("ticks depend on the requested range: %+v vs %+v", got[0], data[0])
+	}
+	if other := webDemoTicks("i2509", from, to); other[0].Price == data[0].Price && other[0].OpenInterest == data[0].OpenInterest {
+		t.Errorf("different symbols produced the same series: %+v", other[0])
+	}
+
+	tick := webTickSizeFor("jm2509")
+	vol := data[0].Vol - uint32(data[0].DiffVol)
+	for i, md := range data {
+		if md.Price <= 0 || md.Bid1 >= md.Ask1 || (md.Price != md.Bid1 && md.Price != md.Ask1) {
+			t.Fatalf("tick %d: invalid book %+v", i, md)
+		}
+		if ticks := float64(md.Price) / tick; math.Abs(ticks-math.Round(ticks)) > 1e-6 {
+			t.Fatalf("tick %d: price %v is not a multiple of %v", i, md.Price, tick)
+		}
+		vol += uint32(md.DiffVol)
+		if md.Vol != vol {
+			t.Fatalf("tick %d: vol %d is not the running sum of diff_vol (%d)", i, md.Vol, vol)
+		}
+	}
+}
+
+func TestWebDemoFeedTicks(t *testing.T) {
+	snapshot, err := webDemoFeedTicks("jm2509", "", 0)
+	if err != nil || len(snapshot) == 0 {
+		t.Fatalf("snapshot: %d ticks, err %v", len(snapshot), err)
+	}
+	last := snapshot[len(snapshot)-10]
+	ticks, err := webDemoFeedTicks("jm2509", last.Time, last.DateTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ticks) < 9 || ticks[0] != snapshot[len(snapshot)-9] {
+		t.Errorf("ticks after %s: got %d ticks starting %+v", last.Time, len(ticks), ticks)
+	}
+}
+
+func TestWebLoadDefaultDatasetUnavailable(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	oldURL := webClickHouseURL
+	webClickHouseURL = down.URL
+	resetCatalog()
+	defer func() { webClickHouseURL = oldURL }()
+
+	// 启动加载失败只返回错误，由调用方记录后继续提供服务
+	err := webLoadDefaultDataset()
+	if err == nil || !strings.Contains(err.Error(), "failed to connect to ClickHouse") {
+		t.Fatalf("webLoadDefaultDataset() error = %v, want a connection error", err)
+	}
+
+	// 页面请求数据时返回JSON错误，由横幅显示并提供重试
+	rec := httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data?table=down&symbol=down2509", nil))
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rec.Body.String(), err)
+	}
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "Connection refused") {
+		t.Errorf("error = %q, want the ClickHouse error", msg)
+	}
+}
+
+func TestWebParseErrors(t *testing.T) {
+	webResetParseErrors()
+	t.Cleanup(webResetParseErrors)
+
+	const good = "tst2509\t2025-07-01 09:00:00\t1000\t1\t100\t0\t0\t999\t1\t1001\t1\t0"
+	data, err := webParseTabSeparatedData(strings.Join([]string{
+		good,
+		"tst2509\tnot a time\t1000\t1\t100\t0\t0\t999\t1\t1001\t1\t0",
+		"tst2509\t2025-07-01 09:00:02\tabc\t1\t100\t0\t0\t999\t1\t1001\t1\t0",
+		"tst2509\t2025-07-01 09:00:04\txyz\t1\t100\t0\t0\t999\t1\t1001\t1\t0",
+		"tst2509\t2025-07-01 09:00:06",
+		good,
+	}, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 {
+		t.Fatalf("got %d rows, want 2", len(data))
+	}
+
+	rec := httptest.NewRecorder()
+	webParseErrorsHandler(rec, httptest.NewRequest("GET", "/api/v1/parse-errors", nil))
+	var resp struct {
+		SkippedRows int                  `json:"skipped_rows"`
+		ByType      []webParseErrorEntry `json:"by_type"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rec.Body.String(), err)
+	}
+	if resp.SkippedRows != 4 {
+		t.Errorf("skipped_rows = %d, want 4", resp.SkippedRows)
+	}
+	var got []string
+	for _, entry := range resp.ByType {
+		got = append(got, fmt.Sprintf("%s=%d", entry.Type, entry.Count))
+	}
+	if want := "bad_price=2 bad_time=1 short_row=1"; strings.Join(got, " ") != want {
+		t.Errorf("by_type = %v, want %s", got, want)
+	}
+	if resp.ByType[0].Sample == "" || resp.ByType[0].Description == "" {
+		t.Errorf("entry %+v is missing the sample row or description", resp.ByType[0])
+	}
+
+	// /data 的统计信息中附带跳过行数，页面据此显示提示
+	webSetLoadedData(webDefaultKey, data, webProfileGeneration.Load())
+	rec = httptest.NewRecorder()
+	webDataHandler(rec, httptest.NewRequest("GET", "/data", nil))
+	var dataResp struct {
+		Stats map[string]interface{} `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dataResp); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rec.Body.String(), err)
+	}
+	if dataResp.Stats["skipped_rows"] != 4.0 {
+		t.Errorf("stats.skipped_rows = %v, want 4", dataResp.Stats["skipped_rows"])
+	}
+
+	rec = httptest.NewRecorder()
+	webParseErrorsHandler(rec, httptest.NewRequest("DELETE", "/api/v1/parse-errors", nil))
+	if _, total := webParseErrorSummary(); total != 0 {
+		t.Errorf("after DELETE total = %d, want 0", total)
+	}
+}